@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Admin roles. Operators can do everything read-only admins can.
+const (
+	RoleReadOnly = "read_only"
+	RoleOperator = "operator"
+)
+
+const (
+	// sessionLifetime is how long a login session is valid
+	sessionLifetime = 12 * time.Hour
+	// lockoutWindow and maxAuthFailures bound brute-force attempts: a user or
+	// source IP with maxAuthFailures failures in one window is locked out
+	// until the window ends
+	lockoutWindow   = 15 * time.Minute
+	maxAuthFailures = 5
+	// minPasswordLength applies to admin passwords
+	minPasswordLength = 12
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,64}$`)
+
+// dummyPasswordHash is compared against when a login names a missing or
+// disabled user, so it takes as long as a wrong password and the response time
+// does not reveal which usernames exist. No password matches it.
+var dummyPasswordHash = []byte("$2a$10$7LDGzv0F3J2upwPvWWoNQOOl9J8PD91iPQnaPWvceFF8AYYj.sx3m")
+
+// AdminUser is a backoffice user
+type AdminUser struct {
+	Username     string    `json:"username" dynamodbav:"username"`
+	PasswordHash string    `json:"-" dynamodbav:"password_hash"`
+	Role         string    `json:"role" dynamodbav:"role"`
+	Status       string    `json:"status" dynamodbav:"status"` // active or disabled
+	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
+	CreatedBy    string    `json:"created_by,omitempty" dynamodbav:"created_by,omitempty"`
+	LastLoginAt  time.Time `json:"last_login_at,omitempty" dynamodbav:"last_login_at,omitempty"`
+}
+
+// adminSession is a login session; only a hash of its token is stored
+type adminSession struct {
+	TokenHash string    `dynamodbav:"token_hash"`
+	Username  string    `dynamodbav:"username"`
+	Role      string    `dynamodbav:"role"`
+	SourceIP  string    `dynamodbav:"source_ip,omitempty"`
+	CreatedAt time.Time `dynamodbav:"created_at"`
+	ExpiresAt time.Time `dynamodbav:"expires_at"`
+	TTL       int64     `dynamodbav:"ttl"`
+}
+
+// adminIdentity is who a request is authenticated as
+type adminIdentity struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type identityKey struct{}
+
+// identity returns the admin a request was authenticated as
+func identity(r *http.Request) (adminIdentity, bool) {
+	id, ok := r.Context().Value(identityKey{}).(adminIdentity)
+	return id, ok
+}
+
+// hasRole reports whether role grants required
+func hasRole(role, required string) bool {
+	return role == RoleOperator || role == required
+}
+
+// sourceIP is the caller's address; the Lambda adapter sets RemoteAddr to
+// the API Gateway source IP
+func sourceIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// hashToken returns the stored form of a session token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequireRole authenticates requests by session token and rejects callers
+// without role. Invalid credentials count towards the source IP's lockout.
+// Only with AuthDisabled (ADMIN_AUTH_DISABLED=true, local development) is
+// every request let through.
+func (h *Handler) RequireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if h.cfg.AuthDisabled {
+				next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, adminIdentity{Username: "dev", Role: RoleOperator})))
+				return
+			}
+
+			ctx := r.Context()
+			ip := sourceIP(r)
+			if until, locked := h.lockedOut(ctx, "ip:"+ip); locked {
+				writeLockedOut(w, until)
+				return
+			}
+
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			id, err := h.authenticate(ctx, token)
+			if err != nil && h.bootstrapping(ctx, r, token) {
+				id, err = adminIdentity{Username: "bootstrap", Role: RoleOperator}, nil
+			}
+			if err != nil {
+				h.recordAuthFailure(ctx, "ip:"+ip)
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			if !hasRole(id.Role, role) {
+				writeError(w, http.StatusForbidden, "requires the "+role+" role")
+				return
+			}
+			next(w, r.WithContext(context.WithValue(ctx, identityKey{}, id)))
+		}
+	}
+}
+
+// bootstrapping reports whether r creates the first backoffice user with the
+// ADMIN_API_KEY. The key is good for nothing else, and for nothing at all
+// once a user exists.
+func (h *Handler) bootstrapping(ctx context.Context, r *http.Request, token string) bool {
+	if h.cfg.AdminAPIKey == "" || token == "" || r.Method != http.MethodPost || r.URL.Path != "/api/admin-users" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminAPIKey)) != 1 {
+		return false
+	}
+	out, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
+		TableName:            aws.String(h.tableName("admin-users")),
+		ProjectionExpression: aws.String("username"),
+		Limit:                aws.Int32(1),
+	})
+	return err == nil && len(out.Items) == 0 && len(out.LastEvaluatedKey) == 0
+}
+
+// authenticate resolves a bearer token to an admin's session
+func (h *Handler) authenticate(ctx context.Context, token string) (adminIdentity, error) {
+	if token == "" {
+		return adminIdentity{}, errors.New("no token")
+	}
+
+	out, err := h.ddbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName("admin-sessions")),
+		Key: map[string]types.AttributeValue{
+			"token_hash": &types.AttributeValueMemberS{Value: hashToken(token)},
+		},
+	})
+	if err != nil {
+		return adminIdentity{}, err
+	}
+	if out.Item == nil {
+		return adminIdentity{}, errors.New("unknown session")
+	}
+	var session adminSession
+	if err := attributevalue.UnmarshalMap(out.Item, &session); err != nil {
+		return adminIdentity{}, err
+	}
+	// TTL deletion lags, so expiry is checked here too
+	if time.Now().After(session.ExpiresAt) {
+		return adminIdentity{}, errors.New("session expired")
+	}
+	return adminIdentity{Username: session.Username, Role: session.Role}, nil
+}
+
+// lockoutKey is the lockout counter of key for the current window
+func lockoutKey(key string, now time.Time) (string, time.Time) {
+	window := now.Unix() / int64(lockoutWindow.Seconds())
+	end := time.Unix((window+1)*int64(lockoutWindow.Seconds()), 0)
+	return key + "#" + strconv.FormatInt(window, 10), end
+}
+
+// lockedOut reports whether key (a user: or ip: name) has reached
+// maxAuthFailures in the current window, and until when. Lookup errors don't
+// lock anyone out.
+func (h *Handler) lockedOut(ctx context.Context, key string) (time.Time, bool) {
+	id, end := lockoutKey(key, time.Now())
+	out, err := h.ddbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName("admin-lockouts")),
+		Key: map[string]types.AttributeValue{
+			"lockout_key": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil || out.Item == nil {
+		return time.Time{}, false
+	}
+	var counter struct {
+		Failures int `dynamodbav:"failures"`
+	}
+	if err := attributevalue.UnmarshalMap(out.Item, &counter); err != nil {
+		return time.Time{}, false
+	}
+	return end, counter.Failures >= maxAuthFailures
+}
+
+// recordAuthFailure counts a failed attempt against key in the current window
+func (h *Handler) recordAuthFailure(ctx context.Context, key string) {
+	id, end := lockoutKey(key, time.Now())
+	_, _ = h.ddbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(h.tableName("admin-lockouts")),
+		Key: map[string]types.AttributeValue{
+			"lockout_key": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("ADD failures :one SET #ttl = :ttl"),
+		ExpressionAttributeNames: map[string]string{
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":ttl": &types.AttributeValueMemberN{Value: strconv.FormatInt(end.Add(lockoutWindow).Unix(), 10)},
+		},
+	})
+}
+
+func writeLockedOut(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	writeError(w, http.StatusTooManyRequests, "too many failed attempts; try again after "+until.UTC().Format(time.RFC3339))
+}
+
+// LoginRequest is the body of POST /api/auth/login
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Login checks an admin's password and starts a session. Failures count
+// towards lockouts of both the username and the source IP; the response does
+// not reveal which part was wrong.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	username := strings.ToLower(strings.TrimSpace(req.Username))
+
+	ctx := context.Background()
+	ip := sourceIP(r)
+	for _, key := range []string{"ip:" + ip, "user:" + username} {
+		if until, locked := h.lockedOut(ctx, key); locked {
+			writeLockedOut(w, until)
+			return
+		}
+	}
+
+	user, err := h.getAdminUser(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to look up user: "+err.Error())
+		return
+	}
+	passwordHash := dummyPasswordHash
+	if user != nil && user.Status == "active" {
+		passwordHash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(req.Password)) != nil ||
+		user == nil || user.Status != "active" {
+		h.recordAuthFailure(ctx, "ip:"+ip)
+		h.recordAuthFailure(ctx, "user:"+username)
+		writeError(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate session token")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	session := adminSession{
+		TokenHash: hashToken(token),
+		Username:  user.Username,
+		Role:      user.Role,
+		SourceIP:  ip,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionLifetime),
+		TTL:       now.Add(sessionLifetime).Unix(),
+	}
+	item, err := attributevalue.MarshalMap(session)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to marshal session")
+		return
+	}
+	if _, err := h.ddbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(h.tableName("admin-sessions")),
+		Item:      item,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save session: "+err.Error())
+		return
+	}
+
+	lastLogin, _ := attributevalue.Marshal(now)
+	_, _ = h.ddbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName("admin-users")),
+		Key:                       adminUserKey(user.Username),
+		UpdateExpression:          aws.String("SET last_login_at = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":now": lastLogin},
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"username":   user.Username,
+		"role":       user.Role,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+// Logout ends the caller's session
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" {
+		_, err := h.ddbClient.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(h.tableName("admin-sessions")),
+			Key: map[string]types.AttributeValue{
+				"token_hash": &types.AttributeValueMemberS{Value: hashToken(token)},
+			},
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to end session: "+err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"logged_out": true})
+}
+
+// GetMe returns who the caller is authenticated as
+func (h *Handler) GetMe(w http.ResponseWriter, r *http.Request) {
+	id, _ := identity(r)
+	writeJSON(w, http.StatusOK, id)
+}
+
+func adminUserKey(username string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"username": &types.AttributeValueMemberS{Value: username},
+	}
+}
+
+// getAdminUser returns the named admin, or nil if there is none
+func (h *Handler) getAdminUser(ctx context.Context, username string) (*AdminUser, error) {
+	out, err := h.ddbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName("admin-users")),
+		Key:       adminUserKey(username),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	var user AdminUser
+	if err := attributevalue.UnmarshalMap(out.Item, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListAdminUsers returns the backoffice users (without password hashes)
+func (h *Handler) ListAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users := []AdminUser{}
+	err := h.scanPages(context.Background(), &dynamodb.ScanInput{
+		TableName: aws.String(h.tableName("admin-users")),
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var u AdminUser
+			if err := attributevalue.UnmarshalMap(item, &u); err == nil {
+				users = append(users, u)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list admin users: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users": users,
+		"count": len(users),
+	})
+}
+
+// AdminUserRequest is the body of POST /api/admin-users and PATCH
+// /api/admin-users/{username}; PATCH leaves empty fields unchanged
+type AdminUserRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+func validateAdminUser(req AdminUserRequest) error {
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if req.Role != "" && req.Role != RoleReadOnly && req.Role != RoleOperator {
+		return errors.New("role must be read_only or operator")
+	}
+	if req.Status != "" && req.Status != "active" && req.Status != "disabled" {
+		return errors.New("status must be active or disabled")
+	}
+	return nil
+}
+
+// CreateAdminUser adds a backoffice user
+func (h *Handler) CreateAdminUser(w http.ResponseWriter, r *http.Request) {
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if !usernamePattern.MatchString(req.Username) {
+		writeError(w, http.StatusBadRequest, "username must be 3-64 of a-z, 0-9 and ._-")
+		return
+	}
+	if req.Password == "" || req.Role == "" {
+		writeError(w, http.StatusBadRequest, "password and role are required")
+		return
+	}
+	if err := validateAdminUser(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+	creator, _ := identity(r)
+	user := AdminUser{
+		Username:     req.Username,
+		PasswordHash: string(hash),
+		Role:         req.Role,
+		Status:       "active",
+		CreatedAt:    time.Now(),
+		CreatedBy:    creator.Username,
+	}
+	item, err := attributevalue.MarshalMap(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to marshal user")
+		return
+	}
+	_, err = h.ddbClient.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName:           aws.String(h.tableName("admin-users")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(username)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			writeError(w, http.StatusConflict, "user already exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to save user: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// UpdateAdminUser changes a user's password, role or status. Sessions of the
+// user are ended so the change applies immediately.
+func (h *Handler) UpdateAdminUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Password == "" && req.Role == "" && req.Status == "" {
+		writeError(w, http.StatusBadRequest, "nothing to update; set password, role or status")
+		return
+	}
+	if err := validateAdminUser(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	expr := newExpression()
+	var sets []string
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to hash password")
+			return
+		}
+		sets = append(sets, expr.name("password_hash")+" = "+expr.value(&types.AttributeValueMemberS{Value: string(hash)}))
+	}
+	if req.Role != "" {
+		sets = append(sets, expr.name("role")+" = "+expr.value(&types.AttributeValueMemberS{Value: req.Role}))
+	}
+	if req.Status != "" {
+		sets = append(sets, expr.name("status")+" = "+expr.value(&types.AttributeValueMemberS{Value: req.Status}))
+	}
+
+	ctx := context.Background()
+	out, err := h.ddbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName("admin-users")),
+		Key:                       adminUserKey(username),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:       aws.String("attribute_exists(" + expr.name("username") + ")"),
+		ExpressionAttributeNames:  expr.attributeNames(),
+		ExpressionAttributeValues: expr.attributeValues(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			writeError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to update user: "+err.Error())
+		return
+	}
+
+	ended, err := h.endSessions(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "updated, but failed to end sessions: "+err.Error())
+		return
+	}
+
+	var user AdminUser
+	if err := attributevalue.UnmarshalMap(out.Attributes, &user); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to unmarshal user")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":           user,
+		"sessions_ended": ended,
+	})
+}
+
+// endSessions deletes every session of username
+func (h *Handler) endSessions(ctx context.Context, username string) (int, error) {
+	table := h.tableName("admin-sessions")
+	var hashes []string
+	err := h.scanPages(ctx, &dynamodb.ScanInput{
+		TableName:                 aws.String(table),
+		ProjectionExpression:      aws.String("token_hash"),
+		FilterExpression:          aws.String("username = :username"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":username": &types.AttributeValueMemberS{Value: username}},
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			if v, ok := item["token_hash"].(*types.AttributeValueMemberS); ok {
+				hashes = append(hashes, v.Value)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hash := range hashes {
+		if _, err := h.ddbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"token_hash": &types.AttributeValueMemberS{Value: hash},
+			},
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), nil
+}
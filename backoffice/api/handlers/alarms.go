@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alarm kinds the backoffice can create
+const (
+	AlarmLambdaErrors      = "lambda_errors"       // Error rate (%) of one Lambda; target is its suffix, e.g. http-proxy
+	AlarmProxy5xx          = "proxy_5xx"           // 5xx rate (%) of the tunnel REST API, which fronts http-proxy
+	AlarmZeroActiveTunnels = "zero_active_tunnels" // No active tunnels; reported every minute by reap-stale-tunnels
+	AlarmDynamoDBThrottled = "dynamodb_throttling" // Throttled reads and writes of one table; target is its suffix, e.g. tunnels
+)
+
+// alarmPeriod is the evaluation period of every alarm, in seconds
+const alarmPeriod = 300
+
+var (
+	snsTopicARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:sns:[a-z0-9-]+:\d{12}:[A-Za-z0-9_-]{1,256}$`)
+	// alarmTargetPattern limits alarm targets to Lambda and table suffixes
+	alarmTargetPattern = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+)
+
+// defaultAlarms is the recommended set POST /api/alarms/defaults installs
+var defaultAlarms = []AlarmRequest{
+	{Kind: AlarmLambdaErrors, Target: "http-proxy"},
+	{Kind: AlarmLambdaErrors, Target: "tunnel-proxy"},
+	{Kind: AlarmLambdaErrors, Target: "tunnel-connect"},
+	{Kind: AlarmLambdaErrors, Target: "create-tunnel"},
+	{Kind: AlarmProxy5xx},
+	{Kind: AlarmZeroActiveTunnels},
+	{Kind: AlarmDynamoDBThrottled, Target: "tunnels"},
+	{Kind: AlarmDynamoDBThrottled, Target: "domains"},
+	{Kind: AlarmDynamoDBThrottled, Target: "pending-requests"},
+}
+
+// AlarmDestination is where an alarm notifies. email subscribes the address
+// to the project alerts topic (the recipient must confirm it); sns and slack
+// name a topic directly, slack being one an AWS Chatbot Slack channel
+// configuration subscribes to. Without a destination the alerts topic is used.
+type AlarmDestination struct {
+	Type     string `json:"type"` // email, sns or slack
+	Address  string `json:"address,omitempty"`
+	TopicARN string `json:"topic_arn,omitempty"`
+}
+
+// AlarmRequest is the body of POST /api/alarms
+type AlarmRequest struct {
+	Kind        string            `json:"kind"`
+	Target      string            `json:"target,omitempty"`
+	Threshold   *float64          `json:"threshold,omitempty"`
+	Destination *AlarmDestination `json:"destination,omitempty"`
+}
+
+// AlarmInfo is a backoffice-managed CloudWatch alarm
+type AlarmInfo struct {
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	State        string    `json:"state"` // OK, ALARM or INSUFFICIENT_DATA
+	StateReason  string    `json:"state_reason"`
+	StateUpdated time.Time `json:"state_updated"`
+	Threshold    float64   `json:"threshold"`
+	Comparison   string    `json:"comparison"`
+	Actions      []string  `json:"actions"`
+}
+
+// alarmSpec is the CloudWatch definition of one alarm
+type alarmSpec struct {
+	name        string
+	description string
+	metrics     []metricQuery
+	expression  string // Metric math over the metrics' IDs; "" alarms on the only metric
+	comparison  string
+	threshold   float64
+	evaluations int
+	missingData string // How periods without data count
+}
+
+// alarmPrefix starts the name of every alarm the backoffice manages
+func (h *Handler) alarmPrefix() string {
+	return h.cfg.ProjectName + "-" + h.cfg.Environment + "-backoffice-"
+}
+
+// alarmSpec builds the alarm for req, validating its kind and target
+func (h *Handler) alarmSpec(req AlarmRequest) (alarmSpec, error) {
+	threshold := func(fallback float64) float64 {
+		if req.Threshold != nil {
+			return *req.Threshold
+		}
+		return fallback
+	}
+	name := h.alarmPrefix() + strings.ReplaceAll(req.Kind, "_", "-")
+	if req.Target != "" {
+		if !alarmTargetPattern.MatchString(req.Target) {
+			return alarmSpec{}, fmt.Errorf("invalid target %q", req.Target)
+		}
+		name += "-" + req.Target
+	}
+
+	switch req.Kind {
+	case AlarmLambdaErrors:
+		if req.Target == "" {
+			return alarmSpec{}, fmt.Errorf("%s needs the Lambda as target, e.g. http-proxy", req.Kind)
+		}
+		dims := map[string]string{"FunctionName": h.lambdaName(req.Target)}
+		return alarmSpec{
+			name:        name,
+			description: "Error rate of " + h.lambdaName(req.Target) + " in percent",
+			metrics: []metricQuery{
+				{ID: "errors", Namespace: "AWS/Lambda", Metric: "Errors", Dimensions: dims, Stat: "Sum"},
+				{ID: "invocations", Namespace: "AWS/Lambda", Metric: "Invocations", Dimensions: dims, Stat: "Sum"},
+			},
+			expression:  "100 * errors / invocations",
+			comparison:  "GreaterThanThreshold",
+			threshold:   threshold(5),
+			evaluations: 1,
+			missingData: "notBreaching",
+		}, nil
+
+	case AlarmProxy5xx:
+		if h.cfg.RestAPIID == "" {
+			return alarmSpec{}, fmt.Errorf("%s needs REST_API_ID", req.Kind)
+		}
+		dims := map[string]string{"ApiId": h.cfg.RestAPIID}
+		return alarmSpec{
+			name:        name,
+			description: "5xx rate of the tunnel REST API in percent",
+			metrics: []metricQuery{
+				{ID: "http_5xx", Namespace: "AWS/ApiGateway", Metric: "5xx", Dimensions: dims, Stat: "Sum"},
+				{ID: "requests", Namespace: "AWS/ApiGateway", Metric: "Count", Dimensions: dims, Stat: "Sum"},
+			},
+			expression:  "100 * http_5xx / requests",
+			comparison:  "GreaterThanThreshold",
+			threshold:   threshold(5),
+			evaluations: 1,
+			missingData: "notBreaching",
+		}, nil
+
+	case AlarmZeroActiveTunnels:
+		return alarmSpec{
+			name:        name,
+			description: "No active tunnels for 15 minutes, or reap-stale-tunnels stopped reporting",
+			metrics: []metricQuery{
+				{ID: "active", Namespace: "Tunnel", Metric: "ActiveTunnels", Dimensions: map[string]string{"FunctionName": h.lambdaName("reap-stale-tunnels")}, Stat: "Maximum"},
+			},
+			comparison:  "LessThanOrEqualToThreshold",
+			threshold:   threshold(0),
+			evaluations: 3,
+			missingData: "breaching",
+		}, nil
+
+	case AlarmDynamoDBThrottled:
+		if req.Target == "" {
+			return alarmSpec{}, fmt.Errorf("%s needs the table as target, e.g. tunnels", req.Kind)
+		}
+		dims := map[string]string{"TableName": h.tableName(req.Target)}
+		return alarmSpec{
+			name:        name,
+			description: "Throttled requests on " + h.tableName(req.Target),
+			metrics: []metricQuery{
+				{ID: "reads", Namespace: "AWS/DynamoDB", Metric: "ReadThrottleEvents", Dimensions: dims, Stat: "Sum"},
+				{ID: "writes", Namespace: "AWS/DynamoDB", Metric: "WriteThrottleEvents", Dimensions: dims, Stat: "Sum"},
+			},
+			expression:  "reads + writes",
+			comparison:  "GreaterThanOrEqualToThreshold",
+			threshold:   threshold(1),
+			evaluations: 1,
+			missingData: "notBreaching",
+		}, nil
+	}
+	return alarmSpec{}, fmt.Errorf("kind must be one of %s, %s, %s, %s", AlarmLambdaErrors, AlarmProxy5xx, AlarmZeroActiveTunnels, AlarmDynamoDBThrottled)
+}
+
+// destinationTopic resolves d to the SNS topic alarms notify, subscribing an
+// email address to the alerts topic when needed
+func (h *Handler) destinationTopic(ctx context.Context, d *AlarmDestination) (string, error) {
+	if d == nil || d.Type == "" {
+		if h.cfg.AlertsTopicARN == "" {
+			return "", fmt.Errorf("no destination given and ALERTS_TOPIC_ARN is not configured")
+		}
+		return h.cfg.AlertsTopicARN, nil
+	}
+
+	switch d.Type {
+	case "email":
+		if h.cfg.AlertsTopicARN == "" {
+			return "", fmt.Errorf("email destinations need ALERTS_TOPIC_ARN")
+		}
+		if !strings.Contains(d.Address, "@") {
+			return "", fmt.Errorf("email destination needs an address")
+		}
+		form := url.Values{}
+		form.Set("Action", "Subscribe")
+		form.Set("Version", "2010-03-31")
+		form.Set("TopicArn", h.cfg.AlertsTopicARN)
+		form.Set("Protocol", "email")
+		form.Set("Endpoint", d.Address)
+		var out struct{}
+		if err := h.callQueryAPI(ctx, "sns", form, &out); err != nil {
+			return "", fmt.Errorf("failed to subscribe %s: %w", d.Address, err)
+		}
+		return h.cfg.AlertsTopicARN, nil
+
+	case "sns", "slack":
+		if !snsTopicARNPattern.MatchString(d.TopicARN) {
+			return "", fmt.Errorf("%s destination needs an SNS topic_arn", d.Type)
+		}
+		return d.TopicARN, nil
+	}
+	return "", fmt.Errorf("destination type must be email, sns or slack")
+}
+
+// putAlarm creates or replaces the alarm, notifying topic on ALARM and OK
+func (h *Handler) putAlarm(ctx context.Context, spec alarmSpec, topic string) error {
+	form := url.Values{}
+	form.Set("Action", "PutMetricAlarm")
+	form.Set("Version", "2010-08-01")
+	form.Set("AlarmName", spec.name)
+	form.Set("AlarmDescription", spec.description)
+	form.Set("ActionsEnabled", "true")
+	form.Set("AlarmActions.member.1", topic)
+	form.Set("OKActions.member.1", topic)
+	form.Set("ComparisonOperator", spec.comparison)
+	form.Set("Threshold", strconv.FormatFloat(spec.threshold, 'f', -1, 64))
+	form.Set("EvaluationPeriods", strconv.Itoa(spec.evaluations))
+	form.Set("DatapointsToAlarm", strconv.Itoa(spec.evaluations))
+	form.Set("TreatMissingData", spec.missingData)
+	form.Set("Tags.member.1.Key", "ManagedBy")
+	form.Set("Tags.member.1.Value", "backoffice")
+
+	for i, m := range spec.metrics {
+		prefix := fmt.Sprintf("Metrics.member.%d.", i+1)
+		setMetricStat(form, prefix, m, alarmPeriod)
+		form.Set(prefix+"ReturnData", strconv.FormatBool(spec.expression == ""))
+	}
+	if spec.expression != "" {
+		prefix := fmt.Sprintf("Metrics.member.%d.", len(spec.metrics)+1)
+		form.Set(prefix+"Id", "result")
+		form.Set(prefix+"Expression", spec.expression)
+		form.Set(prefix+"Label", spec.description)
+		form.Set(prefix+"ReturnData", "true")
+	}
+
+	var out struct{}
+	return h.callCloudWatch(ctx, form, &out)
+}
+
+// ListAlarms returns the alarms the backoffice manages with their state
+func (h *Handler) ListAlarms(w http.ResponseWriter, r *http.Request) {
+	form := url.Values{}
+	form.Set("Action", "DescribeAlarms")
+	form.Set("Version", "2010-08-01")
+	form.Set("AlarmNamePrefix", h.alarmPrefix())
+	form.Set("AlarmTypes.member.1", "MetricAlarm")
+
+	alarms := []AlarmInfo{}
+	ctx := context.Background()
+	for {
+		var page struct {
+			Alarms []struct {
+				Name         string   `xml:"AlarmName"`
+				Description  string   `xml:"AlarmDescription"`
+				State        string   `xml:"StateValue"`
+				StateReason  string   `xml:"StateReason"`
+				StateUpdated string   `xml:"StateUpdatedTimestamp"`
+				Threshold    float64  `xml:"Threshold"`
+				Comparison   string   `xml:"ComparisonOperator"`
+				Actions      []string `xml:"AlarmActions>member"`
+			} `xml:"DescribeAlarmsResult>MetricAlarms>member"`
+			NextToken string `xml:"DescribeAlarmsResult>NextToken"`
+		}
+		if err := h.callCloudWatch(ctx, form, &page); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to describe alarms: "+err.Error())
+			return
+		}
+		for _, a := range page.Alarms {
+			updated, _ := time.Parse(time.RFC3339, a.StateUpdated)
+			alarms = append(alarms, AlarmInfo{
+				Name:         a.Name,
+				Description:  a.Description,
+				State:        a.State,
+				StateReason:  a.StateReason,
+				StateUpdated: updated,
+				Threshold:    a.Threshold,
+				Comparison:   a.Comparison,
+				Actions:      a.Actions,
+			})
+		}
+		if page.NextToken == "" {
+			break
+		}
+		form.Set("NextToken", page.NextToken)
+	}
+
+	byState := map[string]int{}
+	for _, a := range alarms {
+		byState[a.State]++
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alarms":   alarms,
+		"count":    len(alarms),
+		"by_state": byState,
+	})
+}
+
+// CreateAlarm creates or replaces one alarm; see AlarmRequest
+func (h *Handler) CreateAlarm(w http.ResponseWriter, r *http.Request) {
+	var req AlarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	spec, err := h.alarmSpec(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := context.Background()
+	topic, err := h.destinationTopic(ctx, req.Destination)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.putAlarm(ctx, spec, topic); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to put alarm: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"name":      spec.name,
+		"threshold": spec.threshold,
+		"topic_arn": topic,
+	})
+}
+
+// CreateDefaultAlarms installs the defaultAlarms, notifying the destination
+// in the body (optional, as for POST /api/alarms). Kinds the deployment
+// can't support, such as proxy_5xx without REST_API_ID, are skipped.
+func (h *Handler) CreateDefaultAlarms(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Destination *AlarmDestination `json:"destination,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+
+	ctx := context.Background()
+	topic, err := h.destinationTopic(ctx, body.Destination)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created := []string{}
+	skipped := []string{}
+	var failures []string
+	for _, req := range defaultAlarms {
+		spec, err := h.alarmSpec(req)
+		if err != nil {
+			skipped = append(skipped, req.Kind+": "+err.Error())
+			continue
+		}
+		if err := h.putAlarm(ctx, spec, topic); err != nil {
+			failures = append(failures, spec.name+": "+err.Error())
+			continue
+		}
+		created = append(created, spec.name)
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"created":   created,
+		"skipped":   skipped,
+		"failures":  failures,
+		"topic_arn": topic,
+	})
+}
+
+// DeleteAlarm deletes one backoffice-managed alarm
+func (h *Handler) DeleteAlarm(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !strings.HasPrefix(name, h.alarmPrefix()) {
+		writeError(w, http.StatusForbidden, "only alarms named "+h.alarmPrefix()+"* are managed here")
+		return
+	}
+	form := url.Values{}
+	form.Set("Action", "DeleteAlarms")
+	form.Set("Version", "2010-08-01")
+	form.Set("AlarmNames.member.1", name)
+	var out struct{}
+	if err := h.callCloudWatch(context.Background(), form, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete alarm: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": name})
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// analyticsWindows are the selectable windows of the tunnel analytics and the
+// bucket size each is split into
+var analyticsWindows = map[string]struct {
+	duration time.Duration
+	bucket   time.Duration
+}{
+	"1h":  {time.Hour, 5 * time.Minute},
+	"24h": {24 * time.Hour, time.Hour},
+	"7d":  {7 * 24 * time.Hour, 6 * time.Hour},
+	"30d": {30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+// analyticsTopN is how many paths and source IPs are ranked
+const analyticsTopN = 10
+
+// logIDTimeFormat is the time prefix of request log IDs, which sort
+// chronologically within a tunnel
+const logIDTimeFormat = "20060102T150405.000000000Z"
+
+// requestLogEntry is the part of a request log entry the analytics read
+type requestLogEntry struct {
+	Path       string    `dynamodbav:"path"`
+	StatusCode int       `dynamodbav:"status_code"`
+	DurationMs int64     `dynamodbav:"duration_ms"`
+	BytesIn    int64     `dynamodbav:"bytes_in"`
+	BytesOut   int64     `dynamodbav:"bytes_out"`
+	SourceIP   string    `dynamodbav:"source_ip"`
+	CreatedAt  time.Time `dynamodbav:"created_at"`
+}
+
+// AnalyticsBucket is the traffic of one time bucket. Errors are 5xx
+// responses; 4xx responses are counted as client errors.
+type AnalyticsBucket struct {
+	Start        time.Time `json:"start"`
+	Requests     int       `json:"requests"`
+	Errors       int       `json:"errors"`
+	ClientErrors int       `json:"client_errors"`
+	ErrorRate    float64   `json:"error_rate"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+}
+
+// AnalyticsTop is one ranked path or source IP
+type AnalyticsTop struct {
+	Key      string `json:"key"`
+	Requests int    `json:"requests"`
+	Errors   int    `json:"errors"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// GetTunnelAnalytics aggregates a tunnel's request log over ?window= (1h,
+// 24h, 7d or 30d; default 24h) into time buckets, totals and the busiest
+// paths and source IPs
+func (h *Handler) GetTunnelAnalytics(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.PathValue("id")
+	if tunnelID == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id required")
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	spec, ok := analyticsWindows[window]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "window must be one of 1h, 24h, 7d, 30d")
+		return
+	}
+
+	end := time.Now().UTC()
+	since := end.Add(-spec.duration).Truncate(spec.bucket)
+	buckets := make([]AnalyticsBucket, 0, int(end.Sub(since)/spec.bucket)+1)
+	for t := since; !t.After(end); t = t.Add(spec.bucket) {
+		buckets = append(buckets, AnalyticsBucket{Start: t})
+	}
+
+	expr := newExpression()
+	projection := make([]string, 0, 7)
+	for _, attr := range []string{"path", "status_code", "duration_ms", "bytes_in", "bytes_out", "source_ip", "created_at"} {
+		projection = append(projection, expr.name(attr))
+	}
+	keyCondition := expr.name("tunnel_id") + " = " + expr.value(&types.AttributeValueMemberS{Value: tunnelID}) +
+		" AND " + expr.name("log_id") + " >= " + expr.value(&types.AttributeValueMemberS{Value: since.Format(logIDTimeFormat)})
+
+	total := AnalyticsBucket{Start: since}
+	paths := map[string]*AnalyticsTop{}
+	sourceIPs := map[string]*AnalyticsTop{}
+	var durations []int64
+
+	paginator := dynamodb.NewQueryPaginator(h.ddbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(h.tableName("request-log")),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ProjectionExpression:      aws.String(strings.Join(projection, ", ")),
+		ExpressionAttributeNames:  expr.attributeNames(),
+		ExpressionAttributeValues: expr.attributeValues(),
+	})
+	truncated := false
+	ctx := context.Background()
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if pages == maxScanPages {
+			truncated = true
+			break
+		}
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to query request log: "+err.Error())
+			return
+		}
+		for _, item := range out.Items {
+			var e requestLogEntry
+			if err := attributevalue.UnmarshalMap(item, &e); err != nil {
+				continue
+			}
+			i := int(e.CreatedAt.Sub(since) / spec.bucket)
+			if i < 0 || i >= len(buckets) {
+				continue
+			}
+			addToBucket(&buckets[i], e)
+			addToBucket(&total, e)
+			durations = append(durations, e.DurationMs)
+			addToTop(paths, e.Path, e)
+			addToTop(sourceIPs, e.SourceIP, e)
+		}
+	}
+
+	for i := range buckets {
+		buckets[i].ErrorRate = errorRate(buckets[i])
+	}
+	total.ErrorRate = errorRate(total)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tunnel_id":      tunnelID,
+		"window":         window,
+		"since":          since,
+		"bucket_seconds": int(spec.bucket.Seconds()),
+		"buckets":        buckets,
+		"totals":         total,
+		"p50_ms":         percentile(durations, 50),
+		"p95_ms":         percentile(durations, 95),
+		"top_paths":      topN(paths),
+		"top_source_ips": topN(sourceIPs),
+		"truncated":      truncated,
+	})
+}
+
+func addToBucket(b *AnalyticsBucket, e requestLogEntry) {
+	b.Requests++
+	b.BytesIn += e.BytesIn
+	b.BytesOut += e.BytesOut
+	switch {
+	case e.StatusCode >= 500:
+		b.Errors++
+	case e.StatusCode >= 400:
+		b.ClientErrors++
+	}
+}
+
+func addToTop(counts map[string]*AnalyticsTop, key string, e requestLogEntry) {
+	if key == "" {
+		return
+	}
+	c, ok := counts[key]
+	if !ok {
+		c = &AnalyticsTop{Key: key}
+		counts[key] = c
+	}
+	c.Requests++
+	c.BytesOut += e.BytesOut
+	if e.StatusCode >= 500 {
+		c.Errors++
+	}
+}
+
+func errorRate(b AnalyticsBucket) float64 {
+	if b.Requests == 0 {
+		return 0
+	}
+	return float64(b.Errors) / float64(b.Requests)
+}
+
+// topN returns the analyticsTopN entries with the most requests
+func topN(counts map[string]*AnalyticsTop) []AnalyticsTop {
+	top := make([]AnalyticsTop, 0, len(counts))
+	for _, c := range counts {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > analyticsTopN {
+		top = top[:analyticsTopN]
+	}
+	return top
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
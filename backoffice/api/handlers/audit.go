@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// auditRetention is how long audit entries are kept
+	auditRetention = 365 * 24 * time.Hour
+	// auditMaxDays is how many days back GET /api/audit reads when no date
+	// is given
+	auditMaxDays = 7
+)
+
+// auditTargetParams are the path parameters naming what an action targets
+var auditTargetParams = []string{"id", "name", "table", "username"}
+
+// AuditEntry is one admin action recorded in the audit table. Entries are
+// partitioned by UTC day and sorted by a time-based ID.
+type AuditEntry struct {
+	Date       string    `json:"date" dynamodbav:"date"` // YYYY-MM-DD
+	AuditID    string    `json:"audit_id" dynamodbav:"audit_id"`
+	Actor      string    `json:"actor" dynamodbav:"actor"`
+	Method     string    `json:"method" dynamodbav:"method"`
+	Endpoint   string    `json:"endpoint" dynamodbav:"endpoint"` // Route pattern, e.g. DELETE /api/tunnels/{id}
+	Path       string    `json:"path" dynamodbav:"path"`
+	Query      string    `json:"query,omitempty" dynamodbav:"query,omitempty"`
+	Target     string    `json:"target,omitempty" dynamodbav:"target,omitempty"`
+	StatusCode int       `json:"status_code" dynamodbav:"status_code"`
+	Outcome    string    `json:"outcome" dynamodbav:"outcome"` // success or failure
+	DurationMs int64     `json:"duration_ms" dynamodbav:"duration_ms"`
+	SourceIP   string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at" dynamodbav:"created_at"`
+	TTL        int64     `json:"-" dynamodbav:"ttl"`
+}
+
+// adminActor returns the admin making a backoffice call, as authenticated
+// by RequireRole
+func adminActor(r *http.Request) string {
+	if id, ok := identity(r); ok {
+		return id.Username
+	}
+	return "admin"
+}
+
+// statusRecorder captures the status code a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Audit records every call of a mutating route in the audit table once the
+// handler has responded. A failed audit write is logged and does not change
+// the response, which has already been written.
+func (h *Handler) Audit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		target := ""
+		for _, param := range auditTargetParams {
+			if v := r.PathValue(param); v != "" {
+				target = v
+				break
+			}
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		outcome := "success"
+		if status >= 400 {
+			outcome = "failure"
+		}
+
+		entry := AuditEntry{
+			Actor:      adminActor(r),
+			Method:     r.Method,
+			Endpoint:   r.Pattern,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			Target:     target,
+			StatusCode: status,
+			Outcome:    outcome,
+			DurationMs: time.Since(start).Milliseconds(),
+			SourceIP:   sourceIP(r),
+		}
+		if err := h.recordAudit(context.Background(), entry); err != nil {
+			log.Printf("audit: failed to record %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
+}
+
+// recordAudit writes an audit entry, filling in its date, ID and expiry
+func (h *Handler) recordAudit(ctx context.Context, entry AuditEntry) error {
+	now := time.Now()
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	entry.Date = now.UTC().Format("2006-01-02")
+	// Same sortable format as tunnel event IDs
+	entry.AuditID = now.UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix)
+	entry.CreatedAt = now
+	entry.TTL = now.Add(auditRetention).Unix()
+
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.ddbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(h.tableName("audit-log")),
+		Item:      item,
+	})
+	return err
+}
+
+// ListAudit returns audit entries newest first. ?date=YYYY-MM-DD reads one
+// day, otherwise the last auditMaxDays days are read until ?limit= (1-500,
+// default 100) entries are found. ?actor= and ?outcome= filter the entries.
+func (h *Handler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	days := []string{}
+	if date := q.Get("date"); date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			writeError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+		days = append(days, date)
+	} else {
+		today := time.Now().UTC()
+		for i := 0; i < auditMaxDays; i++ {
+			days = append(days, today.AddDate(0, 0, -i).Format("2006-01-02"))
+		}
+	}
+
+	expr := newExpression()
+	dateValue := expr.value(&types.AttributeValueMemberS{})
+	keyCond := expr.name("date") + " = " + dateValue
+	if actor := q.Get("actor"); actor != "" {
+		expr.where(expr.name("actor") + " = " + expr.value(&types.AttributeValueMemberS{Value: actor}))
+	}
+	if outcome := q.Get("outcome"); outcome != "" {
+		expr.where(expr.name("outcome") + " = " + expr.value(&types.AttributeValueMemberS{Value: outcome}))
+	}
+
+	ctx := context.Background()
+	entries := []AuditEntry{}
+	for _, day := range days {
+		values := expr.attributeValues()
+		values[dateValue] = &types.AttributeValueMemberS{Value: day}
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(h.tableName("audit-log")),
+			KeyConditionExpression:    aws.String(keyCond),
+			FilterExpression:          expr.filter(),
+			ExpressionAttributeNames:  expr.attributeNames(),
+			ExpressionAttributeValues: values,
+			ScanIndexForward:          aws.Bool(false),
+		}
+		err := h.queryPages(ctx, input, func(items []map[string]types.AttributeValue) bool {
+			for _, item := range items {
+				var entry AuditEntry
+				if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+					continue
+				}
+				entries = append(entries, entry)
+				if len(entries) == limit {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to query audit log: "+err.Error())
+			return
+		}
+		if len(entries) == limit {
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
@@ -2,49 +2,397 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// clientPlans are the plans an operator can assign, with their default tunnel
+// quota (0 = unlimited); they match the plans the create-tunnel Lambda enforces
+var clientPlans = map[string]int{
+	"free":       3,
+	"pro":        25,
+	"enterprise": 0,
+}
+
 type ClientItem struct {
-	ClientID  string    `json:"client_id" dynamodbav:"client_id"`
-	Status    string    `json:"status" dynamodbav:"status"`
-	CreatedAt time.Time `json:"created_at" dynamodbav:"created_at"`
+	ClientID   string    `json:"client_id" dynamodbav:"client_id"`
+	Status     string    `json:"status" dynamodbav:"status"`
+	Plan       string    `json:"plan,omitempty" dynamodbav:"plan,omitempty"`
+	MaxTunnels int       `json:"max_tunnels,omitempty" dynamodbav:"max_tunnels,omitempty"` // Overrides the plan's quota when > 0
+	CreatedAt  time.Time `json:"created_at" dynamodbav:"created_at"`
+
+	// Namespace of the client's subdomains; see models.Client.SubdomainPrefix
+	SubdomainPrefix string `json:"subdomain_prefix,omitempty" dynamodbav:"subdomain_prefix,omitempty"`
+
+	// Last API call or tunnel connection made with the client's credentials
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" dynamodbav:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" dynamodbav:"last_used_ip,omitempty"`
 }
 
-// ListClients returns all clients from DynamoDB (without API key hashes)
+// defaultStaleDays is how long an unused client takes to count as stale
+const defaultStaleDays = 90
+
+// ListClients returns clients from DynamoDB (without API key hashes).
+// Optional query params: client_id, status and created_after.
 func (h *Handler) ListClients(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	status := r.URL.Query().Get("status")
+	createdAfter, err := parseCreatedAfter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	ctx := context.Background()
 	table := h.tableName("clients")
+	expr := newExpression()
+	projection := strings.Join([]string{
+		expr.name("client_id"), expr.name("status"), expr.name("plan"), expr.name("max_tunnels"), expr.name("created_at"),
+		expr.name("last_used_at"), expr.name("last_used_ip"), expr.name("subdomain_prefix"),
+	}, ", ")
 
-	out, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName:            aws.String(table),
-		ProjectionExpression: aws.String("client_id, #s, created_at"),
-		ExpressionAttributeNames: map[string]string{
-			"#s": "status",
-		},
-		Limit: aws.Int32(200),
+	clients := []ClientItem{}
+	collect := func(items []map[string]types.AttributeValue) bool {
+		for _, item := range items {
+			var c ClientItem
+			if err := attributevalue.UnmarshalMap(item, &c); err != nil {
+				continue
+			}
+			// Already true of query and scan results; needed after the GetItem
+			if status != "" && c.Status != status || !createdAfter.IsZero() && !c.CreatedAt.After(createdAfter) {
+				continue
+			}
+			clients = append(clients, c)
+		}
+		return true
+	}
+
+	switch {
+	case clientID != "":
+		// client_id is the table key: a single read
+		var out *dynamodb.GetItemOutput
+		out, err = h.ddbClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"client_id": &types.AttributeValueMemberS{Value: clientID},
+			},
+			ProjectionExpression:     aws.String(projection),
+			ExpressionAttributeNames: expr.attributeNames(),
+		})
+		if err == nil && out.Item != nil {
+			collect([]map[string]types.AttributeValue{out.Item})
+		}
+
+	case status != "":
+		keyCondition := fmt.Sprintf("%s = %s", expr.name("status"), expr.value(&types.AttributeValueMemberS{Value: status}))
+		if !createdAfter.IsZero() {
+			keyCondition += fmt.Sprintf(" AND %s > %s", expr.name("created_at"), expr.value(createdAfterValue(createdAfter)))
+		}
+		err = h.queryPages(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(table),
+			IndexName:                 aws.String(statusCreatedAtIndex),
+			KeyConditionExpression:    aws.String(keyCondition),
+			ProjectionExpression:      aws.String(projection),
+			ExpressionAttributeNames:  expr.attributeNames(),
+			ExpressionAttributeValues: expr.attributeValues(),
+		}, collect)
+
+	default:
+		if !createdAfter.IsZero() {
+			expr.where(fmt.Sprintf("%s > %s", expr.name("created_at"), expr.value(createdAfterValue(createdAfter))))
+		}
+		err = h.scanPages(ctx, &dynamodb.ScanInput{
+			TableName:                 aws.String(table),
+			ProjectionExpression:      aws.String(projection),
+			FilterExpression:          expr.filter(),
+			ExpressionAttributeNames:  expr.attributeNames(),
+			ExpressionAttributeValues: expr.attributeValues(),
+		}, func(out *dynamodb.ScanOutput) bool {
+			return collect(out.Items)
+		})
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to search clients: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"clients": clients,
+		"count":   len(clients),
+	})
+}
+
+// StaleClients reports active clients whose credentials have not been used in
+// ?days= days (default 90), oldest use first. Clients that were never used
+// count from their creation, and come first.
+func (h *Handler) StaleClients(w http.ResponseWriter, r *http.Request) {
+	days := defaultStaleDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "days must be a positive number")
+			return
+		}
+		days = n
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	expr := newExpression()
+	expr.where(fmt.Sprintf("%s = %s", expr.name("status"), expr.value(&types.AttributeValueMemberS{Value: "active"})))
+	projection := strings.Join([]string{
+		expr.name("client_id"), expr.name("status"), expr.name("plan"), expr.name("max_tunnels"), expr.name("created_at"),
+		expr.name("last_used_at"), expr.name("last_used_ip"), expr.name("subdomain_prefix"),
+	}, ", ")
+
+	stale := []ClientItem{}
+	err := h.scanPages(context.Background(), &dynamodb.ScanInput{
+		TableName:                 aws.String(h.tableName("clients")),
+		ProjectionExpression:      aws.String(projection),
+		FilterExpression:          expr.filter(),
+		ExpressionAttributeNames:  expr.attributeNames(),
+		ExpressionAttributeValues: expr.attributeValues(),
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var c ClientItem
+			if err := attributevalue.UnmarshalMap(item, &c); err != nil {
+				continue
+			}
+			if lastActivity(c).Before(cutoff) {
+				stale = append(stale, c)
+			}
+		}
+		return true
 	})
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to scan clients: "+err.Error())
 		return
 	}
 
-	var clients []ClientItem
-	for _, item := range out.Items {
-		var c ClientItem
-		if err := attributevalue.UnmarshalMap(item, &c); err != nil {
-			continue
+	sort.Slice(stale, func(i, j int) bool {
+		if (stale[i].LastUsedAt == nil) != (stale[j].LastUsedAt == nil) {
+			return stale[i].LastUsedAt == nil
 		}
-		clients = append(clients, c)
-	}
+		return lastActivity(stale[i]).Before(lastActivity(stale[j]))
+	})
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"clients": clients,
-		"count":   len(clients),
+		"clients": stale,
+		"count":   len(stale),
+		"days":    days,
+		"cutoff":  cutoff,
+	})
+}
+
+// lastActivity is when a client was last used, or created if it never was
+func lastActivity(c ClientItem) time.Time {
+	if c.LastUsedAt != nil {
+		return *c.LastUsedAt
+	}
+	return c.CreatedAt
+}
+
+// CreateClientRequest is the body of POST /api/clients
+type CreateClientRequest struct {
+	Plan            string `json:"plan"`                       // free, pro or enterprise
+	MaxTunnels      int    `json:"max_tunnels,omitempty"`      // Overrides the plan's quota when > 0
+	SubdomainPrefix string `json:"subdomain_prefix,omitempty"` // Namespaces the client's subdomains
+}
+
+// UpdateClientRequest is the body of PATCH /api/clients/{id}; omitted fields
+// are left unchanged, max_tunnels 0 restores the plan's quota and an empty
+// subdomain_prefix removes the prefix
+type UpdateClientRequest struct {
+	Plan            *string `json:"plan,omitempty"`
+	MaxTunnels      *int    `json:"max_tunnels,omitempty"`
+	Status          *string `json:"status,omitempty"` // active or inactive
+	SubdomainPrefix *string `json:"subdomain_prefix,omitempty"`
+}
+
+// CreateClient registers a client with the given plan and returns its API
+// key. Only the bcrypt hash is stored, so the key is shown this one time.
+func (h *Handler) CreateClient(w http.ResponseWriter, r *http.Request) {
+	var req CreateClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if _, ok := clientPlans[req.Plan]; !ok {
+		writeError(w, http.StatusBadRequest, "plan must be free, pro or enterprise")
+		return
+	}
+	if req.MaxTunnels < 0 {
+		writeError(w, http.StatusBadRequest, "max_tunnels must not be negative")
+		return
+	}
+	req.SubdomainPrefix = strings.ToLower(req.SubdomainPrefix)
+	if req.SubdomainPrefix != "" && !auth.ValidateSubdomainPrefix(req.SubdomainPrefix) {
+		writeError(w, http.StatusBadRequest, subdomainPrefixError)
+		return
+	}
+
+	// Same formats as the public register-client Lambda
+	id := make([]byte, 16)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate client ID")
+		return
+	}
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate API key")
+		return
+	}
+	clientID := hex.EncodeToString(id)
+	apiKey := "tk_" + base64.URLEncoding.EncodeToString(secret)
+	hash, err := bcrypt.GenerateFromPassword([]byte(apiKey), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to hash API key")
+		return
+	}
+
+	client := ClientItem{
+		ClientID:   clientID,
+		Status:     "active",
+		Plan:       req.Plan,
+		MaxTunnels: req.MaxTunnels,
+		CreatedAt:  time.Now(),
+
+		SubdomainPrefix: req.SubdomainPrefix,
+	}
+	item, err := attributevalue.MarshalMap(client)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to marshal client")
+		return
+	}
+	item["api_key_hash"] = &types.AttributeValueMemberS{Value: string(hash)}
+
+	_, err = h.ddbClient.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName:           aws.String(h.tableName("clients")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(client_id)"),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save client: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"client":  client,
+		"api_key": apiKey,
+		"message": "Client created. The API key is only shown once.",
+	})
+}
+
+// subdomainPrefixError rejects a subdomain prefix that is not a short subdomain label
+const subdomainPrefixError = "subdomain_prefix must be up to 20 lowercase letters, digits and inner hyphens"
+
+// UpdateClient changes a client's plan, tunnel quota, subdomain prefix or status. Setting the
+// status to inactive makes its API key stop working.
+func (h *Handler) UpdateClient(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	if clientID == "" {
+		writeError(w, http.StatusBadRequest, "client id required")
+		return
+	}
+
+	var req UpdateClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	expr := newExpression()
+	var sets, removes []string
+	if req.Plan != nil {
+		if _, ok := clientPlans[*req.Plan]; !ok {
+			writeError(w, http.StatusBadRequest, "plan must be free, pro or enterprise")
+			return
+		}
+		sets = append(sets, expr.name("plan")+" = "+expr.value(&types.AttributeValueMemberS{Value: *req.Plan}))
+	}
+	if req.MaxTunnels != nil {
+		switch {
+		case *req.MaxTunnels < 0:
+			writeError(w, http.StatusBadRequest, "max_tunnels must not be negative")
+			return
+		case *req.MaxTunnels == 0:
+			removes = append(removes, expr.name("max_tunnels"))
+		default:
+			sets = append(sets, expr.name("max_tunnels")+" = "+expr.value(&types.AttributeValueMemberN{Value: fmt.Sprint(*req.MaxTunnels)}))
+		}
+	}
+	if req.SubdomainPrefix != nil {
+		prefix := strings.ToLower(*req.SubdomainPrefix)
+		switch {
+		case prefix == "":
+			removes = append(removes, expr.name("subdomain_prefix"))
+		case !auth.ValidateSubdomainPrefix(prefix):
+			writeError(w, http.StatusBadRequest, subdomainPrefixError)
+			return
+		default:
+			sets = append(sets, expr.name("subdomain_prefix")+" = "+expr.value(&types.AttributeValueMemberS{Value: prefix}))
+		}
+	}
+	if req.Status != nil {
+		if *req.Status != "active" && *req.Status != "inactive" {
+			writeError(w, http.StatusBadRequest, "status must be active or inactive")
+			return
+		}
+		sets = append(sets, expr.name("status")+" = "+expr.value(&types.AttributeValueMemberS{Value: *req.Status}))
+	}
+	if len(sets) == 0 && len(removes) == 0 {
+		writeError(w, http.StatusBadRequest, "nothing to update; set plan, max_tunnels, subdomain_prefix or status")
+		return
+	}
+
+	update := ""
+	if len(sets) > 0 {
+		update = "SET " + strings.Join(sets, ", ")
+	}
+	if len(removes) > 0 {
+		update += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	out, err := h.ddbClient.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(h.tableName("clients")),
+		Key: map[string]types.AttributeValue{
+			"client_id": &types.AttributeValueMemberS{Value: clientID},
+		},
+		UpdateExpression:          aws.String(strings.TrimSpace(update)),
+		ConditionExpression:       aws.String("attribute_exists(" + expr.name("client_id") + ")"),
+		ExpressionAttributeNames:  expr.attributeNames(),
+		ExpressionAttributeValues: expr.attributeValues(),
+		ReturnValues:              types.ReturnValueAllNew,
 	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			writeError(w, http.StatusNotFound, "client not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to update client: "+err.Error())
+		return
+	}
+
+	var client ClientItem
+	if err := attributevalue.UnmarshalMap(out.Attributes, &client); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to unmarshal client")
+		return
+	}
+	writeJSON(w, http.StatusOK, client)
 }
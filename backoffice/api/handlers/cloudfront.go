@@ -2,12 +2,32 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 )
 
+// maxInvalidationPaths caps the paths of one invalidation; CloudFront allows
+// 3000 in progress per distribution, 15 of them with wildcards
+const maxInvalidationPaths = 100
+
+// invalidationRefPrefix marks invalidations created by the backoffice. The
+// caller reference is the only free-form field CloudFront keeps with an
+// invalidation, so it records who triggered it: backoffice/<actor>/<unix nano>
+const invalidationRefPrefix = "backoffice/"
+
+// actorPattern keeps the recorded actor readable and within the caller reference
+var actorPattern = regexp.MustCompile(`^[A-Za-z0-9@._+-]{1,64}$`)
+
 type DistributionInfo struct {
 	ID               string    `json:"id"`
 	DomainName       string    `json:"domain_name"`
@@ -86,3 +106,163 @@ func (h *Handler) GetCloudFront(w http.ResponseWriter, r *http.Request) {
 		"count":         len(distributions),
 	})
 }
+
+// InvalidateRequest is the body of POST /api/cloudfront/invalidate
+type InvalidateRequest struct {
+	Paths []string `json:"paths"` // Path patterns such as /index.html or /assets/*
+}
+
+// InvalidationInfo is a CloudFront invalidation of the project distribution
+type InvalidationInfo struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"` // InProgress or Completed
+	CreateTime  time.Time `json:"create_time"`
+	Paths       []string  `json:"paths,omitempty"`
+	RequestedBy string    `json:"requested_by,omitempty"` // Only known for invalidations made from the backoffice
+}
+
+// InvalidateCloudFront creates an invalidation of the configured distribution
+// for the given path patterns, recording who requested it. It returns 202 with
+// the invalidation ID; GetInvalidation reports when it completes.
+func (h *Handler) InvalidateCloudFront(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.CloudFrontDistributionID == "" {
+		writeError(w, http.StatusServiceUnavailable, "no CloudFront distribution configured")
+		return
+	}
+
+	var req InvalidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(req.Paths) == 0 || len(req.Paths) > maxInvalidationPaths {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("paths must list between 1 and %d path patterns", maxInvalidationPaths))
+		return
+	}
+	for _, p := range req.Paths {
+		if !strings.HasPrefix(p, "/") {
+			writeError(w, http.StatusBadRequest, "path "+p+" must start with /")
+			return
+		}
+		if i := strings.Index(p, "*"); i >= 0 && i != len(p)-1 {
+			writeError(w, http.StatusBadRequest, "path "+p+": * is only allowed at the end")
+			return
+		}
+	}
+	actor := adminActor(r)
+	if !actorPattern.MatchString(actor) {
+		writeError(w, http.StatusBadRequest, "admin name may only contain letters, digits and @._+- (max 64)")
+		return
+	}
+
+	out, err := h.cfClient.CreateInvalidation(context.Background(), &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(h.cfg.CloudFrontDistributionID),
+		InvalidationBatch: &cftypes.InvalidationBatch{
+			CallerReference: aws.String(invalidationRefPrefix + actor + "/" + strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Paths: &cftypes.Paths{
+				Quantity: aws.Int32(int32(len(req.Paths))),
+				Items:    req.Paths,
+			},
+		},
+	})
+	if err != nil {
+		var tooMany *cftypes.TooManyInvalidationsInProgress
+		if errors.As(err, &tooMany) {
+			writeError(w, http.StatusTooManyRequests, "too many invalidations in progress; retry once some complete")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to create invalidation: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, invalidationInfo(out.Invalidation))
+}
+
+// ListInvalidations returns the distribution's most recent invalidations
+func (h *Handler) ListInvalidations(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.CloudFrontDistributionID == "" {
+		writeError(w, http.StatusServiceUnavailable, "no CloudFront distribution configured")
+		return
+	}
+
+	out, err := h.cfClient.ListInvalidations(context.Background(), &cloudfront.ListInvalidationsInput{
+		DistributionId: aws.String(h.cfg.CloudFrontDistributionID),
+		MaxItems:       aws.Int32(25),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list invalidations: "+err.Error())
+		return
+	}
+
+	invalidations := []InvalidationInfo{}
+	if out.InvalidationList != nil {
+		for _, inv := range out.InvalidationList.Items {
+			invalidations = append(invalidations, InvalidationInfo{
+				ID:         aws.ToString(inv.Id),
+				Status:     aws.ToString(inv.Status),
+				CreateTime: aws.ToTime(inv.CreateTime),
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"distribution_id": h.cfg.CloudFrontDistributionID,
+		"invalidations":   invalidations,
+		"count":           len(invalidations),
+	})
+}
+
+// GetInvalidation returns the status, paths and requester of one invalidation
+func (h *Handler) GetInvalidation(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.CloudFrontDistributionID == "" {
+		writeError(w, http.StatusServiceUnavailable, "no CloudFront distribution configured")
+		return
+	}
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "invalidation id required")
+		return
+	}
+
+	out, err := h.cfClient.GetInvalidation(context.Background(), &cloudfront.GetInvalidationInput{
+		DistributionId: aws.String(h.cfg.CloudFrontDistributionID),
+		Id:             aws.String(id),
+	})
+	if err != nil {
+		var notFound *cftypes.NoSuchInvalidation
+		if errors.As(err, &notFound) {
+			writeError(w, http.StatusNotFound, "invalidation not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get invalidation: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invalidationInfo(out.Invalidation))
+}
+
+// invalidationInfo converts an invalidation, reading the requester back from
+// the caller reference
+func invalidationInfo(inv *cftypes.Invalidation) InvalidationInfo {
+	if inv == nil {
+		return InvalidationInfo{}
+	}
+	info := InvalidationInfo{
+		ID:         aws.ToString(inv.Id),
+		Status:     aws.ToString(inv.Status),
+		CreateTime: aws.ToTime(inv.CreateTime),
+	}
+	if batch := inv.InvalidationBatch; batch != nil {
+		if batch.Paths != nil {
+			info.Paths = batch.Paths.Items
+		}
+		ref := aws.ToString(batch.CallerReference)
+		if strings.HasPrefix(ref, invalidationRefPrefix) {
+			rest := strings.TrimPrefix(ref, invalidationRefPrefix)
+			if i := strings.LastIndex(rest, "/"); i > 0 {
+				info.RequestedBy = rest[:i]
+			}
+		}
+	}
+	return info
+}
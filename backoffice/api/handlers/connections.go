@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// connectionProbeWorkers bounds the concurrent GetConnection calls
+const connectionProbeWorkers = 10
+
+// Probe results of a connection's GetConnection call
+const (
+	ConnectionLive      = "live"     // API Gateway knows the connection
+	ConnectionGone      = "gone"     // The record names a connection API Gateway has closed
+	ConnectionUnprobed  = "unprobed" // Not checked: probing off or no WEBSOCKET_ENDPOINT
+	ConnectionRemote    = "remote"   // Homed in another region, whose API this backoffice can't reach
+	ConnectionProbeFail = "error"    // GetConnection failed for another reason
+)
+
+// ConnectionItem is one WebSocket connection held by a tunnel
+type ConnectionItem struct {
+	ConnectionID string     `json:"connection_id"`
+	TunnelID     string     `json:"tunnel_id"`
+	ClientID     string     `json:"client_id"`
+	Domain       string     `json:"domain"`
+	Primary      bool       `json:"primary"` // The tunnel's connection_id; others are extra multi-policy connections
+	Region       string     `json:"region"`
+	Stage        string     `json:"stage"`
+	ConnectedAt  *time.Time `json:"connected_at,omitempty"`
+	LastPingAt   *time.Time `json:"last_ping_at,omitempty"`
+	LastActiveAt *time.Time `json:"last_active_at,omitempty"` // Last message API Gateway saw, from GetConnection
+	SourceIP     string     `json:"source_ip,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	CLIVersion   string     `json:"cli_version,omitempty"`
+	Platform     string     `json:"platform,omitempty"`
+	State        string     `json:"state"`
+	ProbeError   string     `json:"probe_error,omitempty"`
+}
+
+// websocketStage is the WebSocket API stage the management endpoint targets
+func (h *Handler) websocketStage() string {
+	if u, err := url.Parse(h.cfg.WebSocketEndpoint); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+	return h.cfg.Environment
+}
+
+// tunnelConnectionItems lists a tunnel's connections from its record. The
+// connection_info describes the latest connection only, so it is attached
+// to the primary one.
+func (h *Handler) tunnelConnectionItems(t TunnelItem) []ConnectionItem {
+	region := t.Region
+	if region == "" {
+		region = h.cfg.Region
+	}
+	var items []ConnectionItem
+	for _, id := range tunnelConnections(t) {
+		c := ConnectionItem{
+			ConnectionID: id,
+			TunnelID:     t.TunnelID,
+			ClientID:     t.ClientID,
+			Domain:       t.Domain,
+			Primary:      id == t.ConnectionID,
+			Region:       region,
+			Stage:        h.websocketStage(),
+			LastPingAt:   t.LastPingAt,
+			State:        ConnectionUnprobed,
+		}
+		if c.Primary && t.ConnectionInfo != nil {
+			connectedAt := t.ConnectionInfo.ConnectedAt
+			c.ConnectedAt = &connectedAt
+			c.SourceIP = t.ConnectionInfo.SourceIP
+			c.UserAgent = t.ConnectionInfo.UserAgent
+			c.CLIVersion = t.ConnectionInfo.CLIVersion
+			c.Platform = t.ConnectionInfo.Platform
+		}
+		items = append(items, c)
+	}
+	return items
+}
+
+// probeConnection fills c from API Gateway's view of the connection
+func (h *Handler) probeConnection(ctx context.Context, c *ConnectionItem) {
+	if h.apigwClient == nil {
+		return
+	}
+	if c.Region != h.cfg.Region {
+		c.State = ConnectionRemote
+		return
+	}
+	out, err := h.apigwClient.GetConnection(ctx, &apigatewaymanagementapi.GetConnectionInput{
+		ConnectionId: aws.String(c.ConnectionID),
+	})
+	var gone *apigwtypes.GoneException
+	switch {
+	case errors.As(err, &gone):
+		c.State = ConnectionGone
+		return
+	case err != nil:
+		c.State = ConnectionProbeFail
+		c.ProbeError = err.Error()
+		return
+	}
+	c.State = ConnectionLive
+	c.ConnectedAt = out.ConnectedAt
+	c.LastActiveAt = out.LastActiveAt
+	if out.Identity != nil {
+		c.SourceIP = aws.ToString(out.Identity.SourceIp)
+		c.UserAgent = aws.ToString(out.Identity.UserAgent)
+	}
+}
+
+// probeConnections probes every connection, connectionProbeWorkers at a time
+func (h *Handler) probeConnections(ctx context.Context, connections []ConnectionItem) {
+	sem := make(chan struct{}, connectionProbeWorkers)
+	var wg sync.WaitGroup
+	for i := range connections {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *ConnectionItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			h.probeConnection(ctx, c)
+		}(&connections[i])
+	}
+	wg.Wait()
+}
+
+// ListConnections summarizes the WebSocket connections the tunnel records
+// hold, checking each with API Gateway's GetConnection unless ?probe=false.
+// ?client_id= limits it to one client's tunnels.
+func (h *Handler) ListConnections(w http.ResponseWriter, r *http.Request) {
+	probe, err := parseBool(r, "probe")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := context.Background()
+	connected := true
+	tunnels, err := h.searchTunnels(ctx, tunnelSearch{clientID: r.URL.Query().Get("client_id"), connected: &connected})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list connected tunnels: "+err.Error())
+		return
+	}
+
+	connections := []ConnectionItem{}
+	for _, t := range tunnels {
+		connections = append(connections, h.tunnelConnectionItems(t)...)
+	}
+	if probe == nil || *probe {
+		h.probeConnections(ctx, connections)
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		a, b := connections[i].ConnectedAt, connections[j].ConnectedAt
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.After(*b)
+	})
+
+	byState := map[string]int{}
+	byRegion := map[string]int{}
+	for _, c := range connections {
+		byState[c.State]++
+		byRegion[c.Region]++
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": connections,
+		"count":       len(connections),
+		"tunnels":     len(tunnels),
+		"by_state":    byState,
+		"by_region":   byRegion,
+	})
+}
+
+// GetConnection returns one connection, always probed, together with the
+// tunnel that holds it
+func (h *Handler) GetConnection(w http.ResponseWriter, r *http.Request) {
+	connectionID := r.PathValue("id")
+	ctx := context.Background()
+	tunnel, err := h.findConnectionTunnel(ctx, connectionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to find connection: "+err.Error())
+		return
+	}
+	if tunnel == nil {
+		writeError(w, http.StatusNotFound, "no tunnel holds connection "+connectionID)
+		return
+	}
+
+	for _, c := range h.tunnelConnectionItems(*tunnel) {
+		if c.ConnectionID == connectionID {
+			h.probeConnection(ctx, &c)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"connection": c,
+				"tunnel":     tunnel,
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "no tunnel holds connection "+connectionID)
+}
+
+// findConnectionTunnel returns the tunnel holding connectionID, or nil. The
+// connection_id index finds primary connections; extra connections of multi
+// tunnels are only in connection_ids, which takes a scan.
+func (h *Handler) findConnectionTunnel(ctx context.Context, connectionID string) (*TunnelItem, error) {
+	out, err := h.ddbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName("tunnels")),
+		IndexName:              aws.String(connectionIDIndex),
+		KeyConditionExpression: aws.String("connection_id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Items) > 0 {
+		var t TunnelItem
+		if err := attributevalue.UnmarshalMap(out.Items[0], &t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+
+	var found *TunnelItem
+	err = h.scanPages(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(h.tableName("tunnels")),
+		FilterExpression: aws.String("contains(connection_ids, :id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var t TunnelItem
+			if err := attributevalue.UnmarshalMap(item, &t); err == nil {
+				found = &t
+				return false
+			}
+		}
+		return true
+	})
+	return found, err
+}
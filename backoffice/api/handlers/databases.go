@@ -2,12 +2,19 @@ package handlers
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type TableInfo struct {
@@ -34,7 +41,12 @@ func (h *Handler) ListDatabases(w http.ResponseWriter, r *http.Request) {
 		h.tableName("clients"),
 		h.tableName("tunnels"),
 		h.tableName("domains"),
+		h.tableName("released-domains"),
 		h.tableName("pending-requests"),
+		h.tableName("tunnel-events"),
+		h.tableName("request-log"),
+		h.tableName("request-stats"),
+		h.tableName("rate-limits"),
 	}
 
 	result := make([]TableInfo, 0, len(tables))
@@ -84,7 +96,9 @@ func (h *Handler) describeTable(ctx context.Context, tableName string) TableInfo
 	return info
 }
 
-// GetTableItems returns a sample of items from a DynamoDB table
+// GetTableItems returns one page of items from a DynamoDB table. Query params:
+// limit (1-500, default 50), next_token (from the previous page) and
+// attributes (comma-separated top-level attribute names to return).
 func (h *Handler) GetTableItems(w http.ResponseWriter, r *http.Request) {
 	table := r.PathValue("table")
 	if table == "" {
@@ -96,18 +110,63 @@ func (h *Handler) GetTableItems(w http.ResponseWriter, r *http.Request) {
 		h.tableName("clients"):          true,
 		h.tableName("tunnels"):          true,
 		h.tableName("domains"):          true,
+		h.tableName("released-domains"): true,
 		h.tableName("pending-requests"): true,
+		h.tableName("tunnel-events"):    true,
+		h.tableName("request-log"):      true,
+		h.tableName("request-stats"):    true,
+		h.tableName("rate-limits"):      true,
 	}
 	if !allowedTables[table] {
 		writeError(w, http.StatusForbidden, "table not accessible")
 		return
 	}
 
-	ctx := context.Background()
-	out, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	input := &dynamodb.ScanInput{
 		TableName: aws.String(table),
-		Limit:     aws.Int32(50),
-	})
+		Limit:     aws.Int32(int32(limit)),
+	}
+
+	if token := r.URL.Query().Get("next_token"); token != "" {
+		startKey, err := decodePageToken(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid next_token")
+			return
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	if v := r.URL.Query().Get("attributes"); v != "" {
+		// Placeholders keep reserved words like "status" and "ttl" usable
+		var paths []string
+		names := map[string]string{}
+		for i, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			placeholder := "#a" + strconv.Itoa(i)
+			names[placeholder] = name
+			paths = append(paths, placeholder)
+		}
+		if len(paths) > 0 {
+			input.ProjectionExpression = aws.String(strings.Join(paths, ", "))
+			input.ExpressionAttributeNames = names
+		}
+	}
+
+	ctx := context.Background()
+	out, err := h.ddbClient.Scan(ctx, input)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to scan table: "+err.Error())
 		return
@@ -117,15 +176,98 @@ func (h *Handler) GetTableItems(w http.ResponseWriter, r *http.Request) {
 	for _, item := range out.Items {
 		var m map[string]interface{}
 		if err := attributevalue.UnmarshalMap(item, &m); err == nil {
+			if table == h.tableName("pending-requests") || table == h.tableName("request-log") {
+				h.redactItem(m)
+			}
+			for _, name := range secretAttributes {
+				delete(m, name)
+			}
 			items = append(items, m)
 		}
 	}
 
+	nextToken := ""
+	if out.LastEvaluatedKey != nil {
+		nextToken, err = encodePageToken(out.LastEvaluatedKey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to encode next_token: "+err.Error())
+			return
+		}
+	}
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"table":       table,
-		"items":       items,
-		"count":       len(items),
-		"scanned":     out.ScannedCount,
-		"has_more":    out.LastEvaluatedKey != nil,
+		"table":      table,
+		"items":      items,
+		"count":      len(items),
+		"scanned":    out.ScannedCount,
+		"has_more":   out.LastEvaluatedKey != nil,
+		"next_token": nextToken,
 	})
 }
+
+// secretAttributes are never returned by the table browser: a tunnel's
+// access_key signs its access tokens, so anyone who reads it can open the
+// private tunnel
+var secretAttributes = []string{"access_key", "password_hash", "api_key_hash"}
+
+// pageKeyAttr is the JSON form of one key attribute in a page token; table
+// keys are always strings, numbers or binary
+type pageKeyAttr struct {
+	S *string `json:"s,omitempty"`
+	N *string `json:"n,omitempty"`
+	B []byte  `json:"b,omitempty"`
+}
+
+// encodePageToken turns a LastEvaluatedKey into an opaque next_token
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	attrs := make(map[string]pageKeyAttr, len(key))
+	for name, av := range key {
+		switch v := av.(type) {
+		case *types.AttributeValueMemberS:
+			attrs[name] = pageKeyAttr{S: aws.String(v.Value)}
+		case *types.AttributeValueMemberN:
+			attrs[name] = pageKeyAttr{N: aws.String(v.Value)}
+		case *types.AttributeValueMemberB:
+			attrs[name] = pageKeyAttr{B: v.Value}
+		default:
+			return "", fmt.Errorf("unsupported key attribute type for %s", name)
+		}
+	}
+
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken is the inverse of encodePageToken
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs map[string]pageKeyAttr
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, err
+	}
+	if len(attrs) == 0 {
+		return nil, errors.New("empty page token")
+	}
+
+	key := make(map[string]types.AttributeValue, len(attrs))
+	for name, attr := range attrs {
+		switch {
+		case attr.S != nil:
+			key[name] = &types.AttributeValueMemberS{Value: *attr.S}
+		case attr.N != nil:
+			key[name] = &types.AttributeValueMemberN{Value: *attr.N}
+		case attr.B != nil:
+			key[name] = &types.AttributeValueMemberB{Value: attr.B}
+		default:
+			return nil, fmt.Errorf("page token attribute %s has no value", name)
+		}
+	}
+	return key, nil
+}
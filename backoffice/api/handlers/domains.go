@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Health of a domain record, from joining it with the tunnels table
+const (
+	DomainOK         = "ok"         // The tunnel exists and its domain points back
+	DomainDangling   = "dangling"   // The referenced tunnel no longer exists
+	DomainMismatched = "mismatched" // The tunnel exists but serves another domain
+)
+
+// DomainItem is a domain record joined with the tunnel it routes to
+type DomainItem struct {
+	Domain       string    `json:"domain" dynamodbav:"domain"`
+	TunnelID     string    `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	ClientID     string    `json:"client_id" dynamodbav:"client_id"`
+	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
+	TunnelExists bool      `json:"tunnel_exists" dynamodbav:"-"`
+	TunnelDomain string    `json:"tunnel_domain,omitempty" dynamodbav:"-"` // Domain the tunnel record names
+	TunnelStatus string    `json:"tunnel_status,omitempty" dynamodbav:"-"`
+	Health       string    `json:"health" dynamodbav:"-"`
+}
+
+// domainJoin reads every domain record and every tunnel and joins them.
+// It also returns the tunnels no domain record routes to.
+func (h *Handler) domainJoin(ctx context.Context) ([]DomainItem, []TunnelItem, error) {
+	tunnels := map[string]TunnelItem{}
+	expr := newExpression()
+	err := h.scanPages(ctx, &dynamodb.ScanInput{
+		TableName:                aws.String(h.tableName("tunnels")),
+		ProjectionExpression:     aws.String(expr.name("tunnel_id") + ", " + expr.name("client_id") + ", " + expr.name("domain") + ", " + expr.name("subdomain") + ", " + expr.name("status")),
+		ExpressionAttributeNames: expr.attributeNames(),
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var t TunnelItem
+			if err := attributevalue.UnmarshalMap(item, &t); err == nil {
+				tunnels[t.TunnelID] = t
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	domains := []DomainItem{}
+	routed := map[string]bool{}
+	err = h.scanPages(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(h.tableName("domains")),
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var d DomainItem
+			if err := attributevalue.UnmarshalMap(item, &d); err != nil {
+				continue
+			}
+			t, ok := tunnels[d.TunnelID]
+			switch {
+			case !ok:
+				d.Health = DomainDangling
+			case t.Domain != d.Domain:
+				d.Health = DomainMismatched
+			default:
+				d.Health = DomainOK
+				routed[t.TunnelID] = true
+			}
+			if ok {
+				d.TunnelExists = true
+				d.TunnelDomain = t.Domain
+				d.TunnelStatus = t.Status
+			}
+			domains = append(domains, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+
+	unrouted := []TunnelItem{}
+	for id, t := range tunnels {
+		if !routed[id] {
+			unrouted = append(unrouted, t)
+		}
+	}
+	sort.Slice(unrouted, func(i, j int) bool { return unrouted[i].TunnelID < unrouted[j].TunnelID })
+
+	return domains, unrouted, nil
+}
+
+// ListDomains returns the domain records with their join health and the
+// tunnels no domain routes to. ?health=ok|dangling|mismatched filters records.
+func (h *Handler) ListDomains(w http.ResponseWriter, r *http.Request) {
+	health := r.URL.Query().Get("health")
+	if health != "" && health != DomainOK && health != DomainDangling && health != DomainMismatched {
+		writeError(w, http.StatusBadRequest, "health must be ok, dangling or mismatched")
+		return
+	}
+
+	domains, unrouted, err := h.domainJoin(context.Background())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to join domains and tunnels: "+err.Error())
+		return
+	}
+
+	counts := map[string]int{DomainOK: 0, DomainDangling: 0, DomainMismatched: 0}
+	result := []DomainItem{}
+	for _, d := range domains {
+		counts[d.Health]++
+		if health == "" || d.Health == health {
+			result = append(result, d)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"domains":                result,
+		"count":                  len(result),
+		"by_health":              counts,
+		"tunnels_without_domain": unrouted,
+	})
+}
+
+// RepairDomains deletes dangling and mismatched domain records, freeing their
+// names, or only ?domain= when given. Each delete is conditional on the record
+// still routing to the same tunnel and on that tunnel still not pointing back,
+// so a tunnel created or fixed meanwhile keeps its domain. ?dry_run=true only
+// reports what would be deleted.
+func (h *Handler) RepairDomains(w http.ResponseWriter, r *http.Request) {
+	only := r.URL.Query().Get("domain")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	ctx := context.Background()
+	domains, _, err := h.domainJoin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to join domains and tunnels: "+err.Error())
+		return
+	}
+
+	var broken []DomainItem
+	for _, d := range domains {
+		if d.Health != DomainOK && (only == "" || d.Domain == only) {
+			broken = append(broken, d)
+		}
+	}
+	if only != "" && len(broken) == 0 {
+		writeError(w, http.StatusNotFound, "no dangling or mismatched record for domain "+only)
+		return
+	}
+
+	repaired := []string{}
+	skipped := 0
+	var failures []string
+	for _, d := range broken {
+		if dryRun {
+			repaired = append(repaired, d.Domain)
+			continue
+		}
+		if err := h.deleteBrokenDomain(ctx, d); err != nil {
+			var canceled *types.TransactionCanceledException
+			if errors.As(err, &canceled) {
+				skipped++
+				continue
+			}
+			failures = append(failures, d.Domain+": "+err.Error())
+			continue
+		}
+		repaired = append(repaired, d.Domain)
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"repaired": repaired,
+		"count":    len(repaired),
+		"skipped":  skipped,
+		"failures": failures,
+		"dry_run":  dryRun,
+	})
+}
+
+// deleteBrokenDomain deletes a domain record in a transaction that checks the
+// tunnel it names is still gone, or still serves another domain
+func (h *Handler) deleteBrokenDomain(ctx context.Context, d DomainItem) error {
+	tunnelCheck := &types.ConditionCheck{
+		TableName:           aws.String(h.tableName("tunnels")),
+		Key:                 tunnelKey(d.TunnelID),
+		ConditionExpression: aws.String("attribute_not_exists(tunnel_id)"),
+	}
+	if d.Health == DomainMismatched {
+		tunnelCheck.ConditionExpression = aws.String("attribute_exists(tunnel_id) AND #domain <> :domain")
+		tunnelCheck.ExpressionAttributeNames = map[string]string{"#domain": "domain"}
+		tunnelCheck.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":domain": &types.AttributeValueMemberS{Value: d.Domain},
+		}
+	}
+
+	_, err := h.ddbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{ConditionCheck: tunnelCheck},
+			{Delete: &types.Delete{
+				TableName: aws.String(h.tableName("domains")),
+				Key: map[string]types.AttributeValue{
+					"domain": &types.AttributeValueMemberS{Value: d.Domain},
+				},
+				ConditionExpression: aws.String("tunnel_id = :tunnel_id"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":tunnel_id": &types.AttributeValueMemberS{Value: d.TunnelID},
+				},
+			}},
+		},
+	})
+	return err
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// exportMaxBytes keeps an export response under Lambda's 6 MB payload limit;
+// larger exports continue with the X-Next-Token header
+const exportMaxBytes = 5 << 20
+
+// exportTables maps each exportable dataset to its table suffix and columns.
+// Only the listed attributes are read, so secrets like API key hashes never
+// leave DynamoDB.
+var exportTables = map[string]struct {
+	suffix  string
+	columns []string
+}{
+	"tunnels": {"tunnels", []string{"tunnel_id", "client_id", "subdomain", "domain", "status", "connection_id", "region", "created_at", "updated_at"}},
+	"clients": {"clients", []string{"client_id", "status", "plan", "max_tunnels", "created_at"}},
+	"domains": {"domains", []string{"domain", "tunnel_id", "client_id", "created_at"}},
+	"usage":   {"request-log", []string{"tunnel_id", "log_id", "request_id", "method", "path", "status_code", "duration_ms", "queue_ms", "s3_upload_ms", "s3_fetch_ms", "bytes_in", "bytes_out", "source_ip", "user_agent", "country", "created_at"}},
+}
+
+// ExportTable exports tunnels, clients, domains or usage (request log)
+// records as CSV or JSON (?format=csv|json, default json). usage can be
+// limited to one tunnel with ?tunnel_id=. Pages are read until the response
+// nears exportMaxBytes; X-Next-Token is then set and passing it back as
+// ?next_token= continues the export.
+func (h *Handler) ExportTable(w http.ResponseWriter, r *http.Request) {
+	dataset := r.PathValue("table")
+	spec, ok := exportTables[dataset]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown export; use tunnels, clients, domains or usage")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		writeError(w, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+
+	var startKey map[string]types.AttributeValue
+	if token := r.URL.Query().Get("next_token"); token != "" {
+		var err error
+		if startKey, err = decodePageToken(token); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid next_token")
+			return
+		}
+	}
+
+	expr := newExpression()
+	projection := make([]string, len(spec.columns))
+	for i, column := range spec.columns {
+		projection[i] = expr.name(column)
+	}
+	table := h.tableName(spec.suffix)
+
+	// One page of the export: a Query for a single tunnel's usage, a Scan otherwise
+	tunnelID := r.URL.Query().Get("tunnel_id")
+	readPage := func(ctx context.Context, startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		if dataset == "usage" && tunnelID != "" {
+			out, err := h.ddbClient.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(table),
+				KeyConditionExpression:    aws.String(expr.name("tunnel_id") + " = :tunnel_id"),
+				ProjectionExpression:      aws.String(strings.Join(projection, ", ")),
+				ExpressionAttributeNames:  expr.attributeNames(),
+				ExpressionAttributeValues: map[string]types.AttributeValue{":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID}},
+				ExclusiveStartKey:         startKey,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return out.Items, out.LastEvaluatedKey, nil
+		}
+		out, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
+			TableName:                aws.String(table),
+			ProjectionExpression:     aws.String(strings.Join(projection, ", ")),
+			ExpressionAttributeNames: expr.attributeNames(),
+			ExclusiveStartKey:        startKey,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return out.Items, out.LastEvaluatedKey, nil
+	}
+
+	// The whole response is built before it is sent: API Gateway buffers
+	// Lambda responses anyway, and the continuation token goes in a header
+	var body bytes.Buffer
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(&body)
+		_ = csvWriter.Write(spec.columns)
+	} else {
+		body.WriteString("[")
+	}
+
+	ctx := context.Background()
+	rows := 0
+	for {
+		items, lastKey, err := readPage(ctx, startKey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to read "+dataset+": "+err.Error())
+			return
+		}
+
+		for _, item := range items {
+			var record map[string]interface{}
+			if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+				continue
+			}
+			if csvWriter != nil {
+				row := make([]string, len(spec.columns))
+				for i, column := range spec.columns {
+					row[i] = exportValue(record[column])
+				}
+				_ = csvWriter.Write(row)
+			} else {
+				data, err := json.Marshal(record)
+				if err != nil {
+					continue
+				}
+				if rows > 0 {
+					body.WriteString(",")
+				}
+				body.Write(data)
+			}
+			rows++
+		}
+		if csvWriter != nil {
+			csvWriter.Flush()
+		}
+
+		startKey = lastKey
+		if startKey == nil || body.Len() >= exportMaxBytes {
+			break
+		}
+	}
+
+	if format == "json" {
+		body.WriteString("]")
+	}
+
+	if startKey != nil {
+		token, err := encodePageToken(startKey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to encode next_token: "+err.Error())
+			return
+		}
+		w.Header().Set("X-Next-Token", token)
+	}
+
+	contentType := "application/json"
+	if format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	filename := fmt.Sprintf("%s-%s.%s", dataset, time.Now().UTC().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("X-Row-Count", strconv.Itoa(rows))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Token, X-Row-Count")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes())
+}
+
+// exportValue formats one attribute for a CSV cell
+func exportValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
@@ -1,15 +1,21 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lmanrique/tunnel/lambdas/shared/openapi"
+	"github.com/lmanrique/tunnel/lambdas/shared/redact"
 )
 
 // Config holds application configuration
@@ -17,9 +23,19 @@ type Config struct {
 	AWSConfig                aws.Config
 	ProjectName              string
 	Environment              string
-	AdminAPIKey              string
+	AdminAPIKey              string // Creates the first backoffice user, and nothing once one exists
+	AuthDisabled             bool   // Lets every request in as an operator; local development only
 	CloudFrontDistributionID string
 	Region                   string
+	WebSocketEndpoint        string // Management endpoint of the tunnel WebSocket API; "" disables force-disconnect
+	RestAPIID                string // API Gateway IDs graphed by the metrics overview; "" leaves them out
+	WebSocketAPIID           string
+	HealthCheckAPIKey        string        // API key of the client the deep health check tunnels as; "" disables it
+	AlertsTopicARN           string        // SNS topic alarms notify by default and email destinations subscribe to
+	SubdomainQuarantine      time.Duration // How long a deleted tunnel's subdomain stays reserved for its owner; 0 releases it
+
+	// Redact is applied to request headers, bodies and paths before they are shown
+	Redact redact.Rules
 }
 
 // Handler holds all AWS service clients
@@ -29,37 +45,29 @@ type Handler struct {
 	logsClient   *cloudwatchlogs.Client
 	ddbClient    *dynamodb.Client
 	cfClient     *cloudfront.Client
+	s3Client     *s3.Client
+	apigwClient  *apigatewaymanagementapi.Client // nil when no WebSocketEndpoint is configured
+
+	// operations describe the registered routes for GetOpenAPI
+	operations []openapi.Operation
 }
 
 // New creates a new Handler with initialized AWS clients
 func New(cfg Config) *Handler {
-	return &Handler{
+	h := &Handler{
 		cfg:          cfg,
 		lambdaClient: lambda.NewFromConfig(cfg.AWSConfig),
 		logsClient:   cloudwatchlogs.NewFromConfig(cfg.AWSConfig),
 		ddbClient:    dynamodb.NewFromConfig(cfg.AWSConfig),
 		cfClient:     cloudfront.NewFromConfig(cfg.AWSConfig),
+		s3Client:     s3.NewFromConfig(cfg.AWSConfig),
 	}
-}
-
-// AuthMiddleware validates the Bearer token
-func AuthMiddleware(apiKey string) func(http.HandlerFunc) http.HandlerFunc {
-	return func(next http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			if apiKey == "" {
-				// No key configured, allow all (dev mode)
-				next(w, r)
-				return
-			}
-			auth := r.Header.Get("Authorization")
-			token := strings.TrimPrefix(auth, "Bearer ")
-			if token != apiKey {
-				writeError(w, http.StatusUnauthorized, "unauthorized")
-				return
-			}
-			next(w, r)
-		}
+	if cfg.WebSocketEndpoint != "" {
+		h.apigwClient = apigatewaymanagementapi.NewFromConfig(cfg.AWSConfig, func(o *apigatewaymanagementapi.Options) {
+			o.BaseEndpoint = aws.String(cfg.WebSocketEndpoint)
+		})
 	}
+	return h
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -82,3 +90,26 @@ func (h *Handler) tableName(suffix string) string {
 func (h *Handler) lambdaName(suffix string) string {
 	return h.cfg.ProjectName + "-" + suffix + "-" + h.cfg.Environment
 }
+
+// maxScanPages caps how many 1 MB pages a backoffice view scans
+const maxScanPages = 20
+
+// scanPages scans a table page by page, calling fn for each page until fn
+// returns false or the table has been read. Views use it instead of a single
+// Scan, which silently stops at the first page.
+func (h *Handler) scanPages(ctx context.Context, input *dynamodb.ScanInput, fn func(out *dynamodb.ScanOutput) bool) error {
+	paginator := dynamodb.NewScanPaginator(h.ddbClient, input)
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if pages == maxScanPages {
+			return fmt.Errorf("stopped after %d pages", maxScanPages)
+		}
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if !fn(out) {
+			return nil
+		}
+	}
+	return nil
+}
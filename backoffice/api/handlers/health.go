@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// deepHealthTimeout bounds the whole synthetic check
+	deepHealthTimeout = 45 * time.Second
+	// deepHealthPath is the path requested through the synthetic tunnel
+	deepHealthPath = "/__tunnel_health"
+)
+
+// HealthStage is the outcome of one step of the synthetic check
+type HealthStage struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// wsMessage is the WebSocket message envelope of the tunnel protocol
+type wsMessage struct {
+	Action    string          `json:"action"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// deepHealthCheck runs the stages of GET /api/health/deep in order,
+// stopping at the first failure
+type deepHealthCheck struct {
+	h      *Handler
+	http   *http.Client
+	stages []HealthStage
+
+	tunnelID     string
+	domain       string
+	websocketURL string
+	conn         *websocket.Conn
+}
+
+// stage times fn and records its outcome
+func (c *deepHealthCheck) stage(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	s := HealthStage{Name: name, OK: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	c.stages = append(c.stages, s)
+	return err == nil
+}
+
+// GetDeepHealth checks the tunnel pipeline end to end the way a CLI uses it:
+// it creates a temporary tunnel through the REST API with the health check
+// client's API key, connects to it over the WebSocket API, requests its
+// public URL and answers the proxied request itself, then deletes the
+// tunnel. Each stage reports its latency; the first failing stage ends the
+// check and the response is 503.
+func (h *Handler) GetDeepHealth(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.HealthCheckAPIKey == "" || h.cfg.RestAPIID == "" {
+		writeError(w, http.StatusServiceUnavailable, "deep health check not configured (HEALTH_CHECK_API_KEY and REST_API_ID)")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deepHealthTimeout)
+	defer cancel()
+
+	c := &deepHealthCheck{h: h, http: &http.Client{Timeout: 30 * time.Second}}
+	start := time.Now()
+	ok := c.stage("create_tunnel", func() error { return c.createTunnel(ctx) }) &&
+		c.stage("websocket_connect", func() error { return c.connect(ctx) }) &&
+		c.stage("hello", c.hello) &&
+		c.stage("proxy_roundtrip", func() error { return c.roundTrip(ctx) })
+
+	// Clean up even after a failure; a failed delete fails the check
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.tunnelID != "" {
+		ok = c.stage("delete_tunnel", func() error { return c.deleteTunnel(context.Background()) }) && ok
+	}
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"healthy":     ok,
+		"stages":      c.stages,
+		"tunnel_id":   c.tunnelID,
+		"total_ms":    time.Since(start).Milliseconds(),
+		"checked_at":  start.UTC(),
+		"environment": h.cfg.Environment,
+	})
+}
+
+// restURL is the tunnel REST API's URL for path
+func (c *deepHealthCheck) restURL(path string) string {
+	return fmt.Sprintf("https://%s.execute-api.%s.amazonaws.com%s", c.h.cfg.RestAPIID, c.h.cfg.Region, path)
+}
+
+// rest calls the tunnel REST API as the health check client and decodes a
+// JSON response into out
+func (c *deepHealthCheck) rest(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.restURL(path), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.h.cfg.HealthCheckAPIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func (c *deepHealthCheck) createTunnel(ctx context.Context) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	var created struct {
+		TunnelID     string `json:"tunnel_id"`
+		Domain       string `json:"domain"`
+		WebsocketURL string `json:"websocket_url"`
+	}
+	err := c.rest(ctx, http.MethodPost, "/tunnels", map[string]string{
+		"subdomain":         "healthcheck-" + hex.EncodeToString(suffix),
+		"connection_policy": "reject",
+	}, &created)
+	if err != nil {
+		return err
+	}
+	c.tunnelID, c.domain, c.websocketURL = created.TunnelID, created.Domain, created.WebsocketURL
+	if c.tunnelID == "" || c.domain == "" || c.websocketURL == "" {
+		return fmt.Errorf("create-tunnel response is missing tunnel_id, domain or websocket_url")
+	}
+	return nil
+}
+
+func (c *deepHealthCheck) connect(ctx context.Context) error {
+	u, err := url.Parse(c.websocketURL)
+	if err != nil {
+		return fmt.Errorf("invalid websocket_url: %w", err)
+	}
+	q := u.Query()
+	q.Set("tunnel_id", c.tunnelID)
+	q.Set("platform", "backoffice-health-check")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+c.h.cfg.HealthCheckAPIKey)
+	headers.Set("User-Agent", "tunnel-backoffice-health-check")
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), headers)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("dial failed with %d: %w", resp.StatusCode, err)
+		}
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// hello negotiates protocol v1 without capabilities, so requests arrive as
+// plain proxy messages and responses go back in a single proxy_response
+func (c *deepHealthCheck) hello() error {
+	if err := c.send("hello", map[string]interface{}{"protocol_version": 1}); err != nil {
+		return err
+	}
+	msg, err := c.receive("hello_ack")
+	if err != nil {
+		return err
+	}
+	var ack struct {
+		ProtocolVersion int `json:"protocol_version"`
+	}
+	if err := json.Unmarshal(msg.Data, &ack); err != nil || ack.ProtocolVersion < 1 {
+		return fmt.Errorf("malformed hello_ack: %s", msg.Data)
+	}
+	return nil
+}
+
+// roundTrip requests the tunnel's public URL while answering the proxied
+// request over the WebSocket with a nonce, and checks the nonce comes back
+func (c *deepHealthCheck) roundTrip(ctx context.Context) error {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	want := hex.EncodeToString(nonce)
+
+	served := make(chan error, 1)
+	go func() { served <- c.serveOne(want) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.domain+deepHealthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("public request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	// The proxy-side error says more than the HTTP status when both failed
+	select {
+	case err := <-served:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("proxied request never reached the tunnel client")
+	}
+	if resp.StatusCode != http.StatusOK || string(bytes.TrimSpace(body)) != want {
+		return fmt.Errorf("public request returned %d %q, want 200 %q", resp.StatusCode, bytes.TrimSpace(body), want)
+	}
+	return nil
+}
+
+// serveOne waits for the proxied request and answers it with body
+func (c *deepHealthCheck) serveOne(body string) error {
+	msg, err := c.receive("proxy")
+	if err != nil {
+		return err
+	}
+	var req struct {
+		RequestID string `json:"request_id"`
+		Path      string `json:"path"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil || req.RequestID == "" {
+		return fmt.Errorf("malformed proxy message: %s", msg.Data)
+	}
+	return c.send("proxy_response", map[string]interface{}{
+		"request_id":       req.RequestID,
+		"status_code":      http.StatusOK,
+		"response_headers": map[string]string{"Content-Type": "text/plain"},
+		"response_body":    body,
+	})
+}
+
+func (c *deepHealthCheck) send(action string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(wsMessage{Action: action, Data: data})
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// receive reads messages until one with action arrives; an ERROR message or
+// a read error fails it
+func (c *deepHealthCheck) receive(action string) (*wsMessage, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(25 * time.Second))
+	for {
+		_, raw, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("waiting for %s: %w", action, err)
+		}
+		var msg wsMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			continue
+		}
+		switch msg.Action {
+		case action:
+			return &msg, nil
+		case "ERROR":
+			return nil, fmt.Errorf("server sent ERROR while waiting for %s: %s", action, msg.Error)
+		}
+	}
+}
+
+func (c *deepHealthCheck) deleteTunnel(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return c.rest(ctx, http.MethodDelete, "/tunnels/"+url.PathEscape(c.tunnelID), nil, nil)
+}
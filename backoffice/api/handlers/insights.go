@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+const (
+	// insightsWait is how long a request waits for a query to finish; it stays
+	// below the backoffice Lambda's 30 s timeout
+	insightsWait = 20 * time.Second
+	// maxInsightsLogGroups is the Logs Insights per-query limit
+	maxInsightsLogGroups = 50
+)
+
+// insightsPresets are ready-made queries; {{request_id}} is filled in from
+// the request
+var insightsPresets = map[string]struct {
+	query string
+	since time.Duration
+}{
+	"errors": {
+		query: `fields @timestamp, @log, @requestId, @message
+| filter @message like /(?i)(error|panic|fail)/
+| sort @timestamp desc`,
+		since: time.Hour,
+	},
+	"request_id": {
+		query: `fields @timestamp, @log, @requestId, @message
+| filter @message like "{{request_id}}"
+| sort @timestamp asc`,
+		since: 24 * time.Hour,
+	},
+	"slow": {
+		query: `filter @type = "REPORT" and @duration > 1000
+| fields @timestamp, @log, @requestId, @duration, @maxMemoryUsed
+| sort @duration desc`,
+		since: time.Hour,
+	},
+	"cold_starts": {
+		query: `filter @type = "REPORT" and ispresent(@initDuration)
+| fields @timestamp, @log, @requestId, @initDuration
+| sort @timestamp desc`,
+		since: 24 * time.Hour,
+	},
+}
+
+// requestIDPattern keeps a grepped request ID from breaking out of the query
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// LogQueryRequest is the body of POST /api/logs/query
+type LogQueryRequest struct {
+	Query     string   `json:"query,omitempty"`      // Logs Insights query; or
+	Preset    string   `json:"preset,omitempty"`     // errors, request_id, slow or cold_starts
+	RequestID string   `json:"request_id,omitempty"` // For the request_id preset
+	Functions []string `json:"functions,omitempty"`  // Function names; all project Lambdas by default
+	Since     string   `json:"since,omitempty"`      // Go duration, e.g. "1h"; defaults per preset, else 1h
+	Limit     int32    `json:"limit,omitempty"`      // 1-10000, default 1000
+}
+
+// QueryLogs runs a Logs Insights query over the project's Lambda log groups
+// and waits for it. Queries still running after insightsWait are returned
+// with status 202 and can be collected with GetLogQueryResults.
+func (h *Handler) QueryLogs(w http.ResponseWriter, r *http.Request) {
+	var req LogQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	query := req.Query
+	since := time.Hour
+	if req.Preset != "" {
+		preset, ok := insightsPresets[req.Preset]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "unknown preset "+req.Preset)
+			return
+		}
+		query, since = preset.query, preset.since
+		if strings.Contains(query, "{{request_id}}") {
+			if !requestIDPattern.MatchString(req.RequestID) {
+				writeError(w, http.StatusBadRequest, "request_id preset needs a valid request_id")
+				return
+			}
+			query = strings.ReplaceAll(query, "{{request_id}}", req.RequestID)
+		}
+	}
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "query or preset required")
+		return
+	}
+	if req.Since != "" {
+		d, err := time.ParseDuration(req.Since)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "since must be a duration such as 30m or 6h")
+			return
+		}
+		since = d
+	}
+	limit := int32(1000)
+	if req.Limit != 0 {
+		if req.Limit < 1 || req.Limit > 10000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 10000")
+			return
+		}
+		limit = req.Limit
+	}
+
+	ctx := context.Background()
+	logGroups, err := h.projectLogGroups(ctx, req.Functions)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list log groups: "+err.Error())
+		return
+	}
+	if len(logGroups) == 0 {
+		writeError(w, http.StatusNotFound, "no matching log groups")
+		return
+	}
+
+	end := time.Now()
+	out, err := h.logsClient.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupNames: logGroups,
+		QueryString:   aws.String(query),
+		StartTime:     aws.Int64(end.Add(-since).Unix()),
+		EndTime:       aws.Int64(end.Unix()),
+		Limit:         aws.Int32(limit),
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to start query: "+err.Error())
+		return
+	}
+
+	h.writeQueryResults(w, ctx, aws.ToString(out.QueryId), insightsWait, map[string]interface{}{
+		"query":      query,
+		"log_groups": logGroups,
+	})
+}
+
+// GetLogQueryResults returns the results of a query started by QueryLogs
+func (h *Handler) GetLogQueryResults(w http.ResponseWriter, r *http.Request) {
+	queryID := r.PathValue("id")
+	if queryID == "" {
+		writeError(w, http.StatusBadRequest, "query id required")
+		return
+	}
+	h.writeQueryResults(w, context.Background(), queryID, 0, nil)
+}
+
+// writeQueryResults polls a query for up to wait and writes its rows, or
+// status 202 if it is still running
+func (h *Handler) writeQueryResults(w http.ResponseWriter, ctx context.Context, queryID string, wait time.Duration, extra map[string]interface{}) {
+	deadline := time.Now().Add(wait)
+	for {
+		out, err := h.logsClient.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{
+			QueryId: aws.String(queryID),
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to get query results: "+err.Error())
+			return
+		}
+
+		done := true
+		status := http.StatusOK
+		switch out.Status {
+		case logstypes.QueryStatusComplete:
+		case logstypes.QueryStatusScheduled, logstypes.QueryStatusRunning:
+			done = false
+			status = http.StatusAccepted
+		default:
+			// Failed, Cancelled or Timeout
+			status = http.StatusBadGateway
+		}
+
+		if done || time.Now().After(deadline) {
+			body := map[string]interface{}{
+				"query_id": queryID,
+				"status":   string(out.Status),
+				"rows":     queryRows(out.Results),
+				"count":    len(out.Results),
+			}
+			if out.Statistics != nil {
+				body["records_scanned"] = out.Statistics.RecordsScanned
+				body["bytes_scanned"] = out.Statistics.BytesScanned
+			}
+			for k, v := range extra {
+				body[k] = v
+			}
+			writeJSON(w, status, body)
+			return
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// queryRows turns Insights result rows into field → value maps, dropping the
+// internal @ptr field
+func queryRows(results [][]logstypes.ResultField) []map[string]string {
+	rows := make([]map[string]string, 0, len(results))
+	for _, result := range results {
+		row := make(map[string]string, len(result))
+		for _, field := range result {
+			name := aws.ToString(field.Field)
+			if name == "@ptr" {
+				continue
+			}
+			row[name] = aws.ToString(field.Value)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// projectLogGroups returns the log groups of the named project Lambdas, or of
+// all of them when functions is empty
+func (h *Handler) projectLogGroups(ctx context.Context, functions []string) ([]string, error) {
+	prefix := "/aws/lambda/" + h.cfg.ProjectName + "-"
+
+	if len(functions) > 0 {
+		groups := make([]string, 0, len(functions))
+		for _, fn := range functions {
+			group := "/aws/lambda/" + fn
+			if !strings.HasPrefix(group, prefix) {
+				return nil, fmt.Errorf("function %s is not part of the project", fn)
+			}
+			groups = append(groups, group)
+		}
+		if len(groups) > maxInsightsLogGroups {
+			return nil, fmt.Errorf("at most %d functions per query", maxInsightsLogGroups)
+		}
+		return groups, nil
+	}
+
+	var groups []string
+	paginator := cloudwatchlogs.NewDescribeLogGroupsPaginator(h.logsClient, &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() && len(groups) < maxInsightsLogGroups {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range out.LogGroups {
+			if len(groups) == maxInsightsLogGroups {
+				break
+			}
+			groups = append(groups, aws.ToString(group.LogGroupName))
+		}
+	}
+	return groups, nil
+}
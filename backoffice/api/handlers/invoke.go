@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// maxInvokeEvent is the synchronous invocation payload limit
+const maxInvokeEvent = 256 << 10
+
+// invokableLambdas are the functions (by suffix) the backoffice may really
+// invoke: read-only endpoints, so a test event can't change tunnels or
+// clients. Other project functions only accept dry runs, which check the
+// function exists and can be invoked without running it.
+var invokableLambdas = []string{"list-tunnels", "list-tunnel-events", "tunnel-stats"}
+
+// TestHTTPEvent describes an API Gateway HTTP API request; it is turned into
+// the event the REST Lambdas receive
+type TestHTTPEvent struct {
+	Method         string            `json:"method"` // Default GET
+	Path           string            `json:"path"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Query          map[string]string `json:"query,omitempty"`
+	PathParameters map[string]string `json:"path_parameters,omitempty"`
+	Body           string            `json:"body,omitempty"`
+}
+
+// InvokeRequest is the body of POST /api/lambdas/{name}/invoke. Give either
+// a raw event or an http event to build one.
+type InvokeRequest struct {
+	Event  json.RawMessage `json:"event,omitempty"`
+	HTTP   *TestHTTPEvent  `json:"http,omitempty"`
+	DryRun bool            `json:"dry_run,omitempty"`
+}
+
+// InvokeLambda sends a test event to a project function and returns its
+// result together with the tail of its log output. Only invokableLambdas run
+// the event; the others are limited to dry runs.
+func (h *Handler) InvokeLambda(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !strings.HasPrefix(name, h.cfg.ProjectName+"-") {
+		writeError(w, http.StatusForbidden, "function not accessible")
+		return
+	}
+
+	var req InvokeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInvokeEvent+4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !req.DryRun && !h.invokable(name) {
+		writeError(w, http.StatusForbidden, name+" may only be dry-run; test events can be sent to "+strings.Join(invokableLambdas, ", "))
+		return
+	}
+
+	payload := []byte(req.Event)
+	switch {
+	case req.HTTP != nil && len(req.Event) > 0:
+		writeError(w, http.StatusBadRequest, "give either event or http, not both")
+		return
+	case req.HTTP != nil:
+		var err error
+		if payload, err = json.Marshal(testHTTPEvent(*req.HTTP)); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to build event")
+			return
+		}
+	case len(payload) == 0:
+		payload = []byte("{}")
+	}
+	if len(payload) > maxInvokeEvent {
+		writeError(w, http.StatusRequestEntityTooLarge, "event exceeds 256 KB")
+		return
+	}
+
+	invocationType := lambdatypes.InvocationTypeRequestResponse
+	if req.DryRun {
+		invocationType = lambdatypes.InvocationTypeDryRun
+	}
+
+	start := time.Now()
+	out, err := h.lambdaClient.Invoke(context.Background(), &lambda.InvokeInput{
+		FunctionName:   aws.String(name),
+		InvocationType: invocationType,
+		LogType:        lambdatypes.LogTypeTail,
+		Payload:        payload,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "failed to invoke function: "+err.Error())
+		return
+	}
+
+	result := map[string]interface{}{
+		"function":    name,
+		"dry_run":     req.DryRun,
+		"status_code": out.StatusCode,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"version":     aws.ToString(out.ExecutedVersion),
+	}
+	if out.FunctionError != nil {
+		result["function_error"] = aws.ToString(out.FunctionError)
+	}
+	if len(out.Payload) > 0 {
+		if json.Valid(out.Payload) {
+			result["response"] = json.RawMessage(out.Payload)
+		} else {
+			result["response"] = string(out.Payload)
+		}
+	}
+	if out.LogResult != nil {
+		// The last 4 KB of the invocation's log output
+		if logs, err := base64.StdEncoding.DecodeString(*out.LogResult); err == nil {
+			result["log_tail"] = string(logs)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// invokable reports whether name is one of the invokableLambdas
+func (h *Handler) invokable(name string) bool {
+	for _, suffix := range invokableLambdas {
+		if name == h.lambdaName(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// testHTTPEvent builds the API Gateway HTTP API (payload 2.0) event for e
+func testHTTPEvent(e TestHTTPEvent) events.APIGatewayV2HTTPRequest {
+	method := strings.ToUpper(e.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	headers := map[string]string{}
+	for k, v := range e.Headers {
+		// HTTP APIs deliver header names in lower case
+		headers[strings.ToLower(k)] = v
+	}
+
+	query := url.Values{}
+	for k, v := range e.Query {
+		query.Set(k, v)
+	}
+
+	now := time.Now()
+	return events.APIGatewayV2HTTPRequest{
+		Version:               "2.0",
+		RouteKey:              method + " " + e.Path,
+		RawPath:               e.Path,
+		RawQueryString:        query.Encode(),
+		Headers:               headers,
+		QueryStringParameters: e.Query,
+		PathParameters:        e.PathParameters,
+		Body:                  e.Body,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey:  method + " " + e.Path,
+			Stage:     "$default",
+			RequestID: "backoffice-test-" + now.UTC().Format("20060102T150405.000"),
+			TimeEpoch: now.UnixMilli(),
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    method,
+				Path:      e.Path,
+				Protocol:  "HTTP/1.1",
+				SourceIP:  "127.0.0.1",
+				UserAgent: "tunnel-backoffice",
+			},
+		},
+	}
+}
@@ -2,7 +2,13 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,6 +16,34 @@ import (
 	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 )
 
+// tunableEnv are the environment variables operators may read and change
+// from the backoffice, each with a check of its value. Everything else in a
+// function's environment (table names, secrets) stays hidden and untouched.
+var tunableEnv = map[string]func(string) error{
+	"TUNNEL_RECONNECT_GRACE_PERIOD": func(v string) error {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return errors.New("must be a duration such as 30s")
+		}
+		return nil
+	},
+	"STALE_AFTER_MINUTES":     positiveInt,
+	"DYNAMODB_MAX_ATTEMPTS":   positiveInt,
+	"DYNAMODB_MAX_BACKOFF_MS": positiveInt,
+	"DYNAMODB_METRICS": func(v string) error {
+		if v != "on" && v != "off" {
+			return errors.New("must be on or off")
+		}
+		return nil
+	},
+}
+
+func positiveInt(v string) error {
+	if n, err := strconv.Atoi(v); err != nil || n < 1 {
+		return errors.New("must be a positive integer")
+	}
+	return nil
+}
+
 type LambdaInfo struct {
 	Name         string    `json:"name"`
 	FunctionArn  string    `json:"function_arn"`
@@ -23,6 +57,10 @@ type LambdaInfo struct {
 	Description  string    `json:"description"`
 	LogGroup     string    `json:"log_group"`
 	FetchedAt    time.Time `json:"fetched_at"`
+
+	// Only filled in for a single function: its tunableEnv variables that are set
+	Tunables   map[string]string `json:"tunables,omitempty"`
+	RevisionID string            `json:"revision_id,omitempty"`
 }
 
 // ListLambdas returns all Lambda functions belonging to this project
@@ -92,8 +130,8 @@ func (h *Handler) ListLambdas(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GetLambdaConfig returns detailed config for a single Lambda function
-func (h *Handler) GetLambdaConfig(ctx context.Context, name string) (*LambdaInfo, error) {
+// lambdaConfig returns detailed config for a single Lambda function
+func (h *Handler) lambdaConfig(ctx context.Context, name string) (*LambdaInfo, error) {
 	out, err := h.lambdaClient.GetFunction(ctx, &lambda.GetFunctionInput{
 		FunctionName: aws.String(name),
 	})
@@ -129,5 +167,164 @@ func (h *Handler) GetLambdaConfig(ctx context.Context, name string) (*LambdaInfo
 	info.Runtime = string(fn.Runtime)
 	info.State = string(fn.State)
 	info.LogGroup = "/aws/lambda/" + info.Name
+	info.RevisionID = aws.ToString(fn.RevisionId)
+	info.Tunables = map[string]string{}
+	if fn.Environment != nil {
+		for key, value := range fn.Environment.Variables {
+			if _, ok := tunableEnv[key]; ok {
+				info.Tunables[key] = value
+			}
+		}
+	}
 	return info, nil
 }
+
+// GetLambdaConfig returns a project function's configuration, its tunable
+// environment variables and the names of all tunables
+func (h *Handler) GetLambdaConfig(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !strings.HasPrefix(name, h.cfg.ProjectName+"-") {
+		writeError(w, http.StatusForbidden, "function not accessible")
+		return
+	}
+
+	info, err := h.lambdaConfig(context.Background(), name)
+	if err != nil {
+		var notFound *lambdatypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			writeError(w, http.StatusNotFound, "function not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get function: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"function":    info,
+		"tunable_env": tunableEnvNames(),
+	})
+}
+
+// LambdaConfigUpdate is the body of PATCH /api/lambdas/{name}/config; omitted
+// fields are left unchanged
+type LambdaConfigUpdate struct {
+	MemorySize  *int32            `json:"memory_size_mb,omitempty"`  // 128-10240
+	Timeout     *int32            `json:"timeout_seconds,omitempty"` // 1-900
+	Environment map[string]string `json:"environment,omitempty"`     // Tunables to set; "" removes one
+	RevisionID  string            `json:"revision_id,omitempty"`     // From GET; rejects the update if the function changed since
+}
+
+// UpdateLambdaConfig changes a project function's memory, timeout or tunable
+// environment variables. Other variables are kept as they are. The change is
+// made outside OpenTofu, so the next apply reverts it unless the .tf files
+// are updated too.
+func (h *Handler) UpdateLambdaConfig(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !strings.HasPrefix(name, h.cfg.ProjectName+"-") {
+		writeError(w, http.StatusForbidden, "function not accessible")
+		return
+	}
+
+	var req LambdaConfigUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.MemorySize == nil && req.Timeout == nil && len(req.Environment) == 0 {
+		writeError(w, http.StatusBadRequest, "nothing to update; set memory_size_mb, timeout_seconds or environment")
+		return
+	}
+	if req.MemorySize != nil && (*req.MemorySize < 128 || *req.MemorySize > 10240) {
+		writeError(w, http.StatusBadRequest, "memory_size_mb must be between 128 and 10240")
+		return
+	}
+	if req.Timeout != nil && (*req.Timeout < 1 || *req.Timeout > 900) {
+		writeError(w, http.StatusBadRequest, "timeout_seconds must be between 1 and 900")
+		return
+	}
+	for key, value := range req.Environment {
+		check, ok := tunableEnv[key]
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s is not tunable; allowed: %s", key, strings.Join(tunableEnvNames(), ", ")))
+			return
+		}
+		if value == "" {
+			continue
+		}
+		if err := check(value); err != nil {
+			writeError(w, http.StatusBadRequest, key+" "+err.Error())
+			return
+		}
+	}
+
+	ctx := context.Background()
+	input := &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String(name),
+		MemorySize:   req.MemorySize,
+		Timeout:      req.Timeout,
+	}
+	if req.RevisionID != "" {
+		input.RevisionId = aws.String(req.RevisionID)
+	}
+	if len(req.Environment) > 0 {
+		// The API replaces the whole environment, so merge into the current one
+		current, err := h.lambdaClient.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
+			FunctionName: aws.String(name),
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to get function: "+err.Error())
+			return
+		}
+		variables := map[string]string{}
+		if current.Environment != nil {
+			for key, value := range current.Environment.Variables {
+				variables[key] = value
+			}
+		}
+		for key, value := range req.Environment {
+			if value == "" {
+				delete(variables, key)
+			} else {
+				variables[key] = value
+			}
+		}
+		input.Environment = &lambdatypes.Environment{Variables: variables}
+		if input.RevisionId == nil {
+			// Don't overwrite an environment changed since it was read
+			input.RevisionId = current.RevisionId
+		}
+	}
+
+	if _, err := h.lambdaClient.UpdateFunctionConfiguration(ctx, input); err != nil {
+		var conflict *lambdatypes.ResourceConflictException
+		var changed *lambdatypes.PreconditionFailedException
+		switch {
+		case errors.As(err, &conflict):
+			writeError(w, http.StatusConflict, "an update of the function is already in progress; retry shortly")
+		case errors.As(err, &changed):
+			writeError(w, http.StatusConflict, "the function changed since it was read; reload and retry")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to update function: "+err.Error())
+		}
+		return
+	}
+
+	info, err := h.lambdaConfig(ctx, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "updated, but failed to read the function back: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"function":    info,
+		"tunable_env": tunableEnvNames(),
+	})
+}
+
+func tunableEnvNames() []string {
+	names := make([]string, 0, len(tunableEnv))
+	for name := range tunableEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+const (
+	// logStreamPoll is how often FilterLogEvents is polled for new events
+	logStreamPoll = 2 * time.Second
+	// logStreamMaxDuration ends a stream before the backoffice Lambda times
+	// out; the client reconnects from the last event ID
+	logStreamMaxDuration = 25 * time.Second
+	// logStreamLookback re-reads this much of the past on every poll, as
+	// CloudWatch can ingest events after later ones; seen IDs are skipped
+	logStreamLookback = 10 * time.Second
+)
+
+// StreamLambdaLogs tails a Lambda's logs as server-sent events. Event ids are
+// timestamps in Unix ms; a reconnecting client resumes after the last one via
+// the Last-Event-ID header or ?since_ms= (default: the last minute).
+//
+// When the response can be flushed the stream stays open for up to
+// logStreamMaxDuration. Behind API Gateway (which buffers Lambda responses)
+// it ends as soon as events are available, so the client long-polls.
+func (h *Handler) StreamLambdaLogs(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "function name required")
+		return
+	}
+	if !strings.HasPrefix(name, h.cfg.ProjectName+"-") {
+		writeError(w, http.StatusForbidden, "function not accessible")
+		return
+	}
+
+	since := time.Now().Add(-time.Minute).UnixMilli()
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("since_ms")
+	}
+	if cursor != "" {
+		ms, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since_ms must be a Unix timestamp in milliseconds")
+			return
+		}
+		since = ms + 1
+	}
+
+	flusher, streaming := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	// Reconnect quickly when the stream ends
+	fmt.Fprint(w, "retry: 1000\n\n")
+
+	ctx, cancel := context.WithTimeout(r.Context(), logStreamMaxDuration)
+	defer cancel()
+
+	logGroup := "/aws/lambda/" + name
+	floor := since             // The client already has everything before this
+	seen := map[string]int64{} // Event ID → timestamp, pruned to the lookback window
+	for {
+		start := since - logStreamLookback.Milliseconds()
+		sent := 0
+		paginator := cloudwatchlogs.NewFilterLogEventsPaginator(h.logsClient, &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName: aws.String(logGroup),
+			StartTime:    aws.Int64(start),
+		})
+		for paginator.HasMorePages() {
+			out, err := paginator.NextPage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					writeSSE(w, "error", "", map[string]string{"error": err.Error()})
+				}
+				return
+			}
+			for _, e := range out.Events {
+				id, ts := aws.ToString(e.EventId), aws.ToInt64(e.Timestamp)
+				if _, ok := seen[id]; ok || ts < floor {
+					continue
+				}
+				seen[id] = ts
+				if ts > since {
+					since = ts
+				}
+				// The id is the stream's high-water mark, so it never goes
+				// backwards when a late event arrives
+				writeSSE(w, "log", strconv.FormatInt(since, 10), LogEvent{
+					Timestamp: time.UnixMilli(ts),
+					Message:   aws.ToString(e.Message),
+					LogStream: aws.ToString(e.LogStreamName),
+				})
+				sent++
+			}
+		}
+
+		for id, ts := range seen {
+			if ts < since-logStreamLookback.Milliseconds() {
+				delete(seen, id)
+			}
+		}
+
+		if streaming {
+			if sent == 0 {
+				// Keep-alive comment so proxies don't close an idle stream
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			flusher.Flush()
+		} else if sent > 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(logStreamPoll):
+		}
+	}
+}
+
+// writeSSE writes one server-sent event with a JSON payload
+func writeSSE(w http.ResponseWriter, event, id string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// metricWindows are the selectable graph windows and the period (seconds)
+// each is sampled at, keeping every series under CloudWatch's per-query limit
+var metricWindows = map[string]struct {
+	duration time.Duration
+	period   int
+}{
+	"1h":  {time.Hour, 60},
+	"3h":  {3 * time.Hour, 60},
+	"12h": {12 * time.Hour, 300},
+	"24h": {24 * time.Hour, 300},
+	"7d":  {7 * 24 * time.Hour, 3600},
+}
+
+// metricQuery is one series requested from CloudWatch
+type metricQuery struct {
+	ID         string // Series name in the response; lower-case letters, digits and _
+	Namespace  string
+	Metric     string
+	Dimensions map[string]string
+	Stat       string // Sum, Maximum, Average, p95, ...
+}
+
+// MetricPoint is one sample of a series
+type MetricPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// metricData is the GetMetricData response; the backoffice talks to
+// CloudWatch's Query API directly, so only the fields it reads are declared
+type metricData struct {
+	Results []struct {
+		ID         string    `xml:"Id"`
+		StatusCode string    `xml:"StatusCode"`
+		Timestamps []string  `xml:"Timestamps>member"`
+		Values     []float64 `xml:"Values>member"`
+	} `xml:"GetMetricDataResult>MetricDataResults>member"`
+	NextToken string `xml:"GetMetricDataResult>NextToken"`
+}
+
+// getMetricData fetches the queries over [start, end) at period seconds and
+// returns each series oldest first, keyed by query ID
+func (h *Handler) getMetricData(ctx context.Context, queries []metricQuery, start, end time.Time, period int) (map[string][]MetricPoint, error) {
+	form := url.Values{}
+	form.Set("Action", "GetMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("StartTime", start.UTC().Format(time.RFC3339))
+	form.Set("EndTime", end.UTC().Format(time.RFC3339))
+	form.Set("ScanBy", "TimestampAscending")
+	for i, q := range queries {
+		setMetricStat(form, fmt.Sprintf("MetricDataQueries.member.%d.", i+1), q, period)
+	}
+
+	series := make(map[string][]MetricPoint, len(queries))
+	for _, q := range queries {
+		series[q.ID] = []MetricPoint{}
+	}
+
+	for {
+		var page metricData
+		if err := h.callCloudWatch(ctx, form, &page); err != nil {
+			return nil, err
+		}
+		for _, result := range page.Results {
+			for i, ts := range result.Timestamps {
+				t, err := time.Parse(time.RFC3339, ts)
+				if err != nil || i >= len(result.Values) {
+					continue
+				}
+				series[result.ID] = append(series[result.ID], MetricPoint{Timestamp: t, Value: result.Values[i]})
+			}
+		}
+		if page.NextToken == "" {
+			return series, nil
+		}
+		form.Set("NextToken", page.NextToken)
+	}
+}
+
+// setMetricStat encodes q as the MetricDataQuery at prefix (e.g.
+// "MetricDataQueries.member.1."), sampled every period seconds
+func setMetricStat(form url.Values, prefix string, q metricQuery, period int) {
+	form.Set(prefix+"Id", q.ID)
+	form.Set(prefix+"MetricStat.Metric.Namespace", q.Namespace)
+	form.Set(prefix+"MetricStat.Metric.MetricName", q.Metric)
+	form.Set(prefix+"MetricStat.Period", strconv.Itoa(period))
+	form.Set(prefix+"MetricStat.Stat", q.Stat)
+
+	names := make([]string, 0, len(q.Dimensions))
+	for name := range q.Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for j, name := range names {
+		dim := fmt.Sprintf("%sMetricStat.Metric.Dimensions.member.%d.", prefix, j+1)
+		form.Set(dim+"Name", name)
+		form.Set(dim+"Value", q.Dimensions[name])
+	}
+}
+
+// callCloudWatch sends a signed Query API request to CloudWatch and decodes
+// the XML response into out
+func (h *Handler) callCloudWatch(ctx context.Context, form url.Values, out interface{}) error {
+	return h.callQueryAPI(ctx, "monitoring", form, out)
+}
+
+// queryAPIClient sends the Query API requests; a stalled endpoint fails the
+// request instead of holding the handler open
+var queryAPIClient = &http.Client{Timeout: 30 * time.Second}
+
+// callQueryAPI sends a signed request to an AWS Query API (CloudWatch is
+// "monitoring", SNS is "sns") and decodes the XML response into out
+func (h *Handler) callQueryAPI(ctx context.Context, service string, form url.Values, out interface{}) error {
+	body := form.Encode()
+	endpoint := "https://" + service + "." + h.cfg.Region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds, err := h.cfg.AWSConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get credentials: %w", err)
+	}
+	hash := sha256.Sum256([]byte(body))
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), service, h.cfg.Region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := queryAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("%s: %s: %s", service, apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("%s: HTTP %d", service, resp.StatusCode)
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// metricWindow reads the window query parameter (default 1h)
+func metricWindow(r *http.Request) (string, time.Time, time.Time, int, error) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "1h"
+	}
+	w, ok := metricWindows[window]
+	if !ok {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("window must be one of 1h, 3h, 12h, 24h, 7d")
+	}
+	end := time.Now().Truncate(time.Minute)
+	return window, end.Add(-w.duration), end, w.period, nil
+}
+
+// lambdaQueries are the series graphed for one function, or for all
+// functions in the account when functionName is ""
+func lambdaQueries(functionName string) []metricQuery {
+	var dims map[string]string
+	if functionName != "" {
+		dims = map[string]string{"FunctionName": functionName}
+	}
+	return []metricQuery{
+		{ID: "invocations", Namespace: "AWS/Lambda", Metric: "Invocations", Dimensions: dims, Stat: "Sum"},
+		{ID: "errors", Namespace: "AWS/Lambda", Metric: "Errors", Dimensions: dims, Stat: "Sum"},
+		{ID: "duration_p95", Namespace: "AWS/Lambda", Metric: "Duration", Dimensions: dims, Stat: "p95"},
+		{ID: "throttles", Namespace: "AWS/Lambda", Metric: "Throttles", Dimensions: dims, Stat: "Sum"},
+		{ID: "concurrent_executions", Namespace: "AWS/Lambda", Metric: "ConcurrentExecutions", Dimensions: dims, Stat: "Maximum"},
+	}
+}
+
+// GetLambdaMetrics returns invocation, error, p95 duration, throttle and
+// concurrency series for a Lambda function over ?window= (default 1h)
+func (h *Handler) GetLambdaMetrics(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "function name required")
+		return
+	}
+	if !strings.HasPrefix(name, h.cfg.ProjectName+"-") {
+		writeError(w, http.StatusForbidden, "function not accessible")
+		return
+	}
+
+	window, start, end, period, err := metricWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	series, err := h.getMetricData(context.Background(), lambdaQueries(name), start, end, period)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get metrics: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"function":       name,
+		"window":         window,
+		"period_seconds": period,
+		"series":         series,
+		"fetched_at":     time.Now(),
+	})
+}
+
+// GetMetricsOverview returns account-wide Lambda series plus request and
+// error counts of the REST API and connection and message counts of the
+// WebSocket API, when their IDs are configured
+func (h *Handler) GetMetricsOverview(w http.ResponseWriter, r *http.Request) {
+	window, start, end, period, err := metricWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	queries := lambdaQueries("")
+	if h.cfg.RestAPIID != "" {
+		dims := map[string]string{"ApiId": h.cfg.RestAPIID}
+		queries = append(queries,
+			metricQuery{ID: "http_requests", Namespace: "AWS/ApiGateway", Metric: "Count", Dimensions: dims, Stat: "Sum"},
+			metricQuery{ID: "http_4xx", Namespace: "AWS/ApiGateway", Metric: "4xx", Dimensions: dims, Stat: "Sum"},
+			metricQuery{ID: "http_5xx", Namespace: "AWS/ApiGateway", Metric: "5xx", Dimensions: dims, Stat: "Sum"},
+		)
+	}
+	if h.cfg.WebSocketAPIID != "" {
+		dims := map[string]string{"ApiId": h.cfg.WebSocketAPIID}
+		queries = append(queries,
+			metricQuery{ID: "ws_connects", Namespace: "AWS/ApiGateway", Metric: "ConnectCount", Dimensions: dims, Stat: "Sum"},
+			metricQuery{ID: "ws_messages", Namespace: "AWS/ApiGateway", Metric: "MessageCount", Dimensions: dims, Stat: "Sum"},
+			metricQuery{ID: "ws_client_errors", Namespace: "AWS/ApiGateway", Metric: "ClientError", Dimensions: dims, Stat: "Sum"},
+			metricQuery{ID: "ws_execution_errors", Namespace: "AWS/ApiGateway", Metric: "ExecutionError", Dimensions: dims, Stat: "Sum"},
+		)
+	}
+
+	series, err := h.getMetricData(context.Background(), queries, start, end, period)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get metrics: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window":         window,
+		"period_seconds": period,
+		"series":         series,
+		"fetched_at":     time.Now(),
+	})
+}
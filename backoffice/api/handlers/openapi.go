@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/openapi"
+)
+
+// securityAdmin names the security scheme of the routes that need an admin
+const securityAdmin = "adminToken"
+
+// Describe records a route for the OpenAPI document. role is the admin role
+// the route requires, "" for none; handler is the unwrapped handler, whose
+// method name becomes the operation ID.
+func (h *Handler) Describe(pattern, role string, handler http.HandlerFunc, summary string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	op := openapi.Operation{
+		Method:  method,
+		Path:    path,
+		ID:      operationID(handler),
+		Summary: summary,
+		Tag:     strings.Split(strings.TrimPrefix(path, "/api/"), "/")[0],
+	}
+	if role != "" {
+		op.Security = securityAdmin
+		op.Errors = []int{http.StatusForbidden}
+	}
+	h.operations = append(h.operations, op)
+}
+
+// GetOpenAPI serves the OpenAPI description of the backoffice API, generated
+// from the routes registered with Describe
+func (h *Handler) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc := openapi.Generate(openapi.API{
+		Info: openapi.Info{
+			Title:       "Tunnel backoffice API",
+			Version:     "1",
+			Description: "Administers the tunnel service. Routes need a read-only admin, or an operator for changes, which are audited.",
+		},
+		Servers: []openapi.Server{{URL: "https://" + r.Host}},
+		SecuritySchemes: map[string]openapi.SecurityScheme{
+			securityAdmin: openapi.BearerAuth("A session token from POST /api/auth/login, or the admin API key"),
+		},
+		ErrorBody: struct {
+			Error string `json:"error"`
+		}{},
+		ErrorContentType: "application/json",
+		Operations:       h.operations,
+	})
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// operationID turns a handler method value (e.g. h.ListTunnels) into an
+// operation ID (listTunnels)
+func operationID(handler http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// defaultPurgeAge is how old a waiting_upload request must be before a bulk
+// purge removes it; uploads normally finish within the presigned URL's lifetime
+const defaultPurgeAge = 15 * time.Minute
+
+// PendingRequestItem is a pending request as shown in the backoffice. Bodies
+// are left out, only their size is reported, and headers are redacted.
+type PendingRequestItem struct {
+	RequestID      string            `json:"request_id" dynamodbav:"request_id"`
+	TunnelID       string            `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	Method         string            `json:"method" dynamodbav:"method"`
+	Path           string            `json:"path" dynamodbav:"path"`
+	Headers        map[string]string `json:"headers,omitempty" dynamodbav:"headers"`
+	Body           string            `json:"-" dynamodbav:"body"`
+	BodySize       int               `json:"body_size" dynamodbav:"-"`
+	Status         string            `json:"status" dynamodbav:"status"`
+	ResponseStatus int               `json:"response_status,omitempty" dynamodbav:"response_status,omitempty"`
+	CreatedAt      time.Time         `json:"created_at" dynamodbav:"created_at"`
+	AgeSeconds     int64             `json:"age_seconds" dynamodbav:"-"`
+	TTL            int64             `json:"ttl" dynamodbav:"ttl"`
+
+	// Error is why a request ended in a terminal failure status
+	Error string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+}
+
+// pendingFilter selects pending requests by tunnel, status and minimum age
+type pendingFilter struct {
+	tunnelID  string
+	status    string
+	olderThan time.Duration
+}
+
+func (f pendingFilter) matches(p PendingRequestItem, now time.Time) bool {
+	if f.tunnelID != "" && p.TunnelID != f.tunnelID {
+		return false
+	}
+	if f.status != "" && p.Status != f.status {
+		return false
+	}
+	return now.Sub(p.CreatedAt) >= f.olderThan
+}
+
+// parseOlderThan reads the older_than query parameter as a Go duration ("10m", "2h")
+func parseOlderThan(r *http.Request, fallback time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get("older_than")
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("older_than must be a duration such as 10m or 2h")
+	}
+	return d, nil
+}
+
+// scanPendingRequests returns the pending requests matching f
+func (h *Handler) scanPendingRequests(ctx context.Context, f pendingFilter) ([]PendingRequestItem, error) {
+	now := time.Now()
+	requests := []PendingRequestItem{}
+	err := h.scanPages(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(h.tableName("pending-requests")),
+	}, func(out *dynamodb.ScanOutput) bool {
+		for _, item := range out.Items {
+			var p PendingRequestItem
+			if err := attributevalue.UnmarshalMap(item, &p); err != nil {
+				continue
+			}
+			if !f.matches(p, now) {
+				continue
+			}
+			p.BodySize = len(p.Body)
+			p.Path = h.cfg.Redact.Path(p.Path)
+			p.Headers = h.cfg.Redact.Headers(p.Headers)
+			p.AgeSeconds = int64(now.Sub(p.CreatedAt).Seconds())
+			requests = append(requests, p)
+		}
+		return true
+	})
+	return requests, err
+}
+
+// ListPendingRequests returns pending requests, optionally filtered by
+// tunnel_id, status and older_than
+func (h *Handler) ListPendingRequests(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := parseOlderThan(r, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	requests, err := h.scanPendingRequests(context.Background(), pendingFilter{
+		tunnelID:  r.URL.Query().Get("tunnel_id"),
+		status:    r.URL.Query().Get("status"),
+		olderThan: olderThan,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to scan pending requests: "+err.Error())
+		return
+	}
+
+	byStatus := map[string]int{}
+	for _, p := range requests {
+		byStatus[p.Status]++
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pending_requests": requests,
+		"count":            len(requests),
+		"by_status":        byStatus,
+	})
+}
+
+// DeletePendingRequest removes a single pending request; callers polling it
+// (GET /poll/{id}) get a 404 instead of waiting forever
+func (h *Handler) DeletePendingRequest(w http.ResponseWriter, r *http.Request) {
+	requestID := r.PathValue("id")
+	if requestID == "" {
+		writeError(w, http.StatusBadRequest, "request id required")
+		return
+	}
+
+	_, err := h.ddbClient.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(h.tableName("pending-requests")),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		ConditionExpression: aws.String("attribute_exists(request_id)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			writeError(w, http.StatusNotFound, "pending request not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to delete pending request: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"request_id": requestID,
+		"deleted":    true,
+	})
+}
+
+// PurgePendingRequests deletes stuck waiting_upload requests older than
+// older_than (default 15m), optionally limited to one tunnel_id. Each delete
+// is conditional on the status, so an upload that completes mid-purge is kept.
+func (h *Handler) PurgePendingRequests(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := parseOlderThan(r, defaultPurgeAge)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := context.Background()
+	stuck, err := h.scanPendingRequests(ctx, pendingFilter{
+		tunnelID:  r.URL.Query().Get("tunnel_id"),
+		status:    "waiting_upload",
+		olderThan: olderThan,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to scan pending requests: "+err.Error())
+		return
+	}
+
+	table := h.tableName("pending-requests")
+	deleted := []string{}
+	skipped := 0
+	var failures []string
+	for _, p := range stuck {
+		_, err := h.ddbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"request_id": &types.AttributeValueMemberS{Value: p.RequestID},
+			},
+			ConditionExpression: aws.String("#status = :status"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: "waiting_upload"},
+			},
+		})
+		if err != nil {
+			var condErr *types.ConditionalCheckFailedException
+			if errors.As(err, &condErr) {
+				skipped++
+				continue
+			}
+			failures = append(failures, p.RequestID+": "+err.Error())
+			continue
+		}
+		deleted = append(deleted, p.RequestID)
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"deleted":    deleted,
+		"count":      len(deleted),
+		"skipped":    skipped,
+		"failures":   failures,
+		"older_than": olderThan.String(),
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// RequestLogItem is a request log entry as shown in the backoffice. Headers
+// and BodyPreview are only there when http-proxy logs request details, and
+// are redacted again with the backoffice's rules before they are shown.
+type RequestLogItem struct {
+	TunnelID        string            `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	LogID           string            `json:"log_id" dynamodbav:"log_id"`
+	RequestID       string            `json:"request_id" dynamodbav:"request_id"`
+	Method          string            `json:"method" dynamodbav:"method"`
+	Path            string            `json:"path" dynamodbav:"path"`
+	StatusCode      int               `json:"status_code" dynamodbav:"status_code"`
+	DurationMs      int64             `json:"duration_ms" dynamodbav:"duration_ms"`
+	BytesIn         int64             `json:"bytes_in" dynamodbav:"bytes_in"`
+	BytesOut        int64             `json:"bytes_out" dynamodbav:"bytes_out"`
+	SourceIP        string            `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent       string            `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	Country         string            `json:"country,omitempty" dynamodbav:"country,omitempty"`
+	StrippedHeaders []string          `json:"stripped_headers,omitempty" dynamodbav:"stripped_headers,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty" dynamodbav:"headers,omitempty"`
+	BodyPreview     string            `json:"body_preview,omitempty" dynamodbav:"body_preview,omitempty"`
+	CreatedAt       time.Time         `json:"created_at" dynamodbav:"created_at"`
+}
+
+// ListTunnelRequests returns a tunnel's most recent request log entries,
+// newest first
+func (h *Handler) ListTunnelRequests(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.PathValue("id")
+	if tunnelID == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id required")
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+
+	ctx := context.Background()
+	out, err := h.ddbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName("request-log")),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to query request log: "+err.Error())
+		return
+	}
+
+	requests := []RequestLogItem{}
+	for _, item := range out.Items {
+		var e RequestLogItem
+		if err := attributevalue.UnmarshalMap(item, &e); err != nil {
+			continue
+		}
+		e.Path = h.cfg.Redact.Path(e.Path)
+		e.Headers = h.cfg.Redact.Headers(e.Headers)
+		requests = append(requests, e)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tunnel_id": tunnelID,
+		"requests":  requests,
+		"count":     len(requests),
+	})
+}
+
+// redactItem masks the request details of a raw pending request or request
+// log item from the table browser: header values and query parameters are
+// redacted, and a pending request's bodies are cut to redacted previews
+func (h *Handler) redactItem(item map[string]interface{}) {
+	for _, attrs := range [][2]string{{"headers", "body"}, {"response_headers", "response_body"}} {
+		raw, ok := item[attrs[0]].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		headers := make(map[string]string, len(raw))
+		for name, value := range raw {
+			headers[name], _ = value.(string)
+		}
+		item[attrs[0]] = h.cfg.Redact.Headers(headers)
+		if body, ok := item[attrs[1]].(string); ok {
+			item[attrs[1]] = h.cfg.Redact.BodyPreview(contentTypeOf(headers), body)
+		}
+	}
+	if path, ok := item["path"].(string); ok {
+		item["path"] = h.cfg.Redact.Path(path)
+	}
+}
+
+// contentTypeOf finds the Content-Type among headers of any case
+func contentTypeOf(headers map[string]string) string {
+	for name, value := range headers {
+		if http.CanonicalHeaderKey(name) == "Content-Type" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Secondary indexes the search endpoints query
+const (
+	clientIDIndex        = "client_id-index"
+	connectionIDIndex    = "connection_id-index"
+	statusCreatedAtIndex = "status-created_at-index"
+)
+
+// expression collects the attribute names and values of a key condition and
+// a filter so both can share one set of placeholders
+type expression struct {
+	filters []string
+	names   map[string]string
+	values  map[string]types.AttributeValue
+}
+
+func newExpression() *expression {
+	return &expression{names: map[string]string{}, values: map[string]types.AttributeValue{}}
+}
+
+// name returns the placeholder for an attribute name
+func (e *expression) name(attr string) string {
+	placeholder := "#" + strings.ReplaceAll(attr, "-", "_")
+	e.names[placeholder] = attr
+	return placeholder
+}
+
+// value returns a fresh placeholder for v
+func (e *expression) value(v types.AttributeValue) string {
+	placeholder := ":v" + strconv.Itoa(len(e.values))
+	e.values[placeholder] = v
+	return placeholder
+}
+
+// where adds a condition to the filter; conditions are ANDed
+func (e *expression) where(condition string) {
+	e.filters = append(e.filters, condition)
+}
+
+func (e *expression) filter() *string {
+	if len(e.filters) == 0 {
+		return nil
+	}
+	return aws.String(strings.Join(e.filters, " AND "))
+}
+
+// attributeNames and attributeValues return nil when unused, as DynamoDB
+// rejects empty maps
+func (e *expression) attributeNames() map[string]string {
+	if len(e.names) == 0 {
+		return nil
+	}
+	return e.names
+}
+
+func (e *expression) attributeValues() map[string]types.AttributeValue {
+	if len(e.values) == 0 {
+		return nil
+	}
+	return e.values
+}
+
+// createdAfterValue formats t the way created_at is stored, for comparisons
+func createdAfterValue(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: t.UTC().Format(time.RFC3339)}
+}
+
+// parseCreatedAfter reads the created_after query parameter, an RFC 3339
+// timestamp or a date
+func parseCreatedAfter(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("created_after")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("created_after must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+}
+
+// parseBool reads an optional boolean query parameter
+func parseBool(r *http.Request, key string) (*bool, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", key)
+	}
+	return &b, nil
+}
+
+// queryPages is scanPages for Queries
+func (h *Handler) queryPages(ctx context.Context, input *dynamodb.QueryInput, fn func(items []map[string]types.AttributeValue) bool) error {
+	paginator := dynamodb.NewQueryPaginator(h.ddbClient, input)
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if pages == maxScanPages {
+			return fmt.Errorf("stopped after %d pages", maxScanPages)
+		}
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if !fn(out.Items) {
+			return nil
+		}
+	}
+	return nil
+}
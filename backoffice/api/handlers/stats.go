@@ -81,7 +81,8 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	stats.TotalTunnels = int(tableCounts[h.tableName("tunnels")])
 
 	// Count active tunnels with a filter scan
-	activeOut, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
+	activeTunnels := 0
+	err := h.scanPages(ctx, &dynamodb.ScanInput{
 		TableName:        aws.String(h.tableName("tunnels")),
 		FilterExpression: aws.String("#s = :active"),
 		ExpressionAttributeNames: map[string]string{
@@ -91,9 +92,12 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 			":active": &types.AttributeValueMemberS{Value: "active"},
 		},
 		Select: types.SelectCount,
+	}, func(out *dynamodb.ScanOutput) bool {
+		activeTunnels += int(out.Count)
+		return true
 	})
 	if err == nil {
-		stats.ActiveTunnels = int(activeOut.Count)
+		stats.ActiveTunnels = activeTunnels
 	}
 
 	writeJSON(w, http.StatusOK, stats)
@@ -2,52 +2,109 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 type TunnelItem struct {
+	TunnelID         string     `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	ClientID         string     `json:"client_id" dynamodbav:"client_id"`
+	Domain           string     `json:"domain" dynamodbav:"domain"`
+	Subdomain        string     `json:"subdomain" dynamodbav:"subdomain"`
+	Status           string     `json:"status" dynamodbav:"status"`
+	ConnectionID     string     `json:"connection_id,omitempty" dynamodbav:"connection_id,omitempty"`
+	ConnectionPolicy string     `json:"connection_policy,omitempty" dynamodbav:"connection_policy,omitempty"`
+	ConnectionIDs    []string   `json:"connection_ids,omitempty" dynamodbav:"connection_ids,stringset,omitempty"`
+	Region           string     `json:"region,omitempty" dynamodbav:"region,omitempty"`
+	BlockBots        bool       `json:"block_bots,omitempty" dynamodbav:"block_bots,omitempty"`
+	RobotsTxt        bool       `json:"robots_txt,omitempty" dynamodbav:"robots_txt,omitempty"`
+	AllowedCountries []string   `json:"allowed_countries,omitempty" dynamodbav:"allowed_countries,stringset,omitempty"`
+	AllowedMethods   []string   `json:"allowed_methods,omitempty" dynamodbav:"allowed_methods,stringset,omitempty"`
+	StrippedHeaders  []string   `json:"stripped_headers,omitempty" dynamodbav:"stripped_headers,stringset,omitempty"`
+	ResponseHeaders  []string   `json:"response_headers,omitempty" dynamodbav:"response_headers,stringset,omitempty"`
+	LowLatency       bool       `json:"low_latency,omitempty" dynamodbav:"low_latency,omitempty"`
+	MaxConcurrent    int64      `json:"max_concurrent_requests,omitempty" dynamodbav:"max_concurrent_requests,omitempty"`
+	LastPingAt       *time.Time `json:"last_ping_at,omitempty" dynamodbav:"last_ping_at,omitempty"`
+	Version          int64      `json:"version" dynamodbav:"version"`
+	CreatedAt        time.Time  `json:"created_at" dynamodbav:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at" dynamodbav:"updated_at"`
+
+	StrippedResponseHeaders []string            `json:"stripped_response_headers,omitempty" dynamodbav:"stripped_response_headers,stringset,omitempty"`
+	ConnectionInfo          *ConnectionInfoItem `json:"connection_info,omitempty" dynamodbav:"connection_info,omitempty"`
+}
+
+type ConnectionInfoItem struct {
+	CLIVersion  string    `json:"cli_version,omitempty" dynamodbav:"cli_version,omitempty"`
+	Platform    string    `json:"platform,omitempty" dynamodbav:"platform,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	ConnectedAt time.Time `json:"connected_at" dynamodbav:"connected_at"`
+}
+
+type TunnelEventItem struct {
 	TunnelID     string    `json:"tunnel_id" dynamodbav:"tunnel_id"`
-	ClientID     string    `json:"client_id" dynamodbav:"client_id"`
-	Domain       string    `json:"domain" dynamodbav:"domain"`
-	Subdomain    string    `json:"subdomain" dynamodbav:"subdomain"`
-	Status       string    `json:"status" dynamodbav:"status"`
+	EventID      string    `json:"event_id" dynamodbav:"event_id"`
+	Type         string    `json:"type" dynamodbav:"type"`
+	ClientID     string    `json:"client_id,omitempty" dynamodbav:"client_id,omitempty"`
 	ConnectionID string    `json:"connection_id,omitempty" dynamodbav:"connection_id,omitempty"`
+	SourceIP     string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	CLIVersion   string    `json:"cli_version,omitempty" dynamodbav:"cli_version,omitempty"`
+	Platform     string    `json:"platform,omitempty" dynamodbav:"platform,omitempty"`
+	Reason       string    `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Actor        string    `json:"actor,omitempty" dynamodbav:"actor,omitempty"`
 	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" dynamodbav:"updated_at"`
+	TTL          int64     `json:"-" dynamodbav:"ttl,omitempty"`
 }
 
-// ListTunnels returns all tunnels from DynamoDB
-func (h *Handler) ListTunnels(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	table := h.tableName("tunnels")
-
-	// Optional filter by status
-	statusFilter := r.URL.Query().Get("status")
+// tunnelSearch holds the filters ListTunnels accepts
+type tunnelSearch struct {
+	subdomain    string // substring
+	clientID     string
+	status       string
+	createdAfter time.Time
+	connected    *bool
+}
 
-	out, err := h.ddbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(table),
-		Limit:     aws.Int32(200),
-	})
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to scan tunnels: "+err.Error())
+// ListTunnels returns tunnels from DynamoDB. Optional query params: subdomain
+// (substring), client_id, status, created_after and connected (true/false).
+func (h *Handler) ListTunnels(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	search := tunnelSearch{
+		subdomain: q.Get("subdomain"),
+		clientID:  q.Get("client_id"),
+		status:    q.Get("status"),
+	}
+	var err error
+	if search.createdAfter, err = parseCreatedAfter(r); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if search.connected, err = parseBool(r, "connected"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var tunnels []TunnelItem
-	for _, item := range out.Items {
-		var t TunnelItem
-		if err := attributevalue.UnmarshalMap(item, &t); err != nil {
-			continue
-		}
-		if statusFilter != "" && t.Status != statusFilter {
-			continue
-		}
-		tunnels = append(tunnels, t)
+	tunnels, err := h.searchTunnels(context.Background(), search)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to search tunnels: "+err.Error())
+		return
 	}
 
 	active := 0
@@ -67,3 +124,512 @@ func (h *Handler) ListTunnels(w http.ResponseWriter, r *http.Request) {
 		"inactive": inactive,
 	})
 }
+
+// GetTunnelEvents returns the event history of a tunnel, newest first
+func (h *Handler) GetTunnelEvents(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.PathValue("id")
+	if tunnelID == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id required")
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+
+	ctx := context.Background()
+	out, err := h.ddbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName("tunnel-events")),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to query tunnel events: "+err.Error())
+		return
+	}
+
+	events := []TunnelEventItem{}
+	for _, item := range out.Items {
+		var e TunnelEventItem
+		if err := attributevalue.UnmarshalMap(item, &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tunnel_id": tunnelID,
+		"events":    events,
+		"count":     len(events),
+	})
+}
+
+// eventRetention matches how long the tunnel Lambdas keep tunnel events
+const eventRetention = 30 * 24 * time.Hour
+
+// DisconnectTunnel force-disconnects a tunnel: it marks the tunnel inactive,
+// closes every WebSocket connection it has and records an admin "disconnected"
+// event. The record is updated first so the $disconnect handler finds nothing
+// left to detach. The CLI may reconnect on its own afterwards.
+func (h *Handler) DisconnectTunnel(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.PathValue("id")
+	if tunnelID == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id required")
+		return
+	}
+	if h.apigwClient == nil {
+		writeError(w, http.StatusServiceUnavailable, "force-disconnect not configured (WEBSOCKET_ENDPOINT missing)")
+		return
+	}
+
+	ctx := context.Background()
+	tunnel, err := h.getTunnel(ctx, tunnelID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get tunnel: "+err.Error())
+		return
+	}
+	if tunnel == nil {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	connections := tunnelConnections(*tunnel)
+	if len(connections) == 0 {
+		writeError(w, http.StatusConflict, "tunnel has no live connection")
+		return
+	}
+
+	// A connect landing between the read and this write fails the update
+	// instead of being overwritten
+	condition, names, values := versionCondition(tunnel.Version)
+	names["#status"] = "status"
+	values[":status"] = &types.AttributeValueMemberS{Value: "inactive"}
+	values[":updated_at"] = &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)}
+	_, err = h.ddbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName("tunnels")),
+		Key:                       tunnelKey(tunnelID),
+		UpdateExpression:          aws.String("SET #version = :next_version, #status = :status, updated_at = :updated_at REMOVE connection_id, connection_ids"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			writeError(w, http.StatusConflict, "tunnel changed while disconnecting, try again")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to update tunnel: "+err.Error())
+		return
+	}
+
+	disconnected, failures := h.closeConnections(ctx, connections, nil)
+
+	if err := h.recordAdminEvent(ctx, *tunnel, "disconnected", "admin"); err != nil {
+		failures = append(failures, "failed to record event: "+err.Error())
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"tunnel_id":    tunnelID,
+		"status":       "inactive",
+		"disconnected": disconnected,
+		"failures":     failures,
+	})
+}
+
+// searchTunnels reads the tunnels matching search from the narrowest source:
+// the client_id index, the sparse connection_id index (connected tunnels
+// only), the status index, or a table scan. Remaining filters run in DynamoDB.
+func (h *Handler) searchTunnels(ctx context.Context, search tunnelSearch) ([]TunnelItem, error) {
+	table := h.tableName("tunnels")
+	expr := newExpression()
+
+	if search.subdomain != "" {
+		expr.where(fmt.Sprintf("contains(%s, %s)", expr.name("subdomain"), expr.value(&types.AttributeValueMemberS{Value: search.subdomain})))
+	}
+	if search.connected != nil && !*search.connected {
+		expr.where(fmt.Sprintf("attribute_not_exists(%s)", expr.name("connection_id")))
+	}
+
+	tunnels := []TunnelItem{}
+	collect := func(items []map[string]types.AttributeValue) bool {
+		for _, item := range items {
+			var t TunnelItem
+			if err := attributevalue.UnmarshalMap(item, &t); err != nil {
+				continue
+			}
+			tunnels = append(tunnels, t)
+		}
+		return true
+	}
+
+	// Key condition for the status index; a plain filter everywhere else
+	var keyCondition string
+	switch {
+	case search.clientID != "":
+		keyCondition = fmt.Sprintf("%s = %s", expr.name("client_id"), expr.value(&types.AttributeValueMemberS{Value: search.clientID}))
+		if search.status != "" {
+			expr.where(fmt.Sprintf("%s = %s", expr.name("status"), expr.value(&types.AttributeValueMemberS{Value: search.status})))
+		}
+		if !search.createdAfter.IsZero() {
+			expr.where(fmt.Sprintf("%s > %s", expr.name("created_at"), expr.value(createdAfterValue(search.createdAfter))))
+		}
+		if search.connected != nil && *search.connected {
+			expr.where(fmt.Sprintf("attribute_exists(%s)", expr.name("connection_id")))
+		}
+		err := h.queryPages(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(table),
+			IndexName:                 aws.String(clientIDIndex),
+			KeyConditionExpression:    aws.String(keyCondition),
+			FilterExpression:          expr.filter(),
+			ExpressionAttributeNames:  expr.attributeNames(),
+			ExpressionAttributeValues: expr.attributeValues(),
+		}, collect)
+		return tunnels, err
+
+	case search.status != "":
+		keyCondition = fmt.Sprintf("%s = %s", expr.name("status"), expr.value(&types.AttributeValueMemberS{Value: search.status}))
+		if !search.createdAfter.IsZero() {
+			keyCondition += fmt.Sprintf(" AND %s > %s", expr.name("created_at"), expr.value(createdAfterValue(search.createdAfter)))
+		}
+		if search.connected != nil && *search.connected {
+			expr.where(fmt.Sprintf("attribute_exists(%s)", expr.name("connection_id")))
+		}
+		err := h.queryPages(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(table),
+			IndexName:                 aws.String(statusCreatedAtIndex),
+			KeyConditionExpression:    aws.String(keyCondition),
+			FilterExpression:          expr.filter(),
+			ExpressionAttributeNames:  expr.attributeNames(),
+			ExpressionAttributeValues: expr.attributeValues(),
+		}, collect)
+		return tunnels, err
+	}
+
+	if !search.createdAfter.IsZero() {
+		expr.where(fmt.Sprintf("%s > %s", expr.name("created_at"), expr.value(createdAfterValue(search.createdAfter))))
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(table),
+		FilterExpression:          expr.filter(),
+		ExpressionAttributeNames:  expr.attributeNames(),
+		ExpressionAttributeValues: expr.attributeValues(),
+	}
+	if search.connected != nil && *search.connected {
+		// Only connected tunnels carry connection_id, so the index holds exactly them
+		input.IndexName = aws.String(connectionIDIndex)
+	}
+	err := h.scanPages(ctx, input, func(out *dynamodb.ScanOutput) bool {
+		return collect(out.Items)
+	})
+	return tunnels, err
+}
+
+// tunnelConnections returns the tunnel's live connections, primary first
+func tunnelConnections(t TunnelItem) []string {
+	var connections []string
+	if t.ConnectionID != "" {
+		connections = append(connections, t.ConnectionID)
+	}
+	for _, id := range t.ConnectionIDs {
+		if id != t.ConnectionID {
+			connections = append(connections, id)
+		}
+	}
+	return connections
+}
+
+// getTunnel reads a tunnel with a consistent read; it returns nil if there is none
+func (h *Handler) getTunnel(ctx context.Context, tunnelID string) (*TunnelItem, error) {
+	out, err := h.ddbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(h.tableName("tunnels")),
+		Key:            tunnelKey(tunnelID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var tunnel TunnelItem
+	if err := attributevalue.UnmarshalMap(out.Item, &tunnel); err != nil {
+		return nil, err
+	}
+	return &tunnel, nil
+}
+
+func tunnelKey(tunnelID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+	}
+}
+
+// versionCondition is the optimistic check the tunnel Lambdas put on every
+// tunnel write: the record must still be at version, and the write sets
+// :next_version. Records written before versioning count as version 0.
+func versionCondition(version int64) (string, map[string]string, map[string]types.AttributeValue) {
+	condition := "#version = :expected_version"
+	if version == 0 {
+		condition = "(attribute_not_exists(#version) OR #version = :expected_version)"
+	}
+	return condition,
+		map[string]string{"#version": "version"},
+		map[string]types.AttributeValue{
+			":expected_version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+			":next_version":     &types.AttributeValueMemberN{Value: strconv.FormatInt(version+1, 10)},
+		}
+}
+
+// closeConnections closes WebSocket connections, sending notice first when it
+// is not nil. Connections that are already gone count as closed.
+func (h *Handler) closeConnections(ctx context.Context, connections []string, notice []byte) ([]string, []string) {
+	closed := []string{}
+	var failures []string
+	for _, connectionID := range connections {
+		if notice != nil {
+			// Best effort: the connection may already be gone
+			_, _ = h.apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: aws.String(connectionID),
+				Data:         notice,
+			})
+		}
+
+		_, err := h.apigwClient.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+			ConnectionId: aws.String(connectionID),
+		})
+		var gone *apigwtypes.GoneException
+		if err != nil && !errors.As(err, &gone) {
+			failures = append(failures, connectionID+": "+err.Error())
+			continue
+		}
+		closed = append(closed, connectionID)
+	}
+	return closed, failures
+}
+
+// recordAdminEvent adds an admin-initiated entry to the tunnel's event history
+func (h *Handler) recordAdminEvent(ctx context.Context, t TunnelItem, eventType, reason string) error {
+	now := time.Now()
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	item, err := attributevalue.MarshalMap(TunnelEventItem{
+		TunnelID: t.TunnelID,
+		// Same sortable format the tunnel Lambdas use for event IDs
+		EventID:      now.UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix),
+		Type:         eventType,
+		ClientID:     t.ClientID,
+		ConnectionID: t.ConnectionID,
+		Reason:       reason,
+		Actor:        "admin",
+		CreatedAt:    now,
+		TTL:          now.Add(eventRetention).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = h.ddbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(h.tableName("tunnel-events")),
+		Item:      item,
+	})
+	return err
+}
+
+// DeleteTunnel removes a tunnel, its domain record, its in-flight requests and
+// its live connections. The first call without ?confirm= only returns a
+// confirmation token (428); repeating the call with that token deletes. The
+// token is bound to the tunnel's version, so it goes stale if the tunnel
+// changes in between.
+func (h *Handler) DeleteTunnel(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.PathValue("id")
+	if tunnelID == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id required")
+		return
+	}
+
+	ctx := context.Background()
+	tunnel, err := h.getTunnel(ctx, tunnelID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get tunnel: "+err.Error())
+		return
+	}
+	if tunnel == nil {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	token := deleteConfirmToken(*tunnel)
+	switch confirm := r.URL.Query().Get("confirm"); {
+	case confirm == "":
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":         "confirmation required: repeat the request with ?confirm=<confirm_token>",
+			"confirm_token": token,
+			"tunnel_id":     tunnel.TunnelID,
+			"domain":        tunnel.Domain,
+			"status":        tunnel.Status,
+		})
+		return
+	case confirm != token:
+		writeError(w, http.StatusPreconditionFailed, "confirmation token does not match; the tunnel may have changed, request a new one")
+		return
+	}
+
+	// Remove the tunnel and its domain together so neither is left dangling
+	condition, names, values := versionCondition(tunnel.Version)
+	delete(values, ":next_version")
+	items := []types.TransactWriteItem{{
+		Delete: &types.Delete{
+			TableName:                 aws.String(h.tableName("tunnels")),
+			Key:                       tunnelKey(tunnelID),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		},
+	}}
+	if tunnel.Domain != "" {
+		items = append(items, types.TransactWriteItem{
+			Delete: &types.Delete{
+				TableName: aws.String(h.tableName("domains")),
+				Key: map[string]types.AttributeValue{
+					"domain": &types.AttributeValueMemberS{Value: tunnel.Domain},
+				},
+			},
+		})
+	}
+	// The domain stays reserved for its owner, as when the CLI deletes it
+	released := repository.ReleasedRecord(&models.Tunnel{
+		TunnelID: tunnel.TunnelID,
+		ClientID: tunnel.ClientID,
+		Domain:   tunnel.Domain,
+	}, h.cfg.SubdomainQuarantine, time.Now())
+	if released != nil {
+		item, err := attributevalue.MarshalMap(released)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to release domain: "+err.Error())
+			return
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(h.tableName("released-domains")),
+				Item:      item,
+			},
+		})
+	}
+	if _, err := h.ddbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			writeError(w, http.StatusConflict, "tunnel changed while deleting, request a new confirmation token")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to delete tunnel: "+err.Error())
+		return
+	}
+
+	var failures []string
+	expired, err := h.expirePendingRequests(ctx, tunnelID)
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	// Tell every connected CLI the tunnel is gone so it doesn't reconnect.
+	// The record is already deleted, so $disconnect finds nothing to update.
+	disconnected := []string{}
+	if connections := tunnelConnections(*tunnel); len(connections) > 0 {
+		if h.apigwClient == nil {
+			failures = append(failures, "connections left open: WEBSOCKET_ENDPOINT missing")
+		} else {
+			notice, _ := json.Marshal(map[string]interface{}{
+				"action": "tunnel_deleted",
+				"data":   map[string]string{"tunnel_id": tunnelID},
+			})
+			var closeFailures []string
+			disconnected, closeFailures = h.closeConnections(ctx, connections, notice)
+			failures = append(failures, closeFailures...)
+		}
+	}
+
+	if err := h.recordAdminEvent(ctx, *tunnel, "deleted", "admin"); err != nil {
+		failures = append(failures, "failed to record event: "+err.Error())
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tunnel_id":        tunnelID,
+		"deleted":          true,
+		"expired_requests": expired,
+		"disconnected":     disconnected,
+		"failures":         failures,
+	})
+}
+
+// deleteConfirmToken derives the token DeleteTunnel asks to be echoed back
+func deleteConfirmToken(t TunnelItem) string {
+	sum := sha256.Sum256([]byte(t.TunnelID + ":" + strconv.FormatInt(t.Version, 10) + ":" + t.UpdatedAt.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// expirePendingRequests ends the tunnel's outstanding requests as
+// tunnel_disconnected with a 410 so callers stop polling, and lets TTL remove them within a minute. Deleting
+// them outright would leave callers waiting for their poll timeout.
+func (h *Handler) expirePendingRequests(ctx context.Context, tunnelID string) (int, error) {
+	requests, err := h.scanPendingRequests(ctx, pendingFilter{tunnelID: tunnelID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan pending requests: %w", err)
+	}
+
+	const reason = "Tunnel was deleted"
+	body, _ := json.Marshal(map[string]string{
+		"error": reason,
+		"code":  "tunnel_disconnected",
+	})
+
+	expired := 0
+	for _, p := range requests {
+		if p.Status != "pending" && p.Status != "waiting_upload" {
+			continue
+		}
+		_, err := h.ddbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(h.tableName("pending-requests")),
+			Key: map[string]types.AttributeValue{
+				"request_id": &types.AttributeValueMemberS{Value: p.RequestID},
+			},
+			UpdateExpression: aws.String("SET #s = :status, #error = :reason, response_status = :code, response_headers = :headers, response_body = :body, stream_done = :done, #ttl = :ttl"),
+			ExpressionAttributeNames: map[string]string{
+				"#s":     "status",
+				"#error": "error",
+				"#ttl":   "ttl",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: "tunnel_disconnected"},
+				":reason": &types.AttributeValueMemberS{Value: reason},
+				":code":   &types.AttributeValueMemberN{Value: "410"},
+				":headers": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+					"Content-Type": &types.AttributeValueMemberS{Value: "application/json"},
+				}},
+				":body": &types.AttributeValueMemberS{Value: string(body)},
+				":done": &types.AttributeValueMemberBOOL{Value: true},
+				":ttl":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)},
+			},
+		})
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire pending request %s: %w", p.RequestID, err)
+		}
+		expired++
+	}
+	return expired, nil
+}
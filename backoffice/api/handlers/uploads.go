@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultOrphanAge is how old an upload without a pending request must be
+// before cleanup deletes it, so bodies of requests still being set up are kept
+const defaultOrphanAge = time.Hour
+
+// uploadPrefixes are the folders of the uploads bucket: request bodies staged
+// by http-proxy and response bodies staged by the CLI
+var uploadPrefixes = []string{"requests/", "responses/"}
+
+// UploadObject is a staged body in the uploads bucket, linked to the pending
+// request it belongs to
+type UploadObject struct {
+	Key           string    `json:"key"`
+	Kind          string    `json:"kind"` // request or response
+	RequestID     string    `json:"request_id"`
+	Size          int64     `json:"size"`
+	LastModified  time.Time `json:"last_modified"`
+	AgeSeconds    int64     `json:"age_seconds"`
+	PendingStatus string    `json:"pending_status,omitempty"` // Status of the pending request; "" when it no longer exists
+	Orphan        bool      `json:"orphan"`
+}
+
+// uploadsBucket returns the uploads bucket name following the naming convention
+func (h *Handler) uploadsBucket() string {
+	return h.cfg.ProjectName + "-uploads-" + h.cfg.Environment
+}
+
+// listUploads lists the objects under the given prefixes and links each to
+// its pending request. truncated is set when the listing of a prefix stopped
+// after maxScanPages pages.
+func (h *Handler) listUploads(ctx context.Context, prefixes []string) (objects []UploadObject, truncated bool, err error) {
+	now := time.Now()
+	for _, prefix := range prefixes {
+		paginator := s3.NewListObjectsV2Paginator(h.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(h.uploadsBucket()),
+			Prefix: aws.String(prefix),
+		})
+		for pages := 0; paginator.HasMorePages(); pages++ {
+			if pages == maxScanPages {
+				truncated = true
+				break
+			}
+			out, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, obj := range out.Contents {
+				key := aws.ToString(obj.Key)
+				// Keys are {requests|responses}/{request_id}/body
+				parts := strings.Split(key, "/")
+				requestID := ""
+				if len(parts) >= 2 {
+					requestID = parts[1]
+				}
+				modified := aws.ToTime(obj.LastModified)
+				objects = append(objects, UploadObject{
+					Key:          key,
+					Kind:         strings.TrimSuffix(parts[0], "s"),
+					RequestID:    requestID,
+					Size:         aws.ToInt64(obj.Size),
+					LastModified: modified,
+					AgeSeconds:   int64(now.Sub(modified).Seconds()),
+				})
+			}
+		}
+	}
+
+	statuses, err := h.pendingStatuses(ctx, objects)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range objects {
+		objects[i].PendingStatus = statuses[objects[i].RequestID]
+		objects[i].Orphan = objects[i].PendingStatus == ""
+	}
+	return objects, truncated, nil
+}
+
+// pendingStatuses returns the status of each pending request referenced by
+// objects, keyed by request ID; requests that no longer exist are left out
+func (h *Handler) pendingStatuses(ctx context.Context, objects []UploadObject) (map[string]string, error) {
+	table := h.tableName("pending-requests")
+	statuses := map[string]string{}
+
+	var ids []string
+	seen := map[string]bool{}
+	for _, obj := range objects {
+		if obj.RequestID != "" && !seen[obj.RequestID] {
+			seen[obj.RequestID] = true
+			ids = append(ids, obj.RequestID)
+		}
+	}
+
+	// BatchGetItem reads at most 100 keys per call
+	for start := 0; start < len(ids); start += 100 {
+		end := start + 100
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]map[string]types.AttributeValue, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, map[string]types.AttributeValue{
+				"request_id": &types.AttributeValueMemberS{Value: id},
+			})
+		}
+
+		request := map[string]types.KeysAndAttributes{
+			table: {
+				Keys:                     keys,
+				ProjectionExpression:     aws.String("request_id, #status"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+			},
+		}
+		for attempt := 0; len(request) > 0; attempt++ {
+			if attempt == 5 {
+				return nil, fmt.Errorf("pending requests still unprocessed after %d attempts", attempt)
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			out, err := h.ddbClient.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Responses[table] {
+				id, _ := item["request_id"].(*types.AttributeValueMemberS)
+				status, _ := item["status"].(*types.AttributeValueMemberS)
+				if id != nil && status != nil {
+					statuses[id.Value] = status.Value
+				}
+			}
+			request = out.UnprocessedKeys
+		}
+	}
+	return statuses, nil
+}
+
+// uploadPrefixParam reads the prefix query parameter (requests or responses);
+// both folders are listed when it is empty
+func uploadPrefixParam(r *http.Request) ([]string, error) {
+	switch r.URL.Query().Get("prefix") {
+	case "":
+		return uploadPrefixes, nil
+	case "requests":
+		return []string{"requests/"}, nil
+	case "responses":
+		return []string{"responses/"}, nil
+	default:
+		return nil, fmt.Errorf("prefix must be requests or responses")
+	}
+}
+
+// ListUploads lists staged bodies in the uploads bucket with their size, age
+// and pending request status. ?prefix=requests|responses limits the folder and
+// ?orphans=true keeps only objects whose pending request is gone.
+func (h *Handler) ListUploads(w http.ResponseWriter, r *http.Request) {
+	prefixes, err := uploadPrefixParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	orphansOnly := r.URL.Query().Get("orphans") == "true"
+
+	objects, truncated, err := h.listUploads(context.Background(), prefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list uploads: "+err.Error())
+		return
+	}
+
+	result := []UploadObject{}
+	var totalBytes, orphanBytes int64
+	orphans := 0
+	for _, obj := range objects {
+		totalBytes += obj.Size
+		if obj.Orphan {
+			orphans++
+			orphanBytes += obj.Size
+		} else if orphansOnly {
+			continue
+		}
+		result = append(result, obj)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"bucket":       h.uploadsBucket(),
+		"objects":      result,
+		"count":        len(objects),
+		"total_bytes":  totalBytes,
+		"orphans":      orphans,
+		"orphan_bytes": orphanBytes,
+		"truncated":    truncated,
+	})
+}
+
+// CleanupUploads deletes orphaned uploads (objects whose pending request no
+// longer exists) older than older_than (default 1h). ?prefix= limits the
+// folder as for ListUploads and ?dry_run=true only reports what would go.
+func (h *Handler) CleanupUploads(w http.ResponseWriter, r *http.Request) {
+	olderThan, err := parseOlderThan(r, defaultOrphanAge)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefixes, err := uploadPrefixParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	ctx := context.Background()
+	objects, truncated, err := h.listUploads(ctx, prefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list uploads: "+err.Error())
+		return
+	}
+
+	var stale []s3types.ObjectIdentifier
+	var staleBytes int64
+	for _, obj := range objects {
+		if obj.Orphan && time.Duration(obj.AgeSeconds)*time.Second >= olderThan {
+			stale = append(stale, s3types.ObjectIdentifier{Key: aws.String(obj.Key)})
+			staleBytes += obj.Size
+		}
+	}
+
+	deleted := []string{}
+	var failures []string
+	if !dryRun {
+		// DeleteObjects takes at most 1000 keys per call
+		for start := 0; start < len(stale); start += 1000 {
+			end := start + 1000
+			if end > len(stale) {
+				end = len(stale)
+			}
+			out, err := h.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(h.uploadsBucket()),
+				Delete: &s3types.Delete{Objects: stale[start:end], Quiet: aws.Bool(false)},
+			})
+			if err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			for _, d := range out.Deleted {
+				deleted = append(deleted, aws.ToString(d.Key))
+			}
+			for _, e := range out.Errors {
+				failures = append(failures, aws.ToString(e.Key)+": "+aws.ToString(e.Message))
+			}
+		}
+	} else {
+		for _, obj := range stale {
+			deleted = append(deleted, aws.ToString(obj.Key))
+		}
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"deleted":    deleted,
+		"count":      len(deleted),
+		"bytes":      staleBytes,
+		"failures":   failures,
+		"older_than": olderThan.String(),
+		"dry_run":    dryRun,
+		"truncated":  truncated,
+	})
+}
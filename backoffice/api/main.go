@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	golambda "github.com/aws/aws-lambda-go/lambda"
@@ -12,6 +15,7 @@ import (
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
 
 	"github.com/lmanrique/tunnel/backoffice/api/handlers"
+	"github.com/lmanrique/tunnel/lambdas/shared/redact"
 )
 
 var httpLambda *httpadapter.HandlerAdapterV2
@@ -27,24 +31,94 @@ func init() {
 		ProjectName:              getEnv("PROJECT_NAME", "tunnel"),
 		Environment:              getEnv("ENVIRONMENT", "dev"),
 		AdminAPIKey:              os.Getenv("ADMIN_API_KEY"),
+		AuthDisabled:             os.Getenv("ADMIN_AUTH_DISABLED") == "true",
 		CloudFrontDistributionID: os.Getenv("CLOUDFRONT_DISTRIBUTION_ID"),
 		Region:                   getEnv("AWS_REGION", "us-east-1"),
+		WebSocketEndpoint:        os.Getenv("WEBSOCKET_ENDPOINT"),
+		RestAPIID:                os.Getenv("REST_API_ID"),
+		WebSocketAPIID:           os.Getenv("WEBSOCKET_API_ID"),
+		HealthCheckAPIKey:        os.Getenv("HEALTH_CHECK_API_KEY"),
+		AlertsTopicARN:           os.Getenv("ALERTS_TOPIC_ARN"),
+		SubdomainQuarantine:      time.Duration(getEnvInt("SUBDOMAIN_QUARANTINE_HOURS", 720)) * time.Hour,
+		Redact:                   redact.NewRules(redact.ParseList(os.Getenv("REDACT_HEADERS")), redact.ParseList(os.Getenv("REDACT_FIELDS"))),
+	}
+
+	if appCfg.AuthDisabled {
+		log.Printf("ADMIN_AUTH_DISABLED is set: every request is served as an operator")
 	}
 
 	mux := http.NewServeMux()
 	h := handlers.New(appCfg)
 
-	// Auth middleware wraps all routes
-	auth := handlers.AuthMiddleware(appCfg.AdminAPIKey)
+	// Read routes need a read-only admin; mutating routes need an operator
+	// and are audited. Every route is described in GET /api/openapi.json.
+	auth := h.RequireRole(handlers.RoleReadOnly)
+	operator := h.RequireRole(handlers.RoleOperator)
+	handle := func(pattern, role string, handler http.HandlerFunc, summary string) {
+		h.Describe(pattern, role, handler, summary)
+		switch {
+		case role == "":
+		case role == handlers.RoleReadOnly:
+			handler = auth(handler)
+		case strings.HasPrefix(pattern, "GET "):
+			handler = operator(handler)
+		default:
+			handler = operator(h.Audit(handler))
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+
+	handle("POST /api/auth/login", "", h.Login, "Log in with a username and password and get a session token")
+	handle("POST /api/auth/logout", handlers.RoleReadOnly, h.Logout, "End the current session")
+	handle("GET /api/auth/me", handlers.RoleReadOnly, h.GetMe, "Get the logged-in admin and role")
+	handle("GET /api/admin-users", handlers.RoleOperator, h.ListAdminUsers, "List backoffice users")
+	handle("POST /api/admin-users", handlers.RoleOperator, h.CreateAdminUser, "Create a backoffice user")
+	handle("PATCH /api/admin-users/{username}", handlers.RoleOperator, h.UpdateAdminUser, "Change a backoffice user's role, status or password")
 
-	mux.HandleFunc("GET /api/stats", auth(h.GetStats))
-	mux.HandleFunc("GET /api/lambdas", auth(h.ListLambdas))
-	mux.HandleFunc("GET /api/lambdas/{name}/logs", auth(h.GetLambdaLogs))
-	mux.HandleFunc("GET /api/databases", auth(h.ListDatabases))
-	mux.HandleFunc("GET /api/databases/{table}/items", auth(h.GetTableItems))
-	mux.HandleFunc("GET /api/cloudfront", auth(h.GetCloudFront))
-	mux.HandleFunc("GET /api/tunnels", auth(h.ListTunnels))
-	mux.HandleFunc("GET /api/clients", auth(h.ListClients))
+	handle("GET /api/stats", handlers.RoleReadOnly, h.GetStats, "Get totals for the dashboard")
+	handle("GET /api/health/deep", handlers.RoleReadOnly, h.GetDeepHealth, "Check every dependency of the service")
+	handle("GET /api/audit", handlers.RoleReadOnly, h.ListAudit, "List the audit log of mutating calls")
+	handle("GET /api/lambdas", handlers.RoleReadOnly, h.ListLambdas, "List the service's Lambda functions")
+	handle("GET /api/lambdas/{name}/config", handlers.RoleReadOnly, h.GetLambdaConfig, "Get a Lambda's configuration")
+	handle("PATCH /api/lambdas/{name}/config", handlers.RoleOperator, h.UpdateLambdaConfig, "Change a Lambda's configuration")
+	handle("POST /api/lambdas/{name}/invoke", handlers.RoleOperator, h.InvokeLambda, "Invoke a Lambda with a test event")
+	handle("GET /api/lambdas/{name}/logs", handlers.RoleReadOnly, h.GetLambdaLogs, "Get a Lambda's recent logs")
+	handle("GET /api/lambdas/{name}/logs/stream", handlers.RoleReadOnly, h.StreamLambdaLogs, "Stream a Lambda's logs")
+	handle("GET /api/lambdas/{name}/metrics", handlers.RoleReadOnly, h.GetLambdaMetrics, "Get a Lambda's metrics")
+	handle("GET /api/metrics/overview", handlers.RoleReadOnly, h.GetMetricsOverview, "Get service-wide metrics")
+	handle("GET /api/alarms", handlers.RoleReadOnly, h.ListAlarms, "List CloudWatch alarms")
+	handle("POST /api/alarms", handlers.RoleOperator, h.CreateAlarm, "Create a CloudWatch alarm")
+	handle("POST /api/alarms/defaults", handlers.RoleOperator, h.CreateDefaultAlarms, "Create the default alarms")
+	handle("DELETE /api/alarms/{name}", handlers.RoleOperator, h.DeleteAlarm, "Delete a CloudWatch alarm")
+	handle("POST /api/logs/query", handlers.RoleReadOnly, h.QueryLogs, "Start a CloudWatch Logs Insights query")
+	handle("GET /api/logs/query/{id}", handlers.RoleReadOnly, h.GetLogQueryResults, "Get the results of a logs query")
+	handle("GET /api/databases", handlers.RoleReadOnly, h.ListDatabases, "List the DynamoDB tables")
+	handle("GET /api/databases/{table}/items", handlers.RoleReadOnly, h.GetTableItems, "Browse a table's items")
+	handle("GET /api/cloudfront", handlers.RoleReadOnly, h.GetCloudFront, "Get the CloudFront distribution")
+	handle("POST /api/cloudfront/invalidate", handlers.RoleOperator, h.InvalidateCloudFront, "Invalidate CloudFront paths")
+	handle("GET /api/cloudfront/invalidations", handlers.RoleReadOnly, h.ListInvalidations, "List CloudFront invalidations")
+	handle("GET /api/cloudfront/invalidations/{id}", handlers.RoleReadOnly, h.GetInvalidation, "Get a CloudFront invalidation")
+	handle("GET /api/tunnels", handlers.RoleReadOnly, h.ListTunnels, "List all tunnels")
+	handle("GET /api/tunnels/{id}/events", handlers.RoleReadOnly, h.GetTunnelEvents, "List a tunnel's events")
+	handle("GET /api/tunnels/{id}/requests", handlers.RoleReadOnly, h.ListTunnelRequests, "List a tunnel's recent requests, redacted")
+	handle("GET /api/tunnels/{id}/analytics", handlers.RoleReadOnly, h.GetTunnelAnalytics, "Get a tunnel's traffic analytics")
+	handle("POST /api/tunnels/{id}/disconnect", handlers.RoleOperator, h.DisconnectTunnel, "Close a tunnel's connections")
+	handle("DELETE /api/tunnels/{id}", handlers.RoleOperator, h.DeleteTunnel, "Delete a tunnel")
+	handle("GET /api/connections", handlers.RoleReadOnly, h.ListConnections, "List live WebSocket connections")
+	handle("GET /api/connections/{id}", handlers.RoleReadOnly, h.GetConnection, "Get a WebSocket connection")
+	handle("GET /api/domains", handlers.RoleReadOnly, h.ListDomains, "List domain records")
+	handle("POST /api/domains/repair", handlers.RoleOperator, h.RepairDomains, "Repair orphaned or dangling domain records")
+	handle("GET /api/clients", handlers.RoleReadOnly, h.ListClients, "List clients")
+	handle("GET /api/clients/stale", handlers.RoleReadOnly, h.StaleClients, "List active clients unused for ?days")
+	handle("POST /api/clients", handlers.RoleOperator, h.CreateClient, "Create a client")
+	handle("PATCH /api/clients/{id}", handlers.RoleOperator, h.UpdateClient, "Change a client's status, plan or tunnel quota")
+	handle("GET /api/export/{table}", handlers.RoleReadOnly, h.ExportTable, "Export a table")
+	handle("GET /api/pending-requests", handlers.RoleReadOnly, h.ListPendingRequests, "List pending requests")
+	handle("DELETE /api/pending-requests", handlers.RoleOperator, h.PurgePendingRequests, "Purge finished or expired pending requests")
+	handle("DELETE /api/pending-requests/{id}", handlers.RoleOperator, h.DeletePendingRequest, "Delete a pending request")
+	handle("GET /api/uploads", handlers.RoleReadOnly, h.ListUploads, "List large-body uploads")
+	handle("DELETE /api/uploads", handlers.RoleOperator, h.CleanupUploads, "Clean up orphaned uploads")
+	handle("GET /api/openapi.json", handlers.RoleReadOnly, h.GetOpenAPI, "Get this API's OpenAPI description")
 
 	httpLambda = httpadapter.NewV2(mux)
 }
@@ -63,3 +137,11 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v < 0 {
+		return fallback
+	}
+	return v
+}
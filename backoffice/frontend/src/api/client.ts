@@ -1,4 +1,4 @@
-import { useAuthStore } from '../store/useStore'
+import { useAuthStore, type AdminRole } from '../store/useStore'
 
 const BASE = import.meta.env.VITE_API_URL ?? ''
 
@@ -23,6 +23,90 @@ async function apiFetch<T>(path: string, options?: RequestInit): Promise<T> {
   return res.json() as Promise<T>
 }
 
+// streamLambdaLogs tails a Lambda's logs over server-sent events until signal
+// aborts. fetch is used instead of EventSource so the Authorization header can
+// be sent; when the server ends a stream it is reopened after the last event.
+export async function streamLambdaLogs(
+  name: string,
+  onEvent: (event: LogEvent) => void,
+  signal: AbortSignal,
+): Promise<void> {
+  let lastId = ''
+  while (!signal.aborted) {
+    const { apiKey } = useAuthStore.getState()
+    const res = await fetch(`${BASE}/api/lambdas/${encodeURIComponent(name)}/logs/stream`, {
+      signal,
+      headers: {
+        ...(apiKey ? { Authorization: `Bearer ${apiKey}` } : {}),
+        ...(lastId ? { 'Last-Event-ID': lastId } : {}),
+      },
+    })
+    if (!res.ok || !res.body) throw new Error(`HTTP ${res.status}`)
+
+    const reader = res.body.pipeThrough(new TextDecoderStream()).getReader()
+    let buffer = ''
+    for (;;) {
+      const { value, done } = await reader.read()
+      if (done) break
+      buffer += value
+      let end: number
+      while ((end = buffer.indexOf('\n\n')) >= 0) {
+        const block = buffer.slice(0, end)
+        buffer = buffer.slice(end + 2)
+        let event = 'message'
+        let data = ''
+        for (const line of block.split('\n')) {
+          if (line.startsWith('id: ')) lastId = line.slice(4)
+          else if (line.startsWith('event: ')) event = line.slice(7)
+          else if (line.startsWith('data: ')) data += line.slice(6)
+        }
+        if (event === 'log' && data) onEvent(JSON.parse(data) as LogEvent)
+        if (event === 'error' && data) throw new Error((JSON.parse(data) as { error: string }).error)
+      }
+    }
+    await new Promise((resolve) => setTimeout(resolve, 1000))
+  }
+}
+
+// getDeepHealth runs the synthetic end-to-end check. A failing check answers
+// 503 with the same report, so that status is not treated as an error here.
+export async function getDeepHealth(): Promise<DeepHealth> {
+  const { apiKey } = useAuthStore.getState()
+  const res = await fetch(`${BASE}/api/health/deep`, {
+    headers: apiKey ? { Authorization: `Bearer ${apiKey}` } : {},
+  })
+  const body = await res.json().catch(() => ({}))
+  if (res.status === 401) {
+    useAuthStore.getState().logout()
+    throw new Error('Unauthorized')
+  }
+  if (!res.ok && !(body as DeepHealth).stages) {
+    throw new Error((body as { error?: string }).error ?? `HTTP ${res.status}`)
+  }
+  return body as DeepHealth
+}
+
+// exportTable downloads one part of a table export; pass the returned
+// nextToken back in until it is empty
+export async function exportTable(
+  table: 'tunnels' | 'clients' | 'domains' | 'usage',
+  format: 'csv' | 'json',
+  nextToken?: string,
+): Promise<{ blob: Blob; rows: number; nextToken: string }> {
+  const { apiKey } = useAuthStore.getState()
+  const params = new URLSearchParams({ format })
+  if (nextToken) params.set('next_token', nextToken)
+  const res = await fetch(`${BASE}/api/export/${table}?${params}`, {
+    headers: apiKey ? { Authorization: `Bearer ${apiKey}` } : {},
+  })
+  if (!res.ok) throw new Error(`HTTP ${res.status}`)
+  return {
+    blob: await res.blob(),
+    rows: Number(res.headers.get('X-Row-Count') ?? 0),
+    nextToken: res.headers.get('X-Next-Token') ?? '',
+  }
+}
+
 // ---- Types ----
 
 export interface LambdaInfo {
@@ -79,14 +163,315 @@ export interface TunnelItem {
   subdomain: string
   status: string
   connection_id?: string
+  connection_policy?: 'reject' | 'takeover' | 'multi'
+  connection_ids?: string[]
+  connection_info?: ConnectionInfo
+  region?: string
+  block_bots?: boolean
+  robots_txt?: boolean
+  allowed_countries?: string[]
+  allowed_methods?: string[]
+  stripped_headers?: string[]
+  response_headers?: string[]
+  stripped_response_headers?: string[]
+  last_ping_at?: string
   created_at: string
   updated_at: string
 }
 
+export interface ConnectionInfo {
+  cli_version?: string
+  platform?: string
+  source_ip?: string
+  user_agent?: string
+  connected_at: string
+}
+
+export interface TunnelEvent {
+  tunnel_id: string
+  event_id: string
+  type: 'created' | 'connected' | 'disconnected' | 'rejected' | 'deleted'
+  client_id?: string
+  connection_id?: string
+  source_ip?: string
+  user_agent?: string
+  cli_version?: string
+  platform?: string
+  reason?: string
+  actor?: string
+  created_at: string
+}
+
+// Headers and body_preview are only logged when http-proxy has
+// LOG_REQUEST_DETAILS, and are redacted
+export interface RequestLogEntry {
+  tunnel_id: string
+  log_id: string
+  request_id: string
+  method: string
+  path: string
+  status_code: number
+  duration_ms: number
+  bytes_in: number
+  bytes_out: number
+  source_ip?: string
+  user_agent?: string
+  country?: string
+  stripped_headers?: string[]
+  headers?: Record<string, string>
+  body_preview?: string
+  created_at: string
+}
+
+export interface TunnelSearch {
+  subdomain?: string
+  clientId?: string
+  status?: string
+  createdAfter?: string
+  connected?: boolean
+}
+
+export interface AdminUser {
+  username: string
+  role: AdminRole
+  status: 'active' | 'disabled'
+  created_at: string
+  created_by?: string
+  last_login_at?: string
+}
+
+export type ClientPlan = 'free' | 'pro' | 'enterprise'
+
 export interface ClientItem {
   client_id: string
   status: string
+  plan?: ClientPlan
+  max_tunnels?: number
+  created_at: string
+  last_used_at?: string
+  last_used_ip?: string
+  subdomain_prefix?: string
+}
+
+export interface PendingRequestItem {
+  request_id: string
+  tunnel_id: string
+  method: string
+  path: string
+  headers?: Record<string, string>
+  body_size: number
+  status:
+    | 'pending'
+    | 'waiting_upload'
+    | 'completed'
+    | 'failed_upload'
+    | 'tunnel_disconnected'
+    | 'upstream_error'
+    | 'expired'
+  response_status?: number
+  error?: string
   created_at: string
+  age_seconds: number
+  ttl: number
+}
+
+export interface UploadObject {
+  key: string
+  kind: 'request' | 'response'
+  request_id: string
+  size: number
+  last_modified: string
+  age_seconds: number
+  pending_status?: PendingRequestItem['status']
+  orphan: boolean
+}
+
+export interface InvalidationInfo {
+  id: string
+  status: 'InProgress' | 'Completed'
+  create_time: string
+  paths?: string[]
+  requested_by?: string
+}
+
+export interface AuditEntry {
+  date: string
+  audit_id: string
+  actor: string
+  method: string
+  endpoint: string
+  path: string
+  query?: string
+  target?: string
+  status_code: number
+  outcome: 'success' | 'failure'
+  duration_ms: number
+  source_ip?: string
+  created_at: string
+}
+
+export interface AnalyticsBucket {
+  start: string
+  requests: number
+  errors: number
+  client_errors: number
+  error_rate: number
+  bytes_in: number
+  bytes_out: number
+}
+
+export interface AnalyticsTop {
+  key: string
+  requests: number
+  errors: number
+  bytes_out: number
+}
+
+export interface TunnelAnalytics {
+  tunnel_id: string
+  window: '1h' | '24h' | '7d' | '30d'
+  since: string
+  bucket_seconds: number
+  buckets: AnalyticsBucket[]
+  totals: AnalyticsBucket
+  p50_ms: number
+  p95_ms: number
+  top_paths: AnalyticsTop[]
+  top_source_ips: AnalyticsTop[]
+  truncated: boolean
+}
+
+export type DomainHealth = 'ok' | 'dangling' | 'mismatched'
+
+export type ConnectionState = 'live' | 'gone' | 'unprobed' | 'remote' | 'error'
+
+export interface ConnectionItem {
+  connection_id: string
+  tunnel_id: string
+  client_id: string
+  domain: string
+  primary: boolean
+  region: string
+  stage: string
+  connected_at?: string
+  last_ping_at?: string
+  last_active_at?: string
+  source_ip?: string
+  user_agent?: string
+  cli_version?: string
+  platform?: string
+  state: ConnectionState
+  probe_error?: string
+}
+
+export interface DomainItem {
+  domain: string
+  tunnel_id: string
+  client_id: string
+  created_at: string
+  tunnel_exists: boolean
+  tunnel_domain?: string
+  tunnel_status?: string
+  health: DomainHealth
+}
+
+export interface LambdaConfig extends LambdaInfo {
+  tunables?: Record<string, string>
+  revision_id?: string
+}
+
+export interface LambdaConfigResponse {
+  function: LambdaConfig
+  tunable_env: string[]
+}
+
+export interface TestHTTPEvent {
+  method?: string
+  path: string
+  headers?: Record<string, string>
+  query?: Record<string, string>
+  path_parameters?: Record<string, string>
+  body?: string
+}
+
+export interface InvokeResult {
+  function: string
+  dry_run: boolean
+  status_code: number
+  duration_ms: number
+  version: string
+  function_error?: string
+  response?: unknown
+  log_tail?: string
+}
+
+export type MetricWindow = '1h' | '3h' | '12h' | '24h' | '7d'
+
+export interface MetricPoint {
+  timestamp: string
+  value: number
+}
+
+export interface MetricSeries {
+  window: MetricWindow
+  period_seconds: number
+  series: Record<string, MetricPoint[]>
+  fetched_at: string
+}
+
+export interface LogQuery {
+  query?: string
+  preset?: 'errors' | 'request_id' | 'slow' | 'cold_starts'
+  request_id?: string
+  functions?: string[]
+  since?: string
+  limit?: number
+}
+
+export interface LogQueryResult {
+  query_id: string
+  status: string
+  rows: Record<string, string>[]
+  count: number
+  records_scanned?: number
+  bytes_scanned?: number
+  query?: string
+  log_groups?: string[]
+}
+
+export type AlarmKind = 'lambda_errors' | 'proxy_5xx' | 'zero_active_tunnels' | 'dynamodb_throttling'
+
+export interface AlarmDestination {
+  type: 'email' | 'sns' | 'slack'
+  address?: string
+  topic_arn?: string
+}
+
+export interface AlarmInfo {
+  name: string
+  description: string
+  state: 'OK' | 'ALARM' | 'INSUFFICIENT_DATA'
+  state_reason: string
+  state_updated: string
+  threshold: number
+  comparison: string
+  actions: string[]
+}
+
+export interface HealthStage {
+  name: 'create_tunnel' | 'websocket_connect' | 'hello' | 'proxy_roundtrip' | 'delete_tunnel'
+  ok: boolean
+  latency_ms: number
+  error?: string
+}
+
+export interface DeepHealth {
+  healthy: boolean
+  stages: HealthStage[]
+  tunnel_id: string
+  total_ms: number
+  checked_at: string
+  environment: string
 }
 
 export interface Stats {
@@ -103,6 +488,36 @@ export interface Stats {
 // ---- API functions ----
 
 export const api = {
+  login: (username: string, password: string) =>
+    apiFetch<{ token: string; username: string; role: AdminRole; expires_at: string }>('/api/auth/login', {
+      method: 'POST',
+      body: JSON.stringify({ username, password }),
+    }),
+
+  logout: () => apiFetch<{ logged_out: boolean }>('/api/auth/logout', { method: 'POST' }),
+
+  getMe: () => apiFetch<{ username: string; role: AdminRole }>('/api/auth/me'),
+
+  listAdminUsers: () => apiFetch<{ users: AdminUser[]; count: number }>('/api/admin-users'),
+
+  createAdminUser: (user: { username: string; password: string; role: AdminRole }) =>
+    apiFetch<AdminUser>('/api/admin-users', { method: 'POST', body: JSON.stringify(user) }),
+
+  updateAdminUser: (username: string, update: { password?: string; role?: AdminRole; status?: 'active' | 'disabled' }) =>
+    apiFetch<{ user: AdminUser; sessions_ended: number }>(`/api/admin-users/${encodeURIComponent(username)}`, {
+      method: 'PATCH',
+      body: JSON.stringify(update),
+    }),
+
+  listAudit: (filter: { date?: string; actor?: string; outcome?: 'success' | 'failure'; limit?: number } = {}) => {
+    const params = new URLSearchParams()
+    if (filter.date) params.set('date', filter.date)
+    if (filter.actor) params.set('actor', filter.actor)
+    if (filter.outcome) params.set('outcome', filter.outcome)
+    if (filter.limit) params.set('limit', String(filter.limit))
+    return apiFetch<{ entries: AuditEntry[]; count: number }>(`/api/audit?${params}`)
+  },
+
   getStats: () => apiFetch<Stats>('/api/stats'),
 
   listLambdas: () =>
@@ -116,24 +531,257 @@ export const api = {
     )
   },
 
+  getLambdaMetrics: (name: string, window: MetricWindow = '1h') =>
+    apiFetch<MetricSeries & { function: string }>(
+      `/api/lambdas/${encodeURIComponent(name)}/metrics?window=${window}`,
+    ),
+
+  getMetricsOverview: (window: MetricWindow = '1h') =>
+    apiFetch<MetricSeries>(`/api/metrics/overview?window=${window}`),
+
+  queryLogs: (query: LogQuery) =>
+    apiFetch<LogQueryResult>('/api/logs/query', { method: 'POST', body: JSON.stringify(query) }),
+
+  // For queries that were still running (status 202) when queryLogs returned
+  getLogQueryResults: (queryId: string) =>
+    apiFetch<LogQueryResult>(`/api/logs/query/${encodeURIComponent(queryId)}`),
+
   listDatabases: () =>
     apiFetch<{ tables: TableInfo[]; count: number }>('/api/databases'),
 
-  getTableItems: (table: string) =>
-    apiFetch<{ table: string; items: Record<string, unknown>[]; count: number; has_more: boolean }>(
-      `/api/databases/${encodeURIComponent(table)}/items`,
-    ),
+  getTableItems: (table: string, opts: { limit?: number; nextToken?: string; attributes?: string[] } = {}) => {
+    const params = new URLSearchParams()
+    if (opts.limit) params.set('limit', String(opts.limit))
+    if (opts.nextToken) params.set('next_token', opts.nextToken)
+    if (opts.attributes?.length) params.set('attributes', opts.attributes.join(','))
+    return apiFetch<{
+      table: string
+      items: Record<string, unknown>[]
+      count: number
+      scanned: number
+      has_more: boolean
+      next_token: string
+    }>(`/api/databases/${encodeURIComponent(table)}/items?${params}`)
+  },
 
   getCloudFront: () =>
     apiFetch<{ distributions: DistributionInfo[]; count: number }>('/api/cloudfront'),
 
-  listTunnels: (status?: string) => {
-    const params = status ? `?status=${status}` : ''
+  listTunnels: (filter: TunnelSearch = {}) => {
+    const params = new URLSearchParams()
+    if (filter.subdomain) params.set('subdomain', filter.subdomain)
+    if (filter.clientId) params.set('client_id', filter.clientId)
+    if (filter.status) params.set('status', filter.status)
+    if (filter.createdAfter) params.set('created_after', filter.createdAfter)
+    if (filter.connected !== undefined) params.set('connected', String(filter.connected))
     return apiFetch<{ tunnels: TunnelItem[]; count: number; active: number; inactive: number }>(
-      `/api/tunnels${params}`,
+      `/api/tunnels?${params}`,
     )
   },
 
-  listClients: () =>
-    apiFetch<{ clients: ClientItem[]; count: number }>('/api/clients'),
+  getTunnelEvents: (tunnelId: string, limit = 100) =>
+    apiFetch<{ tunnel_id: string; events: TunnelEvent[]; count: number }>(
+      `/api/tunnels/${encodeURIComponent(tunnelId)}/events?limit=${limit}`,
+    ),
+
+  getTunnelRequests: (tunnelId: string, limit = 50) =>
+    apiFetch<{ tunnel_id: string; requests: RequestLogEntry[]; count: number }>(
+      `/api/tunnels/${encodeURIComponent(tunnelId)}/requests?limit=${limit}`,
+    ),
+
+  listAlarms: () =>
+    apiFetch<{ alarms: AlarmInfo[]; count: number; by_state: Record<string, number> }>('/api/alarms'),
+
+  createAlarm: (alarm: { kind: AlarmKind; target?: string; threshold?: number; destination?: AlarmDestination }) =>
+    apiFetch<{ name: string; threshold: number; topic_arn: string }>('/api/alarms', {
+      method: 'POST',
+      body: JSON.stringify(alarm),
+    }),
+
+  createDefaultAlarms: (destination?: AlarmDestination) =>
+    apiFetch<{ created: string[]; skipped: string[]; failures?: string[]; topic_arn: string }>('/api/alarms/defaults', {
+      method: 'POST',
+      body: JSON.stringify({ destination }),
+    }),
+
+  deleteAlarm: (name: string) =>
+    apiFetch<{ deleted: string }>(`/api/alarms/${encodeURIComponent(name)}`, { method: 'DELETE' }),
+
+  listConnections: (filter: { clientId?: string; probe?: boolean } = {}) => {
+    const params = new URLSearchParams()
+    if (filter.clientId) params.set('client_id', filter.clientId)
+    if (filter.probe === false) params.set('probe', 'false')
+    return apiFetch<{
+      connections: ConnectionItem[]
+      count: number
+      tunnels: number
+      by_state: Partial<Record<ConnectionState, number>>
+      by_region: Record<string, number>
+    }>(`/api/connections?${params}`)
+  },
+
+  getConnection: (id: string) =>
+    apiFetch<{ connection: ConnectionItem; tunnel: TunnelItem }>(`/api/connections/${encodeURIComponent(id)}`),
+
+  listDomains: (health?: DomainHealth) =>
+    apiFetch<{
+      domains: DomainItem[]
+      count: number
+      by_health: Record<DomainHealth, number>
+      tunnels_without_domain: TunnelItem[]
+    }>(`/api/domains${health ? `?health=${health}` : ''}`),
+
+  repairDomains: (options: { domain?: string; dryRun?: boolean } = {}) => {
+    const params = new URLSearchParams()
+    if (options.domain) params.set('domain', options.domain)
+    if (options.dryRun) params.set('dry_run', 'true')
+    return apiFetch<{ repaired: string[]; count: number; skipped: number; failures: string[] | null; dry_run: boolean }>(
+      `/api/domains/repair?${params}`,
+      { method: 'POST' },
+    )
+  },
+
+  getLambdaConfig: (name: string) =>
+    apiFetch<LambdaConfigResponse>(`/api/lambdas/${encodeURIComponent(name)}/config`),
+
+  // environment values of "" remove a tunable; revision_id guards against
+  // overwriting changes made since the config was read
+  updateLambdaConfig: (
+    name: string,
+    changes: { memory_size_mb?: number; timeout_seconds?: number; environment?: Record<string, string>; revision_id?: string },
+  ) =>
+    apiFetch<LambdaConfigResponse>(`/api/lambdas/${encodeURIComponent(name)}/config`, {
+      method: 'PATCH',
+      body: JSON.stringify(changes),
+    }),
+
+  // Pass event (raw) or http (built into an API Gateway event); functions
+  // other than the read-only endpoints only accept dryRun
+  invokeLambda: (name: string, input: { event?: unknown; http?: TestHTTPEvent; dryRun?: boolean }) =>
+    apiFetch<InvokeResult>(`/api/lambdas/${encodeURIComponent(name)}/invoke`, {
+      method: 'POST',
+      body: JSON.stringify({ event: input.event, http: input.http, dry_run: input.dryRun }),
+    }),
+
+  getTunnelAnalytics: (tunnelId: string, window: TunnelAnalytics['window'] = '24h') =>
+    apiFetch<TunnelAnalytics>(`/api/tunnels/${encodeURIComponent(tunnelId)}/analytics?window=${window}`),
+
+  disconnectTunnel: (tunnelId: string) =>
+    apiFetch<{ tunnel_id: string; status: string; disconnected: string[]; failures: string[] | null }>(
+      `/api/tunnels/${encodeURIComponent(tunnelId)}/disconnect`,
+      { method: 'POST' },
+    ),
+
+  // Call without confirm to get a confirm_token (HTTP 428), then again with it
+  deleteTunnel: (tunnelId: string, confirm: string) =>
+    apiFetch<{
+      tunnel_id: string
+      deleted: boolean
+      expired_requests: number
+      disconnected: string[]
+      failures: string[] | null
+    }>(`/api/tunnels/${encodeURIComponent(tunnelId)}?confirm=${encodeURIComponent(confirm)}`, {
+      method: 'DELETE',
+    }),
+
+  listClients: (filter: { clientId?: string; status?: string; createdAfter?: string } = {}) => {
+    const params = new URLSearchParams()
+    if (filter.clientId) params.set('client_id', filter.clientId)
+    if (filter.status) params.set('status', filter.status)
+    if (filter.createdAfter) params.set('created_after', filter.createdAfter)
+    return apiFetch<{ clients: ClientItem[]; count: number }>(`/api/clients?${params}`)
+  },
+
+  // Active clients unused for `days` days (server default 90), never-used first
+  listStaleClients: (days?: number) =>
+    apiFetch<{ clients: ClientItem[]; count: number; days: number; cutoff: string }>(
+      `/api/clients/stale${days ? `?days=${days}` : ''}`,
+    ),
+
+  // The API key is only returned here; it cannot be retrieved later
+  createClient: (plan: ClientPlan, maxTunnels?: number) =>
+    apiFetch<{ client: ClientItem; api_key: string; message: string }>('/api/clients', {
+      method: 'POST',
+      body: JSON.stringify({ plan, max_tunnels: maxTunnels }),
+    }),
+
+  updateClient: (
+    clientId: string,
+    changes: { plan?: ClientPlan; max_tunnels?: number; subdomain_prefix?: string; status?: 'active' | 'inactive' },
+  ) =>
+    apiFetch<ClientItem>(`/api/clients/${encodeURIComponent(clientId)}`, {
+      method: 'PATCH',
+      body: JSON.stringify(changes),
+    }),
+
+  listPendingRequests: (filter: { tunnelId?: string; status?: string; olderThan?: string } = {}) => {
+    const params = new URLSearchParams()
+    if (filter.tunnelId) params.set('tunnel_id', filter.tunnelId)
+    if (filter.status) params.set('status', filter.status)
+    if (filter.olderThan) params.set('older_than', filter.olderThan)
+    return apiFetch<{ pending_requests: PendingRequestItem[]; count: number; by_status: Record<string, number> }>(
+      `/api/pending-requests?${params}`,
+    )
+  },
+
+  deletePendingRequest: (requestId: string) =>
+    apiFetch<{ request_id: string; deleted: boolean }>(
+      `/api/pending-requests/${encodeURIComponent(requestId)}`,
+      { method: 'DELETE' },
+    ),
+
+  purgePendingRequests: (olderThan?: string, tunnelId?: string) => {
+    const params = new URLSearchParams()
+    if (olderThan) params.set('older_than', olderThan)
+    if (tunnelId) params.set('tunnel_id', tunnelId)
+    return apiFetch<{ deleted: string[]; count: number; skipped: number; failures: string[] | null; older_than: string }>(
+      `/api/pending-requests?${params}`,
+      { method: 'DELETE' },
+    )
+  },
+
+  listUploads: (filter: { prefix?: 'requests' | 'responses'; orphans?: boolean } = {}) => {
+    const params = new URLSearchParams()
+    if (filter.prefix) params.set('prefix', filter.prefix)
+    if (filter.orphans) params.set('orphans', 'true')
+    return apiFetch<{
+      bucket: string
+      objects: UploadObject[]
+      count: number
+      total_bytes: number
+      orphans: number
+      orphan_bytes: number
+      truncated: boolean
+    }>(`/api/uploads?${params}`)
+  },
+
+  cleanupUploads: (options: { olderThan?: string; prefix?: 'requests' | 'responses'; dryRun?: boolean } = {}) => {
+    const params = new URLSearchParams()
+    if (options.olderThan) params.set('older_than', options.olderThan)
+    if (options.prefix) params.set('prefix', options.prefix)
+    if (options.dryRun) params.set('dry_run', 'true')
+    return apiFetch<{
+      deleted: string[]
+      count: number
+      bytes: number
+      failures: string[] | null
+      older_than: string
+      dry_run: boolean
+      truncated: boolean
+    }>(`/api/uploads?${params}`, { method: 'DELETE' })
+  },
+
+  invalidateCloudFront: (paths: string[]) =>
+    apiFetch<InvalidationInfo>('/api/cloudfront/invalidate', {
+      method: 'POST',
+      body: JSON.stringify({ paths }),
+    }),
+
+  listInvalidations: () =>
+    apiFetch<{ distribution_id: string; invalidations: InvalidationInfo[]; count: number }>(
+      '/api/cloudfront/invalidations',
+    ),
+
+  getInvalidation: (id: string) =>
+    apiFetch<InvalidationInfo>(`/api/cloudfront/invalidations/${encodeURIComponent(id)}`),
 }
@@ -9,6 +9,7 @@ import {
   LogOut,
 } from 'lucide-react'
 import { useAuthStore, useUIStore } from '../store/useStore'
+import { api } from '../api/client'
 
 const navItems = [
   { to: '/', label: 'Dashboard', icon: LayoutDashboard },
@@ -21,7 +22,12 @@ const navItems = [
 
 export default function Sidebar() {
   const { sidebarOpen } = useUIStore()
-  const { logout } = useAuthStore()
+  const { logout, username } = useAuthStore()
+
+  // End the server session too; the local state is cleared either way
+  const signOut = () => {
+    api.logout().catch(() => {}).finally(logout)
+  }
 
   if (!sidebarOpen) return null
 
@@ -62,11 +68,11 @@ export default function Sidebar() {
       {/* Footer */}
       <div className="px-2 py-3 border-t border-gray-800">
         <button
-          onClick={logout}
+          onClick={signOut}
           className="flex items-center gap-2.5 w-full px-3 py-2 rounded-lg text-sm text-gray-400 hover:text-red-400 hover:bg-red-400/10 transition-colors"
         >
           <LogOut size={15} />
-          Sign out
+          Sign out{username ? ` (${username})` : ''}
         </button>
       </div>
     </aside>
@@ -8,12 +8,13 @@ export default function Clients() {
   const [loading, setLoading] = useState(true)
   const [error, setError] = useState<string | null>(null)
   const [search, setSearch] = useState('')
+  const [staleOnly, setStaleOnly] = useState(false)
 
   const load = async () => {
     try {
       setLoading(true)
       setError(null)
-      const data = await api.listClients()
+      const data = staleOnly ? await api.listStaleClients() : await api.listClients()
       setClients(data.clients ?? [])
     } catch (e) {
       setError((e as Error).message)
@@ -22,7 +23,7 @@ export default function Clients() {
     }
   }
 
-  useEffect(() => { load() }, [])
+  useEffect(() => { load() }, [staleOnly])
 
   const filtered = clients.filter((c) =>
     search ? c.client_id.includes(search) : true,
@@ -43,15 +44,25 @@ export default function Clients() {
       <div className="flex items-center justify-between">
         <div>
           <h1 className="text-xl font-bold text-white">Clients</h1>
-          <p className="text-sm text-gray-500 mt-0.5">{clients.length} registered clients</p>
+          <p className="text-sm text-gray-500 mt-0.5">
+            {staleOnly ? `${clients.length} active clients unused for 90 days` : `${clients.length} registered clients`}
+          </p>
+        </div>
+        <div className="flex items-center gap-2">
+          <button
+            onClick={() => setStaleOnly(!staleOnly)}
+            className={`px-3 py-1.5 rounded-lg text-sm transition-colors ${staleOnly ? 'bg-brand-600 text-white' : 'bg-gray-800 hover:bg-gray-700 text-gray-300'}`}
+          >
+            Stale only
+          </button>
+          <button
+            onClick={load}
+            className="flex items-center gap-2 px-3 py-1.5 rounded-lg bg-gray-800 hover:bg-gray-700 text-sm text-gray-300 transition-colors"
+          >
+            <RefreshCw size={14} />
+            Refresh
+          </button>
         </div>
-        <button
-          onClick={load}
-          className="flex items-center gap-2 px-3 py-1.5 rounded-lg bg-gray-800 hover:bg-gray-700 text-sm text-gray-300 transition-colors"
-        >
-          <RefreshCw size={14} />
-          Refresh
-        </button>
       </div>
 
       {/* Search */}
@@ -81,6 +92,7 @@ export default function Clients() {
                   <th className="px-4 py-2.5 text-left text-xs font-medium text-gray-500 uppercase tracking-wide">Client ID</th>
                   <th className="px-4 py-2.5 text-left text-xs font-medium text-gray-500 uppercase tracking-wide">Status</th>
                   <th className="px-4 py-2.5 text-left text-xs font-medium text-gray-500 uppercase tracking-wide">Created</th>
+                  <th className="px-4 py-2.5 text-left text-xs font-medium text-gray-500 uppercase tracking-wide">Last Used</th>
                 </tr>
               </thead>
               <tbody className="divide-y divide-gray-800">
@@ -93,6 +105,10 @@ export default function Clients() {
                     <td className="px-4 py-3 text-xs text-gray-500">
                       {c.created_at ? new Date(c.created_at).toLocaleString() : '—'}
                     </td>
+                    <td className="px-4 py-3 text-xs text-gray-500">
+                      {c.last_used_at ? new Date(c.last_used_at).toLocaleString() : 'Never'}
+                      {c.last_used_ip && <span className="ml-2 font-mono text-gray-600">{c.last_used_ip}</span>}
+                    </td>
                   </tr>
                 ))}
               </tbody>
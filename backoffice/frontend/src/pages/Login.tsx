@@ -1,19 +1,30 @@
 import { useState } from 'react'
 import { Network } from 'lucide-react'
 import { useAuthStore } from '../store/useStore'
+import { api } from '../api/client'
 
 export default function Login() {
-  const [key, setKey] = useState('')
+  const [username, setUsername] = useState('')
+  const [password, setPassword] = useState('')
   const [error, setError] = useState('')
+  const [loading, setLoading] = useState(false)
   const login = useAuthStore((s) => s.login)
 
-  const handleSubmit = (e: React.FormEvent) => {
+  const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault()
-    if (!key.trim()) {
-      setError('API key is required')
+    if (!username.trim() || !password) {
+      setError('Username and password are required')
       return
     }
-    login(key.trim())
+    setLoading(true)
+    try {
+      const session = await api.login(username.trim(), password)
+      login(session.token, session.username, session.role)
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Sign in failed')
+    } finally {
+      setLoading(false)
+    }
   }
 
   return (
@@ -25,17 +36,30 @@ export default function Login() {
             <Network size={22} className="text-white" />
           </div>
           <h1 className="text-xl font-bold text-white">Tunnel Backoffice</h1>
-          <p className="text-sm text-gray-500 mt-1">Enter your admin API key to continue</p>
+          <p className="text-sm text-gray-500 mt-1">Sign in with your admin account</p>
         </div>
 
         <form onSubmit={handleSubmit} className="space-y-4">
           <div>
-            <label className="block text-xs font-medium text-gray-400 mb-1.5">Admin API Key</label>
+            <label className="block text-xs font-medium text-gray-400 mb-1.5">Username</label>
+            <input
+              type="text"
+              autoComplete="username"
+              value={username}
+              onChange={(e) => { setUsername(e.target.value); setError('') }}
+              placeholder="jane.doe"
+              className="w-full bg-gray-900 border border-gray-700 rounded-lg px-3 py-2.5 text-sm text-white placeholder-gray-600 focus:outline-none focus:border-brand-500 focus:ring-1 focus:ring-brand-500 transition-colors"
+            />
+          </div>
+
+          <div>
+            <label className="block text-xs font-medium text-gray-400 mb-1.5">Password</label>
             <input
               type="password"
-              value={key}
-              onChange={(e) => { setKey(e.target.value); setError('') }}
-              placeholder="tk_••••••••••••••••"
+              autoComplete="current-password"
+              value={password}
+              onChange={(e) => { setPassword(e.target.value); setError('') }}
+              placeholder="••••••••••••"
               className="w-full bg-gray-900 border border-gray-700 rounded-lg px-3 py-2.5 text-sm text-white placeholder-gray-600 focus:outline-none focus:border-brand-500 focus:ring-1 focus:ring-brand-500 transition-colors"
             />
             {error && <p className="text-xs text-red-400 mt-1.5">{error}</p>}
@@ -43,9 +67,10 @@ export default function Login() {
 
           <button
             type="submit"
-            className="w-full bg-brand-600 hover:bg-brand-500 text-white rounded-lg px-4 py-2.5 text-sm font-medium transition-colors"
+            disabled={loading}
+            className="w-full bg-brand-600 hover:bg-brand-500 text-white rounded-lg px-4 py-2.5 text-sm font-medium transition-colors disabled:opacity-50"
           >
-            Sign in
+            {loading ? 'Signing in…' : 'Sign in'}
           </button>
         </form>
       </div>
@@ -1,6 +1,6 @@
-import { useEffect, useState } from 'react'
-import { Network, RefreshCw, Search } from 'lucide-react'
-import { api, type TunnelItem } from '../api/client'
+import { Fragment, useEffect, useState } from 'react'
+import { ChevronDown, ChevronRight, History, List, Network, RefreshCw, Search } from 'lucide-react'
+import { api, type RequestLogEntry, type TunnelEvent, type TunnelItem } from '../api/client'
 import StatusBadge from '../components/StatusBadge'
 
 export default function Tunnels() {
@@ -10,6 +10,7 @@ export default function Tunnels() {
   const [search, setSearch] = useState('')
   const [statusFilter, setStatusFilter] = useState<string>('')
   const [summary, setSummary] = useState({ active: 0, inactive: 0, total: 0 })
+  const [expanded, setExpanded] = useState<string | null>(null)
 
   const load = async () => {
     try {
@@ -108,25 +109,49 @@ export default function Tunnels() {
               </thead>
               <tbody className="divide-y divide-gray-800">
                 {filtered.map((t) => (
-                  <tr key={t.tunnel_id} className="hover:bg-gray-800/30 transition-colors">
-                    <td className="px-4 py-3">
-                      <p className="font-mono text-xs text-white">{t.domain}</p>
-                      <p className="font-mono text-xs text-gray-600 mt-0.5">{t.tunnel_id}</p>
-                    </td>
-                    <td className="px-4 py-3">
-                      <StatusBadge status={t.status} />
-                    </td>
-                    <td className="px-4 py-3 font-mono text-xs text-gray-400">{t.client_id}</td>
-                    <td className="px-4 py-3 font-mono text-xs text-gray-500">
-                      {t.connection_id || '—'}
-                    </td>
-                    <td className="px-4 py-3 text-xs text-gray-500">
-                      {t.created_at ? new Date(t.created_at).toLocaleString() : '—'}
-                    </td>
-                    <td className="px-4 py-3 text-xs text-gray-500">
-                      {t.updated_at ? new Date(t.updated_at).toLocaleString() : '—'}
-                    </td>
-                  </tr>
+                  <Fragment key={t.tunnel_id}>
+                    <tr
+                      onClick={() => setExpanded(expanded === t.tunnel_id ? null : t.tunnel_id)}
+                      className="hover:bg-gray-800/30 transition-colors cursor-pointer"
+                    >
+                      <td className="px-4 py-3">
+                        <p className="flex items-center gap-1.5 font-mono text-xs text-white">
+                          {expanded === t.tunnel_id ? <ChevronDown size={12} /> : <ChevronRight size={12} />}
+                          {t.domain}
+                        </p>
+                        <p className="font-mono text-xs text-gray-600 mt-0.5">{t.tunnel_id}</p>
+                      </td>
+                      <td className="px-4 py-3">
+                        <StatusBadge status={t.status} />
+                        {t.region && <p className="font-mono text-xs text-gray-600 mt-0.5">{t.region}</p>}
+                      </td>
+                      <td className="px-4 py-3 font-mono text-xs text-gray-400">{t.client_id}</td>
+                      <td className="px-4 py-3 font-mono text-xs text-gray-500">
+                        <p>{t.connection_id || '—'}</p>
+                        {t.connection_id && t.connection_info && (
+                          <p className="text-gray-600 mt-0.5">
+                            {[t.connection_info.source_ip, t.connection_info.platform, t.connection_info.cli_version]
+                              .filter(Boolean)
+                              .join(' · ')}
+                          </p>
+                        )}
+                      </td>
+                      <td className="px-4 py-3 text-xs text-gray-500">
+                        {t.created_at ? new Date(t.created_at).toLocaleString() : '—'}
+                      </td>
+                      <td className="px-4 py-3 text-xs text-gray-500">
+                        {t.updated_at ? new Date(t.updated_at).toLocaleString() : '—'}
+                      </td>
+                    </tr>
+                    {expanded === t.tunnel_id && (
+                      <tr className="bg-gray-950/40">
+                        <td colSpan={6} className="px-4 py-3">
+                          <TunnelEvents tunnelId={t.tunnel_id} />
+                          <TunnelRequests tunnelId={t.tunnel_id} />
+                        </td>
+                      </tr>
+                    )}
+                  </Fragment>
                 ))}
               </tbody>
             </table>
@@ -137,6 +162,110 @@ export default function Tunnels() {
   )
 }
 
+function TunnelEvents({ tunnelId }: { tunnelId: string }) {
+  const [events, setEvents] = useState<TunnelEvent[] | null>(null)
+  const [error, setError] = useState<string | null>(null)
+
+  useEffect(() => {
+    api
+      .getTunnelEvents(tunnelId)
+      .then((data) => setEvents(data.events ?? []))
+      .catch((e) => setError((e as Error).message))
+  }, [tunnelId])
+
+  if (error) return <p className="text-xs text-red-400">{error}</p>
+  if (!events) return <p className="text-xs text-gray-500">Loading events…</p>
+  if (events.length === 0) {
+    return (
+      <p className="flex items-center gap-2 text-xs text-gray-500">
+        <History size={12} />
+        No events recorded
+      </p>
+    )
+  }
+
+  return (
+    <ul className="space-y-1.5">
+      {events.map((e) => (
+        <li key={e.event_id} className="flex gap-3 text-xs">
+          <span className="w-40 shrink-0 text-gray-500">{new Date(e.created_at).toLocaleString()}</span>
+          <span className="w-24 shrink-0 font-medium text-gray-300">{e.type}</span>
+          <span className="font-mono text-gray-500">
+            {[
+              e.source_ip && `from ${e.source_ip}`,
+              e.cli_version && `cli ${e.cli_version}`,
+              e.platform && `on ${e.platform}`,
+              e.reason && `reason: ${e.reason}`,
+              e.actor && `by ${e.actor}`,
+            ]
+              .filter(Boolean)
+              .join(' · ') || '—'}
+          </span>
+        </li>
+      ))}
+    </ul>
+  )
+}
+
+function TunnelRequests({ tunnelId }: { tunnelId: string }) {
+  const [requests, setRequests] = useState<RequestLogEntry[] | null>(null)
+  const [open, setOpen] = useState<string | null>(null)
+  const [error, setError] = useState<string | null>(null)
+
+  useEffect(() => {
+    api
+      .getTunnelRequests(tunnelId)
+      .then((data) => setRequests(data.requests ?? []))
+      .catch((e) => setError((e as Error).message))
+  }, [tunnelId])
+
+  if (error) return <p className="mt-3 text-xs text-red-400">{error}</p>
+  if (!requests) return <p className="mt-3 text-xs text-gray-500">Loading requests…</p>
+  if (requests.length === 0) {
+    return (
+      <p className="mt-3 flex items-center gap-2 text-xs text-gray-500">
+        <List size={12} />
+        No requests logged
+      </p>
+    )
+  }
+
+  return (
+    <ul className="mt-3 space-y-1.5 border-t border-gray-800 pt-3">
+      {requests.map((r) => (
+        <li key={r.log_id} className="text-xs">
+          <button
+            className="flex w-full gap-3 text-left hover:text-gray-200"
+            onClick={() => setOpen(open === r.log_id ? null : r.log_id)}
+          >
+            <span className="w-40 shrink-0 text-gray-500">{new Date(r.created_at).toLocaleString()}</span>
+            <span className="w-12 shrink-0 font-mono text-gray-400">{r.status_code}</span>
+            <span className="w-16 shrink-0 font-medium text-gray-300">{r.method}</span>
+            <span className="truncate font-mono text-gray-500">{r.path}</span>
+            <span className="ml-auto shrink-0 text-gray-600">{r.duration_ms} ms</span>
+          </button>
+          {open === r.log_id && (
+            <div className="mt-1.5 ml-40 space-y-1 font-mono text-gray-500">
+              {r.headers ? (
+                Object.entries(r.headers)
+                  .sort(([a], [b]) => a.localeCompare(b))
+                  .map(([name, value]) => (
+                    <p key={name} className="break-all">
+                      <span className="text-gray-400">{name}:</span> {value}
+                    </p>
+                  ))
+              ) : (
+                <p>Request details are not logged</p>
+              )}
+              {r.body_preview && <pre className="whitespace-pre-wrap break-all text-gray-400">{r.body_preview}</pre>}
+            </div>
+          )}
+        </li>
+      ))}
+    </ul>
+  )
+}
+
 function Th({ children }: { children: React.ReactNode }) {
   return (
     <th className="px-4 py-2.5 text-left text-xs font-medium text-gray-500 uppercase tracking-wide">
@@ -1,10 +1,15 @@
 import { create } from 'zustand'
 import { persist } from 'zustand/middleware'
 
+export type AdminRole = 'read_only' | 'operator'
+
 interface AuthState {
+  // Session token from /api/auth/login
   apiKey: string | null
+  username: string | null
+  role: AdminRole | null
   isAuthenticated: boolean
-  login: (key: string) => void
+  login: (token: string, username: string, role: AdminRole) => void
   logout: () => void
 }
 
@@ -12,9 +17,12 @@ export const useAuthStore = create<AuthState>()(
   persist(
     (set) => ({
       apiKey: null,
+      username: null,
+      role: null,
       isAuthenticated: false,
-      login: (key: string) => set({ apiKey: key, isAuthenticated: true }),
-      logout: () => set({ apiKey: null, isAuthenticated: false }),
+      login: (token: string, username: string, role: AdminRole) =>
+        set({ apiKey: token, username, role, isAuthenticated: true }),
+      logout: () => set({ apiKey: null, username: null, role: null, isAuthenticated: false }),
     }),
     { name: 'tunnel-backoffice-auth' },
   ),
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lmanrique/tunnel/cli/internal/client"
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/spf13/cobra"
+)
+
+var accessExpires time.Duration
+
+var accessCmd = &cobra.Command{
+	Use:   "access",
+	Short: "Manage who may call a private tunnel",
+	Long: `Issue and revoke the access tokens of a private tunnel (started with --private).
+Only requests carrying a valid token in the X-Tunnel-Access-Token header are
+forwarded; everything else gets 401. Tunnels are given by ID, subdomain or
+hostname.
+
+Examples:
+  tunnel access grant myapp ci-runner
+  tunnel access grant myapp alice@example.com --expires 168h
+  tunnel access list myapp
+  tunnel access revoke myapp ci-runner`,
+}
+
+var accessGrantCmd = &cobra.Command{
+	Use:   "grant [tunnel] [consumer]",
+	Short: "Issue a consumer an access token, replacing its previous one",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runAccessGrant,
+}
+
+var accessRevokeCmd = &cobra.Command{
+	Use:   "revoke [tunnel] [consumer]",
+	Short: "Revoke a consumer's access token",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runAccessRevoke,
+}
+
+var accessListCmd = &cobra.Command{
+	Use:   "list [tunnel]",
+	Short: "List the consumers holding an access token",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runAccessList,
+}
+
+func init() {
+	rootCmd.AddCommand(accessCmd)
+	accessCmd.AddCommand(accessGrantCmd, accessRevokeCmd, accessListCmd)
+	accessGrantCmd.Flags().DurationVar(&accessExpires, "expires", 0, "How long the token is valid, e.g. 24h (default: 30 days, at most a year)")
+}
+
+// accessTunnel loads the config and finds the tunnel name refers to
+func accessTunnel(name string) (*client.Client, client.Tunnel, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, client.Tunnel{}, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if !config.IsConfigured() {
+		return nil, client.Tunnel{}, fmt.Errorf("not configured. Please run 'tunnel register' first")
+	}
+
+	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
+
+	resp, err := apiClient.ListTunnels()
+	if err != nil {
+		return nil, client.Tunnel{}, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+	tunnel, ok := findTunnel(resp.Tunnels, name)
+	if !ok {
+		return nil, client.Tunnel{}, fmt.Errorf("no tunnel matches %q; run 'tunnel list' to see your tunnels", name)
+	}
+	return apiClient, tunnel, nil
+}
+
+func runAccessGrant(cmd *cobra.Command, args []string) error {
+	apiClient, tunnel, err := accessTunnel(args[0])
+	if err != nil {
+		return err
+	}
+
+	token, err := apiClient.CreateAccessToken(tunnel.TunnelID, args[1], accessExpires)
+	if err != nil {
+		return fmt.Errorf("failed to issue access token: %w", err)
+	}
+
+	fmt.Printf("✓ Access token issued to %s\n", token.Consumer)
+	fmt.Printf("  Tunnel:  %s\n", tunnel.Domain)
+	fmt.Printf("  Expires: %s\n", token.ExpiresAt)
+	fmt.Printf("  Header:  %s: %s\n", token.Header, token.Token)
+	if tunnel.Visibility != "private" {
+		fmt.Println("\nThe tunnel is public; restart it with --private to require the token")
+	}
+
+	return nil
+}
+
+func runAccessRevoke(cmd *cobra.Command, args []string) error {
+	apiClient, tunnel, err := accessTunnel(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := apiClient.RevokeAccessToken(tunnel.TunnelID, args[1]); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+
+	fmt.Printf("✓ Access token of %s revoked\n", args[1])
+
+	return nil
+}
+
+func runAccessList(cmd *cobra.Command, args []string) error {
+	_, tunnel, err := accessTunnel(args[0])
+	if err != nil {
+		return err
+	}
+
+	visibility := tunnel.Visibility
+	if visibility == "" {
+		visibility = "public"
+	}
+	fmt.Printf("%s is %s\n", tunnel.Domain, visibility)
+
+	if len(tunnel.AccessConsumers) == 0 {
+		fmt.Println("No access tokens issued")
+		return nil
+	}
+
+	consumers := make([]string, 0, len(tunnel.AccessConsumers))
+	for consumer := range tunnel.AccessConsumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Strings(consumers)
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONSUMER\tISSUED AT")
+	for _, consumer := range consumers {
+		issuedAt := time.Unix(tunnel.AccessConsumers[consumer], 0)
+		fmt.Fprintf(w, "%s\t%s\n", consumer, issuedAt.Local().Format(time.DateTime))
+	}
+	return w.Flush()
+}
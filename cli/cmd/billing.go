@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lmanrique/tunnel/cli/internal/client"
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/spf13/cobra"
+)
+
+var billingCmd = &cobra.Command{
+	Use:   "billing",
+	Short: "Get a link to manage or upgrade your plan",
+	Long: `Print a link to the billing page of your account: the customer portal, where
+a paying client changes its plan, payment method or invoices, or the checkout
+page that sells a plan to a client that has none yet.
+
+Paid plans raise the tunnel quota and unlock custom subdomains (--domain).`,
+	Args: cobra.NoArgs,
+	RunE: runBilling,
+}
+
+func init() {
+	rootCmd.AddCommand(billingCmd)
+}
+
+func runBilling(cmd *cobra.Command, args []string) error {
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if !config.IsConfigured() {
+		return fmt.Errorf("not configured. Please run 'tunnel register' first")
+	}
+
+	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
+
+	link, err := apiClient.BillingPortal()
+	if client.IsCode(err, problem.CodeBillingUnavailable) {
+		return fmt.Errorf("this server does not sell plans: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get billing link: %w", err)
+	}
+
+	if link.Type == "checkout" {
+		fmt.Println("Choose a plan at:")
+	} else {
+		fmt.Println("Manage your plan at:")
+	}
+	fmt.Printf("  %s\n", link.URL)
+
+	return nil
+}
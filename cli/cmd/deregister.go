@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lmanrique/tunnel/cli/internal/client"
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/spf13/cobra"
+)
+
+var deregisterYes bool
+
+var deregisterCmd = &cobra.Command{
+	Use:   "deregister",
+	Short: "Delete your account and all its tunnels",
+	Long: `Delete the registered client together with all its tunnels, their domains
+and in-flight requests, then remove the local configuration.
+This cannot be undone; you are asked to type the client ID first.
+
+Examples:
+  tunnel deregister
+  tunnel deregister --yes`,
+	Args: cobra.NoArgs,
+	RunE: runDeregister,
+}
+
+func init() {
+	rootCmd.AddCommand(deregisterCmd)
+	deregisterCmd.Flags().BoolVarP(&deregisterYes, "yes", "y", false, "Skip the confirmation prompt")
+}
+
+func runDeregister(cmd *cobra.Command, args []string) error {
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if !config.IsConfigured() {
+		return fmt.Errorf("not configured. Nothing to deregister")
+	}
+
+	if !deregisterYes {
+		fmt.Printf("This permanently deletes client %s and all its tunnels.\n", cfg.ClientID)
+		fmt.Print("Type the client ID to confirm: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != cfg.ClientID {
+			return fmt.Errorf("confirmation did not match; nothing was deleted")
+		}
+	}
+
+	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
+
+	resp, err := apiClient.Deregister(cfg.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to deregister: %w", err)
+	}
+
+	if err := config.Clear(); err != nil {
+		return fmt.Errorf("client deregistered, but %w", err)
+	}
+
+	fmt.Printf("✓ Client deregistered, %d tunnel(s) deleted\n", resp.TunnelsDeleted)
+	fmt.Println("  Local configuration removed")
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/lmanrique/tunnel/cli/internal/history"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyTunnel string
+	historyLimit  int
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the requests your tunnels forwarded",
+	Long: `Show the requests 'tunnel start' forwarded to your local services. They are kept
+in ~/.tunnel/history across restarts: by default the last 1000 requests of the
+past 7 days, without bodies. Set history_max_age, history_max_entries and
+history_body_bytes in ~/.tunnel/config.yaml to change that.
+
+Examples:
+  tunnel history list
+  tunnel history list --tunnel myapp -n 50
+  tunnel history show 3f2a9c
+  tunnel history clear`,
+}
+
+var historyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List recent requests, newest first",
+	Args:  cobra.NoArgs,
+	RunE:  runHistoryList,
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show [request-id]",
+	Short: "Show a request and its response; a unique prefix of the ID will do",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runHistoryShow,
+}
+
+var historyClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Delete the request history",
+	Args:  cobra.NoArgs,
+	RunE:  runHistoryClear,
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historyListCmd, historyShowCmd, historyClearCmd)
+	historyListCmd.Flags().StringVar(&historyTunnel, "tunnel", "", "Only list requests of this tunnel (ID, subdomain or hostname)")
+	historyListCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "How many requests to list (0 for all)")
+}
+
+// openHistory opens the history with the retention from the config
+func openHistory() (*history.Store, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	opts, err := history.ConfigOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := history.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	return history.Open(dir, opts)
+}
+
+func runHistoryList(cmd *cobra.Command, args []string) error {
+	store, err := openHistory()
+	if err != nil {
+		return err
+	}
+
+	entries, err := store.List(historyTunnel, historyLimit)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No requests in history")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "REQUEST ID\tTIME\tTUNNEL\tMETHOD\tPATH\tSTATUS\tDURATION\tSIZE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%dms\t%d\n",
+			e.RequestID,
+			e.StartedAt.Local().Format(time.DateTime),
+			historyTunnelName(e),
+			e.Method,
+			truncate(e.Path, 60),
+			historyStatus(e),
+			e.DurationMs,
+			e.ResponseBytes,
+		)
+	}
+	return w.Flush()
+}
+
+func runHistoryShow(cmd *cobra.Command, args []string) error {
+	store, err := openHistory()
+	if err != nil {
+		return err
+	}
+
+	e, err := store.Get(args[0])
+	if errors.Is(err, history.ErrNotFound) {
+		return fmt.Errorf("no request %q in history; run 'tunnel history list' to see them", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Request ID: %s\n", e.RequestID)
+	fmt.Printf("Tunnel:     %s\n", historyTunnelName(*e))
+	fmt.Printf("Time:       %s\n", e.StartedAt.Local().Format(time.DateTime))
+	fmt.Printf("Duration:   %dms\n", e.DurationMs)
+	if e.Error != "" {
+		fmt.Printf("Error:      %s\n", e.Error)
+	}
+
+	fmt.Printf("\n%s %s\n", e.Method, e.Path)
+	printHistoryHeaders(e.RequestHeaders)
+	printHistoryBody(e.RequestBody, e.RequestBytes)
+
+	if e.StatusCode != 0 {
+		fmt.Printf("\n%d %s\n", e.StatusCode, http.StatusText(e.StatusCode))
+		printHistoryHeaders(e.ResponseHeaders)
+		if e.Streamed {
+			fmt.Println("\n(streamed response; body not kept)")
+		} else {
+			printHistoryBody(e.ResponseBody, e.ResponseBytes)
+		}
+	}
+	if e.Truncated {
+		fmt.Println("\n(bodies cut at history_body_bytes)")
+	}
+	return nil
+}
+
+func runHistoryClear(cmd *cobra.Command, args []string) error {
+	store, err := openHistory()
+	if err != nil {
+		return err
+	}
+	if err := store.Clear(); err != nil {
+		return err
+	}
+	fmt.Println("✓ Request history cleared")
+	return nil
+}
+
+// historyTunnelName is the hostname a request came in on, or its tunnel ID
+func historyTunnelName(e history.Entry) string {
+	if e.Domain != "" {
+		return e.Domain
+	}
+	return e.TunnelID
+}
+
+// historyStatus is a request's status code, or ERR when the local service
+// gave no response
+func historyStatus(e history.Entry) string {
+	if e.StatusCode == 0 {
+		return "ERR"
+	}
+	return fmt.Sprintf("%d", e.StatusCode)
+}
+
+func printHistoryHeaders(headers map[string][]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+}
+
+// printHistoryBody prints a kept body; binary ones are only described
+func printHistoryBody(body []byte, size int64) {
+	switch {
+	case size == 0:
+		return
+	case len(body) == 0:
+		fmt.Printf("\n(%d byte body not kept)\n", size)
+	case !utf8.Valid(body):
+		fmt.Printf("\n(%d byte binary body)\n", size)
+	default:
+		fmt.Printf("\n%s\n", strings.TrimRight(string(body), "\n"))
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/lmanrique/tunnel/cli/internal/client"
@@ -17,8 +18,11 @@ var listCmd = &cobra.Command{
 	RunE:  runList,
 }
 
+var checkHealth bool
+
 func init() {
 	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().BoolVar(&checkHealth, "health", false, "Probe each active tunnel's connection and show whether it is reachable")
 }
 
 func runList(cmd *cobra.Command, args []string) error {
@@ -36,7 +40,12 @@ func runList(cmd *cobra.Command, args []string) error {
 	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
 
 	// List tunnels
-	resp, err := apiClient.ListTunnels()
+	var resp *client.ListTunnelsResponse
+	if checkHealth {
+		resp, err = apiClient.ListTunnelsWithHealth()
+	} else {
+		resp, err = apiClient.ListTunnels()
+	}
 	if err != nil {
 		return fmt.Errorf("failed to list tunnels: %w", err)
 	}
@@ -48,14 +57,41 @@ func runList(cmd *cobra.Command, args []string) error {
 
 	// Print tunnels in a table
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "TUNNEL ID\tDOMAIN\tSTATUS\tCREATED AT")
-	fmt.Fprintln(w, "---------\t------\t------\t----------")
+	if checkHealth {
+		fmt.Fprintln(w, "TUNNEL ID\tDOMAIN\tSTATUS\tCONNECTED FROM\tREACHABLE\tLAST SEEN\tCREATED AT")
+		fmt.Fprintln(w, "---------\t------\t------\t--------------\t---------\t---------\t----------")
+	} else {
+		fmt.Fprintln(w, "TUNNEL ID\tDOMAIN\tSTATUS\tCONNECTED FROM\tCREATED AT")
+		fmt.Fprintln(w, "---------\t------\t------\t--------------\t----------")
+	}
 
 	for _, tunnel := range resp.Tunnels {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+		if checkHealth {
+			reachable := "no"
+			if tunnel.ConnectionHealthy != nil && *tunnel.ConnectionHealthy {
+				reachable = "yes"
+			}
+			lastSeen := tunnel.LastSeen
+			if lastSeen == "" {
+				lastSeen = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				tunnel.TunnelID,
+				tunnel.Domain,
+				tunnel.Status,
+				connectedFrom(tunnel),
+				reachable,
+				lastSeen,
+				tunnel.CreatedAt,
+			)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
 			tunnel.TunnelID,
 			tunnel.Domain,
 			tunnel.Status,
+			connectedFrom(tunnel),
 			tunnel.CreatedAt,
 		)
 	}
@@ -66,3 +102,22 @@ func runList(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// connectedFrom summarizes the machine holding an active tunnel, e.g. "203.0.113.7 linux/amd64 v1.2.0"
+func connectedFrom(tunnel client.Tunnel) string {
+	info := tunnel.ConnectionInfo
+	if tunnel.Status != "active" || info == nil {
+		return "-"
+	}
+
+	parts := []string{}
+	for _, part := range []string{info.SourceIP, info.Platform, info.CLIVersion} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
@@ -7,6 +7,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// Version is the CLI version, set at build time via
+// -ldflags "-X github.com/lmanrique/tunnel/cli/cmd.Version=<version>"
+var Version = "dev"
+
 var rootCmd = &cobra.Command{
 	Use:   "tunnel",
 	Short: "Tunnel CLI - Expose local services to the internet",
@@ -31,5 +35,5 @@ func Execute() {
 }
 
 func init() {
-	// Add global flags here if needed
+	rootCmd.Version = Version
 }
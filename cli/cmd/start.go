@@ -1,54 +1,172 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/lmanrique/tunnel/cli/internal/client"
 	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/lmanrique/tunnel/cli/internal/detect"
+	"github.com/lmanrique/tunnel/cli/internal/history"
+	"github.com/lmanrique/tunnel/cli/internal/hooks"
 	"github.com/lmanrique/tunnel/cli/internal/proxy"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
 	"github.com/spf13/cobra"
 )
 
 var startCmd = &cobra.Command{
-	Use:   "start [port]",
+	Use:   "start [port | --auto]",
 	Short: "Start a tunnel to expose a local port",
 	Long: `Start a tunnel to expose a local HTTP service to the internet.
 The tunnel will forward all incoming requests to the specified local port.
+With --auto the port is taken from the project in the current directory
+(package.json, manage.py, bin/rails, docker-compose) or a common dev port
+that is listening, along with settings that suit the framework.
 
 Examples:
   tunnel start 3000                  # Start tunnel with random subdomain
-  tunnel start 8080 --domain myapp   # Start tunnel with custom subdomain`,
-	Args: cobra.ExactArgs(1),
+  tunnel start --auto                # Find the dev server and its port
+  tunnel start 8080 --domain myapp   # Start tunnel with custom subdomain
+  tunnel start 8080 --domain myapp --connection-policy multi   # Share the tunnel between clients
+  tunnel start 8080 --region eu-west-1   # Home the tunnel in a specific region
+  tunnel start 3000 --rewrite-redirects  # Point localhost redirects and cookies at the tunnel
+  tunnel start 3000 --rewrite-body text/html,application/json   # Point localhost links in pages at the tunnel
+  tunnel start 3000 --block-bots --robots-txt   # Keep crawlers and scanners out
+  tunnel start 3000 --allow-country US,CA        # Only serve callers in these countries
+  tunnel start 3000 --allow-method POST          # A webhook receiver that only takes POSTs
+  tunnel start 3000 --password 's3cret-demo'     # Visitors log in with a password first
+  tunnel start 3000 --private                    # Only callers with an access token get through
+  tunnel start 3000 --require-header 'X-Hook-Secret: abc123' --strip-header X-Corp-User   # Header rules
+  tunnel start 3000 --response-header 'X-Robots-Tag: noindex' --strip-response-header X-Powered-By   # Response header policy
+  tunnel start 3000 --exclude-path /metrics,/internal/*   # Keep private endpoints off the public URL
+  tunnel start 3000 --throttle-down 512kbps --throttle-up 128kbps --latency 200ms   # Feel the app as a slow mobile client`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: runStart,
 }
 
 var (
-	subdomain     string
-	autoReconnect bool
+	subdomain        string
+	autoReconnect    bool
+	connectionPolicy string
+	region           string
+	rewriteRedirects bool
+	rewriteBody      []string
+	blockBots        bool
+	robotsTxt        bool
+	allowCountries   []string
+	allowMethods     []string
+	password         string
+	private          bool
+	stripHeaders     []string
+	requireHeaders   []string
+	responseHeaders  []string
+	stripRespHeaders []string
+	lowLatency       bool
+	maxConcurrent    int64
+	throttleDown     string
+	throttleUp       string
+	latency          time.Duration
+	noHistory        bool
+	historyBodies    int
+	excludePaths     []string
+	excludeStatus    int
+	autoDetect       bool
+	onConflictFlag   string
+	onConnectHook    string
+	onDisconnectHook string
 )
 
 func init() {
 	rootCmd.AddCommand(startCmd)
 	startCmd.Flags().StringVar(&subdomain, "domain", "", "Custom subdomain (optional)")
+	startCmd.Flags().BoolVar(&autoDetect, "auto", false, "Detect the dev server in the current directory and use its port and settings; flags you set win")
 	startCmd.Flags().BoolVar(&autoReconnect, "auto-reconnect", true, "Automatically reconnect on connection failure (default: true)")
+	startCmd.Flags().StringVar(&connectionPolicy, "connection-policy", "", "What happens when another client connects: reject, takeover or multi (default: takeover)")
+	startCmd.Flags().StringVar(&region, "region", "", "Home region of the tunnel (default: nearest region)")
+	startCmd.Flags().BoolVar(&rewriteRedirects, "rewrite-redirects", false, "Rewrite Location headers and cookie domains that point at localhost to the tunnel domain, and pass redirects through to the caller")
+	startCmd.Flags().StringSliceVar(&rewriteBody, "rewrite-body", nil, "Content types (e.g. text/html,application/json or text/*) whose bodies get http://localhost:<port> replaced with the tunnel URL")
+	startCmd.Flags().BoolVar(&blockBots, "block-bots", false, "Reject crawler user agents and known scanner IPs before they reach the local service (kept by a reused tunnel until set to false)")
+	startCmd.Flags().BoolVar(&robotsTxt, "robots-txt", false, "Answer /robots.txt with \"Disallow: /\" instead of forwarding it (kept by a reused tunnel until set to false)")
+	startCmd.Flags().StringSliceVar(&allowCountries, "allow-country", nil, "Only serve callers in these ISO country codes, e.g. US,DE (kept by a reused tunnel; --allow-country= lifts the restriction)")
+	startCmd.Flags().StringSliceVar(&allowMethods, "allow-method", nil, "Only accept these HTTP methods, e.g. POST; others get 405 (kept by a reused tunnel; --allow-method= lifts the restriction)")
+	startCmd.Flags().StringVar(&password, "password", "", "Make visitors enter this password on a login page first (kept by a reused tunnel; --password= removes it)")
+	startCmd.Flags().BoolVar(&private, "private", false, "Only forward requests carrying an access token from 'tunnel access grant'; others get 401 (kept by a reused tunnel until set to false)")
+	startCmd.Flags().StringSliceVar(&stripHeaders, "strip-header", nil, "Remove these headers from every request before it reaches the local service (kept by a reused tunnel; --strip-header= clears the list)")
+	startCmd.Flags().StringArrayVar(&requireHeaders, "require-header", nil, "Reject requests without this header with 403; \"Name: value\" also checks its value. Repeatable (kept by a reused tunnel; --require-header= clears the list)")
+	startCmd.Flags().StringArrayVar(&responseHeaders, "response-header", nil, "Set this \"Name: value\" header on every response, replacing the local service's. Repeatable (kept by a reused tunnel; --response-header= clears the list)")
+	startCmd.Flags().StringSliceVar(&stripRespHeaders, "strip-response-header", nil, "Remove these headers from every response (kept by a reused tunnel; --strip-response-header= clears the list)")
+	startCmd.Flags().BoolVar(&lowLatency, "low-latency", false, "Mark the tunnel as latency-sensitive: its requests are metered apart as low-latency usage (kept by a reused tunnel until set to false)")
+	startCmd.Flags().Int64Var(&maxConcurrent, "max-concurrent", 0, "Serve at most this many requests at a time; the rest queue briefly, then get 429 (kept by a reused tunnel; --max-concurrent=0 removes the cap)")
+	startCmd.Flags().StringVar(&throttleDown, "throttle-down", "", "Limit the bandwidth of responses from the local service, e.g. 512kbps or 1.5mbps")
+	startCmd.Flags().StringVar(&throttleUp, "throttle-up", "", "Limit the bandwidth of request bodies sent to the local service, e.g. 128kbps")
+	startCmd.Flags().DurationVar(&latency, "latency", 0, "Hold every request back this long before forwarding it, e.g. 200ms")
+	startCmd.Flags().StringSliceVar(&excludePaths, "exclude-path", nil, "Answer these paths here instead of forwarding them, e.g. /metrics,/internal/* (* matches within a segment, a trailing /* everything below)")
+	startCmd.Flags().IntVar(&excludeStatus, "exclude-status", 404, "Status excluded paths are answered with: 404 or 403")
+	startCmd.Flags().BoolVar(&noHistory, "no-history", false, "Don't keep forwarded requests in ~/.tunnel/history")
+	startCmd.Flags().StringVar(&onConflictFlag, "on-conflict", "", "When another machine holds the tunnel: ask, takeover, attach (multi policy only) or abort (default: ask in a terminal, otherwise the connection policy decides)")
+	startCmd.Flags().StringVar(&onConnectHook, "on-connect", "", "Run this command whenever the tunnel comes online; it gets TUNNEL_* variables and the event as JSON on stdin")
+	startCmd.Flags().StringVar(&onDisconnectHook, "on-disconnect", "", "Run this command whenever the tunnel goes offline, with TUNNEL_REASON and TUNNEL_FINAL set")
+	startCmd.Flags().IntVar(&historyBodies, "history-bodies", 0, "Also keep request and response bodies up to this many bytes in the history (default: history_body_bytes from the config)")
 }
 
 func runStart(cmd *cobra.Command, args []string) error {
-	// Parse port
-	port, err := strconv.Atoi(args[0])
-	if err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+	var port int
+	var err error
+	switch {
+	case len(args) == 1:
+		// Parse port
+		port, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid port: %w", err)
+		}
+	case autoDetect:
+		if port, err = applyPreset(cmd); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("specify the local port to expose, or --auto to detect it")
 	}
 
 	if port < 1 || port > 65535 {
 		return fmt.Errorf("port must be between 1 and 65535")
 	}
 
+	var downRate, upRate int64
+	if throttleDown != "" {
+		if downRate, err = proxy.ParseRate(throttleDown); err != nil {
+			return fmt.Errorf("invalid --throttle-down: %w", err)
+		}
+	}
+	if throttleUp != "" {
+		if upRate, err = proxy.ParseRate(throttleUp); err != nil {
+			return fmt.Errorf("invalid --throttle-up: %w", err)
+		}
+	}
+	if latency < 0 {
+		return fmt.Errorf("--latency must not be negative")
+	}
+	for _, pattern := range excludePaths {
+		if err := proxy.ValidateExcludePath(pattern); err != nil {
+			return fmt.Errorf("invalid --exclude-path: %w", err)
+		}
+	}
+	if excludeStatus != 403 && excludeStatus != 404 {
+		return fmt.Errorf("--exclude-status must be 403 or 404")
+	}
+	if onConflictFlag != "" && onConflictFlag != "abort" && !models.ValidConnectConflict(onConflictFlag) {
+		return fmt.Errorf("--on-conflict must be ask, takeover, attach or abort")
+	}
+
 	// Load config
 	cfg, err := config.Load()
 	if err != nil {
@@ -69,26 +187,190 @@ func runStart(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create tunnel
-	tunnel, err := apiClient.CreateTunnel(subdomain)
+	tunnelReq := client.CreateTunnelRequest{
+		Subdomain:        subdomain,
+		ConnectionPolicy: connectionPolicy,
+		Region:           region,
+	}
+	if cmd.Flags().Changed("block-bots") {
+		tunnelReq.BlockBots = &blockBots
+	}
+	if cmd.Flags().Changed("robots-txt") {
+		tunnelReq.RobotsTxt = &robotsTxt
+	}
+	if cmd.Flags().Changed("allow-country") {
+		tunnelReq.AllowedCountries = append([]string{}, allowCountries...)
+	}
+	if cmd.Flags().Changed("allow-method") {
+		tunnelReq.AllowedMethods = append([]string{}, allowMethods...)
+	}
+	if cmd.Flags().Changed("password") {
+		tunnelReq.Password = &password
+	}
+	if cmd.Flags().Changed("private") {
+		tunnelReq.Visibility = "public"
+		if private {
+			tunnelReq.Visibility = "private"
+		}
+	}
+	if cmd.Flags().Changed("strip-header") {
+		tunnelReq.StrippedHeaders = append([]string{}, stripHeaders...)
+	}
+	if cmd.Flags().Changed("require-header") {
+		tunnelReq.RequiredHeaders = nonEmpty(requireHeaders)
+	}
+	if cmd.Flags().Changed("response-header") {
+		tunnelReq.ResponseHeaders = nonEmpty(responseHeaders)
+	}
+	if cmd.Flags().Changed("strip-response-header") {
+		tunnelReq.StrippedResponseHeaders = append([]string{}, stripRespHeaders...)
+	}
+	if cmd.Flags().Changed("low-latency") {
+		tunnelReq.LowLatency = &lowLatency
+	}
+	if cmd.Flags().Changed("max-concurrent") {
+		tunnelReq.MaxConcurrentRequests = &maxConcurrent
+	}
+	tunnel, err := apiClient.CreateTunnel(tunnelReq)
 	if err != nil {
+		switch {
+		case client.IsCode(err, problem.CodeInvalidAPIKey):
+			return fmt.Errorf("failed to create tunnel: %w (run 'tunnel register' to get a new API key)", err)
+		case client.IsCode(err, problem.CodeSubdomainTaken):
+			return fmt.Errorf("failed to create tunnel: %w (choose another --domain)", err)
+		}
 		return fmt.Errorf("failed to create tunnel: %w", err)
 	}
+	reused := tunnel.Reused
+
+	// Multi-region deployments: move the tunnel to whichever region answers fastest
+	if region == "" && len(tunnel.Regions) > 1 {
+		nearest, err := client.NearestRegion(tunnel.Regions)
+		if err == nil && nearest.Name != tunnel.Region {
+			tunnelReq.Subdomain, tunnelReq.Region = tunnel.Subdomain, nearest.Name
+			if moved, err := apiClient.CreateTunnel(tunnelReq); err == nil {
+				tunnel = moved
+			} else {
+				fmt.Printf("Warning: could not move tunnel to %s: %v\n", nearest.Name, err)
+			}
+		}
+	}
 
-	if tunnel.Reused {
+	if reused {
 		fmt.Printf("\n✓ Reusing existing tunnel!\n")
 	} else {
 		fmt.Printf("\n✓ Tunnel created successfully!\n")
 	}
 	fmt.Printf("  Tunnel ID: %s\n", tunnel.TunnelID)
 	fmt.Printf("  Domain:    %s\n", tunnel.Domain)
-	fmt.Printf("  Status:    %s\n\n", tunnel.Status)
+	fmt.Printf("  Status:    %s\n", tunnel.Status)
+	if tunnel.Region != "" {
+		fmt.Printf("  Region:    %s\n", tunnel.Region)
+	}
+	fmt.Printf("  Policy:    %s\n", tunnel.ConnectionPolicy)
+	if tunnel.BlockBots || tunnel.RobotsTxt {
+		fmt.Printf("  Bots:      %s\n", botSummary(tunnel))
+	}
+	if len(tunnel.AllowedCountries) > 0 {
+		fmt.Printf("  Countries: %s\n", strings.Join(tunnel.AllowedCountries, ", "))
+	}
+	if len(tunnel.AllowedMethods) > 0 {
+		fmt.Printf("  Methods:   %s\n", strings.Join(tunnel.AllowedMethods, ", "))
+	}
+	if tunnel.PasswordProtected {
+		fmt.Printf("  Password:  required\n")
+	}
+	if tunnel.Visibility == "private" {
+		fmt.Printf("  Access:    private (tokens from 'tunnel access grant %s <consumer>')\n", tunnel.Subdomain)
+	}
+	if len(tunnel.StrippedHeaders) > 0 {
+		fmt.Printf("  Strips:    %s\n", strings.Join(tunnel.StrippedHeaders, ", "))
+	}
+	if len(tunnel.RequiredHeaders) > 0 {
+		fmt.Printf("  Requires:  %s\n", strings.Join(requiredHeaderNames(tunnel.RequiredHeaders), ", "))
+	}
+	for _, rule := range tunnel.ResponseHeaders {
+		fmt.Printf("  Responds:  %s\n", rule)
+	}
+	if len(tunnel.StrippedResponseHeaders) > 0 {
+		fmt.Printf("  Hides:     %s\n", strings.Join(tunnel.StrippedResponseHeaders, ", "))
+	}
+	if tunnel.LowLatency {
+		fmt.Printf("  Latency:   low (metered as low-latency usage)\n")
+	}
+	if tunnel.MaxConcurrentRequests > 0 {
+		fmt.Printf("  Serves:    at most %d requests at a time\n", tunnel.MaxConcurrentRequests)
+	}
+	fmt.Println()
 	fmt.Printf("Your local service is now accessible at: https://%s\n\n", tunnel.Domain)
 
 	// Create and start proxy
 	fmt.Println("Starting proxy...")
 
-	proxyInstance := proxy.NewProxy(port, tunnel.WebsocketURL, cfg.APIKey, tunnel.TunnelID)
-	proxyInstance.AutoReconnect = autoReconnect
+	var recorder func(*proxy.Exchange)
+	if !noHistory {
+		if recorder, err = historyRecorder(cmd, cfg, tunnel); err != nil {
+			fmt.Printf("Warning: request history disabled: %v\n", err)
+		}
+	}
+
+	// The hooks still running when the CLI exits get to finish
+	hookRunner := &hooks.Runner{OnConnect: onConnectHook, OnDisconnect: onDisconnectHook}
+	defer hookRunner.Wait()
+	hookEvent := func(event string) hooks.Event {
+		return hooks.Event{
+			Event:     event,
+			TunnelID:  tunnel.TunnelID,
+			Subdomain: tunnel.Subdomain,
+			Domain:    tunnel.Domain,
+			URL:       "https://" + tunnel.Domain,
+			Region:    tunnel.Region,
+			LocalPort: port,
+		}
+	}
+
+	newProxy := func(onConflict string) *proxy.Proxy {
+		proxyInstance := proxy.NewProxy(port, tunnel.WebsocketURL, cfg.APIKey, tunnel.TunnelID)
+		proxyInstance.AutoReconnect = autoReconnect
+		proxyInstance.ClientVersion = Version
+		proxyInstance.PublicDomain = tunnel.Domain
+		proxyInstance.RewriteRedirects = rewriteRedirects
+		proxyInstance.RewriteContentTypes = rewriteBody
+		proxyInstance.ThrottleDown = downRate
+		proxyInstance.ThrottleUp = upRate
+		proxyInstance.Latency = latency
+		proxyInstance.ExcludedPaths = excludePaths
+		proxyInstance.ExcludedStatus = excludeStatus
+		proxyInstance.OnConflict = onConflict
+		proxyInstance.TokenSource = func() (string, error) {
+			resp, err := apiClient.CreateConnectionToken(tunnel.TunnelID)
+			if err != nil {
+				return "", err
+			}
+			return resp.Token, nil
+		}
+
+		proxyInstance.OnStats = edgeStatsPrinter()
+		proxyInstance.OnExchange = recorder
+		proxyInstance.OnConnect = func(reconnect bool) {
+			e := hookEvent(hooks.EventConnect)
+			e.Reconnect = reconnect
+			hookRunner.Fire(e)
+		}
+		proxyInstance.OnDisconnect = func(reason string, final bool) {
+			e := hookEvent(hooks.EventDisconnect)
+			e.Reason, e.Final = reason, final
+			hookRunner.Fire(e)
+		}
+		return proxyInstance
+	}
+
+	if len(excludePaths) > 0 {
+		fmt.Printf("Not forwarding: %s (answered with %d)\n", strings.Join(excludePaths, ", "), excludeStatus)
+	}
+	if downRate > 0 || upRate > 0 || latency > 0 {
+		fmt.Printf("Shaping local traffic: %s\n", throttleSummary(throttleDown, throttleUp, latency))
+	}
 
 	if autoReconnect {
 		fmt.Println("Auto-reconnect enabled - tunnel will automatically restart on failure")
@@ -102,28 +384,254 @@ func runStart(cmd *cobra.Command, args []string) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	// Start proxy in a goroutine
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- proxyInstance.Start(ctx)
-	}()
+	// Ask what to do when another machine holds the tunnel, unless the user
+	// already said or nobody is there to answer
+	onConflict := onConflictFlag
+	if onConflict == "abort" || (onConflict == "" && interactive()) {
+		onConflict = models.ConnectConflictAsk
+	}
 
-	fmt.Println("✓ Tunnel is now active!")
-	fmt.Println("\nPress Ctrl+C to stop the tunnel")
+	for {
+		proxyInstance := newProxy(onConflict)
 
-	// Wait for interrupt or error
-	select {
-	case <-sigCh:
-		fmt.Println("\n\nStopping tunnel...")
-		cancel()
-		// Wait for proxy to stop
-		<-errCh
-		fmt.Println("✓ Tunnel stopped")
-	case err := <-errCh:
-		if err != nil && err != context.Canceled {
-			return fmt.Errorf("proxy error: %w", err)
+		// Start proxy in a goroutine
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- proxyInstance.Start(ctx)
+		}()
+
+		fmt.Println("✓ Tunnel is now active!")
+		fmt.Println("\nPress Ctrl+C to stop the tunnel")
+
+		// Wait for interrupt or error
+		select {
+		case <-sigCh:
+			fmt.Println("\n\nStopping tunnel...")
+			cancel()
+			// Wait for proxy to stop
+			<-errCh
+			fmt.Println("✓ Tunnel stopped")
+		case err := <-errCh:
+			var conflict *proxy.ConflictError
+			if errors.As(err, &conflict) {
+				if onConflict, err = resolveConflict(conflict, sigCh); err != nil {
+					return err
+				}
+				continue
+			}
+			if errors.Is(err, proxy.ErrTunnelDeleted) {
+				fmt.Println("\n✓ Tunnel was deleted, exiting")
+				return nil
+			}
+			if errors.Is(err, proxy.ErrConnectionReplaced) {
+				fmt.Println("\n✓ Another client took over this tunnel, exiting")
+				return nil
+			}
+			if errors.Is(err, proxy.ErrTunnelInUse) {
+				return fmt.Errorf("%w (start the tunnel with --connection-policy takeover or multi to change this)", err)
+			}
+			if errors.Is(err, proxy.ErrConnectionLimit) {
+				return fmt.Errorf("%w (stop a running tunnel first)", err)
+			}
+			if err != nil && err != context.Canceled {
+				return fmt.Errorf("proxy error: %w", err)
+			}
 		}
+		return nil
+	}
+}
+
+// interactive reports whether stdin is a terminal someone can answer on
+func interactive() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// resolveConflict tells the user which machine holds the tunnel and asks
+// whether to take it over, attach next to it or give up. It returns the
+// on_conflict to connect with again. With --on-conflict abort it gives up
+// without asking.
+func resolveConflict(conflict *proxy.ConflictError, sigCh <-chan os.Signal) (string, error) {
+	abort := fmt.Errorf("tunnel is connected from another machine (%s); start with --on-conflict takeover to replace it", conflict.Describe())
+	if onConflictFlag == "abort" || !interactive() {
+		return "", abort
 	}
 
-	return nil
+	fmt.Printf("\nThis tunnel is already connected from another machine:\n  %s\n\n", conflict.Describe())
+	prompt := "[t]ake over, [q]uit: "
+	if conflict.Connection.CanAttach {
+		prompt = "[t]ake over, [a]ttach alongside it, [q]uit: "
+	}
+
+	answers := make(chan string, 1)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print(prompt)
+		go func() {
+			answer, _ := reader.ReadString('\n')
+			answers <- strings.ToLower(strings.TrimSpace(answer))
+		}()
+
+		var answer string
+		select {
+		case answer = <-answers:
+		case <-sigCh:
+			return "", abort
+		}
+		switch {
+		case answer == "t" || answer == "takeover" || answer == "take over":
+			return models.ConnectConflictTakeover, nil
+		case (answer == "a" || answer == "attach") && conflict.Connection.CanAttach:
+			return models.ConnectConflictAttach, nil
+		case answer == "" || answer == "q" || answer == "quit":
+			return "", abort
+		}
+	}
+}
+
+// edgeStatsPrinter returns a stats handler that prints the edge's view of the
+// tunnel whenever it changes, so failures that never reach the local service
+// (saturation, timeouts, a dropped connection) show up too
+func edgeStatsPrinter() func(*models.StatsPayload) {
+	var last string
+	return func(stats *models.StatsPayload) {
+		line := fmt.Sprintf("Edge: %d in flight, %d queued, %d requests in the last %ds (%.1f%% errors)",
+			stats.Inflight, stats.Queued, stats.Requests, stats.WindowSeconds, stats.ErrorRate*100)
+		if line != last {
+			last = line
+			fmt.Println(line)
+		}
+	}
+}
+
+// applyPreset detects the dev server in the working directory, prints what
+// it found and applies the framework's settings the user did not set
+func applyPreset(cmd *cobra.Command) (int, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get working directory: %w", err)
+	}
+	preset, err := detect.Detect(dir)
+	if errors.Is(err, detect.ErrNothingFound) {
+		return 0, fmt.Errorf("--auto found no dev server: nothing listens on ports %s and no known project files are here; pass the port instead", joinPorts(detect.CommonPorts))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Printf("Detected %s\n", preset)
+	if preset.RewriteRedirects && !cmd.Flags().Changed("rewrite-redirects") {
+		rewriteRedirects = true
+		fmt.Println("  Rewriting localhost redirects and cookies (--rewrite-redirects)")
+	}
+	if preset.Hint != "" {
+		fmt.Printf("  Tip: %s\n", preset.Hint)
+	}
+	return preset.Port, nil
+}
+
+func joinPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = strconv.Itoa(port)
+	}
+	return strings.Join(s, ", ")
+}
+
+// historyRecorder opens the request history and returns an exchange handler
+// that adds every forwarded request to it
+func historyRecorder(cmd *cobra.Command, cfg *config.Config, tunnel *client.CreateTunnelResponse) (func(*proxy.Exchange), error) {
+	opts, err := history.ConfigOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Flags().Changed("history-bodies") {
+		opts.MaxBodyBytes = historyBodies
+	}
+	dir, err := history.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	store, err := history.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ex *proxy.Exchange) {
+		err := store.Add(history.Entry{
+			RequestID:       ex.RequestID,
+			TunnelID:        tunnel.TunnelID,
+			Domain:          tunnel.Domain,
+			Method:          ex.Method,
+			Path:            ex.Path,
+			RequestHeaders:  ex.RequestHeaders,
+			RequestBytes:    int64(len(ex.RequestBody)),
+			RequestBody:     ex.RequestBody,
+			StatusCode:      ex.StatusCode,
+			ResponseHeaders: ex.ResponseHeaders,
+			ResponseBytes:   int64(len(ex.ResponseBody)),
+			ResponseBody:    ex.ResponseBody,
+			Streamed:        ex.Streamed,
+			Error:           ex.Error,
+			StartedAt:       ex.StartedAt,
+			DurationMs:      ex.Duration.Milliseconds(),
+		})
+		if err != nil {
+			log.Printf("Failed to record request %s in history: %v", ex.RequestID, err)
+		}
+	}, nil
+}
+
+// throttleSummary describes the shaping set by --throttle-down, --throttle-up
+// and --latency
+func throttleSummary(down, up string, latency time.Duration) string {
+	var parts []string
+	if down != "" {
+		parts = append(parts, down+" down")
+	}
+	if up != "" {
+		parts = append(parts, up+" up")
+	}
+	if latency > 0 {
+		parts = append(parts, latency.String()+" latency")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// botSummary describes a tunnel's bot filtering settings
+func botSummary(tunnel *client.CreateTunnelResponse) string {
+	switch {
+	case tunnel.BlockBots && tunnel.RobotsTxt:
+		return "blocked, robots.txt disallows all"
+	case tunnel.BlockBots:
+		return "blocked"
+	default:
+		return "robots.txt disallows all"
+	}
+}
+
+// nonEmpty drops the empty value a bare --require-header= or
+// --response-header= leaves behind
+func nonEmpty(values []string) []string {
+	kept := []string{}
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// requiredHeaderNames lists required headers by name, keeping shared secrets
+// off the terminal
+func requiredHeaderNames(rules []string) []string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		name, _, hasValue := strings.Cut(rule, ": ")
+		if hasValue {
+			name += " (value checked)"
+		}
+		names[i] = name
+	}
+	return names
 }
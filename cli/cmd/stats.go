@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lmanrique/tunnel/cli/internal/client"
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/spf13/cobra"
+)
+
+var statsWindow string
+
+var statsCmd = &cobra.Command{
+	Use:   "stats [tunnel-id]",
+	Short: "Show request statistics for a tunnel",
+	Long: `Show request counts, error rate, latency percentiles, and bytes transferred
+for a tunnel over a time window.
+
+Examples:
+  tunnel stats abc123def456
+  tunnel stats abc123def456 --window 7d`,
+	Args: cobra.ExactArgs(1),
+	RunE: runStats,
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+	statsCmd.Flags().StringVar(&statsWindow, "window", "24h", "Time window: 1h, 24h, 7d, or 30d")
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	tunnelID := args[0]
+
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if !config.IsConfigured() {
+		return fmt.Errorf("not configured. Please run 'tunnel register' first")
+	}
+
+	// Create API client
+	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
+
+	stats, err := apiClient.GetTunnelStats(tunnelID, statsWindow)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel stats: %w", err)
+	}
+
+	fmt.Printf("Tunnel %s — last %s\n\n", stats.TunnelID, stats.Window)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Requests:\t%d\n", stats.Requests)
+	fmt.Fprintf(w, "Errors (5xx):\t%d\n", stats.Errors)
+	fmt.Fprintf(w, "Client errors (4xx):\t%d\n", stats.ClientErrors)
+	fmt.Fprintf(w, "Error rate:\t%.2f%%\n", stats.ErrorRate*100)
+	fmt.Fprintf(w, "Latency p50:\t%d ms\n", stats.P50Ms)
+	fmt.Fprintf(w, "Latency p95:\t%d ms\n", stats.P95Ms)
+	fmt.Fprintf(w, "Bytes in:\t%s\n", formatBytes(stats.BytesIn))
+	fmt.Fprintf(w, "Bytes out:\t%s\n", formatBytes(stats.BytesOut))
+	w.Flush()
+
+	return nil
+}
+
+// formatBytes renders a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
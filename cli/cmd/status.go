@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/lmanrique/tunnel/cli/internal/client"
 	"github.com/lmanrique/tunnel/cli/internal/config"
 	"github.com/spf13/cobra"
 )
@@ -38,6 +40,7 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	fmt.Printf("API Endpoint:  %s\n", cfg.APIEndpoint)
 	fmt.Printf("WS Endpoint:   %s\n", cfg.WebSocketEndpoint)
 	fmt.Printf("API Key:       %s...\n", maskAPIKey(cfg.APIKey))
+	fmt.Printf("Last Used:     %s\n", lastUsed(client.NewClient(cfg.APIEndpoint, cfg.APIKey)))
 
 	fmt.Println("\nConfiguration file location:")
 	configDir, _ := config.GetConfigDir()
@@ -46,6 +49,21 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// lastUsed describes the API key's last use as recorded by the server. The
+// lookup is a use too, so the server reports the one before it.
+func lastUsed(apiClient *client.Client) string {
+	resp, err := apiClient.ListTunnels()
+	switch {
+	case err != nil:
+		return fmt.Sprintf("unknown (%v)", err)
+	case resp.LastUsedAt == nil:
+		return "never"
+	case resp.LastUsedIP != "":
+		return fmt.Sprintf("%s from %s", resp.LastUsedAt.Local().Format(time.DateTime), resp.LastUsedIP)
+	}
+	return resp.LastUsedAt.Local().Format(time.DateTime)
+}
+
 func maskAPIKey(apiKey string) string {
 	if len(apiKey) < 10 {
 		return "****"
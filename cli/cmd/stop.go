@@ -1,32 +1,41 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/lmanrique/tunnel/cli/internal/client"
 	"github.com/lmanrique/tunnel/cli/internal/config"
 	"github.com/spf13/cobra"
 )
 
+var stopDomains []string
+
 var stopCmd = &cobra.Command{
-	Use:   "stop [tunnel-id]",
-	Short: "Stop and delete a tunnel",
-	Long: `Stop and delete a tunnel by its ID.
-This will permanently remove the tunnel and its associated domain.
-
-Example:
-  tunnel stop abc123def456`,
-	Args: cobra.ExactArgs(1),
+	Use:   "stop [tunnel-id | subdomain | domain]...",
+	Short: "Stop and delete tunnels",
+	Long: `Stop and delete one or more tunnels, each given by its ID, its subdomain
+or its full hostname. Without arguments you pick the tunnels from a list.
+This will permanently remove the tunnels and their associated domains.
+
+Examples:
+  tunnel stop abc123def456
+  tunnel stop myapp api.tunnel.example.com
+  tunnel stop --domain myapp --domain api
+  tunnel stop`,
 	RunE: runStop,
 }
 
 func init() {
 	rootCmd.AddCommand(stopCmd)
+	stopCmd.Flags().StringSliceVar(&stopDomains, "domain", nil, "Subdomain or hostname of a tunnel to stop (repeatable)")
 }
 
 func runStop(cmd *cobra.Command, args []string) error {
-	tunnelID := args[0]
-
 	// Load config
 	cfg, err := config.Load()
 	if err != nil {
@@ -40,14 +49,104 @@ func runStop(cmd *cobra.Command, args []string) error {
 	// Create API client
 	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
 
-	fmt.Printf("Stopping tunnel %s...\n", tunnelID)
+	// IDs, subdomains and hostnames are all resolved against the client's tunnels
+	resp, err := apiClient.ListTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %w", err)
+	}
 
-	// Delete tunnel
-	if err := apiClient.DeleteTunnel(tunnelID); err != nil {
-		return fmt.Errorf("failed to stop tunnel: %w", err)
+	var tunnels []client.Tunnel
+	if len(args) == 0 && len(stopDomains) == 0 {
+		tunnels, err = pickTunnels(resp.Tunnels)
+	} else {
+		tunnels, err = resolveTunnels(resp.Tunnels, append(args, stopDomains...))
+	}
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("✓ Tunnel stopped successfully!")
+	// Keep going past a failure so one bad tunnel doesn't leave the rest running
+	failed := 0
+	for _, tunnel := range tunnels {
+		fmt.Printf("Stopping tunnel %s (%s)...\n", tunnel.TunnelID, tunnel.Domain)
+		if err := apiClient.DeleteTunnel(tunnel.TunnelID); err != nil {
+			fmt.Printf("✗ Failed to stop tunnel %s: %v\n", tunnel.TunnelID, err)
+			failed++
+			continue
+		}
+		fmt.Println("✓ Tunnel stopped successfully!")
+	}
 
+	if failed > 0 {
+		return fmt.Errorf("failed to stop %d of %d tunnel(s)", failed, len(tunnels))
+	}
 	return nil
 }
+
+// resolveTunnels finds the tunnel each name refers to by ID, subdomain or
+// hostname. Every name must match, so a typo stops nothing.
+func resolveTunnels(tunnels []client.Tunnel, names []string) ([]client.Tunnel, error) {
+	var resolved []client.Tunnel
+	seen := make(map[string]bool)
+	for _, name := range names {
+		tunnel, ok := findTunnel(tunnels, name)
+		if !ok {
+			return nil, fmt.Errorf("no tunnel matches %q; run 'tunnel list' to see your tunnels", name)
+		}
+		if seen[tunnel.TunnelID] {
+			continue
+		}
+		seen[tunnel.TunnelID] = true
+		resolved = append(resolved, tunnel)
+	}
+	return resolved, nil
+}
+
+func findTunnel(tunnels []client.Tunnel, name string) (client.Tunnel, bool) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	for _, tunnel := range tunnels {
+		if strings.EqualFold(tunnel.TunnelID, name) || strings.EqualFold(tunnel.Subdomain, name) || strings.EqualFold(tunnel.Domain, name) {
+			return tunnel, true
+		}
+	}
+	return client.Tunnel{}, false
+}
+
+// pickTunnels lists the tunnels and asks which of them to stop
+func pickTunnels(tunnels []client.Tunnel) ([]client.Tunnel, error) {
+	if len(tunnels) == 0 {
+		return nil, fmt.Errorf("no tunnels found")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "#\tTUNNEL ID\tDOMAIN\tSTATUS")
+	for i, tunnel := range tunnels {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, tunnel.TunnelID, tunnel.Domain, tunnel.Status)
+	}
+	w.Flush()
+
+	fmt.Print("\nTunnels to stop (numbers separated by spaces or commas, 'all'): ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return nil, fmt.Errorf("no tunnel selected; nothing was stopped")
+	}
+	if answer == "all" {
+		return tunnels, nil
+	}
+
+	var picked []client.Tunnel
+	seen := make(map[int]bool)
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == ' ' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > len(tunnels) {
+			return nil, fmt.Errorf("invalid selection %q; nothing was stopped", field)
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		picked = append(picked, tunnels[n-1])
+	}
+	return picked, nil
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lmanrique/tunnel/cli/internal/client"
+	"github.com/lmanrique/tunnel/cli/internal/config"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/spf13/cobra"
+)
+
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show the account the API key belongs to",
+	Long: `Ask the server which client the configured API key belongs to, and show
+its status, plan, tunnel quota and usage, and when the key was last used.`,
+	Args: cobra.NoArgs,
+	RunE: runWhoAmI,
+}
+
+func init() {
+	rootCmd.AddCommand(whoamiCmd)
+}
+
+func runWhoAmI(cmd *cobra.Command, args []string) error {
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if !config.IsConfigured() {
+		return fmt.Errorf("not configured. Please run 'tunnel register' first")
+	}
+
+	apiClient := client.NewClient(cfg.APIEndpoint, cfg.APIKey)
+
+	info, err := apiClient.WhoAmI()
+	if client.IsCode(err, problem.CodeInvalidAPIKey) {
+		return fmt.Errorf("the configured API key is not valid: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up client: %w", err)
+	}
+
+	plan := info.Plan
+	if plan == "" {
+		plan = "default"
+	}
+	quota := "unlimited"
+	if info.TunnelQuota > 0 {
+		quota = fmt.Sprintf("%d", info.TunnelQuota)
+	}
+	lastUsed := "never"
+	if info.APIKey.LastUsedAt != nil {
+		lastUsed = info.APIKey.LastUsedAt.Local().Format(time.DateTime)
+		if info.APIKey.LastUsedIP != "" {
+			lastUsed += " from " + info.APIKey.LastUsedIP
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Client ID:\t%s\n", info.ClientID)
+	if info.ClientID != cfg.ClientID {
+		fmt.Fprintf(w, "\t(the config file says %s)\n", cfg.ClientID)
+	}
+	fmt.Fprintf(w, "Status:\t%s\n", info.Status)
+	fmt.Fprintf(w, "Plan:\t%s\n", plan)
+	fmt.Fprintf(w, "Registered:\t%s\n", info.CreatedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Tunnels:\t%d of %s (%d active)\n", info.TunnelCount, quota, info.ActiveTunnels)
+	if info.ConnectionLimit > 0 {
+		fmt.Fprintf(w, "Connections:\t%d of %d\n", info.Connections, info.ConnectionLimit)
+	} else {
+		fmt.Fprintf(w, "Connections:\t%d\n", info.Connections)
+	}
+	fmt.Fprintf(w, "API key:\t%s\n", info.APIKey.Hint)
+	fmt.Fprintf(w, "Key created:\t%s\n", info.APIKey.CreatedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Key last used:\t%s\n", lastUsed)
+	w.Flush()
+
+	return nil
+}
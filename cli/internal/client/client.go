@@ -3,9 +3,18 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
 )
 
 // Client represents a REST API client
@@ -13,6 +22,8 @@ type Client struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
+
+	warnOnce sync.Once
 }
 
 // NewClient creates a new API client
@@ -24,6 +35,28 @@ func NewClient(baseURL, apiKey string) *Client {
 	}
 }
 
+// endpoint returns the URL of a management API path in the version this
+// client speaks
+func (c *Client) endpoint(path string) string {
+	return fmt.Sprintf("%s/v%d%s", strings.TrimSuffix(c.BaseURL, "/"), models.APIVersionCurrent, path)
+}
+
+// do sends a management API request with the API version this client speaks,
+// and shows the first deprecation warning the server answers with
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set(models.APIVersionHeader, strconv.Itoa(models.APIVersionCurrent))
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if warning := resp.Header.Get(models.APIWarningHeader); warning != "" {
+		c.warnOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		})
+	}
+	return resp, nil
+}
+
 // RegisterClientResponse represents the response from client registration
 type RegisterClientResponse struct {
 	ClientID string `json:"client_id"`
@@ -33,18 +66,61 @@ type RegisterClientResponse struct {
 
 // CreateTunnelRequest represents a request to create a tunnel
 type CreateTunnelRequest struct {
-	Subdomain string `json:"subdomain,omitempty"`
+	Subdomain        string `json:"subdomain,omitempty"`
+	ConnectionPolicy string `json:"connection_policy,omitempty"`
+	Region           string `json:"region,omitempty"`
+	// BlockBots and RobotsTxt are left unchanged on a reused tunnel when nil
+	BlockBots *bool `json:"block_bots,omitempty"`
+	RobotsTxt *bool `json:"robots_txt,omitempty"`
+	// AllowedCountries is sent as null when nil, keeping a reused tunnel's
+	// restriction; an empty list lifts it
+	AllowedCountries []string `json:"allowed_countries"`
+	AllowedMethods   []string `json:"allowed_methods"` // Same nil and empty semantics
+	// Password is left unchanged on a reused tunnel when nil; "" removes it
+	Password *string `json:"password,omitempty"`
+	// Visibility is "private" or "public"; "" leaves a reused tunnel's unchanged
+	Visibility string `json:"visibility,omitempty"`
+	// StrippedHeaders and RequiredHeaders have the same nil and empty
+	// semantics as AllowedCountries
+	StrippedHeaders []string `json:"stripped_headers"`
+	RequiredHeaders []string `json:"required_headers"`
+	// ResponseHeaders ("Name: value") and StrippedResponseHeaders, the
+	// response header policy, have the same semantics too
+	ResponseHeaders         []string `json:"response_headers"`
+	StrippedResponseHeaders []string `json:"stripped_response_headers"`
+	// LowLatency is left unchanged on a reused tunnel when nil
+	LowLatency *bool `json:"low_latency,omitempty"`
+	// MaxConcurrentRequests is left unchanged on a reused tunnel when nil;
+	// 0 removes the cap
+	MaxConcurrentRequests *int64 `json:"max_concurrent_requests,omitempty"`
 }
 
 // CreateTunnelResponse represents the response from creating a tunnel
 type CreateTunnelResponse struct {
-	TunnelID     string `json:"tunnel_id"`
-	Domain       string `json:"domain"`
-	Subdomain    string `json:"subdomain"`
-	WebsocketURL string `json:"websocket_url"`
-	Status       string `json:"status"`
-	Message      string `json:"message"`
-	Reused       bool   `json:"reused,omitempty"`
+	TunnelID         string   `json:"tunnel_id"`
+	Domain           string   `json:"domain"`
+	Subdomain        string   `json:"subdomain"`
+	WebsocketURL     string   `json:"websocket_url"`
+	Status           string   `json:"status"`
+	ConnectionPolicy string   `json:"connection_policy"`
+	Message          string   `json:"message"`
+	Reused           bool     `json:"reused,omitempty"`
+	Region           string   `json:"region,omitempty"`
+	Regions          []Region `json:"regions,omitempty"`
+	BlockBots        bool     `json:"block_bots,omitempty"`
+	RobotsTxt        bool     `json:"robots_txt,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+
+	PasswordProtected bool     `json:"password_protected,omitempty"`
+	Visibility        string   `json:"visibility,omitempty"`
+	StrippedHeaders   []string `json:"stripped_headers,omitempty"`
+	RequiredHeaders   []string `json:"required_headers,omitempty"`
+
+	ResponseHeaders         []string `json:"response_headers,omitempty"`
+	StrippedResponseHeaders []string `json:"stripped_response_headers,omitempty"`
+	LowLatency              bool     `json:"low_latency,omitempty"`
+	MaxConcurrentRequests   int64    `json:"max_concurrent_requests,omitempty"`
 }
 
 // Tunnel represents a tunnel
@@ -57,36 +133,143 @@ type Tunnel struct {
 	ConnectionID string `json:"connection_id,omitempty"`
 	CreatedAt    string `json:"created_at"`
 	UpdatedAt    string `json:"updated_at"`
+
+	// Visibility is "private" when only requests with an access token are
+	// forwarded; AccessConsumers maps the holders of one to its issue time
+	Visibility      string           `json:"visibility,omitempty"`
+	AccessConsumers map[string]int64 `json:"access_consumers,omitempty"`
+
+	// Reported by the CLI holding the most recent connection
+	ConnectionInfo *ConnectionInfo `json:"connection_info,omitempty"`
+
+	// Only set when tunnels are listed with a health probe
+	ConnectionHealthy *bool  `json:"connection_healthy,omitempty"`
+	LastSeen          string `json:"last_seen,omitempty"`
+}
+
+// ConnectionInfo describes the machine connected to a tunnel
+type ConnectionInfo struct {
+	CLIVersion  string `json:"cli_version,omitempty"`
+	Platform    string `json:"platform,omitempty"`
+	SourceIP    string `json:"source_ip,omitempty"`
+	ConnectedAt string `json:"connected_at"`
 }
 
 // ListTunnelsResponse represents the response from listing tunnels
 type ListTunnelsResponse struct {
 	Tunnels []Tunnel `json:"tunnels"`
 	Count   int      `json:"count"`
+
+	// LastUsedAt and LastUsedIP are the API key's use before this request
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// ClientInfo is the client an API key belongs to, from GET /clients/me
+type ClientInfo struct {
+	ClientID        string    `json:"client_id"`
+	Status          string    `json:"status"`
+	Plan            string    `json:"plan,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	TunnelQuota     int       `json:"tunnel_quota"` // 0 means no limit
+	TunnelCount     int       `json:"tunnel_count"`
+	ActiveTunnels   int       `json:"active_tunnels"`
+	ConnectionLimit int       `json:"connection_limit"` // 0 means no limit
+	Connections     int       `json:"connections"`
+	APIKey          struct {
+		Hint       string     `json:"hint"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+		LastUsedIP string     `json:"last_used_ip,omitempty"`
+	} `json:"api_key"`
+}
+
+// TunnelStats represents aggregated request statistics for a tunnel
+type TunnelStats struct {
+	TunnelID     string  `json:"tunnel_id"`
+	Window       string  `json:"window"`
+	Since        string  `json:"since"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	ClientErrors int     `json:"client_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	P50Ms        int64   `json:"p50_ms"`
+	P95Ms        int64   `json:"p95_ms"`
+	BytesIn      int64   `json:"bytes_in"`
+	BytesOut     int64   `json:"bytes_out"`
+}
+
+// ConnectionTokenResponse represents a short-lived token for opening a tunnel's WebSocket
+type ConnectionTokenResponse struct {
+	Token     string `json:"token"`
+	TunnelID  string `json:"tunnel_id"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// AccessTokenResponse is an access token issued to a consumer of a private tunnel
+type AccessTokenResponse struct {
+	Token     string `json:"token"`
+	TunnelID  string `json:"tunnel_id"`
+	Consumer  string `json:"consumer"`
+	ExpiresAt string `json:"expires_at"`
+	Header    string `json:"header"`
 }
 
-// ErrorResponse represents an error response from the API
+// ErrorResponse represents an error response from the API, a problem details
+// body (application/problem+json)
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code is one of the problem.Code* constants
+	Code string `json:"code"`
+}
+
+// APIError is returned for an error response from the API
+type APIError struct {
+	StatusCode int
+	// Code is one of the problem.Code* constants, empty when the body was not
+	// a problem
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Message)
+}
+
+// IsCode reports whether err is an APIError with the given problem code
+func IsCode(err error, code string) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// apiError reads the error response resp into an APIError
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error == "" {
+		return &APIError{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+	return &APIError{StatusCode: resp.StatusCode, Code: errResp.Code, Message: errResp.Error}
 }
 
 // RegisterClient registers a new client with the API
 func (c *Client) RegisterClient() (*RegisterClientResponse, error) {
-	url := fmt.Sprintf("%s/clients", c.BaseURL)
+	url := c.endpoint("/clients")
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.HTTPClient.Post(url, "application/json", nil)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		var errResp ErrorResponse
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, errResp.Error)
+		return nil, apiError(resp)
 	}
 
 	var result RegisterClientResponse
@@ -97,13 +280,11 @@ func (c *Client) RegisterClient() (*RegisterClientResponse, error) {
 	return &result, nil
 }
 
-// CreateTunnel creates a new tunnel
-func (c *Client) CreateTunnel(subdomain string) (*CreateTunnelResponse, error) {
-	url := fmt.Sprintf("%s/tunnels", c.BaseURL)
-
-	reqBody := CreateTunnelRequest{
-		Subdomain: subdomain,
-	}
+// CreateTunnel creates a new tunnel, or reuses the caller's tunnel for the
+// subdomain. Empty or nil fields of reqBody keep the server default: a random
+// subdomain, the takeover connection policy, the nearest home region.
+func (c *Client) CreateTunnel(reqBody CreateTunnelRequest) (*CreateTunnelResponse, error) {
+	url := c.endpoint("/tunnels")
 
 	bodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
@@ -118,19 +299,14 @@ func (c *Client) CreateTunnel(subdomain string) (*CreateTunnelResponse, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		var errResp ErrorResponse
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, errResp.Error)
+		return nil, apiError(resp)
 	}
 
 	var result CreateTunnelResponse
@@ -143,7 +319,15 @@ func (c *Client) CreateTunnel(subdomain string) (*CreateTunnelResponse, error) {
 
 // ListTunnels lists all tunnels for the client
 func (c *Client) ListTunnels() (*ListTunnelsResponse, error) {
-	url := fmt.Sprintf("%s/tunnels", c.BaseURL)
+	return c.listTunnels(c.endpoint("/tunnels"))
+}
+
+// ListTunnelsWithHealth lists all tunnels and probes each active tunnel's connection
+func (c *Client) ListTunnelsWithHealth() (*ListTunnelsResponse, error) {
+	return c.listTunnels(c.endpoint("/tunnels?health=1"))
+}
+
+func (c *Client) listTunnels(url string) (*ListTunnelsResponse, error) {
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -152,19 +336,14 @@ func (c *Client) ListTunnels() (*ListTunnelsResponse, error) {
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		var errResp ErrorResponse
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, errResp.Error)
+		return nil, apiError(resp)
 	}
 
 	var result ListTunnelsResponse
@@ -177,7 +356,7 @@ func (c *Client) ListTunnels() (*ListTunnelsResponse, error) {
 
 // DeleteTunnel deletes a tunnel
 func (c *Client) DeleteTunnel(tunnelID string) error {
-	url := fmt.Sprintf("%s/tunnels/%s", c.BaseURL, tunnelID)
+	url := c.endpoint("/tunnels/" + tunnelID)
 
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
@@ -186,24 +365,239 @@ func (c *Client) DeleteTunnel(tunnelID string) error {
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		var errResp ErrorResponse
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return fmt.Errorf("API error: %s", errResp.Error)
+		return apiError(resp)
 	}
 
 	return nil
 }
 
+// CreateConnectionToken exchanges the API key for a short-lived token that
+// authorizes one WebSocket connection to the tunnel
+func (c *Client) CreateConnectionToken(tunnelID string) (*ConnectionTokenResponse, error) {
+	url := c.endpoint("/tunnels/" + tunnelID + "/connection-token")
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, apiError(resp)
+	}
+
+	var result ConnectionTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// CreateAccessToken issues consumer a token to call the private tunnel,
+// replacing its previous one; expiresIn 0 means the server's default
+func (c *Client) CreateAccessToken(tunnelID, consumer string, expiresIn time.Duration) (*AccessTokenResponse, error) {
+	url := c.endpoint("/tunnels/" + tunnelID + "/access-tokens")
+
+	bodyBytes, err := json.Marshal(map[string]interface{}{
+		"consumer":   consumer,
+		"expires_in": int64(expiresIn / time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, apiError(resp)
+	}
+
+	var result AccessTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// RevokeAccessToken ends the access token of a private tunnel's consumer
+func (c *Client) RevokeAccessToken(tunnelID, consumer string) error {
+	url := c.endpoint("/tunnels/" + tunnelID + "/access-tokens/" + neturl.PathEscape(consumer))
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	return nil
+}
+
+// GetTunnelStats returns request statistics for a tunnel over the given window (e.g. "24h")
+func (c *Client) GetTunnelStats(tunnelID, window string) (*TunnelStats, error) {
+	url := c.endpoint(fmt.Sprintf("/tunnels/%s/stats?window=%s", tunnelID, window))
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var result TunnelStats
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// WhoAmI returns the client the API key belongs to
+func (c *Client) WhoAmI() (*ClientInfo, error) {
+	req, err := http.NewRequest("GET", c.endpoint("/clients/me"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var result ClientInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// DeregisterResponse is the result of deleting the client
+type DeregisterResponse struct {
+	Message        string `json:"message"`
+	TunnelsDeleted int    `json:"tunnels_deleted"`
+}
+
+// Deregister deletes the client the API key belongs to with all its tunnels.
+// clientID confirms which client is meant; the server refuses a mismatch.
+func (c *Client) Deregister(clientID string) (*DeregisterResponse, error) {
+	url := c.endpoint("/clients/me?confirm=" + neturl.QueryEscape(clientID))
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var result DeregisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// BillingLink is where the client manages or buys its plan
+type BillingLink struct {
+	URL string `json:"url"`
+	// Type is "portal" for the customer portal of a paying client and
+	// "checkout" for the page that sells a plan
+	Type string `json:"type"`
+}
+
+// BillingPortal returns a link to the client's billing page
+func (c *Client) BillingPortal() (*BillingLink, error) {
+	req, err := http.NewRequest("GET", c.endpoint("/billing/portal"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var result BillingLink
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
 // TestTunnel tests if a tunnel is working by making a health check request
 func (c *Client) TestTunnel(domain string) error {
 	// Make a simple GET request to the tunnel's public URL
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// regionProbeTimeout bounds how long a single region's latency probe may take
+const regionProbeTimeout = 2 * time.Second
+
+// Region is one regional deployment the tunnel can be homed in
+type Region struct {
+	Name         string `json:"region"`
+	WebsocketURL string `json:"websocket_url"`
+	ProxyURL     string `json:"proxy_url"`
+}
+
+// NearestRegion measures the TCP connect time to every region's WebSocket
+// endpoint and returns the fastest one. Probes run concurrently, so this takes
+// at most regionProbeTimeout.
+func NearestRegion(regions []Region) (Region, error) {
+	type probe struct {
+		region  Region
+		latency time.Duration
+		err     error
+	}
+
+	results := make(chan probe, len(regions))
+	for _, region := range regions {
+		go func(region Region) {
+			latency, err := dialLatency(region.WebsocketURL)
+			results <- probe{region: region, latency: latency, err: err}
+		}(region)
+	}
+
+	var nearest *probe
+	for range regions {
+		p := <-results
+		if p.err != nil {
+			continue
+		}
+		if nearest == nil || p.latency < nearest.latency {
+			nearest = &p
+		}
+	}
+
+	if nearest == nil {
+		return Region{}, fmt.Errorf("no region could be reached")
+	}
+	return nearest.region, nil
+}
+
+func dialLatency(websocketURL string) (time.Duration, error) {
+	u, err := url.Parse(websocketURL)
+	if err != nil {
+		return 0, err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), regionProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+
+	return time.Since(start), nil
+}
@@ -19,6 +19,11 @@ type Config struct {
 	WebSocketEndpoint string `mapstructure:"websocket_endpoint"`
 	APIKey            string `mapstructure:"api_key"`
 	ClientID          string `mapstructure:"client_id"`
+
+	// Request history retention; see the history package
+	HistoryMaxAge     string `mapstructure:"history_max_age"`     // e.g. 72h; empty for the default
+	HistoryMaxEntries int    `mapstructure:"history_max_entries"` // 0 for the default
+	HistoryBodyBytes  int    `mapstructure:"history_body_bytes"`  // Bodies up to this size are kept; 0 keeps none
 }
 
 // GetConfigDir returns the configuration directory path
@@ -94,6 +99,15 @@ func Save(config *Config) error {
 	viper.Set("websocket_endpoint", config.WebSocketEndpoint)
 	viper.Set("api_key", config.APIKey)
 	viper.Set("client_id", config.ClientID)
+	if config.HistoryMaxAge != "" {
+		viper.Set("history_max_age", config.HistoryMaxAge)
+	}
+	if config.HistoryMaxEntries != 0 {
+		viper.Set("history_max_entries", config.HistoryMaxEntries)
+	}
+	if config.HistoryBodyBytes != 0 {
+		viper.Set("history_body_bytes", config.HistoryBodyBytes)
+	}
 
 	configPath := filepath.Join(configDir, ConfigFile+".yaml")
 	if err := viper.WriteConfigAs(configPath); err != nil {
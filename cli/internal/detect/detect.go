@@ -0,0 +1,201 @@
+// Package detect finds the local dev server a tunnel should expose, from the
+// project files in a directory and the common dev ports that are listening.
+package detect
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// CommonPorts are probed when the project files name no port, in order
+var CommonPorts = []int{3000, 5173, 8000, 8080, 4200, 5000, 4321}
+
+// probeTimeout bounds each port probe
+const probeTimeout = 300 * time.Millisecond
+
+// ErrNothingFound is returned by Detect when neither the project files nor a
+// listening port point at a dev server
+var ErrNothingFound = errors.New("no dev server found")
+
+// Preset is a dev server and the tunnel settings that suit it
+type Preset struct {
+	Framework        string // e.g. "Vite"; "" when only a listening port was found
+	Port             int
+	Source           string // What the port was found in, e.g. "package.json"
+	Listening        bool   // Something accepted a connection on Port
+	RewriteRedirects bool   // The framework redirects to absolute localhost URLs
+	Hint             string // Setup the framework needs to answer on the tunnel domain
+}
+
+// framework is what a dependency or project file says about a dev server
+type framework struct {
+	name             string
+	port             int
+	rewriteRedirects bool
+	hint             string
+}
+
+// packageFrameworks are recognised by their npm package, most specific first
+var packageFrameworks = []struct {
+	dependency string
+	framework
+}{
+	{"next", framework{name: "Next.js", port: 3000}},
+	{"nuxt", framework{name: "Nuxt", port: 3000}},
+	{"@sveltejs/kit", framework{name: "SvelteKit", port: 5173, hint: "add the tunnel domain to server.allowedHosts in vite.config"}},
+	{"astro", framework{name: "Astro", port: 4321, hint: "add the tunnel domain to server.allowedHosts in astro.config"}},
+	{"@angular/core", framework{name: "Angular", port: 4200, hint: "run ng serve with --allowed-hosts or --disable-host-check"}},
+	{"gatsby", framework{name: "Gatsby", port: 8000}},
+	{"react-scripts", framework{name: "Create React App", port: 3000, hint: "set DANGEROUSLY_DISABLE_HOST_CHECK=true if the page shows Invalid Host header"}},
+	{"vite", framework{name: "Vite", port: 5173, hint: "add the tunnel domain to server.allowedHosts in vite.config"}},
+	{"express", framework{name: "Express", port: 3000}},
+}
+
+// fileFrameworks are recognised by a file in the project root
+var fileFrameworks = []struct {
+	file string
+	framework
+}{
+	{"manage.py", framework{name: "Django", port: 8000, rewriteRedirects: true, hint: "add the tunnel domain to ALLOWED_HOSTS and CSRF_TRUSTED_ORIGINS"}},
+	{"artisan", framework{name: "Laravel", port: 8000, rewriteRedirects: true}},
+	{"bin/rails", framework{name: "Rails", port: 3000, rewriteRedirects: true, hint: "add the tunnel domain to config.hosts"}},
+}
+
+// scriptPort finds a port set on a dev server's command line
+var scriptPort = regexp.MustCompile(`(?:--port[= ]|-p )(\d{2,5})\b`)
+
+// composePort finds the host side of a docker-compose port mapping, as in
+// "8080:80" or 127.0.0.1:8080:80
+var composePort = regexp.MustCompile(`^\s*-\s*["']?(?:[\d.]+:)?(\d{2,5}):\d+`)
+
+// Detect looks for a dev server for the project in dir. A port the project
+// files name wins when it is listening, then any listening common port, then
+// the project's port even though nothing listens on it yet.
+func Detect(dir string) (*Preset, error) {
+	var candidates []Preset
+	if p, ok := fromPackageJSON(dir); ok {
+		candidates = append(candidates, p)
+	}
+	for _, f := range fileFrameworks {
+		if _, err := os.Stat(filepath.Join(dir, f.file)); err == nil {
+			candidates = append(candidates, f.preset(f.file))
+		}
+	}
+	candidates = append(candidates, fromCompose(dir)...)
+
+	for _, c := range candidates {
+		if listening(c.Port) {
+			c.Listening = true
+			return &c, nil
+		}
+	}
+	for _, port := range CommonPorts {
+		if listening(port) {
+			return &Preset{Port: port, Source: "listening port", Listening: true}, nil
+		}
+	}
+	if len(candidates) > 0 {
+		return &candidates[0], nil
+	}
+	return nil, ErrNothingFound
+}
+
+func (f framework) preset(source string) Preset {
+	return Preset{
+		Framework:        f.name,
+		Port:             f.port,
+		Source:           source,
+		RewriteRedirects: f.rewriteRedirects,
+		Hint:             f.hint,
+	}
+}
+
+// fromPackageJSON recognises a Node framework by its dependencies; a port in
+// the dev or start script overrides the framework's default
+func fromPackageJSON(dir string) (Preset, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return Preset{}, false
+	}
+	var pkg struct {
+		Scripts         map[string]string `json:"scripts"`
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return Preset{}, false
+	}
+
+	for _, f := range packageFrameworks {
+		_, dep := pkg.Dependencies[f.dependency]
+		_, devDep := pkg.DevDependencies[f.dependency]
+		if !dep && !devDep {
+			continue
+		}
+		p := f.preset("package.json")
+		for _, script := range []string{"dev", "start", "serve"} {
+			if m := scriptPort.FindStringSubmatch(pkg.Scripts[script]); m != nil {
+				p.Port, _ = strconv.Atoi(m[1])
+				break
+			}
+		}
+		return p, true
+	}
+	return Preset{}, false
+}
+
+// fromCompose lists the host ports published in a docker-compose file
+func fromCompose(dir string) []Preset {
+	for _, name := range []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		var presets []Preset
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if m := composePort.FindStringSubmatch(scanner.Text()); m != nil {
+				port, _ := strconv.Atoi(m[1])
+				presets = append(presets, Preset{Framework: "Docker Compose", Port: port, Source: name})
+			}
+		}
+		return presets
+	}
+	return nil
+}
+
+// listening reports whether something accepts connections on the local port
+func listening(port int) bool {
+	if port < 1 || port > 65535 {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// String describes the preset, e.g. "Vite dev server on port 5173 (package.json)"
+func (p *Preset) String() string {
+	name := "Dev server"
+	if p.Framework != "" {
+		name = p.Framework + " dev server"
+	}
+	state := ""
+	if !p.Listening {
+		state = ", nothing listening yet"
+	}
+	return fmt.Sprintf("%s on port %d (%s%s)", name, p.Port, p.Source, state)
+}
@@ -0,0 +1,345 @@
+// Package history keeps the requests a tunnel forwarded to the local service
+// in an append-only JSON Lines file under ~/.tunnel/history, so they outlive
+// the CLI process.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lmanrique/tunnel/cli/internal/config"
+)
+
+// Dir is the history directory inside the config directory
+const Dir = "history"
+
+// fileName is the file entries are appended to
+const fileName = "requests.jsonl"
+
+// lockName is the file locked while the history is read or written, since
+// every running tunnel and the history commands share it
+const lockName = "requests.lock"
+
+// Default retention
+const (
+	DefaultMaxAge     = 7 * 24 * time.Hour
+	DefaultMaxEntries = 1000
+)
+
+// ErrNotFound is returned by Get when no entry matches
+var ErrNotFound = errors.New("no such request in history")
+
+// Entry is one request forwarded to the local service and its outcome.
+// Bodies are only kept when the store was opened with a body limit.
+type Entry struct {
+	RequestID       string              `json:"request_id"`
+	TunnelID        string              `json:"tunnel_id"`
+	Domain          string              `json:"domain,omitempty"`
+	Method          string              `json:"method"`
+	Path            string              `json:"path"`
+	RequestHeaders  map[string][]string `json:"request_headers,omitempty"`
+	RequestBytes    int64               `json:"request_bytes"`
+	RequestBody     []byte              `json:"request_body,omitempty"`
+	StatusCode      int                 `json:"status_code,omitempty"`
+	ResponseHeaders map[string][]string `json:"response_headers,omitempty"`
+	ResponseBytes   int64               `json:"response_bytes"`
+	ResponseBody    []byte              `json:"response_body,omitempty"`
+	Streamed        bool                `json:"streamed,omitempty"`  // An SSE response; its body is never kept
+	Truncated       bool                `json:"truncated,omitempty"` // A body was cut at the body limit
+	Error           string              `json:"error,omitempty"`     // Why the local service gave no response
+	StartedAt       time.Time           `json:"started_at"`
+	DurationMs      int64               `json:"duration_ms"`
+}
+
+// Options are a store's retention settings
+type Options struct {
+	MaxAge       time.Duration // Entries older than this are dropped; 0 keeps them
+	MaxEntries   int           // Only the newest entries are kept; 0 keeps all
+	MaxBodyBytes int           // Bodies up to this size are kept, longer ones cut; 0 keeps none
+}
+
+// Store is the request history of this machine, shared by all tunnels.
+// Within a process mu serializes access; across processes, the lock file.
+type Store struct {
+	path     string
+	lockPath string
+	opts     Options
+	mu       sync.Mutex
+	added    int // Entries added since the last prune
+}
+
+// DefaultPath returns the history directory, ~/.tunnel/history
+func DefaultPath() (string, error) {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, Dir), nil
+}
+
+// ConfigOptions reads the retention settings from the CLI config, falling
+// back to the defaults for the ones that are not set
+func ConfigOptions(cfg *config.Config) (Options, error) {
+	opts := Options{MaxAge: DefaultMaxAge, MaxEntries: DefaultMaxEntries, MaxBodyBytes: cfg.HistoryBodyBytes}
+	if cfg.HistoryMaxAge != "" {
+		maxAge, err := time.ParseDuration(cfg.HistoryMaxAge)
+		if err != nil || maxAge < 0 {
+			return Options{}, fmt.Errorf("invalid history_max_age %q in config (use e.g. 72h)", cfg.HistoryMaxAge)
+		}
+		opts.MaxAge = maxAge
+	}
+	if cfg.HistoryMaxEntries > 0 {
+		opts.MaxEntries = cfg.HistoryMaxEntries
+	}
+	return opts, nil
+}
+
+// Open opens the history in dir, creating it if needed, and drops the entries
+// that are past opts' retention
+func Open(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	s := &Store{path: filepath.Join(dir, fileName), lockPath: filepath.Join(dir, lockName), opts: opts}
+	unlock, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add appends an entry, cutting its bodies to the body limit. Every
+// MaxEntries additions the history is pruned, so a long session keeps at most
+// twice that many.
+func (s *Store) Add(e Entry) error {
+	e.RequestBody, e.ResponseBody = s.limitBody(&e, e.RequestBody), s.limitBody(&e, e.ResponseBody)
+	if e.Streamed {
+		e.ResponseBody = nil
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	s.added++
+	if s.opts.MaxEntries > 0 && s.added >= s.opts.MaxEntries {
+		return s.prune()
+	}
+	return nil
+}
+
+func (s *Store) limitBody(e *Entry, body []byte) []byte {
+	if s.opts.MaxBodyBytes <= 0 || len(body) == 0 {
+		return nil
+	}
+	if len(body) > s.opts.MaxBodyBytes {
+		e.Truncated = true
+		return body[:s.opts.MaxBodyBytes]
+	}
+	return body
+}
+
+// List returns up to limit entries, newest first, optionally only those of
+// one tunnel, given by ID, subdomain or hostname. A limit of 0 returns all
+// of them.
+func (s *Store) List(tunnel string, limit int) ([]Entry, error) {
+	entries, err := s.readLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []Entry
+	for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(listed) < limit); i-- {
+		if tunnel == "" || entries[i].belongsTo(tunnel) {
+			listed = append(listed, entries[i])
+		}
+	}
+	return listed, nil
+}
+
+// belongsTo reports whether e went through the tunnel with this ID,
+// subdomain or hostname
+func (e *Entry) belongsTo(tunnel string) bool {
+	subdomain, _, _ := strings.Cut(e.Domain, ".")
+	return e.TunnelID == tunnel || strings.EqualFold(e.Domain, tunnel) || strings.EqualFold(subdomain, tunnel)
+}
+
+// Get returns the entry whose request ID is id or starts with it; a prefix
+// must match a single entry
+func (s *Store) Get(id string) (*Entry, error) {
+	entries, err := s.readLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var match *Entry
+	for i := range entries {
+		switch {
+		case entries[i].RequestID == id:
+			return &entries[i], nil
+		case strings.HasPrefix(entries[i].RequestID, id):
+			if match != nil && match.RequestID != entries[i].RequestID {
+				return nil, fmt.Errorf("%q matches more than one request", id)
+			}
+			match = &entries[i]
+		}
+	}
+	if match == nil {
+		return nil, ErrNotFound
+	}
+	return match, nil
+}
+
+// Clear removes every entry
+func (s *Store) Clear() error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear history: %w", err)
+	}
+	return nil
+}
+
+// lock takes mu and the lock file, shared or exclusive, and returns the
+// function that releases both
+func (s *Store) lock(exclusive bool) (func(), error) {
+	s.mu.Lock()
+	f, err := os.OpenFile(s.lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		s.mu.Unlock()
+	}, nil
+}
+
+// readLocked is read under a shared lock
+func (s *Store) readLocked() ([]Entry, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.read()
+}
+
+// read loads all entries, oldest first. Lines that do not parse, such as one
+// cut short by a crash, are skipped.
+func (s *Store) read() ([]Entry, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return entries, nil
+}
+
+// prune rewrites the history without the entries past the retention. The
+// caller holds the exclusive lock.
+func (s *Store) prune() error {
+	s.added = 0
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	kept := entries
+	if s.opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-s.opts.MaxAge)
+		kept = kept[:0:0]
+		for _, e := range entries {
+			if e.StartedAt.After(cutoff) {
+				kept = append(kept, e)
+			}
+		}
+	}
+	if s.opts.MaxEntries > 0 && len(kept) > s.opts.MaxEntries {
+		kept = kept[len(kept)-s.opts.MaxEntries:]
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), fileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range kept {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("failed to prune history: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	return nil
+}
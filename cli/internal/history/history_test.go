@@ -0,0 +1,59 @@
+package history
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Two stores on one directory stand in for two tunnel processes: flocks are
+// per open file, so they exclude each other like separate processes do
+func TestConcurrentStoresKeepEveryEntry(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{MaxEntries: 10}
+
+	var wg sync.WaitGroup
+	for p := 0; p < 2; p++ {
+		s, err := Open(dir, opts)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 40; i++ {
+				if err := s.Add(Entry{RequestID: fmt.Sprintf("req-%d-%d", p, i), StartedAt: time.Now()}); err != nil {
+					t.Errorf("Add: %v", err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	raw, err := os.ReadFile(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.Count(string(raw), "\n")
+	entries, err := (&Store{path: filepath.Join(dir, fileName)}).read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	// A prune that raced an append would leave a torn line or an append
+	// to the replaced file; each store's 40th addition prunes, so the file
+	// ends with exactly the 10 newest
+	if len(entries) != lines || len(entries) != 10 {
+		t.Errorf("got %d entries in %d lines, want 10 whole lines", len(entries), lines)
+	}
+
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if f.Name() != fileName && f.Name() != lockName {
+			t.Errorf("left %s in the history directory", f.Name())
+		}
+	}
+}
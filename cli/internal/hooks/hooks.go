@@ -0,0 +1,143 @@
+// Package hooks runs the user's commands on tunnel lifecycle events, such as
+// the tunnel coming online, with the tunnel's details in the environment and
+// as JSON on stdin.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+)
+
+// Timeout bounds each hook; a hook still running then is killed
+const Timeout = 30 * time.Second
+
+// Event is what a hook is told, as TUNNEL_* variables and as JSON on stdin
+type Event struct {
+	Event     string    `json:"event"`
+	TunnelID  string    `json:"tunnel_id"`
+	Subdomain string    `json:"subdomain"`
+	Domain    string    `json:"domain"`
+	URL       string    `json:"url"`
+	Region    string    `json:"region,omitempty"`
+	LocalPort int       `json:"local_port"`
+	Reconnect bool      `json:"reconnect,omitempty"` // connect: not the first connection
+	Reason    string    `json:"reason,omitempty"`    // disconnect: why, e.g. connection_lost
+	Final     bool      `json:"final,omitempty"`     // disconnect: the CLI will not reconnect
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Runner runs the hook commands. Hooks run in the background, one at a time
+// in the order of the events, so a disconnect hook never overtakes the
+// connect hook before it.
+type Runner struct {
+	OnConnect    string // Command run when the tunnel comes online
+	OnDisconnect string // Command run when it goes offline
+
+	queue chan queued
+	once  sync.Once
+	wg    sync.WaitGroup
+}
+
+type queued struct {
+	command string
+	event   Event
+}
+
+// Fire runs the command for e.Event, if there is one
+func (r *Runner) Fire(e Event) {
+	command := r.OnConnect
+	if e.Event == EventDisconnect {
+		command = r.OnDisconnect
+	}
+	if command == "" {
+		return
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	r.once.Do(func() {
+		r.queue = make(chan queued, 16)
+		go func() {
+			for q := range r.queue {
+				run(q.command, q.event)
+				r.wg.Done()
+			}
+		}()
+	})
+	r.wg.Add(1)
+	r.queue <- queued{command: command, event: e}
+}
+
+// Wait blocks until the hooks fired so far are done, e.g. before the CLI
+// exits after the final disconnect
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+// run runs one hook through the shell and logs its output
+func run(command string, e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	input, _ := json.Marshal(e)
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), e.environ()...)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.CombinedOutput()
+
+	if out := strings.TrimSpace(string(output)); out != "" {
+		for _, line := range strings.Split(out, "\n") {
+			log.Printf("on-%s hook: %s", e.Event, line)
+		}
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("on-%s hook killed after %v", e.Event, Timeout)
+	case err != nil:
+		log.Printf("on-%s hook failed: %v", e.Event, err)
+	}
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// environ is the event as TUNNEL_* environment variables
+func (e Event) environ() []string {
+	env := []string{
+		"TUNNEL_EVENT=" + e.Event,
+		"TUNNEL_ID=" + e.TunnelID,
+		"TUNNEL_SUBDOMAIN=" + e.Subdomain,
+		"TUNNEL_DOMAIN=" + e.Domain,
+		"TUNNEL_URL=" + e.URL,
+		"TUNNEL_REGION=" + e.Region,
+		"TUNNEL_LOCAL_PORT=" + strconv.Itoa(e.LocalPort),
+		"TUNNEL_TIMESTAMP=" + e.Timestamp.UTC().Format(time.RFC3339),
+	}
+	switch e.Event {
+	case EventConnect:
+		env = append(env, "TUNNEL_RECONNECT="+strconv.FormatBool(e.Reconnect))
+	case EventDisconnect:
+		env = append(env, "TUNNEL_REASON="+e.Reason, "TUNNEL_FINAL="+strconv.FormatBool(e.Final))
+	}
+	return env
+}
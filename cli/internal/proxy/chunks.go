@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+const (
+	// chunkTransferTimeout is how long a request's chunks are kept without a
+	// new chunk or the proxy message that completes them
+	chunkTransferTimeout = 60 * time.Second
+	// maxChunkBufferBytes caps the chunk data buffered across all requests
+	maxChunkBufferBytes = 64 * 1024 * 1024
+)
+
+// chunkBuffer collects the proxy_chunk messages of one request body until its
+// proxy message arrives. A failed buffer has already been answered with an
+// error; it lingers for another chunkTransferTimeout so that late chunks and
+// the proxy message are dropped instead of answered again.
+type chunkBuffer struct {
+	chunks map[int]string
+	size   int
+	timer  *time.Timer
+	failed bool
+}
+
+// handleProxyChunk stores an incoming request body chunk
+func (p *Proxy) handleProxyChunk(chunk *models.ChunkPayload) {
+	requestID, data := chunk.RequestID, chunk.Data
+
+	p.chunkMux.Lock()
+	buf := p.chunkBuffers[requestID]
+	if buf == nil {
+		buf = &chunkBuffer{chunks: make(map[int]string)}
+		buf.timer = time.AfterFunc(chunkTransferTimeout, func() { p.expireChunks(requestID) })
+		p.chunkBuffers[requestID] = buf
+	}
+	if buf.failed {
+		p.chunkMux.Unlock()
+		return
+	}
+
+	delta := len(data) - len(buf.chunks[chunk.ChunkIndex])
+	buf.chunks[chunk.ChunkIndex] = data
+	buf.size += delta
+	p.chunkBytes += delta
+	if p.chunkBytes > maxChunkBufferBytes {
+		p.failChunksLocked(requestID, buf)
+		p.chunkMux.Unlock()
+		log.Printf("Dropped request %s: buffered chunks exceed %d bytes", requestID, maxChunkBufferBytes)
+		p.sendProxyError(requestID, http.StatusRequestEntityTooLarge, "Request body exceeds the tunnel client's buffer")
+		return
+	}
+	buf.timer.Reset(chunkTransferTimeout)
+	p.chunkMux.Unlock()
+}
+
+// takeChunks removes and returns the buffered chunks of requestID. ok is false
+// when its transfer already failed and was answered.
+func (p *Proxy) takeChunks(requestID string) (chunks map[int]string, ok bool) {
+	p.chunkMux.Lock()
+	defer p.chunkMux.Unlock()
+	buf := p.chunkBuffers[requestID]
+	if buf == nil {
+		return nil, true
+	}
+	buf.timer.Stop()
+	delete(p.chunkBuffers, requestID)
+	if buf.failed {
+		return nil, false
+	}
+	p.chunkBytes -= buf.size
+	return buf.chunks, true
+}
+
+// expireChunks fails a transfer whose proxy message did not arrive within
+// chunkTransferTimeout of its last chunk, or forgets one that already failed
+func (p *Proxy) expireChunks(requestID string) {
+	p.chunkMux.Lock()
+	buf := p.chunkBuffers[requestID]
+	if buf == nil {
+		p.chunkMux.Unlock()
+		return
+	}
+	if buf.failed {
+		delete(p.chunkBuffers, requestID)
+		p.chunkMux.Unlock()
+		return
+	}
+	received := len(buf.chunks)
+	p.failChunksLocked(requestID, buf)
+	p.chunkMux.Unlock()
+
+	log.Printf("Request %s timed out after %d chunks", requestID, received)
+	p.sendProxyError(requestID, http.StatusBadGateway, fmt.Sprintf("Request body transfer timed out after %d chunks", received))
+}
+
+// failChunksLocked frees buf's chunks and keeps it as a failed marker until
+// its timer fires again. chunkMux must be held.
+func (p *Proxy) failChunksLocked(requestID string, buf *chunkBuffer) {
+	p.chunkBytes -= buf.size
+	buf.chunks, buf.size, buf.failed = nil, 0, true
+	buf.timer.Reset(chunkTransferTimeout)
+}
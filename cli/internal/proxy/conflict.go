@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+)
+
+// ErrTunnelConnected is returned by Start when the tunnel is connected from
+// another machine and OnConflict is "ask"; the error is a *ConflictError
+var ErrTunnelConnected = errors.New("tunnel is connected from another machine")
+
+// ConflictError describes the CLI that holds the tunnel, so the user can
+// choose to take over, attach or give up
+type ConflictError struct {
+	Connection problem.Connection
+}
+
+func (e *ConflictError) Error() string {
+	return ErrTunnelConnected.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrTunnelConnected
+}
+
+// Describe sums up the other machine, e.g. "linux/amd64 at 203.0.113.7, CLI
+// 1.4.0, connected 2h15m ago"
+func (e *ConflictError) Describe() string {
+	c := e.Connection
+	var parts []string
+	machine := c.Platform
+	if machine == "" {
+		machine = "unknown platform"
+	}
+	if c.SourceIP != "" {
+		machine += " at " + c.SourceIP
+	}
+	parts = append(parts, machine)
+	if c.CLIVersion != "" {
+		parts = append(parts, "CLI "+c.CLIVersion)
+	}
+	if c.ConnectedAt != nil {
+		parts = append(parts, fmt.Sprintf("connected %s ago", time.Since(*c.ConnectedAt).Round(time.Second)))
+	}
+	if c.Connections > 1 {
+		parts = append(parts, fmt.Sprintf("%d CLIs connected", c.Connections))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// conflictQuery is the on_conflict sent on connect. Only the first connection
+// asks: once the user has chosen, reconnects leave it to the connection policy.
+func (p *Proxy) conflictQuery() string {
+	p.writeMux.Lock()
+	defer p.writeMux.Unlock()
+	if p.connectedOnce {
+		return ""
+	}
+	return p.OnConflict
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Exchange is one request forwarded to the local service and what came of it
+type Exchange struct {
+	RequestID       string
+	Method          string
+	Path            string
+	RequestHeaders  http.Header
+	RequestBody     []byte
+	StatusCode      int         // 0 when the local service gave no response
+	ResponseHeaders http.Header // After rewriting, as sent to the caller
+	ResponseBody    []byte
+	Streamed        bool   // An SSE response forwarded as it came; ResponseBody is empty
+	Error           string // Why the local service gave no response
+	StartedAt       time.Time
+	Duration        time.Duration
+}
+
+// recordExchange hands a finished exchange to OnExchange, when set
+func (p *Proxy) recordExchange(ex *Exchange) {
+	if p.OnExchange == nil {
+		return
+	}
+	ex.Duration = time.Since(ex.StartedAt)
+	p.OnExchange(ex)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// ValidateExcludePath checks a pattern for ExcludedPaths: an absolute path in
+// which * matches within one segment, and a trailing /* a whole subtree
+func ValidateExcludePath(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("path pattern %q must start with /", pattern)
+	}
+	if _, err := path.Match(pattern, "/"); err != nil {
+		return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// excludedPath reports whether requestPath matches one of ExcludedPaths. The
+// path is decoded and cleaned first, the way the local service will see it,
+// so /a/../metrics or /%6Detrics cannot slip past /metrics.
+func (p *Proxy) excludedPath(requestPath string) bool {
+	if len(p.ExcludedPaths) == 0 {
+		return false
+	}
+
+	requestPath, _, _ = strings.Cut(requestPath, "?")
+	if decoded, err := url.PathUnescape(requestPath); err == nil {
+		requestPath = decoded
+	}
+	requestPath = path.Clean("/" + requestPath)
+
+	for _, pattern := range p.ExcludedPaths {
+		if subtree, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if matchesPrefix(subtree, requestPath) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(path.Clean(pattern), requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPrefix reports whether requestPath is prefix, a pattern without the
+// trailing /*, or lies below it
+func matchesPrefix(prefix, requestPath string) bool {
+	segments := strings.Count(prefix, "/")
+	head := requestPath
+	for strings.Count(head, "/") > segments {
+		head = head[:strings.LastIndex(head, "/")]
+	}
+	if prefix == "" {
+		return true
+	}
+	matched, _ := path.Match(prefix, head)
+	return matched
+}
+
+// excludedResponse answers a request for an excluded path in place of the
+// local service
+func (p *Proxy) excludedResponse(requestID, requestPath string) {
+	status := p.blockedStatus()
+	log.Printf("Blocked request %s for excluded path %s (status: %d)", requestID, requestPath, status)
+	p.sendProxyError(requestID, status, http.StatusText(status))
+}
+
+// excludedLegacyResponse is excludedResponse for servers that predate proxy
+// messages
+func (p *Proxy) excludedLegacyResponse(requestID, requestPath string) {
+	status := p.blockedStatus()
+	log.Printf("Blocked request %s for excluded path %s (status: %d)", requestID, requestPath, status)
+	message := &models.TypedMessage{
+		Action:    models.ActionResponse,
+		RequestID: requestID,
+		Payload: &models.LegacyResponsePayload{
+			StatusCode: status,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       http.StatusText(status),
+		},
+	}
+	if err := p.sendWebSocketMessage(message); err != nil {
+		log.Printf("Failed to send response: %v", err)
+	}
+}
+
+// blockedStatus is the status excluded paths are answered with
+func (p *Proxy) blockedStatus() int {
+	if p.ExcludedStatus == 0 {
+		return http.StatusNotFound
+	}
+	return p.ExcludedStatus
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+)
+
+// Disconnect reasons passed to OnDisconnect
+const (
+	DisconnectLost     = "connection_lost"     // The connection dropped; with AutoReconnect the proxy reconnects
+	DisconnectStopped  = "stopped"             // The proxy was stopped, e.g. with Ctrl+C
+	DisconnectDeleted  = "tunnel_deleted"      // The server deleted the tunnel
+	DisconnectReplaced = "connection_replaced" // Another client took over the tunnel
+	DisconnectRejected = "rejected"            // The server refused to let the proxy reconnect
+)
+
+// connected reports a new connection to OnConnect, unless the proxy is
+// already connected: renewals swap connections without going offline
+func (p *Proxy) connected() {
+	p.lifecycleMux.Lock()
+	if p.online {
+		p.lifecycleMux.Unlock()
+		return
+	}
+	p.online = true
+	reconnect := p.wasOnline
+	p.wasOnline = true
+	p.lifecycleMux.Unlock()
+
+	if p.OnConnect != nil {
+		p.OnConnect(reconnect)
+	}
+}
+
+// disconnected reports the end of the connection to OnDisconnect, once per
+// connection. final means the proxy will not reconnect.
+func (p *Proxy) disconnected(reason string, final bool) {
+	p.lifecycleMux.Lock()
+	if !p.online {
+		p.lifecycleMux.Unlock()
+		return
+	}
+	p.online = false
+	p.lifecycleMux.Unlock()
+
+	if p.OnDisconnect != nil {
+		p.OnDisconnect(reason, final)
+	}
+}
+
+// stopReason is the disconnect reason for the error Start returns
+func stopReason(err error) string {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return DisconnectStopped
+	case errors.Is(err, ErrTunnelDeleted):
+		return DisconnectDeleted
+	case errors.Is(err, ErrConnectionReplaced):
+		return DisconnectReplaced
+	default:
+		return DisconnectRejected
+	}
+}
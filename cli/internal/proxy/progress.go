@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// progressMinBytes is the smallest S3 transfer whose progress is logged
+const progressMinBytes = 8 * 1024 * 1024
+
+// progressInterval is how often a running transfer logs its progress
+const progressInterval = 5 * time.Second
+
+// progressReader logs how far a large S3 transfer has got: percent, throughput
+// and time left when the size is known, bytes and throughput otherwise
+type progressReader struct {
+	r       io.Reader
+	label   string // e.g. "Uploading response for request abc"
+	total   int64  // -1 when unknown
+	read    int64
+	started time.Time
+	logged  time.Time
+}
+
+// newProgressReader wraps r, which carries total bytes (-1 if unknown).
+// Transfers known to be small are returned unwrapped.
+func newProgressReader(r io.Reader, label string, total int64) io.Reader {
+	if total >= 0 && total < progressMinBytes {
+		return r
+	}
+	now := time.Now()
+	return &progressReader{r: r, label: label, total: total, started: now, logged: now}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == nil && time.Since(p.logged) >= progressInterval {
+		p.logged = time.Now()
+		log.Printf("%s: %s", p.label, p.status())
+	}
+	return n, err
+}
+
+// status describes a transfer in progress
+func (p *progressReader) status() string {
+	rate := throughput(p.read, time.Since(p.started))
+	if p.total <= 0 {
+		return fmt.Sprintf("%s, %s/s", formatBytes(p.read), formatBytes(rate))
+	}
+	eta := "unknown"
+	if rate > 0 {
+		eta = (time.Duration(float64(p.total-p.read)/float64(rate)) * time.Second).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d%% (%s of %s), %s/s, ETA %s",
+		p.read*100/p.total, formatBytes(p.read), formatBytes(p.total), formatBytes(rate), eta)
+}
+
+// throughput is n bytes over elapsed in bytes per second
+func throughput(n int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(n) / elapsed.Seconds())
+}
+
+// transferSummary describes a finished transfer of n bytes, e.g.
+// "in 12.3s (85.2 MB/s)"
+func transferSummary(n int64, elapsed time.Duration) string {
+	return fmt.Sprintf("in %s (%s/s)", elapsed.Round(time.Millisecond), formatBytes(throughput(n, elapsed)))
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -4,17 +4,24 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/requesttarget"
 )
 
 const chunkSize = 90 * 1024 // 90KB — stays under API Gateway's 128KB WebSocket message limit
@@ -24,6 +31,44 @@ const chunkSize = 90 * 1024 // 90KB — stays under API Gateway's 128KB WebSocke
 // Set below the 90 KB WebSocket chunk size so any multi-chunk response goes via S3.
 const s3UploadThreshold = 80 * 1024 // 80 KB
 
+// streamBatchBytes caps how many bytes of SSE events that are ready at once go
+// into one proxy_stream_chunk message
+const streamBatchBytes = 32 * 1024
+
+// connectionLifetime is how long a connection is used before the CLI replaces
+// it: API Gateway closes WebSocket connections after 2 hours (and idle ones
+// after 10 minutes, which the 30-second pings prevent)
+const connectionLifetime = 110 * time.Minute
+
+// reconnectAckTimeout bounds the wait for the server to acknowledge reconnect_soon
+const reconnectAckTimeout = 10 * time.Second
+
+// drainPeriod is how long a replaced connection is still read, for requests
+// the server sent it before the new connection took over
+const drainPeriod = 30 * time.Second
+
+// protocolVersion is the WebSocket protocol version this CLI speaks; the server
+// answers the hello sent on connect with the version and capabilities to use
+const protocolVersion = 2
+
+// Protocol capabilities
+const (
+	capabilityStreaming   = "streaming"    // proxy_stream_* responses
+	capabilityInlineLimit = "inline_limit" // max_inline_bytes on proxy requests
+	capabilityChecksums   = "checksums"    // SHA-256 of S3-staged bodies
+	capabilityErrors      = "errors"       // error on proxy responses the CLI made up itself
+	capabilityReconnect   = "reconnect"    // reconnect_soon handover to a fresh connection
+	capabilityStats       = "stats"        // edge-side stats after each PONG
+	capabilityTimings     = "timings"      // s3_upload_ms on S3-staged responses
+)
+
+// supportedCapabilities are advertised in the hello
+var supportedCapabilities = []string{capabilityStreaming, capabilityInlineLimit, capabilityChecksums, capabilityErrors, capabilityReconnect, capabilityStats, capabilityTimings}
+
+// legacyCapabilities apply until a hello_ack arrives; servers that predate
+// negotiation never send one
+var legacyCapabilities = []string{capabilityStreaming}
+
 // isBinaryContentType reports whether ct is a binary media type that should
 // be staged through S3 rather than DynamoDB regardless of size.
 func isBinaryContentType(ct string) bool {
@@ -42,24 +87,78 @@ type Proxy struct {
 	WebSocketURL   string
 	APIKey         string
 	TunnelID       string
+	ClientVersion  string
+	TokenSource    func() (string, error) // Mints a connection token per handshake; nil sends the API key
 	conn           *websocket.Conn
 	pendingReqs    map[string]chan *HTTPResponse
 	pendingReqsMux sync.RWMutex
 	writeMux       sync.Mutex
-	chunkBuffers   map[string]map[int]string
+	chunkBuffers   map[string]*chunkBuffer // See chunks.go
+	chunkBytes     int                     // Total size of chunkBuffers
 	chunkMux       sync.Mutex
 	stopCh         chan struct{}
 	AutoReconnect  bool
 	reconnectMux   sync.Mutex
+	haltCh         chan struct{}
+	haltOnce       sync.Once
+	haltErr        error
+	capabilities   map[string]bool // Negotiated with the server; see negotiated
+	protocolMux    sync.RWMutex
+	reconnectCh    chan struct{} // Set when AutoReconnect runs; see startWithReconnect
+	renewAcks      chan string   // Connection IDs from reconnect_soon replies; see renewConnection
+	connectedOnce  bool          // A connection was made; see conflictQuery
+	online         bool          // Connected, as last reported to OnConnect/OnDisconnect
+	wasOnline      bool          // Connected at some point; see lifecycle.go
+	lifecycleMux   sync.Mutex
+
+	// OnConflict is sent as on_conflict on the first connect: "ask" fails
+	// with a *ConflictError when another machine holds the tunnel, "takeover"
+	// and "attach" override the connection policy, "" leaves it to the policy
+	OnConflict string
+
+	// OnStats, when set, is called with every stats message: the tunnel's
+	// health as the server sees it, including requests that never reach here
+	OnStats func(*models.StatsPayload)
+
+	// OnConnect and OnDisconnect, when set, are called as the tunnel goes
+	// online and offline; a renewed connection is neither. reconnect is true
+	// after the first connection, final when the proxy will not reconnect.
+	// See lifecycle.go for the reasons.
+	OnConnect    func(reconnect bool)
+	OnDisconnect func(reason string, final bool)
+
+	// OnExchange, when set, is called with every request forwarded to the
+	// local service once it is done; see exchange.go
+	OnExchange func(*Exchange)
+
+	// Rewriting of local URLs in responses; see rewrite.go
+	PublicDomain        string   // The tunnel's domain, which local URLs are pointed at
+	RewriteRedirects    bool     // Rewrite local Location headers and cookie domains
+	RewriteContentTypes []string // Media types (or type/*) whose bodies get local URLs rewritten
+
+	// Shaping of traffic to the local service; see throttle.go
+	ThrottleDown      int64         // Bytes per second of responses, 0 for unlimited
+	ThrottleUp        int64         // Bytes per second of request bodies, 0 for unlimited
+	Latency           time.Duration // Delay added before every request
+	throttleOnce      sync.Once
+	throttleTransport http.RoundTripper
+
+	// Paths answered here instead of being forwarded; see exclude.go
+	ExcludedPaths  []string
+	ExcludedStatus int // 403 or 404 (the default)
 }
 
-// WebSocketMessage represents a message sent over the WebSocket connection
-type WebSocketMessage struct {
-	Action    string                 `json:"action"`
-	RequestID string                 `json:"request_id,omitempty"`
-	Data      map[string]interface{} `json:"data,omitempty"`
-	Error     string                 `json:"error,omitempty"`
-}
+var (
+	// ErrTunnelDeleted is returned by Start when the server deletes the tunnel
+	ErrTunnelDeleted = errors.New("tunnel was deleted")
+	// ErrConnectionReplaced is returned by Start when another CLI takes over the tunnel
+	ErrConnectionReplaced = errors.New("connection was replaced by another client")
+	// ErrTunnelInUse is returned when the tunnel rejects a second connection
+	ErrTunnelInUse = errors.New("tunnel is already connected")
+	// ErrConnectionLimit is returned when the client has as many CLIs
+	// connected as the server allows
+	ErrConnectionLimit = errors.New("too many connected clients")
+)
 
 // HTTPRequest represents an HTTP request
 type HTTPRequest struct {
@@ -84,8 +183,10 @@ func NewProxy(localPort int, websocketURL, apiKey, tunnelID string) *Proxy {
 		APIKey:       apiKey,
 		TunnelID:     tunnelID,
 		pendingReqs:  make(map[string]chan *HTTPResponse),
-		chunkBuffers: make(map[string]map[int]string),
+		chunkBuffers: make(map[string]*chunkBuffer),
 		stopCh:       make(chan struct{}),
+		haltCh:       make(chan struct{}),
+		renewAcks:    make(chan string, 1),
 	}
 }
 
@@ -97,33 +198,45 @@ func (p *Proxy) Start(ctx context.Context) error {
 	}
 
 	// Original behavior: single connection attempt
-	if err := p.connectWebSocket(ctx); err != nil {
+	if err := p.connectWebSocket(ctx, ""); err != nil {
 		return fmt.Errorf("failed to connect to WebSocket: %w", err)
 	}
 
 	// Start WebSocket message handler
-	go p.handleWebSocketMessages(ctx)
+	go p.handleWebSocketMessages(ctx, p.currentConn())
 
 	// Start ping/keep-alive loop
 	go p.keepAlive(ctx)
 
-	log.Printf("Proxy connected successfully")
+	// Replace the connection before API Gateway closes it
+	go p.renewConnection(ctx, p.currentConn())
 
-	// Wait for context cancellation
-	<-ctx.Done()
+	log.Printf("Proxy connected successfully")
+	p.connected()
+
+	// Wait for context cancellation or for the server to end the tunnel
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.haltCh:
+		err = p.haltErr
+	}
 
 	// Cleanup
+	p.disconnected(stopReason(err), true)
 	close(p.stopCh)
 	if p.conn != nil {
 		p.conn.Close()
 	}
 
-	return ctx.Err()
+	return err
 }
 
 // startWithReconnect starts the proxy with automatic reconnection on failure
 func (p *Proxy) startWithReconnect(ctx context.Context) error {
 	reconnectCh := make(chan struct{}, 1)
+	p.reconnectCh = reconnectCh
 
 	// Initial connection
 	if err := p.connectAndRun(ctx, reconnectCh); err != nil && err != context.Canceled {
@@ -134,14 +247,23 @@ func (p *Proxy) startWithReconnect(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			// Cleanup
+			p.disconnected(DisconnectStopped, true)
 			close(p.stopCh)
 			if p.conn != nil {
 				p.conn.Close()
 			}
 			return ctx.Err()
+		case <-p.haltCh:
+			p.disconnected(stopReason(p.haltErr), true)
+			close(p.stopCh)
+			if p.conn != nil {
+				p.conn.Close()
+			}
+			return p.haltErr
 		case <-reconnectCh:
 			// Reconnect with exponential backoff
 			log.Printf("Connection lost, attempting to reconnect...")
+			p.disconnected(DisconnectLost, false)
 			if err := p.reconnectWithBackoff(ctx); err != nil {
 				if err == context.Canceled {
 					return err
@@ -150,15 +272,22 @@ func (p *Proxy) startWithReconnect(ctx context.Context) error {
 				continue
 			}
 			// Successfully reconnected, start handling messages again
-			go p.handleWebSocketMessages(ctx)
+			p.connected()
+			go p.handleWebSocketMessages(ctx, p.currentConn())
 			go p.keepAlive(ctx)
+			go p.renewConnection(ctx, p.currentConn())
 		}
 	}
 }
 
 // connectAndRun establishes connection and starts message handlers
 func (p *Proxy) connectAndRun(ctx context.Context, reconnectCh chan struct{}) error {
-	if err := p.connectWebSocket(ctx); err != nil {
+	if err := p.connectWebSocket(ctx, ""); err != nil {
+		// Retrying can't help while other clients hold the connections
+		if errors.Is(err, ErrTunnelInUse) || errors.Is(err, ErrTunnelConnected) || errors.Is(err, ErrConnectionLimit) {
+			p.halt(err)
+			return err
+		}
 		// Trigger reconnect
 		select {
 		case reconnectCh <- struct{}{}:
@@ -168,12 +297,16 @@ func (p *Proxy) connectAndRun(ctx context.Context, reconnectCh chan struct{}) er
 	}
 
 	// Start WebSocket message handler
-	go p.handleWebSocketMessagesWithReconnect(ctx, reconnectCh)
+	go p.handleWebSocketMessagesWithReconnect(ctx, p.currentConn(), reconnectCh)
 
 	// Start ping/keep-alive loop
 	go p.keepAlive(ctx)
 
+	// Replace the connection before API Gateway closes it
+	go p.renewConnection(ctx, p.currentConn())
+
 	log.Printf("Proxy connected successfully")
+	p.connected()
 	return nil
 }
 
@@ -199,7 +332,11 @@ func (p *Proxy) reconnectWithBackoff(ctx context.Context) error {
 		}
 
 		// Attempt to connect
-		if err := p.connectWebSocket(ctx); err != nil {
+		if err := p.connectWebSocket(ctx, ""); err != nil {
+			if errors.Is(err, ErrTunnelInUse) || errors.Is(err, ErrTunnelConnected) || errors.Is(err, ErrConnectionLimit) {
+				p.halt(err)
+				return err
+			}
 			delay := baseDelay * time.Duration(1<<uint(i))
 			if delay > maxDelay {
 				delay = maxDelay
@@ -222,7 +359,7 @@ func (p *Proxy) reconnectWithBackoff(ctx context.Context) error {
 }
 
 // handleWebSocketMessagesWithReconnect handles incoming messages and triggers reconnect on error
-func (p *Proxy) handleWebSocketMessagesWithReconnect(ctx context.Context, reconnectCh chan struct{}) {
+func (p *Proxy) handleWebSocketMessagesWithReconnect(ctx context.Context, conn *websocket.Conn, reconnectCh chan struct{}) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -230,8 +367,12 @@ func (p *Proxy) handleWebSocketMessagesWithReconnect(ctx context.Context, reconn
 		case <-p.stopCh:
 			return
 		default:
-			_, messageBytes, err := p.conn.ReadMessage()
+			_, messageBytes, err := conn.ReadMessage()
 			if err != nil {
+				// A connection replaced by renewConnection was closed on purpose
+				if conn != p.currentConn() {
+					return
+				}
 				log.Printf("Error reading WebSocket message: %v", err)
 				// Trigger reconnect
 				select {
@@ -241,31 +382,16 @@ func (p *Proxy) handleWebSocketMessagesWithReconnect(ctx context.Context, reconn
 				return
 			}
 
-			var message WebSocketMessage
-			if err := json.Unmarshal(messageBytes, &message); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				continue
-			}
-
-			// Handle different message types
-			switch message.Action {
-			case "REQUEST":
-				go p.handleHTTPRequest(ctx, message)
-			case "proxy":
-				go p.handleProxyRequest(ctx, message)
-			case "proxy_chunk":
-				p.handleProxyChunk(message)
-			case "PONG":
-				// Keep-alive response, no action needed
-			default:
-				log.Printf("Unknown message action: %s", message.Action)
+			if stop := p.dispatch(ctx, messageBytes); stop {
+				return
 			}
 		}
 	}
 }
 
-// connectWebSocket establishes a WebSocket connection
-func (p *Proxy) connectWebSocket(ctx context.Context) error {
+// connectWebSocket establishes a WebSocket connection. replaces is the ID of
+// the connection a renewing CLI hands the tunnel over from, empty otherwise.
+func (p *Proxy) connectWebSocket(ctx context.Context, replaces string) error {
 	// Parse URL and add query parameters
 	u, err := url.Parse(p.WebSocketURL)
 	if err != nil {
@@ -276,25 +402,172 @@ func (p *Proxy) connectWebSocket(ctx context.Context) error {
 	q := u.Query()
 	if q.Get("tunnel_id") == "" {
 		q.Set("tunnel_id", p.TunnelID)
-		u.RawQuery = q.Encode()
 	}
+	// Report the CLI version and platform so support can tell which machine holds the tunnel
+	if p.ClientVersion != "" {
+		q.Set("cli_version", p.ClientVersion)
+	}
+	q.Set("platform", runtime.GOOS+"/"+runtime.GOARCH)
+	if replaces != "" {
+		q.Set("replaces", replaces)
+	}
+	if onConflict := p.conflictQuery(); onConflict != "" {
+		q.Set("on_conflict", onConflict)
+	}
+	u.RawQuery = q.Encode()
 
 	// Set up headers with authorization
+	credential := p.APIKey
+	if p.TokenSource != nil {
+		token, err := p.TokenSource()
+		if err != nil {
+			return fmt.Errorf("failed to get connection token: %w", err)
+		}
+		credential = token
+	}
 	headers := http.Header{}
-	headers.Set("Authorization", fmt.Sprintf("Bearer %s", p.APIKey))
+	headers.Set("Authorization", fmt.Sprintf("Bearer %s", credential))
+	headers.Set("User-Agent", fmt.Sprintf("tunnel-cli/%s (%s/%s)", p.ClientVersion, runtime.GOOS, runtime.GOARCH))
 
 	// Connect
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), headers)
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), headers)
 	if err != nil {
+		// The tunnel cannot take the connection this CLI asked to attach,
+		// another machine holds it and this CLI asked to choose, or the client
+		// has as many CLIs connected as it may. The reject policy instead
+		// answers on the connection, with connection_rejected.
+		if resp != nil && (resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusTooManyRequests) {
+			refused := ErrTunnelInUse
+			if resp.StatusCode == http.StatusTooManyRequests {
+				refused = ErrConnectionLimit
+			}
+			body, _ := io.ReadAll(resp.Body)
+			var errResp problem.Problem
+			if json.Unmarshal(body, &errResp) != nil {
+				return refused
+			}
+			if errResp.Code == problem.CodeTunnelConnected && errResp.Connection != nil {
+				return &ConflictError{Connection: *errResp.Connection}
+			}
+			if errResp.Error != "" {
+				return fmt.Errorf("%w: %s", refused, errResp.Error)
+			}
+			return refused
+		}
 		return fmt.Errorf("failed to dial WebSocket: %w", err)
 	}
 
+	p.writeMux.Lock()
 	p.conn = conn
+	p.connectedOnce = true
+	p.writeMux.Unlock()
+
+	// A handover keeps the negotiated protocol: the server keeps it too
+	if replaces != "" {
+		return nil
+	}
+
+	// Advertise what this CLI understands; until the server acknowledges, only
+	// the legacy feature set is used
+	p.setCapabilities(legacyCapabilities)
+	if err := p.sendWebSocketMessage(&models.TypedMessage{
+		Action: models.ActionHello,
+		Payload: &models.HelloPayload{
+			ProtocolVersion: protocolVersion,
+			Capabilities:    supportedCapabilities,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
 	return nil
 }
 
+// dispatch validates one server message and hands it to its handler. It
+// reports whether the server ended the tunnel, in which case the read loop
+// must stop without reconnecting.
+func (p *Proxy) dispatch(ctx context.Context, raw []byte) bool {
+	message, err := models.ParseMessage(raw)
+	if err != nil {
+		log.Printf("Rejected message from server: %v", err)
+		return false
+	}
+
+	switch payload := message.Payload.(type) {
+	case *models.LegacyRequestPayload:
+		go p.handleHTTPRequest(ctx, message.RequestID, payload)
+	case *models.ProxyRequestPayload:
+		go p.handleProxyRequest(ctx, payload)
+	case *models.ChunkPayload:
+		p.handleProxyChunk(payload)
+	case *models.HelloAckPayload:
+		p.handleHelloAck(message, payload)
+	case *models.ReconnectPayload:
+		p.handleReconnectAck(message, payload)
+	case *models.StatsPayload:
+		if p.OnStats != nil {
+			p.OnStats(payload)
+		}
+	case *models.TunnelNoticePayload:
+		switch message.Action {
+		case models.ActionTunnelDeleted:
+			// The server is about to close the connection; don't reconnect
+			p.handleTunnelDeleted()
+			return true
+		case models.ActionConnectionReplaced:
+			// Another client connected under the takeover policy; don't reconnect
+			p.handleConnectionReplaced()
+			return true
+		}
+	case *models.ConnectionRejectedPayload:
+		// The tunnel's connection policy refused this connection, which the
+		// server closes next; don't reconnect
+		p.handleConnectionRejected(payload)
+		return true
+	default:
+		switch message.Action {
+		case models.ActionPong:
+			// Keep-alive response, no action needed
+		case models.ActionError:
+			// The server rejected one of our messages
+			log.Printf("Server error (request %s): %s", message.RequestID, message.Error)
+		default:
+			log.Printf("Unexpected message action from server: %s", message.Action)
+		}
+	}
+	return false
+}
+
+// handleHelloAck applies the protocol the server chose
+func (p *Proxy) handleHelloAck(message *models.TypedMessage, ack *models.HelloAckPayload) {
+	if message.Error != "" {
+		log.Printf("Server rejected protocol negotiation: %s", message.Error)
+		return
+	}
+
+	p.setCapabilities(ack.Capabilities)
+	log.Printf("Negotiated protocol v%d with capabilities %v", ack.ProtocolVersion, ack.Capabilities)
+}
+
+func (p *Proxy) setCapabilities(capabilities []string) {
+	negotiated := make(map[string]bool, len(capabilities))
+	for _, c := range capabilities {
+		negotiated[c] = true
+	}
+
+	p.protocolMux.Lock()
+	defer p.protocolMux.Unlock()
+	p.capabilities = negotiated
+}
+
+// negotiated reports whether the server agreed to use capability
+func (p *Proxy) negotiated(capability string) bool {
+	p.protocolMux.RLock()
+	defer p.protocolMux.RUnlock()
+	return p.capabilities[capability]
+}
+
 // handleWebSocketMessages handles incoming WebSocket messages
-func (p *Proxy) handleWebSocketMessages(ctx context.Context) {
+func (p *Proxy) handleWebSocketMessages(ctx context.Context, conn *websocket.Conn) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -302,65 +575,105 @@ func (p *Proxy) handleWebSocketMessages(ctx context.Context) {
 		case <-p.stopCh:
 			return
 		default:
-			_, messageBytes, err := p.conn.ReadMessage()
+			_, messageBytes, err := conn.ReadMessage()
 			if err != nil {
-				log.Printf("Error reading WebSocket message: %v", err)
+				if conn == p.currentConn() {
+					log.Printf("Error reading WebSocket message: %v", err)
+					p.disconnected(DisconnectLost, p.reconnectCh == nil)
+				}
 				return
 			}
 
-			var message WebSocketMessage
-			if err := json.Unmarshal(messageBytes, &message); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				continue
-			}
-
-			// Handle different message types
-			switch message.Action {
-			case "REQUEST":
-				go p.handleHTTPRequest(ctx, message)
-			case "proxy":
-				go p.handleProxyRequest(ctx, message)
-			case "proxy_chunk":
-				p.handleProxyChunk(message)
-			case "PONG":
-				// Keep-alive response, no action needed
-			default:
-				log.Printf("Unknown message action: %s", message.Action)
+			if stop := p.dispatch(ctx, messageBytes); stop {
+				return
 			}
 		}
 	}
 }
 
+// handleTunnelDeleted stops the proxy after the server deleted the tunnel
+func (p *Proxy) handleTunnelDeleted() {
+	log.Printf("Tunnel %s was deleted on the server", p.TunnelID)
+	p.halt(ErrTunnelDeleted)
+}
+
+// handleConnectionReplaced stops the proxy after another client took over the tunnel
+func (p *Proxy) handleConnectionReplaced() {
+	log.Printf("Tunnel %s was taken over by another client", p.TunnelID)
+	p.halt(ErrConnectionReplaced)
+}
+
+// handleConnectionRejected stops the proxy after the server refused the connection
+func (p *Proxy) handleConnectionRejected(rejected *models.ConnectionRejectedPayload) {
+	log.Printf("Tunnel %s refused the connection: %s", p.TunnelID, rejected.Message)
+	if rejected.Message == "" {
+		p.halt(ErrTunnelInUse)
+		return
+	}
+	p.halt(fmt.Errorf("%w: %s", ErrTunnelInUse, rejected.Message))
+}
+
+// handleReconnectAck passes the server's answer to reconnect_soon on to
+// renewConnection; an empty connection ID means the server refused
+func (p *Proxy) handleReconnectAck(message *models.TypedMessage, ack *models.ReconnectPayload) {
+	connectionID := ack.ConnectionID
+	if message.Error != "" {
+		log.Printf("Server refused to renew the connection: %s", message.Error)
+		connectionID = ""
+	}
+	select {
+	case p.renewAcks <- connectionID:
+	default:
+	}
+}
+
+// halt stops the proxy for good; Start returns err instead of reconnecting
+func (p *Proxy) halt(err error) {
+	p.haltOnce.Do(func() {
+		p.haltErr = err
+		close(p.haltCh)
+	})
+}
+
+// newLocalRequest builds the request to the local service. The target goes
+// on the request line byte for byte as http-proxy forwarded it, so an encoded
+// slash, a plus sign or the order of repeated parameters reaches the service
+// as the caller sent it.
+func (p *Proxy) newLocalRequest(ctx context.Context, method, target string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://localhost:%d/", p.LocalPort), io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	path, rawQuery := requesttarget.Split(requesttarget.Join(requesttarget.Split(target)))
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = decoded, path, rawQuery
+	// An opaque "//..." would be sent as an absolute URL, so such paths go
+	// through RawPath, which Go only re-encodes when it holds unusual bytes
+	if !strings.HasPrefix(path, "//") {
+		req.URL.Opaque = path
+	}
+	return req, nil
+}
+
 // handleHTTPRequest handles an incoming HTTP request from the tunnel
-func (p *Proxy) handleHTTPRequest(ctx context.Context, message WebSocketMessage) {
-	requestID := message.RequestID
+func (p *Proxy) handleHTTPRequest(ctx context.Context, requestID string, request *models.LegacyRequestPayload) {
 	if requestID == "" {
 		log.Printf("Request ID is missing")
 		return
 	}
 
-	// Extract request details from message data
-	method, _ := message.Data["method"].(string)
-	path, _ := message.Data["path"].(string)
-	body, _ := message.Data["body"].(string)
+	method, path, body, headers := request.Method, request.Path, request.Body, request.Headers
 
-	// Convert headers
-	headers := make(map[string][]string)
-	if headersData, ok := message.Data["headers"].(map[string]interface{}); ok {
-		for k, v := range headersData {
-			if vArr, ok := v.([]interface{}); ok {
-				strArr := make([]string, len(vArr))
-				for i, val := range vArr {
-					strArr[i] = fmt.Sprintf("%v", val)
-				}
-				headers[k] = strArr
-			}
-		}
+	if p.excludedPath(path) {
+		p.excludedLegacyResponse(requestID, path)
+		return
 	}
 
 	// Forward request to local service
-	localURL := fmt.Sprintf("http://localhost:%d%s", p.LocalPort, path)
-	req, err := http.NewRequestWithContext(ctx, method, localURL, io.NopCloser(bytes.NewReader([]byte(body))))
+	req, err := p.newLocalRequest(ctx, method, path, []byte(body))
 	if err != nil {
 		log.Printf("Failed to create local request: %v", err)
 		p.sendErrorResponse(requestID, fmt.Sprintf("Failed to create request: %v", err))
@@ -373,24 +686,35 @@ func (p *Proxy) handleHTTPRequest(ctx context.Context, message WebSocketMessage)
 			req.Header.Add(k, val)
 		}
 	}
+	// The whole body is already here, so there is nothing to hold back until
+	// a 100 Continue; servers that predate stripping Expect still forward it
+	req.Header.Del("Expect")
+
+	exchange := &Exchange{RequestID: requestID, Method: method, Path: path, RequestHeaders: req.Header.Clone(), RequestBody: []byte(body), StartedAt: time.Now()}
+	defer p.recordExchange(exchange)
 
 	// Make request to local service
-	client := &http.Client{Timeout: 30 * time.Minute}
-	resp, err := client.Do(req)
+	resp, err := p.localClient().Do(req)
 	if err != nil {
 		log.Printf("Failed to make local request: %v", err)
+		exchange.Error = err.Error()
 		p.sendErrorResponse(requestID, fmt.Sprintf("Failed to make request: %v", err))
 		return
 	}
+	p.rewriteResponseHeaders(resp.Header)
 	defer resp.Body.Close()
+	exchange.StatusCode, exchange.ResponseHeaders = resp.StatusCode, resp.Header
 
 	// Read response body
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Failed to read response body: %v", err)
+		exchange.Error = err.Error()
 		p.sendErrorResponse(requestID, fmt.Sprintf("Failed to read response: %v", err))
 		return
 	}
+	respBody = p.rewriteBody(resp.Header, respBody)
+	exchange.ResponseBody = respBody
 
 	// Send response back through WebSocket
 	httpResponse := HTTPResponse{
@@ -399,13 +723,13 @@ func (p *Proxy) handleHTTPRequest(ctx context.Context, message WebSocketMessage)
 		Body:       string(respBody),
 	}
 
-	responseMessage := WebSocketMessage{
-		Action:    "RESPONSE",
+	responseMessage := &models.TypedMessage{
+		Action:    models.ActionResponse,
 		RequestID: requestID,
-		Data: map[string]interface{}{
-			"status_code": httpResponse.StatusCode,
-			"headers":     httpResponse.Headers,
-			"body":        httpResponse.Body,
+		Payload: &models.LegacyResponsePayload{
+			StatusCode: httpResponse.StatusCode,
+			Headers:    httpResponse.Headers,
+			Body:       httpResponse.Body,
 		},
 	}
 
@@ -416,8 +740,8 @@ func (p *Proxy) handleHTTPRequest(ctx context.Context, message WebSocketMessage)
 
 // sendErrorResponse sends an error response back through the WebSocket
 func (p *Proxy) sendErrorResponse(requestID, errorMsg string) {
-	message := WebSocketMessage{
-		Action:    "ERROR",
+	message := &models.TypedMessage{
+		Action:    models.ActionError,
 		RequestID: requestID,
 		Error:     errorMsg,
 	}
@@ -428,8 +752,8 @@ func (p *Proxy) sendErrorResponse(requestID, errorMsg string) {
 }
 
 // sendWebSocketMessage sends a message through the WebSocket
-func (p *Proxy) sendWebSocketMessage(message WebSocketMessage) error {
-	messageBytes, err := json.Marshal(message)
+func (p *Proxy) sendWebSocketMessage(message *models.TypedMessage) error {
+	messageBytes, err := message.Marshal()
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -439,66 +763,53 @@ func (p *Proxy) sendWebSocketMessage(message WebSocketMessage) error {
 	return p.conn.WriteMessage(websocket.TextMessage, messageBytes)
 }
 
-// handleProxyChunk stores an incoming request body chunk
-func (p *Proxy) handleProxyChunk(message WebSocketMessage) {
-	requestID, _ := message.Data["request_id"].(string)
-	chunkIndexF, _ := message.Data["chunk_index"].(float64)
-	data, _ := message.Data["data"].(string)
-
-	p.chunkMux.Lock()
-	defer p.chunkMux.Unlock()
-	if p.chunkBuffers[requestID] == nil {
-		p.chunkBuffers[requestID] = make(map[int]string)
-	}
-	p.chunkBuffers[requestID][int(chunkIndexF)] = data
-}
-
 // handleProxyRequest handles an incoming proxy request from the HTTP proxy Lambda
-func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage) {
-	// Extract request details from message.Data
-	dataMap := message.Data
-	if dataMap == nil {
-		log.Printf("Invalid proxy request format")
-		return
-	}
-
-	requestID, _ := dataMap["request_id"].(string)
-	if requestID == "" {
-		log.Printf("Request ID is missing in proxy request")
-		return
-	}
-
-	method, _ := dataMap["method"].(string)
-	path, _ := dataMap["path"].(string)
-	body, _ := dataMap["body"].(string)
+func (p *Proxy) handleProxyRequest(ctx context.Context, request *models.ProxyRequestPayload) {
+	requestID := request.RequestID
+	method, path, body := request.Method, request.Path, request.Body
 	// Presigned S3 URL provided by the Lambda for staging large/binary responses
-	s3PutURL, _ := dataMap["s3_put_url"].(string)
-	s3ResponseKey, _ := dataMap["s3_response_key"].(string)
+	s3PutURL, s3ResponseKey := request.S3PutURL, request.S3ResponseKey
 	// For large inbound uploads: the request body is in S3 instead of in the message
-	s3RequestGetURL, _ := dataMap["s3_request_get_url"].(string)
+	s3RequestGetURL := request.S3RequestGetURL
 
 	// If body is in S3 (large upload flow), download it now
 	if s3RequestGetURL != "" && body == "" {
-		downloaded, dlErr := p.downloadFromS3(ctx, s3RequestGetURL)
+		downloadStarted := time.Now()
+		downloaded, dlErr := p.downloadFromS3(ctx, requestID, s3RequestGetURL)
 		if dlErr != nil {
 			log.Printf("Failed to download request body from S3 for request %s: %v", requestID, dlErr)
 			p.sendProxyErrorResponse(requestID, fmt.Sprintf("Failed to download request body: %v", dlErr))
 			return
 		}
+		if want := request.S3RequestSHA256; want != "" {
+			if sum := sha256.Sum256(downloaded); hex.EncodeToString(sum[:]) != strings.ToLower(want) {
+				log.Printf("Request body from S3 for request %s has SHA-256 %x, expected %s", requestID, sum, want)
+				p.sendProxyError(requestID, http.StatusBadGateway, "Staged request body is corrupt: SHA-256 mismatch")
+				return
+			}
+		}
 		body = string(downloaded)
-		log.Printf("Downloaded %d byte request body from S3 for request %s", len(body), requestID)
+		log.Printf("Downloaded %d byte request body from S3 for request %s %s", len(body), requestID, transferSummary(int64(len(body)), time.Since(downloadStarted)))
 	}
 
 	// If body was chunked, assemble it from buffered chunks
-	if totalChunksF, ok := dataMap["total_chunks"].(float64); ok && totalChunksF > 0 {
-		totalChunks := int(totalChunksF)
-		p.chunkMux.Lock()
-		chunks := p.chunkBuffers[requestID]
-		delete(p.chunkBuffers, requestID)
-		p.chunkMux.Unlock()
+	if totalChunks := request.TotalChunks; totalChunks > 0 {
+		chunks, ok := p.takeChunks(requestID)
+		if !ok {
+			log.Printf("Dropped request %s: its body transfer already failed", requestID)
+			return
+		}
+		// http-proxy sends chunks concurrently, so they arrive in any order,
+		// but all of them before the proxy message
 		var buf strings.Builder
 		for i := 0; i < totalChunks; i++ {
-			buf.WriteString(chunks[i])
+			chunk, ok := chunks[i]
+			if !ok {
+				log.Printf("Request %s is missing chunk %d of %d", requestID, i, totalChunks)
+				p.sendProxyError(requestID, http.StatusBadGateway, fmt.Sprintf("Request body is incomplete: chunk %d of %d never arrived", i, totalChunks))
+				return
+			}
+			buf.WriteString(chunk)
 		}
 		body = buf.String()
 		log.Printf("Assembled %d chunks (%d bytes) for request %s", totalChunks, len(body), requestID)
@@ -506,19 +817,19 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 
 	log.Printf("Handling proxy request: %s %s (ID: %s)", method, path, requestID)
 
+	if p.excludedPath(path) {
+		p.excludedResponse(requestID, path)
+		return
+	}
+
 	// Convert headers from map[string]string to map[string][]string
 	headers := make(map[string][]string)
-	if headersData, ok := dataMap["headers"].(map[string]interface{}); ok {
-		for k, v := range headersData {
-			if strVal, ok := v.(string); ok {
-				headers[k] = []string{strVal}
-			}
-		}
+	for k, v := range request.Headers {
+		headers[k] = []string{v}
 	}
 
 	// Forward request to local service
-	localURL := fmt.Sprintf("http://localhost:%d%s", p.LocalPort, path)
-	req, err := http.NewRequestWithContext(ctx, method, localURL, io.NopCloser(bytes.NewReader([]byte(body))))
+	req, err := p.newLocalRequest(ctx, method, path, []byte(body))
 	if err != nil {
 		log.Printf("Failed to create local request: %v", err)
 		p.sendProxyErrorResponse(requestID, fmt.Sprintf("Failed to create request: %v", err))
@@ -531,19 +842,29 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 			req.Header.Add(k, val)
 		}
 	}
+	// The whole body is already here, so there is nothing to hold back until
+	// a 100 Continue; servers that predate stripping Expect still forward it
+	req.Header.Del("Expect")
+
+	exchange := &Exchange{RequestID: requestID, Method: method, Path: path, RequestHeaders: req.Header.Clone(), RequestBody: []byte(body), StartedAt: time.Now()}
+	defer p.recordExchange(exchange)
 
 	// Make request to local service
-	client := &http.Client{Timeout: 30 * time.Minute}
-	resp, err := client.Do(req)
+	resp, err := p.localClient().Do(req)
 	if err != nil {
 		log.Printf("Failed to make local request: %v", err)
-		p.sendProxyErrorResponse(requestID, fmt.Sprintf("Failed to make request: %v", err))
+		exchange.Error = err.Error()
+		p.sendUpstreamError(requestID, fmt.Sprintf("Failed to make request: %v", err))
 		return
 	}
+	p.rewriteResponseHeaders(resp.Header)
+	exchange.StatusCode, exchange.ResponseHeaders = resp.StatusCode, resp.Header
 
-	// Detect SSE streaming responses and handle progressively.
-	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+	// Detect SSE streaming responses and handle progressively, unless the server
+	// did not agree to streaming; the response is then buffered
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") && p.negotiated(capabilityStreaming) {
 		log.Printf("Detected SSE streaming response for request %s, forwarding progressively", requestID)
+		exchange.Streamed = true
 		p.streamProxyResponse(ctx, requestID, resp)
 		return
 	}
@@ -554,9 +875,12 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Failed to read response body: %v", err)
-		p.sendProxyErrorResponse(requestID, fmt.Sprintf("Failed to read response: %v", err))
+		exchange.Error = err.Error()
+		p.sendUpstreamError(requestID, fmt.Sprintf("Failed to read response: %v", err))
 		return
 	}
+	respBody = p.rewriteBody(resp.Header, respBody)
+	exchange.ResponseBody = respBody
 
 	// Convert response headers to map[string]string
 	responseHeaders := make(map[string]string)
@@ -566,26 +890,53 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 		}
 	}
 
+	// The server's inline cap replaces the default threshold; responses over
+	// it must not be sent inline
+	uploadThreshold := s3UploadThreshold
+	if request.MaxInlineBytes > 0 {
+		uploadThreshold = int(request.MaxInlineBytes)
+	}
+	mustStage := request.MaxInlineBytes > 0 && int64(len(respBody)) > request.MaxInlineBytes
+
 	// For large or binary responses, upload the body directly to S3 and notify
 	// the Lambda via the proxy_response message (s3_response_key).
 	// This avoids the DynamoDB 400 KB item-size limit and the per-message chunking overhead.
-	if s3PutURL != "" && s3ResponseKey != "" &&
-		(len(respBody) > s3UploadThreshold || isBinaryContentType(resp.Header.Get("Content-Type"))) {
+	// Responses that cannot have a body (304, 204) always go inline; their
+	// Content-Type describes the cached representation, not this response.
+	if s3PutURL != "" && s3ResponseKey != "" && models.BodyAllowed(resp.StatusCode) &&
+		(len(respBody) > uploadThreshold || isBinaryContentType(resp.Header.Get("Content-Type"))) {
 		// Always upload with application/octet-stream — the presigned URL is signed with that type.
-		if err := p.uploadToS3(ctx, s3PutURL, "application/octet-stream", respBody); err != nil {
+		uploadStarted := time.Now()
+		if err := p.uploadToS3(ctx, requestID, s3PutURL, "application/octet-stream", respBody); err != nil && mustStage {
+			log.Printf("Failed to upload response to S3 for request %s: %v", requestID, err)
+			p.sendProxyErrorResponse(requestID, fmt.Sprintf("Response exceeds the %d byte inline limit and could not be staged: %v", request.MaxInlineBytes, err))
+			return
+		} else if err != nil {
 			log.Printf("Failed to upload response to S3 for request %s: %v — falling back to inline", requestID, err)
 			// Fall through to inline path on error
 		} else {
-			log.Printf("Uploaded %d byte response to S3 for request %s", len(respBody), requestID)
-			responseMessage := WebSocketMessage{
-				Action: "proxy_response",
-				Data: map[string]interface{}{
-					"request_id":       requestID,
-					"status_code":      resp.StatusCode,
-					"response_headers": responseHeaders,
-					"response_body":    "",
-					"s3_response_key":  s3ResponseKey,
-				},
+			uploadTime := time.Since(uploadStarted)
+			log.Printf("Uploaded %d byte response to S3 for request %s %s", len(respBody), requestID, transferSummary(int64(len(respBody)), uploadTime))
+			payload := &models.ProxyResponsePayload{
+				RequestID:       requestID,
+				StatusCode:      resp.StatusCode,
+				ResponseHeaders: responseHeaders,
+				ResponseBody:    "",
+				S3ResponseKey:   s3ResponseKey,
+			}
+			// The server verifies the staged body against these before serving it
+			if p.negotiated(capabilityChecksums) {
+				sum := sha256.Sum256(respBody)
+				payload.S3ResponseSHA256 = hex.EncodeToString(sum[:])
+				payload.S3ResponseBytes = int64(len(respBody))
+			}
+			// The server adds the upload time to the request's timings
+			if p.negotiated(capabilityTimings) {
+				payload.S3UploadMs = uploadTime.Milliseconds()
+			}
+			responseMessage := &models.TypedMessage{
+				Action:  models.ActionProxyResponse,
+				Payload: payload,
 			}
 			if err := p.sendWebSocketMessage(responseMessage); err != nil {
 				log.Printf("Failed to send S3 proxy response for request %s: %v", requestID, err)
@@ -599,16 +950,21 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 	bodyStr := string(respBody)
 
 	// Check total serialized message size against the 128 KB WebSocket limit
-	testMsg := WebSocketMessage{
-		Action: "proxy_response",
-		Data: map[string]interface{}{
-			"request_id":       requestID,
-			"status_code":      resp.StatusCode,
-			"response_headers": responseHeaders,
-			"response_body":    bodyStr,
+	testMsg := &models.TypedMessage{
+		Action: models.ActionProxyResponse,
+		Payload: &models.ProxyResponsePayload{
+			RequestID:       requestID,
+			StatusCode:      resp.StatusCode,
+			ResponseHeaders: responseHeaders,
+			ResponseBody:    bodyStr,
 		},
 	}
-	testBytes, _ := json.Marshal(testMsg)
+	testBytes, err := testMsg.Marshal()
+	if err != nil {
+		log.Printf("Invalid proxy response for request %s: %v", requestID, err)
+		p.sendProxyErrorResponse(requestID, fmt.Sprintf("Invalid response: %v", err))
+		return
+	}
 
 	// If total message exceeds WebSocket message limit, send body in chunks
 	if len(testBytes) > 128*1024 {
@@ -625,12 +981,12 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 			if end > len(bodyStr) {
 				end = len(bodyStr)
 			}
-			chunkMsg := WebSocketMessage{
-				Action: "proxy_response_chunk",
-				Data: map[string]interface{}{
-					"request_id":  requestID,
-					"chunk_index": i,
-					"data":        bodyStr[start:end],
+			chunkMsg := &models.TypedMessage{
+				Action: models.ActionProxyResponseChunk,
+				Payload: &models.ChunkPayload{
+					RequestID:  requestID,
+					ChunkIndex: i,
+					Data:       bodyStr[start:end],
 				},
 			}
 			if err := p.sendWebSocketMessage(chunkMsg); err != nil {
@@ -639,14 +995,14 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 				return
 			}
 		}
-		responseMessage := WebSocketMessage{
-			Action: "proxy_response",
-			Data: map[string]interface{}{
-				"request_id":       requestID,
-				"status_code":      resp.StatusCode,
-				"response_headers": responseHeaders,
-				"response_body":    "",
-				"total_chunks":     totalChunks,
+		responseMessage := &models.TypedMessage{
+			Action: models.ActionProxyResponse,
+			Payload: &models.ProxyResponsePayload{
+				RequestID:       requestID,
+				StatusCode:      resp.StatusCode,
+				ResponseHeaders: responseHeaders,
+				ResponseBody:    "",
+				TotalChunks:     totalChunks,
 			},
 		}
 		if err := p.sendWebSocketMessage(responseMessage); err != nil {
@@ -668,9 +1024,11 @@ func (p *Proxy) handleProxyRequest(ctx context.Context, message WebSocketMessage
 	}
 }
 
-// uploadToS3 performs an HTTP PUT of body to a presigned S3 URL.
-func (p *Proxy) uploadToS3(ctx context.Context, presignedURL, contentType string, body []byte) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, bytes.NewReader(body))
+// uploadToS3 performs an HTTP PUT of body to a presigned S3 URL, logging the
+// progress of large bodies.
+func (p *Proxy) uploadToS3(ctx context.Context, requestID, presignedURL, contentType string, body []byte) error {
+	progress := newProgressReader(bytes.NewReader(body), "Uploading response for request "+requestID, int64(len(body)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, progress)
 	if err != nil {
 		return fmt.Errorf("failed to create S3 PUT request: %w", err)
 	}
@@ -691,8 +1049,9 @@ func (p *Proxy) uploadToS3(ctx context.Context, presignedURL, contentType string
 	return nil
 }
 
-// downloadFromS3 performs an HTTP GET from a presigned S3 URL and returns the body.
-func (p *Proxy) downloadFromS3(ctx context.Context, presignedURL string) ([]byte, error) {
+// downloadFromS3 performs an HTTP GET from a presigned S3 URL and returns the
+// body, logging the progress of large bodies.
+func (p *Proxy) downloadFromS3(ctx context.Context, requestID, presignedURL string) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, presignedURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create S3 GET request: %w", err)
@@ -706,7 +1065,7 @@ func (p *Proxy) downloadFromS3(ctx context.Context, presignedURL string) ([]byte
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return nil, fmt.Errorf("S3 GET returned status %d", resp.StatusCode)
 	}
-	return io.ReadAll(resp.Body)
+	return io.ReadAll(newProgressReader(resp.Body, "Downloading request body for request "+requestID, resp.ContentLength))
 }
 
 // streamProxyResponse handles SSE responses by forwarding each event progressively
@@ -723,12 +1082,12 @@ func (p *Proxy) streamProxyResponse(ctx context.Context, requestID string, resp
 	}
 
 	// Signal stream start (carries status code + headers)
-	startMsg := WebSocketMessage{
-		Action: "proxy_stream_start",
-		Data: map[string]interface{}{
-			"request_id":       requestID,
-			"status_code":      resp.StatusCode,
-			"response_headers": responseHeaders,
+	startMsg := &models.TypedMessage{
+		Action: models.ActionProxyStreamStart,
+		Payload: &models.StreamStartPayload{
+			RequestID:       requestID,
+			StatusCode:      resp.StatusCode,
+			ResponseHeaders: responseHeaders,
 		},
 	}
 	if err := p.sendWebSocketMessage(startMsg); err != nil {
@@ -736,62 +1095,86 @@ func (p *Proxy) streamProxyResponse(ctx context.Context, requestID string, resp
 		return
 	}
 
-	// Stream body as SSE events (data line + blank separator = one chunk) to halve DynamoDB writes.
-	// bufio.Scanner with ScanLines returns empty string for blank lines.
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Buffer(make([]byte, 64*1024), 512*1024) // handle long SSE lines
-	chunkIndex := 0
-	var pending string // accumulates current SSE event lines
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			// Blank line = end of SSE event; send accumulated event as one chunk
+	// Read the body as SSE events (the lines up to a blank line) in the
+	// background, so events that pile up while a chunk is being sent go out
+	// together in the next one: one message and one stored item per burst
+	// instead of per event
+	events := make(chan string, 64)
+	var readErr error
+	go func() {
+		defer close(events)
+		// bufio.Scanner with ScanLines returns empty string for blank lines.
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 512*1024) // handle long SSE lines
+		var pending string                              // accumulates current SSE event lines
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				pending += line + "\n"
+				continue
+			}
 			if pending != "" {
-				chunkMsg := WebSocketMessage{
-					Action: "proxy_stream_chunk",
-					Data: map[string]interface{}{
-						"request_id":  requestID,
-						"chunk_index": chunkIndex,
-						"data":        pending + "\n",
-					},
-				}
-				if err := p.sendWebSocketMessage(chunkMsg); err != nil {
-					log.Printf("Failed to send proxy_stream_chunk %d for request %s: %v", chunkIndex, requestID, err)
-					return
-				}
-				chunkIndex++
+				events <- pending + "\n"
 				pending = ""
 			}
-		} else {
-			pending += line + "\n"
 		}
-	}
-	// Flush any remaining data
-	if pending != "" {
-		chunkMsg := WebSocketMessage{
-			Action: "proxy_stream_chunk",
-			Data: map[string]interface{}{
-				"request_id":  requestID,
-				"chunk_index": chunkIndex,
-				"data":        pending + "\n",
+		// Flush any remaining data
+		if pending != "" {
+			events <- pending + "\n"
+		}
+		readErr = scanner.Err()
+	}()
+
+	chunkIndex := 0
+	failed := false
+	for event := range events {
+		if failed {
+			continue // drain, so the reader can finish
+		}
+		batch := event
+	coalesce:
+		for len(batch) < streamBatchBytes {
+			select {
+			case more, ok := <-events:
+				if !ok {
+					break coalesce
+				}
+				batch += more
+			default:
+				break coalesce
+			}
+		}
+
+		chunkMsg := &models.TypedMessage{
+			Action: models.ActionProxyStreamChunk,
+			Payload: &models.ChunkPayload{
+				RequestID:  requestID,
+				ChunkIndex: chunkIndex,
+				Data:       batch,
 			},
 		}
 		if err := p.sendWebSocketMessage(chunkMsg); err != nil {
 			log.Printf("Failed to send proxy_stream_chunk %d for request %s: %v", chunkIndex, requestID, err)
-		} else {
-			chunkIndex++
+			failed = true
+			resp.Body.Close()
+			continue
 		}
+		chunkIndex++
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading streaming body for request %s: %v", requestID, err)
+	if failed {
+		return
+	}
+	if readErr != nil {
+		log.Printf("Error reading streaming body for request %s: %v", requestID, readErr)
 	}
 	log.Printf("Streamed %d chunks for request %s", chunkIndex, requestID)
 
-	// Signal end of stream
-	endMsg := WebSocketMessage{
-		Action: "proxy_stream_end",
-		Data: map[string]interface{}{
-			"request_id": requestID,
+	// Signal end of stream, with the chunk count the server waits for
+	endMsg := &models.TypedMessage{
+		Action: models.ActionProxyStreamEnd,
+		Payload: &models.StreamEndPayload{
+			RequestID:   requestID,
+			TotalChunks: chunkIndex,
 		},
 	}
 	if err := p.sendWebSocketMessage(endMsg); err != nil {
@@ -799,16 +1182,41 @@ func (p *Proxy) streamProxyResponse(ctx context.Context, requestID string, resp
 	}
 }
 
-// sendProxyErrorResponse sends a proxy error response
+// sendProxyErrorResponse sends a proxy error response with status 500
 func (p *Proxy) sendProxyErrorResponse(requestID, errorMsg string) {
-	message := WebSocketMessage{
-		Action: "proxy_response",
-		Data: map[string]interface{}{
-			"request_id":      requestID,
-			"status_code":     500,
-			"response_headers": map[string]string{"Content-Type": "application/json"},
-			"response_body":   fmt.Sprintf(`{"error":"%s"}`, errorMsg),
-		},
+	p.sendProxyError(requestID, http.StatusInternalServerError, errorMsg)
+}
+
+// sendUpstreamError answers a proxy request the local service did not answer
+// with a 502. Servers that negotiated errors end the request as upstream_error.
+func (p *Proxy) sendUpstreamError(requestID, errorMsg string) {
+	payload := proxyErrorPayload(requestID, http.StatusBadGateway, errorMsg)
+	if p.negotiated(capabilityErrors) {
+		payload.Error = errorMsg
+	}
+	p.sendProxyErrorPayload(payload)
+}
+
+// sendProxyError answers a proxy request with statusCode and a JSON error
+func (p *Proxy) sendProxyError(requestID string, statusCode int, errorMsg string) {
+	p.sendProxyErrorPayload(proxyErrorPayload(requestID, statusCode, errorMsg))
+}
+
+// proxyErrorPayload is a proxy response with statusCode and a JSON error
+func proxyErrorPayload(requestID string, statusCode int, errorMsg string) *models.ProxyResponsePayload {
+	return &models.ProxyResponsePayload{
+		RequestID:       requestID,
+		StatusCode:      statusCode,
+		ResponseHeaders: map[string]string{"Content-Type": "application/json"},
+		ResponseBody:    fmt.Sprintf(`{"error":"%s"}`, errorMsg),
+	}
+}
+
+// sendProxyErrorPayload sends an error proxy response through the WebSocket
+func (p *Proxy) sendProxyErrorPayload(payload *models.ProxyResponsePayload) {
+	message := &models.TypedMessage{
+		Action:  models.ActionProxyResponse,
+		Payload: payload,
 	}
 
 	if err := p.sendWebSocketMessage(message); err != nil {
@@ -828,8 +1236,8 @@ func (p *Proxy) keepAlive(ctx context.Context) {
 		case <-p.stopCh:
 			return
 		case <-ticker.C:
-			message := WebSocketMessage{
-				Action: "PING",
+			message := &models.TypedMessage{
+				Action: models.ActionPing,
 			}
 
 			if err := p.sendWebSocketMessage(message); err != nil {
@@ -839,3 +1247,78 @@ func (p *Proxy) keepAlive(ctx context.Context) {
 		}
 	}
 }
+
+// currentConn returns the connection messages are sent through
+func (p *Proxy) currentConn() *websocket.Conn {
+	p.writeMux.Lock()
+	defer p.writeMux.Unlock()
+	return p.conn
+}
+
+// renewConnection replaces conn with a fresh connection once it has been open
+// for connectionLifetime, before API Gateway closes it. The server is told
+// with reconnect_soon first, so it hands the tunnel over to the new connection
+// instead of applying the connection policy, and stops sending requests to
+// conn; conn is read for drainPeriod more and then closed. Servers that did
+// not negotiate the capability leave conn to be closed and reconnected as
+// usual.
+func (p *Proxy) renewConnection(ctx context.Context, conn *websocket.Conn) {
+	timer := time.NewTimer(connectionLifetime)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-p.stopCh:
+		return
+	case <-timer.C:
+	}
+
+	// Don't race a reconnect after the connection dropped
+	p.reconnectMux.Lock()
+	defer p.reconnectMux.Unlock()
+	if conn != p.currentConn() || !p.negotiated(capabilityReconnect) {
+		return
+	}
+
+	// Drop a stale answer before asking
+	select {
+	case <-p.renewAcks:
+	default:
+	}
+	if err := p.sendWebSocketMessage(&models.TypedMessage{
+		Action:  models.ActionReconnectSoon,
+		Payload: &models.ReconnectPayload{},
+	}); err != nil {
+		log.Printf("Failed to send reconnect_soon: %v", err)
+		return
+	}
+
+	var connectionID string
+	select {
+	case connectionID = <-p.renewAcks:
+	case <-time.After(reconnectAckTimeout):
+		log.Printf("Server did not acknowledge reconnect_soon; keeping the current connection")
+		return
+	case <-ctx.Done():
+		return
+	}
+	if connectionID == "" {
+		return
+	}
+
+	if err := p.connectWebSocket(ctx, connectionID); err != nil {
+		log.Printf("Failed to renew the connection: %v", err)
+		return
+	}
+	newConn := p.currentConn()
+	if p.reconnectCh != nil {
+		go p.handleWebSocketMessagesWithReconnect(ctx, newConn, p.reconnectCh)
+	} else {
+		go p.handleWebSocketMessages(ctx, newConn)
+	}
+	go p.renewConnection(ctx, newConn)
+	log.Printf("Renewed the connection ahead of the server's connection limit")
+
+	time.AfterFunc(drainPeriod, func() { conn.Close() })
+}
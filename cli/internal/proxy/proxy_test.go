@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestNewLocalRequestURL(t *testing.T) {
+	p := &Proxy{LocalPort: 3000}
+	tests := []struct {
+		target     string
+		wantOpaque string
+		wantPath   string
+		wantQuery  string
+	}{
+		{"/", "/", "/", ""},
+		{"/a%2Fb/c", "/a%2Fb/c", "/a/b/c", ""},
+		{"/s?X-Amz-Signature=ab%3D&b=1+2&b=%20", "/s", "/s", "X-Amz-Signature=ab%3D&b=1+2&b=%20"},
+		{"/a b?q=a b", "/a%20b", "/a b", "q=a%20b"},
+		{"/caf\xc3\xa9", "/caf%C3%A9", "/café", ""},
+		{"//double", "", "//double", ""},
+	}
+	for _, tt := range tests {
+		req, err := p.newLocalRequest(context.Background(), http.MethodGet, tt.target, nil)
+		if err != nil {
+			t.Errorf("newLocalRequest(%q): %v", tt.target, err)
+			continue
+		}
+		if req.URL.Opaque != tt.wantOpaque || req.URL.Path != tt.wantPath || req.URL.RawQuery != tt.wantQuery {
+			t.Errorf("newLocalRequest(%q): Opaque %q, Path %q, RawQuery %q; want %q, %q, %q",
+				tt.target, req.URL.Opaque, req.URL.Path, req.URL.RawQuery, tt.wantOpaque, tt.wantPath, tt.wantQuery)
+		}
+		if req.URL.Host != "localhost:3000" {
+			t.Errorf("newLocalRequest(%q): host %q", tt.target, req.URL.Host)
+		}
+	}
+}
+
+// TestNewLocalRequestWire checks the request line the local service receives
+func TestNewLocalRequestWire(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.RequestURI
+	}))
+
+	p := &Proxy{LocalPort: ln.Addr().(*net.TCPAddr).Port}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/a%2Fb/c", "/a%2Fb/c"},
+		{"/a+b?x=1+2&y=%2B&x=3", "/a+b?x=1+2&y=%2B&x=3"},
+		{"/p?a=&b&=c", "/p?a=&b&=c"},
+		{"/{id}|^", "/{id}|^"},
+		{"//double", "//double"},
+		{"/%zz?%", "/%25zz?%25"},
+	}
+	for _, tt := range tests {
+		req, err := p.newLocalRequest(context.Background(), http.MethodGet, tt.target, nil)
+		if err != nil {
+			t.Errorf("newLocalRequest(%q): %v", tt.target, err)
+			continue
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("request for %q: %v", tt.target, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if got := <-received; got != tt.want {
+			t.Errorf("target %q reached the service as %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
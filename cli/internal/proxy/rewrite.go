@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localHosts are the host names a local app uses to refer to itself
+var localHosts = map[string]bool{
+	"localhost": true,
+	"127.0.0.1": true,
+	"::1":       true,
+	"0.0.0.0":   true,
+}
+
+// localClient builds the HTTP client for requests to the local service. With
+// RewriteRedirects, redirects are handed to the caller instead of being
+// followed here, so their rewritten Location reaches the browser. Throttled
+// proxies share one shaped transport; see throttle.go.
+func (p *Proxy) localClient() *http.Client {
+	client := &http.Client{Timeout: 30 * time.Minute}
+	if p.throttled() {
+		client.Transport = p.throttledTransport()
+	}
+	if p.RewriteRedirects && p.PublicDomain != "" {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// rewriteResponseHeaders maps the local origin in Location and Content-Location
+// headers and the Domain attribute of Set-Cookie headers to the public tunnel
+// domain. It does nothing unless RewriteRedirects is set.
+func (p *Proxy) rewriteResponseHeaders(header http.Header) {
+	if !p.RewriteRedirects || p.PublicDomain == "" {
+		return
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := header.Get(name); v != "" {
+			header.Set(name, p.rewriteLocation(v))
+		}
+	}
+	if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+		rewritten := make([]string, len(cookies))
+		for i, c := range cookies {
+			rewritten[i] = p.rewriteCookieDomain(c)
+		}
+		header["Set-Cookie"] = rewritten
+	}
+}
+
+// rewriteLocation points an absolute URL on the local service at the public
+// domain; relative and foreign URLs are left alone
+func (p *Proxy) rewriteLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return location
+	}
+	if !localHosts[u.Hostname()] || !p.isLocalPort(u) {
+		return location
+	}
+	u.Scheme = "https"
+	u.Host = p.PublicDomain
+	return u.String()
+}
+
+// isLocalPort reports whether u addresses the tunneled port
+func (p *Proxy) isLocalPort(u *url.URL) bool {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return port == strconv.Itoa(p.LocalPort)
+}
+
+// rewriteCookieDomain replaces a local Domain attribute of a Set-Cookie value
+// with the public domain
+func (p *Proxy) rewriteCookieDomain(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts[1:] {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(name, "domain") {
+			continue
+		}
+		host := strings.TrimPrefix(strings.TrimSpace(value), ".")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if localHosts[strings.Trim(host, "[]")] {
+			parts[i+1] = " Domain=" + p.PublicDomain
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// rewriteBody replaces the local origin (http://localhost:<port> and its
+// loopback aliases) with the public tunnel URL in bodies whose content type
+// is listed in RewriteContentTypes, fixing Content-Length to match. Encoded
+// (e.g. gzip) bodies are left alone.
+func (p *Proxy) rewriteBody(header http.Header, body []byte) []byte {
+	if len(p.RewriteContentTypes) == 0 || p.PublicDomain == "" || len(body) == 0 {
+		return body
+	}
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return body
+	}
+	if !p.rewritesContentType(header.Get("Content-Type")) {
+		return body
+	}
+
+	public := []byte("https://" + p.PublicDomain)
+	escapedPublic := bytes.ReplaceAll(public, []byte("/"), []byte(`\/`))
+	rewritten := body
+	for host := range localHosts {
+		origin := []byte("http://" + net.JoinHostPort(host, strconv.Itoa(p.LocalPort)))
+		rewritten = bytes.ReplaceAll(rewritten, origin, public)
+		// JSON encoders that escape slashes
+		rewritten = bytes.ReplaceAll(rewritten, bytes.ReplaceAll(origin, []byte("/"), []byte(`\/`)), escapedPublic)
+	}
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
+	return rewritten
+}
+
+// rewritesContentType reports whether contentType matches RewriteContentTypes,
+// whose entries are media types or type wildcards such as text/*
+func (p *Proxy) rewritesContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, want := range p.RewriteContentTypes {
+		want = strings.ToLower(strings.TrimSpace(want))
+		if want == mediaType || (strings.HasSuffix(want, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(want, "*"))) {
+			return true
+		}
+	}
+	return false
+}
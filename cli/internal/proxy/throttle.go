@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk caps how many bytes one read or write moves at a time, so a
+// throttled connection trickles data instead of stalling and bursting
+const throttleChunk = 4 * 1024
+
+// rateUnits are the suffixes ParseRate accepts, in bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"gbps", 1e9},
+	{"mbps", 1e6},
+	{"kbps", 1e3},
+	{"bps", 1},
+}
+
+// ParseRate parses a bandwidth such as 512kbps, 1.5mbps or 56000bps into
+// bytes per second
+func ParseRate(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range rateUnits {
+		if !strings.HasSuffix(v, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(v, unit.suffix), 64)
+		if err != nil || n <= 0 {
+			break
+		}
+		bytesPerSecond := int64(n * unit.bits / 8)
+		if bytesPerSecond < 1 {
+			return 0, fmt.Errorf("rate %q is below one byte per second", s)
+		}
+		return bytesPerSecond, nil
+	}
+	return 0, fmt.Errorf("invalid rate %q (use e.g. 512kbps, 1mbps or 1.5mbps)", s)
+}
+
+// rateLimiter paces a byte stream to a fixed rate. One limiter is shared by
+// every connection going the same way, as all traffic of a slow client shares
+// its link.
+type rateLimiter struct {
+	bytesPerSecond int64
+	mu             sync.Mutex
+	next           time.Time // When the bytes reserved so far have been sent
+}
+
+// chunk is how many bytes to move between waits: at most a tenth of a
+// second's worth, so slow rates don't sleep for long stretches
+func (l *rateLimiter) chunk() int {
+	return int(max(1, min(throttleChunk, l.bytesPerSecond/10)))
+}
+
+// wait blocks until n more bytes fit in the rate
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// throttledConn paces a connection to the local service: reads carry the
+// response down to the caller, writes carry the request up from it
+type throttledConn struct {
+	net.Conn
+	down, up *rateLimiter
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if c.down == nil {
+		return c.Conn.Read(b)
+	}
+	if len(b) > c.down.chunk() {
+		b = b[:c.down.chunk()]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.down.wait(n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.up == nil {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > c.up.chunk() {
+			chunk = chunk[:c.up.chunk()]
+		}
+		c.up.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// latencyTransport holds every request back by a fixed delay before it is
+// sent, like the round trip of a distant or mobile client
+type latencyTransport struct {
+	base    http.RoundTripper
+	latency time.Duration
+}
+
+func (t *latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timer := time.NewTimer(t.latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return t.base.RoundTrip(req)
+}
+
+// throttled reports whether traffic to the local service is shaped
+func (p *Proxy) throttled() bool {
+	return p.ThrottleDown > 0 || p.ThrottleUp > 0 || p.Latency > 0
+}
+
+// throttledTransport returns the transport for requests to the local service
+// when ThrottleDown, ThrottleUp or Latency is set. It is built once, so the
+// limiters and idle connections are shared by all requests.
+func (p *Proxy) throttledTransport() http.RoundTripper {
+	p.throttleOnce.Do(func() {
+		var down, up *rateLimiter
+		if p.ThrottleDown > 0 {
+			down = &rateLimiter{bytesPerSecond: p.ThrottleDown}
+		}
+		if p.ThrottleUp > 0 {
+			up = &rateLimiter{bytesPerSecond: p.ThrottleUp}
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || (down == nil && up == nil) {
+				return conn, err
+			}
+			return &throttledConn{Conn: conn, down: down, up: up}, nil
+		}
+
+		p.throttleTransport = transport
+		if p.Latency > 0 {
+			p.throttleTransport = &latencyTransport{base: transport, latency: p.Latency}
+		}
+	})
+	return p.throttleTransport
+}
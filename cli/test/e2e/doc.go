@@ -0,0 +1,10 @@
+// Package e2e runs the proxy pipeline end to end in one process: a caller's
+// request goes through http-proxy (httpproxy.Handler), a fake API Gateway
+// WebSocket stage and the CLI's proxy to a local test server, and the answer
+// comes back through tunnel-proxy (tunnelproxy.Handler) and DynamoDB, or
+// through an in-memory S3 stub when the CLI stages it. CLIs connect through
+// tunnel-connect (tunnelconnect.Handler), as they do behind $connect.
+//
+// The tests carry the integration build tag and need DynamoDB Local with the
+// project's tables; make test-integration starts it and runs them.
+package e2e
@@ -0,0 +1,557 @@
+//go:build integration
+
+package e2e
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/cli/internal/proxy"
+	"github.com/lmanrique/tunnel/lambdas/http-proxy/httpproxy"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+	"github.com/lmanrique/tunnel/lambdas/tunnel-connect/tunnelconnect"
+	"github.com/lmanrique/tunnel/lambdas/tunnel-proxy/tunnelproxy"
+)
+
+// testDomain is the DOMAIN_NAME tunnels are created under
+const testDomain = "e2e.tunnel.test"
+
+// clientID owns every tunnel the tests create
+const clientID = "e2e-client"
+
+// uploadsBucket is the UPLOADS_BUCKET staged bodies go to in the S3 stub
+const uploadsBucket = "e2e-uploads"
+
+// connectTimeout bounds how long a CLI may take to connect and say hello
+const connectTimeout = 10 * time.Second
+
+var (
+	// skipReason is set when DynamoDB Local is not configured
+	skipReason string
+	gw         *gateway
+	s3         *s3Stub
+	dbClient   *db.DynamoDBClient
+	tunnelRepo repository.TunnelRepository
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("DYNAMODB_ENDPOINT") == "" {
+		skipReason = "DYNAMODB_ENDPOINT is not set; run make test-integration"
+		os.Exit(m.Run())
+	}
+
+	gw = newGateway()
+	s3 = newS3Stub()
+
+	// The Lambdas' other AWS clients sign with whatever credentials there are
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "local",
+		"AWS_SECRET_ACCESS_KEY": "local",
+		"AWS_REGION":            "us-east-1",
+	} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	os.Setenv("WEBSOCKET_ENDPOINT", gw.URL())
+	os.Setenv("DOMAIN_NAME", testDomain)
+	os.Setenv("TUNNEL_RECONNECT_GRACE_PERIOD", "1s")
+	os.Setenv("S3_ENDPOINT", s3.URL())
+	os.Setenv("UPLOADS_BUCKET", uploadsBucket)
+	httpproxy.Init()
+	tunnelconnect.Init()
+	tunnelproxy.Init()
+
+	var err error
+	dbClient, err = db.NewDynamoDBClient(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "e2e: %v\n", err)
+		os.Exit(1)
+	}
+	tunnelRepo = repository.NewTunnelRepository(dbClient, os.Getenv("TUNNELS_TABLE"), os.Getenv("DOMAINS_TABLE"))
+
+	code := m.Run()
+	gw.Close()
+	s3.Close()
+	os.Exit(code)
+}
+
+// harness is one tunnel whose CLI proxies to a local test server
+type harness struct {
+	t      *testing.T
+	tunnel models.Tunnel
+	port   int
+}
+
+// newHarness creates a tunnel, serves local on a test server and connects a
+// CLI proxy for the tunnel to it. Everything is torn down with the test.
+func newHarness(t *testing.T, local http.Handler) *harness {
+	return newPolicyHarness(t, "", local)
+}
+
+// newPolicyHarness is newHarness for a tunnel with a connection policy
+func newPolicyHarness(t *testing.T, policy string, local http.Handler) *harness {
+	t.Helper()
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+	h := &harness{t: t, tunnel: createTunnel(t, policy)}
+
+	server := httptest.NewServer(local)
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	h.port, _ = strconv.Atoi(serverURL.Port())
+
+	cli := h.startCLI()
+	select {
+	case <-cli.connected:
+	case <-cli.done:
+		t.Fatalf("CLI proxy stopped before connecting: %v", cli.err)
+	case <-time.After(connectTimeout):
+		t.Fatal("CLI proxy did not connect")
+	}
+
+	h.waitForHello()
+	return h
+}
+
+// createTunnel stores an inactive tunnel, deleted with the test
+func createTunnel(t *testing.T, policy string) models.Tunnel {
+	t.Helper()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	subdomain := "e2e-" + suffix
+	tunnel := models.Tunnel{
+		TunnelID:         "e2e-tunnel-" + suffix,
+		ClientID:         clientID,
+		Domain:           subdomain + "." + testDomain,
+		Subdomain:        subdomain,
+		Status:           models.TunnelStatusInactive,
+		ConnectionPolicy: policy,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	domain := models.Domain{
+		Domain:    tunnel.Domain,
+		TunnelID:  tunnel.TunnelID,
+		ClientID:  tunnel.ClientID,
+		CreatedAt: time.Now(),
+	}
+	if err := tunnelRepo.Create(context.Background(), tunnel, domain); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := tunnelRepo.Delete(context.Background(), &tunnel); err != nil {
+			t.Logf("failed to delete tunnel %s: %v", tunnel.TunnelID, err)
+		}
+	})
+	return tunnel
+}
+
+// cliRun is a CLI proxy running for a test
+type cliRun struct {
+	connected chan struct{} // receives when it connects
+	done      chan struct{} // closed when Start returns
+	err       error         // what Start returned, once done is closed
+}
+
+// startCLI runs a CLI proxy for the tunnel until the test ends
+func (h *harness) startCLI() *cliRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	cli := &cliRun{connected: make(chan struct{}, 1), done: make(chan struct{})}
+	p := proxy.NewProxy(h.port, gw.WebSocketURL(), "e2e-api-key", h.tunnel.TunnelID)
+	p.ClientVersion = "e2e"
+	p.OnConnect = func(bool) {
+		select {
+		case cli.connected <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		cli.err = p.Start(ctx)
+		close(cli.done)
+	}()
+	h.t.Cleanup(func() {
+		cancel()
+		<-cli.done
+	})
+	return cli
+}
+
+// waitForHello waits until tunnel-proxy has stored the protocol the CLI
+// negotiated, so requests use it rather than the legacy messages
+func (h *harness) waitForHello() {
+	h.t.Helper()
+	deadline := time.Now().Add(connectTimeout)
+	for time.Now().Before(deadline) {
+		tunnel, err := tunnelRepo.Get(context.Background(), h.tunnel.TunnelID)
+		if err == nil && tunnel.ProtocolVersion > 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	h.t.Fatal("tunnel-proxy did not store the CLI's hello")
+}
+
+// response is what a caller got back from http-proxy
+type response struct {
+	status  int
+	headers map[string]string
+	body    string
+}
+
+// header looks a response header up case-insensitively
+func (r response) header(name string) string {
+	for k, v := range r.headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// do sends a request for target (path and query) on the tunnel to http-proxy
+// as a Function URL invocation and reads the whole response
+func (h *harness) do(method, target string, headers map[string]string, body string) response {
+	h.t.Helper()
+	path, query, _ := strings.Cut(target, "?")
+	request := events.APIGatewayV2HTTPRequest{
+		RawPath:        "/t/" + h.tunnel.Subdomain + path,
+		RawQueryString: query,
+		Headers:        map[string]string{"host": "proxy.e2e.test", "user-agent": "e2e"},
+		Body:           body,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			DomainName: "proxy.e2e.test",
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    method,
+				Path:      "/t/" + h.tunnel.Subdomain + path,
+				SourceIP:  "127.0.0.1",
+				UserAgent: "e2e",
+			},
+		},
+	}
+	for name, value := range headers {
+		request.Headers[strings.ToLower(name)] = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := httpproxy.Handler(ctx, request)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, target, err)
+	}
+	got := response{status: resp.StatusCode, headers: resp.Headers}
+	if resp.Body != nil {
+		data, err := io.ReadAll(resp.Body)
+		if closer, ok := resp.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			h.t.Fatalf("%s %s: failed to read response: %v", method, target, err)
+		}
+		got.body = string(data)
+	}
+	return got
+}
+
+func TestBuffered(t *testing.T) {
+	h := newHarness(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-E2e", "local")
+			fmt.Fprintf(w, "hello %s", r.URL.Query().Get("name"))
+		case "/echo":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusTeapot)
+		}
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		headers    map[string]string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		{
+			name:       "GET with query",
+			method:     http.MethodGet,
+			target:     "/hello?name=e2e",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello e2e",
+			wantHeader: map[string]string{"Content-Type": "text/plain", "X-E2e": "local"},
+		},
+		{
+			name:       "POST with body",
+			method:     http.MethodPost,
+			target:     "/echo?a=1&a=2",
+			headers:    map[string]string{"Content-Type": "application/json"},
+			body:       `{"greeting":"hi"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `POST /echo?a=1&a=2 {"greeting":"hi"}`,
+			wantHeader: map[string]string{"Content-Type": "application/json"},
+		},
+		{
+			name:       "encoded path",
+			method:     http.MethodPut,
+			target:     "/echo?path=a%2Fb",
+			body:       "x",
+			wantStatus: http.StatusCreated,
+			wantBody:   "PUT /echo?path=a%2Fb x",
+		},
+		{
+			name:       "local status passed through",
+			method:     http.MethodGet,
+			target:     "/missing",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "404 page not found\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.do(tt.method, tt.target, tt.headers, tt.body)
+			if got.status != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %q)", got.status, tt.wantStatus, got.body)
+			}
+			if got.body != tt.wantBody {
+				t.Errorf("body = %q, want %q", got.body, tt.wantBody)
+			}
+			for name, want := range tt.wantHeader {
+				if value := got.header(name); value != want {
+					t.Errorf("header %s = %q, want %q", name, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownSubdomain(t *testing.T) {
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+	h := &harness{t: t, tunnel: models.Tunnel{Subdomain: "e2e-missing"}}
+	got := h.do(http.MethodGet, "/", nil, "")
+	if got.status != http.StatusNotFound {
+		t.Errorf("status = %d, want %d (body %q)", got.status, http.StatusNotFound, got.body)
+	}
+}
+
+// pattern is n bytes of recognisable text
+func pattern(n int) string {
+	return strings.Repeat("0123456789abcdef", n/16+1)[:n]
+}
+
+// digest is how the local servers describe a body they received
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("%d %x", len(body), sum)
+}
+
+func TestChunked(t *testing.T) {
+	// Bigger than one proxy_chunk (90KB) and than a WebSocket message (128KB),
+	// small enough for the pending request's DynamoDB item
+	requestBody := pattern(250 * 1024)
+	responseBody := pattern(200 * 1024)
+
+	h := newHarness(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/digest":
+			body, _ := io.ReadAll(r.Body)
+			io.WriteString(w, digest(body))
+		case "/large":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, responseBody)
+		default:
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusTeapot)
+		}
+	}))
+
+	t.Run("request body in proxy_chunk messages", func(t *testing.T) {
+		got := h.do(http.MethodPost, "/digest", map[string]string{"Content-Type": "text/plain"}, requestBody)
+		if got.status != http.StatusOK {
+			t.Fatalf("status = %d, want %d (body %q)", got.status, http.StatusOK, got.body)
+		}
+		if want := digest([]byte(requestBody)); got.body != want {
+			t.Errorf("local server got %q, want %q", got.body, want)
+		}
+	})
+
+	t.Run("response body in proxy_response_chunk messages", func(t *testing.T) {
+		// The CLI falls back to chunks when it cannot stage the response
+		s3.FailPuts(true)
+		defer s3.FailPuts(false)
+
+		got := h.do(http.MethodGet, "/large", nil, "")
+		if got.status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", got.status, http.StatusOK)
+		}
+		if got.body != responseBody {
+			t.Errorf("body = %d bytes (%s), want %d bytes", len(got.body), digest([]byte(got.body)), len(responseBody))
+		}
+	})
+}
+
+func TestS3Staged(t *testing.T) {
+	// Over the CLI's 80KB staging threshold
+	large := pattern(300 * 1024)
+	png := "\x89PNG\r\n\x1a\n" + pattern(2048)
+
+	h := newHarness(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, large)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, png)
+		default:
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusTeapot)
+		}
+	}))
+
+	tests := []struct {
+		name            string
+		target          string
+		wantBody        string
+		wantContentType string
+	}{
+		{name: "large response", target: "/large", wantBody: large, wantContentType: "text/plain"},
+		{name: "binary response", target: "/image.png", wantBody: png, wantContentType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puts := s3.Puts()
+			got := h.do(http.MethodGet, tt.target, nil, "")
+			if got.status != http.StatusOK {
+				t.Fatalf("status = %d, want %d (body %q)", got.status, http.StatusOK, got.body)
+			}
+			if got.body != tt.wantBody {
+				t.Errorf("body = %d bytes (%s), want %d bytes", len(got.body), digest([]byte(got.body)), len(tt.wantBody))
+			}
+			if ct := got.header("Content-Type"); ct != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantContentType)
+			}
+			if s3.Puts() != puts+1 {
+				t.Errorf("the CLI made %d uploads to S3, want 1", s3.Puts()-puts)
+			}
+		})
+	}
+}
+
+func TestSSE(t *testing.T) {
+	messages := []string{"one", "two", "three"}
+
+	h := newHarness(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher := w.(http.Flusher)
+		for _, event := range messages {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+
+	got := h.do(http.MethodGet, "/events", map[string]string{"Accept": "text/event-stream"}, "")
+	if got.status != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %q)", got.status, http.StatusOK, got.body)
+	}
+	if ct := got.header("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	want := ""
+	for _, event := range messages {
+		want += "data: " + event + "\n\n"
+	}
+	if got.body != want {
+		t.Errorf("body = %q, want %q", got.body, want)
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	h := newPolicyHarness(t, models.ConnectionPolicyReject, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+	}))
+
+	second := h.startCLI()
+	select {
+	case <-second.done:
+		if !errors.Is(second.err, proxy.ErrTunnelInUse) {
+			t.Fatalf("second CLI stopped with %v, want %v", second.err, proxy.ErrTunnelInUse)
+		}
+	case <-time.After(connectTimeout):
+		t.Fatal("second CLI was not refused")
+	}
+
+	// The first connection keeps the tunnel
+	if got := h.do(http.MethodGet, "/", nil, ""); got.status != http.StatusOK || got.body != "first" {
+		t.Errorf("got %d %q, want 200 from the first CLI", got.status, got.body)
+	}
+}
+
+func TestSwitchToMulti(t *testing.T) {
+	h := newHarness(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	first, err := tunnelRepo.Get(context.Background(), h.tunnel.TunnelID)
+	if err != nil {
+		t.Fatalf("failed to get tunnel: %v", err)
+	}
+
+	// The policy changes while the first CLI is connected
+	_, err = dbClient.UpdateTunnel(context.Background(), os.Getenv("TUNNELS_TABLE"), h.tunnel.TunnelID, func(*models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		return &dynamodb.UpdateItemInput{
+			UpdateExpression: aws.String("SET connection_policy = :policy"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":policy": &types.AttributeValueMemberS{Value: models.ConnectionPolicyMulti},
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to switch the tunnel to multi: %v", err)
+	}
+
+	second := h.startCLI()
+	select {
+	case <-second.connected:
+	case <-second.done:
+		t.Fatalf("second CLI stopped: %v", second.err)
+	case <-time.After(connectTimeout):
+		t.Fatal("second CLI did not connect")
+	}
+
+	tunnel, err := tunnelRepo.Get(context.Background(), h.tunnel.TunnelID)
+	if err != nil {
+		t.Fatalf("failed to get tunnel: %v", err)
+	}
+	connections := tunnel.Connections()
+	if len(connections) != 2 || !tunnel.HasConnection(first.ConnectionID) {
+		t.Errorf("connections = %v, want the first CLI's %s and the second's", connections, first.ConnectionID)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build integration
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gorilla/websocket"
+	"github.com/lmanrique/tunnel/lambdas/tunnel-connect/tunnelconnect"
+	"github.com/lmanrique/tunnel/lambdas/tunnel-proxy/tunnelproxy"
+)
+
+// gateway stands in for the API Gateway WebSocket stage: CLIs connect to it
+// through tunnelconnect.Handler, their messages are handed to
+// tunnelproxy.Handler one at a time per connection, and the management API's
+// @connections endpoints (the WEBSOCKET_ENDPOINT of the Lambdas) send to,
+// describe and close the connections
+type gateway struct {
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	next  int
+	conns map[string]*gatewayConn
+}
+
+type gatewayConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func newGateway() *gateway {
+	g := &gateway{conns: map[string]*gatewayConn{}}
+	g.server = httptest.NewServer(g)
+	return g
+}
+
+// URL is the management API endpoint
+func (g *gateway) URL() string {
+	return g.server.URL
+}
+
+// WebSocketURL is where CLIs connect
+func (g *gateway) WebSocketURL() string {
+	return "ws" + strings.TrimPrefix(g.server.URL, "http") + "/ws"
+}
+
+func (g *gateway) Close() {
+	g.mu.Lock()
+	for _, c := range g.conns {
+		c.ws.Close()
+	}
+	g.mu.Unlock()
+	g.server.Close()
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if escaped, ok := strings.CutPrefix(r.URL.EscapedPath(), "/@connections/"); ok {
+		connectionID, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.manage(w, r, connectionID)
+		return
+	}
+	g.connect(w, r)
+}
+
+// manage serves PostToConnection, DeleteConnection and GetConnection
+func (g *gateway) manage(w http.ResponseWriter, r *http.Request, connectionID string) {
+	g.mu.Lock()
+	c := g.conns[connectionID]
+	g.mu.Unlock()
+	if c == nil {
+		w.Header().Set("X-Amzn-Errortype", "GoneException")
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"message":"Gone"}`)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frame := websocket.TextMessage
+		if !utf8.Valid(data) {
+			frame = websocket.BinaryMessage
+		}
+		c.writeMu.Lock()
+		err = c.ws.WriteMessage(frame, data)
+		c.writeMu.Unlock()
+		if err != nil {
+			w.Header().Set("X-Amzn-Errortype", "GoneException")
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+	case http.MethodDelete:
+		c.ws.Close()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "{}")
+}
+
+// connect runs $connect through tunnel-connect, accepts the CLI's WebSocket
+// connection if it succeeded and relays its messages to tunnel-proxy until
+// it closes
+func (g *gateway) connect(w http.ResponseWriter, r *http.Request) {
+	tunnelID := r.URL.Query().Get("tunnel_id")
+
+	g.mu.Lock()
+	g.next++
+	connectionID := fmt.Sprintf("e2e-connection-%d", g.next)
+	g.mu.Unlock()
+
+	// What the authorizer puts in the context of every connection
+	authorizer := map[string]interface{}{"clientId": clientID, "tunnelId": tunnelID}
+
+	query := map[string]string{}
+	for name, values := range r.URL.Query() {
+		query[name] = values[0]
+	}
+	resp, err := tunnelconnect.Handler(r.Context(), events.APIGatewayWebsocketProxyRequest{
+		QueryStringParameters: query,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$connect",
+			EventType:    "CONNECT",
+			Authorizer:   authorizer,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  "127.0.0.1",
+				UserAgent: r.UserAgent(),
+			},
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		for name, value := range resp.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.WriteString(w, resp.Body)
+		return
+	}
+
+	ws, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &gatewayConn{ws: ws}
+	g.mu.Lock()
+	g.conns[connectionID] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.conns, connectionID)
+		g.mu.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		resp, err := tunnelproxy.Handler(context.Background(), events.APIGatewayWebsocketProxyRequest{
+			Body: string(data),
+			RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+				ConnectionID: connectionID,
+				RouteKey:     "$default",
+				EventType:    "MESSAGE",
+				Authorizer:   authorizer,
+			},
+		})
+		if err != nil || resp.StatusCode >= 400 {
+			log.Printf("e2e: tunnel-proxy answered %s with %d: %v %s", connectionID, resp.StatusCode, err, resp.Body)
+		}
+	}
+}
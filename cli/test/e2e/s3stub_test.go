@@ -0,0 +1,108 @@
+//go:build integration
+
+package e2e
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// s3Stub stands in for the uploads bucket (S3_ENDPOINT). It keeps objects in
+// memory under their path-style request path, /bucket/key, which is enough
+// for the presigned PUTs the CLI stages responses with and the GetObject
+// http-proxy reads them back with. Signatures are not checked.
+type s3Stub struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	puts     int
+	failPuts bool
+}
+
+func newS3Stub() *s3Stub {
+	s := &s3Stub{objects: map[string][]byte{}}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+// URL is the S3 endpoint
+func (s *s3Stub) URL() string {
+	return s.server.URL
+}
+
+func (s *s3Stub) Close() {
+	s.server.Close()
+}
+
+// FailPuts makes uploads fail with 503 until it is called with false
+func (s *s3Stub) FailPuts(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPuts = fail
+}
+
+// Puts is how many uploads the stub has stored
+func (s *s3Stub) Puts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		if s.failPuts {
+			s3Error(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		s.objects[r.URL.Path] = data
+		s.puts++
+		w.Header().Set("ETag", etag(data))
+
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" is not supported by the stub")
+	}
+}
+
+// etag is S3's ETag for a single-part object
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// s3Error writes an error the way S3 does, so the SDK reports its code
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
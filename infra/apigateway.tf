@@ -162,7 +162,8 @@ resource "aws_lambda_permission" "apigw_authorizer" {
   source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
 }
 
-# REST API routes and integrations
+# REST API routes and integrations. Management routes are served under /v1;
+# the unprefixed routes stay for CLIs that predate API versioning.
 resource "aws_apigatewayv2_integration" "register_client" {
   api_id           = aws_apigatewayv2_api.rest_api.id
   integration_type = "AWS_PROXY"
@@ -175,6 +176,12 @@ resource "aws_apigatewayv2_route" "register_client" {
   target    = "integrations/${aws_apigatewayv2_integration.register_client.id}"
 }
 
+resource "aws_apigatewayv2_route" "register_client_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /v1/clients"
+  target    = "integrations/${aws_apigatewayv2_integration.register_client.id}"
+}
+
 resource "aws_lambda_permission" "rest_register_client" {
   statement_id  = "AllowAPIGatewayInvoke"
   action        = "lambda:InvokeFunction"
@@ -195,6 +202,12 @@ resource "aws_apigatewayv2_route" "create_tunnel" {
   target    = "integrations/${aws_apigatewayv2_integration.create_tunnel.id}"
 }
 
+resource "aws_apigatewayv2_route" "create_tunnel_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /v1/tunnels"
+  target    = "integrations/${aws_apigatewayv2_integration.create_tunnel.id}"
+}
+
 resource "aws_lambda_permission" "rest_create_tunnel" {
   statement_id  = "AllowAPIGatewayInvoke"
   action        = "lambda:InvokeFunction"
@@ -215,6 +228,12 @@ resource "aws_apigatewayv2_route" "list_tunnels" {
   target    = "integrations/${aws_apigatewayv2_integration.list_tunnels.id}"
 }
 
+resource "aws_apigatewayv2_route" "list_tunnels_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /v1/tunnels"
+  target    = "integrations/${aws_apigatewayv2_integration.list_tunnels.id}"
+}
+
 resource "aws_lambda_permission" "rest_list_tunnels" {
   statement_id  = "AllowAPIGatewayInvoke"
   action        = "lambda:InvokeFunction"
@@ -223,6 +242,226 @@ resource "aws_lambda_permission" "rest_list_tunnels" {
   source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
 }
 
+resource "aws_apigatewayv2_integration" "list_tunnel_events" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.list_tunnel_events.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "list_tunnel_events" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /tunnels/{tunnel_id}/events"
+  target    = "integrations/${aws_apigatewayv2_integration.list_tunnel_events.id}"
+}
+
+resource "aws_apigatewayv2_route" "list_tunnel_events_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /v1/tunnels/{tunnel_id}/events"
+  target    = "integrations/${aws_apigatewayv2_integration.list_tunnel_events.id}"
+}
+
+resource "aws_lambda_permission" "rest_list_tunnel_events" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.list_tunnel_events.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "tunnel_stats" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.tunnel_stats.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "tunnel_stats" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /tunnels/{tunnel_id}/stats"
+  target    = "integrations/${aws_apigatewayv2_integration.tunnel_stats.id}"
+}
+
+resource "aws_apigatewayv2_route" "tunnel_stats_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /v1/tunnels/{tunnel_id}/stats"
+  target    = "integrations/${aws_apigatewayv2_integration.tunnel_stats.id}"
+}
+
+resource "aws_lambda_permission" "rest_tunnel_stats" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.tunnel_stats.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "create_connection_token" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.create_connection_token.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "create_connection_token" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /tunnels/{tunnel_id}/connection-token"
+  target    = "integrations/${aws_apigatewayv2_integration.create_connection_token.id}"
+}
+
+resource "aws_apigatewayv2_route" "create_connection_token_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /v1/tunnels/{tunnel_id}/connection-token"
+  target    = "integrations/${aws_apigatewayv2_integration.create_connection_token.id}"
+}
+
+resource "aws_lambda_permission" "rest_create_connection_token" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.create_connection_token.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "create_access_token" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.create_access_token.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "create_access_token_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /v1/tunnels/{tunnel_id}/access-tokens"
+  target    = "integrations/${aws_apigatewayv2_integration.create_access_token.id}"
+}
+
+resource "aws_lambda_permission" "rest_create_access_token" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.create_access_token.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "revoke_access_token" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.revoke_access_token.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "revoke_access_token_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "DELETE /v1/tunnels/{tunnel_id}/access-tokens/{consumer}"
+  target    = "integrations/${aws_apigatewayv2_integration.revoke_access_token.id}"
+}
+
+resource "aws_lambda_permission" "rest_revoke_access_token" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.revoke_access_token.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "get_client" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.get_client.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "get_client_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /v1/clients/me"
+  target    = "integrations/${aws_apigatewayv2_integration.get_client.id}"
+}
+
+resource "aws_lambda_permission" "rest_get_client" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.get_client.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "delete_client" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.delete_client.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "delete_client_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "DELETE /v1/clients/me"
+  target    = "integrations/${aws_apigatewayv2_integration.delete_client.id}"
+}
+
+resource "aws_lambda_permission" "rest_delete_client" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.delete_client.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+resource "aws_apigatewayv2_integration" "billing_portal" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.billing_portal.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "billing_portal_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /v1/billing/portal"
+  target    = "integrations/${aws_apigatewayv2_integration.billing_portal.id}"
+}
+
+resource "aws_lambda_permission" "rest_billing_portal" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.billing_portal.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+# Stripe's webhook endpoint; deliveries are authenticated by their signature
+resource "aws_apigatewayv2_integration" "stripe_webhook" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.stripe_webhook.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "stripe_webhook" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /billing/webhook"
+  target    = "integrations/${aws_apigatewayv2_integration.stripe_webhook.id}"
+}
+
+resource "aws_lambda_permission" "rest_stripe_webhook" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.stripe_webhook.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
+# OpenAPI description of the management API; public, for SDK generators
+resource "aws_apigatewayv2_integration" "get_openapi" {
+  api_id           = aws_apigatewayv2_api.rest_api.id
+  integration_type = "AWS_PROXY"
+  integration_uri  = aws_lambda_function.get_openapi.invoke_arn
+}
+
+resource "aws_apigatewayv2_route" "get_openapi" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "GET /openapi.json"
+  target    = "integrations/${aws_apigatewayv2_integration.get_openapi.id}"
+}
+
+resource "aws_lambda_permission" "rest_get_openapi" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.get_openapi.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.rest_api.execution_arn}/*/*"
+}
+
 resource "aws_apigatewayv2_integration" "delete_tunnel" {
   api_id           = aws_apigatewayv2_api.rest_api.id
   integration_type = "AWS_PROXY"
@@ -235,6 +474,12 @@ resource "aws_apigatewayv2_route" "delete_tunnel" {
   target    = "integrations/${aws_apigatewayv2_integration.delete_tunnel.id}"
 }
 
+resource "aws_apigatewayv2_route" "delete_tunnel_v1" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "DELETE /v1/tunnels/{tunnel_id}"
+  target    = "integrations/${aws_apigatewayv2_integration.delete_tunnel.id}"
+}
+
 resource "aws_lambda_permission" "rest_delete_tunnel" {
   statement_id  = "AllowAPIGatewayInvoke"
   action        = "lambda:InvokeFunction"
@@ -283,6 +528,14 @@ resource "aws_apigatewayv2_route" "upload_url_root" {
   target    = "integrations/${aws_apigatewayv2_integration.http_proxy.id}"
 }
 
+# Upload-complete endpoint — clients that got a multipart upload (bodies over 5 GB)
+# post the ETags of its parts here once every part is uploaded.
+resource "aws_apigatewayv2_route" "upload_complete" {
+  api_id    = aws_apigatewayv2_api.rest_api.id
+  route_key = "POST /upload-complete/{request_id}"
+  target    = "integrations/${aws_apigatewayv2_integration.http_proxy.id}"
+}
+
 # Poll endpoint — clients poll here after uploading to S3, waiting for the tunnel response.
 resource "aws_apigatewayv2_route" "poll_response" {
   api_id    = aws_apigatewayv2_api.rest_api.id
@@ -0,0 +1,6 @@
+# SNS topic the alarms managed through the backoffice API (/api/alarms) notify
+# by default; email destinations are subscribed to it by the API
+resource "aws_sns_topic" "alerts" {
+  name = "${var.project_name}-alerts-${var.environment}"
+  tags = local.common_tags
+}
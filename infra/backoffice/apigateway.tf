@@ -6,10 +6,11 @@ resource "aws_apigatewayv2_api" "backoffice" {
   tags          = local.common_tags
 
   cors_configuration {
-    allow_origins = ["*"]
-    allow_methods = ["GET", "OPTIONS"]
-    allow_headers = ["Authorization", "Content-Type"]
-    max_age       = 300
+    allow_origins  = ["*"]
+    allow_methods  = ["GET", "POST", "PATCH", "DELETE", "OPTIONS"]
+    allow_headers  = ["Authorization", "Content-Type", "Last-Event-ID"]
+    expose_headers = ["X-Next-Token", "X-Row-Count"]
+    max_age        = 300
   }
 }
 
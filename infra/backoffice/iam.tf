@@ -57,6 +57,15 @@ resource "aws_iam_role_policy" "backoffice_read" {
           "arn:aws:logs:${var.aws_region}:*:log-group:/aws/apigateway/${var.project_name}-*:*",
         ]
       },
+      # CloudWatch Logs: calls that can't be scoped to a log group
+      {
+        Effect = "Allow"
+        Action = [
+          "logs:DescribeLogGroups",
+          "logs:GetQueryResults",
+        ]
+        Resource = "*"
+      },
       # DynamoDB: read project tables
       {
         Effect = "Allow"
@@ -65,22 +74,191 @@ resource "aws_iam_role_policy" "backoffice_read" {
           "dynamodb:Scan",
           "dynamodb:Query",
           "dynamodb:GetItem",
+          "dynamodb:BatchGetItem",
         ]
         Resource = [
           "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-*-${var.environment}",
           "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-*-${var.environment}/index/*",
         ]
       },
-      # CloudFront: list distributions
+      # S3: browse the uploads bucket
+      {
+        Effect = "Allow"
+        Action = [
+          "s3:ListBucket",
+        ]
+        Resource = "arn:aws:s3:::${var.project_name}-uploads-${var.environment}"
+      },
+      # CloudWatch: metric graphs
+      {
+        Effect = "Allow"
+        Action = [
+          "cloudwatch:GetMetricData",
+        ]
+        Resource = "*"
+      },
+      # CloudFront: list distributions and invalidations
       {
         Effect = "Allow"
         Action = [
           "cloudfront:ListDistributions",
           "cloudfront:GetDistribution",
           "cloudfront:ListTagsForResource",
+          "cloudfront:ListInvalidations",
+          "cloudfront:GetInvalidation",
         ]
         Resource = "*"
       },
     ]
   })
 }
+
+# Policy: admin actions (clearing stuck requests and orphaned uploads, disconnecting tunnels, invalidating the CDN)
+resource "aws_iam_role_policy" "backoffice_admin" {
+  name = "${local.name_prefix}-admin-policy"
+  role = aws_iam_role.backoffice_lambda.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      # DynamoDB: clear stuck pending requests, expire those of deleted tunnels
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:DeleteItem",
+          "dynamodb:UpdateItem",
+        ]
+        Resource = "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-pending-requests-${var.environment}"
+      },
+      # DynamoDB: disconnect and delete tunnels (with their domain), repair
+      # dangling domain records and record the event
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:UpdateItem",
+          "dynamodb:DeleteItem",
+          "dynamodb:ConditionCheckItem",
+        ]
+        Resource = [
+          "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-tunnels-${var.environment}",
+          "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-domains-${var.environment}",
+        ]
+      },
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+        ]
+        Resource = "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-tunnel-events-${var.environment}"
+      },
+      # DynamoDB: keep a deleted tunnel's subdomain reserved for its owner
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+        ]
+        Resource = "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-released-domains-${var.environment}"
+      },
+      # DynamoDB: create clients and change their plan or status
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+          "dynamodb:UpdateItem",
+        ]
+        Resource = "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-clients-${var.environment}"
+      },
+      # DynamoDB: audit log of admin actions
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+        ]
+        Resource = "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-audit-log-${var.environment}"
+      },
+      # DynamoDB: backoffice users, login sessions and lockout counters
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:GetItem",
+          "dynamodb:PutItem",
+          "dynamodb:UpdateItem",
+          "dynamodb:DeleteItem",
+          "dynamodb:Scan",
+        ]
+        Resource = [
+          "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-admin-users-${var.environment}",
+          "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-admin-sessions-${var.environment}",
+          "arn:aws:dynamodb:${var.aws_region}:*:table/${var.project_name}-admin-lockouts-${var.environment}",
+        ]
+      },
+      # S3: delete orphaned request/response bodies
+      {
+        Effect = "Allow"
+        Action = [
+          "s3:DeleteObject",
+        ]
+        Resource = "arn:aws:s3:::${var.project_name}-uploads-${var.environment}/*"
+      },
+      # Lambda: tune memory, timeout and selected environment variables, send
+      # test events (the API limits real invocations to read-only functions)
+      {
+        Effect = "Allow"
+        Action = [
+          "lambda:UpdateFunctionConfiguration",
+          "lambda:InvokeFunction",
+        ]
+        Resource = "arn:aws:lambda:${var.aws_region}:*:function:${var.project_name}-*"
+      },
+      # CloudFront: invalidate cached paths
+      {
+        Effect = "Allow"
+        Action = [
+          "cloudfront:CreateInvalidation",
+        ]
+        Resource = "*"
+      },
+      # CloudWatch: alarms managed from the backoffice (all named <project>-<env>-backoffice-*)
+      {
+        Effect = "Allow"
+        Action = [
+          "cloudwatch:DescribeAlarms",
+        ]
+        Resource = "*"
+      },
+      {
+        Effect = "Allow"
+        Action = [
+          "cloudwatch:PutMetricAlarm",
+          "cloudwatch:DeleteAlarms",
+          "cloudwatch:TagResource",
+        ]
+        Resource = "arn:aws:cloudwatch:${var.aws_region}:*:alarm:${var.project_name}-${var.environment}-backoffice-*"
+      },
+      # SNS: subscribe email destinations to the alerts topic
+      {
+        Effect = "Allow"
+        Action = [
+          "sns:Subscribe",
+        ]
+        Resource = aws_sns_topic.alerts.arn
+      },
+    ]
+  })
+}
+
+# Policy: close tunnel WebSocket connections (only when the WebSocket API is known)
+resource "aws_iam_role_policy" "backoffice_connections" {
+  count = var.websocket_api_id == "" ? 0 : 1
+  name  = "${local.name_prefix}-connections-policy"
+  role  = aws_iam_role.backoffice_lambda.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [{
+      Effect   = "Allow"
+      Action   = ["execute-api:ManageConnections"]
+      Resource = "arn:aws:execute-api:${var.aws_region}:*:${var.websocket_api_id}/${var.environment}/*"
+    }]
+  })
+}
@@ -37,6 +37,14 @@ resource "aws_lambda_function" "backoffice_api" {
       ADMIN_API_KEY              = var.admin_api_key
       CLOUDFRONT_DISTRIBUTION_ID = var.cloudfront_distribution_id
       AWS_REGION_NAME            = var.aws_region
+      WEBSOCKET_ENDPOINT         = var.websocket_api_id == "" ? "" : "https://${var.websocket_api_id}.execute-api.${var.aws_region}.amazonaws.com/${var.environment}"
+      WEBSOCKET_API_ID           = var.websocket_api_id
+      REST_API_ID                = var.rest_api_id
+      HEALTH_CHECK_API_KEY       = var.health_check_api_key
+      ALERTS_TOPIC_ARN           = aws_sns_topic.alerts.arn
+      REDACT_HEADERS             = join(",", var.redact_headers)
+      REDACT_FIELDS              = join(",", var.redact_fields)
+      SUBDOMAIN_QUARANTINE_HOURS = tostring(var.subdomain_quarantine_hours)
     }
   }
 
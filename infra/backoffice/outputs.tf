@@ -27,3 +27,8 @@ output "backoffice_lambda_name" {
   description = "Backoffice Lambda function name"
   value       = aws_lambda_function.backoffice_api.function_name
 }
+
+output "alerts_topic_arn" {
+  description = "SNS topic backoffice-managed alarms notify by default"
+  value       = aws_sns_topic.alerts.arn
+}
@@ -17,17 +17,36 @@ variable "project_name" {
 }
 
 variable "admin_api_key" {
-  description = "Admin API key for backoffice authentication (stored as Lambda env var)"
+  description = "Bootstrap key for the backoffice: only creates the first admin user, and stops working once one exists (stored as Lambda env var)"
   type        = string
   sensitive   = true
 }
 
 variable "cloudfront_distribution_id" {
-  description = "CloudFront distribution ID of the main tunnel service (for monitoring)"
+  description = "CloudFront distribution ID of the main tunnel service (for monitoring and cache invalidations)"
   type        = string
   default     = ""
 }
 
+variable "websocket_api_id" {
+  description = "ID of the main tunnel service's WebSocket API (tofu output websocket_api_id), for force-disconnecting tunnels"
+  type        = string
+  default     = ""
+}
+
+variable "rest_api_id" {
+  description = "ID of the main tunnel service's REST API (tofu output rest_api_id), for the metrics overview"
+  type        = string
+  default     = ""
+}
+
+variable "health_check_api_key" {
+  description = "API key of a dedicated client the deep health check (GET /api/health/deep) creates its temporary tunnels as; needs rest_api_id"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
 variable "certificate_arn" {
   description = "ACM certificate ARN for the backoffice domain (must be in us-east-1 for CloudFront)"
   type        = string
@@ -45,3 +64,21 @@ variable "route53_zone_id" {
   type        = string
   default     = ""
 }
+
+variable "redact_headers" {
+  description = "Headers whose values are redacted in the request details the backoffice shows; keep in step with the main stack's redact_headers"
+  type        = list(string)
+  default     = []
+}
+
+variable "redact_fields" {
+  description = "Fields redacted in the request details the backoffice shows; keep in step with the main stack's redact_fields"
+  type        = list(string)
+  default     = []
+}
+
+variable "subdomain_quarantine_hours" {
+  description = "Hours a subdomain deleted from the backoffice stays reserved for its previous owner (0 releases it immediately); keep in step with the main stack's subdomain_quarantine_hours"
+  type        = number
+  default     = 720
+}
@@ -9,6 +9,24 @@ resource "aws_dynamodb_table" "clients" {
     type = "S"
   }
 
+  attribute {
+    name = "status"
+    type = "S"
+  }
+
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+
+  # Backoffice search by status, optionally narrowed by creation time
+  global_secondary_index {
+    name            = "status-created_at-index"
+    hash_key        = "status"
+    range_key       = "created_at"
+    projection_type = "ALL"
+  }
+
   ttl {
     attribute_name = "ttl"
     enabled        = false
@@ -18,6 +36,17 @@ resource "aws_dynamodb_table" "clients" {
     enabled = true
   }
 
+  # Shared with every regional deployment as a global table
+  stream_enabled   = length(var.replica_regions) > 0
+  stream_view_type = length(var.replica_regions) > 0 ? "NEW_AND_OLD_IMAGES" : null
+
+  dynamic "replica" {
+    for_each = var.replica_regions
+    content {
+      region_name = replica.value
+    }
+  }
+
   tags = {
     Name = "${var.project_name}-clients-${var.environment}"
   }
@@ -39,12 +68,42 @@ resource "aws_dynamodb_table" "tunnels" {
     type = "S"
   }
 
+  attribute {
+    name = "connection_id"
+    type = "S"
+  }
+
   global_secondary_index {
     name            = "client_id-index"
     hash_key        = "client_id"
     projection_type = "ALL"
   }
 
+  # Sparse index: only tunnels with a live connection carry connection_id
+  global_secondary_index {
+    name            = "connection_id-index"
+    hash_key        = "connection_id"
+    projection_type = "ALL"
+  }
+
+  attribute {
+    name = "status"
+    type = "S"
+  }
+
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+
+  # Backoffice search by status, optionally narrowed by creation time
+  global_secondary_index {
+    name            = "status-created_at-index"
+    hash_key        = "status"
+    range_key       = "created_at"
+    projection_type = "ALL"
+  }
+
   ttl {
     attribute_name = "ttl"
     enabled        = false
@@ -54,6 +113,17 @@ resource "aws_dynamodb_table" "tunnels" {
     enabled = true
   }
 
+  # Shared with every regional deployment as a global table
+  stream_enabled   = length(var.replica_regions) > 0
+  stream_view_type = length(var.replica_regions) > 0 ? "NEW_AND_OLD_IMAGES" : null
+
+  dynamic "replica" {
+    for_each = var.replica_regions
+    content {
+      region_name = replica.value
+    }
+  }
+
   tags = {
     Name = "${var.project_name}-tunnels-${var.environment}"
   }
@@ -79,11 +149,55 @@ resource "aws_dynamodb_table" "domains" {
     enabled = true
   }
 
+  # Shared with every regional deployment as a global table
+  stream_enabled   = length(var.replica_regions) > 0
+  stream_view_type = length(var.replica_regions) > 0 ? "NEW_AND_OLD_IMAGES" : null
+
+  dynamic "replica" {
+    for_each = var.replica_regions
+    content {
+      region_name = replica.value
+    }
+  }
+
   tags = {
     Name = "${var.project_name}-domains-${var.environment}"
   }
 }
 
+# Released domains table (subdomains of deleted tunnels, reserved for their
+# previous owner until the quarantine ends; expired by TTL)
+resource "aws_dynamodb_table" "released_domains" {
+  name         = "${var.project_name}-released-domains-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "domain"
+
+  attribute {
+    name = "domain"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  # Shared with every regional deployment as a global table, like domains
+  stream_enabled   = length(var.replica_regions) > 0
+  stream_view_type = length(var.replica_regions) > 0 ? "NEW_AND_OLD_IMAGES" : null
+
+  dynamic "replica" {
+    for_each = var.replica_regions
+    content {
+      region_name = replica.value
+    }
+  }
+
+  tags = {
+    Name = "${var.project_name}-released-domains-${var.environment}"
+  }
+}
+
 # Pending HTTP requests table (for request/response cycle)
 resource "aws_dynamodb_table" "pending_requests" {
   name         = "${var.project_name}-pending-requests-${var.environment}"
@@ -95,6 +209,26 @@ resource "aws_dynamodb_table" "pending_requests" {
     type = "S"
   }
 
+  attribute {
+    name = "tunnel_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+
+  # A tunnel's requests, oldest first, for deleting and reaping tunnels and
+  # for analytics. Bodies and chunks stay out of the index.
+  global_secondary_index {
+    name               = "tunnel_id-index"
+    hash_key           = "tunnel_id"
+    range_key          = "created_at"
+    projection_type    = "INCLUDE"
+    non_key_attributes = ["status", "method", "path"]
+  }
+
   ttl {
     attribute_name = "ttl"
     enabled        = true
@@ -108,3 +242,239 @@ resource "aws_dynamodb_table" "pending_requests" {
     Name = "${var.project_name}-pending-requests-${var.environment}"
   }
 }
+
+# Stream chunks table (pieces of streamed SSE responses, one item per chunk
+# so each is a small write; expired by TTL rather than deleted)
+resource "aws_dynamodb_table" "stream_chunks" {
+  name         = "${var.project_name}-stream-chunks-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "request_id"
+  range_key    = "seq"
+
+  attribute {
+    name = "request_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "seq"
+    type = "N"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-stream-chunks-${var.environment}"
+  }
+}
+
+# Tunnel events table (audit trail of tunnel lifecycle events)
+resource "aws_dynamodb_table" "tunnel_events" {
+  name         = "${var.project_name}-tunnel-events-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "tunnel_id"
+  range_key    = "event_id"
+
+  attribute {
+    name = "tunnel_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "event_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-tunnel-events-${var.environment}"
+  }
+}
+
+# Request log table (one entry per proxied request, used for tunnel statistics)
+resource "aws_dynamodb_table" "request_log" {
+  name         = "${var.project_name}-request-log-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "tunnel_id"
+  range_key    = "log_id"
+
+  attribute {
+    name = "tunnel_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "log_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-request-log-${var.environment}"
+  }
+}
+
+# Request stats table (per-tunnel hourly counters added to as requests are
+# logged; tunnel-stats and report-usage sum them instead of reading the log)
+resource "aws_dynamodb_table" "request_stats" {
+  name         = "${var.project_name}-request-stats-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "tunnel_id"
+  range_key    = "hour"
+
+  attribute {
+    name = "tunnel_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "hour"
+    type = "N"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-request-stats-${var.environment}"
+  }
+}
+
+# Rate limit table (fixed-window message counters per WebSocket connection)
+resource "aws_dynamodb_table" "rate_limits" {
+  name         = "${var.project_name}-rate-limits-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "limit_key"
+
+  attribute {
+    name = "limit_key"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-rate-limits-${var.environment}"
+  }
+}
+
+# Audit log table (every mutating backoffice call, written by the backoffice API)
+resource "aws_dynamodb_table" "audit_log" {
+  name         = "${var.project_name}-audit-log-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "date"
+  range_key    = "audit_id"
+
+  attribute {
+    name = "date"
+    type = "S"
+  }
+
+  attribute {
+    name = "audit_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-audit-log-${var.environment}"
+  }
+}
+
+# Backoffice users (username -> bcrypt password hash and role)
+resource "aws_dynamodb_table" "admin_users" {
+  name         = "${var.project_name}-admin-users-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "username"
+
+  attribute {
+    name = "username"
+    type = "S"
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-admin-users-${var.environment}"
+  }
+}
+
+# Backoffice login sessions, keyed by the SHA-256 of the session token
+resource "aws_dynamodb_table" "admin_sessions" {
+  name         = "${var.project_name}-admin-sessions-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "token_hash"
+
+  attribute {
+    name = "token_hash"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-admin-sessions-${var.environment}"
+  }
+}
+
+# Failed backoffice logins per user and source IP per 15-minute window
+resource "aws_dynamodb_table" "admin_lockouts" {
+  name         = "${var.project_name}-admin-lockouts-${var.environment}"
+  billing_mode = var.dynamodb_billing_mode
+  hash_key     = "lockout_key"
+
+  attribute {
+    name = "lockout_key"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ttl"
+    enabled        = true
+  }
+
+  tags = {
+    Name = "${var.project_name}-admin-lockouts-${var.environment}"
+  }
+}
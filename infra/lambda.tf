@@ -40,6 +40,7 @@ resource "aws_iam_role_policy" "lambda_policy" {
           "dynamodb:PutItem",
           "dynamodb:UpdateItem",
           "dynamodb:DeleteItem",
+          "dynamodb:ConditionCheckItem",
           "dynamodb:Query",
           "dynamodb:Scan"
         ]
@@ -47,8 +48,15 @@ resource "aws_iam_role_policy" "lambda_policy" {
           aws_dynamodb_table.clients.arn,
           aws_dynamodb_table.tunnels.arn,
           aws_dynamodb_table.domains.arn,
+          aws_dynamodb_table.released_domains.arn,
           aws_dynamodb_table.pending_requests.arn,
-          "${aws_dynamodb_table.tunnels.arn}/index/*"
+          aws_dynamodb_table.stream_chunks.arn,
+          aws_dynamodb_table.tunnel_events.arn,
+          aws_dynamodb_table.request_log.arn,
+          aws_dynamodb_table.request_stats.arn,
+          aws_dynamodb_table.rate_limits.arn,
+          "${aws_dynamodb_table.tunnels.arn}/index/*",
+          "${aws_dynamodb_table.pending_requests.arn}/index/*"
         ]
       },
       {
@@ -64,10 +72,26 @@ resource "aws_iam_role_policy" "lambda_policy" {
         Action = [
           "s3:PutObject",
           "s3:GetObject",
-          "s3:DeleteObject"
+          "s3:DeleteObject",
+          "s3:AbortMultipartUpload"
         ]
         Resource = "${aws_s3_bucket.uploads.arn}/*"
       },
+      {
+        # Failed WebSocket deliveries are queued for redeliver-request, and
+        # S3 events s3-upload-notify failed on for s3-upload-failed
+        Effect = "Allow"
+        Action = [
+          "sqs:SendMessage",
+          "sqs:ReceiveMessage",
+          "sqs:DeleteMessage",
+          "sqs:GetQueueAttributes"
+        ]
+        Resource = [
+          aws_sqs_queue.redelivery.arn,
+          aws_sqs_queue.upload_notify_dlq.arn
+        ]
+      },
     ]
   })
 }
@@ -93,6 +117,56 @@ resource "aws_cloudwatch_log_group" "list_tunnels" {
   retention_in_days = 7
 }
 
+resource "aws_cloudwatch_log_group" "list_tunnel_events" {
+  name              = "/aws/lambda/${aws_lambda_function.list_tunnel_events.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "tunnel_stats" {
+  name              = "/aws/lambda/${aws_lambda_function.tunnel_stats.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "create_connection_token" {
+  name              = "/aws/lambda/${aws_lambda_function.create_connection_token.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "create_access_token" {
+  name              = "/aws/lambda/${aws_lambda_function.create_access_token.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "revoke_access_token" {
+  name              = "/aws/lambda/${aws_lambda_function.revoke_access_token.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "get_client" {
+  name              = "/aws/lambda/${aws_lambda_function.get_client.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "delete_client" {
+  name              = "/aws/lambda/${aws_lambda_function.delete_client.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "billing_portal" {
+  name              = "/aws/lambda/${aws_lambda_function.billing_portal.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "stripe_webhook" {
+  name              = "/aws/lambda/${aws_lambda_function.stripe_webhook.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_log_group" "get_openapi" {
+  name              = "/aws/lambda/${aws_lambda_function.get_openapi.function_name}"
+  retention_in_days = 7
+}
+
 resource "aws_cloudwatch_log_group" "authorize_connection" {
   name              = "/aws/lambda/${aws_lambda_function.authorize_connection.function_name}"
   retention_in_days = 7
@@ -146,13 +220,20 @@ resource "aws_lambda_function" "create_tunnel" {
 
   environment {
     variables = {
-      CLIENTS_TABLE        = aws_dynamodb_table.clients.name
-      TUNNELS_TABLE        = aws_dynamodb_table.tunnels.name
-      DOMAINS_TABLE        = aws_dynamodb_table.domains.name
-      DOMAIN_NAME          = var.domain_name
-      WEBSOCKET_API_URL    = aws_apigatewayv2_api.websocket_api.api_endpoint
-      WEBSOCKET_API_STAGE  = aws_apigatewayv2_stage.websocket_api.name
-      ENVIRONMENT          = var.environment
+      CLIENTS_TABLE          = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE          = aws_dynamodb_table.tunnels.name
+      DOMAINS_TABLE          = aws_dynamodb_table.domains.name
+      RELEASED_DOMAINS_TABLE = aws_dynamodb_table.released_domains.name
+      EVENTS_TABLE           = aws_dynamodb_table.tunnel_events.name
+      DOMAIN_NAME            = var.domain_name
+      WEBSOCKET_API_URL      = aws_apigatewayv2_api.websocket_api.api_endpoint
+      WEBSOCKET_API_STAGE    = aws_apigatewayv2_stage.websocket_api.name
+      REGIONS                = jsonencode(var.regions)
+      MAX_TUNNELS_PER_CLIENT = tostring(var.max_tunnels_per_client)
+      BILLING_ENABLED        = tostring(var.stripe_secret_key != "")
+      SUBDOMAIN_LENGTH       = tostring(var.subdomain_length)
+      SUBDOMAIN_CHARSET      = var.subdomain_charset
+      ENVIRONMENT            = var.environment
     }
   }
 }
@@ -170,10 +251,15 @@ resource "aws_lambda_function" "delete_tunnel" {
 
   environment {
     variables = {
-      CLIENTS_TABLE = aws_dynamodb_table.clients.name
-      TUNNELS_TABLE = aws_dynamodb_table.tunnels.name
-      DOMAINS_TABLE = aws_dynamodb_table.domains.name
-      ENVIRONMENT   = var.environment
+      CLIENTS_TABLE              = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE              = aws_dynamodb_table.tunnels.name
+      DOMAINS_TABLE              = aws_dynamodb_table.domains.name
+      RELEASED_DOMAINS_TABLE     = aws_dynamodb_table.released_domains.name
+      SUBDOMAIN_QUARANTINE_HOURS = tostring(var.subdomain_quarantine_hours)
+      PENDING_REQUESTS_TABLE     = aws_dynamodb_table.pending_requests.name
+      EVENTS_TABLE               = aws_dynamodb_table.tunnel_events.name
+      WEBSOCKET_ENDPOINT         = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
+      ENVIRONMENT                = var.environment
     }
   }
 }
@@ -189,6 +275,110 @@ resource "aws_lambda_function" "list_tunnels" {
   filename         = data.archive_file.list_tunnels_placeholder.output_path
   source_code_hash = data.archive_file.list_tunnels_placeholder.output_base64sha256
 
+  environment {
+    variables = {
+      CLIENTS_TABLE      = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE      = aws_dynamodb_table.tunnels.name
+      WEBSOCKET_ENDPOINT = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
+      ENVIRONMENT        = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "list_tunnel_events" {
+  function_name = "${var.project_name}-list-tunnel-events-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.list_tunnel_events_placeholder.output_path
+  source_code_hash = data.archive_file.list_tunnel_events_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE = aws_dynamodb_table.tunnels.name
+      EVENTS_TABLE  = aws_dynamodb_table.tunnel_events.name
+      ENVIRONMENT   = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "tunnel_stats" {
+  function_name = "${var.project_name}-tunnel-stats-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.tunnel_stats_placeholder.output_path
+  source_code_hash = data.archive_file.tunnel_stats_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE       = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE       = aws_dynamodb_table.tunnels.name
+      REQUEST_STATS_TABLE = aws_dynamodb_table.request_stats.name
+      ENVIRONMENT         = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "create_connection_token" {
+  function_name = "${var.project_name}-create-connection-token-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.create_connection_token_placeholder.output_path
+  source_code_hash = data.archive_file.create_connection_token_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE           = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE           = aws_dynamodb_table.tunnels.name
+      CONNECTION_TOKEN_SECRET = random_password.connection_token_secret.result
+      ENVIRONMENT             = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "create_access_token" {
+  function_name = "${var.project_name}-create-access-token-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.create_access_token_placeholder.output_path
+  source_code_hash = data.archive_file.create_access_token_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE = aws_dynamodb_table.tunnels.name
+      ENVIRONMENT   = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "revoke_access_token" {
+  function_name = "${var.project_name}-revoke-access-token-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.revoke_access_token_placeholder.output_path
+  source_code_hash = data.archive_file.revoke_access_token_placeholder.output_base64sha256
+
   environment {
     variables = {
       CLIENTS_TABLE = aws_dynamodb_table.clients.name
@@ -198,6 +388,114 @@ resource "aws_lambda_function" "list_tunnels" {
   }
 }
 
+resource "aws_lambda_function" "get_client" {
+  function_name = "${var.project_name}-get-client-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.get_client_placeholder.output_path
+  source_code_hash = data.archive_file.get_client_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE              = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE              = aws_dynamodb_table.tunnels.name
+      MAX_TUNNELS_PER_CLIENT     = tostring(var.max_tunnels_per_client)
+      MAX_CONNECTIONS_PER_CLIENT = tostring(var.max_connections_per_client)
+      ENVIRONMENT                = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "delete_client" {
+  function_name = "${var.project_name}-delete-client-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.delete_client_placeholder.output_path
+  source_code_hash = data.archive_file.delete_client_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE              = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE              = aws_dynamodb_table.tunnels.name
+      DOMAINS_TABLE              = aws_dynamodb_table.domains.name
+      RELEASED_DOMAINS_TABLE     = aws_dynamodb_table.released_domains.name
+      SUBDOMAIN_QUARANTINE_HOURS = tostring(var.subdomain_quarantine_hours)
+      PENDING_REQUESTS_TABLE     = aws_dynamodb_table.pending_requests.name
+      EVENTS_TABLE               = aws_dynamodb_table.tunnel_events.name
+      WEBSOCKET_ENDPOINT         = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
+      ENVIRONMENT                = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "billing_portal" {
+  function_name = "${var.project_name}-billing-portal-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.billing_portal_placeholder.output_path
+  source_code_hash = data.archive_file.billing_portal_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE        = aws_dynamodb_table.clients.name
+      STRIPE_SECRET_KEY    = var.stripe_secret_key
+      BILLING_CHECKOUT_URL = var.billing_checkout_url
+      BILLING_RETURN_URL   = var.billing_return_url
+      ENVIRONMENT          = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "stripe_webhook" {
+  function_name = "${var.project_name}-stripe-webhook-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.stripe_webhook_placeholder.output_path
+  source_code_hash = data.archive_file.stripe_webhook_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE         = aws_dynamodb_table.clients.name
+      STRIPE_WEBHOOK_SECRET = var.stripe_webhook_secret
+      ENVIRONMENT           = var.environment
+    }
+  }
+}
+
+resource "aws_lambda_function" "get_openapi" {
+  function_name = "${var.project_name}-get-openapi-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.get_openapi_placeholder.output_path
+  source_code_hash = data.archive_file.get_openapi_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      ENVIRONMENT = var.environment
+    }
+  }
+}
+
 resource "aws_lambda_function" "authorize_connection" {
   function_name = "${var.project_name}-authorize-connection-${var.environment}"
   role          = aws_iam_role.lambda_execution.arn
@@ -211,8 +509,9 @@ resource "aws_lambda_function" "authorize_connection" {
 
   environment {
     variables = {
-      CLIENTS_TABLE = aws_dynamodb_table.clients.name
-      ENVIRONMENT   = var.environment
+      CLIENTS_TABLE           = aws_dynamodb_table.clients.name
+      CONNECTION_TOKEN_SECRET = random_password.connection_token_secret.result
+      ENVIRONMENT             = var.environment
     }
   }
 }
@@ -234,10 +533,28 @@ resource "aws_lambda_function" "http_proxy" {
       DOMAINS_TABLE                   = aws_dynamodb_table.domains.name
       TUNNELS_TABLE                   = aws_dynamodb_table.tunnels.name
       PENDING_REQUESTS_TABLE          = aws_dynamodb_table.pending_requests.name
+      STREAM_CHUNKS_TABLE             = aws_dynamodb_table.stream_chunks.name
       WEBSOCKET_ENDPOINT              = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
       DOMAIN_NAME                     = var.domain_name
       UPLOADS_BUCKET                  = aws_s3_bucket.uploads.bucket
+      REQUEST_LOG_TABLE               = aws_dynamodb_table.request_log.name
+      REQUEST_STATS_TABLE             = aws_dynamodb_table.request_stats.name
+      RATE_LIMITS_TABLE               = aws_dynamodb_table.rate_limits.name
       TUNNEL_RECONNECT_GRACE_PERIOD   = "30s"
+      REQUEST_QUEUE_SIZE              = "100"
+      REQUEST_QUEUE_TIMEOUT           = "10s"
+      MAX_INLINE_RESPONSE_BYTES       = tostring(var.max_inline_response_bytes)
+      REDIRECT_LARGE_RESPONSES        = tostring(var.redirect_large_responses)
+      CONSISTENT_POLL_READS           = tostring(var.consistent_poll_reads)
+      LANDING_PAGE_TEMPLATE           = var.landing_page_template
+      SCANNER_CIDRS                   = join(",", var.scanner_cidrs)
+      LOG_REQUEST_DETAILS             = tostring(var.log_request_details)
+      REDACT_HEADERS                  = join(",", var.redact_headers)
+      REDACT_FIELDS                   = join(",", var.redact_fields)
+      SESSION_SECRET                  = random_password.session_secret.result
+      REGIONS                         = jsonencode(var.regions)
+      REGION_FORWARD_SECRET           = var.region_forward_secret
+      REDELIVERY_QUEUE_URL            = aws_sqs_queue.redelivery.url
       ENVIRONMENT                     = var.environment
     }
   }
@@ -262,8 +579,12 @@ resource "aws_lambda_function" "tunnel_connect" {
 
   environment {
     variables = {
-      TUNNELS_TABLE = aws_dynamodb_table.tunnels.name
-      ENVIRONMENT   = var.environment
+      CLIENTS_TABLE              = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE              = aws_dynamodb_table.tunnels.name
+      EVENTS_TABLE               = aws_dynamodb_table.tunnel_events.name
+      MAX_CONNECTIONS_PER_CLIENT = tostring(var.max_connections_per_client)
+      ENVIRONMENT                = var.environment
+      WEBSOCKET_ENDPOINT         = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
     }
   }
 }
@@ -283,6 +604,7 @@ resource "aws_lambda_function" "tunnel_disconnect" {
     variables = {
       TUNNELS_TABLE = aws_dynamodb_table.tunnels.name
       DOMAINS_TABLE = aws_dynamodb_table.domains.name
+      EVENTS_TABLE  = aws_dynamodb_table.tunnel_events.name
       ENVIRONMENT   = var.environment
     }
   }
@@ -304,6 +626,9 @@ resource "aws_lambda_function" "tunnel_proxy" {
       TUNNELS_TABLE          = aws_dynamodb_table.tunnels.name
       DOMAINS_TABLE          = aws_dynamodb_table.domains.name
       PENDING_REQUESTS_TABLE = aws_dynamodb_table.pending_requests.name
+      STREAM_CHUNKS_TABLE    = aws_dynamodb_table.stream_chunks.name
+      RATE_LIMITS_TABLE      = aws_dynamodb_table.rate_limits.name
+      REQUEST_LOG_TABLE      = aws_dynamodb_table.request_log.name
       WEBSOCKET_ENDPOINT     = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
       ENVIRONMENT            = var.environment
     }
@@ -351,6 +676,106 @@ data "archive_file" "list_tunnels_placeholder" {
   }
 }
 
+data "archive_file" "list_tunnel_events_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/list-tunnel-events.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "tunnel_stats_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/tunnel-stats.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "create_connection_token_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/create-connection-token.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "create_access_token_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/create-access-token.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "revoke_access_token_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/revoke-access-token.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "get_client_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/get-client.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "delete_client_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/delete-client.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "billing_portal_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/billing-portal.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "stripe_webhook_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/stripe-webhook.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+data "archive_file" "get_openapi_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/get-openapi.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
 data "archive_file" "authorize_connection_placeholder" {
   type        = "zip"
   output_path = "${path.module}/.terraform/lambda-placeholders/authorize-connection.zip"
@@ -447,9 +872,14 @@ resource "aws_lambda_function" "s3_upload_notify" {
       PENDING_REQUESTS_TABLE = aws_dynamodb_table.pending_requests.name
       WEBSOCKET_ENDPOINT     = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
       UPLOADS_BUCKET         = aws_s3_bucket.uploads.bucket
+      REDELIVERY_QUEUE_URL   = aws_sqs_queue.redelivery.url
       ENVIRONMENT            = var.environment
     }
   }
+
+  dead_letter_config {
+    target_arn = aws_sqs_queue.upload_notify_dlq.arn
+  }
 }
 
 resource "aws_cloudwatch_log_group" "s3_upload_notify" {
@@ -488,3 +918,287 @@ data "archive_file" "s3_upload_notify_placeholder" {
     filename = "bootstrap"
   }
 }
+
+# ── s3-upload-failed Lambda ──────────────────────────────────────────────────
+# Consumes s3-upload-notify's dead-letter queue and marks the pending requests
+# of the failed uploads as failed, with the error s3-upload-notify reported.
+
+resource "aws_lambda_function" "s3_upload_failed" {
+  function_name = "${var.project_name}-s3-upload-failed-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = 30
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.s3_upload_failed_placeholder.output_path
+  source_code_hash = data.archive_file.s3_upload_failed_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      PENDING_REQUESTS_TABLE = aws_dynamodb_table.pending_requests.name
+      ENVIRONMENT            = var.environment
+    }
+  }
+}
+
+resource "aws_cloudwatch_log_group" "s3_upload_failed" {
+  name              = "/aws/lambda/${aws_lambda_function.s3_upload_failed.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_lambda_event_source_mapping" "s3_upload_failed" {
+  event_source_arn = aws_sqs_queue.upload_notify_dlq.arn
+  function_name    = aws_lambda_function.s3_upload_failed.arn
+  batch_size       = 10
+}
+
+data "archive_file" "s3_upload_failed_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/s3-upload-failed.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+# ── reap-stale-tunnels Lambda ────────────────────────────────────────────────
+# Runs on a schedule. API Gateway does not always deliver $disconnect, so
+# tunnels whose CLI heartbeat (last_ping_at) has stopped are marked inactive
+# and their stale connection IDs cleared.
+
+resource "aws_lambda_function" "reap_stale_tunnels" {
+  function_name = "${var.project_name}-reap-stale-tunnels-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = 60
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.reap_stale_tunnels_placeholder.output_path
+  source_code_hash = data.archive_file.reap_stale_tunnels_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      TUNNELS_TABLE          = aws_dynamodb_table.tunnels.name
+      EVENTS_TABLE           = aws_dynamodb_table.tunnel_events.name
+      PENDING_REQUESTS_TABLE = aws_dynamodb_table.pending_requests.name
+      WEBSOCKET_ENDPOINT     = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
+      STALE_AFTER_MINUTES    = var.stale_tunnel_minutes
+      ENVIRONMENT            = var.environment
+    }
+  }
+}
+
+resource "aws_cloudwatch_log_group" "reap_stale_tunnels" {
+  name              = "/aws/lambda/${aws_lambda_function.reap_stale_tunnels.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_event_rule" "reap_stale_tunnels" {
+  name                = "${var.project_name}-reap-stale-tunnels-${var.environment}"
+  description         = "Mark tunnels without a recent heartbeat as inactive"
+  schedule_expression = "rate(1 minute)"
+}
+
+resource "aws_cloudwatch_event_target" "reap_stale_tunnels" {
+  rule = aws_cloudwatch_event_rule.reap_stale_tunnels.name
+  arn  = aws_lambda_function.reap_stale_tunnels.arn
+}
+
+# Allow EventBridge to invoke the reap-stale-tunnels Lambda
+resource "aws_lambda_permission" "reap_stale_tunnels" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.reap_stale_tunnels.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.reap_stale_tunnels.arn
+}
+
+data "archive_file" "reap_stale_tunnels_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/reap-stale-tunnels.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+# ── Lambda warmer ─────────────────────────────────────────────────────────────
+# Optional. Pings http-proxy and tunnel-proxy on a schedule with
+# {"warmer": true}, which only creates their clients, so an idle deployment
+# keeps an initialized execution environment for the next request. One ping
+# keeps one environment warm; concurrent requests beyond it still start cold
+# (see the ColdStart metric).
+
+resource "aws_cloudwatch_event_rule" "lambda_warmer" {
+  count               = var.lambda_warmer_minutes > 0 ? 1 : 0
+  name                = "${var.project_name}-lambda-warmer-${var.environment}"
+  description         = "Keep the request path Lambdas initialized"
+  schedule_expression = var.lambda_warmer_minutes == 1 ? "rate(1 minute)" : "rate(${var.lambda_warmer_minutes} minutes)"
+}
+
+resource "aws_cloudwatch_event_target" "warm_http_proxy" {
+  count = var.lambda_warmer_minutes > 0 ? 1 : 0
+  rule  = aws_cloudwatch_event_rule.lambda_warmer[0].name
+  arn   = aws_lambda_function.http_proxy.arn
+  input = jsonencode({ warmer = true })
+}
+
+resource "aws_cloudwatch_event_target" "warm_tunnel_proxy" {
+  count = var.lambda_warmer_minutes > 0 ? 1 : 0
+  rule  = aws_cloudwatch_event_rule.lambda_warmer[0].name
+  arn   = aws_lambda_function.tunnel_proxy.arn
+  input = jsonencode({ warmer = true })
+}
+
+# Allow EventBridge to invoke the warmed Lambdas
+resource "aws_lambda_permission" "warm_http_proxy" {
+  count         = var.lambda_warmer_minutes > 0 ? 1 : 0
+  statement_id  = "AllowEventBridgeWarmer"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.http_proxy.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.lambda_warmer[0].arn
+}
+
+resource "aws_lambda_permission" "warm_tunnel_proxy" {
+  count         = var.lambda_warmer_minutes > 0 ? 1 : 0
+  statement_id  = "AllowEventBridgeWarmer"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.tunnel_proxy.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.lambda_warmer[0].arn
+}
+
+# ── report-usage Lambda ──────────────────────────────────────────────────────
+# Runs hourly. Reports each billed client's proxied requests for the previous
+# hour, counted from the request log, to its Stripe meter. Does nothing while
+# billing is disabled (no stripe_secret_key).
+
+resource "aws_lambda_function" "report_usage" {
+  function_name = "${var.project_name}-report-usage-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = 300
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.report_usage_placeholder.output_path
+  source_code_hash = data.archive_file.report_usage_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      CLIENTS_TABLE                  = aws_dynamodb_table.clients.name
+      TUNNELS_TABLE                  = aws_dynamodb_table.tunnels.name
+      REQUEST_STATS_TABLE            = aws_dynamodb_table.request_stats.name
+      STRIPE_SECRET_KEY              = var.stripe_secret_key
+      STRIPE_METER_EVENT             = var.stripe_meter_event
+      STRIPE_LOW_LATENCY_METER_EVENT = var.stripe_low_latency_meter_event
+      ENVIRONMENT                    = var.environment
+    }
+  }
+}
+
+resource "aws_cloudwatch_log_group" "report_usage" {
+  name              = "/aws/lambda/${aws_lambda_function.report_usage.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_cloudwatch_event_rule" "report_usage" {
+  name                = "${var.project_name}-report-usage-${var.environment}"
+  description         = "Report the previous hour's metered usage to Stripe"
+  schedule_expression = "cron(5 * * * ? *)"
+}
+
+resource "aws_cloudwatch_event_target" "report_usage" {
+  rule = aws_cloudwatch_event_rule.report_usage.name
+  arn  = aws_lambda_function.report_usage.arn
+}
+
+# Allow EventBridge to invoke the report-usage Lambda
+resource "aws_lambda_permission" "report_usage" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.report_usage.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.report_usage.arn
+}
+
+data "archive_file" "report_usage_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/report-usage.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+# ── redeliver-request Lambda ─────────────────────────────────────────────────
+# Consumes the redelivery queue. Retries sending a queued WebSocket message to
+# the tunnel's current connection, re-queueing it with a longer delay on
+# another transient failure, and completes the pending request with a 502 once
+# its attempts or the caller's patience run out.
+
+resource "aws_lambda_function" "redeliver_request" {
+  function_name = "${var.project_name}-redeliver-request-${var.environment}"
+  role          = aws_iam_role.lambda_execution.arn
+  handler       = "bootstrap"
+  runtime       = "provided.al2023"
+  timeout       = 30
+  memory_size   = var.lambda_memory_size
+
+  filename         = data.archive_file.redeliver_request_placeholder.output_path
+  source_code_hash = data.archive_file.redeliver_request_placeholder.output_base64sha256
+
+  environment {
+    variables = {
+      TUNNELS_TABLE          = aws_dynamodb_table.tunnels.name
+      PENDING_REQUESTS_TABLE = aws_dynamodb_table.pending_requests.name
+      WEBSOCKET_ENDPOINT     = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_api.name}"
+      REDELIVERY_QUEUE_URL   = aws_sqs_queue.redelivery.url
+      ENVIRONMENT            = var.environment
+    }
+  }
+}
+
+resource "aws_cloudwatch_log_group" "redeliver_request" {
+  name              = "/aws/lambda/${aws_lambda_function.redeliver_request.function_name}"
+  retention_in_days = 7
+}
+
+resource "aws_lambda_event_source_mapping" "redeliver_request" {
+  event_source_arn = aws_sqs_queue.redelivery.arn
+  function_name    = aws_lambda_function.redeliver_request.arn
+  batch_size       = 10
+
+  # Retry only the records the handler reports as failed
+  function_response_types = ["ReportBatchItemFailures"]
+}
+
+data "archive_file" "redeliver_request_placeholder" {
+  type        = "zip"
+  output_path = "${path.module}/.terraform/lambda-placeholders/redeliver-request.zip"
+
+  source {
+    content  = "placeholder"
+    filename = "bootstrap"
+  }
+}
+
+# HMAC key for short-lived WebSocket connection tokens. Minted by
+# create-connection-token and verified by authorize-connection.
+resource "random_password" "connection_token_secret" {
+  length  = 64
+  special = false
+}
+
+# HMAC key for the session cookies of password-protected tunnels. Minted and
+# verified by http-proxy.
+resource "random_password" "session_secret" {
+  length  = 64
+  special = false
+}
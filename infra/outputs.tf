@@ -3,11 +3,21 @@ output "rest_api_endpoint" {
   value       = aws_apigatewayv2_api.rest_api.api_endpoint
 }
 
+output "rest_api_id" {
+  description = "REST API ID (input to the backoffice metrics overview)"
+  value       = aws_apigatewayv2_api.rest_api.id
+}
+
 output "websocket_api_endpoint" {
   description = "WebSocket API Gateway endpoint URL"
   value       = aws_apigatewayv2_api.websocket_api.api_endpoint
 }
 
+output "websocket_api_id" {
+  description = "WebSocket API ID (input to the backoffice for force-disconnects)"
+  value       = aws_apigatewayv2_api.websocket_api.id
+}
+
 output "cloudfront_domain" {
   description = "CloudFront distribution domain name"
   value       = var.enable_cloudfront ? aws_cloudfront_distribution.tunnel[0].domain_name : ""
@@ -28,6 +38,36 @@ output "dynamodb_domains_table" {
   value       = aws_dynamodb_table.domains.name
 }
 
+output "dynamodb_tunnel_events_table" {
+  description = "DynamoDB tunnel events table name"
+  value       = aws_dynamodb_table.tunnel_events.name
+}
+
+output "dynamodb_request_log_table" {
+  description = "DynamoDB request log table name"
+  value       = aws_dynamodb_table.request_log.name
+}
+
+output "dynamodb_request_stats_table" {
+  description = "DynamoDB request stats table name"
+  value       = aws_dynamodb_table.request_stats.name
+}
+
+output "dynamodb_audit_log_table" {
+  description = "DynamoDB backoffice audit log table name"
+  value       = aws_dynamodb_table.audit_log.name
+}
+
+output "dynamodb_admin_users_table" {
+  description = "DynamoDB backoffice users table name"
+  value       = aws_dynamodb_table.admin_users.name
+}
+
+output "dynamodb_rate_limits_table" {
+  description = "DynamoDB rate limits table name"
+  value       = aws_dynamodb_table.rate_limits.name
+}
+
 output "lambda_deployment_bucket" {
   description = "S3 bucket for Lambda deployments"
   value       = aws_s3_bucket.lambda_deployments.bucket
@@ -16,6 +16,11 @@ resource "aws_s3_bucket_lifecycle_configuration" "uploads" {
     expiration {
       days = 1 # Minimum allowed by S3; objects are practically short-lived (TTL enforced by DynamoDB)
     }
+
+    # Multipart uploads of large request bodies that were never completed
+    abort_incomplete_multipart_upload {
+      days_after_initiation = 1
+    }
   }
 }
 
@@ -0,0 +1,20 @@
+# SQS queue of WebSocket messages that http-proxy and s3-upload-notify failed
+# to send to a tunnel's CLI with a transient error. redeliver-request retries
+# them with a growing delay while the caller is still waiting; messages are
+# short-lived, so anything left after an hour is dropped.
+
+resource "aws_sqs_queue" "redelivery" {
+  name                       = "${var.project_name}-redelivery-${var.environment}"
+  message_retention_seconds  = 3600
+  visibility_timeout_seconds = 60 # must be at least redeliver-request's timeout
+}
+
+# Dead-letter queue of s3-upload-notify: S3 events it failed on after Lambda's
+# two async retries. s3-upload-failed marks their requests as failed so the
+# caller's GET /poll gets a 502 instead of waiting for the request to expire.
+
+resource "aws_sqs_queue" "upload_notify_dlq" {
+  name                       = "${var.project_name}-upload-notify-dlq-${var.environment}"
+  message_retention_seconds  = 86400
+  visibility_timeout_seconds = 60 # must be at least s3-upload-failed's timeout
+}
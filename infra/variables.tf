@@ -55,3 +55,159 @@ variable "lambda_memory_size" {
   type        = number
   default     = 256
 }
+
+variable "stale_tunnel_minutes" {
+  description = "Minutes without a CLI heartbeat before a tunnel is marked inactive"
+  type        = number
+  default     = 3
+}
+
+variable "lambda_warmer_minutes" {
+  description = "Minutes between warm-up pings of http-proxy and tunnel-proxy (0 disables the warmer)"
+  type        = number
+  default     = 0
+}
+
+variable "max_tunnels_per_client" {
+  description = "Most tunnels a client may own, capping the plans' quotas (0 for no cap; a client's max_tunnels override is not capped)"
+  type        = number
+  default     = 100
+}
+
+variable "subdomain_length" {
+  description = "Length of random tunnel subdomains (4-32), not counting a client's subdomain prefix"
+  type        = number
+  default     = 8
+}
+
+variable "subdomain_charset" {
+  description = "Characters random tunnel subdomains are drawn from: hex, lower, alnum or digits"
+  type        = string
+  default     = "hex"
+}
+
+variable "subdomain_quarantine_hours" {
+  description = "Hours a deleted tunnel's subdomain stays reserved for its previous owner (0 releases it immediately)"
+  type        = number
+  default     = 720
+}
+
+variable "max_connections_per_client" {
+  description = "Most CLIs a client may have connected at once across its tunnels (0 for no limit)"
+  type        = number
+  default     = 50
+}
+
+variable "stripe_secret_key" {
+  description = "Secret API key of the Stripe account that sells plans; empty disables billing and the plan gating of premium features"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+variable "stripe_webhook_secret" {
+  description = "Signing secret of the Stripe webhook endpoint pointed at POST /billing/webhook"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+variable "stripe_meter_event" {
+  description = "Event name of the Stripe meter that counts proxied requests"
+  type        = string
+  default     = "tunnel_requests"
+}
+
+variable "stripe_low_latency_meter_event" {
+  description = "Event name of a Stripe meter that also counts the requests of low-latency tunnels (empty to not meter them apart)"
+  type        = string
+  default     = ""
+}
+
+variable "billing_checkout_url" {
+  description = "Stripe Payment Link (or checkout page) offered to clients without a subscription; the client ID is appended as client_reference_id"
+  type        = string
+  default     = ""
+}
+
+variable "billing_return_url" {
+  description = "Page the Stripe customer portal links back to"
+  type        = string
+  default     = ""
+}
+
+variable "max_inline_response_bytes" {
+  description = "Responses larger than this are always staged in S3 by the CLI instead of sent over the WebSocket (0 keeps the CLI's 80 KB default)"
+  type        = number
+  default     = 0
+}
+
+variable "redirect_large_responses" {
+  description = "Answer responses over max_inline_response_bytes with a 307 to a presigned S3 URL instead of streaming them through http-proxy"
+  type        = bool
+  default     = false
+}
+
+variable "consistent_poll_reads" {
+  description = "Poll for responses with consistent reads, which never miss a response just written by the CLI but cost twice the read capacity"
+  type        = bool
+  default     = false
+}
+
+variable "landing_page_template" {
+  description = "html/template served by http-proxy to browsers requesting an unknown subdomain, with .Subdomain, .Domain and .BaseDomain (empty uses the built-in page; Lambda environment variables are limited to 4 KB in total)"
+  type        = string
+  default     = ""
+}
+
+variable "scanner_cidrs" {
+  description = "Source ranges of known scanners that http-proxy rejects on tunnels with block_bots, alongside crawler user agents"
+  type        = list(string)
+  default     = []
+}
+
+variable "log_request_details" {
+  description = "Keep each request's headers and the start of its body in the request log, redacted"
+  type        = bool
+  default     = false
+}
+
+variable "redact_headers" {
+  description = "Headers whose values are redacted in the request log and backoffice, on top of Authorization, Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key"
+  type        = list(string)
+  default     = []
+}
+
+variable "redact_fields" {
+  description = "JSON field paths (e.g. card.number; a bare name matches at any depth) and form or query parameters redacted in the request log and backoffice, on top of password, secret and token fields"
+  type        = list(string)
+  default     = []
+}
+
+variable "replica_regions" {
+  description = "Extra regions the clients, tunnels and domains tables are replicated to (DynamoDB global tables)"
+  type        = list(string)
+  default     = []
+}
+
+variable "regions" {
+  description = "Every regional deployment (including this one) that CLIs may connect to and http-proxy may forward to"
+  type = list(object({
+    region        = string
+    websocket_url = string
+    proxy_url     = string
+  }))
+  default = []
+}
+
+variable "region_forward_secret" {
+  description = "Secret shared by every regional deployment; http-proxy signs the requests it forwards to another region with it. Required with more than one region"
+  type        = string
+  default     = ""
+  sensitive   = true
+
+  validation {
+    condition     = var.region_forward_secret == "" || length(var.region_forward_secret) >= 32
+    error_message = "region_forward_secret must be at least 32 characters."
+  }
+}
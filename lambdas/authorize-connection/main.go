@@ -7,20 +7,21 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/lmanrique/tunnel/lambdas/shared/auth"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
-	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
 	clientsTable string
+	tokenSecret  []byte
 	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
 )
 
 func init() {
 	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tokenSecret = []byte(os.Getenv("CONNECTION_TOKEN_SECRET"))
 	if clientsTable == "" {
 		panic("CLIENTS_TABLE environment variable is required")
 	}
@@ -34,6 +35,7 @@ func handler(ctx context.Context, request events.APIGatewayCustomAuthorizerReque
 		if err != nil {
 			return denyPolicy(request.MethodArn), fmt.Errorf("failed to initialize database: %w", err)
 		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
 	}
 
 	// Extract API key from Authorization header
@@ -51,34 +53,41 @@ func handler(ctx context.Context, request events.APIGatewayCustomAuthorizerReque
 		return denyPolicy(request.MethodArn), fmt.Errorf("invalid authorization header: %w", err)
 	}
 
+	// Connection tokens are verified locally, without touching DynamoDB
+	if auth.IsConnectionToken(apiKey) {
+		return authorizeConnectionToken(request, apiKey)
+	}
+
 	// Verify client API key
-	clientID, err := verifyClientAPIKey(ctx, apiKey)
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
 	if err != nil {
 		return denyPolicy(request.MethodArn), fmt.Errorf("invalid API key: %w", err)
 	}
 
-	// Return allow policy with client ID in context
-	return allowPolicy(request.MethodArn, clientID), nil
+	// Return allow policy with client ID and requested tunnel in context
+	return allowPolicy(request.MethodArn, client.ClientID, request.QueryStringParameters["tunnel_id"]), nil
 }
 
-func verifyClientAPIKey(ctx context.Context, apiKey string) (string, error) {
-	var clients []models.Client
-	if err := dbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(clientsTable),
-	}, &clients); err != nil {
-		return "", err
+// authorizeConnectionToken allows the connection if the token is valid and was
+// minted for the tunnel being connected to
+func authorizeConnectionToken(request events.APIGatewayCustomAuthorizerRequestTypeRequest, token string) (events.APIGatewayCustomAuthorizerResponse, error) {
+	if len(tokenSecret) == 0 {
+		return denyPolicy(request.MethodArn), fmt.Errorf("connection tokens are not enabled")
 	}
 
-	for _, client := range clients {
-		if auth.VerifyAPIKey(apiKey, client.APIKeyHash) && client.Status == models.ClientStatusActive {
-			return client.ClientID, nil
-		}
+	claims, err := auth.VerifyConnectionToken(tokenSecret, token)
+	if err != nil {
+		return denyPolicy(request.MethodArn), err
+	}
+
+	if tunnelID := request.QueryStringParameters["tunnel_id"]; tunnelID != claims.TunnelID {
+		return denyPolicy(request.MethodArn), fmt.Errorf("connection token was issued for another tunnel")
 	}
 
-	return "", fmt.Errorf("client not found or inactive")
+	return allowPolicy(request.MethodArn, claims.ClientID, claims.TunnelID), nil
 }
 
-func allowPolicy(methodArn, clientID string) events.APIGatewayCustomAuthorizerResponse {
+func allowPolicy(methodArn, clientID, tunnelID string) events.APIGatewayCustomAuthorizerResponse {
 	return events.APIGatewayCustomAuthorizerResponse{
 		PrincipalID: clientID,
 		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
@@ -93,6 +102,7 @@ func allowPolicy(methodArn, clientID string) events.APIGatewayCustomAuthorizerRe
 		},
 		Context: map[string]interface{}{
 			"clientId": clientID,
+			"tunnelId": tunnelID,
 		},
 	}
 }
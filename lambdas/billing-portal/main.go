@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/billing"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+// Kinds of billing link
+const (
+	linkTypePortal   = "portal"   // manage the existing subscription
+	linkTypeCheckout = "checkout" // buy a plan
+)
+
+var (
+	clientsTable string
+	checkoutURL  string
+	returnURL    string
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+	stripe       *billing.Client
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	if clientsTable == "" {
+		panic("CLIENTS_TABLE environment variable is required")
+	}
+
+	// Billing is disabled without a Stripe account
+	if secretKey := os.Getenv("STRIPE_SECRET_KEY"); secretKey != "" {
+		stripe = billing.NewClient(secretKey)
+	}
+	checkoutURL = os.Getenv("BILLING_CHECKOUT_URL")
+	returnURL = os.Getenv("BILLING_RETURN_URL")
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	if stripe == nil {
+		return problem.ErrorResponse(404, problem.CodeBillingUnavailable, "Billing is not enabled on this server")
+	}
+
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	if err := clientRepo.RecordUse(ctx, client.ClientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("billing-portal: %v", err)
+	}
+
+	if client.StripeCustomerID != "" {
+		portalURL, err := stripe.PortalSession(ctx, client.StripeCustomerID, returnURL)
+		if err != nil {
+			return errorResponse(502, err.Error())
+		}
+		return successResponse(200, api.BillingPortalResponse{URL: portalURL, Type: linkTypePortal})
+	}
+
+	// Not a customer yet: send the client to buy a plan. The checkout link
+	// hands the client ID back to stripe-webhook as client_reference_id.
+	if checkoutURL == "" {
+		return problem.ErrorResponse(404, problem.CodeBillingUnavailable, "No plans are for sale on this server")
+	}
+	link, err := url.Parse(checkoutURL)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Invalid checkout URL: %v", err))
+	}
+	query := link.Query()
+	query.Set("client_reference_id", client.ClientID)
+	link.RawQuery = query.Encode()
+
+	return successResponse(200, api.BillingPortalResponse{URL: link.String(), Type: linkTypeCheckout})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable string
+	tunnelsTable string
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+)
+
+// errNotOwner is returned from the tunnel update when the caller does not own
+// the tunnel
+var errNotOwner = errors.New("tunnel belongs to another client")
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("create-access-token: %v", err)
+	}
+
+	tunnelID := request.PathParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	var req api.CreateAccessTokenRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body")
+	}
+	if !auth.ValidateConsumer(req.Consumer) {
+		return errorResponse(400, "consumer must be 1-64 letters, digits and . _ @ -, starting with a letter or digit")
+	}
+	ttl := auth.DefaultAccessTokenTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+		if req.ExpiresIn < 0 || ttl > auth.MaxAccessTokenTTL {
+			return errorResponse(400, fmt.Sprintf("expires_in must be between 1 and %d seconds", int64(auth.MaxAccessTokenTTL/time.Second)))
+		}
+	}
+
+	// Record the consumer's new token, creating the tunnel's signing key with
+	// its first token; the consumer's older token stops working
+	issuedAt := time.Now()
+	var key string
+	_, err = dbClient.UpdateTunnel(ctx, tunnelsTable, tunnelID, func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		if tunnel.ClientID != clientID {
+			return nil, errNotOwner
+		}
+		key = tunnel.AccessKey
+		if key == "" {
+			var err error
+			if key, err = auth.GenerateAccessKey(); err != nil {
+				return nil, err
+			}
+		}
+
+		consumers := maps.Clone(tunnel.AccessConsumers)
+		if consumers == nil {
+			consumers = map[string]int64{}
+		}
+		consumers[req.Consumer] = issuedAt.Unix()
+		consumersAV, err := attributevalue.Marshal(consumers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal access consumers: %w", err)
+		}
+
+		return &dynamodb.UpdateItemInput{
+			UpdateExpression: aws.String("SET access_key = :key, access_consumers = :consumers"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":key":       &types.AttributeValueMemberS{Value: key},
+				":consumers": consumersAV,
+			},
+		}, nil
+	})
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	case errors.Is(err, errNotOwner):
+		return errorResponse(403, "Unauthorized to issue access tokens for this tunnel")
+	case errors.Is(err, db.ErrVersionConflict):
+		return problem.ErrorResponse(409, problem.CodeConcurrentUpdate, "Tunnel changed while issuing the token; retry")
+	case err != nil:
+		return errorResponse(500, fmt.Sprintf("Failed to issue access token: %v", err))
+	}
+
+	token, expiresAt, err := auth.MintAccessToken(key, tunnelID, req.Consumer, issuedAt, ttl)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to create access token: %v", err))
+	}
+
+	return successResponse(201, api.CreateAccessTokenResponse{
+		Token:     token,
+		TunnelID:  tunnelID,
+		Consumer:  req.Consumer,
+		ExpiresAt: expiresAt,
+		Header:    auth.AccessTokenHeader,
+	})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable string
+	tunnelsTable string
+	tokenSecret  []byte
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+	tunnelRepo   repository.TunnelRepository
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	tokenSecret = []byte(os.Getenv("CONNECTION_TOKEN_SECRET"))
+
+	if clientsTable == "" || tunnelsTable == "" || len(tokenSecret) == 0 {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("create-connection-token: %v", err)
+	}
+
+	tunnelID := request.PathParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	// The token is bound to one tunnel, so only its owner may mint it
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
+	if err != nil {
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	if tunnel.ClientID != clientID {
+		return errorResponse(403, "Unauthorized to connect to this tunnel")
+	}
+
+	token, expiresAt, err := auth.MintConnectionToken(tokenSecret, clientID, tunnelID)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to create connection token: %v", err))
+	}
+
+	return successResponse(201, api.CreateConnectionTokenResponse{
+		Token:     token,
+		TunnelID:  tunnelID,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,25 +17,48 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
 	"github.com/lmanrique/tunnel/lambdas/shared/auth"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/env"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/regions"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
 	clientsTable      string
 	tunnelsTable      string
 	domainsTable      string
+	releasedTable     string
+	eventsTable       string
 	domainName        string
 	websocketAPIURL   string
 	websocketAPIStage string
+	deploymentRegions []regions.Region
 	dbClient          *db.DynamoDBClient
+	clientRepo        repository.ClientRepository
+	tunnelRepo        repository.TunnelRepository
+	domainRepo        repository.DomainRepository
+	releasedRepo      repository.ReleasedDomainRepository
+
+	// maxTunnelsPerClient caps the plans' tunnel quotas, 0 meaning no cap
+	maxTunnelsPerClient int
+	// billingEnabled restricts premium features to the plans that include them
+	billingEnabled bool
+	// subdomainFormat is the length and charset of random subdomains
+	subdomainFormat auth.SubdomainFormat
 )
 
 func init() {
 	clientsTable = os.Getenv("CLIENTS_TABLE")
 	tunnelsTable = os.Getenv("TUNNELS_TABLE")
 	domainsTable = os.Getenv("DOMAINS_TABLE")
+	releasedTable = os.Getenv("RELEASED_DOMAINS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
 	domainName = os.Getenv("DOMAIN_NAME")
 	websocketAPIURL = os.Getenv("WEBSOCKET_API_URL")
 	websocketAPIStage = os.Getenv("WEBSOCKET_API_STAGE")
@@ -39,20 +66,27 @@ func init() {
 	if clientsTable == "" || tunnelsTable == "" || domainsTable == "" || domainName == "" {
 		panic("Required environment variables are missing")
 	}
-}
 
-type CreateTunnelRequest struct {
-	Subdomain string `json:"subdomain,omitempty"`
-}
+	maxTunnelsPerClient = env.Count("MAX_TUNNELS_PER_CLIENT", 0)
+	billingEnabled = os.Getenv("BILLING_ENABLED") == "true"
+
+	// Shorter subdomains suit dev, longer and less guessable ones prod
+	subdomainFormat = auth.DefaultSubdomainFormat
+	if n := env.Count("SUBDOMAIN_LENGTH", 0); n > 0 {
+		subdomainFormat.Length = n
+	}
+	if v := os.Getenv("SUBDOMAIN_CHARSET"); v != "" {
+		subdomainFormat.Charset = v
+	}
+	if err := subdomainFormat.Validate(); err != nil {
+		panic(err.Error())
+	}
 
-type CreateTunnelResponse struct {
-	TunnelID     string `json:"tunnel_id"`
-	Domain       string `json:"domain"`
-	Subdomain    string `json:"subdomain"`
-	WebsocketURL string `json:"websocket_url"`
-	Status       string `json:"status"`
-	Message      string `json:"message"`
-	Reused       bool   `json:"reused,omitempty"`
+	var err error
+	deploymentRegions, err = regions.Load()
+	if err != nil {
+		panic(err.Error())
+	}
 }
 
 func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
@@ -63,6 +97,12 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
 		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
+		domainRepo = repository.NewDomainRepository(dbClient, domainsTable)
+		if releasedTable != "" {
+			releasedRepo = repository.NewReleasedDomainRepository(dbClient, releasedTable)
+		}
 	}
 
 	// Extract and verify API key
@@ -73,23 +113,110 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 
 	apiKey, err := auth.ExtractBearerToken(authHeader)
 	if err != nil {
-		return errorResponse(401, "Invalid authorization header")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
 	}
 
 	// Verify client exists and get client ID
-	clientID, err := verifyClientAPIKey(ctx, apiKey)
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
 	if err != nil {
-		return errorResponse(401, "Invalid API key")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("create-tunnel: %v", err)
 	}
 
 	// Parse request body
-	var req CreateTunnelRequest
+	var req api.CreateTunnelRequest
 	if request.Body != "" {
 		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 			return errorResponse(400, "Invalid request body")
 		}
 	}
 
+	if req.ConnectionPolicy != "" && !models.ValidConnectionPolicy(req.ConnectionPolicy) {
+		return errorResponse(400, "connection_policy must be one of reject, takeover, multi")
+	}
+
+	if req.Visibility != "" && !models.ValidVisibility(req.Visibility) {
+		return errorResponse(400, "visibility must be public or private")
+	}
+
+	if req.AllowedCountries != nil {
+		countries, err := normalizeCountries(req.AllowedCountries)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		req.AllowedCountries = countries
+	}
+
+	if req.AllowedMethods != nil {
+		methods, err := normalizeMethods(req.AllowedMethods)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		req.AllowedMethods = methods
+	}
+
+	if req.StrippedHeaders != nil {
+		names, err := normalizeHeaderNames(req.StrippedHeaders)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		req.StrippedHeaders = names
+	}
+
+	if req.RequiredHeaders != nil {
+		rules, err := normalizeRequiredHeaders(req.RequiredHeaders)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		req.RequiredHeaders = rules
+	}
+
+	if req.ResponseHeaders != nil {
+		rules, err := normalizeResponseHeaders(req.ResponseHeaders)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		req.ResponseHeaders = rules
+	}
+
+	if req.StrippedResponseHeaders != nil {
+		names, err := normalizeHeaderNames(req.StrippedResponseHeaders)
+		if err != nil {
+			return errorResponse(400, err.Error())
+		}
+		for _, name := range names {
+			if slices.Contains(framingHeaders, name) {
+				return errorResponse(400, fmt.Sprintf("Header %s cannot be stripped from responses", name))
+			}
+		}
+		req.StrippedResponseHeaders = names
+	}
+
+	// Hash a new password up front; passwordHash is "" when it is removed
+	var passwordHash string
+	if req.Password != nil && *req.Password != "" {
+		if len(*req.Password) < auth.MinTunnelPasswordLength {
+			return errorResponse(400, fmt.Sprintf("password must be at least %d characters", auth.MinTunnelPasswordLength))
+		}
+		passwordHash, err = auth.HashTunnelPassword(*req.Password)
+		if err != nil {
+			return errorResponse(500, err.Error())
+		}
+	}
+
+	if req.MaxConcurrentRequests != nil && *req.MaxConcurrentRequests < 0 {
+		return errorResponse(400, "max_concurrent_requests must not be negative")
+	}
+
+	if req.Region != "" {
+		if _, ok := regions.Find(deploymentRegions, req.Region); !ok {
+			return errorResponse(400, fmt.Sprintf("Unknown region: %s", req.Region))
+		}
+	}
+
 	// Generate or validate subdomain
 	var subdomain string
 	if req.Subdomain != "" {
@@ -105,19 +232,50 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		}
 		if existingDomain != nil {
 			if existingDomain.ClientID != clientID {
-				return errorResponse(409, "Subdomain is already taken")
+				return problem.ErrorResponse(409, problem.CodeSubdomainTaken, "Subdomain is already taken")
 			}
 			// Same client — reuse the existing tunnel
-			return reuseExistingTunnel(ctx, existingDomain.TunnelID)
+			return reuseExistingTunnel(ctx, existingDomain.TunnelID, req, passwordHash)
+		}
+		// A recently deleted tunnel's subdomain stays with its previous owner
+		released, err := getReleasedDomain(ctx, subdomain)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to check subdomain availability: %v", err))
+		}
+		if released != nil && released.ClientID != clientID {
+			message := fmt.Sprintf("Subdomain was recently released and is reserved for its previous owner until %s", released.ReleasedUntil.UTC().Format(time.RFC3339))
+			return problem.ErrorResponse(409, problem.CodeSubdomainTaken, message)
+		}
+		// New subdomains stay in the client's namespace
+		if !auth.InSubdomainNamespace(subdomain, client.SubdomainPrefix) {
+			return errorResponse(400, fmt.Sprintf("Subdomain must start with %s-", client.SubdomainPrefix))
+		}
+		// Choosing a new subdomain is a paid feature; tunnels created before
+		// the client's plan lapsed keep theirs (the reuse above)
+		if billingEnabled && !client.HasFeature(models.FeatureCustomSubdomain) {
+			message := fmt.Sprintf("Custom subdomains are not part of the %s plan; run 'tunnel billing' to upgrade, or omit the subdomain", planName(client.Plan))
+			return problem.ErrorResponse(402, problem.CodePlanUpgradeRequired, message)
 		}
 	} else {
 		// Generate random subdomain
-		subdomain, err = generateUniqueSubdomain(ctx)
+		subdomain, err = generateUniqueSubdomain(ctx, client.SubdomainPrefix)
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to generate subdomain: %v", err))
 		}
 	}
 
+	// Enforce the client's tunnel quota; reusing a tunnel above is always allowed
+	if quota := client.TunnelLimit(maxTunnelsPerClient); quota > 0 {
+		owned, err := tunnelRepo.ListByClient(ctx, clientID)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to check tunnel quota: %v", err))
+		}
+		if len(owned) >= quota {
+			message := fmt.Sprintf("Tunnel quota reached: %d of %d tunnels in use under the %s plan; delete one first", len(owned), quota, planName(client.Plan))
+			return problem.Response(problem.New(409, problem.CodeTunnelQuotaExceeded, message).WithUsage(len(owned), quota))
+		}
+	}
+
 	// Generate tunnel ID
 	tunnelID, err := auth.GenerateTunnelID()
 	if err != nil {
@@ -129,13 +287,30 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 
 	// Create tunnel record
 	tunnel := models.Tunnel{
-		TunnelID:  tunnelID,
-		ClientID:  clientID,
-		Domain:    fullDomain,
-		Subdomain: subdomain,
-		Status:    models.TunnelStatusInactive, // Will be active when WebSocket connects
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		TunnelID:         tunnelID,
+		ClientID:         clientID,
+		Domain:           fullDomain,
+		Subdomain:        subdomain,
+		Status:           models.TunnelStatusInactive, // Will be active when WebSocket connects
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+		ConnectionPolicy: req.ConnectionPolicy,
+		Region:           homeRegion(req.Region),
+		BlockBots:        req.BlockBots != nil && *req.BlockBots,
+		RobotsTxt:        req.RobotsTxt != nil && *req.RobotsTxt,
+		AllowedCountries: req.AllowedCountries,
+		AllowedMethods:   req.AllowedMethods,
+		PasswordHash:     passwordHash,
+		Visibility:       req.Visibility,
+		StrippedHeaders:  req.StrippedHeaders,
+		RequiredHeaders:  req.RequiredHeaders,
+
+		ResponseHeaders:         req.ResponseHeaders,
+		StrippedResponseHeaders: req.StrippedResponseHeaders,
+		LowLatency:              req.LowLatency != nil && *req.LowLatency,
+	}
+	if req.MaxConcurrentRequests != nil {
+		tunnel.MaxConcurrentRequests = *req.MaxConcurrentRequests
 	}
 
 	// Create domain record
@@ -146,101 +321,471 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		CreatedAt: time.Now(),
 	}
 
-	// Save to DynamoDB
-	if err := dbClient.PutItem(ctx, tunnelsTable, tunnel); err != nil {
+	// Save both records atomically; this also catches another client claiming
+	// the subdomain since the availability check
+	if err := tunnelRepo.Create(ctx, tunnel, domain); err != nil {
+		if errors.Is(err, repository.ErrDomainTaken) {
+			return problem.ErrorResponse(409, problem.CodeSubdomainTaken, "Subdomain is already taken")
+		}
 		return errorResponse(500, fmt.Sprintf("Failed to save tunnel: %v", err))
 	}
 
-	if err := dbClient.PutItem(ctx, domainsTable, domain); err != nil {
-		// Rollback tunnel creation
-		_ = deleteTunnel(ctx, tunnelID)
-		return errorResponse(500, fmt.Sprintf("Failed to save domain: %v", err))
+	// Record creation in the tunnel's event history
+	if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+		TunnelID:  tunnelID,
+		Type:      models.TunnelEventCreated,
+		ClientID:  clientID,
+		SourceIP:  request.RequestContext.HTTP.SourceIP,
+		UserAgent: request.RequestContext.HTTP.UserAgent,
+		Actor:     clientID,
+	}); err != nil {
+		log.Printf("create-tunnel: %v", err)
 	}
 
-	// Build WebSocket URL
-	wsURL := fmt.Sprintf("%s/%s?tunnel_id=%s", websocketAPIURL, websocketAPIStage, tunnelID)
-
 	// Return response
-	response := CreateTunnelResponse{
-		TunnelID:     tunnelID,
-		Domain:       fullDomain,
-		Subdomain:    subdomain,
-		WebsocketURL: wsURL,
-		Status:       tunnel.Status,
-		Message:      "Tunnel created successfully. Connect via WebSocket to activate.",
+	response := api.CreateTunnelResponse{
+		TunnelID:         tunnelID,
+		Domain:           fullDomain,
+		Subdomain:        subdomain,
+		WebsocketURL:     websocketURL(tunnel.Region, tunnelID),
+		Status:           tunnel.Status,
+		Message:          "Tunnel created successfully. Connect via WebSocket to activate.",
+		ConnectionPolicy: tunnel.Policy(),
+		Region:           tunnel.Region,
+		Regions:          deploymentRegions,
+		BlockBots:        tunnel.BlockBots,
+		RobotsTxt:        tunnel.RobotsTxt,
+		AllowedCountries: tunnel.AllowedCountries,
+		AllowedMethods:   tunnel.AllowedMethods,
+
+		PasswordProtected: tunnel.PasswordHash != "",
+		Visibility:        tunnel.Visibility,
+
+		StrippedHeaders: tunnel.StrippedHeaders,
+		RequiredHeaders: tunnel.RequiredHeaders,
+
+		ResponseHeaders:         tunnel.ResponseHeaders,
+		StrippedResponseHeaders: tunnel.StrippedResponseHeaders,
+
+		LowLatency:            tunnel.LowLatency,
+		MaxConcurrentRequests: tunnel.MaxConcurrentRequests,
 	}
 
 	return successResponse(201, response)
 }
 
-func verifyClientAPIKey(ctx context.Context, apiKey string) (string, error) {
-	// This is a simplified implementation. In production, you might want to cache this
-	// or use a more efficient lookup method.
-	// For now, we'll scan all clients (not recommended for production)
-	var clients []models.Client
-	if err := dbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(clientsTable),
-	}, &clients); err != nil {
-		return "", err
-	}
+func getExistingDomain(ctx context.Context, subdomain string) (*models.Domain, error) {
+	fullDomain := fmt.Sprintf("%s.%s", subdomain, domainName)
 
-	for _, client := range clients {
-		if auth.VerifyAPIKey(apiKey, client.APIKeyHash) && client.Status == models.ClientStatusActive {
-			return client.ClientID, nil
-		}
+	domain, err := domainRepo.Get(ctx, fullDomain)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
 	}
-
-	return "", fmt.Errorf("client not found or inactive")
+	return domain, err
 }
 
-func getExistingDomain(ctx context.Context, subdomain string) (*models.Domain, error) {
+// getReleasedDomain returns the reservation of a deleted tunnel's subdomain,
+// nil when it has none or released domains aren't tracked
+func getReleasedDomain(ctx context.Context, subdomain string) (*models.ReleasedDomain, error) {
+	if releasedRepo == nil {
+		return nil, nil
+	}
 	fullDomain := fmt.Sprintf("%s.%s", subdomain, domainName)
 
+	released, err := releasedRepo.Get(ctx, fullDomain)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	return released, err
+}
+
+func reuseExistingTunnel(ctx context.Context, tunnelID string, req api.CreateTunnelRequest, passwordHash string) (events.APIGatewayV2HTTPResponse, error) {
 	key := map[string]types.AttributeValue{
-		"domain": &types.AttributeValueMemberS{Value: fullDomain},
+		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
 	}
 
-	var domain models.Domain
-	err := dbClient.GetItem(ctx, domainsTable, key, &domain)
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			return nil, nil
+		return errorResponse(500, "Failed to get existing tunnel")
+	}
+
+	// Apply a newly requested connection policy to the reused tunnel
+	if req.ConnectionPolicy != "" && req.ConnectionPolicy != tunnel.ConnectionPolicy {
+		err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(tunnelsTable),
+			Key:              key,
+			UpdateExpression: aws.String("SET connection_policy = :policy"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":policy": &types.AttributeValueMemberS{Value: req.ConnectionPolicy},
+			},
+		})
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update connection policy: %v", err))
 		}
-		return nil, err
+		tunnel.ConnectionPolicy = req.ConnectionPolicy
 	}
 
-	return &domain, nil
-}
+	// Apply newly requested bot filtering settings
+	if changed := botSettingsUpdate(req, tunnel); changed != nil {
+		err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(tunnelsTable),
+			Key:                       key,
+			UpdateExpression:          aws.String("SET " + strings.Join(changed.sets, ", ")),
+			ExpressionAttributeValues: changed.values,
+		})
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update bot filtering: %v", err))
+		}
+		if req.BlockBots != nil {
+			tunnel.BlockBots = *req.BlockBots
+		}
+		if req.RobotsTxt != nil {
+			tunnel.RobotsTxt = *req.RobotsTxt
+		}
+	}
 
-func reuseExistingTunnel(ctx context.Context, tunnelID string) (events.APIGatewayV2HTTPResponse, error) {
-	key := map[string]types.AttributeValue{
-		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+	// Apply a newly requested country or method restriction
+	if req.AllowedCountries != nil && !slices.Equal(req.AllowedCountries, sortedCopy(tunnel.AllowedCountries)) {
+		if err := setStringSet(ctx, key, "allowed_countries", req.AllowedCountries); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update allowed countries: %v", err))
+		}
+		tunnel.AllowedCountries = req.AllowedCountries
+	}
+	if req.AllowedMethods != nil && !slices.Equal(req.AllowedMethods, sortedCopy(tunnel.AllowedMethods)) {
+		if err := setStringSet(ctx, key, "allowed_methods", req.AllowedMethods); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update allowed methods: %v", err))
+		}
+		tunnel.AllowedMethods = req.AllowedMethods
 	}
 
-	var tunnel models.Tunnel
-	if err := dbClient.GetItem(ctx, tunnelsTable, key, &tunnel); err != nil {
-		return errorResponse(500, "Failed to get existing tunnel")
+	// Set, replace or remove the password
+	if req.Password != nil && (passwordHash != "" || tunnel.PasswordHash != "") {
+		input := &dynamodb.UpdateItemInput{
+			TableName:        aws.String(tunnelsTable),
+			Key:              key,
+			UpdateExpression: aws.String("REMOVE password_hash"),
+		}
+		if passwordHash != "" {
+			input.UpdateExpression = aws.String("SET password_hash = :hash")
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":hash": &types.AttributeValueMemberS{Value: passwordHash},
+			}
+		}
+		if err := dbClient.UpdateItem(ctx, input); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update password: %v", err))
+		}
+		tunnel.PasswordHash = passwordHash
+	}
+
+	// Make the tunnel private or public; access tokens issued before survive
+	if req.Visibility != "" && req.Visibility != tunnel.Visibility {
+		err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(tunnelsTable),
+			Key:              key,
+			UpdateExpression: aws.String("SET visibility = :visibility"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":visibility": &types.AttributeValueMemberS{Value: req.Visibility},
+			},
+		})
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update visibility: %v", err))
+		}
+		tunnel.Visibility = req.Visibility
+	}
+
+	// Apply new header rules
+	if req.StrippedHeaders != nil && !slices.Equal(req.StrippedHeaders, sortedCopy(tunnel.StrippedHeaders)) {
+		if err := setStringSet(ctx, key, "stripped_headers", req.StrippedHeaders); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update stripped headers: %v", err))
+		}
+		tunnel.StrippedHeaders = req.StrippedHeaders
+	}
+	if req.RequiredHeaders != nil && !slices.Equal(req.RequiredHeaders, sortedCopy(tunnel.RequiredHeaders)) {
+		if err := setStringSet(ctx, key, "required_headers", req.RequiredHeaders); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update required headers: %v", err))
+		}
+		tunnel.RequiredHeaders = req.RequiredHeaders
+	}
+	if req.ResponseHeaders != nil && !slices.Equal(req.ResponseHeaders, sortedCopy(tunnel.ResponseHeaders)) {
+		if err := setStringSet(ctx, key, "response_headers", req.ResponseHeaders); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update response headers: %v", err))
+		}
+		tunnel.ResponseHeaders = req.ResponseHeaders
+	}
+	if req.StrippedResponseHeaders != nil && !slices.Equal(req.StrippedResponseHeaders, sortedCopy(tunnel.StrippedResponseHeaders)) {
+		if err := setStringSet(ctx, key, "stripped_response_headers", req.StrippedResponseHeaders); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update stripped response headers: %v", err))
+		}
+		tunnel.StrippedResponseHeaders = req.StrippedResponseHeaders
+	}
+
+	// Mark or unmark the tunnel as latency-sensitive
+	if req.LowLatency != nil && *req.LowLatency != tunnel.LowLatency {
+		err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(tunnelsTable),
+			Key:              key,
+			UpdateExpression: aws.String("SET low_latency = :low_latency"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":low_latency": &types.AttributeValueMemberBOOL{Value: *req.LowLatency},
+			},
+		})
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update low latency: %v", err))
+		}
+		tunnel.LowLatency = *req.LowLatency
+	}
+
+	// Set or remove the cap on requests awaiting a response
+	if req.MaxConcurrentRequests != nil && *req.MaxConcurrentRequests != tunnel.MaxConcurrentRequests {
+		update := &dynamodb.UpdateItemInput{
+			TableName:        aws.String(tunnelsTable),
+			Key:              key,
+			UpdateExpression: aws.String("REMOVE max_concurrent_requests"),
+		}
+		if *req.MaxConcurrentRequests > 0 {
+			update.UpdateExpression = aws.String("SET max_concurrent_requests = :max")
+			update.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":max": &types.AttributeValueMemberN{Value: strconv.FormatInt(*req.MaxConcurrentRequests, 10)},
+			}
+		}
+		if err := dbClient.UpdateItem(ctx, update); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to update max concurrent requests: %v", err))
+		}
+		tunnel.MaxConcurrentRequests = *req.MaxConcurrentRequests
 	}
 
-	wsURL := fmt.Sprintf("%s/%s?tunnel_id=%s", websocketAPIURL, websocketAPIStage, tunnelID)
+	// Move the tunnel to the requested home region. A connected tunnel stays
+	// where it is; its CLI is told the current region instead.
+	if req.Region != "" && req.Region != tunnel.Region && tunnel.Status != models.TunnelStatusActive {
+		err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(tunnelsTable),
+			Key:                 key,
+			UpdateExpression:    aws.String("SET #region = :region"),
+			ConditionExpression: aws.String("#status <> :active"),
+			ExpressionAttributeNames: map[string]string{
+				"#region": "region",
+				"#status": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":region": &types.AttributeValueMemberS{Value: req.Region},
+				":active": &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+			},
+		})
+		if err == nil {
+			tunnel.Region = req.Region
+		} else {
+			log.Printf("create-tunnel: tunnel %s stays in %s: %v", tunnelID, tunnel.Region, err)
+		}
+	}
 
-	response := CreateTunnelResponse{
-		TunnelID:     tunnel.TunnelID,
-		Domain:       tunnel.Domain,
-		Subdomain:    tunnel.Subdomain,
-		WebsocketURL: wsURL,
-		Status:       tunnel.Status,
-		Message:      "Reusing existing tunnel.",
-		Reused:       true,
+	response := api.CreateTunnelResponse{
+		TunnelID:         tunnel.TunnelID,
+		Domain:           tunnel.Domain,
+		Subdomain:        tunnel.Subdomain,
+		WebsocketURL:     websocketURL(tunnel.Region, tunnelID),
+		Status:           tunnel.Status,
+		Message:          "Reusing existing tunnel.",
+		Reused:           true,
+		ConnectionPolicy: tunnel.Policy(),
+		Region:           tunnel.Region,
+		Regions:          deploymentRegions,
+		BlockBots:        tunnel.BlockBots,
+		RobotsTxt:        tunnel.RobotsTxt,
+		AllowedCountries: tunnel.AllowedCountries,
+		AllowedMethods:   tunnel.AllowedMethods,
+
+		PasswordProtected: tunnel.PasswordHash != "",
+		Visibility:        tunnel.Visibility,
+
+		StrippedHeaders: tunnel.StrippedHeaders,
+		RequiredHeaders: tunnel.RequiredHeaders,
+
+		ResponseHeaders:         tunnel.ResponseHeaders,
+		StrippedResponseHeaders: tunnel.StrippedResponseHeaders,
+
+		LowLatency:            tunnel.LowLatency,
+		MaxConcurrentRequests: tunnel.MaxConcurrentRequests,
 	}
 
 	return successResponse(200, response)
 }
 
-func generateUniqueSubdomain(ctx context.Context) (string, error) {
+// botSettings is the update applying a request's bot filtering settings
+type botSettings struct {
+	sets   []string
+	values map[string]types.AttributeValue
+}
+
+// botSettingsUpdate returns the update for the bot filtering settings req
+// changes on tunnel, or nil if it changes none
+func botSettingsUpdate(req api.CreateTunnelRequest, tunnel *models.Tunnel) *botSettings {
+	update := &botSettings{values: map[string]types.AttributeValue{}}
+	if req.BlockBots != nil && *req.BlockBots != tunnel.BlockBots {
+		update.sets = append(update.sets, "block_bots = :block_bots")
+		update.values[":block_bots"] = &types.AttributeValueMemberBOOL{Value: *req.BlockBots}
+	}
+	if req.RobotsTxt != nil && *req.RobotsTxt != tunnel.RobotsTxt {
+		update.sets = append(update.sets, "robots_txt = :robots_txt")
+		update.values[":robots_txt"] = &types.AttributeValueMemberBOOL{Value: *req.RobotsTxt}
+	}
+	if len(update.sets) == 0 {
+		return nil
+	}
+	return update
+}
+
+// normalizeCountries uppercases, validates, sorts and dedupes country codes
+func normalizeCountries(countries []string) ([]string, error) {
+	normalized := make([]string, 0, len(countries))
+	for _, c := range countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if !models.ValidCountryCode(c) {
+			return nil, fmt.Errorf("Invalid country code %q: use ISO 3166-1 alpha-2 codes such as US or DE", c)
+		}
+		normalized = append(normalized, c)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// normalizeMethods uppercases, validates, sorts and dedupes HTTP methods
+func normalizeMethods(methods []string) ([]string, error) {
+	normalized := make([]string, 0, len(methods))
+	for _, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if !models.ValidHTTPMethod(m) {
+			return nil, fmt.Errorf("Invalid HTTP method %q: use %s", m, strings.Join(models.HTTPMethods, ", "))
+		}
+		normalized = append(normalized, m)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// normalizeHeaderNames lowercases, validates, sorts and dedupes header names
+func normalizeHeaderNames(names []string) ([]string, error) {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !models.ValidHeaderName(name) {
+			return nil, fmt.Errorf("Invalid header name %q", name)
+		}
+		normalized = append(normalized, name)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// normalizeRequiredHeaders turns "Name" and "Name: value" rules into the
+// lowercase "name" and "name: value" form http-proxy matches, sorted and
+// deduped
+func normalizeRequiredHeaders(rules []string) ([]string, error) {
+	normalized := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		name, value, hasValue := strings.Cut(rule, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !models.ValidHeaderName(name) {
+			return nil, fmt.Errorf("Invalid header name %q", name)
+		}
+		if value = strings.TrimSpace(value); hasValue && value != "" {
+			name += ": " + value
+		}
+		normalized = append(normalized, name)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// framingHeaders delimit a response's body; a tunnel's response header policy
+// may not touch them
+var framingHeaders = []string{"content-length", "transfer-encoding", "content-encoding", "connection"}
+
+// normalizeResponseHeaders turns "Name: value" rules into the lowercase
+// "name: value" form http-proxy sets, sorted and with one rule per name
+func normalizeResponseHeaders(rules []string) ([]string, error) {
+	normalized := make([]string, 0, len(rules))
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		name, value, _ := strings.Cut(rule, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !models.ValidHeaderName(name) {
+			return nil, fmt.Errorf("Invalid header name %q", name)
+		}
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("Response header %s needs a single-line value, as \"Name: value\"", name)
+		}
+		if slices.Contains(framingHeaders, name) {
+			return nil, fmt.Errorf("Header %s cannot be set on responses", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Response header %s is set more than once", name)
+		}
+		seen[name] = true
+		normalized = append(normalized, name+": "+value)
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// setStringSet replaces a string set attribute of a tunnel, removing it when
+// values is empty since DynamoDB has no empty sets
+func setStringSet(ctx context.Context, key map[string]types.AttributeValue, attr string, values []string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(tunnelsTable),
+		Key:                      key,
+		UpdateExpression:         aws.String("REMOVE #attr"),
+		ExpressionAttributeNames: map[string]string{"#attr": attr},
+	}
+	if len(values) > 0 {
+		input.UpdateExpression = aws.String("SET #attr = :values")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":values": &types.AttributeValueMemberSS{Value: values},
+		}
+	}
+	return dbClient.UpdateItem(ctx, input)
+}
+
+// sortedCopy returns a sorted copy of a string set read from DynamoDB, whose
+// order is not preserved
+func sortedCopy(set []string) []string {
+	sorted := slices.Clone(set)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// planName names a plan in error messages
+func planName(plan string) string {
+	if plan == "" {
+		return "current"
+	}
+	return plan
+}
+
+// homeRegion picks the region a new tunnel is pinned to: the requested one, or
+// the region that served the request
+func homeRegion(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return regions.Current()
+}
+
+// websocketURL returns the URL the CLI connects to for a tunnel homed in region.
+// Tunnels from before regions were tracked use this region's WebSocket API.
+func websocketURL(region, tunnelID string) string {
+	if r, ok := regions.Find(deploymentRegions, region); ok && r.WebsocketURL != "" {
+		return fmt.Sprintf("%s?tunnel_id=%s", r.WebsocketURL, tunnelID)
+	}
+	return fmt.Sprintf("%s/%s?tunnel_id=%s", websocketAPIURL, websocketAPIStage, tunnelID)
+}
+
+// generateUniqueSubdomain picks an unused random subdomain in subdomainFormat,
+// under the client's prefix if it has one
+func generateUniqueSubdomain(ctx context.Context, prefix string) (string, error) {
 	maxAttempts := 10
 	for i := 0; i < maxAttempts; i++ {
-		subdomain, err := auth.GenerateRandomSubdomain()
+		subdomain, err := auth.GenerateRandomSubdomain(subdomainFormat, prefix)
 		if err != nil {
 			return "", err
 		}
@@ -250,7 +795,16 @@ func generateUniqueSubdomain(ctx context.Context) (string, error) {
 			return "", err
 		}
 
-		if existing == nil {
+		if existing != nil {
+			continue
+		}
+
+		// Never hand out a reserved subdomain, not even to its owner
+		released, err := getReleasedDomain(ctx, subdomain)
+		if err != nil {
+			return "", err
+		}
+		if released == nil {
 			return subdomain, nil
 		}
 	}
@@ -258,14 +812,6 @@ func generateUniqueSubdomain(ctx context.Context) (string, error) {
 	return "", fmt.Errorf("failed to generate unique subdomain after %d attempts", maxAttempts)
 }
 
-func deleteTunnel(ctx context.Context, tunnelID string) error {
-	key := map[string]types.AttributeValue{
-		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
-	}
-
-	return dbClient.DeleteItem(ctx, tunnelsTable, key)
-}
-
 func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
 	body, err := json.Marshal(data)
 	if err != nil {
@@ -282,19 +828,9 @@ func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPR
 }
 
 func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
-	body, _ := json.Marshal(map[string]string{
-		"error": message,
-	})
-
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}, nil
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(apiversion.Wrap(handler))
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
+	"github.com/lmanrique/tunnel/lambdas/shared/connections"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable         string
+	tunnelsTable         string
+	domainsTable         string
+	releasedTable        string
+	pendingRequestsTable string
+	eventsTable          string
+	websocketEndpoint    string
+	dbClient             *db.DynamoDBClient
+	clientRepo           repository.ClientRepository
+	tunnelRepo           repository.TunnelRepository
+	releasedRepo         repository.ReleasedDomainRepository
+	pendingRepo          repository.PendingRequestRepository
+	apigwClient          *apigatewaymanagementapi.Client
+
+	// quarantine is how long a deleted tunnel's subdomain stays reserved for
+	// its owner, 0 releasing it immediately
+	quarantine time.Duration
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	domainsTable = os.Getenv("DOMAINS_TABLE")
+	releasedTable = os.Getenv("RELEASED_DOMAINS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+
+	if clientsTable == "" || tunnelsTable == "" || domainsTable == "" || pendingRequestsTable == "" || websocketEndpoint == "" {
+		panic("Required environment variables are missing")
+	}
+
+	if v := os.Getenv("SUBDOMAIN_QUARANTINE_HOURS"); v != "" && releasedTable != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours < 0 {
+			panic("SUBDOMAIN_QUARANTINE_HOURS must be a non-negative integer")
+		}
+		quarantine = time.Duration(hours) * time.Hour
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
+		releasedRepo = repository.NewReleasedDomainRepository(dbClient, releasedTable)
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to get AWS config: %v", err))
+		}
+		apigwClient = awsclients.Management(cfg, websocketEndpoint)
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+
+	// Deleting an account cannot be undone, so the caller confirms which
+	// one it means
+	if request.QueryStringParameters["confirm"] != clientID {
+		return errorResponse(400, "Confirm the deregistration with ?confirm=<client_id>")
+	}
+
+	tunnels, err := tunnelRepo.ListByClient(ctx, clientID)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to query tunnels: %v", err))
+	}
+
+	// Delete the tunnels first: if one fails the client still exists and the
+	// call can be retried
+	for i := range tunnels {
+		tunnel := &tunnels[i]
+		if err := repository.ReleaseTunnelDomain(ctx, releasedRepo, tunnel, quarantine); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to delete tunnel %s: %v", tunnel.TunnelID, err))
+		}
+		if err := tunnelRepo.Delete(ctx, tunnel); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to delete tunnel %s: %v", tunnel.TunnelID, err))
+		}
+
+		for _, connectionID := range tunnel.Connections() {
+			if err := connections.Terminate(ctx, apigwClient, connectionID, tunnel.TunnelID); err != nil {
+				log.Printf("delete-client: %v", err)
+			}
+		}
+		if err := pendingRepo.ExpireByTunnel(ctx, tunnel.TunnelID, "Tunnel was deleted"); err != nil {
+			log.Printf("delete-client: %v", err)
+		}
+		if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+			TunnelID:     tunnel.TunnelID,
+			Type:         models.TunnelEventDeleted,
+			ClientID:     clientID,
+			ConnectionID: tunnel.ConnectionID,
+			SourceIP:     request.RequestContext.HTTP.SourceIP,
+			UserAgent:    request.RequestContext.HTTP.UserAgent,
+			Actor:        clientID,
+		}); err != nil {
+			log.Printf("delete-client: %v", err)
+		}
+	}
+
+	if err := clientRepo.Delete(ctx, clientID); err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to delete client: %v", err))
+	}
+	log.Printf("delete-client: deregistered client %s and %d tunnels", clientID, len(tunnels))
+
+	return successResponse(200, api.DeleteClientResponse{
+		Message:        "Client deregistered successfully",
+		TunnelsDeleted: len(tunnels),
+	})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
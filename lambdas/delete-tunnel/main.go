@@ -4,37 +4,66 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
 	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
+	"github.com/lmanrique/tunnel/lambdas/shared/connections"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
-	clientsTable string
-	tunnelsTable string
-	domainsTable string
-	dbClient     *db.DynamoDBClient
+	clientsTable         string
+	tunnelsTable         string
+	domainsTable         string
+	releasedTable        string
+	pendingRequestsTable string
+	eventsTable          string
+	websocketEndpoint    string
+	dbClient             *db.DynamoDBClient
+	clientRepo           repository.ClientRepository
+	tunnelRepo           repository.TunnelRepository
+	releasedRepo         repository.ReleasedDomainRepository
+	pendingRepo          repository.PendingRequestRepository
+	apigwClient          *apigatewaymanagementapi.Client
+
+	// quarantine is how long a deleted tunnel's subdomain stays reserved for
+	// its owner, 0 releasing it immediately
+	quarantine time.Duration
 )
 
 func init() {
 	clientsTable = os.Getenv("CLIENTS_TABLE")
 	tunnelsTable = os.Getenv("TUNNELS_TABLE")
 	domainsTable = os.Getenv("DOMAINS_TABLE")
+	releasedTable = os.Getenv("RELEASED_DOMAINS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
 
-	if clientsTable == "" || tunnelsTable == "" || domainsTable == "" {
+	if clientsTable == "" || tunnelsTable == "" || domainsTable == "" || pendingRequestsTable == "" || websocketEndpoint == "" {
 		panic("Required environment variables are missing")
 	}
-}
 
-type DeleteTunnelResponse struct {
-	Message string `json:"message"`
+	if v := os.Getenv("SUBDOMAIN_QUARANTINE_HOURS"); v != "" && releasedTable != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours < 0 {
+			panic("SUBDOMAIN_QUARANTINE_HOURS must be a non-negative integer")
+		}
+		quarantine = time.Duration(hours) * time.Hour
+	}
 }
 
 func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
@@ -45,6 +74,16 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
 		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
+		releasedRepo = repository.NewReleasedDomainRepository(dbClient, releasedTable)
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to get AWS config: %v", err))
+		}
+		apigwClient = awsclients.Management(cfg, websocketEndpoint)
 	}
 
 	// Extract and verify API key
@@ -55,13 +94,17 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 
 	apiKey, err := auth.ExtractBearerToken(authHeader)
 	if err != nil {
-		return errorResponse(401, "Invalid authorization header")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
 	}
 
 	// Verify client exists and get client ID
-	clientID, err := verifyClientAPIKey(ctx, apiKey)
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
 	if err != nil {
-		return errorResponse(401, "Invalid API key")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("delete-tunnel: %v", err)
 	}
 
 	// Get tunnel ID from path parameters
@@ -71,14 +114,9 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 	}
 
 	// Get tunnel from database
-	key := map[string]types.AttributeValue{
-		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
-	}
-
-	var tunnel models.Tunnel
-	err = dbClient.GetItem(ctx, tunnelsTable, key, &tunnel)
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
 	if err != nil {
-		return errorResponse(404, "Tunnel not found")
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
 	}
 
 	// Verify tunnel belongs to client
@@ -86,45 +124,47 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		return errorResponse(403, "Unauthorized to delete this tunnel")
 	}
 
-	// Delete domain record
-	domainKey := map[string]types.AttributeValue{
-		"domain": &types.AttributeValueMemberS{Value: tunnel.Domain},
-	}
-
-	err = dbClient.DeleteItem(ctx, domainsTable, domainKey)
-	if err != nil {
-		return errorResponse(500, fmt.Sprintf("Failed to delete domain: %v", err))
+	if err := repository.ReleaseTunnelDomain(ctx, releasedRepo, tunnel, quarantine); err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to delete tunnel: %v", err))
 	}
 
-	// Delete tunnel record
-	err = dbClient.DeleteItem(ctx, tunnelsTable, key)
-	if err != nil {
+	// Delete the domain and tunnel records together so neither is left dangling
+	if err := tunnelRepo.Delete(ctx, tunnel); err != nil {
 		return errorResponse(500, fmt.Sprintf("Failed to delete tunnel: %v", err))
 	}
 
-	// Return success response
-	response := DeleteTunnelResponse{
-		Message: "Tunnel deleted successfully",
+	// Tell every connected CLI the tunnel is gone and drop its WebSocket connection.
+	// The tunnel record is already deleted, so $disconnect finds nothing to update.
+	for _, connectionID := range tunnel.Connections() {
+		if err := connections.Terminate(ctx, apigwClient, connectionID, tunnelID); err != nil {
+			log.Printf("delete-tunnel: %v", err)
+		}
 	}
 
-	return successResponse(200, response)
-}
+	// Fail in-flight requests now instead of letting callers wait for the poll timeout
+	if err := pendingRepo.ExpireByTunnel(ctx, tunnelID, "Tunnel was deleted"); err != nil {
+		log.Printf("delete-tunnel: %v", err)
+	}
 
-func verifyClientAPIKey(ctx context.Context, apiKey string) (string, error) {
-	var clients []models.Client
-	if err := dbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(clientsTable),
-	}, &clients); err != nil {
-		return "", err
+	// Record who deleted the tunnel; the history outlives the tunnel record until TTL
+	if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+		TunnelID:     tunnelID,
+		Type:         models.TunnelEventDeleted,
+		ClientID:     tunnel.ClientID,
+		ConnectionID: tunnel.ConnectionID,
+		SourceIP:     request.RequestContext.HTTP.SourceIP,
+		UserAgent:    request.RequestContext.HTTP.UserAgent,
+		Actor:        clientID,
+	}); err != nil {
+		log.Printf("delete-tunnel: %v", err)
 	}
 
-	for _, client := range clients {
-		if auth.VerifyAPIKey(apiKey, client.APIKeyHash) && client.Status == models.ClientStatusActive {
-			return client.ClientID, nil
-		}
+	// Return success response
+	response := api.DeleteTunnelResponse{
+		Message: "Tunnel deleted successfully",
 	}
 
-	return "", fmt.Errorf("client not found or inactive")
+	return successResponse(200, response)
 }
 
 func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
@@ -143,19 +183,9 @@ func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPR
 }
 
 func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
-	body, _ := json.Marshal(map[string]string{
-		"error": message,
-	})
-
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}, nil
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(apiversion.Wrap(handler))
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/env"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+// keyHintLength is how much of the API key is echoed back, enough to tell
+// keys apart without making the response a credential
+const keyHintLength = len(auth.APIKeyPrefix) + 4
+
+var (
+	clientsTable string
+	tunnelsTable string
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+	tunnelRepo   repository.TunnelRepository
+
+	// The deployment's per-client ceilings, 0 meaning none
+	maxTunnelsPerClient     int
+	maxConnectionsPerClient int
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" {
+		panic("Required environment variables are missing")
+	}
+	maxTunnelsPerClient = env.Count("MAX_TUNNELS_PER_CLIENT", 0)
+	maxConnectionsPerClient = env.Count("MAX_CONNECTIONS_PER_CLIENT", 0)
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	if err := clientRepo.RecordUse(ctx, client.ClientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("get-client: %v", err)
+	}
+
+	tunnels, err := tunnelRepo.ListByClient(ctx, client.ClientID)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to query tunnels: %v", err))
+	}
+	active, connections := 0, 0
+	for _, tunnel := range tunnels {
+		if tunnel.Status == models.TunnelStatusActive {
+			active++
+			connections += len(tunnel.Connections())
+		}
+	}
+
+	hint := apiKey
+	if len(hint) > keyHintLength {
+		hint = hint[:keyHintLength] + "…"
+	}
+
+	return successResponse(200, api.GetClientResponse{
+		ClientID:  client.ClientID,
+		Status:    client.Status,
+		Plan:      client.Plan,
+		CreatedAt: client.CreatedAt,
+
+		TunnelQuota:     client.TunnelLimit(maxTunnelsPerClient),
+		TunnelCount:     len(tunnels),
+		ActiveTunnels:   active,
+		ConnectionLimit: maxConnectionsPerClient,
+		Connections:     connections,
+
+		// A client keeps the key it registered with
+		APIKey: api.APIKeyInfo{
+			Hint:       hint,
+			CreatedAt:  client.CreatedAt,
+			LastUsedAt: client.LastUsedAt,
+			LastUsedIP: client.LastUsedIP,
+		},
+	})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+)
+
+// handler serves the OpenAPI description of the management API, generated
+// from api.Routes and the wire types the Lambdas encode, so SDKs generated from
+// it stay in step with the handlers
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	serverURL := ""
+	if request.RequestContext.DomainName != "" {
+		serverURL = "https://" + request.RequestContext.DomainName
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "public, max-age=300",
+		},
+		Body: string(api.Document(serverURL).JSON()),
+	}, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
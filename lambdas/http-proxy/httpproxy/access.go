@@ -0,0 +1,36 @@
+package httpproxy
+
+import (
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+)
+
+// accessTokenResponse keeps requests without a valid access token off a
+// private tunnel with a 401. A token is valid while it is its consumer's
+// current one, so issuing a new one or revoking the consumer ends it. For
+// valid requests it records the consumer in entry, strips the token from
+// request, which is then forwarded as usual, and returns nil.
+func accessTokenResponse(tunnel *models.Tunnel, request *events.APIGatewayV2HTTPRequest, entry *models.RequestLog) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if !tunnel.Private() {
+		return nil, nil
+	}
+
+	token, _ := headerValue(request.Headers, auth.AccessTokenHeader)
+	for name := range request.Headers {
+		if strings.EqualFold(name, auth.AccessTokenHeader) {
+			delete(request.Headers, name)
+		}
+	}
+
+	claims, err := auth.VerifyAccessToken(tunnel.AccessKey, tunnel.TunnelID, strings.TrimSpace(token))
+	if err != nil || tunnel.AccessConsumers[claims.Consumer] != claims.IssuedAt {
+		return problem.StreamingErrorResponse(401, problem.CodeAccessTokenRequired, "This tunnel is private; send a valid access token in the "+auth.AccessTokenHeader+" header")
+	}
+
+	entry.AccessConsumer = claims.Consumer
+	return nil, nil
+}
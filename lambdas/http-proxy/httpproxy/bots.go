@@ -0,0 +1,107 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// robotsTxtDisallowAll is served for /robots.txt on tunnels with RobotsTxt
+const robotsTxtDisallowAll = "User-agent: *\nDisallow: /\n"
+
+// crawlerAgents are lowercase User-Agent substrings of search engine and AI
+// crawlers, SEO bots and vulnerability scanners
+var crawlerAgents = []string{
+	// Search engines
+	"googlebot", "google-inspectiontool", "bingbot", "slurp", "duckduckbot",
+	"baiduspider", "yandexbot", "applebot", "petalbot", "sogou", "seznambot",
+	// AI crawlers
+	"gptbot", "chatgpt-user", "ccbot", "claudebot", "anthropic-ai",
+	"bytespider", "perplexitybot", "amazonbot", "google-extended",
+	// SEO and archive bots
+	"ahrefsbot", "semrushbot", "mj12bot", "dotbot", "blexbot", "dataforseobot",
+	"ia_archiver", "archive.org_bot",
+	// Scanners
+	"censysinspect", "expanse", "zgrab", "masscan", "nmap", "nuclei", "nikto",
+	"sqlmap", "wpscan", "l9explore", "internetmeasurement",
+	// Generic
+	"crawler", "spider",
+}
+
+// scannerPrefixes are the source ranges from SCANNER_CIDRS, a comma-separated
+// list of CIDRs or addresses of known scanners
+var scannerPrefixes = loadScannerPrefixes()
+
+func loadScannerPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(os.Getenv("SCANNER_CIDRS"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				fmt.Fprintf(os.Stderr, "Ignoring invalid SCANNER_CIDRS entry %q: %v\n", v, err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// isCrawlerAgent reports whether userAgent belongs to a known crawler or scanner
+func isCrawlerAgent(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, agent := range crawlerAgents {
+		if strings.Contains(ua, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// isScannerIP reports whether sourceIP is in one of the SCANNER_CIDRS ranges
+func isScannerIP(sourceIP string) bool {
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range scannerPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// botFilterResponse answers requests a tunnel's bot filtering settings keep
+// from the local service: /robots.txt when RobotsTxt is set, and crawlers and
+// scanners when BlockBots is set. It returns nil for everything else.
+func botFilterResponse(tunnel *models.Tunnel, request events.APIGatewayV2HTTPRequest, proxyPath string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if tunnel.RobotsTxt && strings.SplitN(proxyPath, "?", 2)[0] == "/robots.txt" {
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"Content-Type":  "text/plain; charset=utf-8",
+				"Cache-Control": "public, max-age=3600",
+			},
+			Body: strings.NewReader(robotsTxtDisallowAll),
+		}, nil
+	}
+	if !tunnel.BlockBots {
+		return nil, nil
+	}
+	if isCrawlerAgent(request.RequestContext.HTTP.UserAgent) || isScannerIP(request.RequestContext.HTTP.SourceIP) {
+		return errorResponse(403, "Crawlers are blocked on this tunnel")
+	}
+	return nil, nil
+}
@@ -0,0 +1,316 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/warmup"
+)
+
+// Event formats http-proxy can be invoked with. The handler works on the
+// Function URL (API Gateway HTTP API v2) format; the others are converted to
+// it on the way in and their buffered response format on the way out.
+const (
+	eventFormatV2   = "v2"   // Lambda Function URL or HTTP API payload 2.0
+	eventFormatREST = "rest" // API Gateway REST API (payload 1.0)
+	eventFormatALB  = "alb"  // Application Load Balancer target
+)
+
+// eventProbe holds just enough of an invocation payload to tell its format apart
+type eventProbe struct {
+	HTTPMethod     string `json:"httpMethod"`
+	RequestContext struct {
+		ELB json.RawMessage `json:"elb"`
+	} `json:"requestContext"`
+}
+
+func detectEventFormat(payload json.RawMessage) string {
+	var probe eventProbe
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return eventFormatV2
+	}
+	switch {
+	case len(probe.RequestContext.ELB) > 0:
+		return eventFormatALB
+	case probe.HTTPMethod != "":
+		return eventFormatREST
+	}
+	return eventFormatV2
+}
+
+// Invoke is the Lambda entry point. Function URL invocations get the
+// streaming response as is; REST API and ALB invocations cannot stream, so
+// their response is read in full and returned in their own format. Warm-up
+// pings only create the clients.
+func Invoke(ctx context.Context, payload json.RawMessage) (any, error) {
+	if warmup.Is(payload) {
+		return warmup.Handle(ctx, initClients)
+	}
+	warmup.Observe()
+
+	switch detectEventFormat(payload) {
+	case eventFormatREST:
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid REST API event: %w", err)
+		}
+		resp, err := Handler(ctx, routeByHost(fromRESTRequest(request)))
+		if err != nil {
+			return nil, err
+		}
+		return toRESTResponse(resp)
+
+	case eventFormatALB:
+		var request events.ALBTargetGroupRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid ALB event: %w", err)
+		}
+		resp, err := Handler(ctx, routeByHost(fromALBRequest(request)))
+		if err != nil {
+			return nil, err
+		}
+		return toALBResponse(resp, len(request.MultiValueHeaders) > 0)
+	}
+
+	var request events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, fmt.Errorf("invalid Function URL event: %w", err)
+	}
+	return Handler(ctx, request)
+}
+
+// fromRESTRequest converts a REST API event. API Gateway has already decoded
+// its query string, so it is re-encoded here.
+func fromRESTRequest(request events.APIGatewayProxyRequest) events.APIGatewayV2HTTPRequest {
+	query := url.Values{}
+	for name, values := range request.MultiValueQueryStringParameters {
+		query[name] = values
+	}
+	for name, value := range request.QueryStringParameters {
+		if _, ok := query[name]; !ok {
+			query.Set(name, value)
+		}
+	}
+
+	headers := mergeHeaders(request.Headers, request.MultiValueHeaders)
+	return events.APIGatewayV2HTTPRequest{
+		RawPath:               request.Path,
+		RawQueryString:        query.Encode(),
+		Headers:               headers,
+		QueryStringParameters: request.QueryStringParameters,
+		PathParameters:        request.PathParameters,
+		Body:                  request.Body,
+		IsBase64Encoded:       request.IsBase64Encoded,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RequestID: request.RequestContext.RequestID,
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    request.HTTPMethod,
+				Path:      request.Path,
+				Protocol:  request.RequestContext.Protocol,
+				SourceIP:  request.RequestContext.Identity.SourceIP,
+				UserAgent: request.RequestContext.Identity.UserAgent,
+			},
+		},
+	}
+}
+
+// fromALBRequest converts an ALB event. ALB passes the query string as the
+// caller sent it, still URL-encoded, and the caller's address only in
+// X-Forwarded-For.
+func fromALBRequest(request events.ALBTargetGroupRequest) events.APIGatewayV2HTTPRequest {
+	var query []string
+	if len(request.MultiValueQueryStringParameters) > 0 {
+		for name, values := range request.MultiValueQueryStringParameters {
+			for _, value := range values {
+				query = append(query, name+"="+value)
+			}
+		}
+	} else {
+		for name, value := range request.QueryStringParameters {
+			query = append(query, name+"="+value)
+		}
+	}
+	sort.Strings(query)
+
+	headers := mergeHeaders(request.Headers, request.MultiValueHeaders)
+	sourceIP, _, _ := strings.Cut(headers["x-forwarded-for"], ",")
+	return events.APIGatewayV2HTTPRequest{
+		RawPath:         request.Path,
+		RawQueryString:  strings.Join(query, "&"),
+		Headers:         headers,
+		Body:            request.Body,
+		IsBase64Encoded: request.IsBase64Encoded,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    request.HTTPMethod,
+				Path:      request.Path,
+				SourceIP:  strings.TrimSpace(sourceIP),
+				UserAgent: headers["user-agent"],
+			},
+		},
+	}
+}
+
+// routeByHost does for REST API and ALB requests what the CloudFront viewer
+// function does for the distribution: a request to <subdomain>.DOMAIN_NAME is
+// routed to /t/<subdomain>, and its upload-url and poll requests get the
+// subdomain in X-Tunnel-Subdomain. Requests to any other host, e.g. the
+// load balancer's own name, must use /t/<subdomain> paths.
+func routeByHost(request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPRequest {
+	host := strings.ToLower(request.Headers["host"])
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	subdomain, ok := strings.CutSuffix(host, "."+domainName)
+	if !ok || subdomain == "" || strings.Contains(subdomain, ".") {
+		return request
+	}
+
+	path := request.RawPath
+	if strings.HasPrefix(path, "/upload-url") || strings.HasPrefix(path, "/poll/") {
+		request.Headers["x-tunnel-subdomain"] = subdomain
+		return request
+	}
+	if path == "/" || path == "" {
+		request.RawPath = "/t/" + subdomain
+	} else {
+		request.RawPath = "/t/" + subdomain + path
+	}
+	// Path parameters of the REST API's own route would override the rewritten path
+	request.PathParameters = nil
+	return request
+}
+
+// mergeCookies moves the Cookies of a Function URL request into its Cookie
+// header, next to any cookies the header already had
+func mergeCookies(request *events.APIGatewayV2HTTPRequest) {
+	if len(request.Cookies) == 0 {
+		return
+	}
+	cookies := strings.Join(request.Cookies, "; ")
+	for name, header := range request.Headers {
+		if strings.EqualFold(name, "cookie") {
+			delete(request.Headers, name)
+			cookies = header + "; " + cookies
+		}
+	}
+	if request.Headers == nil {
+		request.Headers = map[string]string{}
+	}
+	request.Headers["cookie"] = cookies
+	request.Cookies = nil
+}
+
+// mergeHeaders folds single- and multi-value headers into the lowercase,
+// comma-joined map of the v2 format
+func mergeHeaders(single map[string]string, multi map[string][]string) map[string]string {
+	headers := make(map[string]string, len(single)+len(multi))
+	for name, value := range single {
+		headers[strings.ToLower(name)] = value
+	}
+	for name, values := range multi {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+// bufferedResponse is a streaming response read in full
+type bufferedResponse struct {
+	statusCode      int
+	headers         map[string]string
+	cookies         []string
+	body            string
+	isBase64Encoded bool
+}
+
+// bufferResponse reads resp's body to the end, which also completes its
+// request log entry. Bodies that are not UTF-8 text are base64-encoded; a REST
+// API only decodes them when its binary media types match the response.
+func bufferResponse(resp *events.LambdaFunctionURLStreamingResponse) (*bufferedResponse, error) {
+	buffered := &bufferedResponse{
+		statusCode: resp.StatusCode,
+		headers:    resp.Headers,
+		cookies:    resp.Cookies,
+	}
+	if resp.Body == nil {
+		return buffered, nil
+	}
+	if closer, ok := resp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if utf8.Valid(body) {
+		buffered.body = string(body)
+	} else {
+		buffered.body = base64.StdEncoding.EncodeToString(body)
+		buffered.isBase64Encoded = true
+	}
+	return buffered, nil
+}
+
+// multiValueHeaders returns the response headers with each cookie as its own
+// Set-Cookie value
+func (b *bufferedResponse) multiValueHeaders() map[string][]string {
+	headers := make(map[string][]string, len(b.headers)+1)
+	for name, value := range b.headers {
+		headers[name] = []string{value}
+	}
+	if len(b.cookies) > 0 {
+		headers["Set-Cookie"] = append(headers["Set-Cookie"], b.cookies...)
+	}
+	return headers
+}
+
+func toRESTResponse(resp *events.LambdaFunctionURLStreamingResponse) (events.APIGatewayProxyResponse, error) {
+	buffered, err := bufferResponse(resp)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode:        buffered.statusCode,
+		MultiValueHeaders: buffered.multiValueHeaders(),
+		Body:              buffered.body,
+		IsBase64Encoded:   buffered.isBase64Encoded,
+	}, nil
+}
+
+// toALBResponse converts resp for an ALB, which requires multi-value headers
+// exactly when they are enabled on the target group, i.e. when the request
+// had them
+func toALBResponse(resp *events.LambdaFunctionURLStreamingResponse, multiValue bool) (events.ALBTargetGroupResponse, error) {
+	buffered, err := bufferResponse(resp)
+	if err != nil {
+		return events.ALBTargetGroupResponse{}, err
+	}
+	albResp := events.ALBTargetGroupResponse{
+		StatusCode:        buffered.statusCode,
+		StatusDescription: fmt.Sprintf("%d %s", buffered.statusCode, http.StatusText(buffered.statusCode)),
+		Body:              buffered.body,
+		IsBase64Encoded:   buffered.isBase64Encoded,
+	}
+	if multiValue {
+		albResp.MultiValueHeaders = buffered.multiValueHeaders()
+		return albResp, nil
+	}
+	albResp.Headers = make(map[string]string, len(buffered.headers)+1)
+	for name, value := range buffered.headers {
+		albResp.Headers[name] = value
+	}
+	// Without multi-value headers an ALB response carries a single cookie
+	if len(buffered.cookies) > 0 {
+		albResp.Headers["Set-Cookie"] = buffered.cookies[0]
+	}
+	return albResp, nil
+}
@@ -0,0 +1,97 @@
+package httpproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/regions"
+)
+
+func TestTrustForwarded(t *testing.T) {
+	oldSecret, oldRegions := forwardSecret, deploymentRegions
+	t.Cleanup(func() { forwardSecret, deploymentRegions = oldSecret, oldRegions })
+	forwardSecret = []byte("shared-forward-secret")
+	deploymentRegions = []regions.Region{
+		{Name: "us-east-1", ProxyURL: "https://proxy.us-east-1.example"},
+		{Name: "eu-west-1", ProxyURL: "https://proxy.eu-west-1.example"},
+	}
+	t.Setenv("AWS_REGION", "us-east-1")
+	tunnel := &models.Tunnel{Region: "eu-west-1"}
+
+	tests := []struct {
+		name      string
+		value     string
+		forwarded bool
+	}{
+		{"signed", regions.SignForward(forwardSecret, "eu-west-1", time.Now()), true},
+		{"spoofed", "eu-west-1", false},
+		{"signed with another secret", regions.SignForward([]byte("guess"), "eu-west-1", time.Now()), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayV2HTTPRequest{
+				Headers: map[string]string{"X-Tunnel-Forwarded-From": tt.value},
+			}
+			ctx := trustForwarded(context.Background(), &request)
+
+			if _, ok := forwardedFrom(ctx); ok != tt.forwarded {
+				t.Errorf("forwarded = %v, want %v", ok, tt.forwarded)
+			}
+			if len(request.Headers) > 0 {
+				t.Errorf("header left on the request: %v", request.Headers)
+			}
+			// Only a request forwarded by another region is served away from
+			// the tunnel's home region
+			if _, ok := homeRegionFor(ctx, tunnel); ok == tt.forwarded {
+				t.Errorf("forward to home region = %v, want %v", ok, !tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestForwardToRegion(t *testing.T) {
+	oldSecret := forwardSecret
+	t.Cleanup(func() { forwardSecret = oldSecret })
+	forwardSecret = []byte("shared-forward-secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	var got *http.Request
+	home := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer home.Close()
+
+	request := events.APIGatewayV2HTTPRequest{
+		Headers: map[string]string{"x-tunnel-subdomain": "myapp", "accept": "text/html"},
+	}
+	request.RequestContext.HTTP.Method = "GET"
+	resp, err := forwardToRegion(context.Background(), regions.Region{Name: "eu-west-1", ProxyURL: home.URL},
+		request, "/t/myapp/login", "")
+	if err != nil {
+		t.Fatalf("forwardToRegion: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusFound || resp.Headers["Location"] != "/elsewhere" {
+		t.Errorf("got %d to %q, want the home region's redirect unfollowed", resp.StatusCode, resp.Headers["Location"])
+	}
+	if len(resp.Cookies) != 2 || resp.Cookies[0] != "a=1" || resp.Cookies[1] != "b=2" {
+		t.Errorf("Cookies = %q, want both cookies", resp.Cookies)
+	}
+	if _, ok := resp.Headers["Set-Cookie"]; ok {
+		t.Errorf("Set-Cookie left in Headers: %q", resp.Headers["Set-Cookie"])
+	}
+	if from, ok := regions.VerifyForward(forwardSecret, got.Header.Get(regions.ForwardedFromHeader), time.Now()); !ok || from != "us-east-1" {
+		t.Errorf("forwarded request not signed by us-east-1: %q", got.Header.Get(regions.ForwardedFromHeader))
+	}
+	if got.Header.Get("X-Tunnel-Subdomain") != "" || got.URL.Path != "/t/myapp/login" {
+		t.Errorf("forwarded %s with X-Tunnel-Subdomain %q", got.URL.Path, got.Header.Get("X-Tunnel-Subdomain"))
+	}
+}
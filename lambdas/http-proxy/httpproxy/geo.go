@@ -0,0 +1,39 @@
+package httpproxy
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// viewerCountryHeader carries the caller's country, looked up by CloudFront
+// from the viewer's IP and passed on by the AllViewerExceptHostHeader origin
+// request policy
+const viewerCountryHeader = "cloudfront-viewer-country"
+
+// viewerCountry returns the caller's ISO 3166-1 alpha-2 country, or "" when
+// the request did not come through CloudFront
+func viewerCountry(request events.APIGatewayV2HTTPRequest) string {
+	for name, value := range request.Headers {
+		if strings.EqualFold(name, viewerCountryHeader) {
+			return strings.ToUpper(strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// geoRestrictionResponse rejects callers outside a tunnel's allowed countries.
+// A caller whose country is unknown is rejected too, so the restriction cannot
+// be sidestepped by calling the Function URL directly. It returns nil for
+// allowed callers.
+func geoRestrictionResponse(tunnel *models.Tunnel, country string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if len(tunnel.AllowedCountries) == 0 || slices.Contains(tunnel.AllowedCountries, country) {
+		return nil, nil
+	}
+	if country == "" {
+		return errorResponse(403, "This tunnel is restricted by country and the caller's country is unknown")
+	}
+	return errorResponse(403, "This tunnel is not available in "+country)
+}
@@ -0,0 +1,91 @@
+package httpproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// headerRulesResponse applies a tunnel's header rules to the headers a request
+// from sourceIP forwards: a request missing one of its RequiredHeaders, or
+// carrying it with another value, is rejected with a 403, and its
+// StrippedHeaders are removed and recorded on entry. It returns nil when the
+// request may be forwarded.
+func headerRulesResponse(tunnel *models.Tunnel, headers map[string]string, sourceIP string, entry *models.RequestLog) (*events.LambdaFunctionURLStreamingResponse, error) {
+	for _, rule := range tunnel.RequiredHeaders {
+		name, want, hasValue := strings.Cut(rule, ": ")
+		got, ok := headerValue(headers, name)
+		if ok && (!hasValue || subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1) {
+			continue
+		}
+		fmt.Printf("http-proxy: tunnel %s rejected a request from %s without required header %s\n",
+			tunnel.TunnelID, sourceIP, name)
+		return errorResponse(403, "Missing or invalid required header "+name)
+	}
+
+	if len(tunnel.StrippedHeaders) == 0 {
+		return nil, nil
+	}
+	for name := range headers {
+		lower := strings.ToLower(name)
+		if slices.Contains(tunnel.StrippedHeaders, lower) {
+			delete(headers, name)
+			entry.StrippedHeaders = append(entry.StrippedHeaders, lower)
+		}
+	}
+	if len(entry.StrippedHeaders) > 0 {
+		slices.Sort(entry.StrippedHeaders)
+		fmt.Printf("http-proxy: tunnel %s stripped %s\n", tunnel.TunnelID, strings.Join(entry.StrippedHeaders, ", "))
+	}
+	return nil, nil
+}
+
+// applyResponseHeaders applies a tunnel's response header policy to resp: its
+// StrippedResponseHeaders are removed and its ResponseHeaders set, replacing
+// whatever the local service or http-proxy itself put there. Function URLs
+// carry Set-Cookie apart from the other headers, in resp.Cookies.
+func applyResponseHeaders(tunnel *models.Tunnel, resp *events.LambdaFunctionURLStreamingResponse) {
+	if resp == nil || len(tunnel.ResponseHeaders)+len(tunnel.StrippedResponseHeaders) == 0 {
+		return
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	for name := range resp.Headers {
+		if slices.Contains(tunnel.StrippedResponseHeaders, strings.ToLower(name)) {
+			delete(resp.Headers, name)
+		}
+	}
+	if slices.Contains(tunnel.StrippedResponseHeaders, "set-cookie") {
+		resp.Cookies = nil
+	}
+
+	for _, rule := range tunnel.ResponseHeaders {
+		name, value, _ := strings.Cut(rule, ": ")
+		if name == "set-cookie" {
+			resp.Cookies = []string{value}
+			continue
+		}
+		for n := range resp.Headers {
+			if strings.EqualFold(n, name) {
+				delete(resp.Headers, n)
+			}
+		}
+		resp.Headers[http.CanonicalHeaderKey(name)] = value
+	}
+}
+
+// headerValue looks a header up by name, whatever its case in headers
+func headerValue(headers map[string]string, name string) (string, bool) {
+	for n, value := range headers {
+		if strings.EqualFold(n, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// healthPath reports on every tunnel whether it is connected; it is never
+// forwarded to the local service
+const healthPath = "/__tunnel/health"
+
+// tunnelHealth is the body of a health check
+type tunnelHealth struct {
+	Status      string     `json:"status"`
+	Connected   bool       `json:"connected"`
+	Connections int        `json:"connections"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	CheckedAt   time.Time  `json:"checked_at"`
+}
+
+// healthCheckResponse answers GET and HEAD on healthPath from the tunnel
+// record, with 200 while a CLI is connected and 503 otherwise, so uptime
+// monitors can watch a tunnel without reaching the local service. It returns
+// nil for every other request.
+func healthCheckResponse(tunnel *models.Tunnel, method, proxyPath string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if path, _, _ := strings.Cut(proxyPath, "?"); path != healthPath {
+		return nil, nil
+	}
+	method = strings.ToUpper(method)
+	if method != "GET" && method != "HEAD" {
+		resp, err := errorResponse(405, "Method "+method+" is not allowed on "+healthPath)
+		resp.Headers["Allow"] = "GET, HEAD"
+		return resp, err
+	}
+
+	health := tunnelHealth{
+		Status:    "disconnected",
+		Connected: tunnel.Status == models.TunnelStatusActive && tunnel.ConnectionID != "",
+		LastSeen:  tunnel.LastPingAt,
+		CheckedAt: time.Now().UTC(),
+	}
+	statusCode := 503
+	if health.Connected {
+		health.Status = "connected"
+		health.Connections = len(tunnel.Connections())
+		statusCode = 200
+	}
+
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Cache-Control": "no-store",
+	}
+	if method == "HEAD" {
+		return bodylessResponse(statusCode, headers), nil
+	}
+	body, err := json.Marshal(health)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal health check")
+	}
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       bytes.NewReader(body),
+	}, nil
+}
@@ -0,0 +1,1830 @@
+// Package httpproxy is the http-proxy Lambda, which forwards HTTP requests to
+// the CLI holding a tunnel and streams its response back. The Lambda's main
+// only calls Init and starts Invoke; the end-to-end tests run it in-process.
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/env"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/ratelimit"
+	"github.com/lmanrique/tunnel/lambdas/shared/redact"
+	"github.com/lmanrique/tunnel/lambdas/shared/redelivery"
+	"github.com/lmanrique/tunnel/lambdas/shared/regions"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+	"github.com/lmanrique/tunnel/lambdas/shared/requestlog"
+	"github.com/lmanrique/tunnel/lambdas/shared/requesttarget"
+)
+
+// Default backpressure of tunnels with max_concurrent_requests set: requests
+// awaiting a response beyond the cap wait in a FIFO queue of REQUEST_QUEUE_SIZE
+// for up to REQUEST_QUEUE_TIMEOUT, and are shed with 429 once the queue is full
+const (
+	defaultRequestQueueSize    = 100
+	defaultRequestQueueTimeout = 10 * time.Second
+)
+
+// redirectURLExpiry is how long the presigned GET URL of a redirected
+// response stays valid
+const redirectURLExpiry = 5 * time.Minute
+
+// responseTimeout is how long a caller waits for the CLI's response, and so
+// how long a failed delivery may be retried
+const responseTimeout = 180 * time.Second
+
+// wsChunkSize is the size of the proxy_chunk messages a request body too
+// large for one WebSocket message is split into
+const wsChunkSize = 90 * 1024
+
+// chunkSendWorkers bounds the concurrent PostToConnection calls sending one
+// request's chunks
+const chunkSendWorkers = 8
+
+// A streamed response's chunks are polled every streamPollInterval while they
+// keep coming, backing off to maxStreamPollInterval while the stream is idle.
+// Once the CLI has ended the stream, chunks still missing are waited for up to
+// streamEndGrace.
+const (
+	streamPollInterval    = 50 * time.Millisecond
+	maxStreamPollInterval = 400 * time.Millisecond
+	streamEndGrace        = 5 * time.Second
+)
+
+var (
+	domainsTable         string
+	tunnelsTable         string
+	pendingRequestsTable string
+	streamChunksTable    string
+	websocketEndpoint    string
+	domainName           string
+	uploadsBucket        string
+	requestLogTable      string
+	requestStatsTable    string // Hourly counters tunnel-stats and report-usage sum; "" skips counting
+	rateLimitsTable      string
+	redeliveryQueueURL   string
+	reconnectGracePeriod time.Duration
+	requestConcurrency   ratelimit.Concurrency
+	maxInlineResponse    int64
+	redirectLargeBodies  bool
+	consistentPolls      bool
+	logRequestDetails    bool
+	redactRules          redact.Rules
+	deploymentRegions    []regions.Region
+	forwardSecret        []byte
+	dbClient             *db.DynamoDBClient
+	tunnelRepo           repository.TunnelRepository
+	domainRepo           repository.DomainRepository
+	pendingRepo          repository.PendingRequestRepository
+	streamChunkRepo      repository.StreamChunkRepository
+	s3Client             *s3.Client
+	s3PresignClient      *s3.PresignClient
+	sqsClient            *sqs.Client
+)
+
+// Init reads the configuration from the environment. It panics when a required
+// variable is missing, failing the Lambda's init phase, and must be called
+// before Invoke or Handler.
+func Init() {
+	domainsTable = os.Getenv("DOMAINS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	streamChunksTable = os.Getenv("STREAM_CHUNKS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+	domainName = os.Getenv("DOMAIN_NAME")
+	uploadsBucket = os.Getenv("UPLOADS_BUCKET")
+	requestLogTable = os.Getenv("REQUEST_LOG_TABLE")
+	requestStatsTable = os.Getenv("REQUEST_STATS_TABLE")
+	rateLimitsTable = os.Getenv("RATE_LIMITS_TABLE")
+	redeliveryQueueURL = os.Getenv("REDELIVERY_QUEUE_URL")
+
+	if domainsTable == "" || tunnelsTable == "" || pendingRequestsTable == "" || websocketEndpoint == "" || domainName == "" {
+		panic("Required environment variables are missing")
+	}
+
+	var err error
+	deploymentRegions, err = regions.Load()
+	if err != nil {
+		panic(err.Error())
+	}
+	// Requests forwarded between regions are signed with REGION_FORWARD_SECRET,
+	// which every region shares
+	forwardSecret = []byte(os.Getenv("REGION_FORWARD_SECRET"))
+	if len(deploymentRegions) > 1 && len(forwardSecret) == 0 {
+		panic("REGION_FORWARD_SECRET is required when REGIONS lists more than one region")
+	}
+
+	// Parse reconnect grace period (default: 30s)
+	gracePeriodStr := os.Getenv("TUNNEL_RECONNECT_GRACE_PERIOD")
+	if gracePeriodStr == "" {
+		reconnectGracePeriod = 30 * time.Second
+	} else {
+		parsed, err := time.ParseDuration(gracePeriodStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TUNNEL_RECONNECT_GRACE_PERIOD: %v, using default 30s\n", err)
+			reconnectGracePeriod = 30 * time.Second
+		} else {
+			reconnectGracePeriod = parsed
+		}
+	}
+
+	// Responses over MAX_INLINE_RESPONSE_BYTES are always staged in S3 by the
+	// CLI, and with REDIRECT_LARGE_RESPONSES the caller is redirected to them
+	maxInlineResponse = int64(env.Count("MAX_INLINE_RESPONSE_BYTES", 0))
+	redirectLargeBodies = os.Getenv("REDIRECT_LARGE_RESPONSES") == "true"
+
+	// With CONSISTENT_POLL_READS every poll for a response is a consistent
+	// read, which never misses a response the CLI just wrote but costs twice
+	// as much; otherwise only the reads that decide the outcome are
+	consistentPolls = os.Getenv("CONSISTENT_POLL_READS") == "true"
+
+	// With LOG_REQUEST_DETAILS the request log also keeps each request's
+	// headers and the start of its body. REDACT_HEADERS and REDACT_FIELDS add
+	// to the redaction rules applied to them and to every logged path.
+	logRequestDetails = os.Getenv("LOG_REQUEST_DETAILS") == "true"
+	redactRules = redact.NewRules(redact.ParseList(os.Getenv("REDACT_HEADERS")), redact.ParseList(os.Getenv("REDACT_FIELDS")))
+
+	requestConcurrency = ratelimit.Concurrency{
+		QueueSize:    int64(env.Count("REQUEST_QUEUE_SIZE", defaultRequestQueueSize)),
+		QueueTimeout: defaultRequestQueueTimeout,
+	}
+	if v := os.Getenv("REQUEST_QUEUE_TIMEOUT"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid REQUEST_QUEUE_TIMEOUT %q, using default %v\n", v, defaultRequestQueueTimeout)
+		} else {
+			requestConcurrency.QueueTimeout = parsed
+		}
+	}
+}
+
+type ProxyRequest struct {
+	RequestID string            `json:"request_id"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+}
+
+type forwardedFromKey struct{}
+
+// trustForwarded strips ForwardedFromHeader from request and, when its
+// signature is valid, records the region that forwarded it in the returned
+// context. Callers cannot mark their own requests as forwarded.
+func trustForwarded(ctx context.Context, request *events.APIGatewayV2HTTPRequest) context.Context {
+	value := ""
+	for name, v := range request.Headers {
+		if strings.EqualFold(name, regions.ForwardedFromHeader) {
+			value = v
+			delete(request.Headers, name)
+		}
+	}
+	if value == "" {
+		return ctx
+	}
+	from, ok := regions.VerifyForward(forwardSecret, value, time.Now())
+	if !ok {
+		fmt.Printf("http-proxy: ignoring an invalid %s from %s\n", regions.ForwardedFromHeader, request.RequestContext.HTTP.SourceIP)
+		return ctx
+	}
+	return context.WithValue(ctx, forwardedFromKey{}, from)
+}
+
+// forwardedFrom returns the region that forwarded the request being served
+func forwardedFrom(ctx context.Context) (string, bool) {
+	from, ok := ctx.Value(forwardedFromKey{}).(string)
+	return from, ok
+}
+
+// homeRegionFor returns the region to forward a request to when the tunnel is
+// homed in another region. Requests that were already forwarded are served here.
+func homeRegionFor(ctx context.Context, tunnel *models.Tunnel) (regions.Region, bool) {
+	if _, forwarded := forwardedFrom(ctx); forwarded || tunnel.Region == "" || tunnel.Region == regions.Current() {
+		return regions.Region{}, false
+	}
+
+	home, ok := regions.Find(deploymentRegions, tunnel.Region)
+	if !ok || home.ProxyURL == "" {
+		return regions.Region{}, false
+	}
+	return home, true
+}
+
+// regionClient makes the requests forwarded to other regions. Redirects are
+// the local service's and go back to the caller as they are. The home region
+// answers within its own response timeout; a streamed body can take as long as
+// the Lambda may run.
+var regionClient = &http.Client{
+	Timeout: 15 * time.Minute,
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = responseTimeout + time.Minute
+		return t
+	}(),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// forwardToRegion replays a request against the home region's http-proxy and
+// streams its response back
+func forwardToRegion(ctx context.Context, home regions.Region, request events.APIGatewayV2HTTPRequest, path, body string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	target := strings.TrimSuffix(home.ProxyURL, "/") + path
+
+	// The response body keeps streaming after the handler returns, so the
+	// forwarded request must outlive the handler context
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), request.RequestContext.HTTP.Method, target, strings.NewReader(body))
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to build forwarded request: %v", err))
+	}
+	for name, value := range request.Headers {
+		// The target path already names the tunnel
+		switch strings.ToLower(name) {
+		case "host", "content-length", "x-tunnel-subdomain":
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	if len(request.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(request.Cookies, "; "))
+	}
+	req.Header.Set(regions.ForwardedFromHeader, regions.SignForward(forwardSecret, regions.Current(), time.Now()))
+
+	fmt.Printf("http-proxy: forwarding %s to %s\n", path, home.Name)
+
+	resp, err := regionClient.Do(req)
+	if err != nil {
+		return errorResponse(502, fmt.Sprintf("Failed to reach region %s: %v", home.Name, err))
+	}
+
+	// Function URLs carry Set-Cookie apart from the other headers, one entry
+	// per cookie; any other header can be folded into one line
+	headers := make(map[string]string, len(resp.Header))
+	for name, values := range resp.Header {
+		if name == "Set-Cookie" {
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		Cookies:    resp.Header.Values("Set-Cookie"),
+		Body:       resp.Body,
+	}, nil
+}
+
+// pickConnection chooses the connection a request is sent through
+func pickConnection(tunnel *models.Tunnel) string {
+	connections := tunnel.Connections()
+	if len(connections) <= 1 {
+		return tunnel.ConnectionID
+	}
+	return connections[mathrand.IntN(len(connections))]
+}
+
+func generateRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// waitForTunnelReconnect waits for an inactive tunnel to become active again.
+// Returns the updated tunnel if it becomes active, or an error if the grace period expires.
+// Only waits if the tunnel was recently active (updated within last 5 minutes).
+func waitForTunnelReconnect(ctx context.Context, tunnelID string, tunnel *models.Tunnel) (*models.Tunnel, error) {
+	// Only apply grace period if tunnel was recently active (within 5 minutes)
+	if time.Since(tunnel.UpdatedAt) > 5*time.Minute {
+		return nil, fmt.Errorf("tunnel has been inactive for too long")
+	}
+
+	fmt.Printf("Tunnel %s is inactive but was recently connected, waiting up to %v for reconnect...\n", tunnelID, reconnectGracePeriod)
+
+	deadline := time.Now().Add(reconnectGracePeriod)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("request cancelled while waiting for tunnel reconnect")
+		case <-ticker.C:
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("tunnel did not reconnect within grace period")
+			}
+
+			updatedTunnel, err := tunnelRepo.Get(ctx, tunnelID)
+			if err != nil {
+				continue
+			}
+
+			if updatedTunnel.Status == models.TunnelStatusActive && updatedTunnel.ConnectionID != "" {
+				fmt.Printf("Tunnel %s reconnected successfully!\n", tunnelID)
+				return updatedTunnel, nil
+			}
+		}
+	}
+}
+
+// dropGoneConnection takes a connection API Gateway reports as gone off its
+// tunnel and returns the tunnel to retry on: right away if other connections
+// remain (multi policy), otherwise once the CLI reconnects within the grace
+// period. The update is versioned so it cannot undo a concurrent reconnect.
+func dropGoneConnection(ctx context.Context, tunnelID, connectionID string) (*models.Tunnel, error) {
+	var remaining []string
+	tunnel, err := dbClient.UpdateTunnel(ctx, tunnelsTable, tunnelID, func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		remaining = nil
+		if !tunnel.HasConnection(connectionID) {
+			return nil, nil
+		}
+		for _, id := range tunnel.Connections() {
+			if id != connectionID {
+				remaining = append(remaining, id)
+			}
+		}
+
+		updatedAt := &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)}
+		if len(remaining) == 0 {
+			return &dynamodb.UpdateItemInput{
+				UpdateExpression: aws.String("SET #status = :status, updated_at = :updated_at REMOVE connection_id, connection_ids"),
+				ExpressionAttributeNames: map[string]string{
+					"#status": "status",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":status":     &types.AttributeValueMemberS{Value: models.TunnelStatusInactive},
+					":updated_at": updatedAt,
+				},
+			}, nil
+		}
+
+		input := &dynamodb.UpdateItemInput{
+			UpdateExpression: aws.String("SET updated_at = :updated_at DELETE connection_ids :gone"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":updated_at": updatedAt,
+				":gone":       &types.AttributeValueMemberSS{Value: []string{connectionID}},
+			},
+		}
+		if tunnel.ConnectionID == connectionID {
+			input.UpdateExpression = aws.String("SET connection_id = :connection_id, updated_at = :updated_at DELETE connection_ids :gone")
+			input.ExpressionAttributeValues[":connection_id"] = &types.AttributeValueMemberS{Value: remaining[0]}
+		}
+		return input, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop gone connection %s: %w", connectionID, err)
+	}
+
+	fmt.Printf("http-proxy: connection %s of tunnel %s is gone\n", connectionID, tunnelID)
+
+	if len(remaining) > 0 {
+		tunnel.ConnectionID = remaining[0]
+		tunnel.ConnectionIDs = remaining
+		return tunnel, nil
+	}
+
+	tunnel.UpdatedAt = time.Now()
+	return waitForTunnelReconnect(ctx, tunnelID, tunnel)
+}
+
+func initClients(ctx context.Context) error {
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialize DynamoDB client: %w", err)
+		}
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
+		domainRepo = repository.NewDomainRepository(dbClient, domainsTable)
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+		streamChunkRepo = repository.NewStreamChunkRepository(dbClient, streamChunksTable)
+	}
+	if s3Client == nil && uploadsBucket != "" {
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get AWS config: %w", err)
+		}
+		s3Client, s3PresignClient = awsclients.S3(cfg)
+	}
+	if sqsClient == nil && redeliveryQueueURL != "" {
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get AWS config: %w", err)
+		}
+		sqsClient = sqs.NewFromConfig(cfg)
+	}
+	return nil
+}
+
+// Handler serves one Function URL request: the poll and upload endpoints, or a
+// request to proxy through its tunnel
+func Handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if err := initClients(ctx); err != nil {
+		return errorResponse(500, err.Error())
+	}
+
+	// DEBUG: log incoming request details
+	fmt.Printf("DEBUG path=%q rawPath=%q host=%q x-tunnel-subdomain=%q method=%q\n",
+		request.RawPath, request.RawPath,
+		request.Headers["host"],
+		request.Headers["x-tunnel-subdomain"],
+		request.RequestContext.HTTP.Method,
+	)
+
+	ctx = trustForwarded(ctx, &request)
+	path := request.RawPath
+
+	// ── Poll endpoint: GET /poll/{request_id} ────────────────────────────────
+	if strings.HasPrefix(path, "/poll/") {
+		requestID := strings.TrimPrefix(path, "/poll/")
+		if requestID == "" {
+			return errorResponse(400, "request_id is required")
+		}
+		return handlePollResponse(ctx, requestID)
+	}
+
+	// ── Upload-URL endpoint: POST /upload-url/{subdomain}[/{proxy+}] ─────────
+	if strings.HasPrefix(path, "/upload-url/") {
+		return handleUploadURL(ctx, request)
+	}
+
+	// ── Upload-complete endpoint: POST /upload-complete/{request_id} ─────────
+	if strings.HasPrefix(path, "/upload-complete/") {
+		requestID := strings.TrimPrefix(path, "/upload-complete/")
+		if requestID == "" {
+			return errorResponse(400, "request_id is required")
+		}
+		return handleUploadComplete(ctx, request, requestID)
+	}
+
+	// ── Normal proxy: /t/{subdomain}[/{proxy+}] ──────────────────────────────
+	return handleProxy(ctx, request)
+}
+
+// handleProxy forwards a request through its tunnel and records it in the request log
+// once the response body has been fully streamed to the caller.
+func handleProxy(ctx context.Context, request events.APIGatewayV2HTTPRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	start := time.Now()
+	entry := &models.RequestLog{
+		Method:    request.RequestContext.HTTP.Method,
+		SourceIP:  request.RequestContext.HTTP.SourceIP,
+		UserAgent: request.RequestContext.HTTP.UserAgent,
+		Country:   viewerCountry(request),
+		CreatedAt: start,
+	}
+
+	resp, err := forwardRequest(ctx, request, entry)
+	if err != nil || resp == nil || entry.TunnelID == "" || requestLogTable == "" {
+		return resp, err
+	}
+
+	statusCode := resp.StatusCode
+	record := func(bytesOut int64) {
+		entry.StatusCode = statusCode
+		entry.DurationMs = time.Since(start).Milliseconds()
+		entry.BytesOut = bytesOut
+		if entry.RequestID == "" {
+			// Failed before a request ID was assigned (e.g. tunnel not connected)
+			entry.RequestID, _ = generateRequestID()
+		}
+
+		// The handler context may already be done while the body is still streaming
+		recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := requestlog.Record(recordCtx, dbClient, requestLogTable, *entry); err != nil {
+			fmt.Printf("http-proxy: %v\n", err)
+		}
+		if err := requestlog.Count(recordCtx, dbClient, requestStatsTable, *entry); err != nil {
+			fmt.Printf("http-proxy: %v\n", err)
+		}
+	}
+
+	if resp.Body == nil {
+		record(0)
+		return resp, nil
+	}
+	resp.Body = requestlog.NewMeteredReader(resp.Body, record)
+	return resp, nil
+}
+
+// forwardRequest is the main tunnel proxy path. It fills in entry as the tunnel
+// and request are resolved; entry.TunnelID stays empty if no tunnel was found.
+func forwardRequest(ctx context.Context, request events.APIGatewayV2HTTPRequest, entry *models.RequestLog) (resp *events.LambdaFunctionURLStreamingResponse, err error) {
+	// Extract subdomain — from path parameters (API Gateway) or raw path (Lambda Function URL)
+	subdomain := request.PathParameters["subdomain"]
+	proxyPath := ""
+	if subdomain == "" {
+		trimmed := strings.TrimPrefix(request.RawPath, "/t/")
+		if trimmed == request.RawPath || trimmed == "" {
+			return errorResponse(400, "Subdomain is required")
+		}
+		slashIdx := strings.Index(trimmed, "/")
+		if slashIdx == -1 {
+			subdomain = trimmed
+			proxyPath = "/"
+		} else {
+			subdomain = trimmed[:slashIdx]
+			proxyPath = trimmed[slashIdx:]
+		}
+	} else if raw, ok := strings.CutPrefix(request.RawPath, "/t/"+subdomain); ok && (raw == "" || raw[0] == '/') {
+		// The proxy path parameter is decoded; the raw path keeps %2F and the like
+		proxyPath = raw
+	} else {
+		proxyPath = "/" + requesttarget.FromDecoded(request.PathParameters["proxy"])
+	}
+	if subdomain == "" {
+		return errorResponse(400, "Subdomain is required")
+	}
+	proxyPath = requesttarget.Join(proxyPath, request.RawQueryString)
+
+	// Decode body if API Gateway base64-encoded it
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return errorResponse(400, "Failed to decode request body")
+		}
+		body = string(decoded)
+	}
+
+	// The edge has already read the whole body, answering any Expect:
+	// 100-continue itself. Passed on, the header would make the CLI's request
+	// to the local service wait for an interim response it does not need.
+	for name := range request.Headers {
+		if strings.EqualFold(name, "expect") {
+			delete(request.Headers, name)
+		}
+	}
+
+	// Look up domain → tunnel
+	fullDomain := fmt.Sprintf("%s.%s", subdomain, domainName)
+	domain, err := domainRepo.Get(ctx, fullDomain)
+	if errors.Is(err, repository.ErrNotFound) {
+		return unknownSubdomainResponse(request, subdomain)
+	}
+	if err != nil {
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+	entry.TunnelID = domain.TunnelID
+	entry.Path = redactRules.Path(proxyPath)
+	entry.BytesIn = int64(len(body))
+
+	tunnel, err := tunnelRepo.Get(ctx, domain.TunnelID)
+	if err != nil {
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	// Whatever answers from here on, the tunnel's own error and login pages
+	// included, gets its response header policy
+	defer func() { applyResponseHeaders(tunnel, resp) }()
+
+	// Health checks are answered from the tunnel record in any region, ahead of
+	// the filters below so monitors are never blocked, and are not logged
+	if resp, err := healthCheckResponse(tunnel, request.RequestContext.HTTP.Method, proxyPath); resp != nil || err != nil {
+		entry.TunnelID = ""
+		return resp, err
+	}
+
+	// Apply the tunnel's filters and restrictions, or hand the request to its
+	// home region
+	if resp, err := admitRequest(ctx, tunnel, &request, admission{
+		method:      request.RequestContext.HTTP.Method,
+		proxyPath:   proxyPath,
+		forwardPath: "/t/" + subdomain + proxyPath,
+		body:        body,
+	}, entry); resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Keep what is forwarded, redacted, when request details are logged
+	if logRequestDetails {
+		contentType, _ := headerValue(request.Headers, "content-type")
+		entry.Headers = redactRules.Headers(request.Headers)
+		entry.BodyPreview = redactRules.BodyPreview(contentType, body)
+	}
+
+	// If tunnel is inactive, wait for reconnection (grace period)
+	if tunnel.Status != models.TunnelStatusActive || tunnel.ConnectionID == "" {
+		reconnectedTunnel, waitErr := waitForTunnelReconnect(ctx, domain.TunnelID, tunnel)
+		if waitErr != nil {
+			// Grace period expired without reconnection
+			if tunnel.Status != models.TunnelStatusActive {
+				return problem.StreamingErrorResponse(503, problem.CodeTunnelInactive, "Tunnel is not active")
+			}
+			return problem.StreamingErrorResponse(503, problem.CodeTunnelInactive, "Tunnel is not connected")
+		}
+		// Use the reconnected tunnel
+		tunnel = reconnectedTunnel
+	}
+
+	// Hold one of the tunnel's request slots until its response is resolved:
+	// a response body gives the slot back when it is closed, after the last
+	// byte was streamed or the caller went away
+	release, resp := acquireRequestSlot(ctx, tunnel, entry)
+	if resp != nil {
+		return resp, nil
+	}
+	if release != nil {
+		defer func() {
+			if resp == nil || resp.Body == nil {
+				release()
+				return
+			}
+			resp.Body = requestlog.NewMeteredReader(resp.Body, func(int64) { release() })
+		}()
+	}
+
+	// Multi-policy tunnels spread requests across all of their connections
+	connectionID := pickConnection(tunnel)
+
+	requestID, err := generateRequestID()
+	if err != nil {
+		return errorResponse(500, "Failed to generate request ID")
+	}
+	entry.RequestID = requestID
+
+	// Pre-generate a presigned S3 PUT URL so the CLI can stage large/binary responses.
+	s3PutURL, s3ResponseKey := "", ""
+	if uploadsBucket != "" {
+		s3ResponseKey = fmt.Sprintf("responses/%s/body", requestID)
+		presignReq, presignErr := s3PresignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(uploadsBucket),
+			Key:    aws.String(s3ResponseKey),
+		}, s3.WithPresignExpires(30*time.Minute))
+		if presignErr == nil {
+			s3PutURL = presignReq.URL
+		}
+	}
+
+	// Store pending request in DynamoDB
+	pendingReq := models.PendingRequest{
+		RequestID: requestID,
+		TunnelID:  domain.TunnelID,
+		Method:    request.RequestContext.HTTP.Method,
+		Path:      proxyPath,
+		Headers:   request.Headers,
+		Body:      body,
+		Status:    "pending",
+		CreatedAt: time.Now(),
+		TTL:       time.Now().Add(5 * time.Minute).Unix(),
+	}
+	if err := pendingRepo.Put(ctx, pendingReq); err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to store request: %v", err))
+	}
+
+	// The API Gateway management client is kept across invocations
+	cfg, err := dbClient.GetAWSConfig(ctx)
+	if err != nil {
+		return errorResponse(500, "Failed to get AWS config")
+	}
+	apigwClient := awsclients.Management(cfg, websocketEndpoint)
+
+	// If request body is large, send it to the CLI in chunks before the main message
+	totalChunks := 0
+	proxyBody := body
+	if len(body) > wsChunkSize {
+		totalChunks = (len(body) + wsChunkSize - 1) / wsChunkSize
+		if err := sendRequestChunks(ctx, apigwClient, connectionID, requestID, body, totalChunks); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to send request chunk to tunnel: %v", err))
+		}
+		proxyBody = ""
+	}
+
+	// The inline response cap only applies when the CLI can stage to S3 and
+	// understands it
+	maxInlineBytes := int64(0)
+	if s3PutURL != "" && tunnel.Supports(models.CapabilityInlineLimit) {
+		maxInlineBytes = maxInlineResponse
+	}
+
+	// Send main proxy message (includes presigned S3 URL for large responses)
+	payloadBytes, err := models.EncodeMessage(models.ActionProxy, &models.ProxyRequestPayload{
+		RequestID:      requestID,
+		Method:         request.RequestContext.HTTP.Method,
+		Path:           proxyPath,
+		Headers:        request.Headers,
+		Body:           proxyBody,
+		TotalChunks:    totalChunks,
+		S3PutURL:       s3PutURL,
+		S3ResponseKey:  s3ResponseKey,
+		MaxInlineBytes: maxInlineBytes,
+	})
+	if err != nil {
+		return errorResponse(500, "Failed to marshal request")
+	}
+	_, err = apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         payloadBytes,
+	})
+
+	// A connection can die without $disconnect firing; drop it and retry once on
+	// another connection or after the CLI reconnects. Chunked bodies already went
+	// to the dead connection, so those requests are not retried.
+	var gone *apigwtypes.GoneException
+	if errors.As(err, &gone) && totalChunks == 0 {
+		if retryTunnel, dropErr := dropGoneConnection(ctx, domain.TunnelID, connectionID); dropErr == nil {
+			connectionID = pickConnection(retryTunnel)
+			_, err = apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: aws.String(connectionID),
+				Data:         payloadBytes,
+			})
+		} else {
+			fmt.Printf("http-proxy: %v\n", dropErr)
+		}
+	}
+	if err != nil && !enqueueRedelivery(ctx, domain.TunnelID, requestID, payloadBytes, totalChunks, err) {
+		return errorResponse(500, fmt.Sprintf("Failed to send request to tunnel: %v", err))
+	}
+
+	timing := &serverTiming{
+		start:      entry.CreatedAt,
+		queued:     time.Duration(entry.QueueMs) * time.Millisecond,
+		dispatched: time.Now(),
+	}
+	resp, err = pollAndReturn(ctx, requestID, timing)
+	addServerTiming(resp, timing)
+	entry.S3UploadMs = timing.s3Upload.Milliseconds()
+	entry.S3FetchMs = timing.s3Fetch.Milliseconds()
+	return resp, err
+}
+
+// admission describes a request admitRequest lets through to a tunnel's
+// local service
+type admission struct {
+	// method and proxyPath are what the local service is asked for
+	method    string
+	proxyPath string
+	// headers are forwarded to the local service; nil means the request's own
+	headers map[string]string
+	// forwardPath and body replay the request against the tunnel's home region
+	forwardPath string
+	body        string
+}
+
+// admitRequest applies a tunnel's per-request gates to request, which asks for
+// what a describes, either proxied directly or staged through /upload-url.
+// Bot filtering and country and method restrictions apply in any region;
+// requests for a tunnel homed in another region are then forwarded there,
+// and the home region checks the access token, the password session and the
+// header rules. It returns nil when the request may be sent to the tunnel.
+func admitRequest(ctx context.Context, tunnel *models.Tunnel, request *events.APIGatewayV2HTTPRequest, a admission, entry *models.RequestLog) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if resp, err := botFilterResponse(tunnel, *request, a.proxyPath); resp != nil || err != nil {
+		return resp, err
+	}
+	if resp, err := geoRestrictionResponse(tunnel, entry.Country); resp != nil || err != nil {
+		return resp, err
+	}
+	if resp, err := methodNotAllowedResponse(tunnel, a.method, a.proxyPath); resp != nil || err != nil {
+		return resp, err
+	}
+
+	// The tunnel's connection lives in another region; hand the request to that
+	// region's http-proxy, which logs it
+	if home, ok := homeRegionFor(ctx, tunnel); ok {
+		entry.TunnelID = ""
+		return forwardToRegion(ctx, home, *request, a.forwardPath, a.body)
+	}
+
+	// Private tunnels only serve callers with an access token, checked here in
+	// the home region, which logs the request
+	if resp, err := accessTokenResponse(tunnel, request, entry); resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Password-protected tunnels: sessions are minted and checked in the home
+	// region only, since every region has its own SESSION_SECRET
+	if resp, err := passwordGate(ctx, tunnel, request, a.proxyPath, a.body); resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Function URLs deliver cookies apart from the other headers; hand them to
+	// the local service as the Cookie header it expects
+	mergeCookies(request)
+
+	// Enforce the tunnel's required and stripped headers
+	headers := a.headers
+	if headers == nil {
+		headers = request.Headers
+	}
+	return headerRulesResponse(tunnel, headers, request.RequestContext.HTTP.SourceIP, entry)
+}
+
+// enqueueRedelivery hands a proxy message that failed to send with sendErr to
+// the redelivery queue, to be retried while the caller is still polling. It
+// reports whether the message was queued; chunked bodies, messages too large
+// for SQS and permanent errors are not.
+func enqueueRedelivery(ctx context.Context, tunnelID, requestID string, message []byte, totalChunks int, sendErr error) bool {
+	if sqsClient == nil || totalChunks > 0 || len(message) > redelivery.MaxMessageBytes || !redelivery.Transient(sendErr) {
+		return false
+	}
+	err := redelivery.Enqueue(ctx, sqsClient, redeliveryQueueURL, redelivery.Delivery{
+		RequestID: requestID,
+		TunnelID:  tunnelID,
+		Message:   message,
+		Attempt:   1,
+		Deadline:  time.Now().Add(responseTimeout),
+	})
+	if err != nil {
+		fmt.Printf("http-proxy: %v\n", err)
+		return false
+	}
+	fmt.Printf("http-proxy: queued request %s for redelivery after: %v\n", requestID, sendErr)
+	return true
+}
+
+// sendRequestChunks posts body to the CLI as totalChunks proxy_chunk messages,
+// chunkSendWorkers at a time. The CLI reassembles them by chunk_index, so they
+// may arrive in any order, but all of them have been accepted by API Gateway
+// before this returns and the proxy message that completes the body is sent.
+func sendRequestChunks(ctx context.Context, apigwClient *apigatewaymanagementapi.Client, connectionID, requestID, body string, totalChunks int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errMux   sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		errMux.Lock()
+		defer errMux.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	sem := make(chan struct{}, chunkSendWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < totalChunks && ctx.Err() == nil; i++ {
+		start := i * wsChunkSize
+		end := min(start+wsChunkSize, len(body))
+		chunkPayload, err := models.EncodeMessage(models.ActionProxyChunk, &models.ChunkPayload{
+			RequestID:  requestID,
+			ChunkIndex: i,
+			Data:       body[start:end],
+		})
+		if err != nil {
+			fail(fmt.Errorf("failed to marshal chunk %d: %w", i, err))
+			break
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(index int, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+				ConnectionId: aws.String(connectionID),
+				Data:         data,
+			}); err != nil {
+				fail(fmt.Errorf("chunk %d: %w", index, err))
+			}
+		}(i, chunkPayload)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	// The handler context ended before every chunk was sent
+	return ctx.Err()
+}
+
+// acquireRequestSlot applies the tunnel's max_concurrent_requests cap on
+// requests awaiting a response, so a saturated tunnel sheds load instead of
+// piling pending requests on DynamoDB and the CLI. Past the cap the request
+// queues; if the queue is full or the wait times out it gets a 429 response to
+// return. Otherwise it gets the release func for its slot, nil when it holds
+// none. Time spent queued is recorded on entry. Counting errors fail open, and
+// uncapped tunnels skip the semaphore writes altogether.
+func acquireRequestSlot(ctx context.Context, tunnel *models.Tunnel, entry *models.RequestLog) (func(), *events.LambdaFunctionURLStreamingResponse) {
+	if rateLimitsTable == "" || tunnel.MaxConcurrentRequests <= 0 {
+		return nil, nil
+	}
+	tunnelID := tunnel.TunnelID
+	concurrency := requestConcurrency
+	concurrency.Limit = tunnel.MaxConcurrentRequests
+
+	waited, err := ratelimit.Acquire(ctx, dbClient, rateLimitsTable, tunnelID, concurrency)
+	entry.QueueMs = waited.Milliseconds()
+	if waited > 0 {
+		db.EmitGauge("RequestQueueTime", float64(entry.QueueMs), "Milliseconds")
+	}
+	switch {
+	case errors.Is(err, ratelimit.ErrSaturated), errors.Is(err, ratelimit.ErrQueueTimeout):
+		fmt.Printf("http-proxy: shedding request to tunnel %s after %v: %v\n", tunnelID, waited, err)
+		db.EmitGauge("RequestsShed", 1, "Count")
+		resp, _ := problem.StreamingErrorResponse(429, problem.CodeTunnelSaturated, "Tunnel is saturated, retry later")
+		resp.Headers["Retry-After"] = strconv.Itoa(max(1, int(requestConcurrency.QueueTimeout.Seconds())))
+		return nil, resp
+	case err != nil:
+		fmt.Printf("http-proxy: %v\n", err)
+		return nil, nil
+	}
+
+	return func() {
+		// The handler context may be done by the time the response is resolved
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ratelimit.Release(releaseCtx, dbClient, rateLimitsTable, tunnelID); err != nil {
+			fmt.Printf("http-proxy: %v\n", err)
+		}
+	}, nil
+}
+
+// handleUploadURL generates a presigned S3 PUT URL for a large request body upload.
+// The client calls POST /upload-url/{subdomain}/{proxy+} with JSON metadata in the body,
+// uploads the actual file to the returned presigned URL, then polls GET /poll/{request_id}.
+func handleUploadURL(ctx context.Context, request events.APIGatewayV2HTTPRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if uploadsBucket == "" {
+		return errorResponse(503, "Large upload support not configured (UPLOADS_BUCKET missing)")
+	}
+
+	// Extract subdomain from path (/upload-url/{subdomain}/...) when present,
+	// or from the Host header when coming through CloudFront (*.tunnel.atelier.run).
+	// Dart client calls: POST myapp.tunnel.atelier.run/upload-url/transcribe
+	// → path = "/upload-url/transcribe", host = "myapp.tunnel.atelier.run"
+	trimmed := strings.TrimPrefix(request.RawPath, "/upload-url/")
+	subdomain := ""
+	proxyPath := "/"
+
+	if trimmed != "" {
+		// CloudFront injects x-tunnel-subdomain header (original Host is stripped by CloudFront).
+		// Fall back to parsing it from the path for direct Lambda URL calls.
+		cfSubdomain := request.Headers["x-tunnel-subdomain"]
+		if cfSubdomain != "" {
+			subdomain = cfSubdomain
+			proxyPath = "/" + trimmed
+		} else {
+			// Direct path: /upload-url/{subdomain}/{proxy+}
+			if idx := strings.Index(trimmed, "/"); idx != -1 {
+				subdomain = trimmed[:idx]
+				proxyPath = trimmed[idx:]
+			} else {
+				subdomain = trimmed
+			}
+		}
+	}
+
+	if subdomain == "" {
+		return errorResponse(400, "Subdomain is required")
+	}
+
+	// Parse optional metadata from body (method, content-type, headers, the
+	// hex SHA-256 of the body the CLI checks the download against, and the
+	// constraints S3 holds the upload to; see upload.go)
+	var meta struct {
+		Method      string            `json:"method"`
+		ContentType string            `json:"content_type"`
+		Headers     map[string]string `json:"headers"`
+		SHA256      string            `json:"sha256"`
+		Constraints uploadConstraints `json:"constraints"`
+	}
+	meta.Method = "POST"
+	if request.Body != "" {
+		_ = json.Unmarshal([]byte(request.Body), &meta)
+	}
+	if meta.Method == "" {
+		meta.Method = "POST"
+	}
+	meta.SHA256 = strings.ToLower(meta.SHA256)
+	if meta.SHA256 != "" && !models.ValidSHA256(meta.SHA256) {
+		return errorResponse(400, "sha256 must be a hex SHA-256")
+	}
+	if err := meta.Constraints.validate(meta.SHA256); err != nil {
+		return errorResponse(400, err.Error())
+	}
+	proxyPath = requesttarget.Join(proxyPath, request.RawQueryString)
+
+	// Look up domain → tunnel (must be active before issuing URL)
+	fullDomain := fmt.Sprintf("%s.%s", subdomain, domainName)
+	domain, err := domainRepo.Get(ctx, fullDomain)
+	if err != nil {
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+	tunnel, err := tunnelRepo.Get(ctx, domain.TunnelID)
+	if err != nil {
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	// The login form of a password-protected tunnel is answered by http-proxy
+	// itself; the metadata must not be taken for a login attempt
+	if path, _, _ := strings.Cut(proxyPath, "?"); tunnel.PasswordHash != "" && path == loginPath {
+		return errorResponse(404, "Uploads to "+loginPath+" are not forwarded")
+	}
+
+	// Uploaded requests pass the same gates as proxied ones, held to the
+	// method and headers the local service will get
+	if meta.Headers == nil {
+		meta.Headers = map[string]string{}
+	}
+	entry := &models.RequestLog{Country: viewerCountry(request)}
+	if resp, err := admitRequest(ctx, tunnel, &request, admission{
+		method:      meta.Method,
+		proxyPath:   proxyPath,
+		headers:     meta.Headers,
+		forwardPath: "/upload-url/" + subdomain + proxyPath,
+		body:        request.Body,
+	}, entry); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if tunnel.Status != models.TunnelStatusActive {
+		return problem.StreamingErrorResponse(503, problem.CodeTunnelInactive, "Tunnel is not active")
+	}
+
+	// Hold one of the tunnel's request slots until a poll returns the
+	// response; see releaseUploadSlot
+	release, resp := acquireRequestSlot(ctx, tunnel, entry)
+	if resp != nil {
+		return resp, nil
+	}
+	stored := false
+	defer func() {
+		if release != nil && !stored {
+			release()
+		}
+	}()
+
+	requestID, err := generateRequestID()
+	if err != nil {
+		return errorResponse(500, "Failed to generate request ID")
+	}
+
+	// S3 key encodes the request_id so the s3-upload-notify Lambda can look it up
+	s3RequestKey := fmt.Sprintf("requests/%s/body", requestID)
+
+	// Also pre-generate a presigned PUT URL for the CLI's response (same as handleProxy)
+	s3ResponseKey := fmt.Sprintf("responses/%s/body", requestID)
+	s3ResponsePutURL := ""
+	responsePutReq, err := s3PresignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(s3ResponseKey),
+	}, s3.WithPresignExpires(meta.Constraints.expiry()))
+	if err == nil {
+		s3ResponsePutURL = responsePutReq.URL
+	}
+
+	// Presign the upload of the request body (what the caller uses to upload).
+	// No Tagging — it would be included as a signed header the client must send.
+	// The request_id is already encoded in the S3 key path.
+	upload, err := presignUpload(ctx, s3RequestKey, requestID, meta.SHA256, meta.Constraints)
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to generate presigned URL: %v", err))
+	}
+
+	// Create pending request (status: waiting_upload)
+	pendingReq := models.PendingRequest{
+		RequestID:     requestID,
+		TunnelID:      domain.TunnelID,
+		Method:        meta.Method,
+		Path:          proxyPath,
+		Headers:       meta.Headers,
+		Body:          "", // body will arrive via S3
+		RequestSHA256: meta.SHA256,
+		Status:        "waiting_upload",
+		CreatedAt:     time.Now(),
+		TTL:           time.Now().Add(meta.Constraints.expiry()).Unix(),
+		SlotHeld:      release != nil,
+	}
+	// The upload-url call carries the caller's trace context; the body upload
+	// and the proxy message s3-upload-notify sends later do not
+	for _, name := range models.TraceHeaders {
+		if value, ok := headerValue(request.Headers, name); ok && value != "" {
+			if pendingReq.TraceContext == nil {
+				pendingReq.TraceContext = map[string]string{}
+			}
+			pendingReq.TraceContext[name] = value
+		}
+	}
+	if err := pendingRepo.Put(ctx, pendingReq); err != nil {
+		if upload.UploadID != "" {
+			abortMultipart(ctx, s3RequestKey, upload.UploadID)
+		}
+		return errorResponse(500, fmt.Sprintf("Failed to store pending request: %v", err))
+	}
+	if upload.UploadID != "" {
+		if err := recordUploadID(ctx, requestID, upload.UploadID); err != nil {
+			abortMultipart(ctx, s3RequestKey, upload.UploadID)
+			return errorResponse(500, fmt.Sprintf("Failed to store pending request: %v", err))
+		}
+	}
+	stored = true
+
+	// Also store the s3_response_key and s3_response_put_url so the notify Lambda
+	// can include them in the WebSocket message to the CLI
+	_ = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET s3_request_key = :rk, s3_response_key = :respk, s3_response_put_url = :respurl"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rk":      &types.AttributeValueMemberS{Value: s3RequestKey},
+			":respk":   &types.AttributeValueMemberS{Value: s3ResponseKey},
+			":respurl": &types.AttributeValueMemberS{Value: s3ResponsePutURL},
+		},
+	})
+
+	// Callers forwarded from another region poll and complete their upload
+	// here, where the pending request lives
+	pollURL := fmt.Sprintf("/poll/%s", requestID)
+	if _, forwarded := forwardedFrom(ctx); forwarded {
+		if self, ok := regions.Find(deploymentRegions, regions.Current()); ok && self.ProxyURL != "" {
+			base := strings.TrimSuffix(self.ProxyURL, "/")
+			pollURL = base + pollURL
+			if upload.CompleteURL != "" {
+				upload.CompleteURL = base + upload.CompleteURL
+			}
+		}
+	}
+
+	body, _ := json.Marshal(struct {
+		RequestID string `json:"request_id"`
+		PollURL   string `json:"poll_url"`
+		*uploadTarget
+	}{requestID, pollURL, upload})
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       bytes.NewReader(body),
+	}, nil
+}
+
+// handlePollResponse polls DynamoDB for the response to a previously initiated upload request.
+func handlePollResponse(ctx context.Context, requestID string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	reqKey := map[string]types.AttributeValue{
+		"request_id": &types.AttributeValueMemberS{Value: requestID},
+	}
+
+	// Check it exists. Callers poll seconds apart, so a response written
+	// just before must not be missed.
+	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey, true)
+	if err != nil || rawItem == nil {
+		return problem.StreamingErrorResponse(404, problem.CodeRequestNotFound, "Request not found")
+	}
+
+	statusAV, ok := rawItem["status"]
+	if !ok {
+		return problem.StreamingErrorResponse(404, problem.CodeRequestNotFound, "Request not found")
+	}
+	sv, _ := statusAV.(*types.AttributeValueMemberS)
+	if sv == nil {
+		return problem.StreamingErrorResponse(404, problem.CodeRequestNotFound, "Request not found")
+	}
+
+	status := sv.Value
+	if (status == "pending" || status == "waiting_upload") && pastTTL(rawItem) {
+		// DynamoDB deletes expired items only eventually
+		status = models.PendingRequestExpired
+	}
+
+	switch status {
+	case "pending", "waiting_upload":
+		body, _ := json.Marshal(map[string]string{"status": status})
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: 202,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       bytes.NewReader(body),
+		}, nil
+	case "completed":
+		releaseUploadSlot(ctx, rawItem)
+		return buildBufferedResponseFromItem(ctx, rawItem)
+	default:
+		if _, ok := models.PendingRequestErrorStatus(status); ok {
+			releaseUploadSlot(ctx, rawItem)
+			return failedRequestResponse(rawItem, status)
+		}
+		body, _ := json.Marshal(map[string]string{"status": status})
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: 202,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       bytes.NewReader(body),
+		}, nil
+	}
+}
+
+// releaseUploadSlot gives back the request slot an uploaded request took at
+// /upload-url. Only the first poll to clear its slot_held flag releases it;
+// the slot of a request nobody polls to the end is freed by the slot lease.
+func releaseUploadSlot(ctx context.Context, rawItem map[string]types.AttributeValue) {
+	held, _ := rawItem["slot_held"].(*types.AttributeValueMemberBOOL)
+	tunnelID, _ := rawItem["tunnel_id"].(*types.AttributeValueMemberS)
+	if held == nil || !held.Value || tunnelID == nil || rateLimitsTable == "" {
+		return
+	}
+
+	err := dbClient.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": rawItem["request_id"],
+		},
+		UpdateExpression:    aws.String("REMOVE slot_held"),
+		ConditionExpression: aws.String("slot_held = :held"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":held": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("http-proxy: failed to clear slot_held: %v\n", err)
+		return
+	}
+	if err := ratelimit.Release(ctx, dbClient, rateLimitsTable, tunnelID.Value); err != nil {
+		fmt.Printf("http-proxy: %v\n", err)
+	}
+}
+
+// pastTTL reports whether a pending request item has outlived its TTL
+func pastTTL(rawItem map[string]types.AttributeValue) bool {
+	nv, ok := rawItem["ttl"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	ttl, err := strconv.ParseInt(nv.Value, 10, 64)
+	return err == nil && ttl < time.Now().Unix()
+}
+
+// failedRequestResponse answers a request that ended in a terminal failure
+// status with its error, and the status as a code callers can act on. A
+// response_status stored with the failure, e.g. the CLI's own, takes
+// precedence over the status's default.
+func failedRequestResponse(rawItem map[string]types.AttributeValue, status string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	statusCode, _ := models.PendingRequestErrorStatus(status)
+	if nv, ok := rawItem["response_status"].(*types.AttributeValueMemberN); ok {
+		if code, err := strconv.Atoi(nv.Value); err == nil && code >= 400 {
+			statusCode = code
+		}
+	}
+	message := http.StatusText(statusCode)
+	if ev, ok := rawItem["error"].(*types.AttributeValueMemberS); ok && ev.Value != "" {
+		message = ev.Value
+	}
+
+	return problem.StreamingErrorResponse(statusCode, status, message)
+}
+
+// pollAndReturn waits for the CLI to complete the request and builds the appropriate response.
+// The time the response arrived and any S3 upload and fetch are recorded on timing.
+func pollAndReturn(ctx context.Context, requestID string, timing *serverTiming) (*events.LambdaFunctionURLStreamingResponse, error) {
+	pollTimeout := time.After(responseTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	reqKey := map[string]types.AttributeValue{
+		"request_id": &types.AttributeValueMemberS{Value: requestID},
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errorResponse(499, "Client disconnected")
+		case <-pollTimeout:
+			// The response may have landed after the last, possibly stale, read
+			if rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey, true); err == nil {
+				if resp, done, err := respondFromItem(ctx, requestID, rawItem, timing); done {
+					return resp, err
+				}
+			}
+			return errorResponse(504, "Gateway timeout - no response from tunnel")
+		case <-ticker.C:
+			rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey, consistentPolls)
+			if err != nil {
+				continue
+			}
+			if resp, done, err := respondFromItem(ctx, requestID, rawItem, timing); done {
+				return resp, err
+			}
+		}
+	}
+}
+
+// respondFromItem builds the response to the request once its pending item
+// shows the CLI is done with it; done is false while it is still waiting
+func respondFromItem(ctx context.Context, requestID string, rawItem map[string]types.AttributeValue, timing *serverTiming) (resp *events.LambdaFunctionURLStreamingResponse, done bool, err error) {
+	// SSE / streaming response
+	if isStreamingAV, ok := rawItem["is_streaming"]; ok {
+		if bv, ok := isStreamingAV.(*types.AttributeValueMemberBOOL); ok && bv.Value {
+			timing.ready = time.Now()
+			resp, err := buildStreamingResponse(ctx, requestID, rawItem)
+			return resp, true, err
+		}
+	}
+
+	// S3-staged response (large/binary body)
+	if s3KeyAV, ok := rawItem["s3_response_key"]; ok {
+		if sv, ok := s3KeyAV.(*types.AttributeValueMemberS); ok && sv.Value != "" {
+			// Only act once the CLI has confirmed it uploaded to S3
+			if doneAV, ok2 := rawItem["s3_response_ready"]; ok2 {
+				if bv, ok3 := doneAV.(*types.AttributeValueMemberBOOL); ok3 && bv.Value {
+					timing.ready = time.Now()
+					if nv, ok := rawItem["s3_upload_ms"].(*types.AttributeValueMemberN); ok {
+						ms, _ := strconv.ParseInt(nv.Value, 10, 64)
+						timing.s3Upload = time.Duration(ms) * time.Millisecond
+					}
+					resp, err := buildS3StreamingResponse(ctx, rawItem, sv.Value)
+					timing.s3Fetch = time.Since(timing.ready)
+					return resp, true, err
+				}
+			}
+		}
+	}
+
+	// Buffered response completed, or the request failed for good
+	if sv, ok := rawItem["status"].(*types.AttributeValueMemberS); ok {
+		if sv.Value == "completed" {
+			timing.ready = time.Now()
+			resp, err := buildBufferedResponseFromItem(ctx, rawItem)
+			return resp, true, err
+		}
+		if _, failed := models.PendingRequestErrorStatus(sv.Value); failed {
+			timing.ready = time.Now()
+			resp, err := failedRequestResponse(rawItem, sv.Value)
+			return resp, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// buildS3StreamingResponse fetches the response body from S3 and pipes it to the caller.
+func buildS3StreamingResponse(ctx context.Context, rawItem map[string]types.AttributeValue, s3Key string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	statusCode := 200
+	if sc, ok := rawItem["response_status"]; ok {
+		if nv, ok := sc.(*types.AttributeValueMemberN); ok {
+			statusCode, _ = strconv.Atoi(nv.Value)
+		}
+	}
+
+	headers := map[string]string{}
+	if h, ok := rawItem["response_headers"]; ok {
+		if mv, ok := h.(*types.AttributeValueMemberM); ok {
+			for k, v := range mv.Value {
+				if sv, ok := v.(*types.AttributeValueMemberS); ok {
+					headers[k] = sv.Value
+				}
+			}
+		}
+	}
+
+	if !models.BodyAllowed(statusCode) {
+		return bodylessResponse(statusCode, headers), nil
+	}
+
+	want := stagedChecksumOf(rawItem)
+
+	if redirectLargeBodies && maxInlineResponse > 0 && statusCode == http.StatusOK {
+		if resp := redirectToS3(ctx, s3Key, headers, want); resp != nil {
+			return resp, nil
+		}
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(s3Key),
+	}
+	// Serve a caller's Range from the staged body when the upstream ignored it
+	byteRange := ""
+	if statusCode == http.StatusOK {
+		byteRange = requestedRange(rawItem)
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	result, err := s3Client.GetObject(ctx, input)
+	var apiErr smithy.APIError
+	if byteRange != "" && errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+		return rangeNotSatisfiable(ctx, s3Key)
+	}
+	if err != nil {
+		return errorResponse(502, fmt.Sprintf("Failed to fetch response from S3: %v", err))
+	}
+
+	body := result.Body // S3 GetObject body is already an io.ReadCloser
+	if byteRange != "" {
+		headers["Accept-Ranges"] = "bytes"
+		if result.ContentRange != nil {
+			statusCode = http.StatusPartialContent
+			headers["Content-Range"] = *result.ContentRange
+			delete(headers, "Content-Length")
+		}
+	}
+
+	if want.sha256 != "" {
+		body, err = want.verify(body, result)
+		if err != nil {
+			fmt.Printf("http-proxy: staged response %s failed verification: %v\n", s3Key, err)
+			return errorResponse(502, fmt.Sprintf("Staged response body is corrupt: %v", err))
+		}
+	}
+
+	// Set Content-Length from S3 object if not already in headers
+	if _, ok := headers["Content-Length"]; !ok && result.ContentLength != nil {
+		headers["Content-Length"] = strconv.FormatInt(*result.ContentLength, 10)
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       body,
+	}, nil
+}
+
+// stagedChecksum is what the CLI reported about a body it staged in S3
+type stagedChecksum struct {
+	sha256 string
+	size   int64
+}
+
+// stagedChecksumOf reads the staged body's checksum off the pending request;
+// it is empty for CLIs that did not negotiate checksums
+func stagedChecksumOf(rawItem map[string]types.AttributeValue) stagedChecksum {
+	var c stagedChecksum
+	if sv, ok := rawItem["s3_response_sha256"].(*types.AttributeValueMemberS); ok {
+		c.sha256 = sv.Value
+	}
+	if nv, ok := rawItem["s3_response_bytes"].(*types.AttributeValueMemberN); ok {
+		c.size, _ = strconv.ParseInt(nv.Value, 10, 64)
+	}
+	return c
+}
+
+// objectSize is the full size of a fetched object, also for ranged fetches
+func objectSize(result *s3.GetObjectOutput) int64 {
+	if cr := aws.ToString(result.ContentRange); cr != "" {
+		if i := strings.LastIndex(cr, "/"); i != -1 {
+			if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return aws.ToInt64(result.ContentLength)
+}
+
+// verify checks a fetched staged body against c and returns the reader to
+// serve. A size mismatch (truncated upload) fails up front. The SHA-256 is
+// checked as the body streams, without buffering it, so a mismatch can only
+// abort the stream: its last read is withheld and the caller gets fewer bytes
+// than Content-Length. A range can only be checked for size.
+func (c stagedChecksum) verify(body io.ReadCloser, result *s3.GetObjectOutput) (io.ReadCloser, error) {
+	if size := objectSize(result); size != c.size {
+		body.Close()
+		return nil, fmt.Errorf("size is %d bytes, the CLI uploaded %d", size, c.size)
+	}
+	if result.ContentRange != nil {
+		return body, nil
+	}
+	return &checksumReader{body: body, hash: sha256.New(), want: c.sha256, size: c.size}, nil
+}
+
+// errCorruptBody aborts the stream of a staged body that does not match the
+// checksum the CLI reported
+var errCorruptBody = errors.New("staged response body is corrupt")
+
+// checksumReader hashes a body of a known size as it is read. The read that
+// completes the body is only returned once its SHA-256 matched, so a corrupt
+// body never reaches the caller whole.
+type checksumReader struct {
+	body io.ReadCloser
+	hash hash.Hash
+	want string
+	size int64
+	read int64
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if r.read < r.size {
+		if err == io.EOF {
+			fmt.Printf("http-proxy: staged response ended after %d of %d bytes\n", r.read, r.size)
+			return n, errCorruptBody
+		}
+		return n, err
+	}
+	if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.want {
+		fmt.Printf("http-proxy: staged response SHA-256 is %s, the CLI uploaded %s\n", got, r.want)
+		return 0, errCorruptBody
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.body.Close()
+}
+
+// requestedRange returns the original request's single byte range, or "" if
+// it has none, asks for several ranges or makes it conditional with If-Range
+func requestedRange(rawItem map[string]types.AttributeValue) string {
+	m, ok := rawItem["headers"].(*types.AttributeValueMemberM)
+	if !ok {
+		return ""
+	}
+	byteRange := ""
+	for name, v := range m.Value {
+		sv, ok := v.(*types.AttributeValueMemberS)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "range":
+			byteRange = strings.TrimSpace(sv.Value)
+		case "if-range":
+			return ""
+		}
+	}
+	if !strings.HasPrefix(byteRange, "bytes=") || strings.Contains(byteRange, ",") {
+		return ""
+	}
+	return byteRange
+}
+
+// rangeNotSatisfiable answers a Range that lies outside the staged body
+func rangeNotSatisfiable(ctx context.Context, s3Key string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	resp, _ := errorResponse(http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(s3Key),
+	})
+	if err == nil && head.ContentLength != nil {
+		resp.Headers["Content-Range"] = fmt.Sprintf("bytes */%d", *head.ContentLength)
+	}
+	return resp, nil
+}
+
+// redirectToS3 answers with a 307 to a short-lived presigned GET URL of the
+// staged body when it is over the inline cap, so huge downloads come straight
+// from S3 instead of through the Lambda. The upstream content headers are
+// carried over as response overrides. Returns nil to pipe the body instead,
+// and a 502 when the body's size does not match its checksum.
+func redirectToS3(ctx context.Context, s3Key string, headers map[string]string, want stagedChecksum) *events.LambdaFunctionURLStreamingResponse {
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil || aws.ToInt64(head.ContentLength) <= maxInlineResponse {
+		return nil
+	}
+	// The caller downloads straight from S3, so only the size can be checked
+	if want.sha256 != "" && aws.ToInt64(head.ContentLength) != want.size {
+		resp, _ := errorResponse(502, fmt.Sprintf("Staged response body is corrupt: size is %d bytes, the CLI uploaded %d", aws.ToInt64(head.ContentLength), want.size))
+		return resp
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(s3Key),
+	}
+	if v := headers["Content-Type"]; v != "" {
+		input.ResponseContentType = aws.String(v)
+	}
+	if v := headers["Content-Disposition"]; v != "" {
+		input.ResponseContentDisposition = aws.String(v)
+	}
+	if v := headers["Content-Encoding"]; v != "" {
+		input.ResponseContentEncoding = aws.String(v)
+	}
+	if v := headers["Cache-Control"]; v != "" {
+		input.ResponseCacheControl = aws.String(v)
+	}
+	presigned, err := s3PresignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(redirectURLExpiry))
+	if err != nil {
+		fmt.Printf("http-proxy: failed to presign redirect for %s: %v\n", s3Key, err)
+		return nil
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusTemporaryRedirect,
+		Headers: map[string]string{
+			"Location":      presigned.URL,
+			"Cache-Control": "no-store",
+		},
+	}
+}
+
+// buildStreamingResponse creates a pipe-backed streaming response that forwards
+// SSE chunks from the stream chunks table to the HTTP caller as they arrive.
+// Each poll reads only the chunks not forwarded yet; the pending request is
+// read only when none came, to learn whether the stream has ended.
+func buildStreamingResponse(ctx context.Context, requestID string, firstItem map[string]types.AttributeValue) (*events.LambdaFunctionURLStreamingResponse, error) {
+	statusCode := 200
+	if sc, ok := firstItem["stream_status"]; ok {
+		if nv, ok := sc.(*types.AttributeValueMemberN); ok {
+			statusCode, _ = strconv.Atoi(nv.Value)
+		}
+	}
+
+	headers := map[string]string{}
+	if h, ok := firstItem["stream_headers"]; ok {
+		if mv, ok := h.(*types.AttributeValueMemberM); ok {
+			for k, v := range mv.Value {
+				if sv, ok := v.(*types.AttributeValueMemberS); ok {
+					headers[k] = sv.Value
+				}
+			}
+		}
+	}
+
+	tunnelID := ""
+	if tv, ok := firstItem["tunnel_id"].(*types.AttributeValueMemberS); ok {
+		tunnelID = tv.Value
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer pw.Close()
+
+		streamTimeout := time.After(180 * time.Second)
+		interval := streamPollInterval
+		poll := time.NewTimer(interval)
+		defer poll.Stop()
+
+		nextChunk := 0
+		var endedAt time.Time
+		reqKey := map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-streamTimeout:
+				return
+			case <-poll.C:
+			}
+
+			chunks, err := streamChunkRepo.From(ctx, requestID, tunnelID, nextChunk)
+			if err != nil {
+				fmt.Printf("http-proxy: %v\n", err)
+			}
+
+			// Forward the chunks that follow on from the last one; a gap is a
+			// chunk still being stored, which the next poll picks up
+			forwarded := false
+			for _, chunk := range chunks {
+				if chunk.Seq != nextChunk {
+					break
+				}
+				if _, err := io.WriteString(pw, chunk.Data); err != nil {
+					return
+				}
+				nextChunk++
+				forwarded = true
+			}
+
+			if forwarded {
+				interval = streamPollInterval
+			} else {
+				// Stop once the CLI ended the stream (or the request failed)
+				// and every chunk it sent was forwarded
+				ended, total := streamEnded(ctx, reqKey)
+				if ended && endedAt.IsZero() {
+					endedAt = time.Now()
+				}
+				if ended && (nextChunk >= total || time.Since(endedAt) > streamEndGrace) {
+					if nextChunk < total {
+						fmt.Printf("http-proxy: stream of request %s ended with %d of %d chunks\n", requestID, nextChunk, total)
+					}
+					return
+				}
+				interval = min(interval*2, maxStreamPollInterval)
+			}
+			poll.Reset(interval)
+		}
+	}()
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       pr,
+	}, nil
+}
+
+// streamEnded reports whether a streamed request has ended, and how many
+// chunks its CLI sent when it said so. The read is consistent like the chunk
+// reads, so a stream the CLI just ended is not held open for another, backed
+// off, poll.
+func streamEnded(ctx context.Context, reqKey map[string]types.AttributeValue) (bool, int) {
+	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey, true)
+	if err != nil {
+		return false, 0
+	}
+	done, ok := rawItem["stream_done"].(*types.AttributeValueMemberBOOL)
+	if !ok || !done.Value {
+		return false, 0
+	}
+	total := 0
+	if nv, ok := rawItem["stream_chunk_count"].(*types.AttributeValueMemberN); ok {
+		total, _ = strconv.Atoi(nv.Value)
+	}
+	return true, total
+}
+
+// buildBufferedResponseFromItem returns a completed buffered response.
+func buildBufferedResponseFromItem(ctx context.Context, rawItem map[string]types.AttributeValue) (*events.LambdaFunctionURLStreamingResponse, error) {
+	// Check for S3-staged response first (large body)
+	if s3KeyAV, ok := rawItem["s3_response_key"]; ok {
+		if sv, ok := s3KeyAV.(*types.AttributeValueMemberS); ok && sv.Value != "" {
+			if doneAV, ok2 := rawItem["s3_response_ready"]; ok2 {
+				if bv, ok3 := doneAV.(*types.AttributeValueMemberBOOL); ok3 && bv.Value {
+					return buildS3StreamingResponse(ctx, rawItem, sv.Value)
+				}
+			}
+		}
+	}
+	return buildBufferedResponse(rawItem)
+}
+
+// buildBufferedResponse returns the full body at once for non-streaming responses.
+func buildBufferedResponse(rawItem map[string]types.AttributeValue) (*events.LambdaFunctionURLStreamingResponse, error) {
+	statusCode := 200
+	if sc, ok := rawItem["response_status"]; ok {
+		if nv, ok := sc.(*types.AttributeValueMemberN); ok {
+			statusCode, _ = strconv.Atoi(nv.Value)
+		}
+	}
+
+	headers := map[string]string{}
+	if h, ok := rawItem["response_headers"]; ok {
+		if mv, ok := h.(*types.AttributeValueMemberM); ok {
+			for k, v := range mv.Value {
+				if sv, ok := v.(*types.AttributeValueMemberS); ok {
+					headers[k] = sv.Value
+				}
+			}
+		}
+	}
+
+	if !models.BodyAllowed(statusCode) {
+		return bodylessResponse(statusCode, headers), nil
+	}
+
+	responseBody := ""
+	if bodyAV, ok := rawItem["response_body"]; ok {
+		if sv, ok := bodyAV.(*types.AttributeValueMemberS); ok {
+			responseBody = sv.Value
+		}
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       bytes.NewReader([]byte(responseBody)),
+	}, nil
+}
+
+// bodylessResponse passes on a response that has no body by definition, such
+// as a 304 answering If-None-Match or If-Modified-Since. Its validators (ETag,
+// Last-Modified) are kept; Content-Length describes the full representation
+// rather than this response, so it is dropped along with Transfer-Encoding.
+func bodylessResponse(statusCode int, headers map[string]string) *events.LambdaFunctionURLStreamingResponse {
+	for name := range headers {
+		switch strings.ToLower(name) {
+		case "content-length", "transfer-encoding":
+			delete(headers, name)
+		}
+	}
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+	}
+}
+
+func errorResponse(statusCode int, message string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	return problem.StreamingErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
@@ -0,0 +1,79 @@
+package httpproxy
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+)
+
+// defaultLandingPage is served for unknown subdomains unless
+// LANDING_PAGE_TEMPLATE replaces it
+//
+//go:embed landing.html
+var defaultLandingPage string
+
+var landingPage = loadLandingPage()
+
+// landingPageData is what the landing page template can use
+type landingPageData struct {
+	Subdomain  string // e.g. myapp
+	Domain     string // e.g. myapp.tunnel.example.com
+	BaseDomain string // e.g. tunnel.example.com
+}
+
+// loadLandingPage parses LANDING_PAGE_TEMPLATE, an html/template, falling back
+// to the built-in page when it is unset or invalid
+func loadLandingPage() *template.Template {
+	if custom := os.Getenv("LANDING_PAGE_TEMPLATE"); custom != "" {
+		tmpl, err := template.New("landing").Parse(custom)
+		if err == nil {
+			return tmpl
+		}
+		fmt.Fprintf(os.Stderr, "Invalid LANDING_PAGE_TEMPLATE: %v, using the default page\n", err)
+	}
+	return template.Must(template.New("landing").Parse(defaultLandingPage))
+}
+
+// acceptsHTML reports whether the caller is a browser rather than an API client
+func acceptsHTML(request events.APIGatewayV2HTTPRequest) bool {
+	for name, value := range request.Headers {
+		if strings.EqualFold(name, "accept") {
+			return strings.Contains(value, "text/html")
+		}
+	}
+	return false
+}
+
+// unknownSubdomainResponse answers a request for a subdomain no tunnel is
+// mapped to: browsers get the landing page, everyone else the JSON 404
+func unknownSubdomainResponse(request events.APIGatewayV2HTTPRequest, subdomain string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if !acceptsHTML(request) {
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	var page bytes.Buffer
+	err := landingPage.Execute(&page, landingPageData{
+		Subdomain:  subdomain,
+		Domain:     subdomain + "." + domainName,
+		BaseDomain: domainName,
+	})
+	if err != nil {
+		fmt.Printf("http-proxy: failed to render landing page: %v\n", err)
+		return problem.StreamingErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: 404,
+		Headers: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-store",
+		},
+		Body: &page,
+	}, nil
+}
@@ -0,0 +1,33 @@
+package httpproxy
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// methodNotAllowedResponse rejects methods outside a tunnel's AllowedMethods
+// with a 405 listing the allowed ones. HEAD is allowed wherever GET is, and
+// the login page of a password-protected tunnel takes any method. It returns
+// nil for allowed methods.
+func methodNotAllowedResponse(tunnel *models.Tunnel, method, proxyPath string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	allowed := tunnel.AllowedMethods
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	if path, _, _ := strings.Cut(proxyPath, "?"); tunnel.PasswordHash != "" && path == loginPath {
+		return nil, nil
+	}
+	if slices.Contains(allowed, "GET") && !slices.Contains(allowed, "HEAD") {
+		allowed = append(slices.Clone(allowed), "HEAD")
+	}
+	if slices.Contains(allowed, strings.ToUpper(method)) {
+		return nil, nil
+	}
+
+	resp, err := errorResponse(405, "Method "+method+" is not allowed on this tunnel")
+	resp.Headers["Allow"] = strings.Join(allowed, ", ")
+	return resp, err
+}
@@ -0,0 +1,188 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/ratelimit"
+)
+
+const (
+	// loginPath receives the login form on every password-protected tunnel;
+	// it is never forwarded to the local service
+	loginPath = "/__tunnel/login"
+	// sessionCookie holds a visitor's tunnel session
+	sessionCookie = "tunnel_session"
+	// loginAttemptLimit bounds password attempts per source IP and tunnel in
+	// each ratelimit.Window
+	loginAttemptLimit = 5
+)
+
+//go:embed login.html
+var loginPageSource string
+
+var loginPage = template.Must(template.New("login").Parse(loginPageSource))
+
+// sessionSecret signs tunnel session cookies
+var sessionSecret = []byte(os.Getenv("SESSION_SECRET"))
+
+// loginPageData is what the login page template can use
+type loginPageData struct {
+	Domain string
+	Action string
+	Next   string
+	Error  string
+}
+
+// passwordGate keeps visitors without a valid session off a password-protected
+// tunnel: it handles the login form, answers browsers with the login page and
+// other callers with a JSON 401. For visitors with a session it strips the
+// session cookie from request, which is then forwarded as usual, and returns
+// nil.
+func passwordGate(ctx context.Context, tunnel *models.Tunnel, request *events.APIGatewayV2HTTPRequest, proxyPath, body string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if tunnel.PasswordHash == "" {
+		return nil, nil
+	}
+	if len(sessionSecret) == 0 {
+		return errorResponse(500, "Password protection is not configured")
+	}
+
+	path, _, _ := strings.Cut(proxyPath, "?")
+	if path == loginPath {
+		if request.RequestContext.HTTP.Method != http.MethodPost {
+			return loginPageResponse(tunnel, "/", "", http.StatusOK)
+		}
+		return handleLogin(ctx, tunnel, request, body)
+	}
+
+	if session, ok := takeSessionCookie(request); ok && auth.VerifyTunnelSession(sessionSecret, session, tunnel.TunnelID, tunnel.PasswordHash) == nil {
+		return nil, nil
+	}
+	if !acceptsHTML(*request) {
+		return problem.StreamingErrorResponse(401, problem.CodePasswordRequired, "This tunnel is password protected; log in at "+loginPath)
+	}
+	return loginPageResponse(tunnel, proxyPath, "", http.StatusUnauthorized)
+}
+
+// handleLogin checks a submitted password and, if it is right, starts a
+// session and sends the visitor back to where they were going
+func handleLogin(ctx context.Context, tunnel *models.Tunnel, request *events.APIGatewayV2HTTPRequest, body string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		return errorResponse(400, "Invalid login form")
+	}
+	next := safeNext(form.Get("next"))
+
+	if rateLimitsTable != "" {
+		key := "login#" + tunnel.TunnelID + "#" + request.RequestContext.HTTP.SourceIP
+		count, err := ratelimit.Hit(ctx, dbClient, rateLimitsTable, key)
+		if err != nil {
+			fmt.Printf("http-proxy: %v\n", err)
+		} else if count > loginAttemptLimit {
+			return loginPageResponse(tunnel, next, "Too many attempts, wait a few seconds and try again.", http.StatusTooManyRequests)
+		}
+	}
+
+	if !auth.VerifyTunnelPassword(form.Get("password"), tunnel.PasswordHash) {
+		return loginPageResponse(tunnel, next, "Wrong password.", http.StatusUnauthorized)
+	}
+
+	session, expiresAt := auth.MintTunnelSession(sessionSecret, tunnel.TunnelID, tunnel.PasswordHash)
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers: map[string]string{
+			"Location":      next,
+			"Cache-Control": "no-store",
+		},
+		Cookies: []string{cookie.String()},
+	}, nil
+}
+
+// safeNext only lets the login form redirect to a path on the tunnel itself
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || next == loginPath {
+		return "/"
+	}
+	return next
+}
+
+func loginPageResponse(tunnel *models.Tunnel, next, message string, statusCode int) (*events.LambdaFunctionURLStreamingResponse, error) {
+	var page bytes.Buffer
+	err := loginPage.Execute(&page, loginPageData{
+		Domain: tunnel.Domain,
+		Action: loginPath,
+		Next:   safeNext(next),
+		Error:  message,
+	})
+	if err != nil {
+		fmt.Printf("http-proxy: failed to render login page: %v\n", err)
+		return problem.StreamingErrorResponse(401, problem.CodePasswordRequired, "This tunnel is password protected")
+	}
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-store",
+		},
+		Body: &page,
+	}, nil
+}
+
+// takeSessionCookie returns the tunnel session cookie and removes it from the
+// request, whose cookies arrive in Cookies (Function URL) or in the Cookie
+// header (REST API and ALB)
+func takeSessionCookie(request *events.APIGatewayV2HTTPRequest) (string, bool) {
+	var session string
+	var found bool
+
+	kept := request.Cookies[:0]
+	for _, c := range request.Cookies {
+		if name, value, _ := strings.Cut(c, "="); strings.TrimSpace(name) == sessionCookie {
+			session, found = value, true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	request.Cookies = kept
+
+	for name, header := range request.Headers {
+		if !strings.EqualFold(name, "cookie") {
+			continue
+		}
+		var rest []string
+		for _, c := range strings.Split(header, ";") {
+			if cname, value, _ := strings.Cut(strings.TrimSpace(c), "="); cname == sessionCookie {
+				session, found = value, true
+				continue
+			}
+			rest = append(rest, strings.TrimSpace(c))
+		}
+		if len(rest) == 0 {
+			delete(request.Headers, name)
+		} else {
+			request.Headers[name] = strings.Join(rest, "; ")
+		}
+	}
+	return session, found
+}
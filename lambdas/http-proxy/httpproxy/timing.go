@@ -0,0 +1,63 @@
+package httpproxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// serverTiming collects where a proxied request's time went, for the
+// Server-Timing response header
+type serverTiming struct {
+	start      time.Time     // http-proxy received the request
+	queued     time.Duration // waiting for one of the tunnel's request slots
+	dispatched time.Time     // the proxy message was handed to the CLI's connection
+	ready      time.Time     // the CLI's response showed up in the pending request
+	s3Upload   time.Duration // the CLI staging its response in S3, as it reported it
+	s3Fetch    time.Duration // opening (and, when verified up front, reading) a staged body
+}
+
+// header renders the metrics known so far: edge-dispatch from arrival to the
+// proxy message being sent (including queue), cli-wait until the CLI's
+// response arrived (of which s3-upload staged it), and s3-fetch for staged
+// bodies
+func (t *serverTiming) header() string {
+	metrics := []string{metric("edge-dispatch", t.dispatched.Sub(t.start))}
+	if t.queued > 0 {
+		metrics = append(metrics, metric("queue", t.queued))
+	}
+	if !t.ready.IsZero() {
+		metrics = append(metrics, metric("cli-wait", t.ready.Sub(t.dispatched)))
+	}
+	if t.s3Upload > 0 {
+		metrics = append(metrics, metric("s3-upload", t.s3Upload))
+	}
+	if t.s3Fetch > 0 {
+		metrics = append(metrics, metric("s3-fetch", t.s3Fetch))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func metric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000)
+}
+
+// addServerTiming appends t's metrics to resp's Server-Timing header, after
+// any the local service set itself
+func addServerTiming(resp *events.LambdaFunctionURLStreamingResponse, t *serverTiming) {
+	if resp == nil {
+		return
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	for name, value := range resp.Headers {
+		if strings.EqualFold(name, "server-timing") {
+			resp.Headers[name] = value + ", " + t.header()
+			return
+		}
+	}
+	resp.Headers["Server-Timing"] = t.header()
+}
@@ -0,0 +1,294 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+)
+
+// S3 limits that decide how a body is uploaded
+const (
+	maxSinglePutBytes = 5 << 30 // Largest body one PUT may carry; larger ones use multipart
+	maxObjectBytes    = 5 << 40 // Largest object S3 stores
+	minPartBytes      = 128 << 20
+	maxUploadParts    = 1000 // Keeps the part URLs in a response of reasonable size
+)
+
+// uploadURLExpiry is how long upload URLs and the pending request stay valid;
+// multipart uploads of bodies over 5 GB get longer
+const (
+	uploadURLExpiry    = 30 * time.Minute
+	multipartURLExpiry = 2 * time.Hour
+)
+
+// Upload methods returned by /upload-url
+const (
+	uploadMethodPut       = "PUT"       // Send the body to upload_url with upload_headers
+	uploadMethodPost      = "POST"      // Send a multipart/form-data POST of upload_fields and a "file" field
+	uploadMethodMultipart = "MULTIPART" // PUT each part to its URL, then POST the ETags to complete_url
+)
+
+// uploadConstraints are the optional limits the caller of /upload-url puts on
+// its own upload, which S3 enforces
+type uploadConstraints struct {
+	Size        int64  `json:"size"`         // Exact body size; S3 rejects any other
+	MaxSize     int64  `json:"max_size"`     // Largest body S3 accepts; the upload becomes a form POST
+	ContentType string `json:"content_type"` // Content-Type the body must be uploaded with
+	Checksum    bool   `json:"checksum"`     // S3 rejects a body that does not match the metadata's sha256
+}
+
+// uploadTarget is where and how the caller uploads the body
+type uploadTarget struct {
+	Method      string            `json:"upload_method"`
+	URL         string            `json:"upload_url,omitempty"`
+	Headers     map[string]string `json:"upload_headers,omitempty"`
+	Fields      map[string]string `json:"upload_fields,omitempty"`
+	UploadID    string            `json:"upload_id,omitempty"`
+	PartSize    int64             `json:"part_size,omitempty"`
+	PartURLs    []string          `json:"part_urls,omitempty"`
+	CompleteURL string            `json:"complete_url,omitempty"`
+}
+
+// validate checks the constraints, given the body's hex SHA-256 from the
+// metadata
+func (c *uploadConstraints) validate(sha256Hex string) error {
+	switch {
+	case c.Size < 0 || c.MaxSize < 0:
+		return fmt.Errorf("size and max_size must not be negative")
+	case c.Size > maxObjectBytes:
+		return fmt.Errorf("size must be at most 5 TB")
+	case c.MaxSize > maxSinglePutBytes:
+		return fmt.Errorf("max_size must be at most 5 GB; give the exact size for larger bodies")
+	case c.Size > 0 && c.MaxSize > 0 && c.Size > c.MaxSize:
+		return fmt.Errorf("size is larger than max_size")
+	case c.Checksum && sha256Hex == "":
+		return fmt.Errorf("checksum needs the body's sha256")
+	case c.Checksum && (c.MaxSize > 0 || c.multipart()):
+		return fmt.Errorf("checksum only applies to single PUT uploads without max_size")
+	}
+	if c.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(c.ContentType); err != nil {
+			return fmt.Errorf("content_type is not a media type")
+		}
+	}
+	return nil
+}
+
+// multipart reports whether the body is too large for a single PUT
+func (c *uploadConstraints) multipart() bool {
+	return c.Size > maxSinglePutBytes
+}
+
+// expiry is how long the upload may take
+func (c *uploadConstraints) expiry() time.Duration {
+	if c.multipart() {
+		return multipartURLExpiry
+	}
+	return uploadURLExpiry
+}
+
+// contentType is what the body is stored as
+func (c *uploadConstraints) contentType() string {
+	if c.ContentType != "" {
+		return c.ContentType
+	}
+	return "application/octet-stream"
+}
+
+// presignUpload prepares the upload of the body to key under the constraints
+func presignUpload(ctx context.Context, key, requestID, sha256Hex string, c uploadConstraints) (*uploadTarget, error) {
+	switch {
+	case c.multipart():
+		return initiateMultipart(ctx, key, requestID, c)
+	case c.MaxSize > 0:
+		return presignPostUpload(ctx, key, c)
+	}
+
+	// Signed headers bind the upload: content-type always, content-length
+	// and the checksum when asked for
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(uploadsBucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(c.contentType()),
+	}
+	headers := map[string]string{"Content-Type": c.contentType()}
+	if c.Size > 0 {
+		input.ContentLength = aws.Int64(c.Size)
+		headers["Content-Length"] = fmt.Sprint(c.Size)
+	}
+	if c.Checksum {
+		sum, _ := hex.DecodeString(sha256Hex)
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum))
+		headers["x-amz-checksum-sha256"] = *input.ChecksumSHA256
+	}
+	presigned, err := s3PresignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(c.expiry()))
+	if err != nil {
+		return nil, err
+	}
+	return &uploadTarget{Method: uploadMethodPut, URL: presigned.URL, Headers: headers}, nil
+}
+
+// presignPostUpload presigns a form POST whose policy caps the body at
+// MaxSize, which a presigned PUT cannot express
+func presignPostUpload(ctx context.Context, key string, c uploadConstraints) (*uploadTarget, error) {
+	conditions := []interface{}{
+		[]interface{}{"content-length-range", 1, c.MaxSize},
+		map[string]string{"Content-Type": c.contentType()},
+	}
+	presigned, err := s3PresignClient.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(uploadsBucket),
+		Key:    aws.String(key),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = c.expiry()
+		o.Conditions = conditions
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{"Content-Type": c.contentType()}
+	for name, value := range presigned.Values {
+		fields[name] = value
+	}
+	return &uploadTarget{Method: uploadMethodPost, URL: presigned.URL, Fields: fields}, nil
+}
+
+// initiateMultipart starts a multipart upload for a body over 5 GB and
+// presigns a PUT per part. Each part's content-length is signed, partSize for
+// all but the last, so the parts can only add up to the declared size. S3
+// sends the object-created event, and so the request on to the tunnel, once
+// the caller completes the upload.
+func initiateMultipart(ctx context.Context, key, requestID string, c uploadConstraints) (*uploadTarget, error) {
+	partSize := max(minPartBytes, (c.Size+maxUploadParts-1)/maxUploadParts)
+	parts := int((c.Size + partSize - 1) / partSize)
+
+	created, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(uploadsBucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(c.contentType()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	target := &uploadTarget{
+		Method:      uploadMethodMultipart,
+		UploadID:    aws.ToString(created.UploadId),
+		PartSize:    partSize,
+		PartURLs:    make([]string, 0, parts),
+		CompleteURL: "/upload-complete/" + requestID,
+	}
+	for part := 1; part <= parts; part++ {
+		size := min(partSize, c.Size-int64(part-1)*partSize)
+		presigned, err := s3PresignClient.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(uploadsBucket),
+			Key:           aws.String(key),
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(int32(part)),
+			ContentLength: aws.Int64(size),
+		}, s3.WithPresignExpires(c.expiry()))
+		if err != nil {
+			abortMultipart(ctx, key, target.UploadID)
+			return nil, fmt.Errorf("failed to presign part %d: %w", part, err)
+		}
+		target.PartURLs = append(target.PartURLs, presigned.URL)
+	}
+	return target, nil
+}
+
+func abortMultipart(ctx context.Context, key, uploadID string) {
+	if _, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(uploadsBucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}); err != nil {
+		fmt.Printf("Failed to abort multipart upload %s: %v\n", uploadID, err)
+	}
+}
+
+// handleUploadComplete completes the multipart upload of a request body with
+// the ETags S3 returned for its parts:
+// POST /upload-complete/{request_id} {"parts": [{"part_number": 1, "etag": "..."}]}
+func handleUploadComplete(ctx context.Context, request events.APIGatewayV2HTTPRequest, requestID string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if uploadsBucket == "" {
+		return errorResponse(503, "Large upload support not configured (UPLOADS_BUCKET missing)")
+	}
+
+	var body struct {
+		Parts []struct {
+			PartNumber int32  `json:"part_number"`
+			ETag       string `json:"etag"`
+		} `json:"parts"`
+	}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || len(body.Parts) == 0 {
+		return errorResponse(400, "parts must list the part_number and etag of every uploaded part")
+	}
+
+	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, map[string]types.AttributeValue{
+		"request_id": &types.AttributeValueMemberS{Value: requestID},
+	}, false)
+	if err != nil || rawItem == nil || pastTTL(rawItem) {
+		return problem.StreamingErrorResponse(404, problem.CodeRequestNotFound, "Request not found")
+	}
+	key, _ := rawItem["s3_request_key"].(*types.AttributeValueMemberS)
+	uploadID, _ := rawItem["upload_id"].(*types.AttributeValueMemberS)
+	if key == nil || uploadID == nil {
+		return errorResponse(400, "Request has no multipart upload")
+	}
+
+	parts := make([]s3types.CompletedPart, 0, len(body.Parts))
+	for _, p := range body.Parts {
+		if p.PartNumber < 1 || p.ETag == "" {
+			return errorResponse(400, "every part needs a part_number from 1 and an etag")
+		}
+		parts = append(parts, s3types.CompletedPart{PartNumber: aws.Int32(p.PartNumber), ETag: aws.String(p.ETag)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	if _, err := s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(uploadsBucket),
+		Key:             aws.String(key.Value),
+		UploadId:        aws.String(uploadID.Value),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return errorResponse(400, fmt.Sprintf("Failed to complete upload: %v", err))
+	}
+
+	respBody, _ := json.Marshal(map[string]string{
+		"request_id": requestID,
+		"poll_url":   fmt.Sprintf("/poll/%s", requestID),
+	})
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       bytes.NewReader(respBody),
+	}, nil
+}
+
+// recordUploadID keeps a multipart upload's ID on its pending request for
+// handleUploadComplete
+func recordUploadID(ctx context.Context, requestID, uploadID string) error {
+	return dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET upload_id = :upload_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":upload_id": &types.AttributeValueMemberS{Value: uploadID},
+		},
+	})
+}
@@ -0,0 +1,192 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+type fakeDomains struct {
+	repository.DomainRepository
+	tunnelID string
+}
+
+func (f fakeDomains) Get(_ context.Context, domain string) (*models.Domain, error) {
+	return &models.Domain{Domain: domain, TunnelID: f.tunnelID}, nil
+}
+
+type fakeTunnels struct {
+	repository.TunnelRepository
+	tunnel *models.Tunnel
+}
+
+func (f fakeTunnels) Get(context.Context, string) (*models.Tunnel, error) {
+	return f.tunnel, nil
+}
+
+type fakePending struct {
+	repository.PendingRequestRepository
+	stored []models.PendingRequest
+}
+
+func (f *fakePending) Put(_ context.Context, request models.PendingRequest) error {
+	f.stored = append(f.stored, request)
+	return nil
+}
+
+// uploadURLRequest is a POST /upload-url/myapp/files/report.pdf carrying meta
+func uploadURLRequest(meta string) events.APIGatewayV2HTTPRequest {
+	request := events.APIGatewayV2HTTPRequest{
+		RawPath: "/upload-url/myapp/files/report.pdf",
+		Headers: map[string]string{"content-type": "application/json"},
+		Body:    meta,
+	}
+	request.RequestContext.HTTP.Method = "POST"
+	request.RequestContext.HTTP.SourceIP = "203.0.113.7"
+	return request
+}
+
+// useTunnel points the package's repositories at tunnel and returns the fake
+// pending requests store
+func useTunnel(t *testing.T, tunnel *models.Tunnel) *fakePending {
+	t.Helper()
+	pending := &fakePending{}
+	oldDomains, oldTunnels, oldPending := domainRepo, tunnelRepo, pendingRepo
+	oldBucket, oldDomain, oldSecret := uploadsBucket, domainName, sessionSecret
+	t.Cleanup(func() {
+		domainRepo, tunnelRepo, pendingRepo = oldDomains, oldTunnels, oldPending
+		uploadsBucket, domainName, sessionSecret = oldBucket, oldDomain, oldSecret
+	})
+
+	domainRepo = fakeDomains{tunnelID: tunnel.TunnelID}
+	tunnelRepo = fakeTunnels{tunnel: tunnel}
+	pendingRepo = pending
+	uploadsBucket = "uploads"
+	domainName = "tunnel.test"
+	sessionSecret = []byte("test-session-secret")
+	return pending
+}
+
+func TestUploadURLAppliesTunnelGates(t *testing.T) {
+	tests := []struct {
+		name   string
+		tunnel models.Tunnel
+		meta   string
+		want   int
+	}{
+		{
+			name:   "private tunnel without access token",
+			tunnel: models.Tunnel{Visibility: models.TunnelVisibilityPrivate, AccessKey: "access-key"},
+			meta:   `{"method":"POST"}`,
+			want:   401,
+		},
+		{
+			name:   "password tunnel without session",
+			tunnel: models.Tunnel{PasswordHash: "$2a$10$abcdefghijklmnopqrstuv"},
+			meta:   `{"method":"POST"}`,
+			want:   401,
+		},
+		{
+			name:   "method outside allowed methods",
+			tunnel: models.Tunnel{AllowedMethods: []string{"GET"}},
+			meta:   `{"method":"DELETE"}`,
+			want:   405,
+		},
+		{
+			name:   "missing required header",
+			tunnel: models.Tunnel{RequiredHeaders: []string{"x-api-key: secret"}},
+			meta:   `{"method":"POST","headers":{"x-api-key":"wrong"}}`,
+			want:   403,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := tt.tunnel
+			tunnel.TunnelID = "tunnel-1"
+			tunnel.Status = models.TunnelStatusActive
+			pending := useTunnel(t, &tunnel)
+
+			resp, err := handleUploadURL(context.Background(), uploadURLRequest(tt.meta))
+			if err != nil {
+				t.Fatalf("handleUploadURL: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if len(pending.stored) > 0 {
+				t.Errorf("stored a pending request for a rejected upload: %+v", pending.stored[0])
+			}
+		})
+	}
+}
+
+func TestUploadURLRequiresPasswordSession(t *testing.T) {
+	tunnel := &models.Tunnel{
+		TunnelID:     "tunnel-1",
+		Status:       models.TunnelStatusActive,
+		PasswordHash: "$2a$10$abcdefghijklmnopqrstuv",
+	}
+
+	t.Run("forged session", func(t *testing.T) {
+		pending := useTunnel(t, tunnel)
+		request := uploadURLRequest(`{"method":"POST"}`)
+		request.Cookies = []string{sessionCookie + "=forged"}
+
+		resp, err := handleUploadURL(context.Background(), request)
+		if err != nil {
+			t.Fatalf("handleUploadURL: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 401 || !strings.Contains(string(body), problem.CodePasswordRequired) {
+			t.Errorf("got %d %s, want 401 %s", resp.StatusCode, body, problem.CodePasswordRequired)
+		}
+		if len(pending.stored) > 0 {
+			t.Errorf("stored a pending request without a session")
+		}
+	})
+
+	t.Run("login path", func(t *testing.T) {
+		pending := useTunnel(t, tunnel)
+		request := uploadURLRequest(`{"method":"POST"}`)
+		request.RawPath = "/upload-url/myapp" + loginPath
+
+		resp, err := handleUploadURL(context.Background(), request)
+		if err != nil {
+			t.Fatalf("handleUploadURL: %v", err)
+		}
+		if resp.StatusCode != 404 || len(resp.Cookies) > 0 {
+			t.Errorf("got %d with cookies %v, want 404 without a session", resp.StatusCode, resp.Cookies)
+		}
+		if len(pending.stored) > 0 {
+			t.Errorf("stored a pending request for the login path")
+		}
+	})
+
+	t.Run("valid session", func(t *testing.T) {
+		useTunnel(t, tunnel)
+		session, _ := auth.MintTunnelSession(sessionSecret, tunnel.TunnelID, tunnel.PasswordHash)
+		request := uploadURLRequest(`{"method":"POST"}`)
+		request.Cookies = []string{sessionCookie + "=" + session}
+		headers := map[string]string{}
+
+		resp, err := admitRequest(context.Background(), tunnel, &request, admission{
+			method:      "POST",
+			proxyPath:   "/files/report.pdf",
+			headers:     headers,
+			forwardPath: "/upload-url/myapp/files/report.pdf",
+		}, &models.RequestLog{})
+		if resp != nil || err != nil {
+			t.Fatalf("admitRequest rejected a valid session: %+v %v", resp, err)
+		}
+		if cookie := request.Headers["cookie"]; strings.Contains(cookie, sessionCookie) {
+			t.Errorf("session cookie left on the request: %q", cookie)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+const (
+	defaultEventsLimit = 50
+	maxEventsLimit     = 200
+)
+
+var (
+	clientsTable string
+	tunnelsTable string
+	eventsTable  string
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+	tunnelRepo   repository.TunnelRepository
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" || eventsTable == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	// Verify client exists and get client ID
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("list-tunnel-events: %v", err)
+	}
+
+	// Get tunnel ID from path parameters
+	tunnelID := request.PathParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	limit := defaultEventsLimit
+	if raw := request.QueryStringParameters["limit"]; raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return errorResponse(400, "limit must be a positive integer")
+		}
+		if limit > maxEventsLimit {
+			limit = maxEventsLimit
+		}
+	}
+
+	// Get tunnel from database
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
+	if err != nil {
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	// Verify tunnel belongs to client
+	if tunnel.ClientID != clientID {
+		return errorResponse(403, "Unauthorized to view this tunnel")
+	}
+
+	tunnelEvents, err := history.List(ctx, dbClient, eventsTable, tunnelID, int32(limit))
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to query tunnel events: %v", err))
+	}
+
+	// Return response
+	response := api.ListTunnelEventsResponse{
+		Events: tunnelEvents,
+		Count:  len(tunnelEvents),
+	}
+
+	return successResponse(200, response)
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
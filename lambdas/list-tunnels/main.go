@@ -3,39 +3,46 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
 	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
-	clientsTable string
-	tunnelsTable string
-	dbClient     *db.DynamoDBClient
+	clientsTable      string
+	tunnelsTable      string
+	websocketEndpoint string
+	dbClient          *db.DynamoDBClient
+	clientRepo        repository.ClientRepository
+	tunnelRepo        repository.TunnelRepository
 )
 
 func init() {
 	clientsTable = os.Getenv("CLIENTS_TABLE")
 	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
 
 	if clientsTable == "" || tunnelsTable == "" {
 		panic("Required environment variables are missing")
 	}
 }
 
-type ListTunnelsResponse struct {
-	Tunnels []models.Tunnel `json:"tunnels"`
-	Count   int             `json:"count"`
-}
-
 func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	// Initialize DB client if not already done
 	if dbClient == nil {
@@ -44,6 +51,8 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
 		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
 	}
 
 	// Extract and verify API key
@@ -54,54 +63,93 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 
 	apiKey, err := auth.ExtractBearerToken(authHeader)
 	if err != nil {
-		return errorResponse(401, "Invalid authorization header")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
 	}
 
 	// Verify client exists and get client ID
-	clientID, err := verifyClientAPIKey(ctx, apiKey)
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
 	if err != nil {
-		return errorResponse(401, "Invalid API key")
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("list-tunnels: %v", err)
 	}
 
 	// Query tunnels by client ID using GSI
-	var tunnels []models.Tunnel
-	err = dbClient.Query(ctx, &dynamodb.QueryInput{
-		TableName:              aws.String(tunnelsTable),
-		IndexName:              aws.String("client_id-index"),
-		KeyConditionExpression: aws.String("client_id = :client_id"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":client_id": &types.AttributeValueMemberS{Value: clientID},
-		},
-	}, &tunnels)
-
+	tunnels, err := tunnelRepo.ListByClient(ctx, clientID)
 	if err != nil {
 		return errorResponse(500, fmt.Sprintf("Failed to query tunnels: %v", err))
 	}
 
+	results := make([]api.TunnelWithHealth, len(tunnels))
+	for i, tunnel := range tunnels {
+		results[i] = api.TunnelWithHealth{Tunnel: tunnel}
+	}
+
+	// Optionally probe each active tunnel's WebSocket connection
+	if request.QueryStringParameters["health"] == "1" {
+		if websocketEndpoint == "" {
+			return errorResponse(503, "Health probe not configured (WEBSOCKET_ENDPOINT missing)")
+		}
+		if err := probeConnections(ctx, results); err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to probe connections: %v", err))
+		}
+	}
+
 	// Return response
-	response := ListTunnelsResponse{
-		Tunnels: tunnels,
-		Count:   len(tunnels),
+	response := api.ListTunnelsResponse{
+		Tunnels: results,
+		Count:   len(results),
+
+		LastUsedAt: client.LastUsedAt,
+		LastUsedIP: client.LastUsedIP,
 	}
 
 	return successResponse(200, response)
 }
 
-func verifyClientAPIKey(ctx context.Context, apiKey string) (string, error) {
-	var clients []models.Client
-	if err := dbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(clientsTable),
-	}, &clients); err != nil {
-		return "", err
+// probeConnections asks API Gateway about each active tunnel's connection.
+// A connection API Gateway no longer knows about is reported as unhealthy.
+func probeConnections(ctx context.Context, tunnels []api.TunnelWithHealth) error {
+	cfg, err := dbClient.GetAWSConfig(ctx)
+	if err != nil {
+		return err
 	}
-
-	for _, client := range clients {
-		if auth.VerifyAPIKey(apiKey, client.APIKeyHash) && client.Status == models.ClientStatusActive {
-			return client.ClientID, nil
+	apigwClient := awsclients.Management(cfg, websocketEndpoint)
+
+	var wg sync.WaitGroup
+	for i := range tunnels {
+		tunnel := &tunnels[i]
+		if tunnel.Status != models.TunnelStatusActive || tunnel.ConnectionID == "" {
+			healthy := false
+			tunnel.ConnectionHealthy = &healthy
+			continue
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			healthy := false
+			out, err := apigwClient.GetConnection(ctx, &apigatewaymanagementapi.GetConnectionInput{
+				ConnectionId: aws.String(tunnel.ConnectionID),
+			})
+			if err == nil {
+				healthy = true
+				tunnel.LastSeen = out.LastActiveAt
+			} else {
+				var gone *apigwtypes.GoneException
+				if !errors.As(err, &gone) {
+					log.Printf("list-tunnels: failed to probe connection %s: %v", tunnel.ConnectionID, err)
+				}
+			}
+			tunnel.ConnectionHealthy = &healthy
+		}()
 	}
+	wg.Wait()
 
-	return "", fmt.Errorf("client not found or inactive")
+	return nil
 }
 
 func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
@@ -120,19 +168,9 @@ func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPR
 }
 
 func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
-	body, _ := json.Marshal(map[string]string{
-		"error": message,
-	})
-
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}, nil
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(apiversion.Wrap(handler))
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+// defaultStaleAfter is how long a tunnel may go without a heartbeat before it
+// is considered gone. The CLI pings every 30 seconds.
+const defaultStaleAfter = 3 * time.Minute
+
+var (
+	tunnelsTable         string
+	eventsTable          string
+	pendingRequestsTable string
+	websocketEndpoint    string
+	staleAfter           time.Duration
+	dbClient             *db.DynamoDBClient
+	apigwClient          *apigatewaymanagementapi.Client
+	pendingRepo          repository.PendingRequestRepository
+)
+
+func init() {
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+
+	if tunnelsTable == "" {
+		panic("TUNNELS_TABLE environment variable is required")
+	}
+
+	staleAfter = defaultStaleAfter
+	if v := os.Getenv("STALE_AFTER_MINUTES"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil || minutes < 1 {
+			panic("STALE_AFTER_MINUTES must be a positive integer")
+		}
+		staleAfter = time.Duration(minutes) * time.Minute
+	}
+}
+
+// ReapResult summarizes one run of the reaper
+type ReapResult struct {
+	Checked int `json:"checked"`
+	Reaped  int `json:"reaped"`
+	Active  int `json:"active"` // Tunnels still active after the run
+}
+
+// handler runs on a schedule. API Gateway does not always deliver $disconnect
+// (e.g. when the CLI's network drops), which leaves tunnels marked active with
+// a dead connection ID; this marks them inactive once their heartbeat stops.
+func handler(ctx context.Context) (ReapResult, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return ReapResult{}, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		if pendingRequestsTable != "" {
+			pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+		}
+	}
+
+	if apigwClient == nil && websocketEndpoint != "" {
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return ReapResult{}, fmt.Errorf("failed to get AWS config: %w", err)
+		}
+		apigwClient = apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+			o.BaseEndpoint = aws.String(websocketEndpoint)
+		})
+	}
+
+	cutoff := time.Now().Add(-staleAfter).UTC().Format(time.RFC3339)
+
+	// Tunnels connected before heartbeats were recorded have no last_ping_at;
+	// fall back to updated_at for those
+	var stale []models.Tunnel
+	if err := dbClient.ScanAll(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(tunnelsTable),
+		FilterExpression: aws.String("#status = :active AND (last_ping_at < :cutoff OR (attribute_not_exists(last_ping_at) AND updated_at < :cutoff))"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+			":cutoff": &types.AttributeValueMemberS{Value: cutoff},
+		},
+	}, &stale); err != nil {
+		return ReapResult{}, fmt.Errorf("failed to scan tunnels: %w", err)
+	}
+
+	result := ReapResult{Checked: len(stale)}
+	for _, tunnel := range stale {
+		reaped, err := reapTunnel(ctx, tunnel, cutoff)
+		if err != nil {
+			log.Printf("reap-stale-tunnels: tunnel %s: %v", tunnel.TunnelID, err)
+			continue
+		}
+		if reaped {
+			result.Reaped++
+		}
+	}
+
+	log.Printf("reap-stale-tunnels: reaped %d of %d stale tunnels (no heartbeat since %s)", result.Reaped, result.Checked, cutoff)
+
+	// The reaper runs every minute, which makes it the natural place to report
+	// the ActiveTunnels gauge that the backoffice's zero-active-tunnels alarm watches
+	if active, err := countActiveTunnels(ctx); err != nil {
+		log.Printf("reap-stale-tunnels: failed to count active tunnels: %v", err)
+	} else {
+		result.Active = active
+		db.EmitGauge("ActiveTunnels", float64(active), "Count")
+	}
+	return result, nil
+}
+
+// countActiveTunnels counts the tunnels left active after reaping
+func countActiveTunnels(ctx context.Context) (int, error) {
+	active := 0
+	err := dbClient.QueryPages(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(tunnelsTable),
+		IndexName:              aws.String("status-created_at-index"),
+		KeyConditionExpression: aws.String("#status = :active"),
+		ProjectionExpression:   aws.String("tunnel_id"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+		},
+	}, func(items []map[string]types.AttributeValue) bool {
+		active += len(items)
+		return true
+	})
+	return active, err
+}
+
+// reapTunnel marks one tunnel inactive and clears its connection IDs. The update
+// is conditioned on the heartbeat still being stale and versioned, so a CLI that
+// pinged or reconnected since the scan is left alone.
+func reapTunnel(ctx context.Context, tunnel models.Tunnel, cutoff string) (bool, error) {
+	err := dbClient.UpdateItemVersioned(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tunnelsTable),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: tunnel.TunnelID},
+		},
+		UpdateExpression:    aws.String("SET #status = :inactive, updated_at = :updated_at REMOVE connection_id, connection_ids"),
+		ConditionExpression: aws.String("#status = :active AND (last_ping_at < :cutoff OR (attribute_not_exists(last_ping_at) AND updated_at < :cutoff))"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active":     &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+			":inactive":   &types.AttributeValueMemberS{Value: models.TunnelStatusInactive},
+			":cutoff":     &types.AttributeValueMemberS{Value: cutoff},
+			":updated_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+	}, tunnel.Version)
+	if err != nil {
+		if errors.Is(err, db.ErrConditionFailed) || errors.Is(err, db.ErrVersionConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// Make sure API Gateway drops whatever is left of the connections
+	for _, connectionID := range tunnel.Connections() {
+		if apigwClient == nil {
+			break
+		}
+		if _, err := apigwClient.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+			ConnectionId: aws.String(connectionID),
+		}); err != nil {
+			log.Printf("reap-stale-tunnels: failed to close connection %s: %v", connectionID, err)
+		}
+	}
+
+	if err := failPendingRequests(ctx, tunnel.TunnelID); err != nil {
+		log.Printf("reap-stale-tunnels: %v", err)
+	}
+
+	if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+		TunnelID:     tunnel.TunnelID,
+		Type:         models.TunnelEventDisconnected,
+		ClientID:     tunnel.ClientID,
+		ConnectionID: tunnel.ConnectionID,
+		Reason:       fmt.Sprintf("no heartbeat for %s", staleAfter),
+		Actor:        "reap-stale-tunnels",
+	}); err != nil {
+		log.Printf("reap-stale-tunnels: %v", err)
+	}
+
+	return true, nil
+}
+
+// failPendingRequests ends the requests still waiting on a reaped tunnel, so
+// their callers get an answer now instead of when the request expires
+func failPendingRequests(ctx context.Context, tunnelID string) error {
+	if pendingRepo == nil {
+		return nil
+	}
+	pending, err := pendingRepo.ListByTunnel(ctx, tunnelID, "pending", "waiting_upload")
+	if err != nil {
+		return err
+	}
+	for _, req := range pending {
+		if err := pendingRepo.Fail(ctx, req.RequestID, models.PendingRequestTunnelDisconnected, "Tunnel stopped responding"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,154 @@
+package main
+
+// redeliver-request retries WebSocket messages that http-proxy and
+// s3-upload-notify failed to send to a tunnel's CLI with a transient error,
+// e.g. while the CLI reconnects or API Gateway throttles. Each SQS message is
+// a redelivery.Delivery; it is sent to one of the tunnel's current
+// connections, and re-queued with a longer delay when that fails again.
+// After redelivery.MaxAttempts attempts the pending request ends as
+// tunnel_disconnected, and once the caller has stopped waiting as expired.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/redelivery"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	tunnelsTable         string
+	pendingRequestsTable string
+	websocketEndpoint    string
+	redeliveryQueueURL   string
+	dbClient             *db.DynamoDBClient
+	tunnelRepo           repository.TunnelRepository
+	pendingRepo          repository.PendingRequestRepository
+	apigwClient          *apigatewaymanagementapi.Client
+	sqsClient            *sqs.Client
+)
+
+func init() {
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+	redeliveryQueueURL = os.Getenv("REDELIVERY_QUEUE_URL")
+
+	if tunnelsTable == "" || pendingRequestsTable == "" || websocketEndpoint == "" || redeliveryQueueURL == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+// handler reports the records whose attempt could neither be made nor handed
+// on as batch item failures, so SQS retries only those once their visibility
+// timeout ends
+func handler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	var response events.SQSEventResponse
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return response, fmt.Errorf("failed to initialize DB client: %w", err)
+		}
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return response, fmt.Errorf("failed to get AWS config: %w", err)
+		}
+		apigwClient = awsclients.Management(cfg, websocketEndpoint)
+		sqsClient = sqs.NewFromConfig(cfg)
+	}
+
+	for _, record := range event.Records {
+		var d redelivery.Delivery
+		if err := json.Unmarshal([]byte(record.Body), &d); err != nil {
+			log.Printf("redeliver-request: dropping malformed message %s: %v", record.MessageId, err)
+			continue
+		}
+		if err := redeliver(ctx, d); err != nil {
+			log.Printf("redeliver-request: request %s: %v", d.RequestID, err)
+			// Continue processing other records — only this one is retried
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: record.MessageId,
+			})
+		}
+	}
+	return response, nil
+}
+
+// redeliver makes the next attempt at sending d and decides what happens
+// when it fails
+func redeliver(ctx context.Context, d redelivery.Delivery) error {
+	pending, err := pendingRepo.Get(ctx, d.RequestID)
+	if errors.Is(err, repository.ErrNotFound) {
+		// Expired, or its tunnel was deleted; nobody is waiting any more
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pending request: %w", err)
+	}
+	if pending.Status != "pending" {
+		return nil
+	}
+	if time.Now().After(d.Deadline) {
+		return pendingRepo.Fail(ctx, d.RequestID, models.PendingRequestExpired, "Request expired before the tunnel could be reached")
+	}
+
+	sendErr := send(ctx, d)
+	if sendErr == nil {
+		log.Printf("redeliver-request: delivered request %s on attempt %d", d.RequestID, d.Attempt+1)
+		return nil
+	}
+
+	d.Attempt++
+	retryAt := time.Now().Add(redelivery.Backoff(d.Attempt))
+	if d.Attempt < redelivery.MaxAttempts && retryAt.Before(d.Deadline) &&
+		(redelivery.Transient(sendErr) || errors.Is(sendErr, errNoConnection)) {
+		return redelivery.Enqueue(ctx, sqsClient, redeliveryQueueURL, d)
+	}
+
+	log.Printf("redeliver-request: giving up on request %s after %d attempts: %v", d.RequestID, d.Attempt, sendErr)
+	return pendingRepo.Fail(ctx, d.RequestID, models.PendingRequestTunnelDisconnected, "Failed to send request to tunnel")
+}
+
+// errNoConnection is returned while a tunnel has no connection to send to,
+// which a reconnecting CLI soon fixes
+var errNoConnection = errors.New("tunnel has no connection")
+
+// send posts d's message to one of its tunnel's connections
+func send(ctx context.Context, d redelivery.Delivery) error {
+	tunnel, err := tunnelRepo.Get(ctx, d.TunnelID)
+	if err != nil {
+		return fmt.Errorf("tunnel %s not found: %w", d.TunnelID, err)
+	}
+	connections := tunnel.Connections()
+	if tunnel.Status != models.TunnelStatusActive || len(connections) == 0 {
+		return errNoConnection
+	}
+
+	_, err = apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connections[mathrand.IntN(len(connections))]),
+		Data:         d.Message,
+	})
+	return err
+}
+
+func main() {
+	lambda.Start(handler)
+}
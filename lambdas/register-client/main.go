@@ -9,14 +9,19 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
 	"github.com/lmanrique/tunnel/lambdas/shared/auth"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
 	clientsTable string
 	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
 )
 
 func init() {
@@ -26,12 +31,6 @@ func init() {
 	}
 }
 
-type RegisterClientResponse struct {
-	ClientID string `json:"client_id"`
-	APIKey   string `json:"api_key"`
-	Message  string `json:"message"`
-}
-
 func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	// Initialize DB client if not already done
 	if dbClient == nil {
@@ -40,6 +39,7 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
 		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
 	}
 
 	// Generate client ID
@@ -69,13 +69,12 @@ func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (event
 	}
 
 	// Save to DynamoDB
-	err = dbClient.PutItem(ctx, clientsTable, client)
-	if err != nil {
+	if err := clientRepo.Put(ctx, client); err != nil {
 		return errorResponse(500, fmt.Sprintf("Failed to save client: %v", err))
 	}
 
 	// Return response with API key (only time it's shown)
-	response := RegisterClientResponse{
+	response := api.RegisterClientResponse{
 		ClientID: clientID,
 		APIKey:   apiKey,
 		Message:  "Client registered successfully. Please save your API key securely.",
@@ -100,19 +99,15 @@ func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPR
 }
 
 func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
-	body, _ := json.Marshal(map[string]string{
-		"error": message,
-	})
-
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: statusCode,
 		Headers: map[string]string{
-			"Content-Type": "application/json",
+			"Content-Type": problem.ContentType,
 		},
-		Body: string(body),
+		Body: string(problem.Body(statusCode, message)),
 	}, nil
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(apiversion.Wrap(handler))
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/billing"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+	"github.com/lmanrique/tunnel/lambdas/shared/requestlog"
+)
+
+// defaultMeterEvent is the Stripe meter that counts proxied requests
+const defaultMeterEvent = "tunnel_requests"
+
+// reportPeriod is how much traffic one meter event reports: one stats bucket.
+// The schedule matches it.
+const reportPeriod = requestlog.BucketPeriod
+
+// maxCatchUp is how far back a run goes to report hours an earlier run failed
+// to; Stripe takes meter events up to 35 days old and the request log keeps 30
+const maxCatchUp = 7 * 24 * time.Hour
+
+var (
+	clientsTable      string
+	tunnelsTable      string
+	requestStatsTable string
+	meterEvent        string
+	dbClient          *db.DynamoDBClient
+	clientRepo        repository.ClientRepository
+	tunnelRepo        repository.TunnelRepository
+	stripe            *billing.Client
+
+	// lowLatencyMeterEvent, when set, is the Stripe meter that also counts
+	// the requests of low-latency tunnels, whose warm-up pings cost extra
+	lowLatencyMeterEvent string
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	requestStatsTable = os.Getenv("REQUEST_STATS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" || requestStatsTable == "" {
+		panic("Required environment variables are missing")
+	}
+
+	// Billing is disabled without a Stripe account
+	if secretKey := os.Getenv("STRIPE_SECRET_KEY"); secretKey != "" {
+		stripe = billing.NewClient(secretKey)
+	}
+	meterEvent = os.Getenv("STRIPE_METER_EVENT")
+	if meterEvent == "" {
+		meterEvent = defaultMeterEvent
+	}
+	lowLatencyMeterEvent = os.Getenv("STRIPE_LOW_LATENCY_METER_EVENT")
+}
+
+// UsageResult summarizes one run of the usage report
+type UsageResult struct {
+	Period   string `json:"period"`
+	Clients  int    `json:"clients"`
+	Reported int    `json:"reported"` // Clients with usage sent to Stripe
+	Requests int64  `json:"requests"`
+	Failed   int    `json:"failed"`
+
+	// LowLatencyRequests are the reported requests of low-latency tunnels
+	LowLatencyRequests int64 `json:"low_latency_requests"`
+}
+
+// handler runs hourly and reports to Stripe how many requests each billed
+// client's tunnels served during each full hour since the client was last
+// reported, counted from the tunnels' hourly stats buckets. A client whose
+// report fails is caught up on by the next run, from the hour after its
+// usage_reported_until. Each report is keyed by client and hour, so an hour
+// sent again is not billed twice.
+func handler(ctx context.Context) (UsageResult, error) {
+	if stripe == nil {
+		return UsageResult{}, nil
+	}
+
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return UsageResult{}, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+	}
+
+	end := time.Now().UTC().Truncate(reportPeriod)
+
+	clients, err := clientRepo.ListBilled(ctx)
+	if err != nil {
+		return UsageResult{}, fmt.Errorf("failed to list billed clients: %w", err)
+	}
+
+	result := UsageResult{Period: end.Add(-reportPeriod).Format(time.RFC3339), Clients: len(clients)}
+	for _, client := range clients {
+		if err := reportClient(ctx, client, end, &result); err != nil {
+			log.Printf("report-usage: client %s: %v", client.ClientID, err)
+			result.Failed++
+		}
+	}
+
+	log.Printf("report-usage: reported %d requests (%d low-latency) for %d of %d billed clients up to %s (%d failed)",
+		result.Requests, result.LowLatencyRequests, result.Reported, result.Clients, end.Format(time.RFC3339), result.Failed)
+	return result, nil
+}
+
+// reportFrom is the first hour to report for a client: the one after the last
+// reported, at most maxCatchUp back, or the previous hour for a client never
+// reported
+func reportFrom(client models.Client, end time.Time) time.Time {
+	if client.UsageReportedUntil == nil {
+		return end.Add(-reportPeriod)
+	}
+	from := client.UsageReportedUntil.UTC().Truncate(reportPeriod)
+	if oldest := end.Add(-maxCatchUp); from.Before(oldest) {
+		return oldest
+	}
+	return from
+}
+
+// reportClient sends the client's usage for each hour from reportFrom up to
+// end, stopping at the first failure, and records how far it got
+func reportClient(ctx context.Context, client models.Client, end time.Time, result *UsageResult) error {
+	start := reportFrom(client, end)
+	if !start.Before(end) {
+		return nil
+	}
+	usage, err := countRequests(ctx, client.ClientID, start, end)
+	if err != nil {
+		return err
+	}
+
+	reported := start
+	var reportErr error
+	var requests, lowLatency int64
+	for hour := start; hour.Before(end); hour = hour.Add(reportPeriod) {
+		u := usage[hour.Unix()]
+		if reportErr = reportHour(ctx, client, hour, u); reportErr != nil {
+			break
+		}
+		requests += u.count
+		if lowLatencyMeterEvent != "" {
+			lowLatency += u.lowLatency
+		}
+		reported = hour.Add(reportPeriod)
+	}
+	if requests > 0 {
+		result.Reported++
+		result.Requests += requests
+		result.LowLatencyRequests += lowLatency
+	}
+	if reported.After(start) {
+		if err := clientRepo.SetUsageReportedUntil(ctx, client.ClientID, reported); err != nil {
+			return fmt.Errorf("failed to record usage reported until %s: %w", reported.Format(time.RFC3339), err)
+		}
+	}
+	return reportErr
+}
+
+// hourUsage is what a client's tunnels served in one hour
+type hourUsage struct {
+	count      int64
+	lowLatency int64 // Requests of low-latency tunnels, included in count
+}
+
+// reportHour sends one hour of a client's usage to the request meter and, if
+// configured, the low-latency meter
+func reportHour(ctx context.Context, client models.Client, hour time.Time, usage hourUsage) error {
+	if usage.count == 0 {
+		return nil
+	}
+	identifier := fmt.Sprintf("%s-%s", client.ClientID, hour.Format("2006010215"))
+	if err := stripe.MeterEvent(ctx, meterEvent, client.StripeCustomerID, usage.count, hour, identifier); err != nil {
+		return err
+	}
+	if usage.lowLatency == 0 || lowLatencyMeterEvent == "" {
+		return nil
+	}
+	if err := stripe.MeterEvent(ctx, lowLatencyMeterEvent, client.StripeCustomerID, usage.lowLatency, hour, identifier+"-low-latency"); err != nil {
+		return fmt.Errorf("low-latency usage: %w", err)
+	}
+	return nil
+}
+
+// countRequests counts the requests of a client's tunnels in [start, end) by
+// hour (keyed by the hour's Unix time) from their stats buckets, with how many
+// of them were for low-latency tunnels
+func countRequests(ctx context.Context, clientID string, start, end time.Time) (map[int64]hourUsage, error) {
+	tunnels, err := tunnelRepo.ListByClient(ctx, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+
+	usage := map[int64]hourUsage{}
+	for _, tunnel := range tunnels {
+		err := requestlog.Buckets(ctx, dbClient, requestStatsTable, tunnel.TunnelID, start, end, func(b requestlog.Bucket) {
+			u := usage[b.Hour.Unix()]
+			u.count += b.Requests
+			if tunnel.LowLatency {
+				u.lowLatency += b.Requests
+			}
+			usage[b.Hour.Unix()] = u
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request stats of tunnel %s: %w", tunnel.TunnelID, err)
+		}
+	}
+	return usage, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
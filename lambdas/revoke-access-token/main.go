@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable string
+	tunnelsTable string
+	dbClient     *db.DynamoDBClient
+	clientRepo   repository.ClientRepository
+)
+
+// Errors returned from the tunnel update
+var (
+	errNotOwner = errors.New("tunnel belongs to another client")
+	errNoToken  = errors.New("consumer has no access token")
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("revoke-access-token: %v", err)
+	}
+
+	tunnelID := request.PathParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	consumer := request.PathParameters["consumer"]
+	if consumer == "" {
+		return errorResponse(400, "Consumer is required")
+	}
+
+	// Forget the consumer; its token stops working with the next request
+	_, err = dbClient.UpdateTunnel(ctx, tunnelsTable, tunnelID, func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		if tunnel.ClientID != clientID {
+			return nil, errNotOwner
+		}
+		if _, ok := tunnel.AccessConsumers[consumer]; !ok {
+			return nil, errNoToken
+		}
+		return &dynamodb.UpdateItemInput{
+			UpdateExpression:         aws.String("REMOVE access_consumers.#consumer"),
+			ExpressionAttributeNames: map[string]string{"#consumer": consumer},
+		}, nil
+	})
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	case errors.Is(err, errNotOwner):
+		return errorResponse(403, "Unauthorized to revoke access tokens of this tunnel")
+	case errors.Is(err, errNoToken):
+		return errorResponse(404, fmt.Sprintf("Consumer %s has no access token", consumer))
+	case errors.Is(err, db.ErrVersionConflict):
+		return problem.ErrorResponse(409, problem.CodeConcurrentUpdate, "Tunnel changed while revoking the token; retry")
+	case err != nil:
+		return errorResponse(500, fmt.Sprintf("Failed to revoke access token: %v", err))
+	}
+
+	return successResponse(200, api.RevokeAccessTokenResponse{
+		Message: fmt.Sprintf("Access token of %s revoked", consumer),
+	})
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
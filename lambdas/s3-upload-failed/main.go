@@ -0,0 +1,100 @@
+package main
+
+// s3-upload-failed consumes the dead-letter queue of s3-upload-notify. Each
+// message is an S3 event that s3-upload-notify failed on every attempt; the
+// pending requests of its uploads end as failed_upload with the last error,
+// so the caller polling GET /poll/{request_id} gets a 502 instead of waiting
+// for the request to expire.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	pendingRequestsTable string
+	dbClient             *db.DynamoDBClient
+	pendingRepo          repository.PendingRequestRepository
+)
+
+func init() {
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+
+	if pendingRequestsTable == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, event events.SQSEvent) error {
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialize DB client: %w", err)
+		}
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+	}
+
+	// Marking a request as failed can be repeated, so a message with any
+	// error is left on the queue to be tried again
+	var errs []error
+	for _, message := range event.Records {
+		var s3Event events.S3Event
+		if err := json.Unmarshal([]byte(message.Body), &s3Event); err != nil {
+			log.Printf("s3-upload-failed: dropping malformed message %s: %v", message.MessageId, err)
+			continue
+		}
+
+		reason := "Upload could not be delivered to the tunnel"
+		if attr, ok := message.MessageAttributes["ErrorMessage"]; ok && attr.StringValue != nil && *attr.StringValue != "" {
+			reason += ": " + *attr.StringValue
+		}
+
+		for _, record := range s3Event.Records {
+			requestID, ok := requestIDFromKey(record.S3.Object.Key)
+			if !ok {
+				log.Printf("s3-upload-failed: unexpected S3 key format: %s", record.S3.Object.Key)
+				continue
+			}
+			// An event fails as a whole; its records that were delivered
+			// before another one failed are in the CLI's hands
+			if request, err := pendingRepo.Get(ctx, requestID); err == nil && request.NotifiedAt != "" {
+				log.Printf("s3-upload-failed: request_id=%s was delivered, not failing it", requestID)
+				continue
+			}
+			if err := pendingRepo.Fail(ctx, requestID, models.PendingRequestFailedUpload, reason); err != nil {
+				log.Printf("s3-upload-failed: %v", err)
+				errs = append(errs, err)
+				continue
+			}
+			log.Printf("s3-upload-failed: marked request_id=%s as failed_upload: %s", requestID, reason)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requestIDFromKey extracts the request ID of an upload key,
+// requests/{request_id}/body
+func requestIDFromKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "requests/")
+	if !ok {
+		return "", false
+	}
+	requestID, _, ok := strings.Cut(rest, "/")
+	return requestID, ok && requestID != ""
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -16,10 +16,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,8 +31,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/lmanrique/tunnel/lambdas/shared/awsclients"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/redelivery"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
@@ -40,9 +45,12 @@ var (
 	pendingRequestsTable string
 	websocketEndpoint    string
 	uploadsBucket        string
+	redeliveryQueueURL   string
 	dbClient             *db.DynamoDBClient
+	tunnelRepo           repository.TunnelRepository
 	s3Client             *s3.Client
 	s3PresignClient      *s3.PresignClient
+	sqsClient            *sqs.Client
 )
 
 func init() {
@@ -51,6 +59,7 @@ func init() {
 	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
 	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
 	uploadsBucket = os.Getenv("UPLOADS_BUCKET")
+	redeliveryQueueURL = os.Getenv("REDELIVERY_QUEUE_URL")
 
 	if tunnelsTable == "" || pendingRequestsTable == "" || websocketEndpoint == "" || uploadsBucket == "" {
 		panic("Required environment variables are missing")
@@ -64,25 +73,37 @@ func handler(ctx context.Context, event events.S3Event) error {
 		if err != nil {
 			return fmt.Errorf("failed to initialize DB client: %w", err)
 		}
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
 	}
 	if s3Client == nil {
 		cfg, err := dbClient.GetAWSConfig(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to get AWS config: %w", err)
 		}
-		s3Client = s3.NewFromConfig(cfg)
-		s3PresignClient = s3.NewPresignClient(s3Client)
+		s3Client, s3PresignClient = awsclients.S3(cfg)
+		if redeliveryQueueURL != "" {
+			sqsClient = sqs.NewFromConfig(cfg)
+		}
 	}
 
+	// Failed records are reported once every record has been tried, so that
+	// Lambda retries the event and finally hands it to the dead-letter queue,
+	// where s3-upload-failed marks its requests as failed. A retry delivers
+	// the whole event again; records that were delivered the first time are
+	// skipped through their notified_at marker.
+	var errs []error
 	for _, record := range event.Records {
 		s3Key := record.S3.Object.Key
 		log.Printf("s3-upload-notify: processing S3 key %s", s3Key)
 		if err := processUpload(ctx, s3Key); err != nil {
 			log.Printf("s3-upload-notify: error processing %s: %v", s3Key, err)
-			// Continue processing other records — don't fail the whole batch
+			errs = append(errs, fmt.Errorf("%s: %w", s3Key, err))
 		}
 	}
-	return nil
+	if len(errs) > 0 {
+		log.Printf("s3-upload-notify: %d of %d records failed; the event will be retried", len(errs), len(event.Records))
+	}
+	return errors.Join(errs...)
 }
 
 // processUpload handles a single uploaded request body.
@@ -104,7 +125,7 @@ func processUpload(ctx context.Context, s3Key string) error {
 	reqKey := map[string]types.AttributeValue{
 		"request_id": &types.AttributeValueMemberS{Value: requestID},
 	}
-	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey)
+	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, reqKey, false)
 	if err != nil || rawItem == nil {
 		return fmt.Errorf("pending request not found for request_id=%s: %v", requestID, err)
 	}
@@ -120,11 +141,19 @@ func processUpload(ctx context.Context, s3Key string) error {
 	}
 	tunnelID := tunnelIDSV.Value
 
+	// S3 may deliver an event more than once, and a retried event carries the
+	// records that succeeded before too; the CLI already has those requests
+	switch dispatchState(rawItem, time.Now()) {
+	case dispatchDone:
+		log.Printf("s3-upload-notify: request_id=%s was already dispatched, skipping", requestID)
+		return nil
+	case dispatchClaimed:
+		return fmt.Errorf("request_id=%s is being dispatched by another invocation", requestID)
+	}
+
 	// Look up tunnel connection
-	var tunnel models.Tunnel
-	if err := dbClient.GetItem(ctx, tunnelsTable, map[string]types.AttributeValue{
-		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
-	}, &tunnel); err != nil {
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
+	if err != nil {
 		return fmt.Errorf("tunnel not found for tunnel_id=%s: %v", tunnelID, err)
 	}
 	if tunnel.Status != models.TunnelStatusActive || tunnel.ConnectionID == "" {
@@ -165,7 +194,15 @@ func processUpload(ctx context.Context, s3Key string) error {
 			s3ResponsePutURL = sv.Value
 		}
 	}
-	headers := map[string]interface{}{}
+	// The uploader's checksum of the body; only CLIs that negotiated
+	// checksums accept it
+	requestSHA256 := ""
+	if cv, ok := rawItem["request_sha256"]; ok && tunnel.Supports(models.CapabilityChecksums) {
+		if sv, ok := cv.(*types.AttributeValueMemberS); ok {
+			requestSHA256 = sv.Value
+		}
+	}
+	headers := map[string]string{}
 	if hv, ok := rawItem["headers"]; ok {
 		if mv, ok := hv.(*types.AttributeValueMemberM); ok {
 			for k, v := range mv.Value {
@@ -176,41 +213,48 @@ func processUpload(ctx context.Context, s3Key string) error {
 		}
 	}
 
+	// Forward the trace context of the upload-url call, unless the uploader
+	// set those headers on the request itself
+	if tv, ok := rawItem["trace_context"]; ok {
+		if mv, ok := tv.(*types.AttributeValueMemberM); ok {
+			for name, v := range mv.Value {
+				sv, ok := v.(*types.AttributeValueMemberS)
+				if !ok || hasHeader(headers, name) {
+					continue
+				}
+				headers[name] = sv.Value
+			}
+		}
+	}
+
 	// Build WebSocket API Gateway client
 	cfg, err := dbClient.GetAWSConfig(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get AWS config: %w", err)
 	}
-	apigwClient := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
-		o.BaseEndpoint = aws.String(websocketEndpoint)
-	})
+	apigwClient := awsclients.Management(cfg, websocketEndpoint)
 
-	// Mark request as pending (was waiting_upload) so the http-proxy poller picks it up
-	_ = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(pendingRequestsTable),
-		Key:       reqKey,
-		UpdateExpression: aws.String("SET #s = :status"),
-		ExpressionAttributeNames: map[string]string{"#s": "status"},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status": &types.AttributeValueMemberS{Value: "pending"},
-		},
-	})
+	// Move the request from waiting_upload to pending, which only one
+	// delivery of the event can do
+	if err := claimDispatch(ctx, reqKey); err != nil {
+		if errors.Is(err, db.ErrConditionFailed) {
+			return fmt.Errorf("request_id=%s was claimed by another invocation", requestID)
+		}
+		return fmt.Errorf("failed to claim request_id=%s: %w", requestID, err)
+	}
 
 	// Send proxy WebSocket message to CLI
-	proxyMsg, err := json.Marshal(map[string]interface{}{
-		"action": "proxy",
-		"data": map[string]interface{}{
-			"request_id":        requestID,
-			"method":            method,
-			"path":              path,
-			"headers":           headers,
-			"body":              "",           // body is in S3
-			"total_chunks":      0,
-			"s3_request_key":    s3Key,        // CLI downloads body from here
-			"s3_request_get_url": presignReq.URL,
-			"s3_put_url":        s3ResponsePutURL, // CLI uploads response body here
-			"s3_response_key":   s3ResponseKey,
-		},
+	proxyMsg, err := models.EncodeMessage(models.ActionProxy, &models.ProxyRequestPayload{
+		RequestID:       requestID,
+		Method:          method,
+		Path:            path,
+		Headers:         headers,
+		Body:            "", // body is in S3
+		S3RequestKey:    s3Key,
+		S3RequestGetURL: presignReq.URL,   // CLI downloads body from here
+		S3PutURL:        s3ResponsePutURL, // CLI uploads response body here
+		S3ResponseKey:   s3ResponseKey,
+		S3RequestSHA256: requestSHA256, // CLI verifies the downloaded body against it
 	})
 	if err != nil {
 		return fmt.Errorf("failed to marshal proxy message: %w", err)
@@ -220,13 +264,145 @@ func processUpload(ctx context.Context, s3Key string) error {
 		ConnectionId: aws.String(tunnel.ConnectionID),
 		Data:         proxyMsg,
 	}); err != nil {
-		return fmt.Errorf("failed to send WebSocket message to CLI: %w", err)
+		// The poller waits until the pending request expires, so a transient
+		// failure is retried from the redelivery queue until then
+		if sqsClient == nil || len(proxyMsg) > redelivery.MaxMessageBytes || !redelivery.Transient(err) {
+			releaseDispatch(ctx, reqKey, requestID)
+			return fmt.Errorf("failed to send WebSocket message to CLI: %w", err)
+		}
+		deadline := time.Now().Add(30 * time.Minute)
+		if tv, ok := rawItem["ttl"].(*types.AttributeValueMemberN); ok {
+			if ttl, parseErr := strconv.ParseInt(tv.Value, 10, 64); parseErr == nil {
+				deadline = time.Unix(ttl, 0)
+			}
+		}
+		if enqueueErr := redelivery.Enqueue(ctx, sqsClient, redeliveryQueueURL, redelivery.Delivery{
+			RequestID: requestID,
+			TunnelID:  tunnelID,
+			Message:   proxyMsg,
+			Attempt:   1,
+			Deadline:  deadline,
+		}); enqueueErr != nil {
+			releaseDispatch(ctx, reqKey, requestID)
+			return fmt.Errorf("failed to send WebSocket message to CLI: %w (%v)", err, enqueueErr)
+		}
+		log.Printf("s3-upload-notify: queued request_id=%s for redelivery after: %v", requestID, err)
+		markNotified(ctx, reqKey, requestID)
+		return nil
 	}
 
 	log.Printf("s3-upload-notify: sent proxy message for request_id=%s to connection %s", requestID, tunnel.ConnectionID)
+	markNotified(ctx, reqKey, requestID)
 	return nil
 }
 
+// dispatchClaimTimeout is how long a claim on a request may go without the
+// request being sent before another delivery of its event may take it over,
+// e.g. after the claiming invocation crashed
+const dispatchClaimTimeout = time.Minute
+
+// Dispatch states of an uploaded request
+const (
+	dispatchReady   = iota // Waiting for its upload, or claimed and abandoned
+	dispatchClaimed        // Another invocation is sending it
+	dispatchDone           // Sent, answered or failed; nothing is left to do
+)
+
+// dispatchState tells from a pending request item whether its proxy message
+// still has to be sent. claimDispatch makes the same decision atomically.
+func dispatchState(rawItem map[string]types.AttributeValue, now time.Time) int {
+	status := ""
+	if sv, ok := rawItem["status"].(*types.AttributeValueMemberS); ok {
+		status = sv.Value
+	}
+	_, notified := rawItem["notified_at"]
+	switch {
+	case status == "waiting_upload":
+		return dispatchReady
+	case status != "pending" || notified:
+		return dispatchDone
+	}
+	dv, ok := rawItem["dispatched_at"].(*types.AttributeValueMemberS)
+	if !ok {
+		// Sent before claims were recorded
+		return dispatchDone
+	}
+	claimed, err := time.Parse(time.RFC3339, dv.Value)
+	if err == nil && now.Sub(claimed) < dispatchClaimTimeout {
+		return dispatchClaimed
+	}
+	return dispatchReady
+}
+
+// claimDispatch moves a request from waiting_upload to pending, or takes over
+// an abandoned claim, and fails with db.ErrConditionFailed when another
+// invocation got there first
+func claimDispatch(ctx context.Context, reqKey map[string]types.AttributeValue) error {
+	now := time.Now().UTC()
+	return dbClient.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(pendingRequestsTable),
+		Key:                 reqKey,
+		UpdateExpression:    aws.String("SET #s = :pending, dispatched_at = :now"),
+		ConditionExpression: aws.String("#s = :waiting_upload OR (#s = :pending AND attribute_not_exists(notified_at) AND dispatched_at < :stale)"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending":        &types.AttributeValueMemberS{Value: "pending"},
+			":waiting_upload": &types.AttributeValueMemberS{Value: "waiting_upload"},
+			":now":            &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			":stale":          &types.AttributeValueMemberS{Value: now.Add(-dispatchClaimTimeout).Format(time.RFC3339)},
+		},
+	})
+}
+
+// releaseDispatch hands a request that could not be sent back to
+// waiting_upload, so the retried event can claim it again
+func releaseDispatch(ctx context.Context, reqKey map[string]types.AttributeValue, requestID string) {
+	err := dbClient.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(pendingRequestsTable),
+		Key:                 reqKey,
+		UpdateExpression:    aws.String("SET #s = :waiting_upload REMOVE dispatched_at"),
+		ConditionExpression: aws.String("#s = :pending AND attribute_not_exists(notified_at)"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending":        &types.AttributeValueMemberS{Value: "pending"},
+			":waiting_upload": &types.AttributeValueMemberS{Value: "waiting_upload"},
+		},
+	})
+	if err != nil && !errors.Is(err, db.ErrConditionFailed) {
+		log.Printf("s3-upload-notify: failed to release request_id=%s: %v", requestID, err)
+	}
+}
+
+// markNotified records that a request was handed to the CLI or the
+// redelivery queue, so a retry of its event does not send it twice. A failure
+// is only logged: the worst case is that very duplicate.
+func markNotified(ctx context.Context, reqKey map[string]types.AttributeValue, requestID string) {
+	if err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(pendingRequestsTable),
+		Key:              reqKey,
+		UpdateExpression: aws.String("SET notified_at = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	}); err != nil {
+		log.Printf("s3-upload-notify: failed to mark request_id=%s as delivered: %v", requestID, err)
+	}
+}
+
+// hasHeader reports whether headers has name, whatever its case
+func hasHeader(headers map[string]string, name string) bool {
+	for n := range headers {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	lambda.Start(handler)
 }
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/openapi"
+)
+
+// SecurityAPIKey names the security scheme of the routes that take the
+// client's API key
+const SecurityAPIKey = "apiKey"
+
+// Routes describes every route of the current management API version; it has
+// to follow the routes infra/apigateway.tf sends to the Lambdas. The
+// unprefixed aliases of v1 are deprecated and left out.
+var Routes = []openapi.Operation{
+	{
+		Method: "POST", Path: "/v1/clients", ID: "registerClient", Tag: "clients",
+		Summary:  "Register a client and get its API key",
+		Status:   201,
+		Response: RegisterClientResponse{},
+	},
+	{
+		Method: "GET", Path: "/v1/clients/me", ID: "getClient", Tag: "clients",
+		Summary:  "Get the client the API key belongs to, with its plan, quotas and usage",
+		Security: SecurityAPIKey,
+		Response: GetClientResponse{},
+	},
+	{
+		Method: "DELETE", Path: "/v1/clients/me", ID: "deleteClient", Tag: "clients",
+		Summary:  "Delete the client and all its tunnels",
+		Security: SecurityAPIKey,
+		Query: []openapi.Param{
+			{Name: "confirm", Description: "The client ID, to confirm the deletion"},
+		},
+		Response: DeleteClientResponse{},
+		Errors:   []int{400},
+	},
+	{
+		Method: "POST", Path: "/v1/tunnels", ID: "createTunnel", Tag: "tunnels",
+		Summary:  "Create a tunnel, or update the one the client owns under the requested subdomain",
+		Security: SecurityAPIKey,
+		Request:  CreateTunnelRequest{},
+		Status:   201,
+		Response: CreateTunnelResponse{},
+		Errors:   []int{400, 402, 409},
+	},
+	{
+		Method: "GET", Path: "/v1/tunnels", ID: "listTunnels", Tag: "tunnels",
+		Summary:  "List the client's tunnels",
+		Security: SecurityAPIKey,
+		Query: []openapi.Param{
+			{Name: "health", Description: "1 to probe each tunnel's connection"},
+		},
+		Response: ListTunnelsResponse{},
+		Errors:   []int{503},
+	},
+	{
+		Method: "DELETE", Path: "/v1/tunnels/{tunnel_id}", ID: "deleteTunnel", Tag: "tunnels",
+		Summary:  "Delete a tunnel, close its connection and fail its pending requests",
+		Security: SecurityAPIKey,
+		Response: DeleteTunnelResponse{},
+		Errors:   []int{400, 403, 404},
+	},
+	{
+		Method: "GET", Path: "/v1/tunnels/{tunnel_id}/events", ID: "listTunnelEvents", Tag: "tunnels",
+		Summary:  "List a tunnel's events, newest first",
+		Security: SecurityAPIKey,
+		Query: []openapi.Param{
+			{Name: "limit", Description: "Most events to return", Type: "integer"},
+		},
+		Response: ListTunnelEventsResponse{},
+		Errors:   []int{400, 403, 404},
+	},
+	{
+		Method: "POST", Path: "/v1/tunnels/{tunnel_id}/connection-token", ID: "createConnectionToken", Tag: "tunnels",
+		Summary:  "Exchange the API key for a short-lived token to connect the tunnel's WebSocket",
+		Security: SecurityAPIKey,
+		Status:   201,
+		Response: CreateConnectionTokenResponse{},
+		Errors:   []int{400, 403, 404},
+	},
+	{
+		Method: "POST", Path: "/v1/tunnels/{tunnel_id}/access-tokens", ID: "createAccessToken", Tag: "tunnels",
+		Summary:  "Issue a consumer a token to call the private tunnel, replacing its previous one",
+		Security: SecurityAPIKey,
+		Request:  CreateAccessTokenRequest{},
+		Status:   201,
+		Response: CreateAccessTokenResponse{},
+		Errors:   []int{400, 403, 404, 409},
+	},
+	{
+		Method: "DELETE", Path: "/v1/tunnels/{tunnel_id}/access-tokens/{consumer}", ID: "revokeAccessToken", Tag: "tunnels",
+		Summary:  "Revoke a consumer's access token",
+		Security: SecurityAPIKey,
+		Response: RevokeAccessTokenResponse{},
+		Errors:   []int{400, 403, 404, 409},
+	},
+	{
+		Method: "GET", Path: "/v1/tunnels/{tunnel_id}/stats", ID: "getTunnelStats", Tag: "tunnels",
+		Summary:  "Get a tunnel's request statistics",
+		Security: SecurityAPIKey,
+		Query: []openapi.Param{
+			{Name: "window", Description: "1h, 24h, 7d or 30d"},
+		},
+		Response: TunnelStatsResponse{},
+		Errors:   []int{400, 403, 404},
+	},
+	{
+		Method: "GET", Path: "/v1/billing/portal", ID: "getBillingPortal", Tag: "billing",
+		Summary:  "Get a link to the client's billing portal, or to buy a plan",
+		Security: SecurityAPIKey,
+		Response: BillingPortalResponse{},
+		Errors:   []int{404, 502},
+	},
+}
+
+// Document generates the OpenAPI description of the management API served
+// from serverURL
+func Document(serverURL string) openapi.Document {
+	var servers []openapi.Server
+	if serverURL != "" {
+		servers = []openapi.Server{{URL: serverURL}}
+	}
+	return openapi.Generate(openapi.API{
+		Info: openapi.Info{
+			Title:       "Tunnel management API",
+			Version:     "v" + strconv.Itoa(models.APIVersionCurrent),
+			Description: "Registers clients and manages their tunnels. Errors are problem details (application/problem+json) with a stable code.",
+		},
+		Servers: servers,
+		SecuritySchemes: map[string]openapi.SecurityScheme{
+			SecurityAPIKey: openapi.BearerAuth("The client's API key (tk_...)"),
+		},
+		Operations: Routes,
+	})
+}
@@ -0,0 +1,224 @@
+// Package api holds the wire types of the management API, shared by the
+// Lambdas that encode them, and the metadata of its routes (Routes), from which
+// GET /openapi.json is generated.
+package api
+
+import (
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/regions"
+)
+
+// RegisterClientResponse is the answer of POST /clients; the API key is only
+// ever shown here
+type RegisterClientResponse struct {
+	ClientID string `json:"client_id"`
+	APIKey   string `json:"api_key"`
+	Message  string `json:"message"`
+}
+
+// CreateTunnelRequest is the body of POST /tunnels
+type CreateTunnelRequest struct {
+	Subdomain        string `json:"subdomain,omitempty"`
+	ConnectionPolicy string `json:"connection_policy,omitempty"`
+	Region           string `json:"region,omitempty"`
+	// BlockBots and RobotsTxt toggle bot filtering; nil leaves a reused
+	// tunnel's setting unchanged
+	BlockBots *bool `json:"block_bots,omitempty"`
+	RobotsTxt *bool `json:"robots_txt,omitempty"`
+	// AllowedCountries restricts the tunnel to these country codes; an empty
+	// list lifts the restriction and nil leaves a reused tunnel's unchanged
+	AllowedCountries []string `json:"allowed_countries"`
+	// AllowedMethods restricts the tunnel to these HTTP methods, with the same
+	// empty and nil semantics
+	AllowedMethods []string `json:"allowed_methods"`
+	// Password protects the tunnel with a login page; "" removes it and nil
+	// leaves a reused tunnel's unchanged
+	Password *string `json:"password,omitempty"`
+	// Visibility is "private" to only forward requests with an access token
+	// or "public"; "" leaves a reused tunnel's unchanged
+	Visibility string `json:"visibility,omitempty"`
+	// StrippedHeaders are removed from every request before it is forwarded,
+	// and RequiredHeaders ("Name" or "Name: value") must be on every request;
+	// an empty list clears them and nil leaves a reused tunnel's unchanged
+	StrippedHeaders []string `json:"stripped_headers"`
+	RequiredHeaders []string `json:"required_headers"`
+	// ResponseHeaders ("Name: value") are set on every response and
+	// StrippedResponseHeaders removed from it, whatever the local service
+	// answers, with the same empty and nil semantics
+	ResponseHeaders         []string `json:"response_headers"`
+	StrippedResponseHeaders []string `json:"stripped_response_headers"`
+	// LowLatency marks the tunnel as latency-sensitive, metering its requests
+	// apart; nil leaves a reused tunnel's setting unchanged
+	LowLatency *bool `json:"low_latency,omitempty"`
+	// MaxConcurrentRequests caps the tunnel's requests awaiting a response;
+	// 0 removes the cap and nil leaves a reused tunnel's cap unchanged
+	MaxConcurrentRequests *int64 `json:"max_concurrent_requests,omitempty"`
+}
+
+// CreateTunnelResponse is the answer of POST /tunnels, for a new tunnel or
+// one the client already owned under the requested subdomain (Reused)
+type CreateTunnelResponse struct {
+	TunnelID         string `json:"tunnel_id"`
+	Domain           string `json:"domain"`
+	Subdomain        string `json:"subdomain"`
+	WebsocketURL     string `json:"websocket_url"`
+	Status           string `json:"status"`
+	ConnectionPolicy string `json:"connection_policy"`
+	Message          string `json:"message"`
+	Reused           bool   `json:"reused,omitempty"`
+	BlockBots        bool   `json:"block_bots,omitempty"`
+	RobotsTxt        bool   `json:"robots_txt,omitempty"`
+
+	// Region is the tunnel's home region; Regions lists every region so the CLI
+	// can measure which one is nearest and ask for the tunnel to be moved there
+	Region  string           `json:"region,omitempty"`
+	Regions []regions.Region `json:"regions,omitempty"`
+
+	// AllowedCountries and AllowedMethods are the tunnel's restrictions, if any
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+
+	// PasswordProtected is set when visitors have to log in
+	PasswordProtected bool `json:"password_protected,omitempty"`
+	// Visibility is "private" when only requests with an access token are
+	// forwarded
+	Visibility string `json:"visibility,omitempty"`
+
+	// StrippedHeaders and RequiredHeaders are the tunnel's header rules
+	StrippedHeaders []string `json:"stripped_headers,omitempty"`
+	RequiredHeaders []string `json:"required_headers,omitempty"`
+
+	// ResponseHeaders and StrippedResponseHeaders are the tunnel's response
+	// header policy
+	ResponseHeaders         []string `json:"response_headers,omitempty"`
+	StrippedResponseHeaders []string `json:"stripped_response_headers,omitempty"`
+
+	// LowLatency is set when the tunnel's requests are metered as low-latency
+	LowLatency bool `json:"low_latency,omitempty"`
+
+	// MaxConcurrentRequests is the tunnel's cap on requests awaiting a
+	// response, 0 when uncapped
+	MaxConcurrentRequests int64 `json:"max_concurrent_requests,omitempty"`
+}
+
+// TunnelWithHealth adds live connection state to a tunnel when ?health=1 is requested
+type TunnelWithHealth struct {
+	models.Tunnel
+	ConnectionHealthy *bool      `json:"connection_healthy,omitempty"`
+	LastSeen          *time.Time `json:"last_seen,omitempty"`
+}
+
+// ListTunnelsResponse is the answer of GET /tunnels
+type ListTunnelsResponse struct {
+	Tunnels []TunnelWithHealth `json:"tunnels"`
+	Count   int                `json:"count"`
+
+	// LastUsedAt and LastUsedIP are the API key's use before this call
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// DeleteTunnelResponse is the answer of DELETE /tunnels/{tunnel_id}
+type DeleteTunnelResponse struct {
+	Message string `json:"message"`
+}
+
+// ListTunnelEventsResponse is the answer of GET /tunnels/{tunnel_id}/events
+type ListTunnelEventsResponse struct {
+	Events []models.TunnelEvent `json:"events"`
+	Count  int                  `json:"count"`
+}
+
+// CreateConnectionTokenResponse is the answer of
+// POST /tunnels/{tunnel_id}/connection-token
+type CreateConnectionTokenResponse struct {
+	Token     string    `json:"token"`
+	TunnelID  string    `json:"tunnel_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateAccessTokenRequest is the body of
+// POST /tunnels/{tunnel_id}/access-tokens
+type CreateAccessTokenRequest struct {
+	// Consumer names who the token is for; a new token replaces the
+	// consumer's previous one
+	Consumer string `json:"consumer"`
+	// ExpiresIn is the token's lifetime in seconds, 30 days when unset
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// CreateAccessTokenResponse is the answer of
+// POST /tunnels/{tunnel_id}/access-tokens
+type CreateAccessTokenResponse struct {
+	Token     string    `json:"token"`
+	TunnelID  string    `json:"tunnel_id"`
+	Consumer  string    `json:"consumer"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Header is the request header the token is sent in
+	Header string `json:"header"`
+}
+
+// RevokeAccessTokenResponse is the answer of
+// DELETE /tunnels/{tunnel_id}/access-tokens/{consumer}
+type RevokeAccessTokenResponse struct {
+	Message string `json:"message"`
+}
+
+// TunnelStatsResponse is the answer of GET /tunnels/{tunnel_id}/stats
+type TunnelStatsResponse struct {
+	TunnelID     string    `json:"tunnel_id"`
+	Window       string    `json:"window"`
+	Since        time.Time `json:"since"`
+	Requests     int       `json:"requests"`
+	Errors       int       `json:"errors"`
+	ClientErrors int       `json:"client_errors"`
+	ErrorRate    float64   `json:"error_rate"`
+	P50Ms        int64     `json:"p50_ms"`
+	P95Ms        int64     `json:"p95_ms"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+}
+
+// APIKeyInfo describes the API key the request was made with
+type APIKeyInfo struct {
+	// Hint is the start of the key, e.g. "tk_AbCd…"
+	Hint      string    `json:"hint"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsedAt and LastUsedIP are the key's use before this call
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// GetClientResponse is the answer of GET /clients/me
+type GetClientResponse struct {
+	ClientID  string    `json:"client_id"`
+	Status    string    `json:"status"`
+	Plan      string    `json:"plan,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// TunnelQuota is how many tunnels the client may own, 0 meaning no limit
+	TunnelQuota   int `json:"tunnel_quota"`
+	TunnelCount   int `json:"tunnel_count"`
+	ActiveTunnels int `json:"active_tunnels"`
+	// ConnectionLimit is how many CLIs may be connected at once, 0 meaning
+	// no limit
+	ConnectionLimit int `json:"connection_limit"`
+	Connections     int `json:"connections"`
+
+	APIKey APIKeyInfo `json:"api_key"`
+}
+
+// DeleteClientResponse is the answer of DELETE /clients/me
+type DeleteClientResponse struct {
+	Message        string `json:"message"`
+	TunnelsDeleted int    `json:"tunnels_deleted"`
+}
+
+// BillingPortalResponse is the answer of GET /billing/portal
+type BillingPortalResponse struct {
+	URL string `json:"url"`
+	// Type is "portal" for a client that already pays, "checkout" otherwise
+	Type string `json:"type"`
+}
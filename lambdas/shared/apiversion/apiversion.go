@@ -0,0 +1,48 @@
+// Package apiversion wraps the management API handlers so every response
+// says which API version served it and warns callers of deprecated versions.
+package apiversion
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// Handler is a management API Lambda handler
+type Handler func(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)
+
+// Wrap negotiates the API version of each request (models.NegotiateAPIVersion)
+// and adds it to the response in models.APIVersionHeader, with a Deprecation
+// header and models.APIWarningHeader when the caller should upgrade.
+func Wrap(h Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		// The route key (e.g. "GET /v1/tunnels/{tunnel_id}") does not depend
+		// on the stage, unlike the raw path
+		_, path, _ := strings.Cut(request.RouteKey, " ")
+		version, warning := models.NegotiateAPIVersion(path, header(request.Headers, models.APIVersionHeader))
+
+		response, err := h(ctx, request)
+		if response.Headers == nil {
+			response.Headers = map[string]string{}
+		}
+		response.Headers[models.APIVersionHeader] = strconv.Itoa(version)
+		if warning != "" {
+			log.Printf("apiversion: %s served deprecated: %s", request.RouteKey, warning)
+			response.Headers["Deprecation"] = "true"
+			response.Headers[models.APIWarningHeader] = warning
+		}
+		return response, err
+	}
+}
+
+// header returns a request header; API Gateway lowercases header names
+func header(headers map[string]string, name string) string {
+	if v, ok := headers[strings.ToLower(name)]; ok {
+		return v
+	}
+	return headers[name]
+}
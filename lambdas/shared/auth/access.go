@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lifetimes of the access tokens of private tunnels
+const (
+	DefaultAccessTokenTTL = 30 * 24 * time.Hour
+	MaxAccessTokenTTL     = 365 * 24 * time.Hour
+)
+
+// AccessTokenHeader carries the access token on requests to a private
+// tunnel; http-proxy removes it before the request is forwarded
+const AccessTokenHeader = "X-Tunnel-Access-Token"
+
+// ErrInvalidAccessToken is returned for an access token that is malformed,
+// signed with another key, for another tunnel or expired
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// AccessClaims are the claims carried by a private tunnel's access token
+type AccessClaims struct {
+	Consumer  string `json:"sub"`
+	TunnelID  string `json:"tid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// accessTokenHeader is the fixed JWT header of every access token; the type
+// keeps one from being mistaken for a connection token
+var accessTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"tunnel-access+jwt"}`))
+
+var consumerPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// ValidateConsumer reports whether name can name the holder of an access
+// token: up to 64 letters, digits and . _ @ -, starting with a letter or digit
+func ValidateConsumer(name string) bool {
+	return consumerPattern.MatchString(name)
+}
+
+// GenerateAccessKey generates the key a tunnel's access tokens are signed with
+func GenerateAccessKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate access key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// MintAccessToken issues an HS256 JWT with which consumer may call tunnelID
+// until issuedAt plus ttl
+func MintAccessToken(key, tunnelID, consumer string, issuedAt time.Time, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := issuedAt.Add(ttl)
+
+	payload, err := json.Marshal(AccessClaims{
+		Consumer:  consumer,
+		TunnelID:  tunnelID,
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	signingInput := accessTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + sign([]byte(key), signingInput), expiresAt, nil
+}
+
+// VerifyAccessToken checks an access token's signature against the tunnel's
+// key, its tunnel and expiry, and returns its claims. Whether the consumer
+// still holds the token is up to the caller.
+func VerifyAccessToken(key, tunnelID, token string) (*AccessClaims, error) {
+	parts := strings.Split(token, ".")
+	if key == "" || len(parts) != 3 || parts[0] != accessTokenHeader {
+		return nil, ErrInvalidAccessToken
+	}
+
+	expected := sign([]byte(key), parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+
+	var claims AccessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+
+	if claims.Consumer == "" || claims.TunnelID != tunnelID || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidAccessToken
+	}
+
+	return &claims, nil
+}
@@ -2,10 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"math/big"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
@@ -77,18 +77,74 @@ func GenerateTunnelID() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// GenerateRandomSubdomain generates a random subdomain
-func GenerateRandomSubdomain() (string, error) {
-	bytes := make([]byte, 6)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+// SubdomainCharsets are the character sets random subdomains can be drawn from
+var SubdomainCharsets = map[string]string{
+	"hex":    "0123456789abcdef",
+	"lower":  "abcdefghijklmnopqrstuvwxyz",
+	"alnum":  "0123456789abcdefghijklmnopqrstuvwxyz",
+	"digits": "0123456789",
+}
+
+// Bounds on the random part of generated subdomains
+const (
+	MinSubdomainLength = 4
+	MaxSubdomainLength = 32
+)
+
+// SubdomainFormat describes the random subdomains create-tunnel generates
+type SubdomainFormat struct {
+	Length  int    // Characters in the random part
+	Charset string // A key of SubdomainCharsets
+}
+
+// DefaultSubdomainFormat is 8 hex characters (32 bits)
+var DefaultSubdomainFormat = SubdomainFormat{Length: 8, Charset: "hex"}
+
+// Validate checks the format's length and character set
+func (f SubdomainFormat) Validate() error {
+	if _, ok := SubdomainCharsets[f.Charset]; !ok {
+		return fmt.Errorf("unknown subdomain charset %q (use hex, lower, alnum or digits)", f.Charset)
+	}
+	if f.Length < MinSubdomainLength || f.Length > MaxSubdomainLength {
+		return fmt.Errorf("subdomain length must be between %d and %d", MinSubdomainLength, MaxSubdomainLength)
+	}
+	return nil
+}
+
+// GenerateRandomSubdomain generates a random subdomain in format, as
+// "<prefix>-<random>" when the client has a subdomain prefix
+func GenerateRandomSubdomain(format SubdomainFormat, prefix string) (string, error) {
+	charset := SubdomainCharsets[format.Charset]
+	if charset == "" {
+		return "", fmt.Errorf("unknown subdomain charset %q", format.Charset)
+	}
+
+	random := make([]byte, format.Length)
+	limit := big.NewInt(int64(len(charset)))
+	for i := range random {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random bytes: %w", err)
+		}
+		random[i] = charset[n.Int64()]
 	}
 
-	// Use SHA256 to generate a deterministic subdomain from random bytes
-	hash := sha256.Sum256(bytes)
-	subdomain := hex.EncodeToString(hash[:4])
+	if prefix != "" {
+		return prefix + "-" + string(random), nil
+	}
+	return string(random), nil
+}
+
+// ValidateSubdomainPrefix validates a client's subdomain prefix: a short
+// subdomain label that leaves room for the random part
+func ValidateSubdomainPrefix(prefix string) bool {
+	return len(prefix) <= 20 && ValidateSubdomain(prefix)
+}
 
-	return subdomain, nil
+// InSubdomainNamespace reports whether subdomain is "<prefix>-..."; every
+// subdomain is in the empty prefix's namespace
+func InSubdomainNamespace(subdomain, prefix string) bool {
+	return prefix == "" || (strings.HasPrefix(subdomain, prefix+"-") && len(subdomain) > len(prefix)+1)
 }
 
 // ValidateSubdomain validates a custom subdomain format
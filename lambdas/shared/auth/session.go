@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TunnelSessionTTL is how long a visitor stays logged in to a
+// password-protected tunnel
+const TunnelSessionTTL = 12 * time.Hour
+
+// MinTunnelPasswordLength is the shortest tunnel password accepted
+const MinTunnelPasswordLength = 8
+
+var ErrInvalidSession = errors.New("invalid tunnel session")
+
+// HashTunnelPassword hashes a tunnel password using bcrypt
+func HashTunnelPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash tunnel password: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// VerifyTunnelPassword verifies a tunnel password against a hash
+func VerifyTunnelPassword(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// MintTunnelSession issues the session cookie value of a visitor who entered
+// the password of tunnelID. It is bound to the password's hash, so changing
+// the password ends every session.
+func MintTunnelSession(secret []byte, tunnelID, passwordHash string) (string, time.Time) {
+	expiresAt := time.Now().Add(TunnelSessionTTL)
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	return exp + "." + sign(secret, sessionSigningInput(tunnelID, passwordHash, exp)), expiresAt
+}
+
+// VerifyTunnelSession checks a session cookie value minted for tunnelID with
+// its current password hash
+func VerifyTunnelSession(secret []byte, session, tunnelID, passwordHash string) error {
+	exp, signature, ok := strings.Cut(session, ".")
+	if !ok {
+		return ErrInvalidSession
+	}
+
+	expected := sign(secret, sessionSigningInput(tunnelID, passwordHash, exp))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSession
+	}
+
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return ErrInvalidSession
+	}
+	return nil
+}
+
+func sessionSigningInput(tunnelID, passwordHash, exp string) string {
+	return "tunnel-session." + tunnelID + "." + passwordHash + "." + exp
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConnectionTokenTTL is how long a connection token is valid. It only has to
+// survive until the WebSocket handshake, so it is kept short.
+const ConnectionTokenTTL = 5 * time.Minute
+
+var (
+	ErrInvalidToken = errors.New("invalid connection token")
+	ErrTokenExpired = errors.New("connection token expired")
+)
+
+// ConnectionClaims are the claims carried by a connection token
+type ConnectionClaims struct {
+	ClientID  string `json:"sub"`
+	TunnelID  string `json:"tid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// tokenHeader is the fixed JWT header of every connection token
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// IsConnectionToken reports whether a bearer credential is a connection token
+// rather than an API key
+func IsConnectionToken(credential string) bool {
+	return !strings.HasPrefix(credential, APIKeyPrefix) && strings.Count(credential, ".") == 2
+}
+
+// MintConnectionToken issues an HS256 JWT that lets clientID open a WebSocket
+// connection for tunnelID until the returned expiry
+func MintConnectionToken(secret []byte, clientID, tunnelID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ConnectionTokenTTL)
+
+	payload, err := json.Marshal(ConnectionClaims{
+		ClientID:  clientID,
+		TunnelID:  tunnelID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + sign(secret, signingInput), expiresAt, nil
+}
+
+// VerifyConnectionToken checks a connection token's signature and expiry and
+// returns its claims
+func VerifyConnectionToken(secret []byte, token string) (*ConnectionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrInvalidToken
+	}
+
+	expected := sign(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims ConnectionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ClientID == "" || claims.TunnelID == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
+
+func sign(secret []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
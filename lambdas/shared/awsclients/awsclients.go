@@ -0,0 +1,75 @@
+// Package awsclients keeps the AWS service clients a Lambda needs for the
+// life of its execution environment. Clients are created on first use and
+// share one HTTP client, so warm invocations reuse the pooled TLS connections
+// instead of dialing API Gateway and S3 again.
+package awsclients
+
+import (
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxIdleConnsPerHost keeps enough idle connections for http-proxy's
+// concurrent chunk posts to one WebSocket endpoint (the SDK keeps 10)
+const maxIdleConnsPerHost = 32
+
+var (
+	httpClientOnce sync.Once
+	httpClient     *awshttp.BuildableClient
+
+	mu          sync.Mutex
+	managements = map[string]*apigatewaymanagementapi.Client{}
+	s3Client    *s3.Client
+	s3Presign   *s3.PresignClient
+)
+
+// HTTPClient is the HTTP client all the package's clients send through
+func HTTPClient() *awshttp.BuildableClient {
+	httpClientOnce.Do(func() {
+		httpClient = awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		})
+	})
+	return httpClient
+}
+
+// Management returns the API Gateway management client for a WebSocket API
+// endpoint, e.g. https://abc123.execute-api.us-east-1.amazonaws.com/prod
+func Management(cfg aws.Config, endpoint string) *apigatewaymanagementapi.Client {
+	mu.Lock()
+	defer mu.Unlock()
+	if client, ok := managements[endpoint]; ok {
+		return client
+	}
+	client := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.HTTPClient = HTTPClient()
+	})
+	managements[endpoint] = client
+	return client
+}
+
+// S3 returns the S3 client and a presigner built on it. S3_ENDPOINT points
+// them at MinIO or another S3 stand-in instead of AWS, with path-style URLs.
+func S3(cfg aws.Config) (*s3.Client, *s3.PresignClient) {
+	mu.Lock()
+	defer mu.Unlock()
+	if s3Client == nil {
+		endpoint := os.Getenv("S3_ENDPOINT")
+		s3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.HTTPClient = HTTPClient()
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+				o.UsePathStyle = true
+			}
+		})
+		s3Presign = s3.NewPresignClient(s3Client)
+	}
+	return s3Client, s3Presign
+}
@@ -0,0 +1,140 @@
+package awsclients
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+func testConfig() aws.Config {
+	return aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+}
+
+// managementServer stands in for a WebSocket API's @connections endpoint over
+// TLS and counts the connections dialed to it
+func managementServer(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+	var dials atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.StartTLS()
+	tb.Cleanup(server.Close)
+	return server, &dials
+}
+
+// trusting returns transport options that trust server's certificate
+func trusting(server *httptest.Server) func(*http.Transport) {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return func(t *http.Transport) {
+		t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+}
+
+// useServer points the package's shared HTTP client at server and forgets
+// the cached clients, so the next Management call builds one on it
+func useServer(server *httptest.Server) {
+	mu.Lock()
+	defer mu.Unlock()
+	httpClientOnce.Do(func() {})
+	httpClient = awshttp.NewBuildableClient().WithTransportOptions(trusting(server))
+	managements = map[string]*apigatewaymanagementapi.Client{}
+	s3Client, s3Presign = nil, nil
+}
+
+func postToConnection(tb testing.TB, client *apigatewaymanagementapi.Client) {
+	tb.Helper()
+	_, err := client.PostToConnection(context.Background(), &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String("connection"),
+		Data:         []byte(`{"type":"ping"}`),
+	})
+	if err != nil {
+		tb.Fatalf("PostToConnection: %v", err)
+	}
+}
+
+func TestManagementCachesPerEndpoint(t *testing.T) {
+	cfg := testConfig()
+	first := Management(cfg, "https://one.example.com/prod")
+	if again := Management(cfg, "https://one.example.com/prod"); again != first {
+		t.Error("Management built a second client for the same endpoint")
+	}
+	if other := Management(cfg, "https://two.example.com/prod"); other == first {
+		t.Error("Management returned the same client for another endpoint")
+	}
+}
+
+func TestS3Cached(t *testing.T) {
+	client, presign := S3(testConfig())
+	again, againPresign := S3(testConfig())
+	if again != client || againPresign != presign {
+		t.Error("S3 built a second client")
+	}
+}
+
+func TestManagementReusesConnections(t *testing.T) {
+	server, dials := managementServer(t)
+	useServer(server)
+
+	for range 5 {
+		postToConnection(t, Management(testConfig(), server.URL))
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("5 posts dialed %d connections, want 1", got)
+	}
+}
+
+// The benchmarks post to a local TLS endpoint the way http-proxy does once
+// per request: through the shared client, or through a client built for the
+// request as http-proxy did before, which dials and handshakes every time.
+// Compare them with go test -bench . ./shared/awsclients/
+
+func BenchmarkPostToConnectionShared(b *testing.B) {
+	server, dials := managementServer(b)
+	useServer(server)
+	cfg := testConfig()
+
+	b.ResetTimer()
+	for range b.N {
+		postToConnection(b, Management(cfg, server.URL))
+	}
+	b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+}
+
+func BenchmarkPostToConnectionPerRequest(b *testing.B) {
+	server, dials := managementServer(b)
+	cfg := testConfig()
+	options := trusting(server)
+
+	b.ResetTimer()
+	for range b.N {
+		client := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+			o.BaseEndpoint = aws.String(server.URL)
+			o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(options)
+		})
+		postToConnection(b, client)
+	}
+	b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+}
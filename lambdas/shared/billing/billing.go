@@ -0,0 +1,213 @@
+// Package billing talks to Stripe: it verifies and decodes webhook events,
+// opens customer-portal sessions and reports metered usage. It calls the REST
+// API directly, with the secret key of the deployment's Stripe account.
+package billing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+const (
+	// SignatureHeader carries the signature of a webhook delivery
+	SignatureHeader = "Stripe-Signature"
+	// signatureTolerance is how old a signed delivery may be, against replays
+	signatureTolerance = 5 * time.Minute
+
+	defaultBaseURL = "https://api.stripe.com"
+)
+
+// Webhook event types the tunnel service acts on
+const (
+	EventCheckoutCompleted   = "checkout.session.completed"
+	EventSubscriptionCreated = "customer.subscription.created"
+	EventSubscriptionUpdated = "customer.subscription.updated"
+	EventSubscriptionDeleted = "customer.subscription.deleted"
+)
+
+// ErrInvalidSignature is returned for a webhook delivery that was not signed
+// with the endpoint's secret, or was signed too long ago
+var ErrInvalidSignature = errors.New("invalid Stripe signature")
+
+// VerifySignature checks the Stripe-Signature header of a webhook delivery:
+// an HMAC-SHA256 of "<timestamp>.<payload>" with the endpoint's signing secret
+func VerifySignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Event is a webhook event; Data.Object holds the object it is about
+type Event struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"` // Unix seconds; Stripe does not deliver events in order
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// CheckoutSession is a completed Checkout or Payment Link purchase. The
+// checkout link carries the client ID as client_reference_id.
+type CheckoutSession struct {
+	ClientReferenceID string `json:"client_reference_id"`
+	Customer          string `json:"customer"`
+}
+
+// Subscription is a customer's subscription to a plan's price
+type Subscription struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Status   string `json:"status"`
+	Items    struct {
+		Data []struct {
+			Price struct {
+				ID        string `json:"id"`
+				LookupKey string `json:"lookup_key"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+// Plan returns the plan the subscription grants: the first of its prices
+// whose lookup key names a paid plan while it is active or trialing, and the
+// free plan once it has ended. ok is false while the subscription is in
+// between (incomplete, past due), when the client keeps its current plan.
+func (s *Subscription) Plan() (plan string, ok bool) {
+	switch s.Status {
+	case "active", "trialing":
+		for _, item := range s.Items.Data {
+			if _, paid := models.PlanFeatures[item.Price.LookupKey]; paid {
+				return item.Price.LookupKey, true
+			}
+		}
+		return models.PlanFree, true
+	case "canceled", "unpaid", "incomplete_expired":
+		return models.PlanFree, true
+	}
+	return "", false
+}
+
+// Client calls the Stripe API
+type Client struct {
+	SecretKey  string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the account of secretKey
+func NewClient(secretKey string) *Client {
+	return &Client{
+		SecretKey:  secretKey,
+		BaseURL:    defaultBaseURL,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PortalSession opens a customer-portal session, where the customer manages
+// their subscription and payment methods, and returns its URL
+func (c *Client) PortalSession(ctx context.Context, customerID, returnURL string) (string, error) {
+	form := url.Values{"customer": {customerID}}
+	if returnURL != "" {
+		form.Set("return_url", returnURL)
+	}
+	var session struct {
+		URL string `json:"url"`
+	}
+	if err := c.post(ctx, "/v1/billing_portal/sessions", form, "", &session); err != nil {
+		return "", fmt.Errorf("failed to create portal session for %s: %w", customerID, err)
+	}
+	return session.URL, nil
+}
+
+// MeterEvent reports value units of the meter eventName for a customer at
+// timestamp. Stripe drops a second event with the same identifier, so a
+// report can be retried.
+func (c *Client) MeterEvent(ctx context.Context, eventName, customerID string, value int64, timestamp time.Time, identifier string) error {
+	form := url.Values{
+		"event_name":                  {eventName},
+		"payload[stripe_customer_id]": {customerID},
+		"payload[value]":              {strconv.FormatInt(value, 10)},
+		"timestamp":                   {strconv.FormatInt(timestamp.Unix(), 10)},
+		"identifier":                  {identifier},
+	}
+	if err := c.post(ctx, "/v1/billing/meter_events", form, identifier, nil); err != nil {
+		return fmt.Errorf("failed to report usage for %s: %w", customerID, err)
+	}
+	return nil
+}
+
+// post sends a form-encoded API request and decodes the response into out
+func (c *Client) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("stripe: %s (status %d)", apiErr.Error.Message, resp.StatusCode)
+		}
+		return fmt.Errorf("stripe: status %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
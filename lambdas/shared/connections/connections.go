@@ -0,0 +1,37 @@
+// Package connections ends tunnel CLIs' WebSocket connections through the
+// API Gateway management API.
+package connections
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// Terminate notifies the CLI with a tunnel_deleted message and closes its
+// connection, so it exits instead of reconnecting to a deleted tunnel
+func Terminate(ctx context.Context, client *apigatewaymanagementapi.Client, connectionID, tunnelID string) error {
+	payload, err := models.EncodeMessage(models.ActionTunnelDeleted, &models.TunnelNoticePayload{TunnelID: tunnelID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel_deleted message: %w", err)
+	}
+
+	// Best effort: the connection may already be gone
+	if _, err := client.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         payload,
+	}); err != nil {
+		log.Printf("connections: failed to notify connection %s: %v", connectionID, err)
+	}
+
+	if _, err := client.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	}); err != nil {
+		return fmt.Errorf("failed to delete connection %s: %w", connectionID, err)
+	}
+	return nil
+}
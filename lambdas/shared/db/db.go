@@ -2,10 +2,13 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -15,19 +18,47 @@ import (
 type DynamoDBClient struct {
 	client *dynamodb.Client
 	cfg    aws.Config
+	hooks  []OperationHook
 }
 
-// NewDynamoDBClient creates a new DynamoDB client
+// NewDynamoDBClient creates a new DynamoDB client. DYNAMODB_ENDPOINT points it
+// at DynamoDB Local or LocalStack instead of AWS; DYNAMODB_STATIC_CREDENTIALS=true
+// signs requests with dummy credentials so no AWS account is needed. Every call
+// is logged with its latency, retries and error class unless DYNAMODB_METRICS=off.
 func NewDynamoDBClient(ctx context.Context) (*DynamoDBClient, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+	var opts []func(*config.LoadOptions) error
+	if os.Getenv("DYNAMODB_STATIC_CREDENTIALS") == "true" {
+		opts = append(opts,
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("local", "local", "")),
+			config.WithDefaultRegion("us-east-1"),
+		)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load AWS config: %w", err)
 	}
 
-	return &DynamoDBClient{
-		client: dynamodb.NewFromConfig(cfg),
-		cfg:    cfg,
-	}, nil
+	policy, err := retryPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+
+	d := &DynamoDBClient{cfg: cfg}
+	if os.Getenv("DYNAMODB_METRICS") != "off" {
+		d.OnOperation(logOperation)
+	}
+	d.client = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.Retryer = newRetryer(policy)
+		o.APIOptions = append(o.APIOptions, d.instrument)
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	return d, nil
 }
 
 // GetAWSConfig returns the AWS config
@@ -64,7 +95,7 @@ func (d *DynamoDBClient) GetItem(ctx context.Context, tableName string, key map[
 	}
 
 	if output.Item == nil {
-		return fmt.Errorf("item not found")
+		return ErrItemNotFound
 	}
 
 	err = attributevalue.UnmarshalMap(output.Item, result)
@@ -103,18 +134,71 @@ func (d *DynamoDBClient) Query(ctx context.Context, input *dynamodb.QueryInput,
 	return nil
 }
 
-// GetRawItem retrieves a raw DynamoDB item without unmarshaling
-func (d *DynamoDBClient) GetRawItem(ctx context.Context, tableName string, key map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+// MaxPages caps how many pages QueryAll, ScanAll, QueryPages and ScanPages read
+// (1 MB each), so a runaway query cannot keep a Lambda busy until it times out
+const MaxPages = 100
+
+// ErrItemNotFound is returned by GetItem when no item has the given key
+var ErrItemNotFound = errors.New("item not found")
+
+// ErrPageLimit is returned when a paginated read stops at MaxPages
+var ErrPageLimit = errors.New("page limit reached")
+
+// QueryAll queries items from a DynamoDB table, following pagination until all
+// matching items have been read
+func (d *DynamoDBClient) QueryAll(ctx context.Context, input *dynamodb.QueryInput, results interface{}) error {
+	var items []map[string]types.AttributeValue
+	err := d.QueryPages(ctx, input, func(page []map[string]types.AttributeValue) bool {
+		items = append(items, page...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	err = attributevalue.UnmarshalListOfMaps(items, results)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal items: %w", err)
+	}
+
+	return nil
+}
+
+// QueryPages queries a DynamoDB table and calls fn with the raw items of each
+// page until fn returns false or there are no more pages
+func (d *DynamoDBClient) QueryPages(ctx context.Context, input *dynamodb.QueryInput, fn func(items []map[string]types.AttributeValue) bool) error {
+	paginator := dynamodb.NewQueryPaginator(d.client, input)
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if pages == MaxPages {
+			return fmt.Errorf("failed to query items: %w", ErrPageLimit)
+		}
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to query items: %w", err)
+		}
+		if !fn(output.Items) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// GetRawItem retrieves a raw DynamoDB item without unmarshaling. A consistent
+// read sees every write that succeeded before it, at twice the read cost; an
+// eventually consistent one may miss writes of the last second or so.
+func (d *DynamoDBClient) GetRawItem(ctx context.Context, tableName string, key map[string]types.AttributeValue, consistent bool) (map[string]types.AttributeValue, error) {
 	output, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
-		Key:       key,
+		TableName:      aws.String(tableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(consistent),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get item: %w", err)
 	}
 
 	if output.Item == nil {
-		return nil, fmt.Errorf("item not found")
+		return nil, ErrItemNotFound
 	}
 
 	return output.Item, nil
@@ -130,6 +214,23 @@ func (d *DynamoDBClient) UpdateItem(ctx context.Context, input *dynamodb.UpdateI
 	return nil
 }
 
+// UpdateItemReturning updates an item and unmarshals the attributes selected by
+// input.ReturnValues into result. A failed ConditionExpression returns
+// ErrConditionFailed.
+func (d *DynamoDBClient) UpdateItemReturning(ctx context.Context, input *dynamodb.UpdateItemInput, result interface{}) error {
+	output, err := d.client.UpdateItem(ctx, input)
+	if err != nil {
+		return conditionError("update item", err)
+	}
+
+	err = attributevalue.UnmarshalMap(output.Attributes, result)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal item: %w", err)
+	}
+
+	return nil
+}
+
 // Scan scans items from a DynamoDB table
 func (d *DynamoDBClient) Scan(ctx context.Context, input *dynamodb.ScanInput, results interface{}) error {
 	output, err := d.client.Scan(ctx, input)
@@ -144,3 +245,43 @@ func (d *DynamoDBClient) Scan(ctx context.Context, input *dynamodb.ScanInput, re
 
 	return nil
 }
+
+// ScanAll scans a DynamoDB table, following pagination until the whole table
+// has been read
+func (d *DynamoDBClient) ScanAll(ctx context.Context, input *dynamodb.ScanInput, results interface{}) error {
+	var items []map[string]types.AttributeValue
+	err := d.ScanPages(ctx, input, func(page []map[string]types.AttributeValue) bool {
+		items = append(items, page...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	err = attributevalue.UnmarshalListOfMaps(items, results)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal items: %w", err)
+	}
+
+	return nil
+}
+
+// ScanPages scans a DynamoDB table and calls fn with the raw items of each page
+// until fn returns false or the whole table has been read
+func (d *DynamoDBClient) ScanPages(ctx context.Context, input *dynamodb.ScanInput, fn func(items []map[string]types.AttributeValue) bool) error {
+	paginator := dynamodb.NewScanPaginator(d.client, input)
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if pages == MaxPages {
+			return fmt.Errorf("failed to scan items: %w", ErrPageLimit)
+		}
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan items: %w", err)
+		}
+		if !fn(output.Items) {
+			return nil
+		}
+	}
+
+	return nil
+}
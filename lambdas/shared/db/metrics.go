@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// metricNamespace is the CloudWatch namespace DynamoDB metrics are emitted in
+const metricNamespace = "Tunnel"
+
+// Operation describes one completed DynamoDB call, including its retries
+type Operation struct {
+	Name       string        // API operation, e.g. "GetItem"
+	Table      string        // Table the call targeted; "" for multi-table transactions
+	Duration   time.Duration // Wall time across all attempts
+	Retries    int           // Attempts after the first
+	ErrorClass string        // "" on success, otherwise see errorClass
+	Err        error
+}
+
+// OperationHook is called after every DynamoDB call made through a DynamoDBClient
+type OperationHook func(op Operation)
+
+// OnOperation registers hook to run after every DynamoDB call. Hooks run
+// synchronously on the calling goroutine and must not block.
+func (d *DynamoDBClient) OnOperation(hook OperationHook) {
+	d.hooks = append(d.hooks, hook)
+}
+
+func (d *DynamoDBClient) runHooks(op Operation) {
+	for _, hook := range d.hooks {
+		hook(op)
+	}
+}
+
+// instrument adds a middleware that times each call end to end (outside the
+// retry loop) and reports it to the client's hooks
+func (d *DynamoDBClient) instrument(stack *middleware.Stack) error {
+	name := stack.ID()
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("TunnelInstrumentation",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+
+			op := Operation{
+				Name:       name,
+				Table:      tableName(in.Parameters),
+				Duration:   time.Since(start),
+				ErrorClass: errorClass(err),
+				Err:        err,
+			}
+			if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 1 {
+				op.Retries = len(attempts.Results) - 1
+			}
+			d.runHooks(op)
+
+			return out, metadata, err
+		}), middleware.After)
+}
+
+// tableName returns the table an operation input targets
+func tableName(params interface{}) string {
+	switch input := params.(type) {
+	case *dynamodb.GetItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.PutItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.UpdateItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.DeleteItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.QueryInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.ScanInput:
+		return aws.ToString(input.TableName)
+	}
+	return ""
+}
+
+// errorClass buckets err into a small set of classes suitable as a metric
+// dimension
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	var canceled *types.TransactionCanceledException
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &conditionFailed):
+		return "ConditionFailed"
+	case errors.As(err, &canceled):
+		return "TransactionCanceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "Timeout"
+	case errors.As(err, &apiErr):
+		if _, ok := retry.DefaultThrottleErrorCodes[apiErr.ErrorCode()]; ok {
+			return "Throttled"
+		}
+		if apiErr.ErrorFault() == smithy.FaultServer {
+			return "ServerError"
+		}
+		return "ClientError"
+	}
+	return "Network"
+}
+
+// logOperation is the default hook: it writes one structured log line per
+// call that doubles as CloudWatch embedded metric format, so Lambda's log
+// forwarding turns it into DynamoDBLatency, DynamoDBRetryCount and
+// DynamoDBErrors metrics per operation and per table
+func logOperation(op Operation) {
+	failed := 0
+	if op.Err != nil {
+		failed = 1
+	}
+
+	fields := map[string]interface{}{
+		"Operation":          op.Name,
+		"Table":              op.Table,
+		"ErrorClass":         op.ErrorClass,
+		"DynamoDBLatency":    float64(op.Duration.Microseconds()) / 1000,
+		"DynamoDBRetryCount": op.Retries,
+		"DynamoDBErrors":     failed,
+	}
+	if op.Err != nil {
+		fields["error"] = op.Err.Error()
+	}
+
+	emitMetrics(fields, [][]string{{"FunctionName", "Operation"}, {"FunctionName", "Table"}},
+		[]map[string]string{
+			{"Name": "DynamoDBLatency", "Unit": "Milliseconds"},
+			{"Name": "DynamoDBRetryCount", "Unit": "Count"},
+			{"Name": "DynamoDBErrors", "Unit": "Count"},
+		})
+}
+
+// EmitGauge writes one value as a metric in embedded metric format, under the
+// calling function's FunctionName dimension
+func EmitGauge(name string, value float64, unit string) {
+	emitMetrics(map[string]interface{}{name: value}, [][]string{{"FunctionName"}},
+		[]map[string]string{{"Name": name, "Unit": unit}})
+}
+
+// emitMetrics writes fields to stdout in CloudWatch embedded metric format;
+// Lambda forwards stdout to CloudWatch Logs, which extracts the metrics
+func emitMetrics(fields map[string]interface{}, dimensions [][]string, metrics []map[string]string) {
+	fields["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricNamespace,
+			"Dimensions": dimensions,
+			"Metrics":    metrics,
+		}},
+	}
+	fields["FunctionName"] = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(line))
+}
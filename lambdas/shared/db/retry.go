@@ -0,0 +1,98 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// RetryPolicy controls how DynamoDB calls are retried. Throttling
+// (ProvisionedThroughputExceeded, RequestLimitExceeded, ...) and transient
+// network errors are retried with exponential backoff and full jitter.
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts per call, including the first
+	MaxBackoff  time.Duration // Upper bound of a single backoff delay
+}
+
+// DefaultRetryPolicy is used unless DYNAMODB_MAX_ATTEMPTS or
+// DYNAMODB_MAX_BACKOFF_MS override it
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	MaxBackoff:  2 * time.Second,
+}
+
+// retryPolicyFromEnv returns DefaultRetryPolicy with any overrides from the
+// environment applied
+func retryPolicyFromEnv() (RetryPolicy, error) {
+	policy := DefaultRetryPolicy
+
+	if v := os.Getenv("DYNAMODB_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("DYNAMODB_MAX_ATTEMPTS must be a positive integer")
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	if v := os.Getenv("DYNAMODB_MAX_BACKOFF_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 1 {
+			return policy, fmt.Errorf("DYNAMODB_MAX_BACKOFF_MS must be a positive integer")
+		}
+		policy.MaxBackoff = time.Duration(ms) * time.Millisecond
+	}
+
+	return policy, nil
+}
+
+// newRetryer builds the SDK retryer for policy. The client-side retry quota is
+// disabled: under a burst every container would otherwise exhaust it and stop
+// retrying exactly when throttling starts.
+func newRetryer(policy RetryPolicy) aws.Retryer {
+	return &meteredRetryer{
+		RetryerV2: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = policy.MaxAttempts
+			o.MaxBackoff = policy.MaxBackoff
+			o.Backoff = retry.NewExponentialJitterBackoff(policy.MaxBackoff)
+			o.RateLimiter = ratelimit.None
+		}),
+	}
+}
+
+// meteredRetryer emits a DynamoDBRetries metric for every retry it schedules
+type meteredRetryer struct {
+	aws.RetryerV2
+}
+
+func (r *meteredRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	delay, delayErr := r.RetryerV2.RetryDelay(attempt, err)
+	if delayErr == nil {
+		emitRetryMetric(errorCode(err))
+	}
+	return delay, delayErr
+}
+
+// errorCode returns the AWS error code of err, or "Transient" for errors that
+// never reached DynamoDB (timeouts, connection resets)
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return "Transient"
+}
+
+// emitRetryMetric logs a DynamoDBRetries metric for a single scheduled retry
+func emitRetryMetric(code string) {
+	emitMetrics(map[string]interface{}{
+		"ErrorCode":       code,
+		"DynamoDBRetries": 1,
+	}, [][]string{{"FunctionName", "ErrorCode"}}, []map[string]string{{"Name": "DynamoDBRetries", "Unit": "Count"}})
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrConditionFailed is wrapped by the errors of conditional writes whose
+// condition did not hold. Match it with errors.Is.
+var ErrConditionFailed = errors.New("condition check failed")
+
+// TransactionCanceledError is returned by TransactWrite when DynamoDB cancels
+// the transaction. It matches ErrConditionFailed when any item's condition failed.
+type TransactionCanceledError struct {
+	// Reasons holds one cancellation code per item, in the order the items were
+	// given; items that did not cause the cancellation have "None"
+	Reasons []string
+
+	err error
+}
+
+func (e *TransactionCanceledError) Error() string {
+	return fmt.Sprintf("transaction canceled [%s]", strings.Join(e.Reasons, ", "))
+}
+
+func (e *TransactionCanceledError) Unwrap() []error {
+	if e.ConditionFailed(-1) {
+		return []error{ErrConditionFailed, e.err}
+	}
+	return []error{e.err}
+}
+
+// ConditionFailed reports whether the condition of item i failed, or of any
+// item when i is negative
+func (e *TransactionCanceledError) ConditionFailed(i int) bool {
+	for j, reason := range e.Reasons {
+		if (i < 0 || i == j) && reason == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionError wraps ErrConditionFailed around DynamoDB's own conditional
+// check error, so callers can match either
+func conditionError(op string, err error) error {
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return fmt.Errorf("failed to %s: %w: %w", op, ErrConditionFailed, err)
+	}
+	return fmt.Errorf("failed to %s: %w", op, err)
+}
+
+// PutItemIfNotExists puts an item unless one with the same partition key
+// (keyAttribute) already exists, in which case it returns ErrConditionFailed
+func (d *DynamoDBClient) PutItemIfNotExists(ctx context.Context, tableName string, item interface{}, keyAttribute string) error {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(tableName),
+		Item:                     av,
+		ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+		ExpressionAttributeNames: map[string]string{"#pk": keyAttribute},
+	})
+	if err != nil {
+		return conditionError("put item", err)
+	}
+
+	return nil
+}
+
+// PutItemWithCondition puts an item if condition holds for the item it would
+// replace, and returns ErrConditionFailed when it does not
+func (d *DynamoDBClient) PutItemWithCondition(ctx context.Context, tableName string, item interface{}, condition string, values map[string]types.AttributeValue) error {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(tableName),
+		Item:                      av,
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return conditionError("put item", err)
+	}
+
+	return nil
+}
+
+// UpdateItemWithCondition runs an update that must carry a ConditionExpression
+// and returns ErrConditionFailed when the condition does not hold
+func (d *DynamoDBClient) UpdateItemWithCondition(ctx context.Context, input *dynamodb.UpdateItemInput) error {
+	if input.ConditionExpression == nil {
+		return fmt.Errorf("failed to update item: missing condition expression")
+	}
+
+	_, err := d.client.UpdateItem(ctx, input)
+	if err != nil {
+		return conditionError("update item", err)
+	}
+
+	return nil
+}
+
+// TransactWrite applies all items atomically. If DynamoDB cancels the
+// transaction the error is a *TransactionCanceledError.
+func (d *DynamoDBClient) TransactWrite(ctx context.Context, items ...types.TransactWriteItem) error {
+	_, err := d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			reasons := make([]string, len(canceled.CancellationReasons))
+			for i, reason := range canceled.CancellationReasons {
+				reasons[i] = aws.ToString(reason.Code)
+			}
+			return &TransactionCanceledError{Reasons: reasons, err: err}
+		}
+		return fmt.Errorf("failed to write transaction: %w", err)
+	}
+
+	return nil
+}
+
+// PutIfNotExists builds a transaction item that puts item unless one with the
+// same partition key (keyAttribute) already exists
+func PutIfNotExists(tableName string, item interface{}, keyAttribute string) (types.TransactWriteItem, error) {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName:                aws.String(tableName),
+			Item:                     av,
+			ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+			ExpressionAttributeNames: map[string]string{"#pk": keyAttribute},
+		},
+	}, nil
+}
+
+// Delete builds a transaction item that deletes the item at key
+func Delete(tableName string, key map[string]types.AttributeValue) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Delete: &types.Delete{
+			TableName: aws.String(tableName),
+			Key:       key,
+		},
+	}
+}
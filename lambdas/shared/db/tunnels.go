@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// ConnectionIDIndex is the tunnels table GSI keyed by connection_id. It is sparse:
+// only tunnels with a live connection appear in it.
+const ConnectionIDIndex = "connection_id-index"
+
+// FindTunnelByConnectionID resolves the tunnel a WebSocket connection belongs to
+func (d *DynamoDBClient) FindTunnelByConnectionID(ctx context.Context, tunnelsTable, connectionID string) (*models.Tunnel, error) {
+	var tunnels []models.Tunnel
+	err := d.QueryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(tunnelsTable),
+		IndexName:              aws.String(ConnectionIDIndex),
+		KeyConditionExpression: aws.String("connection_id = :connection_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	}, &tunnels)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tunnels) == 0 {
+		return nil, fmt.Errorf("tunnel not found for connection ID: %s", connectionID)
+	}
+
+	return &tunnels[0], nil
+}
+
+// FindTunnelForConnection is FindTunnelByConnectionID with a fallback for
+// connections that are not the tunnel's primary connection (multi policy):
+// tunnelIDHint, usually taken from the authorizer context, is loaded directly
+// and accepted only if it lists the connection or is draining it.
+func (d *DynamoDBClient) FindTunnelForConnection(ctx context.Context, tunnelsTable, connectionID, tunnelIDHint string) (*models.Tunnel, error) {
+	tunnel, err := d.FindTunnelByConnectionID(ctx, tunnelsTable, connectionID)
+	if err == nil || tunnelIDHint == "" {
+		return tunnel, err
+	}
+
+	var hinted models.Tunnel
+	if err := d.GetItem(ctx, tunnelsTable, map[string]types.AttributeValue{
+		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelIDHint},
+	}, &hinted); err != nil {
+		return nil, err
+	}
+
+	if !hinted.HasConnection(connectionID) && hinted.DrainingConnectionID != connectionID {
+		return nil, fmt.Errorf("tunnel not found for connection ID: %s", connectionID)
+	}
+
+	return &hinted, nil
+}
+
+// maxVersionConflicts bounds how often UpdateTunnel starts over because the
+// tunnel changed between its read and its write
+const maxVersionConflicts = 5
+
+// ErrVersionConflict is returned when a versioned update finds the tunnel at a
+// different version than it was read at
+var ErrVersionConflict = errors.New("tunnel was modified concurrently")
+
+// Versioned makes an update to a tunnel record apply only if the record is still
+// at version, and bumps the version. Conditions already on input are kept.
+// Records written before versioning have no version attribute and count as 0.
+func Versioned(input *dynamodb.UpdateItemInput, version int64) *dynamodb.UpdateItemInput {
+	if input.ExpressionAttributeNames == nil {
+		input.ExpressionAttributeNames = map[string]string{}
+	}
+	if input.ExpressionAttributeValues == nil {
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{}
+	}
+	input.ExpressionAttributeNames["#version"] = "version"
+	input.ExpressionAttributeValues[":expected_version"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+	input.ExpressionAttributeValues[":next_version"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(version+1, 10)}
+
+	update := aws.ToString(input.UpdateExpression)
+	if rest, ok := strings.CutPrefix(update, "SET "); ok {
+		update = "SET #version = :next_version, " + rest
+	} else {
+		update = "SET #version = :next_version " + update
+	}
+	input.UpdateExpression = aws.String(update)
+
+	condition := "#version = :expected_version"
+	if version == 0 {
+		condition = "(attribute_not_exists(#version) OR #version = :expected_version)"
+	}
+	if input.ConditionExpression != nil {
+		condition = "(" + *input.ConditionExpression + ") AND " + condition
+	}
+	input.ConditionExpression = aws.String(condition)
+
+	// The old item tells a version conflict apart from the caller's own condition
+	input.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+
+	return input
+}
+
+// UpdateItemVersioned applies Versioned(input, version). It returns
+// ErrVersionConflict if the tunnel is no longer at version and
+// ErrConditionFailed if only the caller's own condition failed.
+func (d *DynamoDBClient) UpdateItemVersioned(ctx context.Context, input *dynamodb.UpdateItemInput, version int64) error {
+	_, err := d.client.UpdateItem(ctx, Versioned(input, version))
+	if err == nil {
+		return nil
+	}
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		var current struct {
+			Version int64 `dynamodbav:"version"`
+		}
+		if conditionFailed.Item != nil {
+			_ = attributevalue.UnmarshalMap(conditionFailed.Item, &current)
+		}
+		if conditionFailed.Item == nil || current.Version != version {
+			return fmt.Errorf("failed to update item: %w", ErrVersionConflict)
+		}
+	}
+
+	return conditionError("update item", err)
+}
+
+// UpdateTunnel is an optimistic read-modify-write of one tunnel. It reads the
+// tunnel with a consistent read, asks build for the update to make and applies
+// it as a versioned update, starting over with a fresh read when another writer
+// got there first. build may return a nil input to skip the write; its errors
+// are returned as is. The tunnel is returned as it was before the update.
+func (d *DynamoDBClient) UpdateTunnel(ctx context.Context, tunnelsTable, tunnelID string, build func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error)) (*models.Tunnel, error) {
+	key := map[string]types.AttributeValue{
+		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+	}
+
+	for attempt := 1; ; attempt++ {
+		output, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(tunnelsTable),
+			Key:            key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get item: %w", err)
+		}
+		if output.Item == nil {
+			return nil, ErrItemNotFound
+		}
+
+		var tunnel models.Tunnel
+		if err := attributevalue.UnmarshalMap(output.Item, &tunnel); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal item: %w", err)
+		}
+
+		input, err := build(&tunnel)
+		if err != nil || input == nil {
+			return &tunnel, err
+		}
+		input.TableName = aws.String(tunnelsTable)
+		input.Key = key
+
+		err = d.UpdateItemVersioned(ctx, input, tunnel.Version)
+		if errors.Is(err, ErrVersionConflict) && attempt < maxVersionConflicts {
+			continue
+		}
+		return &tunnel, err
+	}
+}
@@ -0,0 +1,185 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// These tests run against DynamoDB Local (make test-integration), which
+// scripts/local-dynamodb.sh starts and points DYNAMODB_ENDPOINT and
+// TUNNELS_TABLE at.
+
+func integrationClient(t *testing.T) (*DynamoDBClient, string) {
+	t.Helper()
+	table := os.Getenv("TUNNELS_TABLE")
+	if os.Getenv("DYNAMODB_ENDPOINT") == "" || table == "" {
+		t.Skip("DYNAMODB_ENDPOINT and TUNNELS_TABLE are not set; run make test-integration")
+	}
+	client, err := NewDynamoDBClient(context.Background())
+	if err != nil {
+		t.Fatalf("NewDynamoDBClient: %v", err)
+	}
+	return client, table
+}
+
+// putTestTunnel stores a tunnel at version and deletes it when the test ends
+func putTestTunnel(t *testing.T, client *DynamoDBClient, table string, version int64) models.Tunnel {
+	t.Helper()
+	ctx := context.Background()
+	tunnel := models.Tunnel{
+		TunnelID:  fmt.Sprintf("it-%s-%d", t.Name(), time.Now().UnixNano()),
+		ClientID:  "it-client",
+		Domain:    "it.example.com",
+		Subdomain: "it",
+		Status:    models.TunnelStatusInactive,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Version:   version,
+	}
+	if err := client.PutItem(ctx, table, tunnel); err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.DeleteItem(context.Background(), table, tunnelKey(tunnel.TunnelID))
+	})
+	return tunnel
+}
+
+func tunnelKey(tunnelID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+	}
+}
+
+func setStatus(status string) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		UpdateExpression:         aws.String("SET #status = :status"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+		},
+	}
+}
+
+func getTunnel(t *testing.T, client *DynamoDBClient, table, tunnelID string) models.Tunnel {
+	t.Helper()
+	var tunnel models.Tunnel
+	if err := client.GetItem(context.Background(), table, tunnelKey(tunnelID), &tunnel); err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+	return tunnel
+}
+
+func TestUpdateItemVersioned(t *testing.T) {
+	client, table := integrationClient(t)
+	ctx := context.Background()
+	tunnel := putTestTunnel(t, client, table, 3)
+
+	versioned := func(input *dynamodb.UpdateItemInput, version int64) error {
+		input.TableName = aws.String(table)
+		input.Key = tunnelKey(tunnel.TunnelID)
+		return client.UpdateItemVersioned(ctx, input, version)
+	}
+
+	// A stale version is a conflict
+	if err := versioned(setStatus(models.TunnelStatusActive), 2); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("update at stale version: got %v, want ErrVersionConflict", err)
+	}
+
+	// At the current version, a failing caller condition is not a conflict
+	input := setStatus(models.TunnelStatusActive)
+	input.ConditionExpression = aws.String("#status = :status")
+	err := versioned(input, 3)
+	if !errors.Is(err, ErrConditionFailed) || errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("update with failing condition: got %v, want ErrConditionFailed", err)
+	}
+
+	if err := versioned(setStatus(models.TunnelStatusActive), 3); err != nil {
+		t.Fatalf("update at current version: %v", err)
+	}
+	got := getTunnel(t, client, table, tunnel.TunnelID)
+	if got.Version != 4 || got.Status != models.TunnelStatusActive {
+		t.Errorf("after update: version %d status %q, want version 4 status %q", got.Version, got.Status, models.TunnelStatusActive)
+	}
+}
+
+func TestUpdateTunnelRetriesVersionConflict(t *testing.T) {
+	client, table := integrationClient(t)
+	ctx := context.Background()
+	tunnel := putTestTunnel(t, client, table, 1)
+
+	var seen []int64
+	before, err := client.UpdateTunnel(ctx, table, tunnel.TunnelID, func(current *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		seen = append(seen, current.Version)
+		if len(seen) == 1 {
+			// Another writer updates the tunnel between this read and write
+			concurrent := setStatus(models.TunnelStatusActive)
+			concurrent.TableName = aws.String(table)
+			concurrent.Key = tunnelKey(tunnel.TunnelID)
+			if err := client.UpdateItemVersioned(ctx, concurrent, current.Version); err != nil {
+				t.Fatalf("concurrent update: %v", err)
+			}
+		}
+		return setStatus(models.TunnelStatusInactive), nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateTunnel: %v", err)
+	}
+
+	if len(seen) != 2 || seen[0] != 1 || seen[1] != 2 {
+		t.Errorf("build saw versions %v, want [1 2]", seen)
+	}
+	if before.Version != 2 || before.Status != models.TunnelStatusActive {
+		t.Errorf("returned tunnel: version %d status %q, want the concurrent writer's version 2", before.Version, before.Status)
+	}
+	got := getTunnel(t, client, table, tunnel.TunnelID)
+	if got.Version != 3 || got.Status != models.TunnelStatusInactive {
+		t.Errorf("after update: version %d status %q, want version 3 status %q", got.Version, got.Status, models.TunnelStatusInactive)
+	}
+}
+
+func TestUpdateTunnelGivesUpAfterRepeatedConflicts(t *testing.T) {
+	client, table := integrationClient(t)
+	ctx := context.Background()
+	tunnel := putTestTunnel(t, client, table, 0)
+
+	attempts := 0
+	_, err := client.UpdateTunnel(ctx, table, tunnel.TunnelID, func(current *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		attempts++
+		concurrent := setStatus(models.TunnelStatusActive)
+		concurrent.TableName = aws.String(table)
+		concurrent.Key = tunnelKey(tunnel.TunnelID)
+		if err := client.UpdateItemVersioned(ctx, concurrent, current.Version); err != nil {
+			t.Fatalf("concurrent update: %v", err)
+		}
+		return setStatus(models.TunnelStatusInactive), nil
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("UpdateTunnel: got %v, want ErrVersionConflict", err)
+	}
+	if attempts != maxVersionConflicts {
+		t.Errorf("build called %d times, want %d", attempts, maxVersionConflicts)
+	}
+}
+
+func TestUpdateTunnelMissing(t *testing.T) {
+	client, table := integrationClient(t)
+	_, err := client.UpdateTunnel(context.Background(), table, "it-missing-tunnel", func(*models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		t.Fatal("build called for a missing tunnel")
+		return nil, nil
+	})
+	if !errors.Is(err, ErrItemNotFound) {
+		t.Fatalf("UpdateTunnel: got %v, want ErrItemNotFound", err)
+	}
+}
@@ -0,0 +1,22 @@
+// Package env reads the Lambdas' numeric configuration from the environment.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Count reads a non-negative integer from the environment, def when unset.
+// It panics on any other value, failing the Lambda's init phase.
+func Count(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("%s must be a non-negative integer", name))
+	}
+	return n
+}
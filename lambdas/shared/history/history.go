@@ -0,0 +1,76 @@
+package history
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// Retention is how long tunnel events are kept before DynamoDB TTL removes them
+const Retention = 30 * 24 * time.Hour
+
+// eventIDTimeFormat is fixed-width so event IDs sort chronologically within a tunnel
+const eventIDTimeFormat = "20060102T150405.000000000Z"
+
+// GenerateEventID generates a chronologically sortable event ID
+func GenerateEventID(t time.Time) (string, error) {
+	bytes := make([]byte, 4)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+
+	return t.UTC().Format(eventIDTimeFormat) + "-" + hex.EncodeToString(bytes), nil
+}
+
+// Record stores a tunnel event. Recording is skipped when no events table is
+// configured so Lambdas deployed without EVENTS_TABLE keep working.
+func Record(ctx context.Context, client *db.DynamoDBClient, table string, event models.TunnelEvent) error {
+	if table == "" {
+		return nil
+	}
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if event.EventID == "" {
+		eventID, err := GenerateEventID(event.CreatedAt)
+		if err != nil {
+			return err
+		}
+		event.EventID = eventID
+	}
+	event.TTL = event.CreatedAt.Add(Retention).Unix()
+
+	if err := client.PutItem(ctx, table, event); err != nil {
+		return fmt.Errorf("failed to record %s event for tunnel %s: %w", event.Type, event.TunnelID, err)
+	}
+
+	return nil
+}
+
+// List returns the most recent events for a tunnel, newest first
+func List(ctx context.Context, client *db.DynamoDBClient, table, tunnelID string, limit int32) ([]models.TunnelEvent, error) {
+	var events []models.TunnelEvent
+	err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(limit),
+	}, &events)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
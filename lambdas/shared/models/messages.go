@@ -0,0 +1,430 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WebSocket message actions. PING, PONG, REQUEST, RESPONSE and ERROR predate
+// the proxy_* actions and keep their upper-case wire names; ParseMessage
+// matches actions case-insensitively and normalizes them to these constants.
+const (
+	ActionHello              = MessageTypeHello
+	ActionHelloAck           = MessageTypeHelloAck
+	ActionPing               = MessageTypePing
+	ActionPong               = MessageTypePong
+	ActionRequest            = MessageTypeRequest
+	ActionResponse           = MessageTypeResponse
+	ActionError              = MessageTypeError
+	ActionProxy              = "proxy"
+	ActionProxyChunk         = "proxy_chunk"
+	ActionProxyResponse      = "proxy_response"
+	ActionProxyResponseChunk = "proxy_response_chunk"
+	ActionProxyStreamStart   = "proxy_stream_start"
+	ActionProxyStreamChunk   = "proxy_stream_chunk"
+	ActionProxyStreamEnd     = "proxy_stream_end"
+	ActionTunnelDeleted      = "tunnel_deleted"
+	ActionConnectionReplaced = "connection_replaced"
+	ActionConnectionRejected = "connection_rejected"
+	ActionReconnectSoon      = "reconnect_soon"
+	ActionStats              = "stats"
+)
+
+var (
+	// ErrUnknownAction is returned by ParseMessage for actions without a schema
+	ErrUnknownAction = errors.New("unknown message action")
+	// ErrInvalidMessage is wrapped by every schema or validation failure
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// Payload is the typed data of one message action
+type Payload interface {
+	Validate() error
+}
+
+// EmptyPayload is the data of actions that carry none (PING, PONG, ERROR, ...)
+type EmptyPayload struct{}
+
+func (EmptyPayload) Validate() error { return nil }
+
+// HelloPayload opens the protocol negotiation (CLI → server)
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+func (p *HelloPayload) Validate() error {
+	if p.ProtocolVersion < 1 {
+		return fmt.Errorf("protocol_version must be at least 1")
+	}
+	return nil
+}
+
+// HelloAckPayload carries the negotiated protocol (server → CLI)
+type HelloAckPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+func (p *HelloAckPayload) Validate() error {
+	if p.ProtocolVersion < 1 {
+		return fmt.Errorf("protocol_version must be at least 1")
+	}
+	return nil
+}
+
+// ProxyRequestPayload is an HTTP request forwarded to the CLI (server → CLI).
+// Bodies too large for one message precede it as TotalChunks proxy_chunk
+// messages, in any order, or are staged in S3 (S3RequestGetURL). Responses larger than MaxInlineBytes
+// must be staged in S3 (S3PutURL); it is only sent to CLIs that negotiated
+// the inline_limit capability. S3RequestSHA256, for CLIs that negotiated
+// checksums, is the staged request body's hex SHA-256.
+type ProxyRequestPayload struct {
+	RequestID       string            `json:"request_id"`
+	Method          string            `json:"method"`
+	Path            string            `json:"path"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	TotalChunks     int               `json:"total_chunks"`
+	S3PutURL        string            `json:"s3_put_url,omitempty"`
+	S3ResponseKey   string            `json:"s3_response_key,omitempty"`
+	S3RequestKey    string            `json:"s3_request_key,omitempty"`
+	S3RequestGetURL string            `json:"s3_request_get_url,omitempty"`
+	MaxInlineBytes  int64             `json:"max_inline_bytes,omitempty"`
+	S3RequestSHA256 string            `json:"s3_request_sha256,omitempty"`
+}
+
+func (p *ProxyRequestPayload) Validate() error {
+	switch {
+	case p.RequestID == "":
+		return fmt.Errorf("request_id is required")
+	case p.Method == "":
+		return fmt.Errorf("method is required")
+	case !strings.HasPrefix(p.Path, "/"):
+		return fmt.Errorf("path must start with /")
+	case p.TotalChunks < 0:
+		return fmt.Errorf("total_chunks must not be negative")
+	case p.MaxInlineBytes < 0:
+		return fmt.Errorf("max_inline_bytes must not be negative")
+	case p.S3RequestSHA256 != "" && !ValidSHA256(p.S3RequestSHA256):
+		return fmt.Errorf("s3_request_sha256 must be a hex SHA-256")
+	}
+	return nil
+}
+
+// ChunkPayload is one piece of a body too large for a single message; used by
+// proxy_chunk, proxy_response_chunk and proxy_stream_chunk
+type ChunkPayload struct {
+	RequestID  string `json:"request_id"`
+	ChunkIndex int    `json:"chunk_index"`
+	Data       string `json:"data"`
+}
+
+func (p *ChunkPayload) Validate() error {
+	switch {
+	case p.RequestID == "":
+		return fmt.Errorf("request_id is required")
+	case p.ChunkIndex < 0:
+		return fmt.Errorf("chunk_index must not be negative")
+	}
+	return nil
+}
+
+// ProxyResponsePayload answers a ProxyRequestPayload (CLI → server). The body
+// is inline, in TotalChunks earlier proxy_response_chunk messages, or in S3
+// under S3ResponseKey. CLIs that negotiated checksums describe an S3 body
+// with its hex SHA-256 and size, which http-proxy verifies before serving.
+type ProxyResponsePayload struct {
+	RequestID        string            `json:"request_id"`
+	StatusCode       int               `json:"status_code"`
+	ResponseHeaders  map[string]string `json:"response_headers"`
+	ResponseBody     string            `json:"response_body"`
+	TotalChunks      int               `json:"total_chunks,omitempty"`
+	S3ResponseKey    string            `json:"s3_response_key,omitempty"`
+	S3ResponseSHA256 string            `json:"s3_response_sha256,omitempty"`
+	S3ResponseBytes  int64             `json:"s3_response_bytes,omitempty"`
+
+	// S3UploadMs is how long the CLI took to upload an S3-staged body; sent
+	// only with CapabilityTimings
+	S3UploadMs int64 `json:"s3_upload_ms,omitempty"`
+
+	// Error is set when the CLI could not get a response from the local
+	// service and made this one up; sent only with CapabilityErrors
+	Error string `json:"error,omitempty"`
+}
+
+func (p *ProxyResponsePayload) Validate() error {
+	switch {
+	case p.RequestID == "":
+		return fmt.Errorf("request_id is required")
+	case p.StatusCode < 100 || p.StatusCode > 599:
+		return fmt.Errorf("status_code %d is not a valid HTTP status", p.StatusCode)
+	case p.TotalChunks < 0:
+		return fmt.Errorf("total_chunks must not be negative")
+	case p.S3ResponseSHA256 != "" && !ValidSHA256(p.S3ResponseSHA256):
+		return fmt.Errorf("s3_response_sha256 must be a hex SHA-256")
+	case p.S3ResponseBytes < 0:
+		return fmt.Errorf("s3_response_bytes must not be negative")
+	case p.S3UploadMs < 0:
+		return fmt.Errorf("s3_upload_ms must not be negative")
+	}
+	return nil
+}
+
+// ValidSHA256 reports whether s is a hex-encoded SHA-256 digest
+func ValidSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+// StreamStartPayload starts a streamed (SSE) response (CLI → server)
+type StreamStartPayload struct {
+	RequestID       string            `json:"request_id"`
+	StatusCode      int               `json:"status_code"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+}
+
+func (p *StreamStartPayload) Validate() error {
+	switch {
+	case p.RequestID == "":
+		return fmt.Errorf("request_id is required")
+	case p.StatusCode < 100 || p.StatusCode > 599:
+		return fmt.Errorf("status_code %d is not a valid HTTP status", p.StatusCode)
+	}
+	return nil
+}
+
+// StreamEndPayload ends a streamed response (CLI → server). TotalChunks is
+// how many proxy_stream_chunk messages were sent, so the end can be waited out
+// by chunks still being stored; CLIs from before it was sent leave it 0.
+type StreamEndPayload struct {
+	RequestID   string `json:"request_id"`
+	TotalChunks int    `json:"total_chunks,omitempty"`
+}
+
+func (p *StreamEndPayload) Validate() error {
+	switch {
+	case p.RequestID == "":
+		return fmt.Errorf("request_id is required")
+	case p.TotalChunks < 0:
+		return fmt.Errorf("total_chunks must not be negative")
+	}
+	return nil
+}
+
+// TunnelNoticePayload tells the CLI its tunnel was deleted or taken over
+// (server → CLI); the server closes the connection afterwards
+type TunnelNoticePayload struct {
+	TunnelID string `json:"tunnel_id"`
+}
+
+func (p *TunnelNoticePayload) Validate() error {
+	if p.TunnelID == "" {
+		return fmt.Errorf("tunnel_id is required")
+	}
+	return nil
+}
+
+// ConnectionRejectedPayload tells a CLI the tunnel refused its connection
+// (server → CLI); the server closes the connection afterwards
+type ConnectionRejectedPayload struct {
+	TunnelID string `json:"tunnel_id"`
+	Code     string `json:"code"` // A problem code, e.g. tunnel_in_use
+	Message  string `json:"message"`
+}
+
+func (p *ConnectionRejectedPayload) Validate() error {
+	if p.TunnelID == "" || p.Code == "" {
+		return fmt.Errorf("tunnel_id and code are required")
+	}
+	return nil
+}
+
+// ReconnectPayload is the data of reconnect_soon. A CLI that negotiated the
+// reconnect capability sends it empty before replacing its connection; the
+// server marks the connection as about to be replaced and answers with its
+// ConnectionID, which the CLI passes as replaces when it connects again.
+type ReconnectPayload struct {
+	ConnectionID string `json:"connection_id,omitempty"`
+}
+
+func (p *ReconnectPayload) Validate() error { return nil }
+
+// StatsPayload reports the tunnel's health as the edge sees it (server → CLI),
+// sent after each PONG to CLIs that negotiated the stats capability. Inflight
+// and Queued are requests holding or waiting for one of the tunnel's request
+// slots, zero when http-proxy does not cap concurrent requests; Requests and
+// Errors (5xx, including the edge's own) are those logged in the last
+// WindowSeconds.
+type StatsPayload struct {
+	Inflight      int64   `json:"inflight"`
+	Queued        int64   `json:"queued"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	WindowSeconds int     `json:"window_seconds"`
+}
+
+func (p *StatsPayload) Validate() error {
+	switch {
+	case p.Inflight < 0 || p.Queued < 0 || p.Requests < 0 || p.Errors < 0:
+		return fmt.Errorf("counts must not be negative")
+	case p.ErrorRate < 0 || p.ErrorRate > 1:
+		return fmt.Errorf("error_rate must be between 0 and 1")
+	case p.WindowSeconds < 0:
+		return fmt.Errorf("window_seconds must not be negative")
+	}
+	return nil
+}
+
+// LegacyResponsePayload is the data of the RESPONSE action
+type LegacyResponsePayload struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+}
+
+func (p *LegacyResponsePayload) Validate() error { return nil }
+
+// LegacyRequestPayload is the data of the REQUEST action
+type LegacyRequestPayload struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+func (p *LegacyRequestPayload) Validate() error { return nil }
+
+// messageSchema pairs an action's canonical name with its payload type
+type messageSchema struct {
+	action string
+	new    func() Payload
+}
+
+// payloadTypes maps each lower-cased action to its schema
+var payloadTypes = map[string]messageSchema{}
+
+func register(action string, newPayload func() Payload) {
+	payloadTypes[strings.ToLower(action)] = messageSchema{action: action, new: newPayload}
+}
+
+func init() {
+	empty := func() Payload { return &EmptyPayload{} }
+	chunk := func() Payload { return &ChunkPayload{} }
+	notice := func() Payload { return &TunnelNoticePayload{} }
+
+	register(ActionHello, func() Payload { return &HelloPayload{} })
+	register(ActionHelloAck, func() Payload { return &HelloAckPayload{} })
+	register(ActionPing, empty)
+	register(ActionPong, empty)
+	register(ActionError, empty)
+	register(ActionRequest, func() Payload { return &LegacyRequestPayload{} })
+	register(ActionResponse, func() Payload { return &LegacyResponsePayload{} })
+	register(ActionProxy, func() Payload { return &ProxyRequestPayload{} })
+	register(ActionProxyChunk, chunk)
+	register(ActionProxyResponse, func() Payload { return &ProxyResponsePayload{} })
+	register(ActionProxyResponseChunk, chunk)
+	register(ActionProxyStreamStart, func() Payload { return &StreamStartPayload{} })
+	register(ActionProxyStreamChunk, chunk)
+	register(ActionProxyStreamEnd, func() Payload { return &StreamEndPayload{} })
+	register(ActionTunnelDeleted, notice)
+	register(ActionConnectionReplaced, notice)
+	register(ActionConnectionRejected, func() Payload { return &ConnectionRejectedPayload{} })
+	register(ActionReconnectSoon, func() Payload { return &ReconnectPayload{} })
+	register(ActionStats, func() Payload { return &StatsPayload{} })
+}
+
+// envelope is the wire form of a message with its data left undecoded
+type envelope struct {
+	Action    string          `json:"action"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// TypedMessage is a message whose data is its action's payload
+type TypedMessage struct {
+	Action    string // Canonical action name
+	RequestID string
+	Error     string
+	Payload   Payload
+}
+
+// ParseMessage decodes a raw WebSocket message. Unknown actions, unknown or
+// mistyped fields and payloads that fail validation are rejected with an error
+// wrapping ErrUnknownAction or ErrInvalidMessage.
+func ParseMessage(raw []byte) (*TypedMessage, error) {
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	schema, ok := payloadTypes[strings.ToLower(env.Action)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAction, env.Action)
+	}
+
+	msg := &TypedMessage{
+		Action:    schema.action,
+		RequestID: env.RequestID,
+		Error:     env.Error,
+		Payload:   schema.new(),
+	}
+
+	if len(env.Data) > 0 && !bytes.Equal(env.Data, []byte("null")) {
+		decoder := json.NewDecoder(bytes.NewReader(env.Data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(msg.Payload); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessage, schema.action, err)
+		}
+	}
+
+	// Error replies carry no payload
+	if msg.Error == "" {
+		if err := msg.Payload.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessage, schema.action, err)
+		}
+	}
+	return msg, nil
+}
+
+// EncodeMessage validates payload against action's schema and marshals the message
+func EncodeMessage(action string, payload Payload) ([]byte, error) {
+	return (&TypedMessage{Action: action, Payload: payload}).Marshal()
+}
+
+// Marshal validates the message's payload and encodes it for the wire
+func (m *TypedMessage) Marshal() ([]byte, error) {
+	schema, ok := payloadTypes[strings.ToLower(m.Action)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAction, m.Action)
+	}
+
+	env := envelope{Action: schema.action, RequestID: m.RequestID, Error: m.Error}
+	switch m.Payload.(type) {
+	case nil, EmptyPayload, *EmptyPayload:
+	default:
+		if m.Error == "" {
+			if err := m.Payload.Validate(); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessage, schema.action, err)
+			}
+		}
+		data, err := json.Marshal(m.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s payload: %w", schema.action, err)
+		}
+		env.Data = data
+	}
+	return json.Marshal(env)
+}
+
+// ErrorMessage builds the ERROR reply sent when a message is rejected
+func ErrorMessage(requestID string, err error) []byte {
+	reply, _ := (&TypedMessage{Action: ActionError, RequestID: requestID, Error: err.Error()}).Marshal()
+	return reply
+}
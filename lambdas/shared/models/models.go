@@ -1,13 +1,71 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Client represents a registered client
 type Client struct {
 	ClientID   string    `json:"client_id" dynamodbav:"client_id"`
 	APIKeyHash string    `json:"-" dynamodbav:"api_key_hash"`
 	Status     string    `json:"status" dynamodbav:"status"`
+	Plan       string    `json:"plan,omitempty" dynamodbav:"plan,omitempty"`               // Assigned by operators; "" for self-registered clients
+	MaxTunnels int       `json:"max_tunnels,omitempty" dynamodbav:"max_tunnels,omitempty"` // Overrides the plan's tunnel quota when > 0
 	CreatedAt  time.Time `json:"created_at" dynamodbav:"created_at"`
+
+	// LastUsedAt and LastUsedIP record the last API call or tunnel connection
+	// made with the client's credentials, at most once per ClientUseInterval
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" dynamodbav:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" dynamodbav:"last_used_ip,omitempty"`
+
+	// SubdomainPrefix, set by operators, namespaces the client's subdomains:
+	// random ones are generated as "<prefix>-..." and new custom ones must
+	// start with it
+	SubdomainPrefix string `json:"subdomain_prefix,omitempty" dynamodbav:"subdomain_prefix,omitempty"`
+
+	// StripeCustomerID links the client to its Stripe customer once it has
+	// bought a plan; the plan then follows the customer's subscription
+	StripeCustomerID string `json:"stripe_customer_id,omitempty" dynamodbav:"stripe_customer_id,omitempty"`
+	// PlanEventAt is when Stripe created the subscription event that last set
+	// the plan (Unix seconds); older events arriving late are ignored
+	PlanEventAt int64 `json:"plan_event_at,omitempty" dynamodbav:"plan_event_at,omitempty"`
+	// UsageReportedUntil is the end of the last hour report-usage sent to
+	// Stripe; hours after it whose report failed are caught up on
+	UsageReportedUntil *time.Time `json:"usage_reported_until,omitempty" dynamodbav:"usage_reported_until,omitempty"`
+}
+
+// ClientUseInterval is how often a client's last use is written at most
+const ClientUseInterval = time.Minute
+
+// TunnelQuota returns how many tunnels the client may own, 0 meaning no limit
+func (c *Client) TunnelQuota() int {
+	if c.MaxTunnels > 0 {
+		return c.MaxTunnels
+	}
+	return PlanTunnelQuotas[c.Plan]
+}
+
+// TunnelLimit returns how many tunnels the client may own, 0 meaning no
+// limit, once the deployment's per-client ceiling (0 for none) caps its plan's
+// quota. An operator's MaxTunnels override is not capped.
+func (c *Client) TunnelLimit(ceiling int) int {
+	quota := c.TunnelQuota()
+	if c.MaxTunnels > 0 || ceiling <= 0 {
+		return quota
+	}
+	if quota == 0 || quota > ceiling {
+		return ceiling
+	}
+	return quota
+}
+
+// HasFeature reports whether the client's plan includes a premium feature
+func (c *Client) HasFeature(feature string) bool {
+	return slices.Contains(PlanFeatures[c.Plan], feature)
 }
 
 // Tunnel represents an active or inactive tunnel
@@ -20,6 +78,144 @@ type Tunnel struct {
 	ConnectionID string    `json:"connection_id,omitempty" dynamodbav:"connection_id,omitempty"`
 	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at" dynamodbav:"updated_at"`
+
+	// ConnectionPolicy decides what happens when a second CLI connects; empty means takeover
+	ConnectionPolicy string `json:"connection_policy,omitempty" dynamodbav:"connection_policy,omitempty"`
+	// ConnectionIDs holds every live connection of a tunnel using the multi policy
+	ConnectionIDs []string `json:"connection_ids,omitempty" dynamodbav:"connection_ids,stringset,omitempty"`
+	// RejectedConnectionIDs are connections the reject policy refused. Their
+	// handshake succeeds so tunnel-proxy can tell the CLI why on its first
+	// message before closing them; tunnel-disconnect removes them.
+	RejectedConnectionIDs []string `json:"rejected_connection_ids,omitempty" dynamodbav:"rejected_connection_ids,stringset,omitempty"`
+	// ReconnectingConnectionID is a connection whose CLI announced with
+	// reconnect_soon that it is about to replace it; see tunnel-connect
+	ReconnectingConnectionID string `json:"reconnecting_connection_id,omitempty" dynamodbav:"reconnecting_connection_id,omitempty"`
+	// DrainingConnectionID is the connection a CLI replaced ahead of API
+	// Gateway's connection limits. It is sent no more requests, but its
+	// messages are accepted until it closes.
+	DrainingConnectionID string `json:"draining_connection_id,omitempty" dynamodbav:"draining_connection_id,omitempty"`
+	// ConnectionInfo describes the machine behind the most recent connection
+	ConnectionInfo *ConnectionInfo `json:"connection_info,omitempty" dynamodbav:"connection_info,omitempty"`
+	// Region is the tunnel's home region; its CLI connects to that region's WebSocket API
+	Region string `json:"region,omitempty" dynamodbav:"region,omitempty"`
+	// LastPingAt is refreshed by every CLI heartbeat; see reap-stale-tunnels
+	LastPingAt *time.Time `json:"last_ping_at,omitempty" dynamodbav:"last_ping_at,omitempty"`
+	// Version is bumped by every versioned update; see db.UpdateTunnel
+	Version int64 `json:"version" dynamodbav:"version"`
+	// ProtocolVersion and Capabilities were negotiated by the CLI's hello; both
+	// are cleared on $connect, so 0 means a CLI that predates negotiation
+	ProtocolVersion int      `json:"protocol_version,omitempty" dynamodbav:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty" dynamodbav:"capabilities,stringset,omitempty"`
+	// BlockBots makes http-proxy reject crawler user agents and scanner IPs
+	BlockBots bool `json:"block_bots,omitempty" dynamodbav:"block_bots,omitempty"`
+	// RobotsTxt makes http-proxy answer /robots.txt itself, disallowing everything
+	RobotsTxt bool `json:"robots_txt,omitempty" dynamodbav:"robots_txt,omitempty"`
+	// AllowedCountries restricts the tunnel to callers in these ISO 3166-1
+	// alpha-2 countries; empty allows everyone
+	AllowedCountries []string `json:"allowed_countries,omitempty" dynamodbav:"allowed_countries,stringset,omitempty"`
+	// AllowedMethods restricts the tunnel to these HTTP methods; empty allows all
+	AllowedMethods []string `json:"allowed_methods,omitempty" dynamodbav:"allowed_methods,stringset,omitempty"`
+	// PasswordHash is the bcrypt hash of the password visitors must enter on
+	// http-proxy's login page; empty leaves the tunnel open
+	PasswordHash string `json:"-" dynamodbav:"password_hash,omitempty"`
+	// Visibility is TunnelVisibilityPrivate when http-proxy only forwards
+	// requests carrying an access token; empty means public
+	Visibility string `json:"visibility,omitempty" dynamodbav:"visibility,omitempty"`
+	// AccessKey signs the tunnel's access tokens; it is created with the first
+	// token
+	AccessKey string `json:"-" dynamodbav:"access_key,omitempty"`
+	// AccessConsumers maps each consumer holding an access token to the Unix
+	// time its current token was issued at; older tokens of a consumer, and
+	// those of consumers no longer listed, are rejected
+	AccessConsumers map[string]int64 `json:"access_consumers,omitempty" dynamodbav:"access_consumers,omitempty"`
+	// StrippedHeaders are lowercase header names http-proxy removes before a
+	// request reaches the local service
+	StrippedHeaders []string `json:"stripped_headers,omitempty" dynamodbav:"stripped_headers,stringset,omitempty"`
+	// RequiredHeaders must be on every request, each as a lowercase "name" or
+	// as "name: value" when the value must match too
+	RequiredHeaders []string `json:"required_headers,omitempty" dynamodbav:"required_headers,stringset,omitempty"`
+	// ResponseHeaders are set on every response http-proxy returns, replacing
+	// any value the local service gave, each as a lowercase "name: value"
+	ResponseHeaders []string `json:"response_headers,omitempty" dynamodbav:"response_headers,stringset,omitempty"`
+	// StrippedResponseHeaders are lowercase header names http-proxy removes
+	// from every response it returns
+	StrippedResponseHeaders []string `json:"stripped_response_headers,omitempty" dynamodbav:"stripped_response_headers,stringset,omitempty"`
+	// LowLatency marks a tunnel whose callers should not wait on Lambda cold
+	// starts. report-usage meters its requests apart, as they are what the
+	// warm-up pings are kept running for.
+	LowLatency bool `json:"low_latency,omitempty" dynamodbav:"low_latency,omitempty"`
+	// MaxConcurrentRequests caps the tunnel's requests awaiting a response;
+	// http-proxy queues or sheds the rest. 0 leaves the tunnel uncapped.
+	MaxConcurrentRequests int64 `json:"max_concurrent_requests,omitempty" dynamodbav:"max_concurrent_requests,omitempty"`
+}
+
+// ConnectionInfo is reported by the CLI when it connects to a tunnel
+type ConnectionInfo struct {
+	CLIVersion  string    `json:"cli_version,omitempty" dynamodbav:"cli_version,omitempty"`
+	Platform    string    `json:"platform,omitempty" dynamodbav:"platform,omitempty"` // GOOS/GOARCH, e.g. linux/amd64
+	SourceIP    string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	ConnectedAt time.Time `json:"connected_at" dynamodbav:"connected_at"`
+}
+
+// Policy returns the tunnel's connection policy, defaulting to takeover
+func (t *Tunnel) Policy() string {
+	if t.ConnectionPolicy == "" {
+		return ConnectionPolicyTakeover
+	}
+	return t.ConnectionPolicy
+}
+
+// Private reports whether the tunnel only serves requests with an access token
+func (t *Tunnel) Private() bool {
+	return t.Visibility == TunnelVisibilityPrivate
+}
+
+// Protocol returns the WebSocket protocol version the tunnel's CLI speaks
+func (t *Tunnel) Protocol() int {
+	if t.ProtocolVersion == 0 {
+		return ProtocolVersionLegacy
+	}
+	return t.ProtocolVersion
+}
+
+// Supports reports whether the tunnel's CLI negotiated capability. CLIs that
+// never sent a hello support exactly LegacyCapabilities.
+func (t *Tunnel) Supports(capability string) bool {
+	capabilities := t.Capabilities
+	if t.ProtocolVersion == 0 {
+		capabilities = LegacyCapabilities
+	}
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Connections returns every live connection of the tunnel, primary first
+func (t *Tunnel) Connections() []string {
+	var connections []string
+	if t.ConnectionID != "" {
+		connections = append(connections, t.ConnectionID)
+	}
+	for _, id := range t.ConnectionIDs {
+		if id != t.ConnectionID {
+			connections = append(connections, id)
+		}
+	}
+	return connections
+}
+
+// HasConnection reports whether connectionID is one of the tunnel's live connections
+func (t *Tunnel) HasConnection(connectionID string) bool {
+	for _, id := range t.Connections() {
+		if id == connectionID {
+			return true
+		}
+	}
+	return false
 }
 
 // Domain represents a domain mapping to a tunnel
@@ -30,6 +226,160 @@ type Domain struct {
 	CreatedAt time.Time `json:"created_at" dynamodbav:"created_at"`
 }
 
+// ReleasedDomain records the owner of a deleted tunnel's domain. Until
+// ReleasedUntil only that client may claim the domain again, so links to the
+// old tunnel can't be taken over by someone else.
+type ReleasedDomain struct {
+	Domain        string    `json:"domain" dynamodbav:"domain"`
+	ClientID      string    `json:"client_id" dynamodbav:"client_id"`
+	TunnelID      string    `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	ReleasedAt    time.Time `json:"released_at" dynamodbav:"released_at"`
+	ReleasedUntil time.Time `json:"released_until" dynamodbav:"released_until"`
+	TTL           int64     `json:"ttl" dynamodbav:"ttl"` // Unix timestamp for auto-deletion
+}
+
+// Quarantined reports whether the domain is still reserved for its previous
+// owner at now
+func (d *ReleasedDomain) Quarantined(now time.Time) bool {
+	return now.Before(d.ReleasedUntil)
+}
+
+// PendingRequest is an HTTP request waiting for its tunnel's response. Large
+// bodies are stored alongside it as chunk_<n> attributes.
+type PendingRequest struct {
+	RequestID       string            `dynamodbav:"request_id" json:"request_id"`
+	TunnelID        string            `dynamodbav:"tunnel_id" json:"tunnel_id"`
+	Method          string            `dynamodbav:"method" json:"method"`
+	Path            string            `dynamodbav:"path" json:"path"`
+	Headers         map[string]string `dynamodbav:"headers" json:"headers"`
+	Body            string            `dynamodbav:"body" json:"body"`
+	Status          string            `dynamodbav:"status" json:"status"` // "pending", "waiting_upload", "completed" or a terminal failure (PendingRequestErrorStatus)
+	ResponseStatus  int               `dynamodbav:"response_status,omitempty" json:"response_status,omitempty"`
+	ResponseHeaders map[string]string `dynamodbav:"response_headers,omitempty" json:"response_headers,omitempty"`
+	ResponseBody    string            `dynamodbav:"response_body,omitempty" json:"response_body,omitempty"`
+	RequestSHA256   string            `dynamodbav:"request_sha256,omitempty" json:"request_sha256,omitempty"` // Hex SHA-256 of a body staged in S3, given by the uploader
+	CreatedAt       time.Time         `dynamodbav:"created_at" json:"created_at"`
+	TTL             int64             `dynamodbav:"ttl" json:"ttl"` // Unix timestamp for auto-deletion
+
+	// Error is why a request ended in a terminal failure status
+	Error string `dynamodbav:"error,omitempty" json:"error,omitempty"`
+
+	// TraceContext holds the TraceHeaders of the POST /upload-url that created
+	// an uploaded request, forwarded with it so the CLI's work joins the
+	// caller's trace
+	TraceContext map[string]string `dynamodbav:"trace_context,omitempty" json:"trace_context,omitempty"`
+
+	// NotifiedAt is when s3-upload-notify handed an uploaded request to the
+	// CLI or the redelivery queue; a retried S3 event skips it
+	NotifiedAt string `dynamodbav:"notified_at,omitempty" json:"notified_at,omitempty"`
+
+	// DispatchedAt is when s3-upload-notify claimed an uploaded request by
+	// moving it from waiting_upload to pending, which only one delivery of
+	// its S3 event can do
+	DispatchedAt string `dynamodbav:"dispatched_at,omitempty" json:"dispatched_at,omitempty"`
+
+	// SlotHeld is set while an uploaded request holds one of its tunnel's
+	// request slots, which the poll that answers it gives back
+	SlotHeld bool `dynamodbav:"slot_held,omitempty" json:"slot_held,omitempty"`
+}
+
+// StreamChunk is one piece of a streamed (SSE) response, stored apart from
+// its pending request so every chunk is a small write of its own instead of a
+// rewrite of the whole request item. Chunks are read in Seq order; TunnelID
+// lets http-proxy ignore chunks written by another tunnel's CLI.
+type StreamChunk struct {
+	RequestID string `dynamodbav:"request_id" json:"request_id"`
+	Seq       int    `dynamodbav:"seq" json:"seq"`
+	TunnelID  string `dynamodbav:"tunnel_id" json:"tunnel_id"`
+	Data      string `dynamodbav:"data" json:"data"`
+	TTL       int64  `dynamodbav:"ttl" json:"ttl"` // Unix timestamp for auto-deletion
+}
+
+// TraceHeaders are the W3C Trace Context and Baggage headers, lowercase
+var TraceHeaders = []string{"traceparent", "tracestate", "baggage"}
+
+// Terminal failure statuses of a pending request. They are final like
+// "completed", but carry no response from the local service; http-proxy and
+// GET /poll answer them with the request's Error and the status as its code,
+// so callers can stop polling.
+const (
+	PendingRequestFailedUpload       = "failed_upload"       // the uploaded body could not be handed to the CLI
+	PendingRequestTunnelDisconnected = "tunnel_disconnected" // the tunnel went away or could not be reached
+	PendingRequestUpstreamError      = "upstream_error"      // the CLI got no response from the local service
+	PendingRequestExpired            = "expired"             // nothing answered before the request expired
+)
+
+// PendingRequestErrorStatus returns the HTTP status a terminal failure status
+// is answered with when the request has no response_status of its own, and
+// false for any other status
+func PendingRequestErrorStatus(status string) (int, bool) {
+	switch status {
+	case PendingRequestFailedUpload, PendingRequestUpstreamError:
+		return 502, true
+	case PendingRequestTunnelDisconnected:
+		return 503, true
+	case PendingRequestExpired:
+		return 504, true
+	}
+	return 0, false
+}
+
+// BodyAllowed reports whether a response with status may carry a body. 1xx,
+// 204 and 304 responses never do, so their empty response_body is the whole
+// response rather than a body that went missing.
+func BodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// TunnelEvent represents an entry in a tunnel's event history
+type TunnelEvent struct {
+	TunnelID     string    `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	EventID      string    `json:"event_id" dynamodbav:"event_id"`
+	Type         string    `json:"type" dynamodbav:"type"`
+	ClientID     string    `json:"client_id,omitempty" dynamodbav:"client_id,omitempty"`
+	ConnectionID string    `json:"connection_id,omitempty" dynamodbav:"connection_id,omitempty"`
+	SourceIP     string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	CLIVersion   string    `json:"cli_version,omitempty" dynamodbav:"cli_version,omitempty"`
+	Platform     string    `json:"platform,omitempty" dynamodbav:"platform,omitempty"`
+	Reason       string    `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Actor        string    `json:"actor,omitempty" dynamodbav:"actor,omitempty"`
+	CreatedAt    time.Time `json:"created_at" dynamodbav:"created_at"`
+	TTL          int64     `json:"-" dynamodbav:"ttl"` // Unix timestamp for auto-deletion
+}
+
+// RequestLog represents a single request proxied through a tunnel
+type RequestLog struct {
+	TunnelID   string    `json:"tunnel_id" dynamodbav:"tunnel_id"`
+	LogID      string    `json:"log_id" dynamodbav:"log_id"`
+	RequestID  string    `json:"request_id" dynamodbav:"request_id"`
+	Method     string    `json:"method" dynamodbav:"method"`
+	Path       string    `json:"path" dynamodbav:"path"`
+	StatusCode int       `json:"status_code" dynamodbav:"status_code"`
+	DurationMs int64     `json:"duration_ms" dynamodbav:"duration_ms"`
+	QueueMs    int64     `json:"queue_ms,omitempty" dynamodbav:"queue_ms,omitempty"` // Time spent waiting for one of the tunnel's request slots
+	BytesIn    int64     `json:"bytes_in" dynamodbav:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out" dynamodbav:"bytes_out"`
+	SourceIP   string    `json:"source_ip,omitempty" dynamodbav:"source_ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty" dynamodbav:"user_agent,omitempty"`
+	Country    string    `json:"country,omitempty" dynamodbav:"country,omitempty"` // Caller's country from CloudFront, when known
+	CreatedAt  time.Time `json:"created_at" dynamodbav:"created_at"`
+	TTL        int64     `json:"-" dynamodbav:"ttl"` // Unix timestamp for auto-deletion
+
+	// StrippedHeaders lists the headers removed by the tunnel's header rules
+	StrippedHeaders []string `json:"stripped_headers,omitempty" dynamodbav:"stripped_headers,omitempty"`
+	// AccessConsumer is whose access token a request to a private tunnel carried
+	AccessConsumer string `json:"access_consumer,omitempty" dynamodbav:"access_consumer,omitempty"`
+	// S3UploadMs is how long the CLI took to stage the response in S3, as it
+	// reported it, and S3FetchMs how long http-proxy took to open it
+	S3UploadMs int64 `json:"s3_upload_ms,omitempty" dynamodbav:"s3_upload_ms,omitempty"`
+	S3FetchMs  int64 `json:"s3_fetch_ms,omitempty" dynamodbav:"s3_fetch_ms,omitempty"`
+	// Headers and BodyPreview are what was forwarded to the CLI, redacted;
+	// they are only kept when http-proxy logs request details
+	Headers     map[string]string `json:"headers,omitempty" dynamodbav:"headers,omitempty"`
+	BodyPreview string            `json:"body_preview,omitempty" dynamodbav:"body_preview,omitempty"`
+}
+
 // Constants for status values
 const (
 	ClientStatusActive   = "active"
@@ -39,6 +389,117 @@ const (
 	TunnelStatusInactive = "inactive"
 )
 
+// Client plans
+const (
+	PlanFree       = "free"
+	PlanPro        = "pro"
+	PlanEnterprise = "enterprise"
+)
+
+// PlanTunnelQuotas is the default number of tunnels per plan; plans not
+// listed (including the empty plan of self-registered clients) are unlimited
+var PlanTunnelQuotas = map[string]int{
+	PlanFree: 3,
+	PlanPro:  25,
+}
+
+// Premium features, available on the plans that list them in PlanFeatures
+const (
+	// FeatureCustomSubdomain lets a client choose its tunnels' subdomains
+	FeatureCustomSubdomain = "custom_subdomain"
+)
+
+// PlanFeatures lists the premium features of each paid plan. They are only
+// enforced when billing is enabled for the deployment.
+var PlanFeatures = map[string][]string{
+	PlanPro:        {FeatureCustomSubdomain},
+	PlanEnterprise: {FeatureCustomSubdomain},
+}
+
+// Duplicate-connection policies for a tunnel
+const (
+	ConnectionPolicyReject   = "reject"   // refuse a second connection while one is live
+	ConnectionPolicyTakeover = "takeover" // the new connection replaces the old one, which is closed
+	ConnectionPolicyMulti    = "multi"    // all connections stay open and share the traffic
+)
+
+// What a CLI asks $connect to do, in its on_conflict query parameter, when
+// the tunnel is connected elsewhere. Without it the connection policy decides.
+const (
+	ConnectConflictAsk      = "ask"      // refuse with the other connection's details, so the user can choose
+	ConnectConflictTakeover = "takeover" // replace the other connections, whatever the policy
+	ConnectConflictAttach   = "attach"   // join them; only under the multi policy
+)
+
+// ValidConnectConflict reports whether v is a known on_conflict value
+func ValidConnectConflict(v string) bool {
+	return v == ConnectConflictAsk || v == ConnectConflictTakeover || v == ConnectConflictAttach
+}
+
+// Tunnel visibilities
+const (
+	TunnelVisibilityPublic  = "public"  // anyone who knows the domain reaches the tunnel
+	TunnelVisibilityPrivate = "private" // only requests with a valid access token are forwarded
+)
+
+// ValidVisibility reports whether visibility is a known tunnel visibility
+func ValidVisibility(visibility string) bool {
+	return visibility == TunnelVisibilityPublic || visibility == TunnelVisibilityPrivate
+}
+
+// ValidConnectionPolicy reports whether policy is a known connection policy
+func ValidConnectionPolicy(policy string) bool {
+	switch policy {
+	case ConnectionPolicyReject, ConnectionPolicyTakeover, ConnectionPolicyMulti:
+		return true
+	}
+	return false
+}
+
+// HTTPMethods are the methods a tunnel can be restricted to
+var HTTPMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// ValidHTTPMethod reports whether method is one of HTTPMethods
+func ValidHTTPMethod(method string) bool {
+	return slices.Contains(HTTPMethods, method)
+}
+
+// ValidHeaderName reports whether name is a valid HTTP header field name
+func ValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidCountryCode reports whether code looks like an uppercase ISO 3166-1
+// alpha-2 country code
+func ValidCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Tunnel event types
+const (
+	TunnelEventCreated      = "created"
+	TunnelEventConnected    = "connected"
+	TunnelEventDisconnected = "disconnected"
+	TunnelEventRejected     = "rejected"
+	TunnelEventDeleted      = "deleted"
+)
+
 // WebSocket message types
 const (
 	MessageTypeConnect  = "CONNECT"
@@ -47,8 +508,105 @@ const (
 	MessageTypePing     = "PING"
 	MessageTypePong     = "PONG"
 	MessageTypeError    = "ERROR"
+	MessageTypeHello    = "hello"
+	MessageTypeHelloAck = "hello_ack"
 )
 
+// WebSocket protocol versions. The CLI opens every connection with a hello
+// carrying its version and capabilities; the server answers with a hello_ack
+// holding what both sides will use (see NegotiateProtocol).
+const (
+	// ProtocolVersionLegacy is spoken by CLIs that connect without a hello
+	ProtocolVersionLegacy = 1
+	// ProtocolVersionCurrent is the newest version the server speaks
+	ProtocolVersionCurrent = 2
+)
+
+// Protocol capabilities a CLI can advertise in its hello
+const (
+	CapabilityCompression  = "compression"   // gzip-compressed bodies
+	CapabilityBinaryFrames = "binary_frames" // bodies sent as binary WebSocket frames instead of base64
+	CapabilityStreaming    = "streaming"     // proxy_stream_* responses
+	CapabilityChunkAcks    = "chunk_acks"    // per-chunk acknowledgements
+	CapabilityInlineLimit  = "inline_limit"  // max_inline_bytes on proxy requests
+	CapabilityChecksums    = "checksums"     // SHA-256 of S3-staged bodies
+	CapabilityErrors       = "errors"        // error on proxy responses the CLI made up itself
+	CapabilityReconnect    = "reconnect"     // reconnect_soon handover to a fresh connection
+	CapabilityStats        = "stats"         // edge-side stats sent after each PONG
+	CapabilityTimings      = "timings"       // s3_upload_ms on S3-staged proxy responses
+)
+
+// ServerCapabilities are the capabilities the server implements
+var ServerCapabilities = []string{CapabilityStreaming, CapabilityInlineLimit, CapabilityChecksums, CapabilityErrors, CapabilityReconnect, CapabilityStats, CapabilityTimings}
+
+// LegacyCapabilities are assumed for CLIs that never sent a hello
+var LegacyCapabilities = []string{CapabilityStreaming}
+
+// NegotiateProtocol picks the highest version both sides speak and the
+// capabilities both sides implement. A zero version means the CLI sent none.
+func NegotiateProtocol(version int, capabilities []string) (int, []string, error) {
+	if version == 0 {
+		version = ProtocolVersionLegacy
+	}
+	if version < ProtocolVersionLegacy {
+		return 0, nil, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	if version > ProtocolVersionCurrent {
+		version = ProtocolVersionCurrent
+	}
+
+	negotiated := []string{}
+	for _, supported := range ServerCapabilities {
+		for _, c := range capabilities {
+			if c == supported {
+				negotiated = append(negotiated, c)
+				break
+			}
+		}
+	}
+	return version, negotiated, nil
+}
+
+// Management API versions. Routes are served under /v{version}, e.g.
+// GET /v1/tunnels; the unprefixed routes of CLIs that predate versioning are
+// deprecated aliases of version 1. Clients send the version they speak in
+// APIVersionHeader and every response carries the version that served it.
+const (
+	APIVersionHeader = "Tunnel-Api-Version"
+	// APIWarningHeader carries a deprecation notice for the caller to show
+	APIWarningHeader = "Tunnel-Api-Warning"
+
+	// APIVersionCurrent is the newest API version
+	APIVersionCurrent = 1
+	// APIVersionMinimum is the oldest API version served without a
+	// deprecation warning
+	APIVersionMinimum = 1
+)
+
+// NegotiateAPIVersion returns the API version that serves a route, given the
+// route's path and the version the client asked for in APIVersionHeader
+// (empty for clients that predate versioning), and a deprecation warning for
+// the client when it is due.
+func NegotiateAPIVersion(path, requested string) (int, string) {
+	version := 0
+	if rest, ok := strings.CutPrefix(path, "/v"); ok {
+		digits, _, _ := strings.Cut(rest, "/")
+		version, _ = strconv.Atoi(digits)
+	}
+	if version <= 0 {
+		return APIVersionCurrent, fmt.Sprintf("Unversioned API routes are deprecated; upgrade to a client that uses /v%d", APIVersionCurrent)
+	}
+
+	oldest := version
+	if clientVersion, err := strconv.Atoi(requested); err == nil && clientVersion < oldest {
+		oldest = clientVersion
+	}
+	if oldest < APIVersionMinimum {
+		return version, fmt.Sprintf("API version %d is deprecated; upgrade to a client that speaks version %d", oldest, APIVersionCurrent)
+	}
+	return version, ""
+}
+
 // WebSocketMessage represents a message sent over the WebSocket connection
 type WebSocketMessage struct {
 	Action    string                 `json:"action"`
@@ -0,0 +1,343 @@
+// Package openapi generates an OpenAPI 3 description of an HTTP API from the
+// metadata of its routes, deriving the JSON schemas from the Go types the
+// handlers encode and decode. It is stdlib only, so both the management API
+// Lambdas and the backoffice can describe themselves with it.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+)
+
+// Version is the OpenAPI version of the generated documents
+const Version = "3.0.3"
+
+// Operation describes one route
+type Operation struct {
+	Method  string
+	Path    string // e.g. "/v1/tunnels/{tunnel_id}"; path parameters are derived from it
+	ID      string // operationId, the method name in generated SDKs
+	Summary string
+	Tag     string
+	// Security names the security scheme the route requires, "" for none
+	Security string
+	Query    []Param
+	// Request is a value of the JSON body type, nil for none
+	Request interface{}
+	// Status is the success status, 200 when unset, and Response a value of
+	// its JSON body type, nil for an untyped JSON body
+	Status   int
+	Response interface{}
+	// Errors are the error statuses the route documents besides 401 (for
+	// routes with Security) and 500; they answer with the API's error body
+	Errors []int
+}
+
+// Param is a query parameter
+type Param struct {
+	Name        string
+	Description string
+	Type        string // JSON type, "string" when unset
+}
+
+// Info describes the API as a whole
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// SecurityScheme is a way of authenticating
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// BearerAuth is an Authorization: Bearer scheme
+func BearerAuth(description string) SecurityScheme {
+	return SecurityScheme{Type: "http", Scheme: "bearer", Description: description}
+}
+
+// API describes an API as a whole
+type API struct {
+	Info            Info
+	Servers         []Server
+	SecuritySchemes map[string]SecurityScheme
+	// ErrorBody is a value of the type errors are answered with, in
+	// ErrorContentType; problem details (problem.Problem) when nil
+	ErrorBody        interface{}
+	ErrorContentType string
+	Operations       []Operation
+}
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Servers    []Server                         `json:"servers,omitempty"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components components                       `json:"components"`
+
+	// errorContent is the content of error responses
+	errorContent map[string]mediaType
+}
+
+// Server is a base URL the API is served from
+type Server struct {
+	URL string `json:"url"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type operation struct {
+	OperationID string                `json:"operationId,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []parameter           `json:"parameters,omitempty"`
+	RequestBody *body                 `json:"requestBody,omitempty"`
+	Responses   map[string]*body      `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// body is a request body or a response
+type body struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema, or a reference to a component schema
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// pathParam matches the parameters of a route path
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// Generate builds the document describing an API
+func Generate(api API) Document {
+	doc := Document{
+		OpenAPI: Version,
+		Info:    api.Info,
+		Servers: api.Servers,
+		Paths:   map[string]map[string]*operation{},
+		Components: components{
+			Schemas:         map[string]*Schema{},
+			SecuritySchemes: api.SecuritySchemes,
+		},
+	}
+	errorBody, errorContentType := api.ErrorBody, api.ErrorContentType
+	if errorBody == nil {
+		errorBody, errorContentType = problem.Problem{}, problem.ContentType
+	}
+	doc.errorContent = map[string]mediaType{
+		errorContentType: {Schema: doc.schema(reflect.TypeOf(errorBody))},
+	}
+
+	for _, op := range api.Operations {
+		if doc.Paths[op.Path] == nil {
+			doc.Paths[op.Path] = map[string]*operation{}
+		}
+		doc.Paths[op.Path][strings.ToLower(op.Method)] = doc.operation(op)
+	}
+	return doc
+}
+
+// JSON encodes the document
+func (d Document) JSON() []byte {
+	encoded, _ := json.MarshalIndent(d, "", "  ")
+	return encoded
+}
+
+func (d *Document) operation(op Operation) *operation {
+	out := &operation{
+		OperationID: op.ID,
+		Summary:     op.Summary,
+		Responses:   map[string]*body{},
+	}
+	if op.Tag != "" {
+		out.Tags = []string{op.Tag}
+	}
+	if op.Security != "" {
+		out.Security = []map[string][]string{{op.Security: {}}}
+	}
+
+	for _, match := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+		out.Parameters = append(out.Parameters, parameter{
+			Name:     strings.TrimSuffix(match[1], "+"),
+			In:       "path",
+			Required: true,
+			Schema:   &Schema{Type: "string"},
+		})
+	}
+	for _, param := range op.Query {
+		paramType := param.Type
+		if paramType == "" {
+			paramType = "string"
+		}
+		out.Parameters = append(out.Parameters, parameter{
+			Name:        param.Name,
+			In:          "query",
+			Description: param.Description,
+			Schema:      &Schema{Type: paramType},
+		})
+	}
+
+	if op.Request != nil {
+		out.RequestBody = &body{
+			Required: true,
+			Content:  jsonContent(d.schema(reflect.TypeOf(op.Request))),
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	responseSchema := &Schema{Type: "object"}
+	if op.Response != nil {
+		responseSchema = d.schema(reflect.TypeOf(op.Response))
+	}
+	out.Responses[strconv.Itoa(status)] = &body{
+		Description: http.StatusText(status),
+		Content:     jsonContent(responseSchema),
+	}
+
+	// Any route may fail with an internal error
+	statuses := append([]int{http.StatusInternalServerError}, op.Errors...)
+	if op.Security != "" {
+		statuses = append(statuses, http.StatusUnauthorized)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		out.Responses[strconv.Itoa(status)] = &body{
+			Description: http.StatusText(status),
+			Content:     d.errorContent,
+		}
+	}
+	return out
+}
+
+func jsonContent(schema *Schema) map[string]mediaType {
+	return map[string]mediaType{"application/json": {Schema: schema}}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of t. Named struct types become component schemas
+// and are referenced.
+func (d *Document) schema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := d.schema(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.object(t)
+		}
+		if _, ok := d.Components.Schemas[t.Name()]; !ok {
+			// Reserve the name first, for types that refer to themselves
+			d.Components.Schemas[t.Name()] = &Schema{}
+			*d.Components.Schemas[t.Name()] = *d.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	// Interfaces: any JSON value
+	return &Schema{}
+}
+
+// object returns the schema of a struct's JSON encoding; the fields of
+// embedded structs are promoted like encoding/json does
+func (d *Document) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := d.object(field.Type)
+			for property, propertySchema := range embedded.Properties {
+				schema.Properties[property] = propertySchema
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = d.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
@@ -0,0 +1,52 @@
+package problem
+
+import (
+	"bytes"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Response answers an HTTP API (payload 2.0) request with p
+func Response(p Problem) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: p.Status,
+		Headers: map[string]string{
+			"Content-Type": ContentType,
+		},
+		Body: string(p.JSON()),
+	}, nil
+}
+
+// ProxyResponse answers a WebSocket or REST API (payload 1.0) request with p
+func ProxyResponse(p Problem) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: p.Status,
+		Headers: map[string]string{
+			"Content-Type": ContentType,
+		},
+		Body: string(p.JSON()),
+	}, nil
+}
+
+// ErrorResponse answers an HTTP API request with a problem carrying code
+func ErrorResponse(status int, code, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return Response(New(status, code, message))
+}
+
+// ProxyErrorResponse answers a WebSocket or REST API request with a problem
+// carrying code
+func ProxyErrorResponse(status int, code, message string) (events.APIGatewayProxyResponse, error) {
+	return ProxyResponse(New(status, code, message))
+}
+
+// StreamingErrorResponse answers a Function URL request of a streaming
+// function with a problem carrying code
+func StreamingErrorResponse(status int, code, message string) (*events.LambdaFunctionURLStreamingResponse, error) {
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": ContentType,
+		},
+		Body: bytes.NewReader(New(status, code, message).JSON()),
+	}, nil
+}
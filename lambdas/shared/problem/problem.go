@@ -0,0 +1,159 @@
+// Package problem builds the error bodies of the public endpoints: RFC 7807
+// problem details (application/problem+json) with a stable, machine-readable
+// code. The body keeps the "error" member the API always had, so clients that
+// predate problem details still read the message.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ContentType is the media type of a problem details body
+const ContentType = "application/problem+json"
+
+// typePrefix turns a code into the problem's type URI
+const typePrefix = "urn:tunnel:problem:"
+
+// Codes for errors any endpoint can return, one per HTTP status (see
+// CodeForStatus)
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeRateLimited      = "rate_limited"
+	CodeClientClosed     = "client_closed"
+	CodeInternal         = "internal_error"
+	CodeBadGateway       = "bad_gateway"
+	CodeUnavailable      = "unavailable"
+	CodeTimeout          = "timeout"
+)
+
+// Codes for specific errors clients are expected to handle
+const (
+	CodeInvalidAPIKey           = "invalid_api_key"           // 401: the API key is missing, malformed or unknown
+	CodeTunnelNotFound          = "tunnel_not_found"          // 404: no such tunnel, or not the caller's
+	CodeTunnelInactive          = "tunnel_inactive"           // 503: the tunnel has no connected CLI
+	CodeTunnelInUse             = "tunnel_in_use"             // 409: the connection policy refuses another CLI
+	CodeTunnelConnected         = "tunnel_connected"          // 409: another CLI holds the tunnel and the connecting one asked to choose
+	CodeTunnelSaturated         = "tunnel_saturated"          // 429: too many requests in flight to the tunnel
+	CodeSubdomainTaken          = "subdomain_taken"           // 409: another client owns the subdomain
+	CodeTunnelQuotaExceeded     = "tunnel_quota_exceeded"     // 409: the client may own no more tunnels
+	CodePasswordRequired        = "password_required"         // 401: the tunnel is password protected
+	CodeAccessTokenRequired     = "access_token_required"     // 401: the tunnel is private and the access token is missing or invalid
+	CodeRequestNotFound         = "request_not_found"         // 404: no such pending request, e.g. to poll
+	CodeConcurrentUpdate        = "concurrent_update"         // 409: the tunnel changed meanwhile; retry
+	CodeConnectionLimitExceeded = "connection_limit_exceeded" // 429: the client has as many connected CLIs as it may
+	CodePlanUpgradeRequired     = "plan_upgrade_required"     // 402: the feature is not part of the client's plan
+	CodeBillingUnavailable      = "billing_unavailable"       // 404: the deployment does not sell plans
+)
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	// Error repeats Detail for clients that predate problem details
+	Error string `json:"error"`
+	// Usage is set on errors about a limit
+	Usage *Usage `json:"usage,omitempty"`
+	// Connection is set on tunnel_connected
+	Connection *Connection `json:"connection,omitempty"`
+}
+
+// Usage is how much of a limit is in use
+type Usage struct {
+	Current int `json:"current"`
+	Limit   int `json:"limit"`
+}
+
+// Connection describes the CLI that holds a tunnel, and what the connecting
+// one may do about it
+type Connection struct {
+	SourceIP         string     `json:"source_ip,omitempty"`
+	Platform         string     `json:"platform,omitempty"`
+	CLIVersion       string     `json:"cli_version,omitempty"`
+	ConnectedAt      *time.Time `json:"connected_at,omitempty"`
+	Connections      int        `json:"connections"`
+	ConnectionPolicy string     `json:"connection_policy"`
+	CanAttach        bool       `json:"can_attach"` // The policy is multi, so on_conflict=attach is allowed
+}
+
+// New returns the problem for an error with status, code and a human-readable
+// detail
+func New(status int, code, detail string) Problem {
+	title := http.StatusText(status)
+	if title == "" {
+		title = "Error"
+	}
+	return Problem{
+		Type:   typePrefix + code,
+		Title:  title,
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Error:  detail,
+	}
+}
+
+// WithUsage returns the problem with the usage of the limit it is about
+func (p Problem) WithUsage(current, limit int) Problem {
+	p.Usage = &Usage{Current: current, Limit: limit}
+	return p
+}
+
+// WithConnection returns the problem with the CLI that holds the tunnel
+func (p Problem) WithConnection(c Connection) Problem {
+	p.Connection = &c
+	return p
+}
+
+// JSON encodes the problem
+func (p Problem) JSON() []byte {
+	body, _ := json.Marshal(p)
+	return body
+}
+
+// Body returns the encoded problem for an error with status and detail, with
+// the status's generic code
+func Body(status int, detail string) []byte {
+	return New(status, CodeForStatus(status), detail).JSON()
+}
+
+// CodeForStatus returns the generic code of an HTTP error status
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound, http.StatusGone:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case 499:
+		return CodeClientClosed
+	case http.StatusBadGateway:
+		return CodeBadGateway
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeTimeout
+	}
+	if status >= 400 && status < 500 {
+		return CodeInvalidRequest
+	}
+	return CodeInternal
+}
@@ -0,0 +1,298 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+)
+
+// Errors returned by Acquire when no slot could be had
+var (
+	ErrSaturated    = errors.New("all slots are in use and the queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in the queue")
+)
+
+const (
+	// A queued caller first checks for a free slot after queuePollMin and
+	// doubles the wait after every miss up to queuePollMax, which stays under
+	// queueSkipAfter so a live head of the queue is not taken for a dead one
+	queuePollMin = 25 * time.Millisecond
+	queuePollMax = 500 * time.Millisecond
+	// queueSkipAfter is how long the head of the queue may leave a free slot
+	// unclaimed before the next waiter takes its turn. Waiters whose Lambda
+	// died or timed out never leave the queue, so they have to be skipped.
+	queueSkipAfter = time.Second
+	// slotLease bounds how long the slot count is trusted without any acquire
+	// or release. A Lambda killed while holding a slot never releases it; no
+	// invocation outlives the 15-minute Lambda limit, so after that the count
+	// is reset.
+	slotLease = 15 * time.Minute
+	// semaphoreTTL expires the items of idle keys
+	semaphoreTTL = time.Hour
+)
+
+// Concurrency configures a counting semaphore: Limit holders at a time, up to
+// QueueSize callers waiting in FIFO order for at most QueueTimeout, and the
+// rest turned away
+type Concurrency struct {
+	Limit        int64
+	QueueSize    int64
+	QueueTimeout time.Duration
+}
+
+// semaphore is the item holding one key's slots and queue. Waiters draw
+// ascending tickets from next_ticket; serving is the last ticket admitted and
+// admit_until the highest ticket the queue has room for.
+type semaphore struct {
+	Inflight   int64 `dynamodbav:"inflight"`
+	NextTicket int64 `dynamodbav:"next_ticket"`
+	Serving    int64 `dynamodbav:"serving"`
+	TouchedAt  int64 `dynamodbav:"touched_at"` // Unix milliseconds of the last acquire or release
+}
+
+func semaphoreKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"limit_key": &types.AttributeValueMemberS{Value: "inflight#" + key},
+	}
+}
+
+func number(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+// Acquire takes one of key's c.Limit slots, queueing behind earlier callers
+// while they are all in use, and returns how long it waited. It fails with
+// ErrSaturated when the queue is full and ErrQueueTimeout when no slot freed
+// up in time. Every successful Acquire must be paired with a Release. Like
+// Hit, the semaphore lives in the rate-limits table so all Lambda containers
+// share it.
+func Acquire(ctx context.Context, client *db.DynamoDBClient, table, key string, c Concurrency) (time.Duration, error) {
+	start := time.Now()
+
+	acquired, err := tryAcquire(ctx, client, table, key, c.Limit)
+	if err != nil || acquired {
+		return 0, err
+	}
+	if c.QueueSize < 1 {
+		return 0, ErrSaturated
+	}
+
+	ticket, err := takeTicket(ctx, client, table, key, c.QueueSize)
+	if errors.Is(err, db.ErrConditionFailed) {
+		return 0, ErrSaturated
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.NewTimer(c.QueueTimeout)
+	defer deadline.Stop()
+	poll := queuePollMin
+	retry := time.NewTimer(poll)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return time.Since(start), ctx.Err()
+		case <-deadline.C:
+			return time.Since(start), ErrQueueTimeout
+		case <-retry.C:
+			acquired, err := claim(ctx, client, table, key, ticket, c)
+			if err != nil || acquired {
+				return time.Since(start), err
+			}
+			poll = min(poll*2, queuePollMax)
+			retry.Reset(poll)
+		}
+	}
+}
+
+// Release gives back a slot taken by Acquire
+func Release(ctx context.Context, client *db.DynamoDBClient, table, key string) error {
+	now := time.Now()
+	err := client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(table),
+		Key:                 semaphoreKey(key),
+		UpdateExpression:    aws.String("ADD inflight :minus_one SET touched_at = :now"),
+		ConditionExpression: aws.String("inflight > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minus_one": number(-1),
+			":zero":      number(0),
+			":now":       number(now.UnixMilli()),
+		},
+	})
+	// The count was reset after its lease expired while this slot was held
+	if errors.Is(err, db.ErrConditionFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release %s: %w", key, err)
+	}
+	return nil
+}
+
+// Usage returns how many of key's slots are held and how many callers are
+// queued for one. Queued counts waiters that died in the queue until it moves
+// past them.
+func Usage(ctx context.Context, client *db.DynamoDBClient, table, key string) (inflight, queued int64, err error) {
+	raw, err := client.GetRawItem(ctx, table, semaphoreKey(key), false)
+	if errors.Is(err, db.ErrItemNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	var s semaphore
+	if err := attributevalue.UnmarshalMap(raw, &s); err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return max(s.Inflight, 0), max(s.NextTicket-s.Serving, 0), nil
+}
+
+// tryAcquire takes a slot right away if one is free and nobody is queued
+func tryAcquire(ctx context.Context, client *db.DynamoDBClient, table, key string, limit int64) (bool, error) {
+	now := time.Now()
+	err := client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(table),
+		Key:              semaphoreKey(key),
+		UpdateExpression: aws.String("ADD inflight :one SET touched_at = :now, #ttl = :ttl"),
+		ConditionExpression: aws.String("(attribute_not_exists(inflight) OR inflight < :limit) AND " +
+			"(attribute_not_exists(next_ticket) OR serving >= next_ticket)"),
+		ExpressionAttributeNames: map[string]string{
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":   number(1),
+			":limit": number(limit),
+			":now":   number(now.UnixMilli()),
+			":ttl":   number(now.Add(semaphoreTTL).Unix()),
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return reclaim(ctx, client, table, key)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// reclaim resets a slot count whose lease has expired and takes the first
+// slot of the fresh count
+func reclaim(ctx context.Context, client *db.DynamoDBClient, table, key string) (bool, error) {
+	now := time.Now()
+	err := client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(table),
+		Key:                 semaphoreKey(key),
+		UpdateExpression:    aws.String("SET inflight = :one, touched_at = :now"),
+		ConditionExpression: aws.String("touched_at < :expired"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     number(1),
+			":now":     number(now.UnixMilli()),
+			":expired": number(now.Add(-slotLease).UnixMilli()),
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to reclaim %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// takeTicket joins the queue, failing with db.ErrConditionFailed when it is
+// full. A queue nobody has moved for queueSkipAfter only holds dead waiters,
+// so it is joined regardless; the new waiter skips them.
+func takeTicket(ctx context.Context, client *db.DynamoDBClient, table, key string, queueSize int64) (int64, error) {
+	now := time.Now()
+	var result semaphore
+	err := client.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(table),
+		Key:              semaphoreKey(key),
+		UpdateExpression: aws.String("ADD next_ticket :one SET serving = if_not_exists(serving, :zero), admit_until = if_not_exists(admit_until, :queue_size), #ttl = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(next_ticket) OR next_ticket < admit_until OR " +
+			"touched_at < :stale"),
+		ExpressionAttributeNames: map[string]string{
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":        number(1),
+			":zero":       number(0),
+			":queue_size": number(queueSize),
+			":stale":      number(now.Add(-queueSkipAfter).UnixMilli()),
+			":ttl":        number(now.Add(semaphoreTTL).Unix()),
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	}, &result)
+	if errors.Is(err, db.ErrConditionFailed) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue for %s: %w", key, err)
+	}
+	return result.NextTicket, nil
+}
+
+// claim takes a slot for ticket if one is free and it is ticket's turn: the
+// previous ticket was admitted, the queue has stalled on a dead waiter, or
+// ticket itself was skipped while it was slow to poll
+func claim(ctx context.Context, client *db.DynamoDBClient, table, key string, ticket int64, c Concurrency) (bool, error) {
+	raw, err := client.GetRawItem(ctx, table, semaphoreKey(key), false)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	var s semaphore
+	if err := attributevalue.UnmarshalMap(raw, &s); err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	now := time.Now()
+	if s.Inflight >= c.Limit {
+		if now.Sub(time.UnixMilli(s.TouchedAt)) > slotLease {
+			return reclaim(ctx, client, table, key)
+		}
+		return false, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key:       semaphoreKey(key),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":   number(1),
+			":limit": number(c.Limit),
+			":now":   number(now.UnixMilli()),
+		},
+	}
+	switch {
+	case s.Serving >= ticket:
+		input.UpdateExpression = aws.String("ADD inflight :one SET touched_at = :now")
+		input.ConditionExpression = aws.String("inflight < :limit")
+	case s.Serving == ticket-1 || now.Sub(time.UnixMilli(s.TouchedAt)) > queueSkipAfter:
+		input.UpdateExpression = aws.String("ADD inflight :one SET serving = :ticket, admit_until = :admit_until, touched_at = :now")
+		input.ConditionExpression = aws.String("inflight < :limit AND serving = :serving")
+		input.ExpressionAttributeValues[":ticket"] = number(ticket)
+		input.ExpressionAttributeValues[":admit_until"] = number(ticket + c.QueueSize)
+		input.ExpressionAttributeValues[":serving"] = number(s.Serving)
+	default:
+		return false, nil
+	}
+
+	err = client.UpdateItemWithCondition(ctx, input)
+	if errors.Is(err, db.ErrConditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire %s: %w", key, err)
+	}
+	return true, nil
+}
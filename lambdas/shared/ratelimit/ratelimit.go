@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+)
+
+// Window is the length of a fixed counting window
+const Window = 10 * time.Second
+
+// counter is a rate-limit item; one exists per key and window
+type counter struct {
+	Count int64 `dynamodbav:"count"`
+}
+
+// Hit counts one event for key in the current window and returns the number
+// of events seen so far in that window. Counters live in DynamoDB so every
+// Lambda container shares them, and expire through TTL shortly after the window.
+func Hit(ctx context.Context, client *db.DynamoDBClient, table, key string) (int64, error) {
+	now := time.Now()
+	windowStart := now.Truncate(Window)
+
+	var result counter
+	err := client.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"limit_key": &types.AttributeValueMemberS{Value: key + "#" + strconv.FormatInt(windowStart.Unix(), 10)},
+		},
+		UpdateExpression: aws.String("ADD #count :one SET #ttl = if_not_exists(#ttl, :ttl)"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "count",
+			"#ttl":   "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":ttl": &types.AttributeValueMemberN{Value: strconv.FormatInt(windowStart.Add(2*Window).Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}, &result)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count %s: %w", key, err)
+	}
+
+	return result.Count, nil
+}
@@ -0,0 +1,189 @@
+// Package redact masks secrets in the request details http-proxy keeps in the
+// request log and the backoffice shows: header values, JSON and form fields,
+// and query parameters. It is stdlib only, so the backoffice applies the same
+// rules to what it displays.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Mask replaces every redacted value
+const Mask = "[REDACTED]"
+
+// PreviewBytes is the most of a request body a preview keeps
+const PreviewBytes = 1024
+
+// DefaultHeaders are always redacted
+var DefaultHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"}
+
+// DefaultFields are always redacted, at any depth of a JSON body and in form
+// bodies and query strings
+var DefaultFields = []string{"password", "secret", "token", "access_token", "refresh_token", "api_key", "client_secret"}
+
+// Rules are the header names and field paths to redact. A field without a
+// dot matches that key at any depth; "user.password" matches from the root of
+// a JSON body only, looking through arrays.
+type Rules struct {
+	headers []string
+	fields  [][]string
+}
+
+// NewRules returns the default rules extended with headers and fields
+func NewRules(headers, fields []string) Rules {
+	var r Rules
+	for _, name := range append(DefaultHeaders, headers...) {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			r.headers = append(r.headers, name)
+		}
+	}
+	for _, field := range append(DefaultFields, fields...) {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			r.fields = append(r.fields, strings.Split(field, "."))
+		}
+	}
+	return r
+}
+
+// ParseList splits a comma-separated list, as rules are configured in the
+// environment
+func ParseList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Headers returns a copy of headers with the values of redacted ones masked
+func (r Rules) Headers(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if r.header(name) {
+			value = Mask
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+func (r Rules) header(name string) bool {
+	name = strings.ToLower(name)
+	for _, h := range r.headers {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Path masks redacted fields in the query string of a request path
+func (r Rules) Path(path string) string {
+	base, query, ok := strings.Cut(path, "?")
+	if !ok || query == "" {
+		return path
+	}
+	return base + "?" + r.query(query)
+}
+
+// query masks redacted fields of a URL-encoded query or form, keeping the
+// order of its parameters
+func (r Rules) query(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if r.field([]string{strings.ToLower(name)}) {
+			params[i] = key + "=" + url.QueryEscape(Mask)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// field reports whether the key at path (lowercase, from the root of the
+// body) is redacted
+func (r Rules) field(path []string) bool {
+	for _, f := range r.fields {
+		if len(f) == 1 && f[0] == path[len(path)-1] {
+			return true
+		}
+		if len(f) == len(path) && strings.Join(f, ".") == strings.Join(path, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// BodyPreview returns the redacted start of a request body of contentType, at
+// most PreviewBytes long. JSON and form bodies have their redacted fields
+// masked; a JSON body that does not parse is not previewed at all, since its
+// fields cannot be found. Binary bodies are not previewed either.
+func (r Rules) BodyPreview(contentType, body string) string {
+	if body == "" || !utf8.ValidString(body) {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		decoder := json.NewDecoder(strings.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return Mask
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(r.json(value, nil)); err != nil {
+			return Mask
+		}
+		body = strings.TrimSuffix(buf.String(), "\n")
+	case mediaType == "application/x-www-form-urlencoded":
+		body = r.query(body)
+	}
+	return truncate(body, PreviewBytes)
+}
+
+// json masks the redacted fields of a decoded JSON value found at path
+func (r Rules) json(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childPath := append(path[:len(path):len(path)], strings.ToLower(key))
+			if r.field(childPath) {
+				v[key] = Mask
+				continue
+			}
+			v[key] = r.json(child, childPath)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = r.json(child, path)
+		}
+	}
+	return value
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,77 @@
+package redelivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// MaxAttempts is how many times a message is sent before its request is
+	// failed, the first send included
+	MaxAttempts = 5
+	// MaxMessageBytes leaves room under SQS's 256 KB message limit for the
+	// JSON and base64 overhead of a delivery
+	MaxMessageBytes = 180 * 1024
+
+	firstBackoff = time.Second
+	maxBackoff   = 15 * time.Second
+)
+
+// Delivery is a WebSocket message for a pending request that could not be
+// sent to the CLI. It is retried until Deadline, after which the caller has
+// stopped waiting for the response.
+type Delivery struct {
+	RequestID string    `json:"request_id"`
+	TunnelID  string    `json:"tunnel_id"`
+	Message   []byte    `json:"message"`
+	Attempt   int       `json:"attempt"`
+	Deadline  time.Time `json:"deadline"`
+}
+
+// Transient reports whether a PostToConnection error may succeed on a later
+// attempt: the connection went away while the CLI reconnects, API Gateway
+// throttled the send, or it failed on the service side
+func Transient(err error) bool {
+	var gone *apigwtypes.GoneException
+	var limit *apigwtypes.LimitExceededException
+	if errors.As(err, &gone) || errors.As(err, &limit) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorFault() == smithy.FaultServer
+}
+
+// Backoff is the wait before the given attempt, doubling from one second
+func Backoff(attempt int) time.Duration {
+	wait := firstBackoff
+	for i := 1; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
+
+// Enqueue schedules d for its next attempt after its backoff
+func Enqueue(ctx context.Context, client *sqs.Client, queueURL string, d Delivery) error {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+
+	_, err = client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(queueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: int32(Backoff(d.Attempt) / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue delivery for request %s: %w", d.RequestID, err)
+	}
+	return nil
+}
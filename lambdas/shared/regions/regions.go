@@ -0,0 +1,99 @@
+package regions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ForwardedFromHeader marks a request that http-proxy already forwarded from
+// another region, so it is never forwarded twice. Its value is signed with the
+// deployment's shared forwarding secret (see SignForward); http-proxy strips
+// it from every request and only trusts it with a valid signature.
+const ForwardedFromHeader = "x-tunnel-forwarded-from"
+
+// forwardMaxAge bounds how old a ForwardedFromHeader signature may be, which
+// also bounds the clock skew tolerated between regions
+const forwardMaxAge = 5 * time.Minute
+
+// Region is one regional deployment of the tunnel service
+type Region struct {
+	Name         string `json:"region"`
+	WebsocketURL string `json:"websocket_url"` // wss://.../stage of the region's WebSocket API
+	ProxyURL     string `json:"proxy_url"`     // Base URL of the region's http-proxy
+}
+
+// Load reads the deployment's regions from the REGIONS environment variable, a
+// JSON array of Region. It returns nil for single-region deployments.
+func Load() ([]Region, error) {
+	raw := os.Getenv("REGIONS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var regions []Region
+	if err := json.Unmarshal([]byte(raw), &regions); err != nil {
+		return nil, fmt.Errorf("invalid REGIONS: %w", err)
+	}
+
+	return regions, nil
+}
+
+// Current returns the region this Lambda runs in
+func Current() string {
+	return os.Getenv("AWS_REGION")
+}
+
+// Find returns the region called name
+func Find(regions []Region, name string) (Region, bool) {
+	for _, r := range regions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+// SignForward returns the ForwardedFromHeader value of a request that region
+// from forwards at now: the region, the Unix time and an HMAC-SHA256 of both
+// under secret, separated by semicolons
+func SignForward(secret []byte, from string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return from + ";" + ts + ";" + forwardMAC(secret, from, ts)
+}
+
+// VerifyForward returns the region a ForwardedFromHeader value names when it
+// was signed with secret less than forwardMaxAge before now
+func VerifyForward(secret []byte, value string, now time.Time) (string, bool) {
+	if len(secret) == 0 {
+		return "", false
+	}
+	parts := strings.Split(value, ";")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", false
+	}
+	from, ts, mac := parts[0], parts[1], parts[2]
+	if !hmac.Equal([]byte(mac), []byte(forwardMAC(secret, from, ts))) {
+		return "", false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > forwardMaxAge || age < -forwardMaxAge {
+		return "", false
+	}
+	return from, true
+}
+
+func forwardMAC(secret []byte, from, ts string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(from + "\n" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
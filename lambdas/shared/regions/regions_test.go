@@ -0,0 +1,39 @@
+package regions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyForward(t *testing.T) {
+	secret := []byte("shared-forward-secret")
+	now := time.Unix(1_700_000_000, 0)
+	signed := SignForward(secret, "eu-west-1", now)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		value  string
+		at     time.Time
+		ok     bool
+	}{
+		{"valid", secret, signed, now.Add(time.Minute), true},
+		{"plain region", secret, "eu-west-1", now, false},
+		{"other region", secret, "us-east-1" + signed[len("eu-west-1"):], now, false},
+		{"other secret", []byte("another-secret"), signed, now, false},
+		{"no secret", nil, signed, now, false},
+		{"stale", secret, signed, now.Add(forwardMaxAge + time.Second), false},
+		{"from the future", secret, signed, now.Add(-forwardMaxAge - time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, ok := VerifyForward(tt.secret, tt.value, tt.at)
+			if ok != tt.ok {
+				t.Fatalf("VerifyForward(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			}
+			if ok && from != "eu-west-1" {
+				t.Errorf("from = %q, want eu-west-1", from)
+			}
+		})
+	}
+}
@@ -0,0 +1,481 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// ClientIDIndex is the tunnels table GSI keyed by client_id
+const ClientIDIndex = "client_id-index"
+
+// PendingTunnelIndex is the pending requests table GSI keyed by tunnel_id and
+// sorted by created_at
+const PendingTunnelIndex = "tunnel_id-index"
+
+func stringKey(name, value string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		name: &types.AttributeValueMemberS{Value: value},
+	}
+}
+
+type dynamoTunnels struct {
+	client       *db.DynamoDBClient
+	tunnelsTable string
+	domainsTable string
+}
+
+// NewTunnelRepository returns a TunnelRepository backed by the tunnels and
+// domains tables. Lambdas that only read tunnels may leave domainsTable empty.
+func NewTunnelRepository(client *db.DynamoDBClient, tunnelsTable, domainsTable string) TunnelRepository {
+	return &dynamoTunnels{client: client, tunnelsTable: tunnelsTable, domainsTable: domainsTable}
+}
+
+func (r *dynamoTunnels) Get(ctx context.Context, tunnelID string) (*models.Tunnel, error) {
+	var tunnel models.Tunnel
+	if err := r.client.GetItem(ctx, r.tunnelsTable, stringKey("tunnel_id", tunnelID), &tunnel); err != nil {
+		return nil, err
+	}
+	return &tunnel, nil
+}
+
+func (r *dynamoTunnels) ListByClient(ctx context.Context, clientID string) ([]models.Tunnel, error) {
+	var tunnels []models.Tunnel
+	err := r.client.QueryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tunnelsTable),
+		IndexName:              aws.String(ClientIDIndex),
+		KeyConditionExpression: aws.String("client_id = :client_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":client_id": &types.AttributeValueMemberS{Value: clientID},
+		},
+	}, &tunnels)
+	if err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+func (r *dynamoTunnels) FindByConnection(ctx context.Context, connectionID, tunnelIDHint string) (*models.Tunnel, error) {
+	return r.client.FindTunnelForConnection(ctx, r.tunnelsTable, connectionID, tunnelIDHint)
+}
+
+func (r *dynamoTunnels) Create(ctx context.Context, tunnel models.Tunnel, domain models.Domain) error {
+	domainItem, err := db.PutIfNotExists(r.domainsTable, domain, "domain")
+	if err != nil {
+		return err
+	}
+	tunnelItem, err := db.PutIfNotExists(r.tunnelsTable, tunnel, "tunnel_id")
+	if err != nil {
+		return err
+	}
+
+	if err := r.client.TransactWrite(ctx, domainItem, tunnelItem); err != nil {
+		var canceled *db.TransactionCanceledError
+		if errors.As(err, &canceled) && canceled.ConditionFailed(0) {
+			return ErrDomainTaken
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *dynamoTunnels) Delete(ctx context.Context, tunnel *models.Tunnel) error {
+	return r.client.TransactWrite(ctx,
+		db.Delete(r.domainsTable, stringKey("domain", tunnel.Domain)),
+		db.Delete(r.tunnelsTable, stringKey("tunnel_id", tunnel.TunnelID)),
+	)
+}
+
+type dynamoDomains struct {
+	client *db.DynamoDBClient
+	table  string
+}
+
+// NewDomainRepository returns a DomainRepository backed by the domains table
+func NewDomainRepository(client *db.DynamoDBClient, table string) DomainRepository {
+	return &dynamoDomains{client: client, table: table}
+}
+
+func (r *dynamoDomains) Get(ctx context.Context, domain string) (*models.Domain, error) {
+	var record models.Domain
+	if err := r.client.GetItem(ctx, r.table, stringKey("domain", domain), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type dynamoReleasedDomains struct {
+	client *db.DynamoDBClient
+	table  string
+}
+
+// NewReleasedDomainRepository returns a ReleasedDomainRepository backed by the
+// released domains table
+func NewReleasedDomainRepository(client *db.DynamoDBClient, table string) ReleasedDomainRepository {
+	return &dynamoReleasedDomains{client: client, table: table}
+}
+
+func (r *dynamoReleasedDomains) Release(ctx context.Context, record models.ReleasedDomain) error {
+	if record.ReleasedAt.IsZero() {
+		record.ReleasedAt = time.Now()
+	}
+	if record.TTL == 0 {
+		record.TTL = record.ReleasedUntil.Unix()
+	}
+	if err := r.client.PutItem(ctx, r.table, record); err != nil {
+		return fmt.Errorf("failed to release domain %s: %w", record.Domain, err)
+	}
+	return nil
+}
+
+func (r *dynamoReleasedDomains) Get(ctx context.Context, domain string) (*models.ReleasedDomain, error) {
+	var record models.ReleasedDomain
+	if err := r.client.GetItem(ctx, r.table, stringKey("domain", domain), &record); err != nil {
+		return nil, err
+	}
+	// TTL deletion lags behind, so an expired record may still be read
+	if !record.Quarantined(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+type dynamoClients struct {
+	client *db.DynamoDBClient
+	table  string
+}
+
+// NewClientRepository returns a ClientRepository backed by the clients table
+func NewClientRepository(client *db.DynamoDBClient, table string) ClientRepository {
+	return &dynamoClients{client: client, table: table}
+}
+
+func (r *dynamoClients) Put(ctx context.Context, client models.Client) error {
+	return r.client.PutItem(ctx, r.table, client)
+}
+
+// FindByAPIKey scans every client, since only bcrypt hashes of the keys are
+// stored (not production-grade for large client counts)
+func (r *dynamoClients) FindByAPIKey(ctx context.Context, apiKey string) (*models.Client, error) {
+	var clients []models.Client
+	if err := r.client.ScanAll(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(r.table),
+	}, &clients); err != nil {
+		return nil, err
+	}
+
+	for _, client := range clients {
+		if auth.VerifyAPIKey(apiKey, client.APIKeyHash) && client.Status == models.ClientStatusActive {
+			return &client, nil
+		}
+	}
+
+	return nil, ErrInvalidAPIKey
+}
+
+func (r *dynamoClients) RecordUse(ctx context.Context, clientID, sourceIP string) error {
+	now := time.Now().UTC()
+	err := r.client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(r.table),
+		Key:              stringKey("client_id", clientID),
+		UpdateExpression: aws.String("SET last_used_at = :now, last_used_ip = :ip"),
+		// Skip deleted clients and uses that are too recent to be worth a write
+		ConditionExpression: aws.String("attribute_exists(client_id) AND (attribute_not_exists(last_used_at) OR last_used_at < :cutoff)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339Nano)},
+			":ip":     &types.AttributeValueMemberS{Value: sourceIP},
+			":cutoff": &types.AttributeValueMemberS{Value: now.Add(-models.ClientUseInterval).Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil && !errors.Is(err, db.ErrConditionFailed) {
+		return fmt.Errorf("failed to record use of client %s: %w", clientID, err)
+	}
+	return nil
+}
+
+func (r *dynamoClients) Delete(ctx context.Context, clientID string) error {
+	return r.client.DeleteItem(ctx, r.table, stringKey("client_id", clientID))
+}
+
+// FindByStripeCustomer scans the clients table; webhook deliveries are rare
+// enough not to warrant an index
+func (r *dynamoClients) FindByStripeCustomer(ctx context.Context, customerID string) (*models.Client, error) {
+	var clients []models.Client
+	if err := r.client.ScanAll(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(r.table),
+		FilterExpression: aws.String("stripe_customer_id = :customer"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":customer": &types.AttributeValueMemberS{Value: customerID},
+		},
+	}, &clients); err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrNotFound
+	}
+	return &clients[0], nil
+}
+
+func (r *dynamoClients) ListBilled(ctx context.Context) ([]models.Client, error) {
+	var clients []models.Client
+	if err := r.client.ScanAll(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(r.table),
+		FilterExpression: aws.String("attribute_exists(stripe_customer_id)"),
+	}, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *dynamoClients) SetStripeCustomer(ctx context.Context, clientID, customerID string) error {
+	return r.set(ctx, clientID, "stripe_customer_id", customerID)
+}
+
+func (r *dynamoClients) SetPlan(ctx context.Context, clientID, plan string, eventAt int64) error {
+	err := r.client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(r.table),
+		Key:                      stringKey("client_id", clientID),
+		UpdateExpression:         aws.String("SET #plan = :plan, plan_event_at = :event_at"),
+		ConditionExpression:      aws.String("attribute_exists(client_id) AND (attribute_not_exists(plan_event_at) OR plan_event_at <= :event_at)"),
+		ExpressionAttributeNames: map[string]string{"#plan": "plan"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":plan":     &types.AttributeValueMemberS{Value: plan},
+			":event_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(eventAt, 10)},
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		// Tell a deleted client from a stale event
+		var client models.Client
+		if err := r.client.GetItem(ctx, r.table, stringKey("client_id", clientID), &client); err != nil {
+			return err
+		}
+		return ErrStaleEvent
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set plan of client %s: %w", clientID, err)
+	}
+	return nil
+}
+
+func (r *dynamoClients) SetUsageReportedUntil(ctx context.Context, clientID string, until time.Time) error {
+	return r.set(ctx, clientID, "usage_reported_until", until.UTC().Format(time.RFC3339))
+}
+
+// set writes one string attribute of a client, ErrNotFound if it was deleted
+func (r *dynamoClients) set(ctx context.Context, clientID, attribute, value string) error {
+	err := r.client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(r.table),
+		Key:                      stringKey("client_id", clientID),
+		UpdateExpression:         aws.String("SET #attr = :value"),
+		ConditionExpression:      aws.String("attribute_exists(client_id)"),
+		ExpressionAttributeNames: map[string]string{"#attr": attribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":value": &types.AttributeValueMemberS{Value: value},
+		},
+	})
+	if errors.Is(err, db.ErrConditionFailed) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set %s of client %s: %w", attribute, clientID, err)
+	}
+	return nil
+}
+
+type dynamoPendingRequests struct {
+	client *db.DynamoDBClient
+	table  string
+}
+
+// NewPendingRequestRepository returns a PendingRequestRepository backed by the
+// pending requests table
+func NewPendingRequestRepository(client *db.DynamoDBClient, table string) PendingRequestRepository {
+	return &dynamoPendingRequests{client: client, table: table}
+}
+
+func (r *dynamoPendingRequests) Put(ctx context.Context, request models.PendingRequest) error {
+	return r.client.PutItem(ctx, r.table, request)
+}
+
+func (r *dynamoPendingRequests) Get(ctx context.Context, requestID string) (*models.PendingRequest, error) {
+	var request models.PendingRequest
+	if err := r.client.GetItem(ctx, r.table, stringKey("request_id", requestID), &request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (r *dynamoPendingRequests) Fail(ctx context.Context, requestID, status, reason string) error {
+	err := r.client.UpdateItemWithCondition(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(r.table),
+		Key:              stringKey("request_id", requestID),
+		UpdateExpression: aws.String("SET #s = :status, #error = :reason, stream_done = :done"),
+		// Only requests still waiting for an answer can end
+		ConditionExpression: aws.String("#s IN (:pending, :waiting_upload)"),
+		ExpressionAttributeNames: map[string]string{
+			"#s":     "status",
+			"#error": "error",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":         &types.AttributeValueMemberS{Value: status},
+			":reason":         &types.AttributeValueMemberS{Value: reason},
+			":done":           &types.AttributeValueMemberBOOL{Value: true},
+			":pending":        &types.AttributeValueMemberS{Value: "pending"},
+			":waiting_upload": &types.AttributeValueMemberS{Value: "waiting_upload"},
+		},
+	})
+	if err != nil && !errors.Is(err, db.ErrConditionFailed) {
+		return fmt.Errorf("failed to mark request %s as %s: %w", requestID, status, err)
+	}
+	return nil
+}
+
+func (r *dynamoPendingRequests) ListByTunnel(ctx context.Context, tunnelID string, statuses ...string) ([]models.PendingRequest, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.table),
+		IndexName:              aws.String(PendingTunnelIndex),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+	}
+	if len(statuses) > 0 {
+		placeholders := make([]string, len(statuses))
+		for i, status := range statuses {
+			placeholders[i] = fmt.Sprintf(":status%d", i)
+			input.ExpressionAttributeValues[placeholders[i]] = &types.AttributeValueMemberS{Value: status}
+		}
+		input.FilterExpression = aws.String(fmt.Sprintf("#s IN (%s)", strings.Join(placeholders, ", ")))
+		input.ExpressionAttributeNames = map[string]string{"#s": "status"}
+	}
+
+	var requests []models.PendingRequest
+	if err := r.client.QueryAll(ctx, input, &requests); err != nil {
+		return nil, fmt.Errorf("failed to list requests of tunnel %s: %w", tunnelID, err)
+	}
+	return requests, nil
+}
+
+func (r *dynamoPendingRequests) ExpireByTunnel(ctx context.Context, tunnelID, reason string) error {
+	pending, err := r.ListByTunnel(ctx, tunnelID, "pending", "waiting_upload")
+	if err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"error": reason,
+		"code":  models.PendingRequestTunnelDisconnected,
+	})
+
+	for _, req := range pending {
+		err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(r.table),
+			Key:              stringKey("request_id", req.RequestID),
+			UpdateExpression: aws.String("SET #s = :status, #error = :reason, response_status = :code, response_headers = :headers, response_body = :body, stream_done = :done, #ttl = :ttl"),
+			ExpressionAttributeNames: map[string]string{
+				"#s":     "status",
+				"#error": "error",
+				"#ttl":   "ttl",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: models.PendingRequestTunnelDisconnected},
+				":reason": &types.AttributeValueMemberS{Value: reason},
+				":code":   &types.AttributeValueMemberN{Value: "410"},
+				":headers": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+					"Content-Type": &types.AttributeValueMemberS{Value: "application/json"},
+				}},
+				":body": &types.AttributeValueMemberS{Value: string(body)},
+				":done": &types.AttributeValueMemberBOOL{Value: true},
+				":ttl":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to expire pending request %s: %w", req.RequestID, err)
+		}
+	}
+	return nil
+}
+
+func (r *dynamoPendingRequests) Chunks(ctx context.Context, requestID string, total int) (string, error) {
+	rawItem, err := r.client.GetRawItem(ctx, r.table, stringKey("request_id", requestID), false)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	for i := 0; i < total; i++ {
+		av, ok := rawItem[fmt.Sprintf("chunk_%d", i)]
+		if !ok {
+			continue
+		}
+		var chunk string
+		if err := attributevalue.Unmarshal(av, &chunk); err == nil {
+			buf.WriteString(chunk)
+		}
+	}
+	return buf.String(), nil
+}
+
+// StreamChunkRetention is how long stream chunks are kept before DynamoDB TTL
+// removes them; they are never deleted explicitly
+const StreamChunkRetention = time.Hour
+
+type dynamoStreamChunks struct {
+	client *db.DynamoDBClient
+	table  string
+}
+
+// NewStreamChunkRepository returns a StreamChunkRepository backed by the
+// stream chunks table
+func NewStreamChunkRepository(client *db.DynamoDBClient, table string) StreamChunkRepository {
+	return &dynamoStreamChunks{client: client, table: table}
+}
+
+func (r *dynamoStreamChunks) Put(ctx context.Context, chunk models.StreamChunk) error {
+	if chunk.TTL == 0 {
+		chunk.TTL = time.Now().Add(StreamChunkRetention).Unix()
+	}
+	// A chunk another tunnel wrote is never replaced, so a connection cannot
+	// overwrite part of a stream it does not own
+	err := r.client.PutItemWithCondition(ctx, r.table, chunk,
+		"attribute_not_exists(request_id) OR tunnel_id = :tunnel_id",
+		map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: chunk.TunnelID},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to store stream chunk %d of request %s: %w", chunk.Seq, chunk.RequestID, err)
+	}
+	return nil
+}
+
+func (r *dynamoStreamChunks) From(ctx context.Context, requestID, tunnelID string, seq int) ([]models.StreamChunk, error) {
+	var chunks []models.StreamChunk
+	err := r.client.QueryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(r.table),
+		KeyConditionExpression: aws.String("request_id = :request_id AND seq >= :seq"),
+		FilterExpression:       aws.String("tunnel_id = :tunnel_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":request_id": &types.AttributeValueMemberS{Value: requestID},
+			":seq":        &types.AttributeValueMemberN{Value: strconv.Itoa(seq)},
+			":tunnel_id":  &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		// Chunks written just before must be seen by the next poll
+		ConsistentRead: aws.Bool(true),
+	}, &chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream chunks of request %s: %w", requestID, err)
+	}
+	return chunks, nil
+}
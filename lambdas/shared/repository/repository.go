@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+var (
+	// ErrNotFound is returned when the requested record does not exist
+	ErrNotFound = db.ErrItemNotFound
+	// ErrDomainTaken is returned by TunnelRepository.Create when another tunnel
+	// claimed the domain first
+	ErrDomainTaken = errors.New("domain is already taken")
+	// ErrInvalidAPIKey is returned by ClientRepository.FindByAPIKey when no
+	// active client has the key
+	ErrInvalidAPIKey = errors.New("client not found or inactive")
+	// ErrStaleEvent is returned by ClientRepository.SetPlan for an event older
+	// than the one that last set the plan
+	ErrStaleEvent = errors.New("a later event already set the plan")
+)
+
+// TunnelRepository stores tunnels together with the domain records that route
+// to them
+type TunnelRepository interface {
+	Get(ctx context.Context, tunnelID string) (*models.Tunnel, error)
+	ListByClient(ctx context.Context, clientID string) ([]models.Tunnel, error)
+	// FindByConnection resolves the tunnel a WebSocket connection belongs to;
+	// tunnelIDHint (from the authorizer) also finds secondary connections
+	FindByConnection(ctx context.Context, connectionID, tunnelIDHint string) (*models.Tunnel, error)
+	// Create saves a new tunnel and its domain atomically
+	Create(ctx context.Context, tunnel models.Tunnel, domain models.Domain) error
+	// Delete removes a tunnel and its domain atomically
+	Delete(ctx context.Context, tunnel *models.Tunnel) error
+}
+
+// DomainRepository looks up which tunnel serves a domain
+type DomainRepository interface {
+	Get(ctx context.Context, domain string) (*models.Domain, error)
+}
+
+// ReleasedDomainRepository stores the domains of deleted tunnels while they
+// are reserved for their previous owner
+type ReleasedDomainRepository interface {
+	// Release reserves a deleted tunnel's domain for its owner until
+	// record.ReleasedUntil, replacing any earlier reservation
+	Release(ctx context.Context, record models.ReleasedDomain) error
+	// Get returns the domain's reservation, or ErrNotFound if it has none or
+	// the reservation ended
+	Get(ctx context.Context, domain string) (*models.ReleasedDomain, error)
+}
+
+// ReleasedRecord is the reservation of a deleted tunnel's domain for its
+// owner from now until the quarantine ends, or nil when there is nothing to
+// reserve: no quarantine or no domain
+func ReleasedRecord(tunnel *models.Tunnel, quarantine time.Duration, now time.Time) *models.ReleasedDomain {
+	if quarantine <= 0 || tunnel.Domain == "" {
+		return nil
+	}
+	until := now.Add(quarantine)
+	return &models.ReleasedDomain{
+		Domain:        tunnel.Domain,
+		ClientID:      tunnel.ClientID,
+		TunnelID:      tunnel.TunnelID,
+		ReleasedAt:    now,
+		ReleasedUntil: until,
+		TTL:           until.Unix(),
+	}
+}
+
+// ReleaseTunnelDomain reserves a deleted tunnel's domain for its owner for
+// the quarantine period. Delete paths call it before deleting the tunnel so a
+// failure leaves the domain with its owner rather than free for anyone to
+// claim.
+func ReleaseTunnelDomain(ctx context.Context, repo ReleasedDomainRepository, tunnel *models.Tunnel, quarantine time.Duration) error {
+	record := ReleasedRecord(tunnel, quarantine, time.Now())
+	if record == nil {
+		return nil
+	}
+	return repo.Release(ctx, *record)
+}
+
+// ClientRepository stores registered CLI clients
+type ClientRepository interface {
+	Put(ctx context.Context, client models.Client) error
+	// FindByAPIKey returns the active client whose API key hash matches apiKey
+	FindByAPIKey(ctx context.Context, apiKey string) (*models.Client, error)
+	// RecordUse sets the client's last use to now from sourceIP, unless it was
+	// already recorded within models.ClientUseInterval
+	RecordUse(ctx context.Context, clientID, sourceIP string) error
+	// Delete removes the client record; its tunnels are deleted separately
+	Delete(ctx context.Context, clientID string) error
+	// FindByStripeCustomer returns the client linked to a Stripe customer
+	FindByStripeCustomer(ctx context.Context, customerID string) (*models.Client, error)
+	// ListBilled returns every client linked to a Stripe customer
+	ListBilled(ctx context.Context) ([]models.Client, error)
+	// SetStripeCustomer links an existing client to a Stripe customer
+	SetStripeCustomer(ctx context.Context, clientID, customerID string) error
+	// SetPlan assigns an existing client a plan from a Stripe event created at
+	// eventAt (Unix seconds). It returns ErrStaleEvent, leaving the plan alone,
+	// if an event created later already set it.
+	SetPlan(ctx context.Context, clientID, plan string, eventAt int64) error
+	// SetUsageReportedUntil records that the client's usage was reported to
+	// Stripe up to until
+	SetUsageReportedUntil(ctx context.Context, clientID string, until time.Time) error
+}
+
+// PendingRequestRepository stores HTTP requests waiting for a tunnel's response
+type PendingRequestRepository interface {
+	Put(ctx context.Context, request models.PendingRequest) error
+	Get(ctx context.Context, requestID string) (*models.PendingRequest, error)
+	// Chunks concatenates the first total chunk_<n> attributes of a request
+	Chunks(ctx context.Context, requestID string, total int) (string, error)
+	// Fail ends a request that is still pending or waiting for its upload in
+	// the terminal failure status with reason, which http-proxy returns to the
+	// caller. Requests that already ended are left alone.
+	Fail(ctx context.Context, requestID, status, reason string) error
+	// ListByTunnel returns a tunnel's requests, oldest first, only those in
+	// one of statuses when any are given. Only the attributes of the
+	// tunnel_id index are set: request ID, tunnel ID, status, method, path and
+	// created_at.
+	ListByTunnel(ctx context.Context, tunnelID string, statuses ...string) ([]models.PendingRequest, error)
+	// ExpireByTunnel ends every request of the tunnel still pending or
+	// waiting for its upload as tunnel_disconnected with a 410 carrying
+	// reason, so http-proxy answers its caller immediately, and shortens their
+	// TTL
+	ExpireByTunnel(ctx context.Context, tunnelID, reason string) error
+}
+
+// StreamChunkRepository stores the chunks of streamed (SSE) responses
+type StreamChunkRepository interface {
+	// Put stores a chunk, or returns db.ErrConditionFailed if another tunnel
+	// already wrote one with the same sequence number
+	Put(ctx context.Context, chunk models.StreamChunk) error
+	// From returns a request's chunks with a sequence number of at least seq
+	// that tunnelID wrote, in order; there may be gaps where chunks are still
+	// being written
+	From(ctx context.Context, requestID, tunnelID string, seq int) ([]models.StreamChunk, error)
+}
@@ -0,0 +1,113 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// Retention is how long request log entries are kept before DynamoDB TTL removes them
+const Retention = 30 * 24 * time.Hour
+
+// logIDTimeFormat is fixed-width so log IDs sort chronologically within a tunnel
+const logIDTimeFormat = "20060102T150405.000000000Z"
+
+// LogID builds the sort key for a request log entry
+func LogID(t time.Time, requestID string) string {
+	return t.UTC().Format(logIDTimeFormat) + "-" + requestID
+}
+
+// Record stores a request log entry. Recording is skipped when no request log
+// table is configured.
+func Record(ctx context.Context, client *db.DynamoDBClient, table string, entry models.RequestLog) error {
+	if table == "" {
+		return nil
+	}
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if entry.LogID == "" {
+		entry.LogID = LogID(entry.CreatedAt, entry.RequestID)
+	}
+	entry.TTL = entry.CreatedAt.Add(Retention).Unix()
+
+	if err := client.PutItem(ctx, table, entry); err != nil {
+		return fmt.Errorf("failed to record request %s for tunnel %s: %w", entry.RequestID, entry.TunnelID, err)
+	}
+
+	return nil
+}
+
+// Tally counts the requests logged for a tunnel at or after since and how
+// many of them failed with a 5xx status, reading only their status codes
+func Tally(ctx context.Context, client *db.DynamoDBClient, table, tunnelID string, since time.Time) (requests, errors int64, err error) {
+	err = client.QueryPages(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id AND log_id >= :since"),
+		ProjectionExpression:   aws.String("status_code"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+			":since":     &types.AttributeValueMemberS{Value: since.UTC().Format(logIDTimeFormat)},
+		},
+	}, func(items []map[string]types.AttributeValue) bool {
+		for _, item := range items {
+			requests++
+			if status, ok := item["status_code"].(*types.AttributeValueMemberN); ok {
+				if code, _ := strconv.Atoi(status.Value); code >= 500 {
+					errors++
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return requests, errors, nil
+}
+
+// meteredReader counts the bytes read through it and reports the total once the
+// underlying reader is exhausted, fails or is closed
+type meteredReader struct {
+	r    io.Reader
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+// NewMeteredReader wraps r so done is called with the number of bytes read once
+// r returns an error (including io.EOF) or the reader is closed. The Lambda
+// runtime closes a streamed response body when the caller goes away, so a
+// body that is never read to the end is still reported.
+func NewMeteredReader(r io.Reader, done func(n int64)) io.ReadCloser {
+	return &meteredReader{r: r, done: done}
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if err != nil {
+		m.once.Do(func() { m.done(m.n) })
+	}
+	return n, err
+}
+
+// Close reports the bytes read so far, if not reported yet, and closes the
+// underlying reader
+func (m *meteredReader) Close() error {
+	m.once.Do(func() { m.done(m.n) })
+	if closer, ok := m.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
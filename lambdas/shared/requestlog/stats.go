@@ -0,0 +1,183 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+)
+
+// BucketPeriod is how much traffic one stats bucket counts
+const BucketPeriod = time.Hour
+
+// LatencyBounds are the upper bounds, in milliseconds, of the latency
+// histogram each bucket keeps; slower requests go in one more bucket past the
+// last bound
+var LatencyBounds = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// Bucket is what a tunnel's requests added up to in one BucketPeriod
+type Bucket struct {
+	Hour         time.Time // Start of the bucket
+	Requests     int64
+	Errors       int64 // 5xx responses
+	ClientErrors int64 // 4xx responses
+	BytesIn      int64
+	BytesOut     int64
+	Latency      []int64 // Requests per LatencyBounds bucket, the last one past the last bound
+}
+
+// Add adds another bucket's counts to b
+func (b *Bucket) Add(other Bucket) {
+	b.Requests += other.Requests
+	b.Errors += other.Errors
+	b.ClientErrors += other.ClientErrors
+	b.BytesIn += other.BytesIn
+	b.BytesOut += other.BytesOut
+	if b.Latency == nil {
+		b.Latency = make([]int64, len(LatencyBounds)+1)
+	}
+	for i, n := range other.Latency {
+		b.Latency[i] += n
+	}
+}
+
+// Percentile estimates the nearest-rank percentile of the request durations
+// as the upper bound of the histogram bucket it falls in; durations past the
+// last bound are reported as that bound
+func (b *Bucket) Percentile(p int) int64 {
+	if b.Requests == 0 {
+		return 0
+	}
+	rank := (int64(p)*b.Requests + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range b.Latency {
+		seen += n
+		if seen >= rank {
+			return LatencyBounds[min(i, len(LatencyBounds)-1)]
+		}
+	}
+	return LatencyBounds[len(LatencyBounds)-1]
+}
+
+// latencyAttribute names the histogram counter a duration is added to
+func latencyAttribute(durationMs int64) string {
+	i := 0
+	for i < len(LatencyBounds) && durationMs > LatencyBounds[i] {
+		i++
+	}
+	return "latency_" + strconv.Itoa(i)
+}
+
+// Count adds a logged request to its tunnel's stats bucket. Counting is
+// skipped when no stats table is configured.
+func Count(ctx context.Context, client *db.DynamoDBClient, table string, entry models.RequestLog) error {
+	if table == "" {
+		return nil
+	}
+
+	hour := entry.CreatedAt.Truncate(BucketPeriod)
+	// Placeholders keep reserved words like "hour" and "ttl" usable
+	names := map[string]string{
+		"#requests":  "requests",
+		"#bytes_in":  "bytes_in",
+		"#bytes_out": "bytes_out",
+		"#latency":   latencyAttribute(entry.DurationMs),
+		"#ttl":       "ttl",
+	}
+	update := "ADD #requests :one, #bytes_in :bytes_in, #bytes_out :bytes_out, #latency :one"
+	switch {
+	case entry.StatusCode >= 500:
+		update += ", #status_class :one"
+		names["#status_class"] = "errors"
+	case entry.StatusCode >= 400:
+		update += ", #status_class :one"
+		names["#status_class"] = "client_errors"
+	}
+	update += " SET #ttl = :ttl"
+
+	err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: entry.TunnelID},
+			"hour":      &types.AttributeValueMemberN{Value: strconv.FormatInt(hour.Unix(), 10)},
+		},
+		UpdateExpression:         aws.String(update),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":       &types.AttributeValueMemberN{Value: "1"},
+			":bytes_in":  &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.BytesIn, 10)},
+			":bytes_out": &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.BytesOut, 10)},
+			":ttl":       &types.AttributeValueMemberN{Value: strconv.FormatInt(hour.Add(Retention).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to count request %s for tunnel %s: %w", entry.RequestID, entry.TunnelID, err)
+	}
+	return nil
+}
+
+// Buckets calls fn with each of a tunnel's stats buckets that start in
+// [from, to), oldest first, reading them a page at a time
+func Buckets(ctx context.Context, client *db.DynamoDBClient, table, tunnelID string, from, to time.Time, fn func(Bucket)) error {
+	return client.QueryPages(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("tunnel_id = :tunnel_id AND #hour BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{
+			"#hour": "hour",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+			":from":      &types.AttributeValueMemberN{Value: strconv.FormatInt(from.Truncate(BucketPeriod).Unix(), 10)},
+			":to":        &types.AttributeValueMemberN{Value: strconv.FormatInt(to.Unix()-1, 10)},
+		},
+	}, func(items []map[string]types.AttributeValue) bool {
+		for _, item := range items {
+			fn(bucketOf(item))
+		}
+		return true
+	})
+}
+
+// Sum adds up a tunnel's stats buckets from the one holding since to now
+func Sum(ctx context.Context, client *db.DynamoDBClient, table, tunnelID string, since time.Time) (Bucket, error) {
+	total := Bucket{Hour: since.Truncate(BucketPeriod), Latency: make([]int64, len(LatencyBounds)+1)}
+	err := Buckets(ctx, client, table, tunnelID, since, time.Now().Add(BucketPeriod), func(b Bucket) {
+		total.Add(b)
+	})
+	if err != nil {
+		return Bucket{}, err
+	}
+	return total, nil
+}
+
+func bucketOf(item map[string]types.AttributeValue) Bucket {
+	number := func(name string) int64 {
+		if av, ok := item[name].(*types.AttributeValueMemberN); ok {
+			n, _ := strconv.ParseInt(av.Value, 10, 64)
+			return n
+		}
+		return 0
+	}
+	b := Bucket{
+		Hour:         time.Unix(number("hour"), 0).UTC(),
+		Requests:     number("requests"),
+		Errors:       number("errors"),
+		ClientErrors: number("client_errors"),
+		BytesIn:      number("bytes_in"),
+		BytesOut:     number("bytes_out"),
+		Latency:      make([]int64, len(LatencyBounds)+1),
+	}
+	for i := range b.Latency {
+		b.Latency[i] = number("latency_" + strconv.Itoa(i))
+	}
+	return b
+}
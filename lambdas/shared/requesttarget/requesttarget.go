@@ -0,0 +1,81 @@
+// Package requesttarget carries a request's path and query string from the
+// edge to the local service as the caller sent them. Signed URLs and many
+// routers tell %2F from /, + from %20 and the order of repeated parameters
+// apart, so a target is never decoded and re-encoded on the way: http-proxy
+// and the CLI only escape the bytes that cannot appear on a request line.
+package requesttarget
+
+import "strings"
+
+const upperhex = "0123456789ABCDEF"
+
+// Join builds the request target for path and raw query, escaping what must
+// be escaped in each. An empty path is "/".
+func Join(path, rawQuery string) string {
+	if path == "" {
+		path = "/"
+	}
+	target := escape(path, true)
+	if rawQuery != "" {
+		target += "?" + escape(rawQuery, false)
+	}
+	return target
+}
+
+// Split separates a target into its path and raw query, without the '?'
+func Split(target string) (path, rawQuery string) {
+	path, rawQuery, _ = strings.Cut(target, "?")
+	return path, rawQuery
+}
+
+// FromDecoded rebuilds a path from one API Gateway has already decoded, such
+// as a {proxy+} path parameter, for when the raw path is not available. Each
+// segment is escaped again; an encoded slash cannot be told from a real one
+// and comes back as a slash.
+func FromDecoded(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '%' || c == '?' || c == '#' || mustEscape(c) {
+			writeEscaped(&b, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// escape percent-encodes the bytes of s that cannot appear in a request
+// target: controls, space, '#', non-ASCII and, in a path, '?'. Existing
+// escapes and everything else are kept as they are; a '%' not followed by
+// two hex digits is encoded as %25.
+func escape(s string, inPath bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(c)
+		case c == '%', c == '#', c == '?' && inPath, mustEscape(c):
+			writeEscaped(&b, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// mustEscape reports whether c never appears unescaped in a request target
+func mustEscape(c byte) bool {
+	return c <= ' ' || c >= 0x7f
+}
+
+func writeEscaped(b *strings.Builder, c byte) {
+	b.WriteByte('%')
+	b.WriteByte(upperhex[c>>4])
+	b.WriteByte(upperhex[c&15])
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
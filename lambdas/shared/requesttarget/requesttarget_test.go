@@ -0,0 +1,109 @@
+package requesttarget
+
+import "testing"
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		rawQuery string
+		want     string
+	}{
+		{"empty path", "", "", "/"},
+		{"root", "/", "", "/"},
+		{"encoded slash", "/files/a%2Fb", "", "/files/a%2Fb"},
+		{"encoded slash lowercase", "/files/a%2fb", "", "/files/a%2fb"},
+		{"plus in path", "/c++/a+b", "", "/c++/a+b"},
+		{"plus and %20 in query", "/search", "q=a+b&r=a%20b", "/search?q=a+b&r=a%20b"},
+		{"encoded plus in query", "/search", "q=1%2B1", "/search?q=1%2B1"},
+		{"repeated params keep order", "/p", "b=2&a=1&b=1", "/p?b=2&a=1&b=1"},
+		{"empty params", "/p", "a=&b&=c&&", "/p?a=&b&=c&&"},
+		{"signed url", "/obj", "X-Amz-Credential=AK%2F20240101%2Fus-east-1&X-Amz-Signature=ab%3D", "/obj?X-Amz-Credential=AK%2F20240101%2Fus-east-1&X-Amz-Signature=ab%3D"},
+		{"question mark in query", "/p", "next=/a?b=c", "/p?next=/a?b=c"},
+		{"question mark in path", "/a?b", "", "/a%3Fb"},
+		{"hash", "/a#b", "q=#", "/a%23b?q=%23"},
+		{"space", "/a b", "q=a b", "/a%20b?q=a%20b"},
+		{"control byte", "/a\tb", "", "/a%09b"},
+		{"non-ASCII", "/café", "q=naïve", "/caf%C3%A9?q=na%C3%AFve"},
+		{"already encoded non-ASCII", "/caf%C3%A9", "", "/caf%C3%A9"},
+		{"double slash", "//double//slash", "", "//double//slash"},
+		{"stray percent", "/100%", "p=%zz&q=%4", "/100%25?p=%25zz&q=%254"},
+		{"sub-delims kept", "/{id}|x^y`z;v=1,2@3:4!$&'()*", "", "/{id}|x^y`z;v=1,2@3:4!$&'()*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Join(tt.path, tt.rawQuery); got != tt.want {
+				t.Errorf("Join(%q, %q) = %q, want %q", tt.path, tt.rawQuery, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		target    string
+		wantPath  string
+		wantQuery string
+	}{
+		{"/", "/", ""},
+		{"/a%2Fb", "/a%2Fb", ""},
+		{"/a?", "/a", ""},
+		{"/a?b=1&b=2", "/a", "b=1&b=2"},
+		{"/a?next=/b?c", "/a", "next=/b?c"},
+		{"//x?y", "//x", "y"},
+	}
+	for _, tt := range tests {
+		path, rawQuery := Split(tt.target)
+		if path != tt.wantPath || rawQuery != tt.wantQuery {
+			t.Errorf("Split(%q) = %q, %q, want %q, %q", tt.target, path, rawQuery, tt.wantPath, tt.wantQuery)
+		}
+	}
+}
+
+// TestRoundTrip checks that a target built from an event's RawPath and
+// RawQueryString splits back into the same bytes when they needed no escaping
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		rawPath        string
+		rawQueryString string
+	}{
+		{"/", ""},
+		{"/api/v1/items", "page=2&page=3"},
+		{"/files/a%2Fb%2Fc", "sig=ab%2Bcd%3D&exp=1"},
+		{"/q", "a=1+2&b=%20&c=&d"},
+		{"//proxy//path", "x=%E2%9C%93"},
+		{"/caf%C3%A9", "q=%25"},
+	}
+	for _, tt := range tests {
+		target := Join(tt.rawPath, tt.rawQueryString)
+		path, rawQuery := Split(target)
+		if path != tt.rawPath || rawQuery != tt.rawQueryString {
+			t.Errorf("Join(%q, %q) = %q splits into %q, %q", tt.rawPath, tt.rawQueryString, target, path, rawQuery)
+		}
+		if again := Join(path, rawQuery); again != target {
+			t.Errorf("Join is not idempotent: %q became %q", target, again)
+		}
+	}
+}
+
+func TestFromDecoded(t *testing.T) {
+	tests := []struct {
+		decoded string
+		want    string
+	}{
+		{"", ""},
+		{"api/items", "api/items"},
+		{"a b/c", "a%20b/c"},
+		{"100%", "100%25"},
+		{"100%41", "100%2541"},
+		{"what?", "what%3F"},
+		{"a#b", "a%23b"},
+		{"café", "caf%C3%A9"},
+		{"a+b", "a+b"},
+	}
+	for _, tt := range tests {
+		if got := FromDecoded(tt.decoded); got != tt.want {
+			t.Errorf("FromDecoded(%q) = %q, want %q", tt.decoded, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package warmup handles the scheduled warm-up pings that keep http-proxy's
+// and tunnel-proxy's execution environments initialized between requests,
+// and counts the cold starts real requests still pay for.
+//
+// A warm-up ping is the EventBridge constant input {"warmer": true}. The
+// function prepares its clients and returns without touching any tunnel.
+package warmup
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+)
+
+// Lambda initialization types, from AWS_LAMBDA_INITIALIZATION_TYPE
+const (
+	InitOnDemand    = "on-demand"
+	InitProvisioned = "provisioned-concurrency"
+)
+
+// Event is the payload of a warm-up ping
+type Event struct {
+	Warmer bool `json:"warmer"`
+}
+
+// Result is what a warm-up ping returns
+type Result struct {
+	Warmed    bool   `json:"warmed"`
+	ColdStart bool   `json:"cold_start"` // The ping, not a request, paid for initializing the environment
+	InitType  string `json:"init_type"`
+}
+
+// invoked is set by the environment's first invocation
+var invoked atomic.Bool
+
+// Is reports whether payload is a warm-up ping
+func Is(payload []byte) bool {
+	var event Event
+	return json.Unmarshal(payload, &event) == nil && event.Warmer
+}
+
+// InitType is how Lambda initialized this execution environment: on demand,
+// or ahead of time for provisioned concurrency
+func InitType() string {
+	if t := os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE"); t != "" {
+		return t
+	}
+	return InitOnDemand
+}
+
+// firstInvocation reports whether this is the environment's first invocation
+func firstInvocation() bool {
+	return !invoked.Swap(true)
+}
+
+// Handle answers a warm-up ping, running init to create the clients that
+// requests would otherwise create on their first invocation
+func Handle(ctx context.Context, init func(context.Context) error) (Result, error) {
+	result := Result{ColdStart: firstInvocation(), InitType: InitType()}
+	if err := init(ctx); err != nil {
+		log.Printf("warmup: %v", err)
+		return result, nil
+	}
+	result.Warmed = true
+	return result, nil
+}
+
+// Observe counts a request invocation, emitting the ColdStart metric when the
+// request landed on a fresh on-demand environment. Environments initialized
+// for provisioned concurrency were ready before the request, so they are not
+// counted.
+func Observe() {
+	if !firstInvocation() || InitType() != InitOnDemand {
+		return
+	}
+	db.EmitGauge("ColdStart", 1, "Count")
+}
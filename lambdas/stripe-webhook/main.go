@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/billing"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable  string
+	webhookSecret string
+	dbClient      *db.DynamoDBClient
+	clientRepo    repository.ClientRepository
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+
+	if clientsTable == "" {
+		panic("CLIENTS_TABLE environment variable is required")
+	}
+}
+
+// handler receives Stripe webhook deliveries. A completed checkout links the
+// client named by its client_reference_id to the paying Stripe customer; the
+// customer's subscription events then set the client's plan. Any non-2xx
+// answer makes Stripe retry the delivery, which is relied on for database
+// errors and for subscription events that arrive before their checkout.
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	if webhookSecret == "" {
+		return errorResponse(404, "Billing is not enabled on this server")
+	}
+
+	payload := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return errorResponse(400, "Invalid body encoding")
+		}
+		payload = decoded
+	}
+
+	signature := request.Headers[strings.ToLower(billing.SignatureHeader)]
+	if err := billing.VerifySignature(payload, signature, webhookSecret, time.Now()); err != nil {
+		return errorResponse(400, err.Error())
+	}
+
+	var event billing.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return errorResponse(400, "Invalid event")
+	}
+
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+	}
+
+	var err error
+	switch event.Type {
+	case billing.EventCheckoutCompleted:
+		err = linkCustomer(ctx, event)
+	case billing.EventSubscriptionCreated, billing.EventSubscriptionUpdated, billing.EventSubscriptionDeleted:
+		err = assignPlan(ctx, event)
+	default:
+		log.Printf("stripe-webhook: ignoring event %s of type %s", event.ID, event.Type)
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		return errorResponse(404, err.Error())
+	}
+	if err != nil {
+		return errorResponse(500, err.Error())
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: `{"received":true}`,
+	}, nil
+}
+
+// linkCustomer links the client that started a checkout to its customer
+func linkCustomer(ctx context.Context, event billing.Event) error {
+	var session billing.CheckoutSession
+	if err := json.Unmarshal(event.Data.Object, &session); err != nil {
+		return fmt.Errorf("invalid checkout session in event %s: %w", event.ID, err)
+	}
+	if session.ClientReferenceID == "" || session.Customer == "" {
+		log.Printf("stripe-webhook: checkout in event %s has no client reference or customer; ignoring", event.ID)
+		return nil
+	}
+
+	if err := clientRepo.SetStripeCustomer(ctx, session.ClientReferenceID, session.Customer); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			// Retrying will not bring a deleted client back
+			log.Printf("stripe-webhook: client %s of customer %s no longer exists", session.ClientReferenceID, session.Customer)
+			return nil
+		}
+		return err
+	}
+	log.Printf("stripe-webhook: linked client %s to customer %s", session.ClientReferenceID, session.Customer)
+	return nil
+}
+
+// assignPlan gives the customer's client the plan its subscription grants
+func assignPlan(ctx context.Context, event billing.Event) error {
+	var subscription billing.Subscription
+	if err := json.Unmarshal(event.Data.Object, &subscription); err != nil {
+		return fmt.Errorf("invalid subscription in event %s: %w", event.ID, err)
+	}
+	plan, ok := subscription.Plan()
+	if !ok {
+		log.Printf("stripe-webhook: subscription %s is %s; keeping the current plan", subscription.ID, subscription.Status)
+		return nil
+	}
+
+	client, err := clientRepo.FindByStripeCustomer(ctx, subscription.Customer)
+	if errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("no client is linked to customer %s yet: %w", subscription.Customer, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find client of customer %s: %w", subscription.Customer, err)
+	}
+	// The event time is recorded even when the plan stays the same, so an
+	// older event arriving after it cannot change the plan back
+	if err := clientRepo.SetPlan(ctx, client.ClientID, plan, event.Created); err != nil {
+		if errors.Is(err, repository.ErrStaleEvent) {
+			log.Printf("stripe-webhook: ignoring event %s for client %s; a later event already set the plan", event.ID, client.ClientID)
+			return nil
+		}
+		if errors.Is(err, repository.ErrNotFound) {
+			// Retrying will not bring a deleted client back
+			log.Printf("stripe-webhook: client %s of customer %s no longer exists", client.ClientID, subscription.Customer)
+			return nil
+		}
+		return err
+	}
+	if client.Plan == plan {
+		return nil
+	}
+	log.Printf("stripe-webhook: client %s moved from plan %q to %q (subscription %s %s)", client.ClientID, client.Plan, plan, subscription.ID, subscription.Status)
+	return nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": problem.ContentType,
+		},
+		Body: string(problem.Body(statusCode, message)),
+	}, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
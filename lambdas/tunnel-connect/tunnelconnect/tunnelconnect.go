@@ -0,0 +1,448 @@
+// Package tunnelconnect is the tunnel-connect Lambda, which handles $connect
+// on the WebSocket API and claims the tunnel for the new connection per its
+// connection policy. The Lambda's main only calls Init and starts Handler;
+// the end-to-end tests run it in-process.
+package tunnelconnect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/env"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/regions"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+)
+
+var (
+	clientsTable      string
+	tunnelsTable      string
+	eventsTable       string
+	websocketEndpoint string
+	dbClient          *db.DynamoDBClient
+	apigwClient       *apigatewaymanagementapi.Client
+
+	// maxConnectionsPerClient caps the CLIs a client has connected across
+	// its tunnels, 0 meaning no cap
+	maxConnectionsPerClient int
+)
+
+// errNotOwner aborts the tunnel update when the tunnel belongs to another client
+var errNotOwner = errors.New("tunnel belongs to another client")
+
+// Init reads the configuration from the environment. It panics when a required
+// variable is missing, failing the Lambda's init phase, and must be called
+// before Handler.
+func Init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+	if tunnelsTable == "" {
+		panic("TUNNELS_TABLE environment variable is required")
+	}
+	if websocketEndpoint == "" {
+		panic("WEBSOCKET_ENDPOINT environment variable is required")
+	}
+	maxConnectionsPerClient = env.Count("MAX_CONNECTIONS_PER_CLIENT", 0)
+}
+
+// Handler claims the tunnel named by the $connect request for its connection
+func Handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+	}
+
+	// Get client ID from authorizer context
+	var clientID string
+	if authContext, ok := request.RequestContext.Authorizer.(map[string]interface{}); ok {
+		if cid, exists := authContext["clientId"]; exists {
+			clientID, _ = cid.(string)
+		}
+	}
+	if clientID == "" {
+		return errorResponse(401, "Client ID not found in context")
+	}
+
+	// Get tunnel ID from query parameters
+	tunnelID := request.QueryStringParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	// Get connection ID
+	connectionID := request.RequestContext.ConnectionID
+
+	// A CLI renewing its connection ahead of API Gateway's limits names the
+	// connection it replaces, which announced it with reconnect_soon
+	replaces := request.QueryStringParameters["replaces"]
+
+	// CLIs that let the user choose what happens when the tunnel is connected
+	// elsewhere say so; older ones leave it to the connection policy
+	onConflict := request.QueryStringParameters["on_conflict"]
+	if onConflict != "" && !models.ValidConnectConflict(onConflict) {
+		return errorResponse(400, "on_conflict must be one of ask, takeover, attach")
+	}
+
+	if apigwClient == nil {
+		cfg, err := dbClient.GetAWSConfig(ctx)
+		if err != nil {
+			return errorResponse(500, "Failed to get AWS config")
+		}
+		apigwClient = apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+			o.BaseEndpoint = aws.String(websocketEndpoint)
+		})
+	}
+
+	// Remember which machine holds the tunnel so support can tell clients apart
+	info := connectionInfo(request)
+	infoAV, err := attributevalue.Marshal(info)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal connection info")
+	}
+
+	// Enforce the client's connection limit. It is checked before the claim,
+	// so connects racing each other can overshoot it slightly.
+	if maxConnectionsPerClient > 0 {
+		connected, err := connectedCLIs(ctx, clientID, tunnelID, replaces)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to check connection limit: %v", err))
+		}
+		if connected >= maxConnectionsPerClient {
+			message := fmt.Sprintf("Connection limit reached: %d of %d CLIs connected; stop one first", connected, maxConnectionsPerClient)
+			return rejectConnection(ctx, request, tunnelID, clientID, info, "client connection limit reached",
+				problem.New(429, problem.CodeConnectionLimitExceeded, message).WithUsage(connected, maxConnectionsPerClient))
+		}
+	}
+
+	// Claim the tunnel. The update is versioned, so a connect or disconnect that
+	// lands in between makes UpdateTunnel re-read the tunnel and decide again.
+	var previousConnectionID string
+	var previousConnections []string
+	var conflict *problem.Connection
+	policy := ""
+	rejected := false
+	refused := false
+	handover := false
+	_, err = dbClient.UpdateTunnel(ctx, tunnelsTable, tunnelID, func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		if tunnel.ClientID != clientID {
+			return nil, errNotOwner
+		}
+
+		// A handover replaces the announced connection whatever the policy
+		handover = replaces != "" && replaces == tunnel.ReconnectingConnectionID && tunnel.HasConnection(replaces)
+		if handover {
+			return handoverUpdate(tunnel, connectionID, replaces, infoAV, info.ConnectedAt), nil
+		}
+
+		// Apply the tunnel's duplicate-connection policy
+		previousConnectionID = tunnel.ConnectionID
+		if previousConnectionID == connectionID {
+			previousConnectionID = ""
+		}
+		previousConnections = tunnel.Connections()
+
+		// What the CLI asked for on a conflict overrides the policy
+		policy = tunnel.Policy()
+		conflict = nil
+		refused = false
+		switch onConflict {
+		case models.ConnectConflictAsk:
+			if previousConnectionID != "" && connectionAlive(ctx, previousConnectionID) {
+				conflict = connectionConflict(tunnel)
+				return nil, nil
+			}
+		case models.ConnectConflictTakeover:
+			policy = models.ConnectionPolicyTakeover
+		case models.ConnectConflictAttach:
+			if policy != models.ConnectionPolicyMulti {
+				rejected = true
+				return nil, nil
+			}
+		}
+
+		// The home region follows the connection, since only this region's API can
+		// post to it; http-proxy in other regions forwards requests here. The
+		// negotiated protocol is cleared until the new CLI sends its hello.
+		updateInput := &dynamodb.UpdateItemInput{
+			UpdateExpression: aws.String("SET connection_id = :connection_id, #status = :status, updated_at = :updated_at, connection_info = :connection_info, last_ping_at = :last_ping_at, #region = :region REMOVE connection_ids, protocol_version, capabilities"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+				"#region": "region",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":connection_id":   &types.AttributeValueMemberS{Value: connectionID},
+				":status":          &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+				":updated_at":      &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+				":connection_info": infoAV,
+				":region":          &types.AttributeValueMemberS{Value: regions.Current()},
+				":last_ping_at":    &types.AttributeValueMemberS{Value: info.ConnectedAt.UTC().Format(time.RFC3339)},
+			},
+		}
+
+		switch policy {
+		case models.ConnectionPolicyReject:
+			// The handshake still succeeds: only an open connection can be
+			// told why, so tunnel-proxy answers its first message with
+			// connection_rejected and closes it
+			if previousConnectionID != "" && connectionAlive(ctx, previousConnectionID) {
+				refused = true
+				return &dynamodb.UpdateItemInput{
+					UpdateExpression: aws.String("ADD rejected_connection_ids :rejected"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":rejected": &types.AttributeValueMemberSS{Value: []string{connectionID}},
+					},
+				}, nil
+			}
+		case models.ConnectionPolicyMulti:
+			// Keep every connection, including a primary that connected before
+			// the tunnel switched to multi; the newest becomes the primary
+			// connection_id
+			connections := []string{connectionID}
+			if previousConnectionID != "" {
+				connections = append(connections, previousConnectionID)
+			}
+			updateInput.UpdateExpression = aws.String("SET connection_id = :connection_id, #status = :status, updated_at = :updated_at, connection_info = :connection_info, last_ping_at = :last_ping_at, #region = :region REMOVE protocol_version, capabilities ADD connection_ids :connection_ids")
+			updateInput.ExpressionAttributeValues[":connection_ids"] = &types.AttributeValueMemberSS{Value: connections}
+		}
+
+		return updateInput, nil
+	})
+	switch {
+	case errors.Is(err, db.ErrItemNotFound):
+		return problem.ProxyErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	case errors.Is(err, errNotOwner):
+		return errorResponse(403, "Unauthorized to connect to this tunnel")
+	case errors.Is(err, db.ErrVersionConflict):
+		return problem.ProxyErrorResponse(409, problem.CodeConcurrentUpdate, "Tunnel is being modified concurrently, retry")
+	case err != nil:
+		return errorResponse(500, fmt.Sprintf("Failed to update tunnel: %v", err))
+	}
+
+	if conflict != nil {
+		return rejectConnection(ctx, request, tunnelID, clientID, info, "tunnel is connected elsewhere",
+			problem.New(409, problem.CodeTunnelConnected, "Tunnel is already connected from another machine").WithConnection(*conflict))
+	}
+	if rejected {
+		return rejectConnection(ctx, request, tunnelID, clientID, info, "attach needs the multi connection policy",
+			problem.New(409, problem.CodeTunnelInUse, fmt.Sprintf("Tunnel cannot take another connection (connection policy: %s)", policy)))
+	}
+	if refused {
+		recordRejection(ctx, request, tunnelID, clientID, info, "tunnel already has an active connection")
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Body:       `{"message": "Connected, pending rejection"}`,
+		}, nil
+	}
+
+	// Under takeover, tell the old CLIs they were replaced and close their
+	// connections; a takeover the CLI asked for may replace several under multi
+	if policy == models.ConnectionPolicyTakeover && previousConnectionID != "" && !handover {
+		for _, id := range previousConnections {
+			if id != connectionID {
+				replaceConnection(ctx, id, tunnelID)
+			}
+		}
+	}
+
+	// Record where the connection came from in the tunnel's event history
+	event := models.TunnelEvent{
+		TunnelID:     tunnelID,
+		Type:         models.TunnelEventConnected,
+		ClientID:     clientID,
+		ConnectionID: connectionID,
+		SourceIP:     info.SourceIP,
+		UserAgent:    info.UserAgent,
+		CLIVersion:   info.CLIVersion,
+		Platform:     info.Platform,
+	}
+	if handover {
+		event.Reason = "replaces connection " + replaces
+	}
+	if err := history.Record(ctx, dbClient, eventsTable, event); err != nil {
+		log.Printf("tunnel-connect: %v", err)
+	}
+
+	// Track the client's last use; connection tokens count as uses of the key
+	// they were minted with
+	if clientsTable != "" {
+		clientRepo := repository.NewClientRepository(dbClient, clientsTable)
+		if err := clientRepo.RecordUse(ctx, clientID, info.SourceIP); err != nil {
+			log.Printf("tunnel-connect: %v", err)
+		}
+	}
+
+	// Return success response
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       `{"message": "Connected successfully"}`,
+	}, nil
+}
+
+// handoverUpdate moves the tunnel from the connection its CLI is replacing to
+// the new one. The replaced connection stops getting requests but keeps
+// draining: tunnel-proxy accepts its messages until it closes. The negotiated
+// protocol is kept, since the same CLI is on the other end.
+func handoverUpdate(tunnel *models.Tunnel, connectionID, replaces string, infoAV types.AttributeValue, connectedAt time.Time) *dynamodb.UpdateItemInput {
+	input := &dynamodb.UpdateItemInput{
+		UpdateExpression: aws.String("SET connection_id = :connection_id, #status = :status, updated_at = :updated_at, connection_info = :connection_info, last_ping_at = :last_ping_at, #region = :region, draining_connection_id = :draining REMOVE connection_ids, reconnecting_connection_id"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+			"#region": "region",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":connection_id":   &types.AttributeValueMemberS{Value: connectionID},
+			":status":          &types.AttributeValueMemberS{Value: models.TunnelStatusActive},
+			":updated_at":      &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			":connection_info": infoAV,
+			":region":          &types.AttributeValueMemberS{Value: regions.Current()},
+			":last_ping_at":    &types.AttributeValueMemberS{Value: connectedAt.UTC().Format(time.RFC3339)},
+			":draining":        &types.AttributeValueMemberS{Value: replaces},
+		},
+	}
+
+	// Under the multi policy the other CLIs' connections stay
+	if tunnel.Policy() == models.ConnectionPolicyMulti {
+		connections := []string{connectionID}
+		for _, id := range tunnel.Connections() {
+			if id != replaces && id != connectionID {
+				connections = append(connections, id)
+			}
+		}
+		input.UpdateExpression = aws.String("SET connection_id = :connection_id, #status = :status, updated_at = :updated_at, connection_info = :connection_info, last_ping_at = :last_ping_at, #region = :region, draining_connection_id = :draining, connection_ids = :connection_ids REMOVE reconnecting_connection_id")
+		input.ExpressionAttributeValues[":connection_ids"] = &types.AttributeValueMemberSS{Value: connections}
+	}
+
+	return input
+}
+
+// connectionConflict describes the CLI holding the tunnel to one that asked to
+// choose what to do about it
+func connectionConflict(tunnel *models.Tunnel) *problem.Connection {
+	c := &problem.Connection{
+		Connections:      len(tunnel.Connections()),
+		ConnectionPolicy: tunnel.Policy(),
+		CanAttach:        tunnel.Policy() == models.ConnectionPolicyMulti,
+	}
+	if info := tunnel.ConnectionInfo; info != nil {
+		c.SourceIP = info.SourceIP
+		c.Platform = info.Platform
+		c.CLIVersion = info.CLIVersion
+		connectedAt := info.ConnectedAt
+		c.ConnectedAt = &connectedAt
+	}
+	return c
+}
+
+// connectionInfo collects what the CLI reported about itself on $connect
+func connectionInfo(request events.APIGatewayWebsocketProxyRequest) *models.ConnectionInfo {
+	return &models.ConnectionInfo{
+		CLIVersion:  request.QueryStringParameters["cli_version"],
+		Platform:    request.QueryStringParameters["platform"],
+		SourceIP:    request.RequestContext.Identity.SourceIP,
+		UserAgent:   request.RequestContext.Identity.UserAgent,
+		ConnectedAt: time.Now(),
+	}
+}
+
+// connectionAlive reports whether API Gateway still knows about a connection.
+// Errors other than GoneException count as alive so reject stays conservative.
+func connectionAlive(ctx context.Context, connectionID string) bool {
+	_, err := apigwClient.GetConnection(ctx, &apigatewaymanagementapi.GetConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	})
+	var gone *apigwtypes.GoneException
+	return !errors.As(err, &gone)
+}
+
+// connectedCLIs counts the connections of the client's active tunnels that
+// stay open when a CLI connects to tunnelID: unless the tunnel keeps multiple
+// connections, its own is replaced or the newcomer is rejected anyway, and
+// the connection a renewing CLI replaces is on its way out
+func connectedCLIs(ctx context.Context, clientID, tunnelID, replaces string) (int, error) {
+	tunnels, err := repository.NewTunnelRepository(dbClient, tunnelsTable, "").ListByClient(ctx, clientID)
+	if err != nil {
+		return 0, err
+	}
+	connected := 0
+	for _, tunnel := range tunnels {
+		if tunnel.Status != models.TunnelStatusActive {
+			continue
+		}
+		if tunnel.TunnelID == tunnelID && tunnel.Policy() != models.ConnectionPolicyMulti {
+			continue
+		}
+		for _, id := range tunnel.Connections() {
+			if id != replaces {
+				connected++
+			}
+		}
+	}
+	return connected, nil
+}
+
+// rejectConnection refuses the WebSocket handshake with p, recording why in
+// the tunnel's event history
+func rejectConnection(ctx context.Context, request events.APIGatewayWebsocketProxyRequest, tunnelID, clientID string, info *models.ConnectionInfo, reason string, p problem.Problem) (events.APIGatewayProxyResponse, error) {
+	recordRejection(ctx, request, tunnelID, clientID, info, reason)
+	return problem.ProxyResponse(p)
+}
+
+// recordRejection records a refused connection in the tunnel's event history
+func recordRejection(ctx context.Context, request events.APIGatewayWebsocketProxyRequest, tunnelID, clientID string, info *models.ConnectionInfo, reason string) {
+	if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+		TunnelID:     tunnelID,
+		Type:         models.TunnelEventRejected,
+		ClientID:     clientID,
+		ConnectionID: request.RequestContext.ConnectionID,
+		SourceIP:     info.SourceIP,
+		UserAgent:    info.UserAgent,
+		CLIVersion:   info.CLIVersion,
+		Platform:     info.Platform,
+		Reason:       reason,
+	}); err != nil {
+		log.Printf("tunnel-connect: %v", err)
+	}
+}
+
+// replaceConnection notifies a superseded connection and closes it. Failures are
+// logged only: the connection may already be gone.
+func replaceConnection(ctx context.Context, connectionID, tunnelID string) {
+	payload, _ := models.EncodeMessage(models.ActionConnectionReplaced, &models.TunnelNoticePayload{TunnelID: tunnelID})
+
+	if _, err := apigwClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         payload,
+	}); err != nil {
+		log.Printf("tunnel-connect: failed to notify replaced connection %s: %v", connectionID, err)
+	}
+
+	if _, err := apigwClient.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	}); err != nil {
+		log.Printf("tunnel-connect: failed to close replaced connection %s: %v", connectionID, err)
+	}
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
+	return problem.ProxyErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
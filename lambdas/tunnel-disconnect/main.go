@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -13,16 +15,22 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/history"
 	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
 )
 
 var (
 	tunnelsTable string
+	eventsTable  string
 	dbClient     *db.DynamoDBClient
+	tunnelRepo   repository.TunnelRepository
 )
 
 func init() {
 	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	eventsTable = os.Getenv("EVENTS_TABLE")
 	if tunnelsTable == "" {
 		panic("TUNNELS_TABLE environment variable is required")
 	}
@@ -36,14 +44,20 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 		if err != nil {
 			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
 		}
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
 	}
 
 	// Get connection ID
 	connectionID := request.RequestContext.ConnectionID
 
-	// Find tunnel by connection ID
-	tunnelID, err := findTunnelByConnectionID(ctx, connectionID)
+	// Find tunnel by connection ID, falling back to the tunnel requested at
+	// $connect for secondary connections of multi-policy tunnels
+	tunnel, err := tunnelRepo.FindByConnection(ctx, connectionID, authorizerTunnelID(request))
 	if err != nil {
+		// A connection the reject policy refused only has to be forgotten
+		if tunnelID := authorizerTunnelID(request); tunnelID != "" {
+			forgetRejected(ctx, tunnelID, connectionID)
+		}
 		// Connection might not be associated with a tunnel, which is okay
 		return events.APIGatewayProxyResponse{
 			StatusCode: 200,
@@ -51,66 +65,150 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 		}, nil
 	}
 
-	// Update tunnel status to inactive and remove connection ID
-	key := map[string]types.AttributeValue{
-		"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
-	}
+	tunnelID := tunnel.TunnelID
+
+	// The GSI is eventually consistent and the CLI may already have reconnected,
+	// so decide on a fresh read; the versioned update starts over if a connect
+	// lands in between
+	detached := false
+	tunnel, err = dbClient.UpdateTunnel(ctx, tunnelsTable, tunnelID, func(tunnel *models.Tunnel) (*dynamodb.UpdateItemInput, error) {
+		if !tunnel.HasConnection(connectionID) {
+			// A connection its CLI replaced has finished draining
+			if tunnel.DrainingConnectionID == connectionID {
+				return &dynamodb.UpdateItemInput{
+					UpdateExpression: aws.String("REMOVE draining_connection_id"),
+				}, nil
+			}
+			return nil, nil
+		}
+		detached = true
 
-	updateInput := &dynamodb.UpdateItemInput{
-		TableName: aws.String(tunnelsTable),
-		Key:       key,
-		UpdateExpression: aws.String("SET #status = :status, updated_at = :updated_at REMOVE connection_id"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status":     &types.AttributeValueMemberS{Value: models.TunnelStatusInactive},
-			":updated_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
-		},
-	}
+		// A multi-policy tunnel stays active while other connections remain
+		if remaining := otherConnections(tunnel, connectionID); len(remaining) > 0 {
+			return detachConnection(tunnel, connectionID, remaining[0]), nil
+		}
 
-	err = dbClient.UpdateItem(ctx, updateInput)
+		// Update tunnel status to inactive and remove connection ID
+		return &dynamodb.UpdateItemInput{
+			UpdateExpression: aws.String("SET #status = :status, updated_at = :updated_at REMOVE connection_id, connection_ids"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status":     &types.AttributeValueMemberS{Value: models.TunnelStatusInactive},
+				":updated_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			},
+		}, nil
+	})
+	if errors.Is(err, db.ErrItemNotFound) || (err == nil && !detached) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Body:       `{"message": "Disconnected"}`,
+		}, nil
+	}
 	if err != nil {
 		return errorResponse(500, fmt.Sprintf("Failed to update tunnel: %v", err))
 	}
 
+	// Record why the connection went away in the tunnel's event history
+	if err := history.Record(ctx, dbClient, eventsTable, models.TunnelEvent{
+		TunnelID:     tunnelID,
+		Type:         models.TunnelEventDisconnected,
+		ClientID:     tunnel.ClientID,
+		ConnectionID: connectionID,
+		SourceIP:     request.RequestContext.Identity.SourceIP,
+		Reason:       disconnectReason(request.RequestContext),
+	}); err != nil {
+		log.Printf("tunnel-disconnect: %v", err)
+	}
+
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 		Body:       `{"message": "Disconnected successfully"}`,
 	}, nil
 }
 
-func findTunnelByConnectionID(ctx context.Context, connectionID string) (string, error) {
-	// Scan tunnels table to find tunnel with matching connection ID
-	// In production, consider using a GSI for better performance
-	var tunnels []models.Tunnel
-	err := dbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName:        aws.String(tunnelsTable),
-		FilterExpression: aws.String("connection_id = :connection_id"),
+// authorizerTunnelID returns the tunnel the connection asked for at $connect
+func authorizerTunnelID(request events.APIGatewayWebsocketProxyRequest) string {
+	authorizer, ok := request.RequestContext.Authorizer.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	tunnelID, _ := authorizer["tunnelId"].(string)
+	return tunnelID
+}
+
+// forgetRejected removes a closed connection from the tunnel's rejected
+// connections, if it is there
+func forgetRejected(ctx context.Context, tunnelID, connectionID string) {
+	err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tunnelsTable),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		UpdateExpression:    aws.String("DELETE rejected_connection_ids :connection_ids"),
+		ConditionExpression: aws.String("contains(rejected_connection_ids, :connection_id)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":connection_id": &types.AttributeValueMemberS{Value: connectionID},
+			":connection_ids": &types.AttributeValueMemberSS{Value: []string{connectionID}},
+			":connection_id":  &types.AttributeValueMemberS{Value: connectionID},
 		},
-	}, &tunnels)
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionFailed) {
+		log.Printf("tunnel-disconnect: failed to forget rejected connection %s: %v", connectionID, err)
+	}
+}
 
-	if err != nil {
-		return "", err
+// otherConnections lists the tunnel's live connections except connectionID
+func otherConnections(tunnel *models.Tunnel, connectionID string) []string {
+	var others []string
+	for _, id := range tunnel.Connections() {
+		if id != connectionID {
+			others = append(others, id)
+		}
+	}
+	return others
+}
+
+// detachConnection removes one connection from a multi-policy tunnel that keeps
+// serving through its other connections. If the departing connection was the
+// primary, next takes its place.
+func detachConnection(tunnel *models.Tunnel, connectionID, next string) *dynamodb.UpdateItemInput {
+	input := &dynamodb.UpdateItemInput{
+		UpdateExpression: aws.String("SET updated_at = :updated_at DELETE connection_ids :connection_ids"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":updated_at":     &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			":connection_ids": &types.AttributeValueMemberSS{Value: []string{connectionID}},
+		},
 	}
 
-	if len(tunnels) == 0 {
-		return "", fmt.Errorf("tunnel not found for connection ID: %s", connectionID)
+	if tunnel.ConnectionID == connectionID {
+		input.UpdateExpression = aws.String("SET connection_id = :next_connection_id, updated_at = :updated_at DELETE connection_ids :connection_ids")
+		input.ExpressionAttributeValues[":next_connection_id"] = &types.AttributeValueMemberS{Value: next}
 	}
 
-	return tunnels[0].TunnelID, nil
+	return input
 }
 
-func errorResponse(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
-	body, _ := json.Marshal(map[string]string{
-		"error": message,
-	})
+// disconnectReason formats the close code and reason API Gateway reports on $disconnect
+func disconnectReason(requestContext events.APIGatewayWebsocketProxyRequestContext) string {
+	reason := ""
+	if requestContext.DisconnectReason != nil {
+		reason = *requestContext.DisconnectReason
+	}
+	if requestContext.DisconnectStatusCode != 0 {
+		reason = strings.TrimSpace(fmt.Sprintf("%d %s", requestContext.DisconnectStatusCode, reason))
+	}
+	return reason
+}
 
+func errorResponse(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
 	return events.APIGatewayProxyResponse{
 		StatusCode: statusCode,
-		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": problem.ContentType,
+		},
+		Body: string(problem.Body(statusCode, message)),
 	}, nil
 }
 
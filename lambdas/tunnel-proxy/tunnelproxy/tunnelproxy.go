@@ -0,0 +1,924 @@
+// Package tunnelproxy is the tunnel-proxy Lambda, which handles the messages
+// CLIs send over the WebSocket API. The Lambda's main only calls Init and
+// starts Invoke; the end-to-end tests run it in-process.
+package tunnelproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/models"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/ratelimit"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+	"github.com/lmanrique/tunnel/lambdas/shared/requestlog"
+	"github.com/lmanrique/tunnel/lambdas/shared/warmup"
+)
+
+// Default per-connection limits, counted per ratelimit.Window. Streaming a large
+// response sends many proxy_stream_chunk messages, so the overall limit is generous;
+// the CLI only pings every 30 seconds.
+const (
+	defaultMessageLimit = 5000
+	defaultPingLimit    = 20
+)
+
+// statsWindow is how far back the error rate in stats messages looks
+const statsWindow = time.Minute
+
+var (
+	tunnelsTable         string
+	domainsTable         string
+	pendingRequestsTable string
+	streamChunksTable    string
+	rateLimitsTable      string
+	requestLogTable      string
+	websocketEndpoint    string
+	messageLimit         int64
+	pingLimit            int64
+	dbClient             *db.DynamoDBClient
+	tunnelRepo           repository.TunnelRepository
+	domainRepo           repository.DomainRepository
+	pendingRepo          repository.PendingRequestRepository
+	streamChunkRepo      repository.StreamChunkRepository
+	apiGatewayClient     *apigatewaymanagementapi.Client
+)
+
+// Init reads the configuration from the environment. It panics when a required
+// variable is missing, failing the Lambda's init phase, and must be called
+// before Invoke or Handler.
+func Init() {
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	domainsTable = os.Getenv("DOMAINS_TABLE")
+	pendingRequestsTable = os.Getenv("PENDING_REQUESTS_TABLE")
+	streamChunksTable = os.Getenv("STREAM_CHUNKS_TABLE")
+	rateLimitsTable = os.Getenv("RATE_LIMITS_TABLE")
+	requestLogTable = os.Getenv("REQUEST_LOG_TABLE")
+	websocketEndpoint = os.Getenv("WEBSOCKET_ENDPOINT")
+
+	if tunnelsTable == "" || domainsTable == "" {
+		panic("Required environment variables are missing")
+	}
+
+	messageLimit = envLimit("RATE_LIMIT_MESSAGES", defaultMessageLimit)
+	pingLimit = envLimit("RATE_LIMIT_PINGS", defaultPingLimit)
+}
+
+// envLimit reads a positive limit from the environment, falling back to def
+func envLimit(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 1 {
+		panic(fmt.Sprintf("%s must be a positive integer", name))
+	}
+	return limit
+}
+
+// initClients creates the DB client and repositories if not already done
+func initClients(ctx context.Context) error {
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, domainsTable)
+		domainRepo = repository.NewDomainRepository(dbClient, domainsTable)
+		pendingRepo = repository.NewPendingRequestRepository(dbClient, pendingRequestsTable)
+		streamChunkRepo = repository.NewStreamChunkRepository(dbClient, streamChunksTable)
+	}
+	return nil
+}
+
+// Invoke is the Lambda entry point: warm-up pings only create the clients,
+// everything else is a WebSocket message
+func Invoke(ctx context.Context, payload json.RawMessage) (any, error) {
+	if warmup.Is(payload) {
+		return warmup.Handle(ctx, initClients)
+	}
+	warmup.Observe()
+
+	var request events.APIGatewayWebsocketProxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, fmt.Errorf("invalid WebSocket event: %w", err)
+	}
+	return Handler(ctx, request)
+}
+
+// Handler handles one message a CLI sent on its connection
+func Handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := initClients(ctx); err != nil {
+		return errorResponse(500, err.Error())
+	}
+
+	// Parse and validate the message against its action's schema
+	message, parseErr := models.ParseMessage([]byte(request.Body))
+	action := ""
+	if parseErr == nil {
+		action = message.Action
+	}
+
+	// Throttle abusive connections before doing any other work for them
+	if !allowMessage(ctx, request.RequestContext.ConnectionID, action) {
+		return errorResponse(429, "Rate limit exceeded")
+	}
+
+	// Tell the CLI exactly what was wrong instead of dropping the message
+	if parseErr != nil {
+		log.Printf("rejecting message: %v", parseErr)
+		if err := reply(ctx, request.RequestContext.ConnectionID, models.ErrorMessage("", parseErr)); err != nil {
+			log.Printf("rejecting message: failed to send error reply: %v", err)
+		}
+		return errorResponse(400, parseErr.Error())
+	}
+
+	switch payload := message.Payload.(type) {
+	case *models.EmptyPayload:
+		switch message.Action {
+		case models.ActionPing:
+			return handlePing(ctx, request)
+		case models.ActionError:
+			log.Printf("ERROR from CLI for request_id=%s: %s", message.RequestID, message.Error)
+			return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message": "Error received"}`}, nil
+		}
+	case *models.LegacyResponsePayload:
+		return handleResponse(ctx, payload)
+	}
+
+	// Every remaining action writes a response into a pending request, so resolve
+	// which tunnel this connection serves; updates are conditioned on it below
+	tunnelID, err := tunnelForConnection(ctx, request)
+	if err != nil {
+		if refuseRejected(ctx, request) {
+			return errorResponse(409, "Connection was rejected")
+		}
+		log.Printf("%s: %v", message.Action, err)
+		return errorResponse(403, "Connection is not associated with a tunnel")
+	}
+
+	switch payload := message.Payload.(type) {
+	case *models.HelloPayload:
+		return handleHello(ctx, request.RequestContext.ConnectionID, tunnelID, payload)
+	case *models.ReconnectPayload:
+		return handleReconnectSoon(ctx, request.RequestContext.ConnectionID, tunnelID)
+	case *models.ProxyResponsePayload:
+		return handleProxyResponse(ctx, tunnelID, payload)
+	case *models.StreamStartPayload:
+		return handleProxyStreamStart(ctx, tunnelID, payload)
+	case *models.StreamEndPayload:
+		return handleProxyStreamEnd(ctx, tunnelID, payload)
+	case *models.ChunkPayload:
+		switch message.Action {
+		case models.ActionProxyResponseChunk:
+			return handleProxyResponseChunk(ctx, tunnelID, payload)
+		case models.ActionProxyStreamChunk:
+			return handleProxyStreamChunk(ctx, tunnelID, payload)
+		}
+	}
+
+	// Server-to-CLI actions are never valid from a CLI
+	err = fmt.Errorf("%w: %s is not accepted from clients", models.ErrUnknownAction, message.Action)
+	if replyErr := reply(ctx, request.RequestContext.ConnectionID, models.ErrorMessage(message.RequestID, err)); replyErr != nil {
+		log.Printf("rejecting message: failed to send error reply: %v", replyErr)
+	}
+	return errorResponse(400, err.Error())
+}
+
+// reply posts a message back to a connection
+func reply(ctx context.Context, connectionID string, data []byte) error {
+	if _, err := managementClient(ctx); err != nil {
+		return err
+	}
+	_, err := apiGatewayClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         data,
+	})
+	return err
+}
+
+// throttledConnections remembers, per container, connections that exceeded a
+// limit and until when, so their remaining messages are dropped without a DynamoDB write
+var throttledConnections sync.Map
+
+// counterLimit is the maximum count per window for one rate-limit counter
+type counterLimit struct {
+	key   string
+	limit int64
+}
+
+// allowMessage applies the per-connection message limit and, for PING, the
+// per-action limit. A connection that goes over a limit is disconnected; the
+// CLI reconnects with backoff. Counting errors fail open.
+func allowMessage(ctx context.Context, connectionID, action string) bool {
+	if until, ok := throttledConnections.Load(connectionID); ok && time.Now().Before(until.(time.Time)) {
+		return false
+	}
+
+	if rateLimitsTable == "" {
+		return true
+	}
+
+	limits := []counterLimit{{"conn#" + connectionID, messageLimit}}
+	if action == models.MessageTypePing {
+		limits = append(limits, counterLimit{"conn#" + connectionID + "#" + action, pingLimit})
+	}
+
+	for _, l := range limits {
+		count, err := ratelimit.Hit(ctx, dbClient, rateLimitsTable, l.key)
+		if err != nil {
+			log.Printf("rate limit: %v", err)
+			continue
+		}
+		if count <= l.limit {
+			continue
+		}
+
+		throttledConnections.Store(connectionID, time.Now().Add(ratelimit.Window))
+		// Only the message that crosses the limit triggers the disconnect
+		if count == l.limit+1 {
+			log.Printf("rate limit: connection %s exceeded %d messages per %s (%s), disconnecting", connectionID, l.limit, ratelimit.Window, l.key)
+			disconnect(ctx, connectionID)
+		}
+		return false
+	}
+
+	return true
+}
+
+// disconnect closes a WebSocket connection from the server side
+func disconnect(ctx context.Context, connectionID string) {
+	client, err := managementClient(ctx)
+	if err != nil {
+		log.Printf("disconnect: %v", err)
+		return
+	}
+
+	if _, err := client.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	}); err != nil {
+		log.Printf("disconnect: failed to close connection %s: %v", connectionID, err)
+	}
+}
+
+// managementClient returns the API Gateway Management API client for the
+// WebSocket stage, creating it on first use
+func managementClient(ctx context.Context) (*apigatewaymanagementapi.Client, error) {
+	if apiGatewayClient == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+
+		apiGatewayClient = apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+			if websocketEndpoint != "" {
+				o.BaseEndpoint = aws.String(websocketEndpoint)
+			}
+		})
+	}
+	return apiGatewayClient, nil
+}
+
+// connectionTunnels caches connection → tunnel lookups for the lifetime of the
+// container; a connection never moves to another tunnel
+var connectionTunnels sync.Map
+
+// tunnelForConnection returns the ID of the tunnel served by the request's connection
+func tunnelForConnection(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (string, error) {
+	connectionID := request.RequestContext.ConnectionID
+	if tunnelID, ok := connectionTunnels.Load(connectionID); ok {
+		return tunnelID.(string), nil
+	}
+
+	// Secondary connections of multi-policy tunnels are not in the GSI; the
+	// authorizer context carries the tunnel they connected to
+	tunnelIDHint := ""
+	if authorizer, ok := request.RequestContext.Authorizer.(map[string]interface{}); ok {
+		tunnelIDHint, _ = authorizer["tunnelId"].(string)
+	}
+
+	tunnel, err := tunnelRepo.FindByConnection(ctx, connectionID, tunnelIDHint)
+	if err != nil {
+		return "", err
+	}
+
+	connectionTunnels.Store(connectionID, tunnel.TunnelID)
+	return tunnel.TunnelID, nil
+}
+
+// refuseRejected tells a connection the reject policy refused why, with
+// connection_rejected, and closes it. It reports whether the connection was
+// one; the authorizer context names the tunnel it asked for.
+func refuseRejected(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) bool {
+	connectionID := request.RequestContext.ConnectionID
+	authorizer, _ := request.RequestContext.Authorizer.(map[string]interface{})
+	tunnelID, _ := authorizer["tunnelId"].(string)
+	if tunnelID == "" {
+		return false
+	}
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
+	if err != nil || !slices.Contains(tunnel.RejectedConnectionIDs, connectionID) {
+		return false
+	}
+
+	messageBytes, err := models.EncodeMessage(models.ActionConnectionRejected, &models.ConnectionRejectedPayload{
+		TunnelID: tunnelID,
+		Code:     problem.CodeTunnelInUse,
+		Message:  "Tunnel already has an active connection (connection policy: reject)",
+	})
+	if err == nil {
+		err = reply(ctx, connectionID, messageBytes)
+	}
+	if err != nil {
+		log.Printf("rejected connection %s: failed to send connection_rejected: %v", connectionID, err)
+	}
+	disconnect(ctx, connectionID)
+	return true
+}
+
+// ownedBy conditions a pending-request update on the request belonging to
+// tunnelID, so a connection can only answer requests sent to its own tunnel
+func ownedBy(input *dynamodb.UpdateItemInput, tunnelID string) *dynamodb.UpdateItemInput {
+	input.ConditionExpression = aws.String("tunnel_id = :owner_tunnel_id")
+	if input.ExpressionAttributeValues == nil {
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{}
+	}
+	input.ExpressionAttributeValues[":owner_tunnel_id"] = &types.AttributeValueMemberS{Value: tunnelID}
+	return input
+}
+
+// isNotOwned reports whether an update was rejected by ownedBy's condition
+func isNotOwned(err error) bool {
+	var conditionFailed *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionFailed)
+}
+
+func handlePing(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	connectionID := request.RequestContext.ConnectionID
+
+	// Record the heartbeat; reap-stale-tunnels marks tunnels whose heartbeat
+	// stops as inactive when $disconnect never fires
+	tunnel, err := recordHeartbeat(ctx, request)
+	if err != nil {
+		if refuseRejected(ctx, request) {
+			return errorResponse(409, "Connection was rejected")
+		}
+		log.Printf("PING: %v", err)
+	}
+
+	// Initialize API Gateway Management API client
+	if _, err := managementClient(ctx); err != nil {
+		return errorResponse(500, "Failed to load AWS config")
+	}
+
+	// Send PONG response
+	pongMessage := models.WebSocketMessage{
+		Action: models.MessageTypePong,
+	}
+
+	messageBytes, err := json.Marshal(pongMessage)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal PONG message")
+	}
+
+	_, err = apiGatewayClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         messageBytes,
+	})
+
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to send PONG: %v", err))
+	}
+
+	// Pings are the CLI's clock, so edge-side stats follow each PONG
+	if tunnel != nil && tunnel.Supports(models.CapabilityStats) {
+		if err := sendStats(ctx, connectionID, tunnel.TunnelID); err != nil {
+			log.Printf("PING: stats for tunnel %s: %v", tunnel.TunnelID, err)
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       `{"message": "PONG sent"}`,
+	}, nil
+}
+
+// recordHeartbeat stamps last_ping_at on the tunnel served by the request's
+// connection and returns the updated tunnel
+func recordHeartbeat(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (*models.Tunnel, error) {
+	tunnelID, err := tunnelForConnection(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnel models.Tunnel
+	if err := dbClient.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tunnelsTable),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		UpdateExpression:    aws.String("SET last_ping_at = :last_ping_at"),
+		ConditionExpression: aws.String("attribute_exists(tunnel_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":last_ping_at": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	}, &tunnel); err != nil {
+		return nil, err
+	}
+	return &tunnel, nil
+}
+
+// sendStats tells the CLI how its tunnel looks from the edge: requests holding
+// or queued for a request slot, and the 5xx rate over statsWindow. Either part
+// is left zero when its table is not configured.
+func sendStats(ctx context.Context, connectionID, tunnelID string) error {
+	stats := &models.StatsPayload{WindowSeconds: int(statsWindow.Seconds())}
+
+	if rateLimitsTable != "" {
+		inflight, queued, err := ratelimit.Usage(ctx, dbClient, rateLimitsTable, tunnelID)
+		if err != nil {
+			return err
+		}
+		stats.Inflight, stats.Queued = inflight, queued
+	}
+
+	if requestLogTable != "" {
+		requests, errors, err := requestlog.Tally(ctx, dbClient, requestLogTable, tunnelID, time.Now().Add(-statsWindow))
+		if err != nil {
+			return err
+		}
+		stats.Requests, stats.Errors = requests, errors
+		if requests > 0 {
+			stats.ErrorRate = float64(errors) / float64(requests)
+		}
+	}
+
+	messageBytes, err := models.EncodeMessage(models.ActionStats, stats)
+	if err != nil {
+		return err
+	}
+	return reply(ctx, connectionID, messageBytes)
+}
+
+// handleHello negotiates the protocol version and capabilities for a newly
+// connected CLI, stores them on the tunnel so other Lambdas only send what the
+// CLI understands, and replies with a hello_ack
+func handleHello(ctx context.Context, connectionID, tunnelID string, hello *models.HelloPayload) (events.APIGatewayProxyResponse, error) {
+	ack := &models.TypedMessage{Action: models.ActionHelloAck}
+	version, capabilities, err := models.NegotiateProtocol(hello.ProtocolVersion, hello.Capabilities)
+	if err != nil {
+		ack.Error = err.Error()
+	} else {
+		ack.Payload = &models.HelloAckPayload{ProtocolVersion: version, Capabilities: capabilities}
+		if err := storeProtocol(ctx, tunnelID, version, capabilities); err != nil {
+			log.Printf("hello: failed to store protocol for tunnel %s: %v", tunnelID, err)
+			return errorResponse(500, "Failed to store negotiated protocol")
+		}
+		log.Printf("hello: tunnel %s negotiated protocol v%d %v", tunnelID, version, capabilities)
+	}
+
+	messageBytes, err := ack.Marshal()
+	if err != nil {
+		return errorResponse(500, "Failed to marshal hello_ack message")
+	}
+	if err := reply(ctx, connectionID, messageBytes); err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to send hello_ack: %v", err))
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"hello acknowledged"}`}, nil
+}
+
+// storeProtocol records the negotiated protocol on the tunnel
+func storeProtocol(ctx context.Context, tunnelID string, version int, capabilities []string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(tunnelsTable),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		UpdateExpression:    aws.String("SET protocol_version = :protocol_version REMOVE capabilities"),
+		ConditionExpression: aws.String("attribute_exists(tunnel_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":protocol_version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+		},
+	}
+	// String sets cannot be empty
+	if len(capabilities) > 0 {
+		input.UpdateExpression = aws.String("SET protocol_version = :protocol_version, capabilities = :capabilities")
+		input.ExpressionAttributeValues[":capabilities"] = &types.AttributeValueMemberSS{Value: capabilities}
+	}
+	return dbClient.UpdateItem(ctx, input)
+}
+
+// handleReconnectSoon marks the connection as about to be replaced by its CLI,
+// which reconnects ahead of API Gateway's 2-hour connection limit, and answers
+// with the connection's ID. tunnel-connect only hands the tunnel over to a
+// connection that names a marked one, without applying the connection policy.
+func handleReconnectSoon(ctx context.Context, connectionID, tunnelID string) (events.APIGatewayProxyResponse, error) {
+	ack := &models.TypedMessage{Action: models.ActionReconnectSoon}
+	err := dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tunnelsTable),
+		Key: map[string]types.AttributeValue{
+			"tunnel_id": &types.AttributeValueMemberS{Value: tunnelID},
+		},
+		UpdateExpression:    aws.String("SET reconnecting_connection_id = :connection_id"),
+		ConditionExpression: aws.String("connection_id = :connection_id OR contains(connection_ids, :connection_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":connection_id": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	if err != nil {
+		log.Printf("reconnect_soon: tunnel %s connection %s: %v", tunnelID, connectionID, err)
+		ack.Error = "Connection is no longer serving the tunnel"
+	} else {
+		ack.Payload = &models.ReconnectPayload{ConnectionID: connectionID}
+	}
+
+	messageBytes, err := ack.Marshal()
+	if err != nil {
+		return errorResponse(500, "Failed to marshal reconnect_soon message")
+	}
+	if err := reply(ctx, connectionID, messageBytes); err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to send reconnect_soon: %v", err))
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"reconnect acknowledged"}`}, nil
+}
+
+func handleResponse(ctx context.Context, response *models.LegacyResponsePayload) (events.APIGatewayProxyResponse, error) {
+	// This would handle HTTP responses from the client
+	// In a full implementation, this would:
+	// 1. Look up the pending request by request_id
+	// 2. Store the HTTP response
+	// 3. Return the response to the original HTTP requester
+	// 4. Clean up the pending request
+
+	// For now, just acknowledge receipt
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       `{"message": "Response received"}`,
+	}, nil
+}
+
+func handleProxyResponseChunk(ctx context.Context, tunnelID string, chunk *models.ChunkPayload) (events.APIGatewayProxyResponse, error) {
+	requestID, chunkIndex, data := chunk.RequestID, chunk.ChunkIndex, chunk.Data
+
+	// Each chunk is stored on the request's own DynamoDB item (keyed by request_id),
+	// so attribute names only need to be unique within that item — chunk_0, chunk_1, etc.
+	// No cross-request collision is possible because each request has its own item.
+	attrName := fmt.Sprintf("chunk_%d", chunkIndex)
+	err := dbClient.UpdateItem(ctx, ownedBy(&dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression:         aws.String("SET #chunk = :data"),
+		ExpressionAttributeNames: map[string]string{"#chunk": attrName},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":data": &types.AttributeValueMemberS{Value: data},
+		},
+	}, tunnelID))
+	if err != nil {
+		if isNotOwned(err) {
+			log.Printf("proxy_response_chunk: request_id=%s does not belong to tunnel %s", requestID, tunnelID)
+			return errorResponse(403, "Request does not belong to this tunnel")
+		}
+		log.Printf("proxy_response_chunk: failed to store chunk %d for request_id=%s: %v", chunkIndex, requestID, err)
+		return errorResponse(500, fmt.Sprintf("Failed to store chunk: %v", err))
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"chunk stored"}`}, nil
+}
+
+func handleProxyResponse(ctx context.Context, tunnelID string, response *models.ProxyResponsePayload) (events.APIGatewayProxyResponse, error) {
+	if pendingRequestsTable == "" {
+		log.Printf("proxy_response: PENDING_REQUESTS_TABLE not configured")
+		return errorResponse(500, "PENDING_REQUESTS_TABLE not configured")
+	}
+
+	requestID := response.RequestID
+	log.Printf("proxy_response: received for request_id=%s", requestID)
+
+	statusCode := response.StatusCode
+	responseBody := response.ResponseBody
+
+	// If the response was chunked, assemble body from stored chunks
+	if totalChunks := response.TotalChunks; totalChunks > 0 {
+		body, err := pendingRepo.Chunks(ctx, requestID, totalChunks)
+		if err != nil {
+			log.Printf("proxy_response: failed to read chunks for request_id=%s: %v", requestID, err)
+			return errorResponse(500, fmt.Sprintf("Failed to read chunks: %v", err))
+		}
+		responseBody = body
+		log.Printf("proxy_response: assembled %d chunks (%d bytes) for request_id=%s", totalChunks, len(responseBody), requestID)
+	}
+
+	// Build DynamoDB map for response headers
+	headersAV := map[string]types.AttributeValue{}
+	for k, v := range response.ResponseHeaders {
+		headersAV[k] = &types.AttributeValueMemberS{Value: v}
+	}
+
+	// If the CLI uploaded the response body to S3, store the key and flag as ready.
+	// The http-proxy Lambda will fetch from S3 instead of reading response_body.
+	if s3ResponseKey := response.S3ResponseKey; s3ResponseKey != "" {
+		log.Printf("proxy_response: request_id=%s using S3 response key %s", requestID, s3ResponseKey)
+		input := &dynamodb.UpdateItemInput{
+			TableName: aws.String(pendingRequestsTable),
+			Key: map[string]types.AttributeValue{
+				"request_id": &types.AttributeValueMemberS{Value: requestID},
+			},
+			UpdateExpression: aws.String("SET #s = :status, response_status = :code, response_headers = :headers, s3_response_key = :s3k, s3_response_ready = :ready"),
+			ExpressionAttributeNames: map[string]string{
+				"#s": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status":  &types.AttributeValueMemberS{Value: "completed"},
+				":code":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", statusCode)},
+				":headers": &types.AttributeValueMemberM{Value: headersAV},
+				":s3k":     &types.AttributeValueMemberS{Value: s3ResponseKey},
+				":ready":   &types.AttributeValueMemberBOOL{Value: true},
+			},
+		}
+		// http-proxy verifies the staged body against these before serving it
+		if response.S3ResponseSHA256 != "" {
+			input.UpdateExpression = aws.String(*input.UpdateExpression + ", s3_response_sha256 = :sha256, s3_response_bytes = :bytes")
+			input.ExpressionAttributeValues[":sha256"] = &types.AttributeValueMemberS{Value: response.S3ResponseSHA256}
+			input.ExpressionAttributeValues[":bytes"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", response.S3ResponseBytes)}
+		}
+		// http-proxy adds the upload time to Server-Timing and the request log
+		if response.S3UploadMs > 0 {
+			input.UpdateExpression = aws.String(*input.UpdateExpression + ", s3_upload_ms = :upload_ms")
+			input.ExpressionAttributeValues[":upload_ms"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", response.S3UploadMs)}
+		}
+		err := dbClient.UpdateItem(ctx, ownedBy(input, tunnelID))
+		if err != nil {
+			if isNotOwned(err) {
+				log.Printf("proxy_response: request_id=%s does not belong to tunnel %s", requestID, tunnelID)
+				return errorResponse(403, "Request does not belong to this tunnel")
+			}
+			log.Printf("proxy_response: failed to store S3 response key for request_id=%s: %v", requestID, err)
+			return errorResponse(500, fmt.Sprintf("Failed to update pending request: %v", err))
+		}
+		log.Printf("proxy_response: request_id=%s marked completed with S3 body (status=%d)", requestID, statusCode)
+		return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message": "Proxy response processed (S3)"}`}, nil
+	}
+
+	// A response the CLI made up because the local service did not answer ends
+	// the request as upstream_error
+	status := "completed"
+	if response.Error != "" {
+		status = models.PendingRequestUpstreamError
+	}
+
+	// Use UpdateItem to atomically set only the response fields (no GetItem needed)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET #s = :status, response_status = :code, response_headers = :headers, response_body = :body"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":  &types.AttributeValueMemberS{Value: status},
+			":code":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", statusCode)},
+			":headers": &types.AttributeValueMemberM{Value: headersAV},
+			":body":    &types.AttributeValueMemberS{Value: responseBody},
+		},
+	}
+	if response.Error != "" {
+		input.UpdateExpression = aws.String(*input.UpdateExpression + ", #error = :error")
+		input.ExpressionAttributeNames["#error"] = "error"
+		input.ExpressionAttributeValues[":error"] = &types.AttributeValueMemberS{Value: response.Error}
+	}
+	err := dbClient.UpdateItem(ctx, ownedBy(input, tunnelID))
+	if err != nil {
+		if isNotOwned(err) {
+			log.Printf("proxy_response: request_id=%s does not belong to tunnel %s", requestID, tunnelID)
+			return errorResponse(403, "Request does not belong to this tunnel")
+		}
+		log.Printf("proxy_response: failed to update request_id=%s: %v", requestID, err)
+		return errorResponse(500, fmt.Sprintf("Failed to update pending request: %v", err))
+	}
+
+	log.Printf("proxy_response: successfully marked request_id=%s as %s (status=%d)", requestID, status, statusCode)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       `{"message": "Proxy response processed"}`,
+	}, nil
+}
+
+// handleProxyStreamStart marks a pending request as streaming and stores status/headers.
+func handleProxyStreamStart(ctx context.Context, tunnelID string, start *models.StreamStartPayload) (events.APIGatewayProxyResponse, error) {
+	requestID, statusCode := start.RequestID, start.StatusCode
+
+	headersAV := map[string]types.AttributeValue{}
+	for k, v := range start.ResponseHeaders {
+		headersAV[k] = &types.AttributeValueMemberS{Value: v}
+	}
+
+	err := dbClient.UpdateItem(ctx, ownedBy(&dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET is_streaming = :t, stream_status = :code, stream_headers = :headers"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t":       &types.AttributeValueMemberBOOL{Value: true},
+			":code":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", statusCode)},
+			":headers": &types.AttributeValueMemberM{Value: headersAV},
+		},
+	}, tunnelID))
+	if err != nil {
+		if isNotOwned(err) {
+			log.Printf("proxy_stream_start: request_id=%s does not belong to tunnel %s", requestID, tunnelID)
+			return errorResponse(403, "Request does not belong to this tunnel")
+		}
+		log.Printf("proxy_stream_start: failed for request_id=%s: %v", requestID, err)
+		return errorResponse(500, fmt.Sprintf("Failed to mark stream start: %v", err))
+	}
+	streamOwners.Store(requestID, tunnelID)
+	log.Printf("proxy_stream_start: request_id=%s status=%d", requestID, statusCode)
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"stream started"}`}, nil
+}
+
+// handleProxyStreamChunk stores a chunk of an SSE response as an item of its
+// own in the stream chunks table, where http-proxy reads it by sequence
+// number. Chunks are tagged with the tunnel that sent them; http-proxy only
+// forwards the ones from the request's own tunnel.
+func handleProxyStreamChunk(ctx context.Context, tunnelID string, chunk *models.ChunkPayload) (events.APIGatewayProxyResponse, error) {
+	if streamChunksTable == "" {
+		return errorResponse(500, "Streaming is not configured")
+	}
+
+	owned, err := ownsStream(ctx, chunk.RequestID, tunnelID)
+	if err != nil {
+		log.Printf("proxy_stream_chunk: failed to read request_id=%s: %v", chunk.RequestID, err)
+		return errorResponse(500, fmt.Sprintf("Failed to store stream chunk: %v", err))
+	}
+	if !owned {
+		log.Printf("proxy_stream_chunk: request_id=%s does not belong to tunnel %s", chunk.RequestID, tunnelID)
+		return errorResponse(403, "Request does not belong to this tunnel")
+	}
+
+	err = streamChunkRepo.Put(ctx, models.StreamChunk{
+		RequestID: chunk.RequestID,
+		Seq:       chunk.ChunkIndex,
+		TunnelID:  tunnelID,
+		Data:      chunk.Data,
+	})
+	if err != nil {
+		if isNotOwned(err) {
+			log.Printf("proxy_stream_chunk: chunk %d of request_id=%s was written by another tunnel", chunk.ChunkIndex, chunk.RequestID)
+			return errorResponse(403, "Request does not belong to this tunnel")
+		}
+		log.Printf("proxy_stream_chunk: %v", err)
+		return errorResponse(500, fmt.Sprintf("Failed to store stream chunk: %v", err))
+	}
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"chunk stored"}`}, nil
+}
+
+// streamOwners caches request → tunnel for the streams this container has
+// seen, so only a stream's first message here reads the pending request; a
+// request never moves to another tunnel. proxy_stream_end drops the entry.
+var streamOwners sync.Map
+
+// ownsStream reports whether requestID was sent to tunnelID. Chunk items are
+// keyed by request and sequence number alone, so the pending request is what
+// says which tunnel may write them.
+func ownsStream(ctx context.Context, requestID, tunnelID string) (bool, error) {
+	if owner, ok := streamOwners.Load(requestID); ok {
+		return owner.(string) == tunnelID, nil
+	}
+
+	rawItem, err := dbClient.GetRawItem(ctx, pendingRequestsTable, map[string]types.AttributeValue{
+		"request_id": &types.AttributeValueMemberS{Value: requestID},
+	}, true)
+	if err != nil {
+		return false, err
+	}
+	owner, _ := rawItem["tunnel_id"].(*types.AttributeValueMemberS)
+	if owner == nil {
+		return false, nil
+	}
+	streamOwners.Store(requestID, owner.Value)
+	return owner.Value == tunnelID, nil
+}
+
+// handleProxyStreamEnd marks a streaming request as done, with the number of
+// chunks http-proxy still has to forward when the CLI sent it
+func handleProxyStreamEnd(ctx context.Context, tunnelID string, end *models.StreamEndPayload) (events.APIGatewayProxyResponse, error) {
+	requestID := end.RequestID
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(pendingRequestsTable),
+		Key: map[string]types.AttributeValue{
+			"request_id": &types.AttributeValueMemberS{Value: requestID},
+		},
+		UpdateExpression: aws.String("SET stream_done = :t"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	}
+	if end.TotalChunks > 0 {
+		input.UpdateExpression = aws.String("SET stream_done = :t, stream_chunk_count = :total")
+		input.ExpressionAttributeValues[":total"] = &types.AttributeValueMemberN{Value: strconv.Itoa(end.TotalChunks)}
+	}
+	err := dbClient.UpdateItem(ctx, ownedBy(input, tunnelID))
+	if err != nil {
+		if isNotOwned(err) {
+			log.Printf("proxy_stream_end: request_id=%s does not belong to tunnel %s", requestID, tunnelID)
+			return errorResponse(403, "Request does not belong to this tunnel")
+		}
+		log.Printf("proxy_stream_end: failed for request_id=%s: %v", requestID, err)
+		return errorResponse(500, fmt.Sprintf("Failed to mark stream end: %v", err))
+	}
+	streamOwners.Delete(requestID)
+	log.Printf("proxy_stream_end: stream complete for request_id=%s", requestID)
+	return events.APIGatewayProxyResponse{StatusCode: 200, Body: `{"message":"stream ended"}`}, nil
+}
+
+// handleHTTPRequest would be called when an external HTTP request comes in
+// This would typically be triggered by CloudFront or a separate Lambda
+func handleHTTPRequest(ctx context.Context, domain string, httpReq models.HTTPRequest) error {
+	// 1. Look up tunnel by domain
+	domainRecord, err := domainRepo.Get(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("domain not found: %w", err)
+	}
+
+	// 2. Get tunnel details
+	tunnel, err := tunnelRepo.Get(ctx, domainRecord.TunnelID)
+	if err != nil {
+		return fmt.Errorf("tunnel not found: %w", err)
+	}
+
+	if tunnel.Status != models.TunnelStatusActive || tunnel.ConnectionID == "" {
+		return fmt.Errorf("tunnel is not active")
+	}
+
+	// 3. Send request to client via WebSocket
+	requestMessage := models.WebSocketMessage{
+		Action:    models.MessageTypeRequest,
+		RequestID: generateRequestID(),
+		Data: map[string]interface{}{
+			"method":  httpReq.Method,
+			"path":    httpReq.Path,
+			"headers": httpReq.Headers,
+			"body":    httpReq.Body,
+		},
+	}
+
+	messageBytes, err := json.Marshal(requestMessage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	_, err = apiGatewayClient.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(tunnel.ConnectionID),
+		Data:         messageBytes,
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to send request to client: %w", err)
+	}
+
+	// 4. In production, store pending request and wait for response
+	// This would typically use DynamoDB or Redis to track pending requests
+
+	return nil
+}
+
+func generateRequestID() string {
+	// In production, use a proper UUID generator
+	return fmt.Sprintf("req_%d", time.Now().UnixNano())
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": problem.ContentType,
+		},
+		Body: string(problem.Body(statusCode, message)),
+	}, nil
+}
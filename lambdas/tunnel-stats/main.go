@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lmanrique/tunnel/lambdas/shared/api"
+	"github.com/lmanrique/tunnel/lambdas/shared/apiversion"
+	"github.com/lmanrique/tunnel/lambdas/shared/auth"
+	"github.com/lmanrique/tunnel/lambdas/shared/db"
+	"github.com/lmanrique/tunnel/lambdas/shared/problem"
+	"github.com/lmanrique/tunnel/lambdas/shared/repository"
+	"github.com/lmanrique/tunnel/lambdas/shared/requestlog"
+)
+
+// windows maps the accepted ?window= values to their durations
+var windows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+const defaultWindow = "24h"
+
+var (
+	clientsTable      string
+	tunnelsTable      string
+	requestStatsTable string
+	dbClient          *db.DynamoDBClient
+	clientRepo        repository.ClientRepository
+	tunnelRepo        repository.TunnelRepository
+)
+
+func init() {
+	clientsTable = os.Getenv("CLIENTS_TABLE")
+	tunnelsTable = os.Getenv("TUNNELS_TABLE")
+	requestStatsTable = os.Getenv("REQUEST_STATS_TABLE")
+
+	if clientsTable == "" || tunnelsTable == "" || requestStatsTable == "" {
+		panic("Required environment variables are missing")
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Initialize DB client if not already done
+	if dbClient == nil {
+		var err error
+		dbClient, err = db.NewDynamoDBClient(ctx)
+		if err != nil {
+			return errorResponse(500, fmt.Sprintf("Failed to initialize database: %v", err))
+		}
+		clientRepo = repository.NewClientRepository(dbClient, clientsTable)
+		tunnelRepo = repository.NewTunnelRepository(dbClient, tunnelsTable, "")
+	}
+
+	// Extract and verify API key
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	apiKey, err := auth.ExtractBearerToken(authHeader)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid authorization header")
+	}
+
+	// Verify client exists and get client ID
+	client, err := clientRepo.FindByAPIKey(ctx, apiKey)
+	if err != nil {
+		return problem.ErrorResponse(401, problem.CodeInvalidAPIKey, "Invalid API key")
+	}
+	clientID := client.ClientID
+	if err := clientRepo.RecordUse(ctx, clientID, request.RequestContext.HTTP.SourceIP); err != nil {
+		log.Printf("tunnel-stats: %v", err)
+	}
+
+	// Get tunnel ID from path parameters
+	tunnelID := request.PathParameters["tunnel_id"]
+	if tunnelID == "" {
+		return errorResponse(400, "Tunnel ID is required")
+	}
+
+	window := request.QueryStringParameters["window"]
+	if window == "" {
+		window = defaultWindow
+	}
+	windowDuration, ok := windows[window]
+	if !ok {
+		return errorResponse(400, "window must be one of 1h, 24h, 7d, 30d")
+	}
+
+	// Get tunnel from database
+	tunnel, err := tunnelRepo.Get(ctx, tunnelID)
+	if err != nil {
+		return problem.ErrorResponse(404, problem.CodeTunnelNotFound, "Tunnel not found")
+	}
+
+	// Verify tunnel belongs to client
+	if tunnel.ClientID != clientID {
+		return errorResponse(403, "Unauthorized to view this tunnel")
+	}
+
+	// The window is summed from hourly counters, so it starts at the top of
+	// the hour it reaches back into
+	totals, err := requestlog.Sum(ctx, dbClient, requestStatsTable, tunnelID, time.Now().Add(-windowDuration))
+	if err != nil {
+		return errorResponse(500, fmt.Sprintf("Failed to query request stats: %v", err))
+	}
+
+	response := summarize(totals)
+	response.TunnelID = tunnelID
+	response.Window = window
+	response.Since = totals.Hour
+
+	return successResponse(200, response)
+}
+
+// summarize turns summed stats buckets into the response. Errors are 5xx
+// responses; 4xx responses are counted separately as client errors. The
+// percentiles are the upper bounds of the latency histogram buckets they
+// fall in.
+func summarize(totals requestlog.Bucket) api.TunnelStatsResponse {
+	stats := api.TunnelStatsResponse{
+		Requests:     int(totals.Requests),
+		Errors:       int(totals.Errors),
+		ClientErrors: int(totals.ClientErrors),
+		BytesIn:      totals.BytesIn,
+		BytesOut:     totals.BytesOut,
+		P50Ms:        totals.Percentile(50),
+		P95Ms:        totals.Percentile(95),
+	}
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	}
+	return stats
+}
+
+func successResponse(statusCode int, data interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(500, "Failed to marshal response")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func errorResponse(statusCode int, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return problem.ErrorResponse(statusCode, problem.CodeForStatus(statusCode), message)
+}
+
+func main() {
+	lambda.Start(apiversion.Wrap(handler))
+}
@@ -0,0 +1,3 @@
+module github.com/lmanrique/tunnel/pkg
+
+go 1.23
@@ -0,0 +1,495 @@
+// Package tunnelclient sends requests with large bodies through a tunnel.
+//
+// Requests through a tunnel are limited by the edge to a few megabytes. For
+// larger bodies http-proxy offers a three-step flow: POST /upload-url returns
+// a presigned S3 URL and a request ID, the body is uploaded to S3, and the
+// tunnel's response is fetched from GET /poll/{request_id} once the CLI has
+// answered. The upload is a PUT with the headers S3 signed, a form POST, or,
+// for bodies over 5 GB, a PUT per part completed with the parts' ETags, as
+// /upload-url says. Client.Do runs all the steps for an
+// ordinary *http.Request:
+//
+//	c := tunnelclient.New("https://myapp.tunnel.example.com")
+//	req, _ := http.NewRequestWithContext(ctx, "POST", "/transcribe?lang=en", file)
+//	req.ContentLength = size
+//	req.Header.Set("Content-Type", "audio/wav")
+//	resp, err := c.Do(req)
+//
+// The request's context bounds the whole exchange, polling included.
+package tunnelclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPollInterval is the first wait between polls; it doubles up to
+	// DefaultMaxPollInterval
+	DefaultPollInterval    = 250 * time.Millisecond
+	DefaultMaxPollInterval = 5 * time.Second
+	// maxPollErrors is how many polls in a row may fail in transit before Do
+	// gives up
+	maxPollErrors = 5
+)
+
+// Client sends requests to one tunnel through the upload and poll flow
+type Client struct {
+	// BaseURL is the tunnel's own URL (https://<subdomain>.<domain>), or the
+	// http-proxy Function URL when Subdomain is set
+	BaseURL string
+	// Subdomain names the tunnel when BaseURL is not the tunnel's own host
+	Subdomain string
+	// HTTPClient makes every call, including the S3 upload
+	HTTPClient *http.Client
+	// PollInterval and MaxPollInterval bound the backoff between polls
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+}
+
+// Upload methods of the /upload-url response
+const (
+	uploadMethodPut       = "PUT"       // PUT the body to upload_url with upload_headers
+	uploadMethodPost      = "POST"      // POST upload_fields and the body as a form to upload_url
+	uploadMethodMultipart = "MULTIPART" // PUT each part to its URL, then POST the ETags to complete_url
+)
+
+// maxSinglePutBytes is the largest body S3 takes in one upload; larger ones
+// are uploaded in parts
+const maxSinglePutBytes = 5 << 30
+
+// uploadURLRequest is the metadata POSTed to /upload-url
+type uploadURLRequest struct {
+	Method      string             `json:"method"`
+	ContentType string             `json:"content_type,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`
+	SHA256      string             `json:"sha256,omitempty"`
+	Constraints *uploadConstraints `json:"constraints,omitempty"`
+}
+
+// uploadConstraints are the limits S3 holds the upload to. The exact size
+// also decides whether the body is uploaded in parts.
+type uploadConstraints struct {
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Checksum    bool   `json:"checksum,omitempty"`
+}
+
+// uploadURLResponse is what /upload-url returns
+type uploadURLResponse struct {
+	RequestID   string            `json:"request_id"`
+	PollURL     string            `json:"poll_url"`
+	Method      string            `json:"upload_method"`
+	UploadURL   string            `json:"upload_url"`
+	Headers     map[string]string `json:"upload_headers"`
+	Fields      map[string]string `json:"upload_fields"`
+	PartSize    int64             `json:"part_size"`
+	PartURLs    []string          `json:"part_urls"`
+	CompleteURL string            `json:"complete_url"`
+}
+
+// completedPart is an uploaded part of a multipart upload, as POSTed to
+// complete_url
+type completedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// ErrorResponse is the error body of the tunnel service, a problem details
+// object (application/problem+json)
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code identifies the error. A request that ended without a response from
+	// the local service has failed_upload, tunnel_disconnected, upstream_error
+	// or expired
+	Code string `json:"code,omitempty"`
+}
+
+// New returns a Client for the tunnel at baseURL with the default polling
+// backoff
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:         strings.TrimSuffix(baseURL, "/"),
+		HTTPClient:      &http.Client{},
+		PollInterval:    DefaultPollInterval,
+		MaxPollInterval: DefaultMaxPollInterval,
+	}
+}
+
+// Do sends req to the local service behind the tunnel and returns its
+// response. Only req's method, path and query, headers and body are used; the
+// host comes from the Client. The caller must close the response body. A
+// request that ended without a response from the local service is answered
+// with an error status and an ErrorResponse carrying its Code.
+//
+// A body whose length is unknown (req.ContentLength of 0 or -1 with a body) is
+// read into memory first, since S3 needs the length up front. When the body
+// can be read twice (req.GetBody, set by http.NewRequest for in-memory
+// bodies), its SHA-256 is sent along and the CLI checks the upload against it.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	body, length, checksum, err := prepareBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		defer body.Close()
+	}
+
+	upload, err := c.requestUploadURL(ctx, req, length, checksum)
+	if err != nil {
+		return nil, err
+	}
+	switch upload.Method {
+	case uploadMethodMultipart:
+		err = c.uploadParts(ctx, upload, body, length)
+	case uploadMethodPost:
+		err = c.uploadForm(ctx, upload, body, length)
+	default:
+		err = c.upload(ctx, upload, body, length)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request %s: %w", upload.RequestID, err)
+	}
+	return c.poll(ctx, upload)
+}
+
+// prepareBody returns the body to upload with its length, and its hex SHA-256
+// when the body could be read for it without consuming the upload
+func prepareBody(req *http.Request) (io.ReadCloser, int64, string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, 0, hex.EncodeToString(sha256.New().Sum(nil)), nil
+	}
+
+	if req.ContentLength <= 0 {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to read request body: %w", err)
+		}
+		sum := sha256.Sum256(data)
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), hex.EncodeToString(sum[:]), nil
+	}
+
+	var checksum string
+	if req.GetBody != nil {
+		dup, err := req.GetBody()
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to read request body: %w", err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, dup)
+		dup.Close()
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to hash request body: %w", err)
+		}
+		checksum = hex.EncodeToString(h.Sum(nil))
+	}
+	return req.Body, req.ContentLength, checksum, nil
+}
+
+// requestUploadURL registers the request with http-proxy and gets the
+// presigned URLs for its body of length bytes
+func (c *Client) requestUploadURL(ctx context.Context, req *http.Request, length int64, checksum string) (*uploadURLResponse, error) {
+	meta := uploadURLRequest{
+		Method:      req.Method,
+		ContentType: req.Header.Get("Content-Type"),
+		SHA256:      checksum,
+	}
+	// S3 holds the upload to the body's size and type, and to its checksum
+	// where it can check one
+	constraints := uploadConstraints{Size: length}
+	if _, _, err := mime.ParseMediaType(meta.ContentType); err == nil {
+		constraints.ContentType = meta.ContentType
+	}
+	constraints.Checksum = checksum != "" && length <= maxSinglePutBytes
+	if constraints != (uploadConstraints{}) {
+		meta.Constraints = &constraints
+	}
+	if meta.Method == "" {
+		meta.Method = http.MethodGet
+	}
+	if len(req.Header) > 0 {
+		meta.Headers = make(map[string]string, len(req.Header))
+		for name, values := range req.Header {
+			meta.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upload metadata: %w", err)
+	}
+
+	uploadURL := c.BaseURL + "/upload-url"
+	if c.Subdomain != "" {
+		uploadURL += "/" + url.PathEscape(c.Subdomain)
+	}
+	uploadURL += req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		uploadURL += "?" + req.URL.RawQuery
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(metaBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request upload URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upload URL rejected: %w", apiError(resp))
+	}
+
+	var result uploadURLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode upload URL response: %w", err)
+	}
+	if result.RequestID == "" {
+		return nil, fmt.Errorf("upload URL response is missing request_id")
+	}
+	switch result.Method {
+	case uploadMethodMultipart:
+		if result.PartSize <= 0 || len(result.PartURLs) == 0 || result.CompleteURL == "" {
+			return nil, fmt.Errorf("multipart upload response is missing part_size, part_urls or complete_url")
+		}
+	case "", uploadMethodPut, uploadMethodPost:
+		if result.UploadURL == "" {
+			return nil, fmt.Errorf("upload URL response is missing upload_url")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upload_method %q", result.Method)
+	}
+	if result.PollURL == "" {
+		result.PollURL = "/poll/" + result.RequestID
+	}
+	return &result, nil
+}
+
+// upload PUTs the body to its presigned S3 URL with the headers S3 signed,
+// which include the body's type and may pin its length and checksum
+func (c *Client) upload(ctx context.Context, upload *uploadURLResponse, body io.Reader, length int64) error {
+	if body == nil {
+		body = http.NoBody
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, upload.UploadURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	httpReq.ContentLength = length
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	for name, value := range upload.Headers {
+		if strings.EqualFold(name, "Content-Length") {
+			if value != strconv.FormatInt(length, 10) {
+				return fmt.Errorf("upload was signed for %s bytes, body has %d", value, length)
+			}
+			continue
+		}
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to upload body: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("upload failed (status %d): %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// uploadForm POSTs the body to its presigned S3 URL as a multipart/form-data
+// form: upload_fields, which carry the signed policy, then the body as the
+// "file" field, which S3 requires last. The form's length is known up front,
+// as S3 does not take chunked uploads.
+func (c *Client) uploadForm(ctx context.Context, upload *uploadURLResponse, body io.Reader, length int64) error {
+	if body == nil {
+		body = http.NoBody
+	}
+
+	var head bytes.Buffer
+	form := multipart.NewWriter(&head)
+	names := make([]string, 0, len(upload.Fields))
+	for name := range upload.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := form.WriteField(name, upload.Fields[name]); err != nil {
+			return fmt.Errorf("failed to build upload form: %w", err)
+		}
+	}
+	if _, err := form.CreateFormFile("file", "body"); err != nil {
+		return fmt.Errorf("failed to build upload form: %w", err)
+	}
+	tail := "\r\n--" + form.Boundary() + "--\r\n"
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL,
+		io.MultiReader(&head, body, strings.NewReader(tail)))
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	httpReq.ContentLength = int64(head.Len()) + length + int64(len(tail))
+	httpReq.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to upload body: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("upload failed (status %d): %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// uploadParts PUTs the body to the part URLs in pieces of part_size bytes,
+// the last one shorter, as each URL was signed for its piece's length. The
+// upload is then completed with the ETags S3 returned for the parts.
+func (c *Client) uploadParts(ctx context.Context, upload *uploadURLResponse, body io.Reader, length int64) error {
+	if want := (length + upload.PartSize - 1) / upload.PartSize; int64(len(upload.PartURLs)) != want {
+		return fmt.Errorf("got %d part URLs for %d parts", len(upload.PartURLs), want)
+	}
+
+	parts := make([]completedPart, 0, len(upload.PartURLs))
+	for i, partURL := range upload.PartURLs {
+		size := min(upload.PartSize, length-int64(i)*upload.PartSize)
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, partURL, io.LimitReader(body, size))
+		if err != nil {
+			return fmt.Errorf("failed to create part upload request: %w", err)
+		}
+		httpReq.ContentLength = size
+
+		resp, err := c.HTTPClient.Do(httpReq)
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", i+1, err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("upload of part %d failed (status %d): %s", i+1, resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return fmt.Errorf("upload of part %d returned no ETag", i+1)
+		}
+		parts = append(parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	return c.completeUpload(ctx, upload.CompleteURL, parts)
+}
+
+// completeUpload posts the ETags of the uploaded parts to complete_url, which
+// assembles the body and sends the request on to the tunnel
+func (c *Client) completeUpload(ctx context.Context, completeURL string, parts []completedPart) error {
+	payload, err := json.Marshal(map[string][]completedPart{"parts": parts})
+	if err != nil {
+		return fmt.Errorf("failed to marshal completed parts: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.resolve(completeURL), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create complete request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload completion rejected: %w", apiError(resp))
+	}
+	return nil
+}
+
+// resolve makes a URL returned by http-proxy absolute; relative ones are on
+// the Client's BaseURL
+func (c *Client) resolve(u string) string {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return u
+	}
+	return c.BaseURL + u
+}
+
+// poll fetches the response until it is no longer 202 Accepted, backing off
+// between polls. A few polls in a row may fail in transit.
+func (c *Client) poll(ctx context.Context, upload *uploadURLResponse) (*http.Response, error) {
+	pollURL := c.resolve(upload.PollURL)
+
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	maxInterval := c.MaxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultMaxPollInterval
+	}
+	maxInterval = max(maxInterval, interval)
+
+	errorsInRow := 0
+	for {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, pollURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create poll request: %w", err)
+		}
+
+		resp, err := c.HTTPClient.Do(httpReq)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("request %s: %w", upload.RequestID, ctx.Err())
+			}
+			if errorsInRow++; errorsInRow >= maxPollErrors {
+				return nil, fmt.Errorf("request %s: failed to poll: %w", upload.RequestID, err)
+			}
+		case resp.StatusCode == http.StatusAccepted:
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			errorsInRow = 0
+		default:
+			return resp, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("request %s: %w", upload.RequestID, ctx.Err())
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, maxInterval)
+	}
+}
+
+// apiError describes an error response of the tunnel service
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error == "" {
+		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return fmt.Errorf("API error (status %d): %s", resp.StatusCode, errResp.Error)
+}
@@ -0,0 +1,288 @@
+package tunnelclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeProxy plays http-proxy and S3 for one request: target is the upload
+// part of the /upload-url response (upload_method and what goes with it),
+// with {{base}} replaced by the server's URL
+type fakeProxy struct {
+	*httptest.Server
+	t      *testing.T
+	target map[string]any
+
+	mu       sync.Mutex
+	meta     uploadURLRequest
+	uploaded map[string]*http.Request // by path
+	bodies   map[string]string
+	fields   map[string]string // of a form POST
+	complete []completedPart
+}
+
+func newFakeProxy(t *testing.T, target map[string]any) *fakeProxy {
+	f := &fakeProxy{t: t, target: target, uploaded: map[string]*http.Request{}, bodies: map[string]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeProxy) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload-url/"):
+		if err := json.NewDecoder(r.Body).Decode(&f.meta); err != nil {
+			f.t.Errorf("upload-url metadata: %v", err)
+		}
+		resp := map[string]any{"request_id": "req-1", "poll_url": "/poll/req-1"}
+		for name, value := range f.target {
+			resp[name] = expand(value, f.URL)
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case strings.HasPrefix(r.URL.Path, "/s3/"):
+		body, _ := io.ReadAll(r.Body)
+		f.uploaded[r.URL.Path] = r
+		f.bodies[r.URL.Path] = string(body)
+		if int64(len(body)) != r.ContentLength {
+			f.t.Errorf("%s: got %d bytes, Content-Length %d", r.URL.Path, len(body), r.ContentLength)
+		}
+		w.Header().Set("ETag", fmt.Sprintf("%q", "etag-"+strings.TrimPrefix(r.URL.Path, "/s3/")))
+		if r.Method == http.MethodPost {
+			f.readForm(r, body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case r.URL.Path == "/upload-complete/req-1":
+		var body struct {
+			Parts []completedPart `json:"parts"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.complete = body.Parts
+		json.NewEncoder(w).Encode(map[string]string{"request_id": "req-1", "poll_url": "/poll/req-1"})
+
+	case r.URL.Path == "/poll/req-1":
+		io.WriteString(w, "done")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// readForm records the fields of a form POST, and its file as the body
+func (f *fakeProxy) readForm(r *http.Request, body []byte) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		f.t.Errorf("form Content-Type: %v", err)
+		return
+	}
+	f.fields = map[string]string{}
+	form := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	seenFile := false
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			f.t.Errorf("form: %v", err)
+			return
+		}
+		value, _ := io.ReadAll(part)
+		if part.FormName() == "file" {
+			f.bodies[r.URL.Path] = string(value)
+			seenFile = true
+			continue
+		}
+		if seenFile {
+			f.t.Errorf("field %s after the file", part.FormName())
+		}
+		f.fields[part.FormName()] = string(value)
+	}
+}
+
+// expand replaces {{base}} in the strings of v
+func expand(v any, base string) any {
+	switch v := v.(type) {
+	case string:
+		return strings.ReplaceAll(v, "{{base}}", base)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = strings.ReplaceAll(s, "{{base}}", base)
+		}
+		return out
+	}
+	return v
+}
+
+func TestDoMultipart(t *testing.T) {
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method": "MULTIPART",
+		"upload_id":     "upload-1",
+		"part_size":     4,
+		"part_urls":     []string{"{{base}}/s3/1", "{{base}}/s3/2", "{{base}}/s3/3"},
+		"complete_url":  "/upload-complete/req-1",
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", strings.NewReader("0123456789"))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "done" {
+		t.Errorf("response = %q, want the polled response", body)
+	}
+
+	if proxy.meta.Constraints == nil || proxy.meta.Constraints.Size != 10 {
+		t.Errorf("constraints = %+v, want the body's size", proxy.meta.Constraints)
+	}
+	for path, want := range map[string]string{"/s3/1": "0123", "/s3/2": "4567", "/s3/3": "89"} {
+		if got := proxy.bodies[path]; got != want {
+			t.Errorf("part %s = %q, want %q", path, got, want)
+		}
+	}
+	want := []completedPart{{1, `"etag-1"`}, {2, `"etag-2"`}, {3, `"etag-3"`}}
+	if fmt.Sprint(proxy.complete) != fmt.Sprint(want) {
+		t.Errorf("completed parts = %v, want %v", proxy.complete, want)
+	}
+}
+
+func TestDoMultipartPartCountMismatch(t *testing.T) {
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method": "MULTIPART",
+		"part_size":     4,
+		"part_urls":     []string{"{{base}}/s3/1"},
+		"complete_url":  "/upload-complete/req-1",
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", strings.NewReader("0123456789"))
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("Do uploaded 10 bytes to a single 4-byte part")
+	}
+	if proxy.complete != nil {
+		t.Errorf("completed an upload with missing parts")
+	}
+}
+
+func TestDoPutWithSignedHeaders(t *testing.T) {
+	sum := sha256.Sum256([]byte("0123456789"))
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method": "PUT",
+		"upload_url":    "{{base}}/s3/body",
+		"upload_headers": map[string]string{
+			"Content-Type":          "audio/wav",
+			"Content-Length":        "10",
+			"x-amz-checksum-sha256": "c2lnbmVk",
+		},
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", strings.NewReader("0123456789"))
+	req.Header.Set("Content-Type", "audio/wav")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	want := uploadConstraints{Size: 10, ContentType: "audio/wav", Checksum: true}
+	if proxy.meta.Constraints == nil || *proxy.meta.Constraints != want {
+		t.Errorf("constraints = %+v, want %+v", proxy.meta.Constraints, want)
+	}
+	if proxy.meta.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 = %q, want the body's", proxy.meta.SHA256)
+	}
+	put := proxy.uploaded["/s3/body"]
+	if put == nil {
+		t.Fatal("body was not uploaded")
+	}
+	if put.Method != http.MethodPut || put.Header.Get("Content-Type") != "audio/wav" || put.Header.Get("X-Amz-Checksum-Sha256") != "c2lnbmVk" {
+		t.Errorf("uploaded with %s %v, want a PUT with the signed headers", put.Method, put.Header)
+	}
+	if proxy.bodies["/s3/body"] != "0123456789" {
+		t.Errorf("uploaded %q", proxy.bodies["/s3/body"])
+	}
+}
+
+func TestDoPutSignedForAnotherLength(t *testing.T) {
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method":  "PUT",
+		"upload_url":     "{{base}}/s3/body",
+		"upload_headers": map[string]string{"Content-Length": "3"},
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", strings.NewReader("0123456789"))
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("Do uploaded a body of another length than was signed")
+	}
+	if proxy.uploaded["/s3/body"] != nil {
+		t.Error("body was uploaded")
+	}
+}
+
+func TestDoFormPost(t *testing.T) {
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method": "POST",
+		"upload_url":    "{{base}}/s3/form",
+		"upload_fields": map[string]string{
+			"key":          "requests/req-1/body",
+			"policy":       "cG9saWN5",
+			"Content-Type": "application/octet-stream",
+		},
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	// Unknown length: the body is read first
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", io.NopCloser(strings.NewReader("0123456789")))
+	req.ContentLength = -1
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if proxy.bodies["/s3/form"] != "0123456789" {
+		t.Errorf("file = %q, want the body", proxy.bodies["/s3/form"])
+	}
+	if proxy.fields["key"] != "requests/req-1/body" || proxy.fields["policy"] != "cG9saWN5" || len(proxy.fields) != 3 {
+		t.Errorf("fields = %v, want upload_fields", proxy.fields)
+	}
+}
+
+func TestDoUnknownUploadMethod(t *testing.T) {
+	proxy := newFakeProxy(t, map[string]any{
+		"upload_method": "CARRIER_PIGEON",
+		"upload_url":    "{{base}}/s3/body",
+	})
+	c := New(proxy.URL)
+	c.Subdomain = "myapp"
+
+	req, _ := http.NewRequest(http.MethodPost, "/transcribe", strings.NewReader("0123456789"))
+	if _, err := c.Do(req); err == nil || !strings.Contains(err.Error(), "CARRIER_PIGEON") {
+		t.Fatalf("Do = %v, want an unsupported upload_method error", err)
+	}
+}
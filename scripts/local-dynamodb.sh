@@ -0,0 +1,149 @@
+#!/bin/bash
+set -e
+
+# Runs DynamoDB Local in Docker with the same tables as infra/dynamodb.tf, so
+# Lambda handlers and integration tests can run without an AWS account.
+#
+#   scripts/local-dynamodb.sh start   # start the container and create the tables
+#   scripts/local-dynamodb.sh stop    # remove the container (and its data)
+#   scripts/local-dynamodb.sh env     # print the environment for the Lambdas
+#
+# Set DYNAMODB_ENDPOINT to target LocalStack or an already running instance.
+
+# Colors for output
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+CONTAINER="tunnel-dynamodb-local"
+PORT="${DYNAMODB_LOCAL_PORT:-8000}"
+ENDPOINT="${DYNAMODB_ENDPOINT:-http://localhost:$PORT}"
+PROJECT="tunnel"
+ENVIRONMENT="dev"
+
+# DynamoDB Local accepts any credentials
+export AWS_ACCESS_KEY_ID=local
+export AWS_SECRET_ACCESS_KEY=local
+export AWS_DEFAULT_REGION=us-east-1
+
+table() {
+    echo "${PROJECT}-$1-${ENVIRONMENT}"
+}
+
+ddb() {
+    aws dynamodb --endpoint-url "$ENDPOINT" --no-cli-pager "$@"
+}
+
+create_table() {
+    local name
+    name=$(table "$1")
+    shift
+    if ddb describe-table --table-name "$name" >/dev/null 2>&1; then
+        echo "  $name (exists)"
+        return
+    fi
+    ddb create-table --table-name "$name" --billing-mode PAY_PER_REQUEST "$@" >/dev/null
+    echo "  $name"
+}
+
+create_tables() {
+    echo -e "${GREEN}Creating tables at $ENDPOINT${NC}"
+
+    create_table clients \
+        --attribute-definitions AttributeName=client_id,AttributeType=S \
+        --key-schema AttributeName=client_id,KeyType=HASH
+
+    create_table tunnels \
+        --attribute-definitions \
+            AttributeName=tunnel_id,AttributeType=S \
+            AttributeName=client_id,AttributeType=S \
+            AttributeName=connection_id,AttributeType=S \
+        --key-schema AttributeName=tunnel_id,KeyType=HASH \
+        --global-secondary-indexes \
+            'IndexName=client_id-index,KeySchema=[{AttributeName=client_id,KeyType=HASH}],Projection={ProjectionType=ALL}' \
+            'IndexName=connection_id-index,KeySchema=[{AttributeName=connection_id,KeyType=HASH}],Projection={ProjectionType=ALL}'
+
+    create_table domains \
+        --attribute-definitions AttributeName=domain,AttributeType=S \
+        --key-schema AttributeName=domain,KeyType=HASH
+
+    create_table released-domains \
+        --attribute-definitions AttributeName=domain,AttributeType=S \
+        --key-schema AttributeName=domain,KeyType=HASH
+
+    create_table pending-requests \
+        --attribute-definitions \
+            AttributeName=request_id,AttributeType=S \
+            AttributeName=tunnel_id,AttributeType=S \
+            AttributeName=created_at,AttributeType=S \
+        --key-schema AttributeName=request_id,KeyType=HASH \
+        --global-secondary-indexes \
+            'IndexName=tunnel_id-index,KeySchema=[{AttributeName=tunnel_id,KeyType=HASH},{AttributeName=created_at,KeyType=RANGE}],Projection={ProjectionType=INCLUDE,NonKeyAttributes=[status,method,path]}'
+
+    create_table stream-chunks \
+        --attribute-definitions AttributeName=request_id,AttributeType=S AttributeName=seq,AttributeType=N \
+        --key-schema AttributeName=request_id,KeyType=HASH AttributeName=seq,KeyType=RANGE
+
+    create_table tunnel-events \
+        --attribute-definitions AttributeName=tunnel_id,AttributeType=S AttributeName=event_id,AttributeType=S \
+        --key-schema AttributeName=tunnel_id,KeyType=HASH AttributeName=event_id,KeyType=RANGE
+
+    create_table request-log \
+        --attribute-definitions AttributeName=tunnel_id,AttributeType=S AttributeName=log_id,AttributeType=S \
+        --key-schema AttributeName=tunnel_id,KeyType=HASH AttributeName=log_id,KeyType=RANGE
+
+    create_table request-stats \
+        --attribute-definitions AttributeName=tunnel_id,AttributeType=S AttributeName=hour,AttributeType=N \
+        --key-schema AttributeName=tunnel_id,KeyType=HASH AttributeName=hour,KeyType=RANGE
+
+    create_table rate-limits \
+        --attribute-definitions AttributeName=limit_key,AttributeType=S \
+        --key-schema AttributeName=limit_key,KeyType=HASH
+}
+
+print_env() {
+    cat <<EOF
+export DYNAMODB_ENDPOINT=$ENDPOINT
+export DYNAMODB_STATIC_CREDENTIALS=true
+export CLIENTS_TABLE=$(table clients)
+export TUNNELS_TABLE=$(table tunnels)
+export DOMAINS_TABLE=$(table domains)
+export RELEASED_DOMAINS_TABLE=$(table released-domains)
+export PENDING_REQUESTS_TABLE=$(table pending-requests)
+export STREAM_CHUNKS_TABLE=$(table stream-chunks)
+export EVENTS_TABLE=$(table tunnel-events)
+export REQUEST_LOG_TABLE=$(table request-log)
+export REQUEST_STATS_TABLE=$(table request-stats)
+export RATE_LIMITS_TABLE=$(table rate-limits)
+EOF
+}
+
+case "${1:-start}" in
+    start)
+        if [ -z "$DYNAMODB_ENDPOINT" ]; then
+            if ! docker ps --format '{{.Names}}' | grep -q "^${CONTAINER}$"; then
+                echo -e "${GREEN}Starting DynamoDB Local on port $PORT${NC}"
+                docker run -d --rm --name "$CONTAINER" -p "$PORT:8000" amazon/dynamodb-local >/dev/null
+            fi
+            # Wait for the container to accept requests
+            for _ in $(seq 1 30); do
+                ddb list-tables >/dev/null 2>&1 && break
+                sleep 1
+            done
+        fi
+        create_tables
+        echo ""
+        echo -e "${YELLOW}Point the Lambdas at it with:${NC} eval \"\$($0 env)\""
+        ;;
+    stop)
+        docker rm -f "$CONTAINER" >/dev/null 2>&1 || true
+        echo -e "${GREEN}✓ DynamoDB Local stopped${NC}"
+        ;;
+    env)
+        print_env
+        ;;
+    *)
+        echo "Usage: $0 [start|stop|env]"
+        exit 1
+        ;;
+esac
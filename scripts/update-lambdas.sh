@@ -21,12 +21,26 @@ FUNCTIONS=(
     "create-tunnel:tunnel-create-tunnel-dev"
     "delete-tunnel:tunnel-delete-tunnel-dev"
     "list-tunnels:tunnel-list-tunnels-dev"
+    "list-tunnel-events:tunnel-list-tunnel-events-dev"
+    "tunnel-stats:tunnel-tunnel-stats-dev"
+    "create-connection-token:tunnel-create-connection-token-dev"
+    "create-access-token:tunnel-create-access-token-dev"
+    "revoke-access-token:tunnel-revoke-access-token-dev"
+    "get-client:tunnel-get-client-dev"
+    "delete-client:tunnel-delete-client-dev"
+    "billing-portal:tunnel-billing-portal-dev"
+    "stripe-webhook:tunnel-stripe-webhook-dev"
+    "get-openapi:tunnel-get-openapi-dev"
     "authorize-connection:tunnel-authorize-connection-dev"
     "tunnel-connect:tunnel-tunnel-connect-dev"
     "tunnel-disconnect:tunnel-tunnel-disconnect-dev"
     "tunnel-proxy:tunnel-tunnel-proxy-dev"
     "http-proxy:tunnel-http-proxy-dev"
     "s3-upload-notify:tunnel-s3-upload-notify-dev"
+    "s3-upload-failed:tunnel-s3-upload-failed-dev"
+    "redeliver-request:tunnel-redeliver-request-dev"
+    "reap-stale-tunnels:tunnel-reap-stale-tunnels-dev"
+    "report-usage:tunnel-report-usage-dev"
 )
 
 echo -e "${GREEN}Deploying Lambda functions to AWS${NC}"